@@ -27,7 +27,9 @@ import (
 	"strings"
 
 	"github.com/holiman/uint256"
+	"go.uber.org/atomic"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/ledgerwatch/log/v3"
 
@@ -44,7 +46,7 @@ type keccakState interface {
 }
 
 // HexPatriciaHashed implements commitment based on patricia merkle tree with radix 16,
-// with keys pre-hashed by keccak256
+// with keys pre-hashed by Scheme's key hasher (keccak256 by default)
 type HexPatriciaHashed struct {
 	root Cell // Root cell of the tree
 	// How many rows (starting from row 0) are currently active and have corresponding selected columns
@@ -64,6 +66,8 @@ type HexPatriciaHashed struct {
 	afterMap     [128]uint16   // For each row, bitmap of cells that were present after modification
 	keccak       keccakState
 	keccak2      keccakState
+	keyHasher    hash.Hash // hashes plain keys into trie paths, see Scheme
+	scheme       Scheme
 	rootChecked  bool // Set to false if it is not known whether the root is empty, set to true if it is checked
 	rootTouched  bool
 	rootPresent  bool
@@ -79,6 +83,10 @@ type HexPatriciaHashed struct {
 
 	hashAuxBuffer [128]byte     // buffer to compute cell hash or write hash-related things
 	auxBuffer     *bytes.Buffer // auxiliary buffer used during branch updates encoding
+
+	storageBatchMin     int                  // see SetStorageBatching
+	storageBatchWorkers int                  // see SetStorageBatching
+	subTries            []*HexPatriciaHashed // per-worker tries of storage batches
 }
 
 // represents state of the tree
@@ -103,6 +111,8 @@ func NewHexPatriciaHashed(accountKeyLen int,
 	return &HexPatriciaHashed{
 		keccak:        sha3.NewLegacyKeccak256().(keccakState),
 		keccak2:       sha3.NewLegacyKeccak256().(keccakState),
+		keyHasher:     EthereumScheme.NewKeyHasher(),
+		scheme:        EthereumScheme,
 		accountKeyLen: accountKeyLen,
 		branchFn:      branchFn,
 		accountFn:     accountFn,
@@ -126,7 +136,9 @@ type Cell struct {
 	h             [length.Hash]byte               // cell hash
 	CodeHash      [length.Hash]byte               // hash of the bytecode
 	Storage       [length.Hash]byte
-	apk           [length.Addr]byte // account plain key
+	apk           [length.Addr]byte        // account plain key
+	Extra         [MaxAccountExtraLen]byte // chain-specific account fields, see AccountEncoder
+	ExtraLen      int
 	Delete        bool
 }
 
@@ -144,6 +156,7 @@ func (cell *Cell) fillEmpty() {
 	cell.Nonce = 0
 	cell.Balance.Clear()
 	copy(cell.CodeHash[:], EmptyCodeHash)
+	cell.ExtraLen = 0
 	cell.StorageLen = 0
 	cell.Delete = false
 }
@@ -172,6 +185,7 @@ func (cell *Cell) fillFromUpperCell(upCell *Cell, depth, depthIncrement int) {
 			cell.Balance.Set(&upCell.Balance)
 			cell.Nonce = upCell.Nonce
 			copy(cell.CodeHash[:], upCell.CodeHash[:])
+			cell.SetAccountExtra(upCell.Extra[:upCell.ExtraLen])
 			cell.extLen = upCell.extLen
 			if upCell.extLen > 0 {
 				copy(cell.extension[:], upCell.extension[:upCell.extLen])
@@ -203,6 +217,7 @@ func (cell *Cell) fillFromLowerCell(lowCell *Cell, lowDepth int, preExtension []
 		cell.Balance.Set(&lowCell.Balance)
 		cell.Nonce = lowCell.Nonce
 		copy(cell.CodeHash[:], lowCell.CodeHash[:])
+		cell.SetAccountExtra(lowCell.Extra[:lowCell.ExtraLen])
 	}
 	cell.spl = lowCell.spl
 	if lowCell.spl > 0 {
@@ -237,15 +252,19 @@ func (cell *Cell) fillFromLowerCell(lowCell *Cell, lowDepth int, preExtension []
 	}
 }
 
-func hashKey(keccak keccakState, plainKey []byte, dest []byte, hashedKeyOffset int) error {
-	keccak.Reset()
+func hashKey(hasher hash.Hash, plainKey []byte, dest []byte, hashedKeyOffset int) error {
+	hasher.Reset()
 	var hashBufBack [length.Hash]byte
 	hashBuf := hashBufBack[:]
-	if _, err := keccak.Write(plainKey); err != nil {
+	if _, err := hasher.Write(plainKey); err != nil {
 		return err
 	}
-	if _, err := keccak.Read(hashBuf); err != nil {
-		return err
+	if keccak, ok := hasher.(keccakState); ok {
+		if _, err := keccak.Read(hashBuf); err != nil {
+			return err
+		}
+	} else {
+		hashBuf = hasher.Sum(hashBuf[:0])
 	}
 	hashBuf = hashBuf[hashedKeyOffset/2:]
 	var k int
@@ -263,7 +282,7 @@ func hashKey(keccak keccakState, plainKey []byte, dest []byte, hashedKeyOffset i
 	return nil
 }
 
-func (cell *Cell) deriveHashedKeys(depth int, keccak keccakState, accountKeyLen int) error {
+func (cell *Cell) deriveHashedKeys(depth int, keyHasher hash.Hash, accountKeyLen int) error {
 	extraLen := 0
 	if cell.apl > 0 {
 		if depth > 64 {
@@ -285,7 +304,7 @@ func (cell *Cell) deriveHashedKeys(depth int, keccak keccakState, accountKeyLen
 		cell.downHashedLen += extraLen
 		var hashedKeyOffset, downOffset int
 		if cell.apl > 0 {
-			if err := hashKey(keccak, cell.apk[:cell.apl], cell.downHashedKey[:], depth); err != nil {
+			if err := hashKey(keyHasher, cell.apk[:cell.apl], cell.downHashedKey[:], depth); err != nil {
 				return err
 			}
 			downOffset = 64 - depth
@@ -294,7 +313,7 @@ func (cell *Cell) deriveHashedKeys(depth int, keccak keccakState, accountKeyLen
 			if depth >= 64 {
 				hashedKeyOffset = depth - 64
 			}
-			if err := hashKey(keccak, cell.spk[accountKeyLen:cell.spl], cell.downHashedKey[downOffset:], hashedKeyOffset); err != nil {
+			if err := hashKey(keyHasher, cell.spk[accountKeyLen:cell.spl], cell.downHashedKey[downOffset:], hashedKeyOffset); err != nil {
 				return err
 			}
 		}
@@ -399,6 +418,11 @@ func (cell *Cell) setAccountFields(codeHash []byte, balance *uint256.Int, nonce
 	cell.Nonce = nonce
 }
 
+// SetAccountExtra - chain-specific account fields (see Scheme.DecodeAccountExtra), extra longer than MaxAccountExtraLen is truncated
+func (cell *Cell) SetAccountExtra(extra []byte) {
+	cell.ExtraLen = copy(cell.Extra[:], extra)
+}
+
 func (cell *Cell) accountForHashing(buffer []byte, storageRootHash [length.Hash]byte) int {
 	balanceBytes := 0
 	if !cell.Balance.LtUint64(128) {
@@ -674,7 +698,7 @@ func (hph *HexPatriciaHashed) computeCellHash(cell *Cell, depth int, buf []byte)
 			hashedKeyOffset = depth - 64
 		}
 		singleton := depth <= 64
-		if err := hashKey(hph.keccak, cell.spk[hph.accountKeyLen:cell.spl], cell.downHashedKey[:], hashedKeyOffset); err != nil {
+		if err := hashKey(hph.keyHasher, cell.spk[hph.accountKeyLen:cell.spl], cell.downHashedKey[:], hashedKeyOffset); err != nil {
 			return nil, err
 		}
 		cell.downHashedKey[64-hashedKeyOffset] = 16 // Add terminator
@@ -696,7 +720,7 @@ func (hph *HexPatriciaHashed) computeCellHash(cell *Cell, depth int, buf []byte)
 		}
 	}
 	if cell.apl > 0 {
-		if err := hashKey(hph.keccak, cell.apk[:cell.apl], cell.downHashedKey[:], depth); err != nil {
+		if err := hashKey(hph.keyHasher, cell.apk[:cell.apl], cell.downHashedKey[:], depth); err != nil {
 			return nil, err
 		}
 		cell.downHashedKey[64-depth] = 16 // Add terminator
@@ -719,12 +743,12 @@ func (hph *HexPatriciaHashed) computeCellHash(cell *Cell, depth int, buf []byte)
 				storageRootHash = *(*[length.Hash]byte)(EmptyRootHash)
 			}
 		}
-		var valBuf [128]byte
-		valLen := cell.accountForHashing(valBuf[:], storageRootHash)
+		var valBuf [128 + MaxAccountExtraLen]byte
+		val := hph.scheme.EncodeAccount(valBuf[:0], cell, storageRootHash)
 		if hph.trace {
-			fmt.Printf("accountLeafHashWithKey for [%x]=>[%x]\n", hph.hashAuxBuffer[:65-depth], valBuf[:valLen])
+			fmt.Printf("accountLeafHashWithKey for [%x]=>[%x]\n", hph.hashAuxBuffer[:65-depth], val)
 		}
-		return hph.accountLeafHashWithKey(buf, cell.downHashedKey[:65-depth], rlp.RlpEncodedBytes(valBuf[:valLen]))
+		return hph.accountLeafHashWithKey(buf, cell.downHashedKey[:65-depth], rlp.RlpEncodedBytes(val))
 	}
 	buf = append(buf, 0x80+32)
 	if cell.extLen > 0 {
@@ -849,7 +873,7 @@ func (hph *HexPatriciaHashed) unfoldBranchNode(row int, deleted bool, depth int)
 		if cell.spl > 0 {
 			hph.storageFn(cell.spk[:cell.spl], cell)
 		}
-		if err = cell.deriveHashedKeys(depth, hph.keccak, hph.accountKeyLen); err != nil {
+		if err = cell.deriveHashedKeys(depth, hph.keyHasher, hph.accountKeyLen); err != nil {
 			return false, err
 		}
 		bitset ^= bit
@@ -1202,6 +1226,7 @@ func (hph *HexPatriciaHashed) deleteCell(hashedKey []byte) {
 	cell.Balance.Clear()
 	copy(cell.CodeHash[:], EmptyCodeHash)
 	cell.Nonce = 0
+	cell.ExtraLen = 0
 }
 
 func (hph *HexPatriciaHashed) updateCell(plainKey, hashedKey []byte) *Cell {
@@ -1283,6 +1308,7 @@ func (hph *HexPatriciaHashed) ReviewKeys(plainKeys, hashedKeys [][]byte) (rootHa
 			if !stagedCell.Delete {
 				cell := hph.updateCell(plainKey, hashedKey)
 				cell.setAccountFields(stagedCell.CodeHash[:], &stagedCell.Balance, stagedCell.Nonce)
+				cell.SetAccountExtra(stagedCell.Extra[:stagedCell.ExtraLen])
 
 				if hph.trace {
 					fmt.Printf("accountFn reading key %x => balance=%v nonce=%v codeHash=%x\n", cell.apk, cell.Balance.Uint64(), cell.Nonce, cell.CodeHash)
@@ -1327,6 +1353,22 @@ func (hph *HexPatriciaHashed) SetTrace(trace bool) { hph.trace = trace }
 
 func (hph *HexPatriciaHashed) Variant() TrieVariant { return VariantHexPatriciaTrie }
 
+func (hph *HexPatriciaHashed) Scheme() Scheme { return hph.scheme }
+
+// SetScheme - changes key hashing and account serialization. Must be called before any keys are processed:
+// trie data built with one scheme can't be continued with another.
+func (hph *HexPatriciaHashed) SetScheme(s Scheme) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if hph.activeRows != 0 {
+		return fmt.Errorf("has active rows, could not change scheme")
+	}
+	hph.scheme = s
+	hph.keyHasher = s.NewKeyHasher()
+	return nil
+}
+
 // Reset allows HexPatriciaHashed instance to be reused for the new commitment calculation
 func (hph *HexPatriciaHashed) Reset() {
 	hph.rootChecked = false
@@ -1339,6 +1381,7 @@ func (hph *HexPatriciaHashed) Reset() {
 	hph.root.StorageLen = 0
 	hph.root.Balance.Clear()
 	hph.root.Nonce = 0
+	hph.root.ExtraLen = 0
 	hph.rootTouched = false
 	hph.rootPresent = true
 }
@@ -1721,65 +1764,21 @@ func commonPrefixLen(b1, b2 []byte) int {
 func (hph *HexPatriciaHashed) ProcessUpdates(plainKeys, hashedKeys [][]byte, updates []Update) (rootHash []byte, branchNodeUpdates map[string]BranchData, err error) {
 	branchNodeUpdates = make(map[string]BranchData)
 
-	for i, plainKey := range plainKeys {
-		hashedKey := hashedKeys[i]
-		if hph.trace {
-			fmt.Printf("plainKey=[%x], hashedKey=[%x], currentKey=[%x]\n", plainKey, hashedKey, hph.currentKey[:hph.currentKeyLen])
-		}
-		// Keep folding until the currentKey is the prefix of the key we modify
-		for hph.needFolding(hashedKey) {
-			if branchData, updateKey, err := hph.fold(); err != nil {
-				return nil, nil, fmt.Errorf("fold: %w", err)
-			} else if branchData != nil {
-				branchNodeUpdates[string(updateKey)] = branchData
-			}
-		}
-		// Now unfold until we step on an empty cell
-		for unfolding := hph.needUnfolding(hashedKey); unfolding > 0; unfolding = hph.needUnfolding(hashedKey) {
-			if err := hph.unfold(hashedKey, unfolding); err != nil {
-				return nil, nil, fmt.Errorf("unfold: %w", err)
+	batches, err := hph.processStorageBatches(plainKeys, hashedKeys, updates)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < len(plainKeys); i++ {
+		if len(batches) > 0 && batches[0].from == i {
+			if err = hph.applyStorageBatch(&batches[0], plainKeys[i], hashedKeys[i][:2*length.Hash], branchNodeUpdates); err != nil {
+				return nil, nil, err
 			}
+			i = batches[0].to - 1
+			batches = batches[1:]
+			continue
 		}
-
-		update := updates[i]
-		// Update the cell
-		if update.Flags == DELETE_UPDATE {
-			hph.deleteCell(hashedKey)
-			if hph.trace {
-				fmt.Printf("key %x deleted\n", plainKey)
-			}
-		} else {
-			cell := hph.updateCell(plainKey, hashedKey)
-			if hph.trace {
-				fmt.Printf("accountFn updated key %x =>", plainKey)
-			}
-			if update.Flags&BALANCE_UPDATE != 0 {
-				if hph.trace {
-					fmt.Printf(" balance=%d", update.Balance.Uint64())
-				}
-				cell.Balance.Set(&update.Balance)
-			}
-			if update.Flags&NONCE_UPDATE != 0 {
-				if hph.trace {
-					fmt.Printf(" nonce=%d", update.Nonce)
-				}
-				cell.Nonce = update.Nonce
-			}
-			if update.Flags&CODE_UPDATE != 0 {
-				if hph.trace {
-					fmt.Printf(" codeHash=%x", update.CodeHashOrStorage)
-				}
-				copy(cell.CodeHash[:], update.CodeHashOrStorage[:])
-			}
-			if hph.trace {
-				fmt.Printf("\n")
-			}
-			if update.Flags&STORAGE_UPDATE != 0 {
-				cell.setStorage(update.CodeHashOrStorage[:update.ValLength])
-				if hph.trace {
-					fmt.Printf("\rstorageFn filled key %x => %x\n", plainKey, update.CodeHashOrStorage[:update.ValLength])
-				}
-			}
+		if err = hph.followAndUpdate(plainKeys[i], hashedKeys[i], &updates[i], branchNodeUpdates); err != nil {
+			return nil, nil, err
 		}
 	}
 	// Folding everything up to the root
@@ -1798,20 +1797,256 @@ func (hph *HexPatriciaHashed) ProcessUpdates(plainKeys, hashedKeys [][]byte, upd
 	return rootHash, branchNodeUpdates, nil
 }
 
-// nolint
-// Hashes provided key and expands resulting hash into nibbles (each byte split into two nibbles by 4 bits)
-func (hph *HexPatriciaHashed) hashAndNibblizeKey(key []byte) []byte {
+// followKey folds and unfolds the grid until the cell of hashedKey is reachable
+func (hph *HexPatriciaHashed) followKey(hashedKey []byte, branchNodeUpdates map[string]BranchData) error {
+	// Keep folding until the currentKey is the prefix of the key we modify
+	for hph.needFolding(hashedKey) {
+		if branchData, updateKey, err := hph.fold(); err != nil {
+			return fmt.Errorf("fold: %w", err)
+		} else if branchData != nil {
+			branchNodeUpdates[string(updateKey)] = branchData
+		}
+	}
+	// Now unfold until we step on an empty cell
+	for unfolding := hph.needUnfolding(hashedKey); unfolding > 0; unfolding = hph.needUnfolding(hashedKey) {
+		if err := hph.unfold(hashedKey, unfolding); err != nil {
+			return fmt.Errorf("unfold: %w", err)
+		}
+	}
+	return nil
+}
+
+func (hph *HexPatriciaHashed) followAndUpdate(plainKey, hashedKey []byte, update *Update, branchNodeUpdates map[string]BranchData) error {
+	if hph.trace {
+		fmt.Printf("plainKey=[%x], hashedKey=[%x], currentKey=[%x]\n", plainKey, hashedKey, hph.currentKey[:hph.currentKeyLen])
+	}
+	if err := hph.followKey(hashedKey, branchNodeUpdates); err != nil {
+		return err
+	}
+
+	// Update the cell
+	if update.Flags == DELETE_UPDATE {
+		hph.deleteCell(hashedKey)
+		if hph.trace {
+			fmt.Printf("key %x deleted\n", plainKey)
+		}
+		return nil
+	}
+	cell := hph.updateCell(plainKey, hashedKey)
+	if hph.trace {
+		fmt.Printf("accountFn updated key %x =>", plainKey)
+	}
+	if update.Flags&BALANCE_UPDATE != 0 {
+		if hph.trace {
+			fmt.Printf(" balance=%d", update.Balance.Uint64())
+		}
+		cell.Balance.Set(&update.Balance)
+	}
+	if update.Flags&NONCE_UPDATE != 0 {
+		if hph.trace {
+			fmt.Printf(" nonce=%d", update.Nonce)
+		}
+		cell.Nonce = update.Nonce
+	}
+	if update.Flags&CODE_UPDATE != 0 {
+		if hph.trace {
+			fmt.Printf(" codeHash=%x", update.CodeHashOrStorage)
+		}
+		copy(cell.CodeHash[:], update.CodeHashOrStorage[:])
+	}
+	if update.Flags&EXTRA_UPDATE != 0 {
+		if hph.trace {
+			fmt.Printf(" extra=%x", update.Extra)
+		}
+		cell.SetAccountExtra(update.Extra)
+	}
+	if hph.trace {
+		fmt.Printf("\n")
+	}
+	if update.Flags&STORAGE_UPDATE != 0 {
+		cell.setStorage(update.CodeHashOrStorage[:update.ValLength])
+		if hph.trace {
+			fmt.Printf("\rstorageFn filled key %x => %x\n", plainKey, update.CodeHashOrStorage[:update.ValLength])
+		}
+	}
+	return nil
+}
+
+// SetStorageBatching - ProcessUpdates computes storage subtrie of each contract with at least minUpdates storage updates
+// apart from the main trie (on up to `workers` goroutines) and feeds into the main trie only the change of account leaf.
+// Useful for blocks which touch thousands of slots of a few contracts. workers > 1 requires branchFn, accountFn
+// and storageFn to be safe for concurrent use. minUpdates 0 disables batching.
+func (hph *HexPatriciaHashed) SetStorageBatching(minUpdates, workers int) {
+	hph.storageBatchMin, hph.storageBatchWorkers = minUpdates, workers
+}
+
+// storageBatch - storage updates [from; to) of one contract, processed by separate trie
+type storageBatch struct {
+	from, to          int
+	ok                bool // false - account is not in the trie before updates, batch is processed by main trie
+	cell              Cell // account cell (depth 64) with folded storage subtrie
+	touched, present  bool
+	branchNodeUpdates map[string]BranchData
+}
+
+// processStorageBatches - finds contracts with enough storage updates and folds their storage subtries
+// starting from current state of the trie. Must be called before any update of the main trie.
+func (hph *HexPatriciaHashed) processStorageBatches(plainKeys, hashedKeys [][]byte, updates []Update) ([]storageBatch, error) {
+	if hph.storageBatchMin <= 0 || hph.activeRows != 0 {
+		return nil, nil
+	}
+	var batches []storageBatch
+	for i := 0; i < len(hashedKeys); {
+		if len(hashedKeys[i]) == 2*length.Hash {
+			i++
+			continue
+		}
+		accountKey := hashedKeys[i][:2*length.Hash]
+		j := i + 1
+		for j < len(hashedKeys) && len(hashedKeys[j]) > 2*length.Hash && bytes.Equal(hashedKeys[j][:2*length.Hash], accountKey) {
+			j++
+		}
+		// storage of deleted account is not folded into its cell
+		deleted := i > 0 && updates[i-1].Flags == DELETE_UPDATE && bytes.Equal(hashedKeys[i-1], accountKey)
+		if j-i >= hph.storageBatchMin && !deleted {
+			batches = append(batches, storageBatch{from: i, to: j})
+		}
+		i = j
+	}
+	if len(batches) == 0 {
+		return nil, nil
+	}
+
+	workers := hph.storageBatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	for len(hph.subTries) < workers {
+		hph.subTries = append(hph.subTries, NewHexPatriciaHashed(hph.accountKeyLen, nil, nil, nil))
+	}
+	g := errgroup.Group{}
+	next := atomic.NewInt64(-1)
+	for w := 0; w < workers; w++ {
+		sub := hph.subTries[w]
+		sub.ResetFns(hph.branchFn, hph.accountFn, hph.storageFn)
+		sub.scheme, sub.keyHasher, sub.trace = hph.scheme, hph.scheme.NewKeyHasher(), hph.trace
+		g.Go(func() error {
+			for i := int(next.Inc()); i < len(batches); i = int(next.Inc()) {
+				if err := hph.foldStorageBatch(sub, &batches[i], plainKeys, hashedKeys, updates); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	ok := batches[:0]
+	for _, b := range batches {
+		if b.ok {
+			ok = append(ok, b)
+		}
+	}
+	return ok, nil
+}
+
+// foldStorageBatch - applies storage updates of batch by sub trie (started from the root of main trie)
+// and folds it up to the account cell
+func (hph *HexPatriciaHashed) foldStorageBatch(sub *HexPatriciaHashed, b *storageBatch, plainKeys, hashedKeys [][]byte, updates []Update) error {
+	sub.root = hph.root
+	sub.rootChecked, sub.rootTouched, sub.rootPresent = hph.rootChecked, hph.rootTouched, hph.rootPresent
+	sub.activeRows, sub.currentKeyLen = 0, 0
+	b.branchNodeUpdates = make(map[string]BranchData)
+	for i := b.from; i < b.to; i++ {
+		if err := sub.followAndUpdate(plainKeys[i], hashedKeys[i], &updates[i], b.branchNodeUpdates); err != nil {
+			return fmt.Errorf("storage batch [%x]: %w", plainKeys[i], err)
+		}
+	}
+	row := -1
+	for r := 0; r < sub.activeRows; r++ {
+		if sub.depths[r] == 64 {
+			row = r
+			break
+		}
+	}
+	col := hashedKeys[b.from][2*length.Hash-1]
+	if row < 0 || sub.grid[row][col].apl == 0 {
+		// new account: storage subtrie is not separated from accounts part yet
+		b.branchNodeUpdates = nil
+		return nil
+	}
+	for sub.activeRows > row+1 {
+		if branchData, updateKey, err := sub.fold(); err != nil {
+			return fmt.Errorf("storage batch fold: %w", err)
+		} else if branchData != nil {
+			b.branchNodeUpdates[string(updateKey)] = branchData
+		}
+	}
+	b.cell = sub.grid[row][col]
+	b.touched = sub.touchMap[row]&(uint16(1)<<col) != 0
+	b.present = sub.afterMap[row]&(uint16(1)<<col) != 0
+	b.ok = true
+	return nil
+}
+
+// applyStorageBatch - replaces storage subtrie of account cell by folded one
+func (hph *HexPatriciaHashed) applyStorageBatch(b *storageBatch, plainKey, accountKey []byte, branchNodeUpdates map[string]BranchData) error {
+	if err := hph.followKey(accountKey, branchNodeUpdates); err != nil {
+		return err
+	}
+	row := hph.activeRows - 1
+	col := int(accountKey[2*length.Hash-1])
+	if row < 0 || hph.depths[row] != 64 {
+		return fmt.Errorf("storage batch [%x]: account cell is not unfolded", plainKey)
+	}
+	cell := &hph.grid[row][col]
+	cell.downHashedLen = b.cell.downHashedLen
+	copy(cell.downHashedKey[:], b.cell.downHashedKey[:b.cell.downHashedLen])
+	cell.extLen = b.cell.extLen
+	copy(cell.extension[:], b.cell.extension[:b.cell.extLen])
+	cell.hl = b.cell.hl
+	copy(cell.h[:], b.cell.h[:b.cell.hl])
+	cell.spl = b.cell.spl
+	copy(cell.spk[:], b.cell.spk[:b.cell.spl])
+	cell.StorageLen = b.cell.StorageLen
+	copy(cell.Storage[:], b.cell.Storage[:b.cell.StorageLen])
+	if b.touched {
+		hph.touchMap[row] |= uint16(1) << col
+	}
+	if b.present {
+		hph.afterMap[row] |= uint16(1) << col
+	}
+	for k, v := range b.branchNodeUpdates {
+		branchNodeUpdates[k] = v
+	}
+	if hph.trace {
+		fmt.Printf("storage batch of [%x] applied to cell (%d, %x), hash=[%x]\n", plainKey, row, col, cell.h[:cell.hl])
+	}
+	return nil
+}
+
+// HashAndNibblizeKey hashes provided key by Scheme's key hasher and expands resulting hash into nibbles
+// (each byte split into two nibbles by 4 bits). Storage keys are hashed as two parts: account and location.
+func (hph *HexPatriciaHashed) HashAndNibblizeKey(key []byte) []byte {
 	hashedKey := make([]byte, length.Hash)
+	accountKeyLen := hph.accountKeyLen
+	if len(key) < accountKeyLen {
+		accountKeyLen = len(key)
+	}
 
-	hph.keccak.Reset()
-	hph.keccak.Write(key[:length.Addr])
-	copy(hashedKey[:length.Hash], hph.keccak.Sum(nil))
+	hph.keyHasher.Reset()
+	hph.keyHasher.Write(key[:accountKeyLen])
+	copy(hashedKey[:length.Hash], hph.keyHasher.Sum(nil))
 
-	if len(key[length.Addr:]) > 0 {
+	if len(key[accountKeyLen:]) > 0 {
 		hashedKey = append(hashedKey, make([]byte, length.Hash)...)
-		hph.keccak.Reset()
-		hph.keccak.Write(key[length.Addr:])
-		copy(hashedKey[length.Hash:], hph.keccak.Sum(nil))
+		hph.keyHasher.Reset()
+		hph.keyHasher.Write(key[accountKeyLen:])
+		copy(hashedKey[length.Hash:], hph.keyHasher.Sum(nil))
 	}
 
 	nibblized := make([]byte, len(hashedKey)*2)
@@ -1830,6 +2065,7 @@ const (
 	BALANCE_UPDATE UpdateFlags = 4
 	NONCE_UPDATE   UpdateFlags = 8
 	STORAGE_UPDATE UpdateFlags = 16
+	EXTRA_UPDATE   UpdateFlags = 32 // chain-specific account fields, see Scheme
 )
 
 func (uf UpdateFlags) String() string {
@@ -1849,6 +2085,9 @@ func (uf UpdateFlags) String() string {
 		if uf&STORAGE_UPDATE != 0 {
 			sb.WriteString("+Storage")
 		}
+		if uf&EXTRA_UPDATE != 0 {
+			sb.WriteString("+Extra")
+		}
 	}
 	return sb.String()
 }
@@ -1859,6 +2098,7 @@ type Update struct {
 	Nonce             uint64
 	CodeHashOrStorage [length.Hash]byte
 	ValLength         int
+	Extra             []byte // not longer than MaxAccountExtraLen
 }
 
 func (u *Update) DecodeForStorage(enc []byte) {
@@ -1906,6 +2146,11 @@ func (u *Update) Encode(buf []byte, numBuf []byte) []byte {
 			buf = append(buf, u.CodeHashOrStorage[:u.ValLength]...)
 		}
 	}
+	if u.Flags&EXTRA_UPDATE != 0 {
+		n := binary.PutUvarint(numBuf, uint64(len(u.Extra)))
+		buf = append(buf, numBuf[:n]...)
+		buf = append(buf, u.Extra...)
+	}
 	return buf
 }
 
@@ -1961,6 +2206,21 @@ func (u *Update) Decode(buf []byte, pos int) (int, error) {
 		copy(u.CodeHashOrStorage[:], buf[pos:pos+int(l)])
 		pos += int(l)
 	}
+	if u.Flags&EXTRA_UPDATE != 0 {
+		l, n := binary.Uvarint(buf[pos:])
+		if n == 0 {
+			return 0, fmt.Errorf("decode Update: buffer too small for extra len")
+		}
+		if n < 0 || l > MaxAccountExtraLen {
+			return 0, fmt.Errorf("decode Update: extra len overflow")
+		}
+		pos += n
+		if len(buf) < pos+int(l) {
+			return 0, fmt.Errorf("decode Update: buffer too small for extra")
+		}
+		u.Extra = append(u.Extra[:0], buf[pos:pos+int(l)]...)
+		pos += int(l)
+	}
 	return pos, nil
 }
 
@@ -1979,5 +2239,8 @@ func (u *Update) String() string {
 	if u.Flags&STORAGE_UPDATE != 0 {
 		sb.WriteString(fmt.Sprintf(", Storage: [%x]", u.CodeHashOrStorage[:u.ValLength]))
 	}
+	if u.Flags&EXTRA_UPDATE != 0 {
+		sb.WriteString(fmt.Sprintf(", Extra: [%x]", u.Extra))
+	}
 	return sb.String()
 }
@@ -17,14 +17,18 @@
 package commitment
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/rlp"
 )
 
 func Test_HexPatriciaHashed_ResetThenSingularUpdates(t *testing.T) {
@@ -521,3 +525,154 @@ func Test_HexPatriciaHashed_ProcessUpdates_UniqueRepresentation_AfterStateRestor
 		"expected equal roots, got sequential [%v] != batch [%v]", hex.EncodeToString(roots[len(roots)-1]), hex.EncodeToString(batchRoot))
 	require.Lenf(t, batchRoot, 32, "root hash length should be equal to 32 bytes")
 }
+
+// sortedByScheme re-hashes plain keys by scheme of hph and sorts updates by new hashed keys
+func sortedByScheme(hph *HexPatriciaHashed, plainKeys [][]byte, updates []Update) ([][]byte, [][]byte, []Update) {
+	hashedKeys := make([][]byte, len(plainKeys))
+	for i := range plainKeys {
+		hashedKeys[i] = hph.HashAndNibblizeKey(plainKeys[i])
+	}
+	idx := make([]int, len(plainKeys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return string(hashedKeys[idx[i]]) < string(hashedKeys[idx[j]]) })
+	pk, hk, upd := make([][]byte, len(idx)), make([][]byte, len(idx)), make([]Update, len(idx))
+	for i, j := range idx {
+		pk[i], hk[i], upd[i] = plainKeys[j], hashedKeys[j], updates[j]
+	}
+	return pk, hk, upd
+}
+
+// encodeAccountWithExtra - ethereum account with one more RLP field: Cell.Extra
+func encodeAccountWithExtra(buf []byte, cell *Cell, storageRootHash [length.Hash]byte) []byte {
+	eth := EncodeEthAccount(nil, cell, storageRootHash)
+	prefixLen := 1
+	if eth[0] > 0xf7 {
+		prefixLen += int(eth[0] - 0xf7)
+	}
+	fields := append(eth[prefixLen:], byte(0x80+cell.ExtraLen)) // extra is shorter than 56 bytes
+	fields = append(fields, cell.Extra[:cell.ExtraLen]...)
+	var lenPrefix [4]byte
+	pt := rlp.GenerateStructLen(lenPrefix[:], len(fields))
+	buf = append(buf, lenPrefix[:pt]...)
+	return append(buf, fields...)
+}
+
+func Test_HexPatriciaHashed_Scheme(t *testing.T) {
+	custom := Scheme{Name: "sha256-extra", NewKeyHasher: sha256.New, EncodeAccount: encodeAccountWithExtra}
+
+	rootHash := func(s Scheme, review bool, extra string) []byte {
+		t.Helper()
+		ms := NewMockState(t)
+		hph := NewHexPatriciaHashed(1, ms.branchFn, ms.accountFn, ms.storageFn)
+		require.NoError(t, hph.SetScheme(s))
+		emptyCode := hex.EncodeToString(EmptyCodeHash)
+		plainKeys, _, updates := NewUpdateBuilder().
+			Balance("00", 4).
+			CodeHash("00", emptyCode).
+			Nonce("01", 2).
+			CodeHash("01", emptyCode).
+			Extra("01", extra).
+			Storage("01", "05", "0505").
+			Storage("01", "06", "0606").
+			Balance("02", 7).
+			CodeHash("02", emptyCode).
+			Extra("02", "ff").
+			Build()
+		plainKeys, hashedKeys, updates := sortedByScheme(hph, plainKeys, updates)
+		require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+
+		var root []byte
+		var err error
+		if review {
+			root, _, err = hph.ReviewKeys(plainKeys, hashedKeys)
+		} else {
+			root, _, err = hph.ProcessUpdates(plainKeys, hashedKeys, updates)
+		}
+		require.NoError(t, err)
+		require.Len(t, root, length.Hash)
+		return root
+	}
+
+	for _, review := range []bool{true, false} {
+		ethRoot := rootHash(EthereumScheme, review, "0a0b")
+		require.EqualValues(t, ethRoot, rootHash(EthereumScheme, review, "0c"), "extra fields are not part of ethereum account")
+
+		customRoot := rootHash(custom, review, "0a0b")
+		require.EqualValues(t, customRoot, rootHash(custom, review, "0a0b"))
+		require.NotEqualValues(t, ethRoot, customRoot)
+		require.NotEqualValues(t, customRoot, rootHash(custom, review, "0c"))
+
+		// only key hashing differs
+		require.NotEqualValues(t, ethRoot, rootHash(Scheme{Name: "sha256", NewKeyHasher: sha256.New, EncodeAccount: EncodeEthAccount}, review, "0a0b"))
+	}
+
+	hph := NewHexPatriciaHashed(1, nil, nil, nil)
+	require.Equal(t, EthereumScheme.Name, hph.Scheme().Name)
+	require.Error(t, hph.SetScheme(Scheme{Name: "sha512", NewKeyHasher: sha512.New, EncodeAccount: EncodeEthAccount}))
+	require.Error(t, hph.SetScheme(Scheme{NewKeyHasher: sha256.New, EncodeAccount: EncodeEthAccount}))
+	require.Equal(t, EthereumScheme.Name, hph.Scheme().Name)
+}
+
+func Test_UpdateEncodeExtra(t *testing.T) {
+	var numBuf [10]byte
+	u := Update{Flags: NONCE_UPDATE | EXTRA_UPDATE, Nonce: 5, Extra: []byte{1, 2, 3}}
+	enc := u.Encode(nil, numBuf[:])
+	var dec Update
+	pos, err := dec.Decode(enc, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(enc), pos)
+	require.Equal(t, u.Nonce, dec.Nonce)
+	require.Equal(t, u.Extra, dec.Extra)
+	_, err = dec.Decode(enc[:len(enc)-1], 0)
+	require.Error(t, err)
+}
+
+func Test_HexPatriciaHashed_StorageBatching(t *testing.T) {
+	ms, ms2 := NewMockState(t), NewMockState(t)
+	plain := NewHexPatriciaHashed(1, ms.branchFn, ms.accountFn, ms.storageFn)
+	batching := NewHexPatriciaHashed(1, ms2.branchFn, ms2.accountFn, ms2.storageFn)
+	batching.SetStorageBatching(3, 4)
+
+	slots := func(ub *UpdateBuilder, addr string, from, to int, val string) *UpdateBuilder {
+		for i := from; i < to; i++ {
+			ub.Storage(addr, fmt.Sprintf("%04x", i), val)
+		}
+		return ub
+	}
+	deleteSlots := func(ub *UpdateBuilder, addr string, from, to int) *UpdateBuilder {
+		for i := from; i < to; i++ {
+			ub.DeleteStorage(addr, fmt.Sprintf("%04x", i))
+		}
+		return ub
+	}
+	rounds := []*UpdateBuilder{
+		// new contracts: storage is processed by main trie
+		slots(slots(NewUpdateBuilder().Balance("00", 1).Balance("01", 2).Balance("03", 3).Balance("05", 4), "03", 0, 20, "0303"), "05", 0, 2, "05"),
+		slots(slots(NewUpdateBuilder(), "03", 10, 50, "aa"), "05", 0, 5, "0505"),
+		slots(slots(NewUpdateBuilder().Balance("03", 33).Nonce("05", 1), "03", 0, 3, "bb"), "05", 100, 150, "0501"),
+		deleteSlots(NewUpdateBuilder().Balance("02", 1), "03", 0, 50),
+		slots(NewUpdateBuilder(), "03", 7, 8, "07"),
+		slots(deleteSlots(NewUpdateBuilder(), "05", 0, 149), "03", 0, 7, "08"),
+		deleteSlots(NewUpdateBuilder().Delete("05"), "05", 149, 150),
+	}
+	for i, ub := range rounds {
+		plainKeys, hashedKeys, updates := ub.Build()
+		require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+		require.NoError(t, ms2.applyPlainUpdates(plainKeys, updates))
+		if i%2 == 0 {
+			plain.Reset()
+			batching.Reset()
+		}
+
+		root, branchNodeUpdates, err := plain.ProcessUpdates(plainKeys, hashedKeys, updates)
+		require.NoError(t, err)
+		root2, branchNodeUpdates2, err := batching.ProcessUpdates(plainKeys, hashedKeys, updates)
+		require.NoError(t, err)
+		require.Equal(t, root, root2, "round %d", i)
+		require.Equal(t, branchNodeUpdates, branchNodeUpdates2, "round %d", i)
+		ms.applyBranchNodeUpdates(branchNodeUpdates)
+		ms2.applyBranchNodeUpdates(branchNodeUpdates2)
+	}
+}
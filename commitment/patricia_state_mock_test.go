@@ -78,6 +78,11 @@ func (ms MockState) accountFn(plainKey []byte, cell *Cell) error {
 	} else {
 		copy(cell.CodeHash[:], EmptyCodeHash)
 	}
+	if ex.Flags&EXTRA_UPDATE != 0 {
+		cell.SetAccountExtra(ex.Extra)
+	} else {
+		cell.ExtraLen = 0
+	}
 	return nil
 }
 
@@ -155,6 +160,10 @@ func (ms *MockState) applyPlainUpdates(plainKeys [][]byte, updates []Update) err
 					ex.Flags |= STORAGE_UPDATE
 					copy(ex.CodeHashOrStorage[:], update.CodeHashOrStorage[:])
 				}
+				if update.Flags&EXTRA_UPDATE != 0 {
+					ex.Flags |= EXTRA_UPDATE
+					ex.Extra = common.Copy(update.Extra)
+				}
 				ms.sm[string(key)] = ex.Encode(nil, ms.numBuf[:])
 			} else {
 				ms.sm[string(key)] = update.Encode(nil, ms.numBuf[:])
@@ -193,6 +202,7 @@ type UpdateBuilder struct {
 	balances   map[string]*uint256.Int
 	nonces     map[string]uint64
 	codeHashes map[string][length.Hash]byte
+	extras     map[string][]byte
 	storages   map[string]map[string][]byte
 	deletes    map[string]struct{}
 	deletes2   map[string]map[string]struct{}
@@ -205,6 +215,7 @@ func NewUpdateBuilder() *UpdateBuilder {
 		balances:   make(map[string]*uint256.Int),
 		nonces:     make(map[string]uint64),
 		codeHashes: make(map[string][length.Hash]byte),
+		extras:     make(map[string][]byte),
 		storages:   make(map[string]map[string][]byte),
 		deletes:    make(map[string]struct{}),
 		deletes2:   make(map[string]map[string]struct{}),
@@ -248,6 +259,15 @@ func (ub *UpdateBuilder) CodeHash(addr string, hash string) *UpdateBuilder {
 	return ub
 }
 
+// Extra - chain-specific account fields, see Scheme
+func (ub *UpdateBuilder) Extra(addr string, extra string) *UpdateBuilder {
+	sk := string(decodeHex(addr))
+	delete(ub.deletes, sk)
+	ub.extras[sk] = decodeHex(extra)
+	ub.keyset[sk] = struct{}{}
+	return ub
+}
+
 func (ub *UpdateBuilder) Storage(addr string, loc string, value string) *UpdateBuilder {
 	sk1 := string(decodeHex(addr))
 	sk2 := string(decodeHex(loc))
@@ -294,6 +314,7 @@ func (ub *UpdateBuilder) Delete(addr string) *UpdateBuilder {
 	delete(ub.balances, sk)
 	delete(ub.nonces, sk)
 	delete(ub.codeHashes, sk)
+	delete(ub.extras, sk)
 	delete(ub.storages, sk)
 	ub.deletes[sk] = struct{}{}
 	ub.keyset[sk] = struct{}{}
@@ -397,6 +418,10 @@ func (ub *UpdateBuilder) Build() (plainKeys, hashedKeys [][]byte, updates []Upda
 				u.Flags |= CODE_UPDATE
 				copy(u.CodeHashOrStorage[:], codeHash[:])
 			}
+			if extra, ok := ub.extras[string(key)]; ok {
+				u.Flags |= EXTRA_UPDATE
+				u.Extra = extra
+			}
 			if _, del := ub.deletes[string(key)]; del {
 				u.Flags = DELETE_UPDATE
 				continue
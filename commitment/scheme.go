@@ -0,0 +1,75 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commitment
+
+import (
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+)
+
+// MaxAccountExtraLen - max size of chain-specific account fields (Cell.Extra) which trie carries for AccountEncoder
+const MaxAccountExtraLen = 64
+
+// AccountEncoder - appends to `buf` RLP-encoded account leaf value. Result is hashed into account leaf node.
+// Cell has account fields: Nonce, Balance, CodeHash and chain-specific Extra[:ExtraLen].
+type AccountEncoder func(buf []byte, cell *Cell, storageRootHash [length.Hash]byte) []byte
+
+// Scheme - chain-specific parameters of commitment trie. Trie structure (nibbles, branch/extension nodes encoding
+// and hashing) is the same for all schemes, but chains may differ by:
+//   - function which turns plain keys (account address, storage location) into trie paths
+//   - account leaf layout (set of fields and their serialization)
+//
+// Name is persisted together with commitment state - data built with one scheme must not be continued with another.
+type Scheme struct {
+	Name          string
+	NewKeyHasher  func() hash.Hash // must produce length.Hash bytes
+	EncodeAccount AccountEncoder
+	// DecodeAccountExtra - chain-specific fields of account value stored by application (state domain), they become
+	// Cell.Extra (see Cell.SetAccountExtra) for EncodeAccount. nil - accounts have no extra fields.
+	DecodeAccountExtra func(encAccount []byte) []byte
+}
+
+// EthereumScheme - keccak256 of plain keys, account is RLP list [nonce, balance, storageRoot, codeHash]
+var EthereumScheme = Scheme{
+	Name:          "eth",
+	NewKeyHasher:  func() hash.Hash { return sha3.NewLegacyKeccak256() },
+	EncodeAccount: EncodeEthAccount,
+}
+
+// EncodeEthAccount - AccountEncoder of EthereumScheme. Cell.Extra is ignored.
+func EncodeEthAccount(buf []byte, cell *Cell, storageRootHash [length.Hash]byte) []byte {
+	var valBuf [128]byte
+	valLen := cell.accountForHashing(valBuf[:], storageRootHash)
+	return append(buf, valBuf[:valLen]...)
+}
+
+func (s Scheme) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("commitment scheme: empty name")
+	}
+	if s.NewKeyHasher == nil || s.EncodeAccount == nil {
+		return fmt.Errorf("commitment scheme %q: key hasher and account encoder are required", s.Name)
+	}
+	if size := s.NewKeyHasher().Size(); size != length.Hash {
+		return fmt.Errorf("commitment scheme %q: key hash size %d, expected %d", s.Name, size, length.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package background
+
+import (
+	"context"
+	"runtime"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// CPULimit - budget of CPUs shared by all background jobs (collate, merge, indices build), so they can't starve
+// foreground work (like blocks execution). Each job acquires as many CPUs as workers it runs.
+// nil CPULimit - no limit.
+type CPULimit struct {
+	sem   *semaphore.Weighted
+	limit int
+}
+
+func NewCPULimit(cpus int) *CPULimit {
+	if cpus < 1 {
+		cpus = 1
+	}
+	return &CPULimit{sem: semaphore.NewWeighted(int64(cpus)), limit: cpus}
+}
+
+// NewCPULimitShare - limit is share of GOMAXPROCS (0 < share <= 1), at least 1 CPU
+func NewCPULimitShare(share float64) *CPULimit {
+	return NewCPULimit(int(float64(runtime.GOMAXPROCS(-1)) * share))
+}
+
+// Limit - 0 means no limit
+func (l *CPULimit) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return l.limit
+}
+
+// Workers - how many workers can run job which wants `want` workers
+func (l *CPULimit) Workers(want int) int {
+	if want < 1 {
+		want = 1
+	}
+	if l == nil || want <= l.limit {
+		return want
+	}
+	return l.limit
+}
+
+// Acquire - blocks until Workers(want) CPUs are free, returns amount of acquired CPUs - it must be passed to Release
+func (l *CPULimit) Acquire(ctx context.Context, want int) (int, error) {
+	n := l.Workers(want)
+	if l == nil {
+		return n, nil
+	}
+	if err := l.sem.Acquire(ctx, int64(n)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l *CPULimit) Release(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.sem.Release(int64(n))
+}
+
+// Do - runs f with Workers(want) acquired CPUs, f gets amount of them
+func (l *CPULimit) Do(ctx context.Context, want int, f func(workers int) error) error {
+	n, err := l.Acquire(ctx, want)
+	if err != nil {
+		return err
+	}
+	defer l.Release(n)
+	return f(n)
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package background
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPULimit(t *testing.T) {
+	ctx := context.Background()
+	var unlimited *CPULimit
+	require.Equal(t, 0, unlimited.Limit())
+	require.Equal(t, 8, unlimited.Workers(8))
+	require.NoError(t, unlimited.Do(ctx, 8, func(workers int) error {
+		require.Equal(t, 8, workers)
+		return nil
+	}))
+
+	l := NewCPULimit(2)
+	require.Equal(t, 2, l.Workers(8))
+	require.Equal(t, 1, l.Workers(0))
+
+	n, err := l.Acquire(ctx, 8)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(timeout, 1) // budget is used
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	l.Release(n)
+
+	require.NoError(t, l.Do(ctx, 1, func(workers int) error {
+		require.Equal(t, 1, workers)
+		n, err := l.Acquire(ctx, 1) // 1 CPU is left
+		require.NoError(t, err)
+		l.Release(n)
+		return nil
+	}))
+}
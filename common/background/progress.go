@@ -49,7 +49,11 @@ func NewProgressSet() *ProgressSet {
 	return &ProgressSet{list: btree2.NewMap[int, *Progress](128)}
 }
 
+// Add - nil ProgressSet is valid: progress is not tracked
 func (s *ProgressSet) Add(p *Progress) {
+	if s == nil {
+		return
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.i++
@@ -58,6 +62,9 @@ func (s *ProgressSet) Add(p *Progress) {
 }
 
 func (s *ProgressSet) Delete(p *Progress) {
+	if s == nil {
+		return
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.list.Delete(p.i)
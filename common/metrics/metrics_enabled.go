@@ -19,6 +19,7 @@ package metrics
 import (
 	"os"
 	"strings"
+	"time"
 )
 
 // Enabled is checked by the constructor functions for all of the
@@ -52,6 +53,12 @@ type Config struct { //nolint:maligned
 	EnabledExpensive bool   `toml:",omitempty"`
 	HTTP             string `toml:",omitempty"`
 	Port             int    `toml:",omitempty"`
+
+	// OTLP push exporter: disabled if endpoint is empty. Endpoint is base url of collector: http://localhost:4318
+	OTLPEndpoint string            `toml:",omitempty"`
+	OTLPInterval time.Duration     `toml:",omitempty"`
+	OTLPHeaders  map[string]string `toml:",omitempty"`
+	ServiceName  string            `toml:",omitempty"` // `service.name` resource attribute of OTLP
 }
 
 // DefaultConfig is the default config for metrics used in go-ethereum.
@@ -60,4 +67,6 @@ var DefaultConfig = Config{
 	EnabledExpensive: false,
 	HTTP:             "127.0.0.1",
 	Port:             6060,
+	OTLPInterval:     15 * time.Second,
+	ServiceName:      "erigon",
 }
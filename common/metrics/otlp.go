@@ -0,0 +1,239 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// OTLPExporter - push exporter: sends all metrics of Registry to OpenTelemetry collector by OTLP/HTTP (json encoding).
+// Counters are exported as cumulative monotonic sums, gauges as gauges, histograms as cumulative explicit-bucket histograms.
+// Metrics registered in VictoriaMetrics directly (kv, txpool) are not pushed.
+//
+// Not built on OpenTelemetry SDK on purpose: its metric exporters require newer Go than this module supports, and
+// OTLP/HTTP with json encoding is a small stable subset of the protocol.
+type OTLPExporter struct {
+	r        *Registry
+	url      string // <endpoint>/v1/metrics
+	headers  map[string]string
+	service  string
+	client   *http.Client
+	start    time.Time
+	interval time.Duration
+	logger   log.Logger
+}
+
+func NewOTLPExporter(r *Registry, cfg Config, logger log.Logger) *OTLPExporter {
+	interval := cfg.OTLPInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	service := cfg.ServiceName
+	if service == "" {
+		service = "erigon"
+	}
+	return &OTLPExporter{
+		r:        r,
+		url:      strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/metrics",
+		headers:  cfg.OTLPHeaders,
+		service:  service,
+		client:   &http.Client{Timeout: interval},
+		start:    time.Now(),
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run - pushes every interval until ctx is done. Failed pushes are logged, not retried: next push has all values anyway.
+func (e *OTLPExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Push(ctx); err != nil {
+				e.logger.Warn("[metrics] otlp push", "err", err)
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) Push(ctx context.Context) error {
+	body, err := json.Marshal(e.request(time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp push to %s: %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// OTLP/HTTP json: https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+// 64-bit integers are strings, enums are numbers
+const otlpCumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value otlpAnyString `json:"value"`
+}
+
+type otlpAnyString struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+// request - metrics of same name are data points of one otlp metric
+func (e *OTLPExporter) request(now time.Time) otlpRequest {
+	start, ts := nanos(e.start), nanos(now)
+	var metrics []otlpMetric
+	for _, nm := range e.r.sorted() {
+		if len(metrics) == 0 || metrics[len(metrics)-1].Name != nm.name {
+			metrics = append(metrics, otlpMetric{Name: nm.name})
+		}
+		om := &metrics[len(metrics)-1]
+		attrs := otlpAttributes(nm.labels)
+		switch m := nm.m.(type) {
+		case *Counter:
+			if om.Sum == nil {
+				om.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			}
+			om.Sum.DataPoints = append(om.Sum.DataPoints, otlpNumberDataPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: ts, AsInt: strconv.FormatUint(m.Get(), 10)})
+		case *Gauge:
+			if om.Gauge == nil {
+				om.Gauge = &otlpGauge{}
+			}
+			v := m.Get()
+			om.Gauge.DataPoints = append(om.Gauge.DataPoints, otlpNumberDataPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: &v})
+		case *Histogram:
+			if om.Histogram == nil {
+				om.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			}
+			s := m.Snapshot()
+			counts := make([]string, len(s.Counts))
+			for i, c := range s.Counts {
+				counts[i] = strconv.FormatUint(c, 10)
+			}
+			om.Histogram.DataPoints = append(om.Histogram.DataPoints, otlpHistogramDataPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: ts,
+				Count: strconv.FormatUint(s.Count, 10), Sum: s.Sum, BucketCounts: counts, ExplicitBounds: s.Bounds})
+		}
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyString{StringValue: e.service}}}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "github.com/ledgerwatch/erigon-lib"}, Metrics: metrics}},
+	}}}
+}
+
+func otlpAttributes(labels []Label) []otlpKeyValue {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make([]otlpKeyValue, len(labels))
+	for i, l := range labels {
+		res[i] = otlpKeyValue{Key: l.Name, Value: otlpAnyString{StringValue: l.Value}}
+	}
+	return res
+}
+
+func nanos(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
@@ -0,0 +1,102 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WritePrometheus - pull exporter: all metrics in Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	prevName := ""
+	for _, nm := range r.sorted() {
+		if nm.name != prevName {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", nm.name, nm.kind)
+			prevName = nm.name
+		}
+		switch m := nm.m.(type) {
+		case *Counter:
+			fmt.Fprintf(bw, "%s %d\n", nm.full, m.Get())
+		case *Gauge:
+			fmt.Fprintf(bw, "%s %s\n", nm.full, formatFloat(m.Get()))
+		case *Histogram:
+			s := m.Snapshot()
+			var cumulative uint64
+			for i, c := range s.Counts {
+				cumulative += c
+				le := "+Inf"
+				if i < len(s.Bounds) {
+					le = formatFloat(s.Bounds[i])
+				}
+				fmt.Fprintf(bw, "%s %d\n", withLabel(nm, "_bucket", Label{Name: "le", Value: le}), cumulative)
+			}
+			fmt.Fprintf(bw, "%s %s\n", withLabel(nm, "_sum"), formatFloat(s.Sum))
+			fmt.Fprintf(bw, "%s %d\n", withLabel(nm, "_count"), s.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler - serves WritePrometheus, to mount on /debug/metrics/prometheus or similar. Registry mirrored into
+// VictoriaMetrics set serves whole set: it has metrics registered in set directly too (kv, txpool).
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if r.vm != nil {
+			r.vm.WritePrometheus(w)
+			return
+		}
+		_ = r.WritePrometheus(w)
+	})
+}
+
+// withLabel - `name_suffix{labels...,extra...}`
+func withLabel(nm *namedMetric, suffix string, extra ...Label) string {
+	labels := append(append([]Label(nil), nm.labels...), extra...)
+	if len(labels) == 0 {
+		return nm.name + suffix
+	}
+	var sb strings.Builder
+	sb.WriteString(nm.name)
+	sb.WriteString(suffix)
+	sb.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, l.Name, l.Value)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
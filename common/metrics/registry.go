@@ -0,0 +1,321 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	vm "github.com/VictoriaMetrics/metrics"
+	"go.uber.org/atomic"
+)
+
+// Registry - metrics of library subsystems (state, etl, downloader, kv background workers). Metric name can have
+// labels in Prometheus syntax: `db_commit_seconds{phase="sync"}`. Exported by pull (WritePrometheus, Handler) and
+// push (PushOTLP) exporters, see Setup.
+type Registry struct {
+	lock    sync.RWMutex
+	metrics map[string]*namedMetric // by full name: with labels
+	vm      *vm.Set                 // nil - not mirrored, see NewVMRegistry
+}
+
+// DefaultRegistry - used by library subsystems, exported by Setup. Mirrored into default set of VictoriaMetrics:
+// embedders which expose VictoriaMetrics (metrics.WritePrometheus) see its metrics next to kv and txpool ones -
+// those are registered in VictoriaMetrics directly.
+var DefaultRegistry = NewVMRegistry(vm.GetDefaultSet())
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*namedMetric{}}
+}
+
+// NewVMRegistry - registry mirrored into VictoriaMetrics set: each metric is exposed by set.WritePrometheus too.
+// Counters and gauges are mirrored as gauges, histograms - as gauges of `_bucket`, `_sum` and `_count` series.
+func NewVMRegistry(set *vm.Set) *Registry {
+	return &Registry{metrics: map[string]*namedMetric{}, vm: set}
+}
+
+type Kind int
+
+const (
+	KindCounter Kind = iota
+	KindGauge
+	KindHistogram
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+type Label struct {
+	Name, Value string
+}
+
+type namedMetric struct {
+	full   string
+	name   string // without labels
+	labels []Label
+	kind   Kind
+	m      interface{} // *Counter, *Gauge or *Histogram
+
+	mirrored []string // names in Registry.vm
+}
+
+// Counter - monotonic counter. Set is for values which are counted by others (like db page operations).
+type Counter struct {
+	n atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.n.Inc() }
+func (c *Counter) Add(n int)     { c.n.Add(uint64(n)) }
+func (c *Counter) Set(n uint64)  { c.n.Store(n) }
+func (c *Counter) Get() uint64   { return c.n.Load() }
+func (c *Counter) value() uint64 { return c.n.Load() }
+
+// Gauge - value which goes up and down. If it's created with callback - value is taken from callback, Set is no-op.
+type Gauge struct {
+	bits atomic.Uint64
+	f    func() float64
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Get() float64 {
+	if g.f != nil {
+		return g.f()
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+// DefaultBuckets - upper bounds of Histogram buckets, suitable for durations in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Histogram - distribution of values by buckets with explicit upper bounds
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64 // len(bounds)+1: last is (bounds[last], +Inf)
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Update(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// UpdateDuration - seconds since `start`
+func (h *Histogram) UpdateDuration(start time.Time) { h.Update(time.Since(start).Seconds()) }
+
+// HistogramSnapshot - consistent state of Histogram: Counts are not cumulative
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return HistogramSnapshot{Bounds: h.bounds, Counts: append([]uint64(nil), h.counts...), Sum: h.sum, Count: h.count}
+}
+
+// cumulative - count of values in buckets [0, i]
+func (h *Histogram) cumulative(i int) (n uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, c := range h.counts[:i+1] {
+		n += c
+	}
+	return n
+}
+
+func (r *Registry) GetOrCreateCounter(name string) *Counter {
+	return r.getOrCreate(name, KindCounter, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// GetOrCreateGauge - f != nil: value of gauge is taken from f at export
+func (r *Registry) GetOrCreateGauge(name string, f func() float64) *Gauge {
+	return r.getOrCreate(name, KindGauge, func() interface{} { return &Gauge{f: f} }).(*Gauge)
+}
+
+// GetOrCreateHistogram - histogram with DefaultBuckets
+func (r *Registry) GetOrCreateHistogram(name string) *Histogram {
+	return r.GetOrCreateHistogramExt(name, DefaultBuckets)
+}
+
+// GetOrCreateHistogramExt - histogram with sorted upper bounds of buckets. Bounds of existing histogram are not changed.
+func (r *Registry) GetOrCreateHistogramExt(name string, bounds []float64) *Histogram {
+	if !sort.Float64sAreSorted(bounds) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	return r.getOrCreate(name, KindHistogram, func() interface{} { return newHistogram(bounds) }).(*Histogram)
+}
+
+func (r *Registry) getOrCreate(full string, kind Kind, create func() interface{}) interface{} {
+	r.lock.RLock()
+	nm, ok := r.metrics[full]
+	r.lock.RUnlock()
+	if !ok {
+		name, labels, err := parseName(full)
+		if err != nil {
+			panic(err)
+		}
+		r.lock.Lock()
+		if nm, ok = r.metrics[full]; !ok {
+			nm = &namedMetric{full: full, name: name, labels: labels, kind: kind, m: create()}
+			r.mirror(nm)
+			r.metrics[full] = nm
+		}
+		r.lock.Unlock()
+	}
+	if nm.kind != kind {
+		panic(fmt.Sprintf("metrics: %s is registered as %s, not %s", full, nm.kind, kind))
+	}
+	return nm.m
+}
+
+// mirror - registers gauges which read nm in Registry.vm
+func (r *Registry) mirror(nm *namedMetric) {
+	if r.vm == nil {
+		return
+	}
+	gauge := func(name string, f func() float64) {
+		r.vm.GetOrCreateGauge(name, f)
+		nm.mirrored = append(nm.mirrored, name)
+	}
+	switch m := nm.m.(type) {
+	case *Counter:
+		gauge(nm.full, func() float64 { return float64(m.Get()) })
+	case *Gauge:
+		gauge(nm.full, m.Get)
+	case *Histogram:
+		for i := 0; i <= len(m.bounds); i++ {
+			i, le := i, "+Inf"
+			if i < len(m.bounds) {
+				le = formatFloat(m.bounds[i])
+			}
+			gauge(withLabel(nm, "_bucket", Label{Name: "le", Value: le}), func() float64 { return float64(m.cumulative(i)) })
+		}
+		gauge(withLabel(nm, "_sum"), func() float64 { return m.Snapshot().Sum })
+		gauge(withLabel(nm, "_count"), func() float64 { return float64(m.Snapshot().Count) })
+	}
+}
+
+// Unregister - false if there is no metric with such name
+func (r *Registry) Unregister(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	nm, ok := r.metrics[name]
+	if ok {
+		for _, n := range nm.mirrored {
+			r.vm.UnregisterMetric(n)
+		}
+	}
+	delete(r.metrics, name)
+	return ok
+}
+
+// sorted - metrics sorted by name, then by labels: metrics of same name are exported together
+func (r *Registry) sorted() []*namedMetric {
+	r.lock.RLock()
+	res := make([]*namedMetric, 0, len(r.metrics))
+	for _, nm := range r.metrics {
+		res = append(res, nm)
+	}
+	r.lock.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].name != res[j].name {
+			return res[i].name < res[j].name
+		}
+		return res[i].full < res[j].full
+	})
+	return res
+}
+
+// parseName - `name{k1="v1",k2="v2"}`
+func parseName(full string) (name string, labels []Label, err error) {
+	i := strings.IndexByte(full, '{')
+	if i < 0 {
+		if !validName(full) {
+			return "", nil, fmt.Errorf("metrics: invalid name %q", full)
+		}
+		return full, nil, nil
+	}
+	name, rest := full[:i], full[i+1:]
+	if !validName(name) || !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("metrics: invalid name %q", full)
+	}
+	rest = rest[:len(rest)-1]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, `="`)
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("metrics: invalid labels of %q", full)
+		}
+		end := strings.IndexByte(rest[eq+2:], '"')
+		if end < 0 {
+			return "", nil, fmt.Errorf("metrics: invalid labels of %q", full)
+		}
+		labels = append(labels, Label{Name: rest[:eq], Value: rest[eq+2 : eq+2+end]})
+		rest = strings.TrimPrefix(rest[eq+2+end+1:], ",")
+	}
+	return name, labels, nil
+}
+
+func validName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// GetOrCreateCounter - of DefaultRegistry
+func GetOrCreateCounter(name string) *Counter { return DefaultRegistry.GetOrCreateCounter(name) }
+
+// GetOrCreateGauge - of DefaultRegistry
+func GetOrCreateGauge(name string, f func() float64) *Gauge {
+	return DefaultRegistry.GetOrCreateGauge(name, f)
+}
+
+// GetOrCreateHistogram - of DefaultRegistry
+func GetOrCreateHistogram(name string) *Histogram { return DefaultRegistry.GetOrCreateHistogram(name) }
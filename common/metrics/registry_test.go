@@ -0,0 +1,142 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vm "github.com/VictoriaMetrics/metrics"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.GetOrCreateCounter(`db_ops{op="put"}`).Add(3)
+	r.GetOrCreateCounter(`db_ops{op="del"}`).Inc()
+	r.GetOrCreateGauge(`queue_depth`, nil).Set(1.5)
+	r.GetOrCreateGauge(`files`, func() float64 { return 7 })
+	h := r.GetOrCreateHistogramExt(`flush_seconds{domain="accounts"}`, []float64{1, 10})
+	h.Update(0.5)
+	h.Update(5)
+	h.Update(50)
+	require.Same(t, h, r.GetOrCreateHistogram(`flush_seconds{domain="accounts"}`))
+	require.Panics(t, func() { r.GetOrCreateCounter(`queue_depth`) })
+	require.Panics(t, func() { r.GetOrCreateCounter(`bad name`) })
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WritePrometheus(&buf))
+	require.Equal(t, `# TYPE db_ops counter
+db_ops{op="del"} 1
+db_ops{op="put"} 3
+# TYPE files gauge
+files 7
+# TYPE flush_seconds histogram
+flush_seconds_bucket{domain="accounts",le="1"} 1
+flush_seconds_bucket{domain="accounts",le="10"} 2
+flush_seconds_bucket{domain="accounts",le="+Inf"} 3
+flush_seconds_sum{domain="accounts"} 55.5
+flush_seconds_count{domain="accounts"} 3
+# TYPE queue_depth gauge
+queue_depth 1.5
+`, buf.String())
+
+	require.True(t, r.Unregister(`files`))
+	require.False(t, r.Unregister(`files`))
+}
+
+func TestRegistryMirroredIntoVM(t *testing.T) {
+	set := vm.NewSet()
+	set.NewCounter(`db_size`).Set(10) // registered in VictoriaMetrics directly
+	r := NewVMRegistry(set)
+	r.GetOrCreateCounter(`db_ops{op="put"}`).Add(3)
+	r.GetOrCreateGauge(`queue_depth`, nil).Set(1.5)
+	h := r.GetOrCreateHistogramExt(`flush_seconds{domain="accounts"}`, []float64{1})
+	h.Update(0.5)
+	h.Update(5)
+
+	var buf bytes.Buffer
+	set.WritePrometheus(&buf)
+	require.Equal(t, `db_ops{op="put"} 3
+db_size 10
+flush_seconds_bucket{domain="accounts",le="+Inf"} 2
+flush_seconds_bucket{domain="accounts",le="1"} 1
+flush_seconds_count{domain="accounts"} 2
+flush_seconds_sum{domain="accounts"} 5.5
+queue_depth 1.5
+`, buf.String())
+
+	srv := httptest.NewServer(r.Handler()) // serves whole set
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, buf.String(), string(body))
+
+	require.True(t, r.Unregister(`flush_seconds{domain="accounts"}`))
+	require.Equal(t, []string{`db_ops{op="put"}`, `db_size`, `queue_depth`}, set.ListMetricNames())
+}
+
+func TestOTLPPush(t *testing.T) {
+	r := NewRegistry()
+	r.GetOrCreateCounter(`db_ops{op="put"}`).Add(3)
+	r.GetOrCreateGauge(`queue_depth`, nil).Set(2)
+	r.GetOrCreateHistogramExt(`flush_seconds`, []float64{1}).Update(0.5)
+
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/v1/metrics", req.URL.Path)
+		require.Equal(t, "secret", req.Header.Get("Authorization"))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &got))
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(r, Config{OTLPEndpoint: srv.URL, OTLPHeaders: map[string]string{"Authorization": "secret"}, ServiceName: "test"}, log.New())
+	require.NoError(t, e.Push(context.Background()))
+
+	rm := got["resourceMetrics"].([]interface{})[0].(map[string]interface{})
+	attr := rm["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "test", attr["value"].(map[string]interface{})["stringValue"])
+	metrics := rm["scopeMetrics"].([]interface{})[0].(map[string]interface{})["metrics"].([]interface{})
+	require.Len(t, metrics, 3)
+
+	ops := metrics[0].(map[string]interface{})
+	require.Equal(t, "db_ops", ops["name"])
+	sum := ops["sum"].(map[string]interface{})
+	require.Equal(t, true, sum["isMonotonic"])
+	require.Equal(t, "3", sum["dataPoints"].([]interface{})[0].(map[string]interface{})["asInt"])
+
+	flush := metrics[1].(map[string]interface{})["histogram"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "1", flush["count"])
+	require.Equal(t, []interface{}{"1", "0"}, flush["bucketCounts"])
+
+	depth := metrics[2].(map[string]interface{})["gauge"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, 2.0, depth["asDouble"])
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) })
+	require.Error(t, e.Push(context.Background()))
+}
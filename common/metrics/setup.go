@@ -0,0 +1,77 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Setup - starts exporters of DefaultRegistry configured by embedder: Prometheus pull exporter on HTTP:Port
+// (`/debug/metrics/prometheus`) and OTLP push exporter if OTLPEndpoint is set. Returns func which stops both.
+func Setup(ctx context.Context, cfg Config, logger log.Logger) (stop func(), err error) {
+	return DefaultRegistry.Setup(ctx, cfg, logger)
+}
+
+func (r *Registry) Setup(ctx context.Context, cfg Config, logger log.Logger) (stop func(), err error) {
+	if !cfg.Enabled {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var srv *http.Server
+	if cfg.HTTP != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/metrics/prometheus", r.Handler())
+		addr := fmt.Sprintf("%s:%d", cfg.HTTP, cfg.Port)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("metrics: listen %s: %w", addr, err)
+		}
+		srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Warn("[metrics] prometheus exporter", "err", err)
+			}
+		}()
+		logger.Info("[metrics] prometheus exporter started", "addr", ln.Addr())
+	}
+	pushed := make(chan struct{})
+	if cfg.OTLPEndpoint != "" {
+		e := NewOTLPExporter(r, cfg, logger)
+		go func() {
+			defer close(pushed)
+			e.Run(ctx)
+		}()
+		logger.Info("[metrics] otlp exporter started", "endpoint", cfg.OTLPEndpoint, "interval", e.interval)
+	} else {
+		close(pushed)
+	}
+	return func() {
+		cancel()
+		<-pushed
+		if srv != nil {
+			_ = srv.Close()
+		}
+	}, nil
+}
@@ -69,6 +69,8 @@ type Compressor struct {
 	Ratio            CompressionRatio
 	lvl              log.Lvl
 	trace            bool
+	compressTmp      bool
+	format           Format // see SetFormat
 }
 
 func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, minPatternScore uint64, workers int, lvl log.Lvl) (*Compressor, error) {
@@ -111,6 +113,7 @@ func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, mi
 		suffixCollectors: suffixCollectors,
 		lvl:              lvl,
 		wg:               wg,
+		format:           FormatLegacy,
 	}, nil
 }
 
@@ -126,6 +129,19 @@ func (c *Compressor) SetTrace(trace bool) {
 	c.trace = trace
 }
 
+// SetCompressTmpFiles - ETL temp files of dictionary building are compressed, see etl.Collector.SetCompressTmpFiles.
+// Call it before first AddWord.
+func (c *Compressor) SetCompressTmpFiles(v bool) {
+	c.compressTmp = v
+	for _, collector := range c.suffixCollectors {
+		collector.SetCompressTmpFiles(v)
+	}
+}
+
+// SetFormat - format of output file, FormatLegacy by default. Other formats are produced by transcoding of
+// legacy output: costs 1 more write of file.
+func (c *Compressor) SetFormat(f Format) { c.format = f }
+
 func (c *Compressor) Count() int { return int(c.wordsCount) }
 
 func (c *Compressor) AddWord(word []byte) error {
@@ -170,7 +186,7 @@ func (c *Compressor) Compress() error {
 		log.Log(c.lvl, fmt.Sprintf("[%s] BuildDict start", c.logPrefix), "workers", c.workers)
 	}
 	t := time.Now()
-	db, err := DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.lvl)
+	db, err := dictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.compressTmp, c.lvl)
 	if err != nil {
 
 		return err
@@ -191,7 +207,11 @@ func (c *Compressor) Compress() error {
 		return err
 	}
 
-	if err := os.Rename(c.tmpOutFilePath, c.outputFile); err != nil {
+	if c.format.Name != FormatLegacy.Name {
+		if err := Transcode(c.tmpOutFilePath, c.outputFile, c.format, nil); err != nil {
+			return err
+		}
+	} else if err := os.Rename(c.tmpOutFilePath, c.outputFile); err != nil {
 		return fmt.Errorf("renaming: %w", err)
 	}
 	c.Ratio, err = Ratio(c.uncompressedFile.filePath, c.outputFile)
@@ -166,3 +166,43 @@ func TestCompressDict1(t *testing.T) {
 		t.Errorf("result file hash changed, %d", cs)
 	}
 }
+
+func TestFormats(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 1, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetFormat(FormatV1)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i))))
+	}
+	require.NoError(t, c.Compress())
+
+	check := func(format string) {
+		t.Helper()
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		defer d.Close()
+		require.Equal(t, format, d.Format())
+		g := d.MakeGetter()
+		for i := 0; i < 100; i++ {
+			require.True(t, g.HasNext())
+			w, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("%d longlongword %d", i, i), string(w))
+		}
+		require.False(t, g.HasNext())
+	}
+	check(FormatV1.Name)
+	require.NoError(t, Transcode(file, file, FormatLegacy, nil))
+	check(FormatLegacy.Name)
+	require.NoError(t, Transcode(file, file, FormatV1, nil))
+	check(FormatV1.Name)
+	require.NoFileExists(t, file+".transcode.tmp")
+
+	require.Error(t, RegisterFormat(Format{Name: "zero", Magic: []byte{0, 1}}))
+	require.Error(t, RegisterFormat(Format{Name: "conflict", Magic: []byte("ESG")}))
+	f, ok := FormatByName(FormatV1.Name)
+	require.True(t, ok)
+	require.Equal(t, FormatV1.Magic, f.Magic)
+}
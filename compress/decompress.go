@@ -100,16 +100,16 @@ type posTable struct {
 // Decompressor provides access to the superstrings in a file produced by a compressor
 type Decompressor struct {
 	f               *os.File
-	mmapHandle2     *[mmap.MaxMapSize]byte // mmap handle for windows (this is used to close mmap)
+	region          *mmap.Region // mapped file, registered in mmap.DefaultManager
 	dict            *patternTable
 	posDict         *posTable
-	mmapHandle1     []byte // mmap handle for unix (this is used to close mmap)
 	data            []byte // slice of correct size for the decompressor to work with
 	wordsStart      uint64 // Offset of whether the superstrings actually start
 	size            int64
 	modTime         time.Time
 	wordsCount      uint64
 	emptyWordsCount uint64
+	format          string // name of Format of file
 
 	filePath, fileName string
 }
@@ -169,12 +169,19 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 		return nil, fmt.Errorf("compressed file is too short: %d", d.size)
 	}
 	d.modTime = stat.ModTime()
-	if d.mmapHandle1, d.mmapHandle2, err = mmap.Mmap(d.f, int(d.size)); err != nil {
+	if d.region, err = mmap.DefaultManager.Map(d.f, int(d.size)); err != nil {
 		return nil, err
 	}
 
 	// read patterns from file
-	d.data = d.mmapHandle1[:d.size]
+	format := DetectFormat(d.region.Bytes()[:d.size])
+	if d.data, err = format.Decode(d.region.Bytes()[:d.size]); err != nil {
+		return nil, fmt.Errorf("decompressing file: %s, %w", compressedFilePath, err)
+	}
+	if len(d.data) < 32 {
+		return nil, fmt.Errorf("compressed file is too short: %d", len(d.data))
+	}
+	d.format = format.Name
 	d.wordsCount = binary.BigEndian.Uint64(d.data[:8])
 	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[8:16])
 	dictSize := binary.BigEndian.Uint64(d.data[16:24])
@@ -341,7 +348,7 @@ func (d *Decompressor) ModTime() time.Time {
 }
 
 func (d *Decompressor) Close() error {
-	if err := mmap.Munmap(d.mmapHandle1, d.mmapHandle2); err != nil {
+	if err := d.region.Unmap(); err != nil {
 		log.Trace("unmap", "err", err, "file", d.FileName())
 	}
 	if err := d.f.Close(); err != nil {
@@ -353,43 +360,46 @@ func (d *Decompressor) Close() error {
 func (d *Decompressor) FilePath() string { return d.filePath }
 func (d *Decompressor) FileName() string { return d.fileName }
 
+// Format - name of Format of file, see DetectFormat
+func (d *Decompressor) Format() string { return d.format }
+
 // WithReadAhead - Expect read in sequential order. (Hence, pages in the given range can be aggressively read ahead, and may be freed soon after they are accessed.)
 func (d *Decompressor) WithReadAhead(f func() error) error {
-	if d == nil || d.mmapHandle1 == nil {
+	if d == nil || d.region == nil {
 		return nil
 	}
-	_ = mmap.MadviseSequential(d.mmapHandle1)
-	//_ = mmap.MadviseWillNeed(d.mmapHandle1)
-	defer mmap.MadviseRandom(d.mmapHandle1)
+	_ = d.region.Advise(mmap.Sequential)
+	defer d.region.ResetAdvice()
 	return f()
 }
 
 // DisableReadAhead - usage: `defer d.EnableReadAhead().DisableReadAhead()`. Please don't use this funcs without `defer` to avoid leak.
+// Returns file to access pattern of mmap.DefaultManager policy.
 func (d *Decompressor) DisableReadAhead() {
-	if d == nil || d.mmapHandle1 == nil {
+	if d == nil {
 		return
 	}
-	_ = mmap.MadviseRandom(d.mmapHandle1)
+	_ = d.region.ResetAdvice()
 }
 func (d *Decompressor) EnableReadAhead() *Decompressor {
-	if d == nil || d.mmapHandle1 == nil {
+	if d == nil {
 		return d
 	}
-	_ = mmap.MadviseSequential(d.mmapHandle1)
+	_ = d.region.Advise(mmap.Sequential)
 	return d
 }
 func (d *Decompressor) EnableMadvNormal() *Decompressor {
-	if d == nil || d.mmapHandle1 == nil {
+	if d == nil {
 		return d
 	}
-	_ = mmap.MadviseNormal(d.mmapHandle1)
+	_ = d.region.Advise(mmap.Normal)
 	return d
 }
 func (d *Decompressor) EnableWillNeed() *Decompressor {
-	if d == nil || d.mmapHandle1 == nil {
+	if d == nil {
 		return d
 	}
-	_ = mmap.MadviseWillNeed(d.mmapHandle1)
+	_ = d.region.Advise(mmap.WillNeed)
 	return d
 }
 
@@ -0,0 +1,155 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Format - layout of data file on disk. Formats are recognized by magic at beginning of file, so directory may
+// contain files of different formats (e.g. during transition to new codec): Decompressor opens each file by its own
+// format. File without known magic has FormatLegacy: magic of new format must not be valid beginning of legacy file
+// (legacy file starts from big-endian count of words: first byte is 0 for any real file).
+type Format struct {
+	Name  string
+	Magic []byte
+	// Decode - payload of file `data` (whole mapped file, starting from Magic): layout of Compressor (counts,
+	// dictionaries, words). May return sub-slice of `data` (zero-copy) or decoded copy.
+	Decode func(data []byte) ([]byte, error)
+	// Encode - writes file of this format, including Magic
+	Encode func(w io.Writer, payload []byte) error
+}
+
+// FormatLegacy - payload without header, as Compressor writes it
+var FormatLegacy = Format{
+	Name:   "v0",
+	Decode: func(data []byte) ([]byte, error) { return data, nil },
+	Encode: func(w io.Writer, payload []byte) error {
+		_, err := w.Write(payload)
+		return err
+	},
+}
+
+// FormatV1 - payload with header: magic and 4 reserved bytes (flags of future codecs)
+var FormatV1 = Format{
+	Name:  "v1",
+	Magic: []byte("ESG1"),
+	Decode: func(data []byte) ([]byte, error) {
+		if len(data) < formatV1HeaderSize {
+			return nil, fmt.Errorf("file is too short for v1 header: %d", len(data))
+		}
+		return data[formatV1HeaderSize:], nil
+	},
+	Encode: func(w io.Writer, payload []byte) error {
+		var header [formatV1HeaderSize]byte
+		copy(header[:], "ESG1")
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		return err
+	},
+}
+
+const formatV1HeaderSize = 8
+
+var formats = struct {
+	sync.RWMutex
+	byName map[string]Format
+}{byName: map[string]Format{FormatLegacy.Name: FormatLegacy, FormatV1.Name: FormatV1}}
+
+// RegisterFormat - makes files of format `f` readable by Decompressor and writable by Compressor.SetFormat and Transcode
+func RegisterFormat(f Format) error {
+	if len(f.Magic) == 0 || f.Magic[0] == 0 {
+		return fmt.Errorf("format %s: magic must be non-empty and not start with 0", f.Name)
+	}
+	formats.Lock()
+	defer formats.Unlock()
+	for _, other := range formats.byName {
+		if other.Name == f.Name || (len(other.Magic) > 0 && (bytes.HasPrefix(other.Magic, f.Magic) || bytes.HasPrefix(f.Magic, other.Magic))) {
+			return fmt.Errorf("format %s: conflicts with format %s", f.Name, other.Name)
+		}
+	}
+	formats.byName[f.Name] = f
+	return nil
+}
+
+// FormatByName - registered format, false if there is no such format
+func FormatByName(name string) (Format, bool) {
+	formats.RLock()
+	defer formats.RUnlock()
+	f, ok := formats.byName[name]
+	return f, ok
+}
+
+// DetectFormat - format of file by its beginning `data`
+func DetectFormat(data []byte) Format {
+	formats.RLock()
+	defer formats.RUnlock()
+	for _, f := range formats.byName {
+		if len(f.Magic) > 0 && bytes.HasPrefix(data, f.Magic) {
+			return f
+		}
+	}
+	return FormatLegacy
+}
+
+// Transcode - writes file `to` of format `f` with payload of file `from`. File is written to `to`.transcode.tmp and renamed:
+// `to` may be `from` (readers which already opened it keep reading previous file). `w` wraps file writer
+// (e.g. to limit IO rate), may be nil.
+func Transcode(from, to string, f Format, w func(io.Writer) io.Writer) (err error) {
+	d, err := NewDecompressor(from)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	tmpPath := to + ".transcode.tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if out != nil {
+			out.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	bw := bufio.NewWriterSize(out, 512*1024)
+	var dst io.Writer = bw
+	if w != nil {
+		dst = w(bw)
+	}
+	if err = f.Encode(dst, d.data); err != nil {
+		return fmt.Errorf("transcode %s to %s: %w", d.FileName(), f.Name, err)
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	out = nil
+	return os.Rename(tmpPath, to)
+}
@@ -32,6 +32,9 @@ func NewDownloaderClient(server proto_downloader.DownloaderServer) *DownloaderCl
 	return &DownloaderClient{server: server}
 }
 
+// Probe - see DownloaderPeersProbe
+func (c *DownloaderClient) Probe() Probe { return DownloaderPeersProbe(c) }
+
 func (c *DownloaderClient) Download(ctx context.Context, in *proto_downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
 	return c.server.Download(ctx, in)
 }
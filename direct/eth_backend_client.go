@@ -42,6 +42,8 @@ func (s *EthBackendClientDirect) Etherbase(ctx context.Context, in *remote.Ether
 	return s.server.Etherbase(ctx, in)
 }
 
+func (s *EthBackendClientDirect) Probe() Probe { return VersionProbe("ethbackend", s) }
+
 func (s *EthBackendClientDirect) NetVersion(ctx context.Context, in *remote.NetVersionRequest, opts ...grpc.CallOption) (*remote.NetVersionReply, error) {
 	return s.server.NetVersion(ctx, in)
 }
@@ -0,0 +1,100 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var _ grpc_health_v1.HealthClient = (*HealthClientDirect)(nil) // compile-time interface check
+
+// HealthClientDirect - gRPC health protocol client linked directly to health server of component in same process
+type HealthClientDirect struct {
+	server grpc_health_v1.HealthServer
+}
+
+func NewHealthClientDirect(server grpc_health_v1.HealthServer) *HealthClientDirect {
+	return &HealthClientDirect{server: server}
+}
+
+func (c *HealthClientDirect) Check(ctx context.Context, in *grpc_health_v1.HealthCheckRequest, opts ...grpc.CallOption) (*grpc_health_v1.HealthCheckResponse, error) {
+	return c.server.Check(ctx, in)
+}
+
+// -- start Watch
+
+func (c *HealthClientDirect) Watch(ctx context.Context, in *grpc_health_v1.HealthCheckRequest, opts ...grpc.CallOption) (grpc_health_v1.Health_WatchClient, error) {
+	ch := make(chan *healthWatchReply, 16)
+	streamServer := &HealthWatchS{ch: ch, ctx: ctx}
+	go func() {
+		defer close(ch)
+		streamServer.Err(c.server.Watch(in, streamServer))
+	}()
+	return &HealthWatchC{ch: ch, ctx: ctx}, nil
+}
+
+type healthWatchReply struct {
+	r   *grpc_health_v1.HealthCheckResponse
+	err error
+}
+
+// HealthWatchS implements grpc_health_v1.Health_WatchServer
+type HealthWatchS struct {
+	ch  chan *healthWatchReply
+	ctx context.Context
+	grpc.ServerStream
+}
+
+func (s *HealthWatchS) Send(m *grpc_health_v1.HealthCheckResponse) error {
+	select {
+	case s.ch <- &healthWatchReply{r: m}:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+func (s *HealthWatchS) Context() context.Context { return s.ctx }
+func (s *HealthWatchS) Err(err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case s.ch <- &healthWatchReply{err: err}:
+	case <-s.ctx.Done():
+	}
+}
+
+type HealthWatchC struct {
+	ch  chan *healthWatchReply
+	ctx context.Context
+	grpc.ClientStream
+}
+
+func (c *HealthWatchC) Recv() (*grpc_health_v1.HealthCheckResponse, error) {
+	m, ok := <-c.ch
+	if !ok || m == nil {
+		return nil, io.EOF
+	}
+	return m.r, m.err
+}
+func (c *HealthWatchC) Context() context.Context { return c.ctx }
+
+// -- end Watch
@@ -0,0 +1,94 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestHealthClient(t *testing.T) {
+	server := health.NewServer()
+	server.SetServingStatus("txpool", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	grpcServer, conn := grpc.NewServer(), bufconn.Listen(1024*1024)
+	grpc_health_v1.RegisterHealthServer(grpcServer, server)
+	go func() { _ = grpcServer.Serve(conn) }()
+	defer grpcServer.Stop()
+	cc, err := grpc.Dial("", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, url string) (net.Conn, error) { return conn.Dial() }))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	clients := map[string]grpc_health_v1.HealthClient{
+		"direct": NewHealthClientDirect(server),
+		"remote": grpc_health_v1.NewHealthClient(cc),
+	}
+	for name, client := range clients {
+		client := client
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.SetServingStatus("txpool", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+			reply, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+			require.NoError(t, err)
+			require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, reply.Status)
+			_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "unknown"})
+			require.Equal(t, codes.NotFound, status.Code(err))
+
+			probe := HealthProbe("txpool", client, "txpool")
+			require.EqualError(t, probe.Check(ctx), "health status: NOT_SERVING")
+			require.NoError(t, HealthProbe("server", client, "").Check(ctx))
+
+			watchCtx, stopWatch := context.WithCancel(ctx)
+			defer stopWatch()
+			stream, err := client.Watch(watchCtx, &grpc_health_v1.HealthCheckRequest{Service: "txpool"})
+			require.NoError(t, err)
+			reply, err = stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, reply.Status)
+
+			server.SetServingStatus("txpool", grpc_health_v1.HealthCheckResponse_SERVING)
+			reply, err = stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, reply.Status)
+			require.NoError(t, probe.Check(ctx))
+
+			stopWatch()
+			for err == nil { // stream ends after cancellation
+				_, err = stream.Recv()
+			}
+		})
+	}
+
+	// server shutdown: all services are NOT_SERVING
+	server.Shutdown()
+	for _, client := range clients {
+		err := HealthProbe("server", client, "").Check(context.Background())
+		require.EqualError(t, err, "health status: NOT_SERVING")
+	}
+}
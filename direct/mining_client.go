@@ -36,6 +36,8 @@ func NewMiningClient(server txpool_proto.MiningServer) *MiningClient {
 	return &MiningClient{server: server}
 }
 
+func (s *MiningClient) Probe() Probe { return VersionProbe("mining", s) }
+
 func (s *MiningClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*types.VersionReply, error) {
 	return s.server.Version(ctx, in)
 }
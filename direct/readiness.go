@@ -0,0 +1,241 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/sentry"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Probe - readiness check of 1 component. Same probes work for direct and remote clients,
+// so orchestration layer can gate traffic on readiness of all components without custom code per service.
+type Probe interface {
+	Name() string
+	Check(ctx context.Context) error // nil - ready
+}
+
+type probeFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (p probeFunc) Name() string                    { return p.name }
+func (p probeFunc) Check(ctx context.Context) error { return p.check(ctx) }
+
+func NewProbe(name string, check func(ctx context.Context) error) Probe {
+	return probeFunc{name: name, check: check}
+}
+
+// HealthProbe - gRPC health protocol: `service` ("" - whole server) must be SERVING
+func HealthProbe(name string, client grpc_health_v1.HealthClient, service string) Probe {
+	return NewProbe(name, func(ctx context.Context) error {
+		reply, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if reply.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("health status: %s", reply.Status)
+		}
+		return nil
+	})
+}
+
+// VersionClient - common part of txpool, mining, ethbackend and kv clients
+type VersionClient interface {
+	Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*types.VersionReply, error)
+}
+
+// VersionProbe - component answers Version request
+func VersionProbe(name string, client VersionClient) Probe {
+	return NewProbe(name, func(ctx context.Context) error {
+		_, err := client.Version(ctx, &emptypb.Empty{})
+		return err
+	})
+}
+
+// DownloaderPeersProbe - downloader has metadata of all files and has peers to download them from.
+// Downloader which completed download doesn't need peers.
+func DownloaderPeersProbe(client proto_downloader.DownloaderClient) Probe {
+	return NewProbe("downloader", func(ctx context.Context) error {
+		stats, err := client.Stats(ctx, &proto_downloader.StatsRequest{})
+		if err != nil {
+			return err
+		}
+		if stats.Completed {
+			return nil
+		}
+		if stats.MetadataReady < stats.FilesTotal {
+			return fmt.Errorf("metadata of %d/%d files is ready", stats.MetadataReady, stats.FilesTotal)
+		}
+		if stats.PeersUnique == 0 {
+			return errors.New("no peers")
+		}
+		return nil
+	})
+}
+
+// SentryPeersProbe - sentry did handshake and has at least minPeers peers
+func SentryPeersProbe(client SentryClient, minPeers uint64) Probe {
+	return NewProbe("sentry", func(ctx context.Context) error {
+		if !client.Ready() {
+			return errors.New("not ready")
+		}
+		reply, err := client.PeerCount(ctx, &sentry.PeerCountRequest{})
+		if err != nil {
+			return err
+		}
+		if reply.Count < minPeers {
+			return fmt.Errorf("peers: %d, need %d", reply.Count, minPeers)
+		}
+		return nil
+	})
+}
+
+// StateVersionProbe - kv state version (id of last write transaction in db) is advancing:
+// stream of state changes delivered new version not longer than maxLag ago.
+// Run must be running in background, probe is not ready until first batch of changes.
+type StateVersionProbe struct {
+	client StateDiffClient
+	maxLag time.Duration
+	now    func() time.Time
+
+	lock    sync.Mutex
+	version uint64
+	updated time.Time
+	err     error
+}
+
+func NewStateVersionProbe(client StateDiffClient, maxLag time.Duration) *StateVersionProbe {
+	return &StateVersionProbe{client: client, maxLag: maxLag, now: time.Now}
+}
+
+func (p *StateVersionProbe) Name() string { return "kv state version" }
+
+// Run - subscribes to state changes and tracks their version until ctx is done or stream is broken
+func (p *StateVersionProbe) Run(ctx context.Context) error {
+	stream, err := p.client.StateChanges(ctx, &remote.StateChangeRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		p.setErr(err)
+		return err
+	}
+	for {
+		batch, err := stream.Recv()
+		if err != nil {
+			p.setErr(err)
+			return err
+		}
+		p.observe(batch.StateVersionID)
+	}
+}
+
+func (p *StateVersionProbe) observe(version uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.updated.IsZero() || version > p.version {
+		p.version, p.updated = version, p.now()
+	}
+	p.err = nil
+}
+
+func (p *StateVersionProbe) setErr(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.err = err
+}
+
+func (p *StateVersionProbe) Check(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return fmt.Errorf("state changes stream: %w", p.err)
+	}
+	if p.updated.IsZero() {
+		return errors.New("no state changes yet")
+	}
+	if lag := p.now().Sub(p.updated); lag > p.maxLag {
+		return fmt.Errorf("state version %d is not advancing for %s", p.version, lag.Round(time.Second))
+	}
+	return nil
+}
+
+// Readiness - result of probes of all components, by probe name
+type Readiness map[string]error
+
+// CheckReadiness - runs all probes concurrently, each one is limited by ctx.
+// Probe names must be unique - otherwise result of one probe would hide result of another.
+func CheckReadiness(ctx context.Context, probes ...Probe) (Readiness, error) {
+	res := make(Readiness, len(probes))
+	for _, p := range probes {
+		if _, ok := res[p.Name()]; ok {
+			return nil, fmt.Errorf("duplicate readiness probe name: %q", p.Name())
+		}
+		res[p.Name()] = nil
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Check(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			res[p.Name()] = err
+		}()
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// Ready - all probes are passed
+func (r Readiness) Ready() bool {
+	for _, err := range r {
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Err - nil if ready, otherwise error which lists failed probes
+func (r Readiness) Err() error {
+	var failed []string
+	for name, err := range r {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("not ready: %s", strings.Join(failed, "; "))
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	ok := func(name string) Probe { return NewProbe(name, func(ctx context.Context) error { return nil }) }
+	fail := func(name, msg string) Probe {
+		return NewProbe(name, func(ctx context.Context) error { return errors.New(msg) })
+	}
+	waitCtx := func(name string) Probe {
+		return NewProbe(name, func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() })
+	}
+
+	tests := []struct {
+		name    string
+		probes  []Probe
+		failed  []string
+		err     string
+		invalid bool
+	}{
+		{name: "no probes"},
+		{name: "all ready", probes: []Probe{ok("a"), ok("b")}},
+		{name: "one failed", probes: []Probe{ok("a"), fail("b", "boom")}, failed: []string{"b"}, err: "not ready: b: boom"},
+		{name: "failed are sorted", probes: []Probe{fail("c", "x"), ok("a"), fail("b", "y")}, failed: []string{"b", "c"}, err: "not ready: b: y; c: x"},
+		{name: "probe is limited by ctx", probes: []Probe{ok("a"), waitCtx("slow")}, failed: []string{"slow"}, err: "not ready: slow: context deadline exceeded"},
+		{name: "duplicate names", probes: []Probe{ok("a"), fail("a", "boom")}, invalid: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			r, err := CheckReadiness(ctx, tt.probes...)
+			if tt.invalid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, len(tt.probes), len(r))
+			var failed []string
+			for _, p := range tt.probes {
+				if r[p.Name()] != nil {
+					failed = append(failed, p.Name())
+				}
+			}
+			require.ElementsMatch(t, tt.failed, failed)
+			require.Equal(t, len(tt.failed) == 0, r.Ready())
+			if tt.err == "" {
+				require.NoError(t, r.Err())
+			} else {
+				require.EqualError(t, r.Err(), tt.err)
+			}
+		})
+	}
+}
@@ -136,6 +136,9 @@ func (c *SentryClientRemote) Ready() bool {
 	return c.ready
 }
 
+// Probe - see SentryPeersProbe
+func (c *SentryClientRemote) Probe(minPeers uint64) Probe { return SentryPeersProbe(c, minPeers) }
+
 func (c *SentryClientRemote) MarkDisconnected() {
 	c.Lock()
 	defer c.Unlock()
@@ -198,6 +201,9 @@ func (c *SentryClientDirect) Protocol() uint    { return c.protocol }
 func (c *SentryClientDirect) Ready() bool       { return true }
 func (c *SentryClientDirect) MarkDisconnected() {}
 
+// Probe - see SentryPeersProbe
+func (c *SentryClientDirect) Probe(minPeers uint64) Probe { return SentryPeersProbe(c, minPeers) }
+
 func (c *SentryClientDirect) PenalizePeer(ctx context.Context, in *sentry.PenalizePeerRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
 	return c.server.PenalizePeer(ctx, in)
 }
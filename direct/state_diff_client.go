@@ -19,6 +19,7 @@ package direct
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
 	"google.golang.org/grpc"
@@ -41,6 +42,11 @@ func NewStateDiffClientDirect(server remote.KVServer) *StateDiffClientDirect {
 	return &StateDiffClientDirect{server: server}
 }
 
+// Probe - see StateVersionProbe, its Run must be started by caller
+func (c *StateDiffClientDirect) Probe(maxLag time.Duration) *StateVersionProbe {
+	return NewStateVersionProbe(c, maxLag)
+}
+
 func (c *StateDiffClientDirect) Snapshots(ctx context.Context, in *remote.SnapshotsRequest, opts ...grpc.CallOption) (*remote.SnapshotsReply, error) {
 	return c.server.Snapshots(ctx, in)
 }
@@ -36,6 +36,8 @@ func NewTxPoolClient(server txpool_proto.TxpoolServer) *TxPoolClient {
 	return &TxPoolClient{server}
 }
 
+func (s *TxPoolClient) Probe() Probe { return VersionProbe("txpool", s) }
+
 func (s *TxPoolClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*types.VersionReply, error) {
 	return s.server.Version(ctx, in)
 }
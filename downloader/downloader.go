@@ -30,6 +30,7 @@ import (
 	"github.com/anacrolix/torrent/storage"
 	common2 "github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
 	"github.com/ledgerwatch/erigon-lib/downloader/downloadercfg"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
@@ -38,6 +39,16 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
+var (
+	downloadBytes   = metrics.GetOrCreateCounter(`downloader_bytes_total{direction="download"}`)
+	uploadBytes     = metrics.GetOrCreateCounter(`downloader_bytes_total{direction="upload"}`)
+	completedBytes  = metrics.GetOrCreateGauge(`downloader_completed_bytes`, nil)
+	totalBytes      = metrics.GetOrCreateGauge(`downloader_total_bytes`, nil)
+	progressPercent = metrics.GetOrCreateGauge(`downloader_progress_percent`, nil)
+	peersUnique     = metrics.GetOrCreateGauge(`downloader_peers`, nil)
+	filesTotal      = metrics.GetOrCreateGauge(`downloader_files`, nil)
+)
+
 // Downloader - component which downloading historical files. Can use BitTorrent, or other protocols
 type Downloader struct {
 	db                kv.RwDB
@@ -51,6 +62,9 @@ type Downloader struct {
 	stats     AggStats
 
 	folder storage.ClientImplCloser
+
+	ctx       context.Context // lifetime of Downloader: ctx of New, cancelled by Close. Background work must stop by it
+	ctxCancel context.CancelFunc
 }
 
 type AggStats struct {
@@ -109,6 +123,7 @@ func New(ctx context.Context, cfg *downloadercfg.Cfg) (*Downloader, error) {
 
 		statsLock: &sync.RWMutex{},
 	}
+	d.ctx, d.ctxCancel = context.WithCancel(ctx)
 	if err := d.addSegments(); err != nil {
 		return nil, err
 	}
@@ -172,6 +187,17 @@ func (d *Downloader) ReCalcStats(interval time.Duration) {
 	stats.FilesTotal = int32(len(torrents))
 
 	d.stats = stats
+	stats.updateMetrics()
+}
+
+func (s AggStats) updateMetrics() {
+	downloadBytes.Set(s.BytesDownload)
+	uploadBytes.Set(s.BytesUpload)
+	completedBytes.Set(float64(s.BytesCompleted))
+	totalBytes.Set(float64(s.BytesTotal))
+	progressPercent.Set(float64(s.Progress))
+	peersUnique.Set(float64(s.PeersUnique))
+	filesTotal.Set(float64(s.FilesTotal))
 }
 
 func moveFromTmp(snapDir string) error {
@@ -290,6 +316,7 @@ func (d *Downloader) Stats() AggStats {
 }
 
 func (d *Downloader) Close() {
+	d.ctxCancel()
 	d.torrentClient.Close()
 	if err := d.folder.Close(); err != nil {
 		log.Warn("[Snapshots] folder.close", "err", err)
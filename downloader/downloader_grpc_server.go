@@ -23,6 +23,7 @@ import (
 
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces"
 	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
 	prototypes "github.com/ledgerwatch/erigon-lib/gointerfaces/types"
@@ -50,12 +51,19 @@ func (s *GrpcServer) Download(ctx context.Context, request *proto_downloader.Dow
 
 	torrentClient := s.d.Torrent()
 	snapDir := s.d.SnapDir()
+	covered, merges, err := historyItemsCoveredLocally(ctx, snapDir, torrentClient, request.Items)
+	if err != nil {
+		return nil, err
+	}
 	for i, it := range request.Items {
 		select {
 		case <-logEvery.C:
 			log.Info("[snapshots] initializing", "files", fmt.Sprintf("%d/%d", i, len(request.Items)))
 		default:
 		}
+		if _, ok := covered[it.Path]; ok {
+			continue
+		}
 
 		if it.TorrentHash == nil {
 			// if we dont have the torrent hash then we seed a new snapshot
@@ -72,7 +80,11 @@ func (s *GrpcServer) Download(ctx context.Context, request *proto_downloader.Dow
 			continue
 		}
 
-		_, err := createMagnetLinkWithInfoHash(it.TorrentHash, torrentClient, snapDir)
+		var merge *snaptype.MergeReplacement
+		if m, ok := merges[it.Path]; ok {
+			merge = &m
+		}
+		_, err := createMagnetLinkWithInfoHash(s.d.ctx, it.TorrentHash, torrentClient, snapDir, merge)
 		if err != nil {
 			return nil, err
 		}
@@ -137,7 +149,9 @@ func seedNewSnapshot(it *proto_downloader.DownloadItem, torrentClient *torrent.C
 }
 
 // we dont have .seg or .torrent so we get them through the torrent hash
-func createMagnetLinkWithInfoHash(hash *prototypes.H160, torrentClient *torrent.Client, snapDir string) (bool, error) {
+// merge != nil - provider merged this file from files we have locally: their data is re-used, see reuseMergedParts
+// ctx - lifetime of Downloader (not of request): background work of added torrent stops by it
+func createMagnetLinkWithInfoHash(ctx context.Context, hash *prototypes.H160, torrentClient *torrent.Client, snapDir string, merge *snaptype.MergeReplacement) (bool, error) {
 	mi := &metainfo.MetaInfo{AnnounceList: Trackers}
 	if hash == nil {
 		return false, nil
@@ -159,13 +173,20 @@ func createMagnetLinkWithInfoHash(hash *prototypes.H160, torrentClient *torrent.
 		}
 		t.DisallowDataDownload()
 		t.AllowDataUpload()
-		<-t.GotInfo()
+		select {
+		case <-t.GotInfo():
+		case <-ctx.Done():
+			return
+		}
 
 		mi := t.Metainfo()
 		if err := CreateTorrentFileIfNotExists(snapDir, t.Info(), &mi); err != nil {
 			log.Warn("[downloader] create torrent file", "err", err)
 			return
 		}
+		if merge != nil {
+			reuseMergedParts(ctx, t, torrentClient, snapDir, *merge)
+		}
 	}(magnet.String())
 	//log.Debug("[downloader] downloaded both seg and torrent files", "hash", infoHash)
 	return false, nil
@@ -0,0 +1,236 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snaptype
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/verify"
+)
+
+var historyFileRegex = regexp.MustCompile("^([[:lower:]]+).([0-9]+)-([0-9]+).(v|ef)$")
+
+// HistoryFileInfo - parsed metadata of aggregator's file. Example: `accounts.0-32.ef`
+type HistoryFileInfo struct {
+	Name     string // accounts, storage, logaddrs, ...
+	From, To uint64 // steps [From, To)
+	Ext      string // .v, .ef
+	Path     string // relative to snapshots dir. Example: history/accounts.0-32.ef
+}
+
+func (f HistoryFileInfo) covers(o HistoryFileInfo) bool {
+	return f.Name == o.Name && f.Ext == o.Ext && f.From <= o.From && o.To <= f.To
+}
+
+func ParseHistoryFileName(dir, fileName string) (res HistoryFileInfo, ok bool) {
+	subs := historyFileRegex.FindStringSubmatch(fileName)
+	if len(subs) != 5 {
+		return res, false
+	}
+	from, err := strconv.ParseUint(subs[2], 10, 64)
+	if err != nil {
+		return res, false
+	}
+	to, err := strconv.ParseUint(subs[3], 10, 64)
+	if err != nil || from >= to {
+		return res, false
+	}
+	return HistoryFileInfo{Name: subs[1], From: from, To: to, Ext: "." + subs[4], Path: filepath.Join(dir, fileName)}, true
+}
+
+// Completeness - reports whether local file is complete: built locally or fully downloaded.
+// Partially downloaded files (pre-allocated by torrent client) don't cover remote files.
+type Completeness func(ctx context.Context, f HistoryFileInfo) (bool, error)
+
+// VerifiedByTorrent - file without .torrent was built locally (by Aggregator) and is complete, file with .torrent is
+// complete if all pieces match hashes of .torrent. Reads whole file: callers which have torrent client should check
+// completeness of its torrents first, and must not call it on request path.
+func VerifiedByTorrent(snapDir string) Completeness {
+	return func(ctx context.Context, f HistoryFileInfo) (bool, error) {
+		mi, err := metainfo.LoadFromFile(filepath.Join(snapDir, f.Path+".torrent"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return true, nil
+			}
+			return false, err
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return false, fmt.Errorf("%s.torrent: %w", f.Path, err)
+		}
+		results, err := verify.Files(ctx, []verify.Target{verify.TorrentTarget(&info, filepath.Join(snapDir, filepath.Dir(f.Path)))}, 1, nil)
+		if err != nil {
+			return false, err
+		}
+		return results[0].OK(), nil
+	}
+}
+
+// ParseHistoryDir - complete local aggregator's files in `snapDir/history`, `complete=nil` means VerifiedByTorrent
+func ParseHistoryDir(ctx context.Context, snapDir string, complete Completeness) (res []HistoryFileInfo, err error) {
+	if complete == nil {
+		complete = VerifiedByTorrent(snapDir)
+	}
+	files, err := os.ReadDir(filepath.Join(snapDir, "history"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []HistoryFileInfo{}, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !f.Type().IsRegular() {
+			continue
+		}
+		fileInfo, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.Size() == 0 {
+			continue
+		}
+		meta, ok := ParseHistoryFileName("history", f.Name())
+		if !ok {
+			continue
+		}
+		ok, err = complete(ctx, meta)
+		if err != nil {
+			return nil, fmt.Errorf("ParseHistoryDir: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		res = append(res, meta)
+	}
+	return res, nil
+}
+
+// HistoryDelta - compares local aggregator's files with remote manifest:
+//   - remote files which are sub-set of another remote file are ignored - the biggest (merged) file is preferred
+//   - remote files fully covered by local files are not needed
+//   - other remote files must be downloaded. Local files which are sub-set of such file are `replaced`:
+//     they can be removed after download (Aggregator does treat them as garbage when bigger file exists)
+func HistoryDelta(local, remote []HistoryFileInfo) (download, replaced []HistoryFileInfo) {
+	for i, r := range remote {
+		if isSubsetOfAnother(remote, i) {
+			continue
+		}
+		var haveLocally bool
+		for _, l := range local {
+			if l.covers(r) {
+				haveLocally = true
+				break
+			}
+		}
+		if haveLocally {
+			continue
+		}
+		download = append(download, r)
+		for _, l := range local {
+			if r.covers(l) && !slices.Contains(replaced, l) {
+				replaced = append(replaced, l)
+			}
+		}
+	}
+	sortHistoryFiles(download)
+	sortHistoryFiles(replaced)
+	return download, replaced
+}
+
+// HistoryDeltaFromDir - HistoryDelta with local files from `snapDir`
+func HistoryDeltaFromDir(ctx context.Context, snapDir string, remote []HistoryFileInfo) (download, replaced []HistoryFileInfo, err error) {
+	local, err := ParseHistoryDir(ctx, snapDir, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("HistoryDeltaFromDir: %w", err)
+	}
+	download, replaced = HistoryDelta(local, remote)
+	return download, replaced, nil
+}
+
+func isSubsetOfAnother(files []HistoryFileInfo, i int) bool {
+	for j, f := range files {
+		if j == i || !f.covers(files[i]) {
+			continue
+		}
+		if f.From == files[i].From && f.To == files[i].To && j > i { // duplicates: keep first one
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func sortHistoryFiles(files []HistoryFileInfo) {
+	slices.SortFunc(files, func(i, j HistoryFileInfo) bool {
+		if i.Name != j.Name {
+			return i.Name < j.Name
+		}
+		if i.Ext != j.Ext {
+			return i.Ext < j.Ext
+		}
+		if i.From != j.From {
+			return i.From < j.From
+		}
+		return i.To < j.To
+	})
+}
+
+// MergeReplacement - remote file which was merged by provider from smaller files, all of them are local:
+// data of Parts can be re-used as partial content of Merged, and Parts can be retired after download
+type MergeReplacement struct {
+	Merged HistoryFileInfo
+	Parts  []HistoryFileInfo // sorted, cover [Merged.From, Merged.To) without gaps and overlaps
+}
+
+// MergeReplacements - files of HistoryDelta's `download` which are exactly covered by local files.
+// Local files which are sub-set of another local file are ignored (same as Aggregator does).
+func MergeReplacements(local, remote []HistoryFileInfo) (res []MergeReplacement) {
+	download, _ := HistoryDelta(local, remote)
+	for _, r := range download {
+		var parts []HistoryFileInfo
+		for i, l := range local {
+			if r.covers(l) && !isSubsetOfAnother(local, i) {
+				parts = append(parts, l)
+			}
+		}
+		if len(parts) < 2 {
+			continue
+		}
+		sortHistoryFiles(parts)
+		next := r.From
+		for _, p := range parts {
+			if p.From != next {
+				break
+			}
+			next = p.To
+		}
+		if next != r.To {
+			continue
+		}
+		res = append(res, MergeReplacement{Merged: r, Parts: parts})
+	}
+	return res
+}
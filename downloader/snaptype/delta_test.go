@@ -0,0 +1,150 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snaptype
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/require"
+)
+
+func historyFiles(t *testing.T, names ...string) (res []HistoryFileInfo) {
+	t.Helper()
+	for _, name := range names {
+		f, ok := ParseHistoryFileName("history", name)
+		require.True(t, ok, name)
+		res = append(res, f)
+	}
+	return res
+}
+
+func paths(files []HistoryFileInfo) (res []string) {
+	for _, f := range files {
+		res = append(res, filepath.Base(f.Path))
+	}
+	return res
+}
+
+func TestHistoryDelta(t *testing.T) {
+	_, ok := ParseHistoryFileName("history", "v1-000000-000500-bodies.seg")
+	require.False(t, ok)
+
+	local := historyFiles(t,
+		"accounts.0-32.ef", "accounts.0-32.v",
+		"accounts.32-48.ef", "accounts.48-56.ef", "accounts.56-57.ef",
+		"storage.0-32.ef",
+	)
+	remote := historyFiles(t,
+		"accounts.0-32.ef", "accounts.0-32.v", // already have
+		"accounts.32-64.ef", "accounts.32-48.ef", "accounts.64-96.ef", // 32-48 is sub-set of 32-64
+		"accounts.32-64.v",
+		"storage.0-16.ef",                      // local has bigger
+		"storage.32-64.ef", "storage.32-64.ef", // duplicate
+	)
+	download, replaced := HistoryDelta(local, remote)
+	require.Equal(t, []string{"accounts.32-64.ef", "accounts.64-96.ef", "accounts.32-64.v", "storage.32-64.ef"}, paths(download))
+	require.Equal(t, []string{"accounts.32-48.ef", "accounts.48-56.ef", "accounts.56-57.ef"}, paths(replaced))
+
+	download, replaced = HistoryDelta(nil, remote)
+	require.Equal(t, 7, len(download))
+	require.Equal(t, 0, len(replaced))
+}
+
+func TestMergeReplacements(t *testing.T) {
+	local := historyFiles(t,
+		"accounts.0-32.ef",
+		"accounts.32-48.ef", "accounts.48-56.ef", "accounts.56-64.ef", "accounts.48-52.ef", // 48-52 is sub-set of 48-56
+		"accounts.64-80.ef", // gap: 80-96
+		"storage.0-16.ef",
+	)
+	remote := historyFiles(t,
+		"accounts.0-32.ef",                   // already have
+		"accounts.32-64.ef",                  // merged from 3 local files
+		"accounts.64-96.ef",                  // local files don't cover it
+		"storage.0-16.ef", "storage.0-32.ef", // only 1 local part: nothing to merge
+	)
+	res := MergeReplacements(local, remote)
+	require.Equal(t, 1, len(res))
+	require.Equal(t, "accounts.32-64.ef", filepath.Base(res[0].Merged.Path))
+	require.Equal(t, []string{"accounts.32-48.ef", "accounts.48-56.ef", "accounts.56-64.ef"}, paths(res[0].Parts))
+}
+
+func TestHistoryDeltaFromDir(t *testing.T) {
+	snapDir := t.TempDir()
+	download, _, err := HistoryDeltaFromDir(context.Background(), snapDir, historyFiles(t, "accounts.0-32.ef"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(download))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(snapDir, "history"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(snapDir, "history", "accounts.0-16.ef"), []byte{1}, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(snapDir, "history", "accounts.16-32.ef"), []byte{}, 0644)) // empty files are ignored
+	download, replaced, err := HistoryDeltaFromDir(context.Background(), snapDir, historyFiles(t, "accounts.0-32.ef", "accounts.0-16.ef"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"accounts.0-32.ef"}, paths(download))
+	require.Equal(t, []string{"accounts.0-16.ef"}, paths(replaced))
+	require.Equal(t, filepath.Join("history", "accounts.0-16.ef"), replaced[0].Path)
+}
+
+func TestParseHistoryDirIncomplete(t *testing.T) {
+	snapDir := t.TempDir()
+	dir := filepath.Join(snapDir, "history")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	path := filepath.Join(dir, "accounts.0-32.ef")
+	data := make([]byte, 3*256*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	info := metainfo.Info{PieceLength: 256 * 1024}
+	require.NoError(t, info.BuildFromFilePath(path))
+	infoBytes, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	f, err := os.Create(path + ".torrent")
+	require.NoError(t, err)
+	require.NoError(t, (&metainfo.MetaInfo{InfoBytes: infoBytes}).Write(f))
+	require.NoError(t, f.Close())
+
+	local, err := ParseHistoryDir(context.Background(), snapDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"accounts.0-32.ef"}, paths(local))
+
+	// pre-allocated by torrent client, but last piece is not downloaded yet
+	copy(data[2*256*1024:], make([]byte, 256*1024))
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	local, err = ParseHistoryDir(context.Background(), snapDir, nil)
+	require.NoError(t, err)
+	require.Empty(t, local)
+	download, _, err := HistoryDeltaFromDir(context.Background(), snapDir, historyFiles(t, "accounts.0-32.ef"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"accounts.0-32.ef"}, paths(download))
+
+	// verification is cancellable
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ParseHistoryDir(ctx, snapDir, nil)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// completeness is defined by caller
+	local, err = ParseHistoryDir(context.Background(), snapDir, func(ctx context.Context, f HistoryFileInfo) (bool, error) { return true, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, len(local))
+}
@@ -17,12 +17,9 @@
 package downloader
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1" //nolint:gosec
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -35,14 +32,15 @@ import (
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
-	"github.com/anacrolix/torrent/mmap_span"
-	"github.com/edsrzf/mmap-go"
 	common2 "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/cmp"
 	dir2 "github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/downloader/downloadercfg"
 	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
 	"github.com/ledgerwatch/erigon-lib/downloader/trackers"
+	"github.com/ledgerwatch/erigon-lib/downloader/verify"
+	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/log/v3"
 	atomic2 "go.uber.org/atomic"
@@ -189,6 +187,122 @@ func seedableHistorySnapshots(dir string) ([]string, error) {
 	return res, nil
 }
 
+// historyItemsCoveredLocally - requested history files which are already covered by local (same or bigger) files.
+// Smaller local files which will be replaced by requested merged files are only logged: Aggregator removes them when bigger file appears.
+// `merges` - requested files which provider merged from files we have locally (by path of merged file): their data is re-used.
+func historyItemsCoveredLocally(ctx context.Context, snapDir string, torrentClient *torrent.Client, items []*proto_downloader.DownloadItem) (covered map[string]struct{}, merges map[string]snaptype.MergeReplacement, err error) {
+	var remote []snaptype.HistoryFileInfo
+	for _, it := range items {
+		if it.TorrentHash == nil {
+			continue
+		}
+		f, ok := snaptype.ParseHistoryFileName(filepath.Dir(it.Path), filepath.Base(it.Path))
+		if !ok {
+			continue
+		}
+		remote = append(remote, f)
+	}
+	if len(remote) == 0 {
+		return nil, nil, nil
+	}
+	local, err := snaptype.ParseHistoryDir(ctx, snapDir, torrentCompleteness(snapDir, torrentClient))
+	if err != nil {
+		return nil, nil, err
+	}
+	download, replaced := snaptype.HistoryDelta(local, remote)
+	need := make(map[string]struct{}, len(download))
+	for _, f := range download {
+		need[f.Path] = struct{}{}
+	}
+	covered = map[string]struct{}{}
+	for _, f := range remote {
+		if _, ok := need[f.Path]; !ok {
+			covered[f.Path] = struct{}{}
+		}
+	}
+	for _, f := range replaced {
+		log.Debug("[snapshots] local file will be replaced by bigger one", "file", f.Path)
+	}
+	if len(covered) > 0 {
+		log.Info("[snapshots] skip files already covered by local files", "amount", len(covered), "download", len(download), "replaced", len(replaced))
+	}
+	merges = map[string]snaptype.MergeReplacement{}
+	for _, m := range snaptype.MergeReplacements(local, remote) {
+		merges[m.Merged.Path] = m
+	}
+	return covered, merges, nil
+}
+
+// torrentCompleteness - file is complete if its torrent is complete in torrentClient (by piece completion).
+// File without .torrent was built locally and is complete. File with .torrent which is not loaded in torrentClient
+// (yet) is not complete: it would require hashing of whole file on request path, see snaptype.VerifiedByTorrent.
+func torrentCompleteness(snapDir string, torrentClient *torrent.Client) snaptype.Completeness {
+	return func(ctx context.Context, f snaptype.HistoryFileInfo) (bool, error) {
+		mi, err := metainfo.LoadFromFile(filepath.Join(snapDir, f.Path+".torrent"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return true, nil
+			}
+			return false, err
+		}
+		if torrentClient == nil {
+			return false, nil
+		}
+		t, ok := torrentClient.Torrent(mi.HashInfoBytes())
+		if !ok || t.Info() == nil {
+			return false, nil
+		}
+		return t.Complete.Bool(), nil
+	}
+}
+
+// reuseMergedParts - provider replaced several small files by 1 merged: copy pieces of merged file from local parts,
+// then torrent client re-checks them and downloads only the rest. When merged file is complete: torrents of parts are
+// dropped and their .torrent files removed, data files of parts are removed by Aggregator (it treats them as garbage).
+func reuseMergedParts(ctx context.Context, t *torrent.Torrent, torrentClient *torrent.Client, snapDir string, m snaptype.MergeReplacement) {
+	parts := make([]string, 0, len(m.Parts))
+	for _, p := range m.Parts {
+		parts = append(parts, filepath.Join(snapDir, p.Path))
+	}
+	reused, err := verify.ReusePieces(ctx, t.Info(), filepath.Join(snapDir, t.Name()), parts)
+	if err != nil {
+		log.Warn("[snapshots] reuse local parts of merged file", "file", t.Name(), "err", err)
+		return
+	}
+	log.Info("[snapshots] reuse local parts of merged file", "file", t.Name(), "parts", len(parts), "pieces", fmt.Sprintf("%d/%d", reused, t.NumPieces()))
+	if reused > 0 {
+		t.VerifyData()
+	}
+
+	go func() {
+		select {
+		case <-t.Complete.On():
+		case <-t.Closed():
+			return
+		case <-ctx.Done():
+			return
+		}
+		retired := make(map[string]struct{}, len(m.Parts))
+		for _, p := range m.Parts {
+			retired[p.Path] = struct{}{}
+		}
+		for _, pt := range torrentClient.Torrents() {
+			if pt.Info() == nil {
+				continue
+			}
+			if _, ok := retired[pt.Name()]; ok {
+				pt.Drop()
+			}
+		}
+		for _, p := range m.Parts {
+			if err := os.Remove(filepath.Join(snapDir, p.Path+".torrent")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Warn("[snapshots] retire replaced file", "file", p.Path, "err", err)
+			}
+		}
+		log.Info("[snapshots] merged file downloaded, replaced files retired", "file", t.Name(), "retired", len(m.Parts))
+	}()
+}
+
 func buildTorrentIfNeed(fName, root string) (err error) {
 	fPath := filepath.Join(root, fName)
 	if dir2.FileExist(fPath + ".torrent") {
@@ -316,51 +430,6 @@ func segmentFileNameFromTorrentFileName(in string) string {
 	return in[0 : len(in)-len(ext)]
 }
 
-func mmapFile(name string) (mm mmap.MMap, err error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	fi, err := f.Stat()
-	if err != nil {
-		return
-	}
-	if fi.Size() == 0 {
-		return
-	}
-	return mmap.MapRegion(f, -1, mmap.RDONLY, mmap.COPY, 0)
-}
-
-func verifyTorrent(info *metainfo.Info, root string, consumer func(i int, good bool) error) error {
-	span := new(mmap_span.MMapSpan)
-	for _, file := range info.UpvertedFiles() {
-		filename := filepath.Join(append([]string{root, info.Name}, file.Path...)...)
-		mm, err := mmapFile(filename)
-		if err != nil {
-			return err
-		}
-		if int64(len(mm)) != file.Length {
-			return fmt.Errorf("file %q has wrong length", filename)
-		}
-		span.Append(mm)
-	}
-	span.InitIndex()
-	for i, numPieces := 0, info.NumPieces(); i < numPieces; i += 1 {
-		p := info.Piece(i)
-		hash := sha1.New() //nolint:gosec
-		_, err := io.Copy(hash, io.NewSectionReader(span, p.Offset(), p.Length()))
-		if err != nil {
-			return err
-		}
-		good := bytes.Equal(hash.Sum(nil), p.Hash().Bytes())
-		if err := consumer(i, good); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // AddTorrentFile - adding .torrent file to torrentClient (and checking their hashes), if .torrent file
 // added first time - pieces verification process will start (disk IO heavy) - Progress
 // kept in `piece completion storage` (surviving reboot). Once it done - no disk IO needed again.
@@ -395,6 +464,7 @@ func AddTorrentFile(torrentFilePath string, torrentClient *torrent.Client) (*tor
 
 var ErrSkip = fmt.Errorf("skip")
 
+// VerifyDtaFiles - checks pieces of all files which have .torrent, see verify.Files
 func VerifyDtaFiles(ctx context.Context, snapDir string) error {
 	logEvery := time.NewTicker(5 * time.Second)
 	defer logEvery.Stop()
@@ -403,7 +473,7 @@ func VerifyDtaFiles(ctx context.Context, snapDir string) error {
 	if err != nil {
 		return err
 	}
-	totalPieces := 0
+	targets := make([]verify.Target, 0, len(files))
 	for _, f := range files {
 		metaInfo, err := metainfo.LoadFromFile(f)
 		if err != nil {
@@ -413,41 +483,37 @@ func VerifyDtaFiles(ctx context.Context, snapDir string) error {
 		if err != nil {
 			return err
 		}
-		totalPieces += info.NumPieces()
+		targets = append(targets, verify.TorrentTarget(&info, snapDir))
 	}
 
-	j := 0
-	failsAmount := 0
-	for _, f := range files {
-		metaInfo, err := metainfo.LoadFromFile(f)
-		if err != nil {
-			return err
-		}
-		info, err := metaInfo.UnmarshalInfo()
-		if err != nil {
-			return err
-		}
-
-		if err = verifyTorrent(&info, snapDir, func(i int, good bool) error {
-			j++
-			if !good {
-				failsAmount++
-				log.Error("[Snapshots] Verify hash mismatch", "at piece", i, "file", info.Name)
-				return ErrSkip
-			}
+	progress := &background.Progress{}
+	progress.Name.Store("verify")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
 			select {
 			case <-logEvery.C:
-				log.Info("[Snapshots] Verify", "Progress", fmt.Sprintf("%.2f%%", 100*float64(j)/float64(totalPieces)))
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
+				log.Info("[Snapshots] Verify", "Progress", fmt.Sprintf("%.2f%%", 100*float64(progress.Processed.Load())/float64(progress.Total.Load())))
+			case <-done:
+				return
 			}
-			return nil
-		}); err != nil {
-			if errors.Is(ErrSkip, err) {
-				continue
-			}
-			return err
+		}
+	}()
+	results, err := verify.Files(ctx, targets, runtime.GOMAXPROCS(-1), progress)
+	if err != nil {
+		return err
+	}
+	failsAmount := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failsAmount++
+			log.Error("[Snapshots] Verify", "file", r.Name, "err", r.Err)
+			continue
+		}
+		for _, i := range r.BadPieces {
+			failsAmount++
+			log.Error("[Snapshots] Verify hash mismatch", "at piece", i, "file", r.Name)
 		}
 	}
 	if failsAmount > 0 {
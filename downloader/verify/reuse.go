@@ -0,0 +1,142 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package verify
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// ReusePieces - fills missing pieces of single-file torrent `info` at `dst` by data of local files `parts`:
+// provider can merge several small files into one, then most pieces of merged file already exist locally.
+// Blocks of parts are matched by hash of pieces: aligned by start of each part and by start of parts
+// concatenation. Pieces which already match at `dst` are not touched. Returns amount of copied pieces:
+// the rest must be downloaded. After that torrent client must re-check data (see torrent.Torrent.VerifyData).
+func ReusePieces(ctx context.Context, info *metainfo.Info, dst string, parts []string) (reused int, err error) {
+	if info.IsDir() {
+		return 0, fmt.Errorf("ReusePieces: %s is not single-file torrent", info.Name)
+	}
+	src := Target{Name: info.Name, Files: parts, Lengths: make([]int64, len(parts))}
+	var sizes []int64
+	for i, part := range parts {
+		src.Lengths[i] = -1
+		fi, err := os.Stat(part)
+		if err != nil {
+			return 0, fmt.Errorf("ReusePieces: %w", err)
+		}
+		sizes = append(sizes, fi.Size())
+	}
+	span, err := openSpan(&src)
+	if err != nil {
+		return 0, fmt.Errorf("ReusePieces: %w", err)
+	}
+	defer span.Close()
+
+	pieceLen := info.PieceLength
+	buf := make([]byte, pieceLen)
+	blocks := map[metainfo.Hash]int64{} // hash of block -> its offset in parts concatenation
+	addBlock := func(offset, length int64) error {
+		if _, err := span.ReadAt(buf[:length], offset); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		h := metainfo.Hash(sha1.Sum(buf[:length])) //nolint:gosec
+		if _, ok := blocks[h]; !ok {
+			blocks[h] = offset
+		}
+		return nil
+	}
+	var total int64
+	for _, size := range sizes {
+		for offset := int64(0); offset < size; offset += pieceLen {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			if err := addBlock(total+offset, min64(pieceLen, size-offset)); err != nil {
+				return 0, fmt.Errorf("ReusePieces: %w", err)
+			}
+		}
+		total += size
+	}
+	for offset := int64(0); offset < total; offset += pieceLen {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := addBlock(offset, min64(pieceLen, total-offset)); err != nil {
+			return 0, fmt.Errorf("ReusePieces: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, fmt.Errorf("ReusePieces: %w", err)
+	}
+	f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("ReusePieces: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("ReusePieces: %w", err)
+	}
+	if fi.Size() != info.Length {
+		if err := f.Truncate(info.Length); err != nil {
+			return 0, fmt.Errorf("ReusePieces: %w", err)
+		}
+	}
+	for i, numPieces := 0, info.NumPieces(); i < numPieces; i++ {
+		if err := ctx.Err(); err != nil {
+			return reused, err
+		}
+		p := info.Piece(i)
+		piece := buf[:p.Length()]
+		if _, err := f.ReadAt(piece, p.Offset()); err != nil && !errors.Is(err, io.EOF) {
+			return reused, fmt.Errorf("ReusePieces: %w", err)
+		}
+		if metainfo.Hash(sha1.Sum(piece)) == p.Hash() { //nolint:gosec
+			continue
+		}
+		offset, ok := blocks[p.Hash()]
+		if !ok {
+			continue
+		}
+		if _, err := span.ReadAt(piece, offset); err != nil && !errors.Is(err, io.EOF) {
+			return reused, fmt.Errorf("ReusePieces: %w", err)
+		}
+		if _, err := f.WriteAt(piece, p.Offset()); err != nil {
+			return reused, fmt.Errorf("ReusePieces: %w", err)
+		}
+		reused++
+	}
+	if err := f.Sync(); err != nil {
+		return reused, fmt.Errorf("ReusePieces: %w", err)
+	}
+	return reused, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
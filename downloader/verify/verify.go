@@ -0,0 +1,244 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package verify - client-side checksumming of snapshot files: by pieces of .torrent or by hash of whole file.
+// Used by downloader and by AggregatorV3.VerifyFiles - node has one notion of valid file.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/mmap_span"
+	"github.com/edsrzf/mmap-go"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"golang.org/x/sync/errgroup"
+)
+
+// Algo - hash function of pieces
+type Algo int
+
+const (
+	SHA1   Algo = iota // pieces of .torrent
+	SHA256             // whole files: content-addressed names, export manifests
+)
+
+func (a Algo) New() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New() //nolint:gosec
+	case SHA256:
+		return sha256.New()
+	default:
+		panic(fmt.Sprintf("unknown hash algo %d", a))
+	}
+}
+
+func (a Algo) String() string {
+	switch a {
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("algo(%d)", a)
+	}
+}
+
+// Piece - range of Target's data with expected hash. Hash can be shorter than output of Algo: then it's compared
+// with prefix of computed hash (content-addressed names embed only few bytes of hash).
+type Piece struct {
+	Offset, Length int64
+	Hash           []byte
+}
+
+// Target - one or more files hashed as continuous data (like files of multi-file torrent)
+type Target struct {
+	Name    string
+	Files   []string
+	Lengths []int64 // expected length of each file, -1 if unknown
+	Algo    Algo
+	Pieces  []Piece
+}
+
+// TorrentTarget - files of .torrent info, which are expected at root
+func TorrentTarget(info *metainfo.Info, root string) Target {
+	t := Target{Name: info.Name, Algo: SHA1}
+	for _, file := range info.UpvertedFiles() {
+		t.Files = append(t.Files, filepath.Join(append([]string{root, info.Name}, file.Path...)...))
+		t.Lengths = append(t.Lengths, file.Length)
+	}
+	for i, numPieces := 0, info.NumPieces(); i < numPieces; i++ {
+		p := info.Piece(i)
+		t.Pieces = append(t.Pieces, Piece{Offset: p.Offset(), Length: p.Length(), Hash: p.Hash().Bytes()})
+	}
+	return t
+}
+
+// FileTarget - 1 piece: whole file. Length is taken at verification time.
+func FileTarget(path string, algo Algo, expected []byte) Target {
+	return Target{Name: filepath.Base(path), Files: []string{path}, Lengths: []int64{-1}, Algo: algo, Pieces: []Piece{{Offset: 0, Length: -1, Hash: expected}}}
+}
+
+// Result - verification result of 1 Target
+type Result struct {
+	Name      string
+	Err       error // file is missing, has wrong length, or can't be read
+	BadPieces []int
+}
+
+func (r Result) OK() bool { return r.Err == nil && len(r.BadPieces) == 0 }
+
+// Size - sum of lengths of pieces in bytes, for progress. Pieces of unknown length are counted when target is opened.
+func (t Target) Size() (size int64) {
+	for _, p := range t.Pieces {
+		if p.Length > 0 {
+			size += p.Length
+		}
+	}
+	return size
+}
+
+// HashFile - hash of whole file content
+func HashFile(path string, algo Algo) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := algo.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func mmapFile(name string) (mm mmap.MMap, size int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() == 0 {
+		return
+	}
+	mm, err = mmap.MapRegion(f, -1, mmap.RDONLY, mmap.COPY, 0)
+	return mm, fi.Size(), err
+}
+
+func openSpan(t *Target) (*mmap_span.MMapSpan, error) {
+	span := new(mmap_span.MMapSpan)
+	var total int64
+	for i, name := range t.Files {
+		mm, size, err := mmapFile(name)
+		if err != nil {
+			span.Close()
+			return nil, err
+		}
+		if mm != nil {
+			span.Append(mm)
+		}
+		if t.Lengths[i] >= 0 && size != t.Lengths[i] {
+			span.Close()
+			return nil, fmt.Errorf("file %q has wrong length %d, expected %d", name, size, t.Lengths[i])
+		}
+		total += size
+	}
+	span.InitIndex()
+	t.Pieces = append([]Piece(nil), t.Pieces...) // targets can be verified again: after change of file length
+	for i := range t.Pieces {
+		if t.Pieces[i].Length < 0 {
+			t.Pieces[i].Length = total - t.Pieces[i].Offset
+		}
+	}
+	return span, nil
+}
+
+// Files - hashes pieces of targets by workers goroutines. Results are in order of targets.
+// If progress is not nil: Total and Processed are in bytes.
+// Mismatch of hash is not error: it's reported in Result, as well as missing or unreadable files.
+func Files(ctx context.Context, targets []Target, workers int, progress *background.Progress) ([]Result, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if progress != nil {
+		for _, t := range targets {
+			progress.Total.Add(uint64(t.Size()))
+		}
+	}
+	res := make([]Result, len(targets))
+	for ti := range targets {
+		t := targets[ti]
+		res[ti].Name = t.Name
+		sizeBefore := t.Size()
+		span, err := openSpan(&t)
+		if err != nil {
+			res[ti].Err = err
+			continue
+		}
+		if progress != nil {
+			progress.Total.Add(uint64(t.Size() - sizeBefore))
+		}
+		bad := make([]bool, len(t.Pieces))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(workers)
+		for i := range t.Pieces {
+			i := i
+			g.Go(func() error {
+				select {
+				case <-gctx.Done():
+					return gctx.Err()
+				default:
+				}
+				p := t.Pieces[i]
+				h := t.Algo.New()
+				if _, err := io.Copy(h, io.NewSectionReader(span, p.Offset, p.Length)); err != nil {
+					return fmt.Errorf("%s piece %d: %w", t.Name, i, err)
+				}
+				if sum := h.Sum(nil); len(p.Hash) > len(sum) || !bytes.Equal(sum[:len(p.Hash)], p.Hash) {
+					bad[i] = true
+				}
+				if progress != nil {
+					progress.Processed.Add(uint64(p.Length))
+				}
+				return nil
+			})
+		}
+		err = g.Wait()
+		span.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i, b := range bad {
+			if b {
+				res[ti].BadPieces = append(res[ti].BadPieces, i)
+			}
+		}
+	}
+	return res, nil
+}
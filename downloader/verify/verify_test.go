@@ -0,0 +1,103 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package verify
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiles(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "accounts.0-32.v")
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	require.NoError(os.WriteFile(path, data, 0644))
+
+	info := metainfo.Info{PieceLength: 64}
+	require.NoError(info.BuildFromFilePath(path))
+	sum, err := HashFile(path, SHA256)
+	require.NoError(err)
+	targets := []Target{TorrentTarget(&info, dir), FileTarget(path, SHA256, sum[:8])}
+
+	progress := &background.Progress{}
+	res, err := Files(context.Background(), targets, 4, progress)
+	require.NoError(err)
+	require.Len(res, 2)
+	for _, r := range res {
+		require.True(r.OK(), r.Name)
+	}
+	require.Equal(uint64(2000), progress.Total.Load())
+	require.Equal(uint64(2000), progress.Processed.Load())
+
+	data[130] ^= 0xff // piece 2
+	require.NoError(os.WriteFile(path, data, 0644))
+	res, err = Files(context.Background(), targets, 4, nil)
+	require.NoError(err)
+	require.Equal([]int{2}, res[0].BadPieces)
+	require.Equal([]int{0}, res[1].BadPieces)
+
+	require.NoError(os.WriteFile(path, data[:999], 0644))
+	res, err = Files(context.Background(), targets, 4, nil)
+	require.NoError(err)
+	require.ErrorContains(res[0].Err, "wrong length")
+	require.False(res[1].OK())
+
+	require.NoError(os.Remove(path))
+	res, err = Files(context.Background(), targets, 4, nil)
+	require.NoError(err)
+	require.Error(res[0].Err)
+	require.Error(res[1].Err)
+}
+
+func TestReusePieces(t *testing.T) {
+	require := require.New(t)
+	dir, partsDir := t.TempDir(), t.TempDir()
+	data := make([]byte, 600)
+	rand.New(rand.NewSource(1)).Read(data)
+	merged := filepath.Join(dir, "accounts.0-32.v")
+	require.NoError(os.WriteFile(merged, data, 0644))
+	info := metainfo.Info{PieceLength: 64}
+	require.NoError(info.BuildFromFilePath(merged))
+	require.NoError(os.Remove(merged))
+
+	parts := []string{filepath.Join(partsDir, "accounts.0-16.v"), filepath.Join(partsDir, "accounts.16-32.v")}
+	require.NoError(os.WriteFile(parts[0], data[:200], 0644))
+	require.NoError(os.WriteFile(parts[1], data[200:500], 0644)) // last 100 bytes are missing locally
+
+	reused, err := ReusePieces(context.Background(), &info, merged, parts)
+	require.NoError(err)
+	require.Equal(7, reused) // pieces 0-6: [0, 448)
+	res, err := Files(context.Background(), []Target{TorrentTarget(&info, dir)}, 1, nil)
+	require.NoError(err)
+	require.NoError(res[0].Err)
+	require.Equal([]int{7, 8, 9}, res[0].BadPieces)
+
+	reused, err = ReusePieces(context.Background(), &info, merged, parts)
+	require.NoError(err)
+	require.Equal(0, reused) // already in place
+}
@@ -25,14 +25,22 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ledgerwatch/log/v3"
 
 	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
 	"github.com/ledgerwatch/erigon-lib/kv"
 )
 
+var (
+	spillFiles   = metrics.GetOrCreateCounter(`etl_spill_files_total`)   // sorted buffers flushed to tmp files
+	spillRecords = metrics.GetOrCreateCounter(`etl_spill_records_total`) // records in such files
+	loadSeconds  = metrics.GetOrCreateHistogram(`etl_load_seconds`)
+)
+
 type LoadNextFunc func(originalK, k, v []byte) error
 type LoadFunc func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error
 type simpleLoadFunc func(k, v []byte) error
@@ -48,6 +56,7 @@ type Collector struct {
 	bufType       int
 	allFlushed    bool
 	autoClean     bool
+	compressTmp   bool
 }
 
 // NewCollectorFromFiles creates collector from existing files (left over from previous unsuccessful loading)
@@ -69,6 +78,7 @@ func NewCollectorFromFiles(logPrefix, tmpdir string) (*Collector, error) {
 			return nil, fmt.Errorf("collector from files - reading file info %s: %w", dirEntry.Name(), err)
 		}
 		var dataProvider fileDataProvider
+		dataProvider.compressed = strings.HasPrefix(fileInfo.Name(), compressedBufFilePrefix)
 		dataProvider.file, err = os.Open(filepath.Join(tmpdir, fileInfo.Name()))
 		if err != nil {
 			return nil, fmt.Errorf("collector from files - opening file %s: %w", fileInfo.Name(), err)
@@ -103,6 +113,10 @@ func (c *Collector) Collect(k, v []byte) error {
 
 func (c *Collector) LogLvl(v log.Lvl) { c.logLvl = v }
 
+// SetCompressTmpFiles - flushed buffers are written to tmpdir compressed: less temp-disk usage and IO, more CPU.
+// Call it before first Collect.
+func (c *Collector) SetCompressTmpFiles(v bool) { c.compressTmp = v }
+
 func (c *Collector) flushBuffer(canStoreInRam bool) error {
 	if c.buf.Len() == 0 {
 		return nil
@@ -115,7 +129,9 @@ func (c *Collector) flushBuffer(canStoreInRam bool) error {
 		c.allFlushed = true
 	} else {
 		doFsync := !c.autoClean /* is critical collector */
-		provider, err = FlushToDisk(c.logPrefix, c.buf, c.tmpdir, doFsync, c.logLvl)
+		spillFiles.Inc()
+		spillRecords.Add(c.buf.Len())
+		provider, err = flushToDisk(c.logPrefix, c.buf, c.tmpdir, doFsync, c.compressTmp, c.logLvl)
 	}
 	if err != nil {
 		return err
@@ -130,6 +146,7 @@ func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args Tr
 	if c.autoClean {
 		defer c.Close()
 	}
+	defer loadSeconds.UpdateDuration(time.Now())
 
 	if !c.allFlushed {
 		if e := c.flushBuffer(true); e != nil {
@@ -140,7 +157,7 @@ func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args Tr
 	bucket := toBucket
 
 	var cursor kv.RwCursor
-	haveSortingGuaranties := isIdentityLoadFunc(loadFunc) // user-defined loadFunc may change ordering
+	haveSortingGuaranties := isIdentityLoadFunc(loadFunc) && args.Transform == nil // user-defined loadFunc or Transform may change ordering
 	var lastKey []byte
 	if bucket != "" { // passing empty bucket name is valid case for etl when DB modification is not expected
 		var err error
@@ -255,6 +272,13 @@ func (c *Collector) Close() {
 // The subsequent iterations pop the heap again and load up the provider associated with it to get the next element after processing LoadFunc.
 // this continues until all providers have reached their EOF.
 func mergeSortFiles(logPrefix string, providers []dataProvider, loadFunc simpleLoadFunc, args TransformArgs) error {
+	var transform *transformPipeline
+	if args.Transform != nil {
+		transform = startTransform(args, loadFunc)
+		defer transform.close()
+		loadFunc = transform.add
+	}
+
 	h := &Heap{}
 	heap.Init(h)
 	for i, provider := range providers {
@@ -286,6 +310,9 @@ func mergeSortFiles(logPrefix string, providers []dataProvider, loadFunc simpleL
 			return fmt.Errorf("%s: error while reading next element from disk: %w", logPrefix, err)
 		}
 	}
+	if transform != nil {
+		return transform.flush()
+	}
 	return nil
 }
 
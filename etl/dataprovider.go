@@ -18,6 +18,7 @@ package etl
 
 import (
 	"bufio"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -35,10 +36,23 @@ type fileDataProvider struct {
 	file       *os.File
 	reader     io.Reader
 	byteReader io.ByteReader // Different interface to the same object as reader
+	compressed bool          // see Collector.SetCompressTmpFiles
+	decomp     io.ReadCloser
 }
 
+const (
+	bufFilePrefix           = "erigon-sortable-buf-"
+	compressedBufFilePrefix = "erigon-sortable-buf-z-" // deflate stream: NewCollectorFromFiles recognizes it by name
+)
+
 // FlushToDisk - `doFsync` is true only for 'critical' collectors (which should not loose).
 func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl log.Lvl) (dataProvider, error) {
+	return flushToDisk(logPrefix, b, tmpdir, doFsync, false, lvl)
+}
+
+// flushToDisk - `compressed` trades CPU for temp-disk space and IO: sorted buffers are well-compressible
+// (keys share prefixes), fastest deflate level is used.
+func flushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync, compressed bool, lvl log.Lvl) (dataProvider, error) {
 	if b.Len() == 0 {
 		return nil, nil
 	}
@@ -51,7 +65,11 @@ func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl lo
 		}
 	}
 
-	bufferFile, err := os.CreateTemp(tmpdir, "erigon-sortable-buf-")
+	prefix := bufFilePrefix
+	if compressed {
+		prefix = compressedBufFilePrefix
+	}
+	bufferFile, err := os.CreateTemp(tmpdir, prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -67,11 +85,23 @@ func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl lo
 		log.Log(lvl, fmt.Sprintf("[%s] Flushed buffer file", logPrefix), "name", bufferFile.Name())
 	}()
 
-	if err = b.Write(w); err != nil {
+	if !compressed {
+		if err = b.Write(w); err != nil {
+			return nil, fmt.Errorf("error writing entries to disk: %w", err)
+		}
+		return &fileDataProvider{file: bufferFile, reader: nil}, nil
+	}
+	zw, err := flate.NewWriter(w, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Write(zw); err != nil {
 		return nil, fmt.Errorf("error writing entries to disk: %w", err)
 	}
-
-	return &fileDataProvider{file: bufferFile, reader: nil}, nil
+	if err = zw.Close(); err != nil { // before w.Flush
+		return nil, fmt.Errorf("error writing entries to disk: %w", err)
+	}
+	return &fileDataProvider{file: bufferFile, reader: nil, compressed: true}, nil
 }
 
 func (p *fileDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
@@ -80,7 +110,13 @@ func (p *fileDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
 		if err != nil {
 			return nil, nil, err
 		}
-		r := bufio.NewReaderSize(p.file, BufIOSize)
+		var r *bufio.Reader
+		if p.compressed {
+			p.decomp = flate.NewReader(bufio.NewReaderSize(p.file, BufIOSize))
+			r = bufio.NewReaderSize(p.decomp, BufIOSize)
+		} else {
+			r = bufio.NewReaderSize(p.file, BufIOSize)
+		}
 		p.reader = r
 		p.byteReader = r
 
@@ -90,6 +126,10 @@ func (p *fileDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
 
 func (p *fileDataProvider) Dispose() uint64 {
 	info, _ := os.Stat(p.file.Name())
+	if p.decomp != nil {
+		_ = p.decomp.Close()
+		p.decomp = nil
+	}
 	_ = p.file.Close()
 	_ = os.Remove(p.file.Name())
 	if info == nil {
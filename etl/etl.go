@@ -71,6 +71,12 @@ type TransformArgs struct {
 	ExtractEndKey   []byte
 	BufferType      int
 	BufferSize      int
+
+	// Transform - optional, applied to records before LoadFunc by TransformWorkers goroutines (0 - GOMAXPROCS)
+	// in batches of TransformBatch records (0 - DefaultTransformBatch). Order of records is preserved.
+	Transform        TransformFunc
+	TransformWorkers int
+	TransformBatch   int
 }
 
 func Transform(
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -413,3 +414,79 @@ func TestReuseCollectorAfterLoad(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, see)
 }
+
+func TestTransformWorkers(t *testing.T) {
+	c := NewCollector("", t.TempDir(), NewSortableBuffer(1024)) // small buffer: records go through files
+	for i := 0; i < 10_000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("%d", i))))
+	}
+	var loaded []string
+	err := c.Load(nil, "", func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		loaded = append(loaded, string(k)+"="+string(v))
+		return nil
+	}, TransformArgs{
+		Transform: func(k, v []byte) ([]byte, []byte, error) {
+			return append(k, 'k'), append(v, 'v'), nil
+		},
+		TransformWorkers: 4,
+		TransformBatch:   100,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10_000, len(loaded))
+	for i, kv := range loaded {
+		require.Equal(t, fmt.Sprintf("%06dk=%dv", i, i), kv)
+	}
+
+	// error of transform stops load
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%06d", i)), nil))
+	}
+	errBroken := fmt.Errorf("broken")
+	loadedCount := 0
+	err = c.Load(nil, "", func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		loadedCount++
+		return nil
+	}, TransformArgs{
+		Transform: func(k, v []byte) ([]byte, []byte, error) {
+			if string(k) == "000500" {
+				return nil, nil, errBroken
+			}
+			return k, v, nil
+		},
+		TransformBatch: 10,
+	})
+	require.ErrorIs(t, err, errBroken)
+	require.Equal(t, 500, loadedCount)
+}
+
+func TestCompressTmpFiles(t *testing.T) {
+	tmp := t.TempDir()
+	c := NewCriticalCollector("", tmp, NewSortableBuffer(1024)) // small buffer: records go through files
+	c.SetCompressTmpFiles(true)
+	for i := 0; i < 10_000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("%d", i))))
+	}
+	require.NoError(t, c.flushBuffer(false))
+	require.Greater(t, len(c.dataProviders), 1)
+	for _, p := range c.dataProviders {
+		require.True(t, strings.HasPrefix(filepath.Base(p.(*fileDataProvider).file.Name()), compressedBufFilePrefix))
+	}
+
+	// files left over from unsuccessful loading are read back decompressed
+	c2, err := NewCollectorFromFiles("", tmp)
+	require.NoError(t, err)
+	var loaded []string
+	err = c2.Load(nil, "", func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		loaded = append(loaded, string(k)+"="+string(v))
+		return nil
+	}, TransformArgs{})
+	require.NoError(t, err)
+	require.Equal(t, 10_000, len(loaded))
+	for i, kv := range loaded {
+		require.Equal(t, fmt.Sprintf("%06d=%d", i, i), kv)
+	}
+	c.Close()
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Zero(t, len(entries))
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"runtime"
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// TransformFunc - CPU-heavy per-record work (hashing keys, re-encoding values) applied between merge-sort
+// of collected data and LoadFunc. Runs concurrently on TransformArgs.TransformWorkers goroutines,
+// so must not touch db. k and v are owned by func: result may reuse them.
+type TransformFunc func(k, v []byte) (newK, newV []byte, err error)
+
+const DefaultTransformBatch = 1024
+
+type transformBatch struct {
+	keys, vals [][]byte
+	err        error
+	done       chan struct{}
+}
+
+// transformPipeline - records are grouped into batches, batches are transformed by worker pool and passed to
+// load in order they were added. Load runs on caller's goroutine (RwTx is bound to thread): while it loads
+// oldest batch, workers transform next ones.
+type transformPipeline struct {
+	transform TransformFunc
+	load      simpleLoadFunc
+	batchSize int
+	workers   int
+
+	batch    *transformBatch
+	inFlight []*transformBatch
+	jobs     chan *transformBatch
+	stopped  atomic.Bool
+	wg       sync.WaitGroup
+}
+
+func startTransform(args TransformArgs, load simpleLoadFunc) *transformPipeline {
+	p := &transformPipeline{transform: args.Transform, load: load, batchSize: args.TransformBatch, workers: args.TransformWorkers}
+	if p.batchSize <= 0 {
+		p.batchSize = DefaultTransformBatch
+	}
+	if p.workers <= 0 {
+		p.workers = runtime.GOMAXPROCS(-1)
+	}
+	p.jobs = make(chan *transformBatch, p.workers+1) // in-flight batches <= workers+1: send never blocks
+	p.batch = p.newBatch()
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *transformPipeline) newBatch() *transformBatch {
+	return &transformBatch{keys: make([][]byte, 0, p.batchSize), vals: make([][]byte, 0, p.batchSize), done: make(chan struct{})}
+}
+
+func (p *transformPipeline) work() {
+	defer p.wg.Done()
+	for b := range p.jobs {
+		for i := range b.keys {
+			if p.stopped.Load() {
+				break
+			}
+			if b.keys[i], b.vals[i], b.err = p.transform(b.keys[i], b.vals[i]); b.err != nil {
+				break
+			}
+		}
+		close(b.done)
+	}
+}
+
+// add - k, v are copied: providers re-use their buffers
+func (p *transformPipeline) add(k, v []byte) error {
+	p.batch.keys = append(p.batch.keys, common.Copy(k))
+	p.batch.vals = append(p.batch.vals, common.Copy(v))
+	if len(p.batch.keys) < p.batchSize {
+		return nil
+	}
+	return p.send()
+}
+
+func (p *transformPipeline) send() error {
+	b := p.batch
+	p.batch = p.newBatch()
+	p.jobs <- b
+	p.inFlight = append(p.inFlight, b)
+	for len(p.inFlight) > p.workers {
+		if err := p.loadOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *transformPipeline) loadOldest() error {
+	b := p.inFlight[0]
+	p.inFlight = p.inFlight[1:]
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+	for i := range b.keys {
+		if err := p.load(b.keys[i], b.vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush - transforms and loads all added records
+func (p *transformPipeline) flush() error {
+	if len(p.batch.keys) > 0 {
+		if err := p.send(); err != nil {
+			return err
+		}
+	}
+	for len(p.inFlight) > 0 {
+		if err := p.loadOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close - stops workers, not loaded batches are dropped
+func (p *transformPipeline) close() {
+	p.stopped.Store(true)
+	close(p.jobs)
+	p.wg.Wait()
+	p.inFlight = nil
+}
@@ -0,0 +1,450 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package backup - logical dump/restore of kv.RwDB tables.
+// Dump format doesn't depend on MDBX page size - it's useful for migration between page sizes
+// and for rescue of data from partially corrupted db.
+//
+// Layout of dump directory:
+//
+//	manifest.json                 - list of tables, their flags and chunks with checksums
+//	<table>.<chunkNum>.kv.gz      - gzip-ed stream of records: uvarint(len(k)), k, uvarint(len(v)), v
+//
+// DupSort tables are dumped as logical (k, v) pairs - every duplicate is a separated record,
+// restore puts them back by Append (so restore into empty table is O(n)).
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+const (
+	ManifestFileName = "manifest.json"
+	FormatVersion    = 1
+
+	DefaultChunkSize = 512 * datasize.MB
+)
+
+var ErrChecksumMismatch = errors.New("backup: chunk checksum mismatch")
+
+type Manifest struct {
+	Version  int          `json:"version"`
+	PageSize uint64       `json:"pageSize"`
+	Tables   []TableEntry `json:"tables"`
+}
+
+type TableEntry struct {
+	Name                      string        `json:"name"`
+	Flags                     kv.TableFlags `json:"flags"`
+	AutoDupSortKeysConversion bool          `json:"autoDupSortKeysConversion,omitempty"`
+	Records                   uint64        `json:"records"`
+	Chunks                    []ChunkEntry  `json:"chunks"`
+}
+
+type ChunkEntry struct {
+	File    string `json:"file"`
+	Sha256  string `json:"sha256"` // of compressed file
+	Records uint64 `json:"records"`
+	Size    uint64 `json:"size"` // uncompressed size of records
+}
+
+// Progress - called after each chunk. `records` is amount of records of `table` processed so far.
+type Progress func(table string, records uint64)
+
+type Cfg struct {
+	// Include - if not empty, only these tables are processed
+	Include []string
+	// Exclude - tables to skip. Applied after Include
+	Exclude []string
+	// ChunkSize - limit of uncompressed records size in 1 file
+	ChunkSize        datasize.ByteSize
+	CompressionLevel int
+	Progress         Progress
+}
+
+func NewCfg() Cfg {
+	return Cfg{ChunkSize: DefaultChunkSize, CompressionLevel: gzip.DefaultCompression}
+}
+
+func (cfg Cfg) filter(tables []string) []string {
+	include := map[string]struct{}{}
+	for _, t := range cfg.Include {
+		include[t] = struct{}{}
+	}
+	exclude := map[string]struct{}{}
+	for _, t := range cfg.Exclude {
+		exclude[t] = struct{}{}
+	}
+	res := make([]string, 0, len(tables))
+	for _, t := range tables {
+		if _, ok := include[t]; len(include) > 0 && !ok {
+			continue
+		}
+		if _, ok := exclude[t]; ok {
+			continue
+		}
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Dump - writes all (filtered) tables of `db` into `dir`. All tables are read in 1 read transaction - dump is consistent.
+func Dump(ctx context.Context, db kv.RoDB, dir string, cfg Cfg) (*Manifest, error) {
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = DefaultChunkSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tablesCfg := db.AllBuckets()
+	names := make([]string, 0, len(tablesCfg))
+	for name, tCfg := range tablesCfg {
+		if tCfg.IsDeprecated {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	m := &Manifest{Version: FormatVersion, PageSize: db.PageSize()}
+	if err := db.View(ctx, func(tx kv.Tx) error {
+		for _, name := range cfg.filter(names) {
+			entry, err := dumpTable(ctx, tx, name, tablesCfg[name], dir, cfg)
+			if err != nil {
+				return fmt.Errorf("dump %s: %w", name, err)
+			}
+			m.Tables = append(m.Tables, entry)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(dir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func dumpTable(ctx context.Context, tx kv.Tx, table string, tCfg kv.TableCfgItem, dir string, cfg Cfg) (TableEntry, error) {
+	entry := TableEntry{Name: table, Flags: tCfg.Flags, AutoDupSortKeysConversion: tCfg.AutoDupSortKeysConversion}
+	c, err := tx.Cursor(table)
+	if err != nil {
+		return entry, err
+	}
+	defer c.Close()
+
+	var w *chunkWriter
+	defer func() {
+		if w != nil { // unfinished chunk on error
+			w.abort()
+		}
+	}()
+	finishChunk := func() error {
+		if w == nil {
+			return nil
+		}
+		chunk, err := w.Close()
+		w = nil
+		if err != nil {
+			return err
+		}
+		entry.Chunks = append(entry.Chunks, chunk)
+		if cfg.Progress != nil {
+			cfg.Progress(table, entry.Records)
+		}
+		return nil
+	}
+
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return entry, err
+		}
+		if w == nil {
+			select {
+			case <-ctx.Done():
+				return entry, ctx.Err()
+			default:
+			}
+			if w, err = newChunkWriter(dir, fmt.Sprintf("%s.%d.kv.gz", table, len(entry.Chunks)), cfg.CompressionLevel); err != nil {
+				return entry, err
+			}
+		}
+		if err = w.Add(k, v); err != nil {
+			return entry, err
+		}
+		entry.Records++
+		if w.size >= uint64(cfg.ChunkSize) {
+			if err = finishChunk(); err != nil {
+				return entry, err
+			}
+		}
+	}
+	if err = finishChunk(); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// Restore - reads dump from `dir` and writes it to `db`. Tables are cleared before restore.
+// Table flags in target db must match flags recorded in the dump (restore into non-dupsort table of dupsort data
+// will silently lose data).
+// Every chunk is written in own RwTx - `db` must not be used by other writers until Restore finished.
+func Restore(ctx context.Context, db kv.RwDB, dir string, cfg Cfg) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	tablesCfg := db.AllBuckets()
+	names := make([]string, 0, len(m.Tables))
+	entries := make(map[string]TableEntry, len(m.Tables))
+	for _, entry := range m.Tables {
+		names = append(names, entry.Name)
+		entries[entry.Name] = entry
+	}
+	for _, name := range cfg.filter(names) {
+		entry := entries[name]
+		tCfg, ok := tablesCfg[name]
+		if !ok {
+			return fmt.Errorf("restore %s: %w", name, kv.ErrUnknownBucket)
+		}
+		if tCfg.Flags != entry.Flags || tCfg.AutoDupSortKeysConversion != entry.AutoDupSortKeysConversion {
+			return fmt.Errorf("restore %s: table flags mismatch: dump=%d, db=%d", name, entry.Flags, tCfg.Flags)
+		}
+		if err := restoreTable(ctx, db, dir, entry, cfg); err != nil {
+			return fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func restoreTable(ctx context.Context, db kv.RwDB, dir string, entry TableEntry, cfg Cfg) error {
+	if err := db.Update(ctx, func(tx kv.RwTx) error { return tx.ClearBucket(entry.Name) }); err != nil {
+		return err
+	}
+	var records uint64
+	for _, chunk := range entry.Chunks {
+		if err := db.Update(ctx, func(tx kv.RwTx) error {
+			c, err := tx.RwCursor(entry.Name)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			return ReadChunk(dir, chunk, func(k, v []byte) error {
+				records++
+				return c.Append(k, v)
+			})
+		}); err != nil {
+			return err
+		}
+		if cfg.Progress != nil {
+			cfg.Progress(entry.Name, records)
+		}
+	}
+	if records != entry.Records {
+		return fmt.Errorf("records amount mismatch: manifest=%d, restored=%d", entry.Records, records)
+	}
+	return nil
+}
+
+// Verify - checks checksums of all chunks in dump directory, without decompression
+func Verify(dir string) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range m.Tables {
+		for _, chunk := range entry.Chunks {
+			if err := verifyChunk(dir, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadChunk - verifies checksum of chunk and streams it's records to `walker`.
+// k, v are valid only until walker returns.
+func ReadChunk(dir string, chunk ChunkEntry, walker func(k, v []byte) error) error {
+	if err := verifyChunk(dir, chunk); err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, chunk.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReaderSize(f, 1024*1024))
+	if err != nil {
+		return fmt.Errorf("%s: %w", chunk.File, err)
+	}
+	defer gz.Close()
+	r := bufio.NewReaderSize(gz, 1024*1024)
+
+	var k, v []byte
+	for i := uint64(0); i < chunk.Records; i++ {
+		if k, err = readField(r, k[:0]); err != nil {
+			return fmt.Errorf("%s: record %d: %w", chunk.File, i, err)
+		}
+		if v, err = readField(r, v[:0]); err != nil {
+			return fmt.Errorf("%s: record %d: %w", chunk.File, i, err)
+		}
+		if err = walker(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readField(r *bufio.Reader, buf []byte) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(cap(buf)) < l {
+		buf = make([]byte, l)
+	}
+	buf = buf[:l]
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func verifyChunk(dir string, chunk ChunkEntry) error {
+	f, err := os.Open(filepath.Join(dir, chunk.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != chunk.Sha256 {
+		return fmt.Errorf("%w: %s, expected=%s, got=%s", ErrChecksumMismatch, chunk.File, chunk.Sha256, got)
+	}
+	return nil
+}
+
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", ManifestFileName, err)
+	}
+	if m.Version != FormatVersion {
+		return nil, fmt.Errorf("%s: unsupported format version %d", ManifestFileName, m.Version)
+	}
+	return m, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ManifestFileName+".tmp")
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestFileName))
+}
+
+type chunkWriter struct {
+	f       *os.File
+	h       hash.Hash
+	gz      *gzip.Writer
+	w       *bufio.Writer
+	name    string
+	size    uint64
+	records uint64
+	numBuf  [binary.MaxVarintLen64]byte
+}
+
+func newChunkWriter(dir, name string, level int) (*chunkWriter, error) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	gz, err := gzip.NewWriterLevel(io.MultiWriter(f, h), level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &chunkWriter{f: f, h: h, gz: gz, w: bufio.NewWriterSize(gz, 1024*1024), name: name}, nil
+}
+
+func (w *chunkWriter) Add(k, v []byte) error {
+	if err := w.addField(k); err != nil {
+		return err
+	}
+	if err := w.addField(v); err != nil {
+		return err
+	}
+	w.records++
+	return nil
+}
+
+func (w *chunkWriter) addField(b []byte) error {
+	n := binary.PutUvarint(w.numBuf[:], uint64(len(b)))
+	if _, err := w.w.Write(w.numBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	w.size += uint64(n + len(b))
+	return nil
+}
+
+func (w *chunkWriter) Close() (ChunkEntry, error) {
+	defer w.f.Close()
+	if err := w.w.Flush(); err != nil {
+		return ChunkEntry{}, err
+	}
+	if err := w.gz.Close(); err != nil {
+		return ChunkEntry{}, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return ChunkEntry{}, err
+	}
+	return ChunkEntry{File: w.name, Sha256: hex.EncodeToString(w.h.Sum(nil)), Records: w.records, Size: w.size}, nil
+}
+
+func (w *chunkWriter) abort() {
+	w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func fillTestDB(t *testing.T, db kv.RwDB) {
+	t.Helper()
+	err := db.Update(context.Background(), func(tx kv.RwTx) error {
+		for i := uint64(0); i < 1000; i++ {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, i)
+			if err := tx.Put(kv.Headers, k, k); err != nil {
+				return err
+			}
+			for j := uint64(0); j < 3; j++ {
+				v := make([]byte, 8)
+				binary.BigEndian.PutUint64(v, i*10+j)
+				if err := tx.Put(kv.AccountChangeSet, k, v); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Put(kv.DatabaseInfo, []byte("k"), []byte("v"))
+	})
+	require.NoError(t, err)
+}
+
+func tableContent(t *testing.T, db kv.RoDB, table string) (keys, vals [][]byte) {
+	t.Helper()
+	err := db.View(context.Background(), func(tx kv.Tx) error {
+		return tx.ForEach(table, nil, func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			vals = append(vals, append([]byte{}, v...))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	return keys, vals
+}
+
+func TestDumpRestore(t *testing.T) {
+	require := require.New(t)
+	ctx, dir := context.Background(), t.TempDir()
+	src, dst := memdb.NewTestDB(t), memdb.NewTestDB(t)
+	fillTestDB(t, src)
+
+	var progressCalls int
+	cfg := NewCfg()
+	cfg.ChunkSize = 4096
+	cfg.Include = []string{kv.Headers, kv.AccountChangeSet, kv.DatabaseInfo}
+	cfg.Exclude = []string{kv.DatabaseInfo}
+	cfg.Progress = func(table string, records uint64) { progressCalls++ }
+
+	m, err := Dump(ctx, src, dir, cfg)
+	require.NoError(err)
+	require.Equal(2, len(m.Tables))
+	require.Equal(kv.AccountChangeSet, m.Tables[0].Name)
+	require.Equal(uint64(3000), m.Tables[0].Records)
+	require.Greater(len(m.Tables[0].Chunks), 1)
+	require.Equal(uint64(1000), m.Tables[1].Records)
+	require.NoError(Verify(dir))
+
+	require.NoError(Restore(ctx, dst, dir, cfg))
+	require.Greater(progressCalls, 4)
+	for _, table := range []string{kv.Headers, kv.AccountChangeSet} {
+		expectK, expectV := tableContent(t, src, table)
+		gotK, gotV := tableContent(t, dst, table)
+		require.Equal(expectK, gotK, table)
+		require.Equal(expectV, gotV, table)
+	}
+	gotK, _ := tableContent(t, dst, kv.DatabaseInfo)
+	require.Equal(0, len(gotK))
+
+	t.Run("corrupted chunk", func(t *testing.T) {
+		f := filepath.Join(dir, m.Tables[1].Chunks[0].File)
+		data, err := os.ReadFile(f)
+		require.NoError(err)
+		data[len(data)/2]++
+		require.NoError(os.WriteFile(f, data, 0644))
+		require.ErrorIs(Verify(dir), ErrChecksumMismatch)
+		require.ErrorIs(Restore(ctx, dst, dir, cfg), ErrChecksumMismatch)
+	})
+}
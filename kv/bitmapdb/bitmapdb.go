@@ -136,6 +136,23 @@ func WalkChunkWithKeys(k []byte, m *roaring.Bitmap, sizeLimit uint64, f func(chu
 // starts from hot shard, stops when shard not overlap with [from-to)
 // !Important: [from, to)
 func TruncateRange(db kv.RwTx, bucket string, key []byte, to uint32) error {
+	buf := bytes.NewBuffer(nil)
+	return truncateRange(db, bucket, key, to, func(chunk *roaring.Bitmap) ([]byte, error) {
+		buf.Reset()
+		if _, err := chunk.WriteTo(buf); err != nil {
+			return nil, err
+		}
+		return libcommon.Copy(buf.Bytes()), nil
+	})
+}
+
+// TruncateRangeHybrid - same as TruncateRange, but writes chunks by EncodeChunk.
+// Opt-in for tables which are read only by DecodeChunk/Get - see ChunkEncoding.
+func TruncateRangeHybrid(db kv.RwTx, bucket string, key []byte, to uint32) error {
+	return truncateRange(db, bucket, key, to, EncodeChunk)
+}
+
+func truncateRange(db kv.RwTx, bucket string, key []byte, to uint32, encode func(chunk *roaring.Bitmap) ([]byte, error)) error {
 	chunkKey := make([]byte, len(key)+4)
 	copy(chunkKey, key)
 	binary.BigEndian.PutUint32(chunkKey[len(chunkKey)-4:], to)
@@ -165,13 +182,12 @@ func TruncateRange(db kv.RwTx, bucket string, key []byte, to uint32) error {
 		return err
 	}
 
-	buf := bytes.NewBuffer(nil)
 	return WalkChunkWithKeys(key, bm, ChunkLimit, func(chunkKey []byte, chunk *roaring.Bitmap) error {
-		buf.Reset()
-		if _, err := chunk.WriteTo(buf); err != nil {
+		v, err := encode(chunk)
+		if err != nil {
 			return err
 		}
-		return db.Put(bucket, chunkKey, libcommon.Copy(buf.Bytes()))
+		return db.Put(bucket, chunkKey, v)
 	})
 }
 
@@ -197,7 +213,7 @@ func Get(db kv.Tx, bucket string, key []byte, from, to uint32) (*roaring.Bitmap,
 		}
 		bm := NewBitmap()
 		defer ReturnToPool(bm)
-		if _, err := bm.ReadFrom(bytes.NewReader(v)); err != nil {
+		if err := DecodeChunk(v, bm); err != nil {
 			return nil, err
 		}
 		chunks = append(chunks, bm)
@@ -286,6 +302,23 @@ func WalkChunkWithKeys64(k []byte, m *roaring64.Bitmap, sizeLimit uint64, f func
 // starts from hot shard, stops when shard not overlap with [from-to)
 // !Important: [from, to)
 func TruncateRange64(db kv.RwTx, bucket string, key []byte, to uint64) error {
+	buf := bytes.NewBuffer(nil)
+	return truncateRange64(db, bucket, key, to, func(chunk *roaring64.Bitmap) ([]byte, error) {
+		buf.Reset()
+		if _, err := chunk.WriteTo(buf); err != nil {
+			return nil, err
+		}
+		return libcommon.Copy(buf.Bytes()), nil
+	})
+}
+
+// TruncateRange64Hybrid - same as TruncateRange64, but writes chunks by EncodeChunk64.
+// Opt-in for tables which are read only by DecodeChunk64/Get64 - see ChunkEncoding.
+func TruncateRange64Hybrid(db kv.RwTx, bucket string, key []byte, to uint64) error {
+	return truncateRange64(db, bucket, key, to, EncodeChunk64)
+}
+
+func truncateRange64(db kv.RwTx, bucket string, key []byte, to uint64, encode func(chunk *roaring64.Bitmap) ([]byte, error)) error {
 	chunkKey := make([]byte, len(key)+8)
 	copy(chunkKey, key)
 	binary.BigEndian.PutUint64(chunkKey[len(chunkKey)-8:], to)
@@ -320,13 +353,12 @@ func TruncateRange64(db kv.RwTx, bucket string, key []byte, to uint64) error {
 		return err
 	}
 
-	buf := bytes.NewBuffer(nil)
 	return WalkChunkWithKeys64(key, bm, ChunkLimit, func(chunkKey []byte, chunk *roaring64.Bitmap) error {
-		buf.Reset()
-		if _, err := chunk.WriteTo(buf); err != nil {
+		v, err := encode(chunk)
+		if err != nil {
 			return err
 		}
-		return db.Put(bucket, chunkKey, libcommon.Copy(buf.Bytes()))
+		return db.Put(bucket, chunkKey, v)
 	})
 }
 
@@ -353,8 +385,7 @@ func Get64(db kv.Tx, bucket string, key []byte, from, to uint64) (*roaring64.Bit
 		}
 		bm := NewBitmap64()
 		defer ReturnToPool64(bm)
-		_, err := bm.ReadFrom(bytes.NewReader(v))
-		if err != nil {
+		if err := DecodeChunk64(v, bm); err != nil {
 			return nil, err
 		}
 		chunks = append(chunks, bm)
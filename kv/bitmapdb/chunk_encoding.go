@@ -0,0 +1,298 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bitmapdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// ChunkEncoding - encoding of 1 chunk of bitmap stored in DB row.
+// EncodeChunk picks the cheapest one for each chunk: roaring containers have fixed per-container overhead,
+// which is pessimal for typical chunks (a few hundreds of values of 1 key, or long runs of dense keys like popular log topics).
+//
+// Tagged rows start with chunkTag and encoding byte. Rows of ChunkRoaring are not tagged - same as rows written before
+// hybrid encoding was introduced. Untagged rows never start with chunkTag followed by a valid encoding:
+// 32-bit roaring starts with cookie 0x3A30 or 0x3B30, 64-bit roaring starts with little-endian uint64 amount of 32-bit buckets -
+// second byte of it is non-zero only for rows bigger than 3Kb.
+//
+// Hybrid encoding is opt-in for writers (EncodeChunk, TruncateRangeHybrid): tagged rows can't be read by older binaries
+// and by code which decodes rows by roaring directly, so writers of shared index tables (LogTopicIndex, TracesToIndex, etc.)
+// keep roaring - making hybrid the default requires bump of kv.DBSchemaVersion. Readers (DecodeChunk, Get) accept all encodings.
+type ChunkEncoding byte
+
+const (
+	ChunkRoaring ChunkEncoding = iota // roaring portable serialization (with run containers)
+	ChunkArray                        // uvarint deltas of sorted values
+	ChunkRuns                         // uvarint pairs: (gap from end of previous run, length of run - 1)
+	ChunkBitmap                       // uvarint minimum, then bitset of [minimum, maximum]
+)
+
+const chunkTag = 0xFF
+
+func (e ChunkEncoding) String() string {
+	switch e {
+	case ChunkRoaring:
+		return "roaring"
+	case ChunkArray:
+		return "array"
+	case ChunkRuns:
+		return "runs"
+	case ChunkBitmap:
+		return "bitmap"
+	default:
+		return fmt.Sprintf("encoding(%d)", byte(e))
+	}
+}
+
+// ChunkEncodingOf - encoding of DB row written by EncodeChunk/EncodeChunk64 (or by roaring serialization)
+func ChunkEncodingOf(v []byte) ChunkEncoding {
+	if len(v) >= 2 && v[0] == chunkTag && v[1] >= byte(ChunkArray) && v[1] <= byte(ChunkBitmap) {
+		return ChunkEncoding(v[1])
+	}
+	return ChunkRoaring
+}
+
+type uint64Iterator interface {
+	HasNext() bool
+	Next() uint64
+}
+
+type iterator32 struct{ it roaring.IntIterable }
+
+func (i iterator32) HasNext() bool { return i.it.HasNext() }
+func (i iterator32) Next() uint64  { return uint64(i.it.Next()) }
+
+func uvarintLen(x uint64) int { return (bits.Len64(x|1) + 6) / 7 }
+
+// pickChunkEncoding - 1 pass over values: estimates sizes of tagged encodings, stops when they can't be better than `best`
+func pickChunkEncoding(it uint64Iterator, min, max uint64, roaringSize int) ChunkEncoding {
+	enc, best := ChunkRoaring, roaringSize
+	if span := max - min; span < 8*uint64(best) {
+		if sz := 2 + uvarintLen(min) + int(span/8) + 1; sz < best {
+			enc, best = ChunkBitmap, sz
+		}
+	}
+	arraySize, runsSize := 2, 2
+	var prev, runStart, prevRunEnd uint64
+	first := true
+	for it.HasNext() && (arraySize < best || runsSize < best) {
+		v := it.Next()
+		if first {
+			arraySize += uvarintLen(v)
+			runStart, first = v, false
+		} else {
+			arraySize += uvarintLen(v - prev)
+			if v != prev+1 {
+				runsSize += uvarintLen(runStart-prevRunEnd) + uvarintLen(prev-runStart)
+				prevRunEnd, runStart = prev, v
+			}
+		}
+		prev = v
+	}
+	if !it.HasNext() && !first {
+		runsSize += uvarintLen(runStart-prevRunEnd) + uvarintLen(prev-runStart)
+		if arraySize < best {
+			enc, best = ChunkArray, arraySize
+		}
+		if runsSize < best {
+			enc = ChunkRuns
+		}
+	}
+	return enc
+}
+
+func encodeTagged(enc ChunkEncoding, it uint64Iterator, min, max uint64) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, chunkTag, byte(enc))
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+	}
+	switch enc {
+	case ChunkArray:
+		var prev uint64
+		for it.HasNext() {
+			v := it.Next()
+			putUvarint(v - prev)
+			prev = v
+		}
+	case ChunkRuns:
+		var prev, runStart, prevRunEnd uint64
+		first := true
+		for it.HasNext() {
+			v := it.Next()
+			if first {
+				runStart, first = v, false
+			} else if v != prev+1 {
+				putUvarint(runStart - prevRunEnd)
+				putUvarint(prev - runStart)
+				prevRunEnd, runStart = prev, v
+			}
+			prev = v
+		}
+		putUvarint(runStart - prevRunEnd)
+		putUvarint(prev - runStart)
+	case ChunkBitmap:
+		putUvarint(min)
+		offset := len(buf)
+		buf = append(buf, make([]byte, (max-min)/8+1)...)
+		for it.HasNext() {
+			d := it.Next() - min
+			buf[offset+int(d/8)] |= 1 << (d % 8)
+		}
+	default:
+		panic(fmt.Sprintf("bitmapdb: can't encode %s", enc))
+	}
+	return buf
+}
+
+// EncodeChunk - serializes chunk in cheapest encoding, see ChunkEncoding. Calls RunOptimize on chunk.
+func EncodeChunk(chunk *roaring.Bitmap) ([]byte, error) {
+	chunk.RunOptimize()
+	if chunk.IsEmpty() {
+		return chunk.ToBytes()
+	}
+	min, max := uint64(chunk.Minimum()), uint64(chunk.Maximum())
+	enc := pickChunkEncoding(iterator32{chunk.Iterator()}, min, max, int(chunk.GetSerializedSizeInBytes()))
+	if enc == ChunkRoaring {
+		return chunk.ToBytes()
+	}
+	return encodeTagged(enc, iterator32{chunk.Iterator()}, min, max), nil
+}
+
+// EncodeChunk64 - serializes chunk in cheapest encoding, see ChunkEncoding. Calls RunOptimize on chunk.
+func EncodeChunk64(chunk *roaring64.Bitmap) ([]byte, error) {
+	chunk.RunOptimize()
+	if chunk.IsEmpty() {
+		return chunk.ToBytes()
+	}
+	min, max := chunk.Minimum(), chunk.Maximum()
+	enc := pickChunkEncoding(chunk.Iterator(), min, max, int(chunk.GetSerializedSizeInBytes()))
+	if enc == ChunkRoaring {
+		return chunk.ToBytes()
+	}
+	return encodeTagged(enc, chunk.Iterator(), min, max), nil
+}
+
+// decodeTagged - calls addRange for each [from, to] range of values (single values are ranges of length 1)
+func decodeTagged(v []byte, maxValue uint64, addRange func(from, to uint64)) error {
+	enc := ChunkEncoding(v[1])
+	v = v[2:]
+	uvarint := func() (uint64, error) {
+		x, n := binary.Uvarint(v)
+		if n <= 0 {
+			return 0, fmt.Errorf("bitmapdb: corrupted %s chunk", enc)
+		}
+		v = v[n:]
+		return x, nil
+	}
+	checked := func(from, to uint64) error {
+		if to < from || to > maxValue {
+			return fmt.Errorf("bitmapdb: corrupted %s chunk: value %d out of range", enc, to)
+		}
+		addRange(from, to)
+		return nil
+	}
+	switch enc {
+	case ChunkArray:
+		var prev uint64
+		for first := true; len(v) > 0; first = false {
+			d, err := uvarint()
+			if err != nil {
+				return err
+			}
+			if !first && d == 0 {
+				return fmt.Errorf("bitmapdb: corrupted %s chunk: values are not sorted", enc)
+			}
+			if err = checked(prev+d, prev+d); err != nil {
+				return err
+			}
+			prev += d
+		}
+	case ChunkRuns:
+		var prevRunEnd uint64
+		for len(v) > 0 {
+			gap, err := uvarint()
+			if err != nil {
+				return err
+			}
+			length, err := uvarint()
+			if err != nil {
+				return err
+			}
+			from := prevRunEnd + gap
+			if err = checked(from, from+length); err != nil {
+				return err
+			}
+			prevRunEnd = from + length
+		}
+	case ChunkBitmap:
+		min, err := uvarint()
+		if err != nil {
+			return err
+		}
+		for i, b := range v {
+			for b != 0 {
+				bit := uint64(bits.TrailingZeros8(b))
+				x := min + uint64(i)*8 + bit
+				if err = checked(x, x); err != nil {
+					return err
+				}
+				b &= b - 1
+			}
+		}
+	}
+	return nil
+}
+
+// DecodeChunk - reads row written by EncodeChunk (or by roaring serialization) into bm, previous content of bm is lost
+func DecodeChunk(v []byte, bm *roaring.Bitmap) error {
+	if ChunkEncodingOf(v) == ChunkRoaring {
+		_, err := bm.ReadFrom(bytes.NewReader(v))
+		return err
+	}
+	bm.Clear()
+	return decodeTagged(v, MaxUint32, func(from, to uint64) {
+		if from == to {
+			bm.Add(uint32(from))
+		} else {
+			bm.AddRange(from, to+1)
+		}
+	})
+}
+
+// DecodeChunk64 - reads row written by EncodeChunk64 (or by roaring serialization) into bm, previous content of bm is lost
+func DecodeChunk64(v []byte, bm *roaring64.Bitmap) error {
+	if ChunkEncodingOf(v) == ChunkRoaring {
+		_, err := bm.ReadFrom(bytes.NewReader(v))
+		return err
+	}
+	bm.Clear()
+	return decodeTagged(v, ^uint64(0)-1, func(from, to uint64) {
+		if from == to {
+			bm.Add(from)
+		} else {
+			bm.AddRange(from, to+1)
+		}
+	})
+}
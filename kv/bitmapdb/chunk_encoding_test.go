@@ -0,0 +1,141 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bitmapdb_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func to64(bm *roaring.Bitmap) *roaring64.Bitmap {
+	res := roaring64.New()
+	for it := bm.Iterator(); it.HasNext(); {
+		res.Add(uint64(it.Next()))
+	}
+	return res
+}
+
+func TestChunkEncoding(t *testing.T) {
+	sparse := roaring.New()
+	for i := uint32(0); i < 300; i++ {
+		sparse.Add(1_000_000 + i*7919)
+	}
+	runs := roaring.New()
+	for i := uint64(0); i < 50; i++ {
+		runs.AddRange(i*100_000, i*100_000+3000)
+	}
+	dense := roaring.New()
+	for i := uint32(0); i < 10_000; i += 3 {
+		dense.Add(5_000_000 + i)
+	}
+	single := roaring.BitmapOf(0)
+	full := roaring.New()
+	full.AddRange(bitmapdb.MaxUint32-1000, bitmapdb.MaxUint32+1)
+
+	for _, tc := range []struct {
+		name string
+		bm   *roaring.Bitmap
+		enc  bitmapdb.ChunkEncoding
+	}{
+		{"sparse", sparse, bitmapdb.ChunkArray},
+		{"runs", runs, bitmapdb.ChunkRuns},
+		{"dense", dense, bitmapdb.ChunkBitmap},
+		{"single", single, bitmapdb.ChunkArray},
+		{"full", full, bitmapdb.ChunkRuns},
+		{"empty", roaring.New(), bitmapdb.ChunkRoaring},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := bitmapdb.EncodeChunk(tc.bm.Clone())
+			require.NoError(t, err)
+			require.Equal(t, tc.enc, bitmapdb.ChunkEncodingOf(v))
+			optimized := tc.bm.Clone()
+			optimized.RunOptimize()
+			require.LessOrEqual(t, uint64(len(v)), optimized.GetSerializedSizeInBytes())
+
+			got := roaring.BitmapOf(42) // must be overwritten
+			require.NoError(t, bitmapdb.DecodeChunk(v, got))
+			require.True(t, tc.bm.Equals(got))
+
+			bm64 := to64(tc.bm)
+			v, err = bitmapdb.EncodeChunk64(bm64.Clone())
+			require.NoError(t, err)
+			got64 := roaring64.New()
+			require.NoError(t, bitmapdb.DecodeChunk64(v, got64))
+			require.True(t, bm64.Equals(got64))
+		})
+	}
+
+	t.Run("untagged", func(t *testing.T) { // rows written before hybrid encoding
+		v, err := sparse.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, bitmapdb.ChunkRoaring, bitmapdb.ChunkEncodingOf(v))
+		got := roaring.New()
+		require.NoError(t, bitmapdb.DecodeChunk(v, got))
+		require.True(t, sparse.Equals(got))
+
+		bm64 := to64(sparse)
+		v, err = bm64.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, bitmapdb.ChunkRoaring, bitmapdb.ChunkEncodingOf(v))
+		got64 := roaring64.New()
+		require.NoError(t, bitmapdb.DecodeChunk64(v, got64))
+		require.True(t, bm64.Equals(got64))
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		require.Error(t, bitmapdb.DecodeChunk([]byte{0xFF, byte(bitmapdb.ChunkArray), 0x80}, roaring.New()))
+		require.Error(t, bitmapdb.DecodeChunk([]byte{0xFF, byte(bitmapdb.ChunkArray), 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, roaring.New()))
+	})
+}
+
+func TestTruncateRangeEncoding(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	key := []byte("topic")
+	lastChunk := append(append([]byte{}, key...), 0xFF, 0xFF, 0xFF, 0xFF)
+	bm := roaring.New()
+	for i := uint32(0); i < 300; i++ {
+		bm.Add(1_000_000 + i*7919)
+	}
+	v, err := bm.ToBytes()
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(kv.LogTopicIndex, lastChunk, v))
+
+	// roaring is default write format: rows must stay readable by older binaries
+	require.NoError(t, bitmapdb.TruncateRange(tx, kv.LogTopicIndex, key, 2_000_000))
+	v, err = tx.GetOne(kv.LogTopicIndex, lastChunk)
+	require.NoError(t, err)
+	require.Equal(t, bitmapdb.ChunkRoaring, bitmapdb.ChunkEncodingOf(v))
+	_, err = roaring.New().ReadFrom(bytes.NewReader(v))
+	require.NoError(t, err)
+
+	require.NoError(t, bitmapdb.TruncateRangeHybrid(tx, kv.LogTopicIndex, key, 2_000_000))
+	v, err = tx.GetOne(kv.LogTopicIndex, lastChunk)
+	require.NoError(t, err)
+	require.Equal(t, bitmapdb.ChunkArray, bitmapdb.ChunkEncodingOf(v))
+
+	got, err := bitmapdb.Get(tx, kv.LogTopicIndex, key, 0, bitmapdb.MaxUint32)
+	require.NoError(t, err)
+	bm.RemoveRange(2_000_000, bitmapdb.MaxUint32+1)
+	require.True(t, bm.Equals(got))
+}
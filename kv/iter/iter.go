@@ -18,9 +18,12 @@ package iter
 
 import (
 	"bytes"
+	"fmt"
 
 	"golang.org/x/exp/constraints"
 	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 )
 
 var (
@@ -83,214 +86,382 @@ func (it *RangeIter[T]) Next() (T, error) {
 	return v, nil
 }
 
-// UnionKVIter - merge 2 kv.Pairs streams to 1 in lexicographically order
-// 1-st stream has higher priority - when 2 streams return same key
-type UnionKVIter struct {
-	x, y               KV
-	xHasNext, yHasNext bool
-	xNextK, xNextV     []byte
-	yNextK, yNextV     []byte
-	err                error
-}
+type setOp uint8
 
-func UnionKV(x, y KV) KV {
-	if x == nil && y == nil {
-		return EmptyKV
-	}
+const (
+	opUnion      setOp = iota // keys of x or y
+	opIntersect               // keys of x which are in y
+	opDifference              // keys of x which are not in y
+)
+
+// MergeIter - lazy union/intersection/difference of 2 streams sorted by key in same order.
+// For key present in both streams - pair of x is returned (or result of `merge`, see MergePairs).
+// Returns at most `limit` pairs (-1 - unlimited) and doesn't read underlying streams after limit is reached.
+type MergeIter[K, V any] struct {
+	x, y       Dual[K, V]
+	op         setOp
+	cmp        func(a, b K) int // <0 - `a` goes before `b` in order of streams
+	merge      func(k K, xV, yV V) (V, error)
+	limit      int
+	xHas, yHas bool
+	xK, yK     K
+	xV, yV     V
+	err        error
+}
+
+func newMerge[K, V any](x, y Dual[K, V], op setOp, cmp func(a, b K) int, asc order.By, limit int) *MergeIter[K, V] {
 	if x == nil {
-		return y
+		x = &EmptyDual[K, V]{}
 	}
 	if y == nil {
-		return x
+		y = &EmptyDual[K, V]{}
+	}
+	m := &MergeIter[K, V]{x: x, y: y, op: op, cmp: cmp, limit: limit}
+	if !asc {
+		m.cmp = func(a, b K) int { return cmp(b, a) }
+	}
+	if limit == 0 {
+		return m
 	}
-	m := &UnionKVIter{x: x, y: y}
 	m.advanceX()
 	m.advanceY()
+	m.seek()
 	return m
 }
-func (m *UnionKVIter) HasNext() bool { return m.xHasNext || m.yHasNext }
-func (m *UnionKVIter) advanceX() {
+
+func (m *MergeIter[K, V]) HasNext() bool {
 	if m.err != nil {
-		return
+		return true
 	}
-	m.xHasNext = m.x.HasNext()
-	if m.xHasNext {
-		m.xNextK, m.xNextV, m.err = m.x.Next()
+	if m.limit == 0 {
+		return false
 	}
+	return m.xHas || (m.op == opUnion && m.yHas)
 }
-func (m *UnionKVIter) advanceY() {
+func (m *MergeIter[K, V]) advanceX() {
 	if m.err != nil {
 		return
 	}
-	m.yHasNext = m.y.HasNext()
-	if m.yHasNext {
-		m.yNextK, m.yNextV, m.err = m.y.Next()
+	m.xHas = m.x.HasNext()
+	if m.xHas {
+		m.xK, m.xV, m.err = m.x.Next()
 	}
 }
-func (m *UnionKVIter) Next() ([]byte, []byte, error) {
+func (m *MergeIter[K, V]) advanceY() {
 	if m.err != nil {
-		return nil, nil, m.err
+		return
 	}
-	if m.xHasNext && m.yHasNext {
-		cmp := bytes.Compare(m.xNextK, m.yNextK)
-		if cmp < 0 {
-			k, v, err := m.xNextK, m.xNextV, m.err
-			m.advanceX()
-			return k, v, err
-		} else if cmp == 0 {
-			k, v, err := m.xNextK, m.xNextV, m.err
-			m.advanceX()
+	m.yHas = m.y.HasNext()
+	if m.yHas {
+		m.yK, m.yV, m.err = m.y.Next()
+	}
+}
+
+// seek - moves x to next key which must be returned: for union any key is returned, nothing to skip
+func (m *MergeIter[K, V]) seek() {
+	switch m.op {
+	case opIntersect:
+		for m.err == nil && m.xHas && m.yHas {
+			c := m.cmp(m.xK, m.yK)
+			if c == 0 {
+				return
+			}
+			if c < 0 {
+				m.advanceX()
+			} else {
+				m.advanceY()
+			}
+		}
+		m.xHas = false
+	case opDifference:
+		for m.err == nil && m.xHas && m.yHas {
+			c := m.cmp(m.xK, m.yK)
+			if c < 0 {
+				return
+			}
+			if c == 0 {
+				m.advanceX()
+			}
 			m.advanceY()
+		}
+	}
+}
+
+func (m *MergeIter[K, V]) Next() (k K, v V, err error) {
+	if m.err != nil {
+		return k, v, m.err
+	}
+	if m.op == opUnion && (!m.xHas || (m.yHas && m.cmp(m.xK, m.yK) > 0)) {
+		k, v = m.yK, m.yV
+		m.consume(false, true)
+		return k, v, nil
+	}
+	k, v = m.xK, m.xV
+	both := m.yHas && m.cmp(m.xK, m.yK) == 0
+	if both && m.merge != nil {
+		if v, err = m.merge(k, m.xV, m.yV); err != nil {
+			m.err = err
 			return k, v, err
 		}
-		k, v, err := m.yNextK, m.yNextV, m.err
-		m.advanceY()
-		return k, v, err
 	}
-	if m.xHasNext {
-		k, v, err := m.xNextK, m.xNextV, m.err
+	m.consume(true, both)
+	return k, v, nil
+}
+
+func (m *MergeIter[K, V]) consume(x, y bool) {
+	if m.limit > 0 {
+		m.limit--
+		if m.limit == 0 {
+			return
+		}
+	}
+	if x {
 		m.advanceX()
-		return k, v, err
 	}
-	k, v, err := m.yNextK, m.yNextV, m.err
-	m.advanceY()
-	return k, v, err
+	if y {
+		m.advanceY()
+	}
+	m.seek()
+}
+
+// UnionKVIter - merge 2 kv.Pairs streams to 1 in lexicographically order
+// 1-st stream has higher priority - when 2 streams return same key
+type UnionKVIter struct{ *MergeIter[[]byte, []byte] }
+
+func UnionKV(x, y KV) KV {
+	return &UnionKVIter{newMerge[[]byte, []byte](x, y, opUnion, bytes.Compare, order.Asc, -1)}
 }
 func (m *UnionKVIter) ToArray() (keys, values [][]byte, err error) { return ToKVArray(m) }
 
-// UnionIter
-type UnionIter[T constraints.Ordered] struct {
-	x, y           Unary[T]
-	xHas, yHas     bool
-	xNextK, yNextK T
-	err            error
+// UnionKVLimit - as UnionKV, but streams are sorted in `asc` order, at most `limit` pairs (-1 - unlimited)
+func UnionKVLimit(x, y KV, asc order.By, limit int) KV {
+	return newMerge[[]byte, []byte](x, y, opUnion, bytes.Compare, asc, limit)
 }
 
+// IntersectKV - pairs of x which keys are in y
+func IntersectKV(x, y KV, asc order.By, limit int) KV {
+	return newMerge[[]byte, []byte](x, y, opIntersect, bytes.Compare, asc, limit)
+}
+
+// DifferenceKV - pairs of x which keys are not in y
+func DifferenceKV(x, y KV, asc order.By, limit int) KV {
+	return newMerge[[]byte, []byte](x, y, opDifference, bytes.Compare, asc, limit)
+}
+
+// MergePairs - union of 2 streams, value of key present in both streams is `merge(k, xV, yV)`.
+// For example: values of db with values of not-committed batch on top.
+func MergePairs(x, y KV, asc order.By, limit int, merge func(k, xV, yV []byte) ([]byte, error)) KV {
+	m := newMerge[[]byte, []byte](x, y, opUnion, bytes.Compare, asc, limit)
+	m.merge = merge
+	return m
+}
+
+// UnionIter - merge 2 ascending streams to 1 without duplicates
+type UnionIter[T constraints.Ordered] struct{ keysIter[T] }
+
 func Union[T constraints.Ordered](x, y Unary[T]) Unary[T] {
-	if x == nil && y == nil {
-		return &EmptyUnary[T]{}
+	return &UnionIter[T]{mergeUnary[T](x, y, opUnion, order.Asc, -1)}
+}
+
+// UnionLimit - as Union, but streams are sorted in `asc` order, at most `limit` items (-1 - unlimited)
+func UnionLimit[T constraints.Ordered](x, y Unary[T], asc order.By, limit int) Unary[T] {
+	return mergeUnary[T](x, y, opUnion, asc, limit)
+}
+
+// IntersectIter - items of ascending stream x which are in y
+type IntersectIter[T constraints.Ordered] struct{ keysIter[T] }
+
+func Intersect[T constraints.Ordered](x, y Unary[T]) Unary[T] {
+	return &IntersectIter[T]{mergeUnary[T](x, y, opIntersect, order.Asc, -1)}
+}
+
+// IntersectLimit - as Intersect, but streams are sorted in `asc` order, at most `limit` items (-1 - unlimited)
+func IntersectLimit[T constraints.Ordered](x, y Unary[T], asc order.By, limit int) Unary[T] {
+	return mergeUnary[T](x, y, opIntersect, asc, limit)
+}
+
+// Difference - items of x which are not in y
+func Difference[T constraints.Ordered](x, y Unary[T], asc order.By, limit int) Unary[T] {
+	return mergeUnary[T](x, y, opDifference, asc, limit)
+}
+
+func mergeUnary[T constraints.Ordered](x, y Unary[T], op setOp, asc order.By, limit int) keysIter[T] {
+	return keysOf[T](newMerge[T, struct{}](withEmptyValues(x), withEmptyValues(y), op, compare[T], asc, limit))
+}
+
+func compare[T constraints.Ordered](a, b T) int {
+	if a < b {
+		return -1
 	}
-	if x == nil {
-		return y
+	if a > b {
+		return 1
 	}
-	if y == nil {
-		return x
+	return 0
+}
+
+type unaryAsDual[T any] struct{ it Unary[T] }
+
+func withEmptyValues[T any](it Unary[T]) Dual[T, struct{}] {
+	if it == nil {
+		return nil
 	}
-	m := &UnionIter[T]{x: x, y: y}
-	m.advanceX()
-	m.advanceY()
-	return m
+	return unaryAsDual[T]{it: it}
 }
+func (m unaryAsDual[T]) HasNext() bool { return m.it.HasNext() }
+func (m unaryAsDual[T]) Next() (T, struct{}, error) {
+	k, err := m.it.Next()
+	return k, struct{}{}, err
+}
+
+type keysIter[T any] struct{ it Dual[T, struct{}] }
 
-func (m *UnionIter[T]) HasNext() bool {
-	return m.err != nil || m.xHas || m.yHas
+func keysOf[T any](it Dual[T, struct{}]) keysIter[T] { return keysIter[T]{it: it} }
+func (m keysIter[T]) HasNext() bool                  { return m.it.HasNext() }
+func (m keysIter[T]) Next() (T, error) {
+	k, _, err := m.it.Next()
+	return k, err
 }
-func (m *UnionIter[T]) advanceX() {
-	if m.err != nil {
+
+// DedupIter - skips repeated keys of sorted stream: only 1-st pair of each key is returned.
+// Reads underlying stream only in HasNext, at most `limit` pairs are returned (-1 - unlimited).
+type DedupIter[K, V any] struct {
+	it      Dual[K, V]
+	eq      func(a, b K) bool
+	keep    func(dst, k K) K // copy of `k` to compare with next keys: `k` may be invalidated by reads of stream
+	limit   int
+	prev    K
+	hasPrev bool
+	fetched bool
+	hasNext bool
+	nextK   K
+	nextV   V
+	err     error
+}
+
+// DedupKV - pairs of sorted stream with unique keys
+func DedupKV(it KV, limit int) *DedupIter[[]byte, []byte] {
+	return &DedupIter[[]byte, []byte]{it: it, eq: bytes.Equal, keep: func(dst, k []byte) []byte { return append(dst[:0], k...) }, limit: limit}
+}
+
+// Dedup - unique items of sorted stream
+func Dedup[T comparable](it Unary[T], limit int) Unary[T] {
+	eq := func(a, b T) bool { return a == b }
+	keep := func(_, k T) T { return k }
+	return keysOf[T](&DedupIter[T, struct{}]{it: withEmptyValues(it), eq: eq, keep: keep, limit: limit})
+}
+
+func (m *DedupIter[K, V]) fetch() {
+	if m.fetched {
 		return
 	}
-	m.xHas = m.x.HasNext()
-	if m.xHas {
-		m.xNextK, m.err = m.x.Next()
-	}
-}
-func (m *UnionIter[T]) advanceY() {
-	if m.err != nil {
+	m.fetched, m.hasNext = true, false
+	if m.err != nil || m.limit == 0 || m.it == nil {
 		return
 	}
-	m.yHas = m.y.HasNext()
-	if m.yHas {
-		m.yNextK, m.err = m.y.Next()
+	for m.it.HasNext() {
+		k, v, err := m.it.Next()
+		if err != nil {
+			m.err = err
+			return
+		}
+		if m.hasPrev && m.eq(m.prev, k) {
+			continue
+		}
+		m.prev, m.hasPrev = m.keep(m.prev, k), true
+		m.hasNext, m.nextK, m.nextV = true, k, v
+		return
 	}
 }
-func (m *UnionIter[T]) Next() (res T, err error) {
+func (m *DedupIter[K, V]) HasNext() bool {
+	m.fetch()
+	return m.err != nil || m.hasNext
+}
+func (m *DedupIter[K, V]) Next() (k K, v V, err error) {
+	m.fetch()
 	if m.err != nil {
-		return res, m.err
-	}
-	if m.xHas && m.yHas {
-		if m.xNextK < m.yNextK {
-			k, err := m.xNextK, m.err
-			m.advanceX()
-			return k, err
-		} else if m.xNextK == m.yNextK {
-			k, err := m.xNextK, m.err
-			m.advanceX()
-			m.advanceY()
-			return k, err
-		}
-		k, err := m.yNextK, m.err
-		m.advanceY()
-		return k, err
+		return k, v, m.err
 	}
-	if m.xHas {
-		k, err := m.xNextK, m.err
-		m.advanceX()
-		return k, err
+	if m.limit > 0 {
+		m.limit--
 	}
-	k, err := m.yNextK, m.err
-	m.advanceY()
-	return k, err
+	m.fetched = false
+	return m.nextK, m.nextV, nil
 }
 
-// IntersectIter
-type IntersectIter[T constraints.Ordered] struct {
-	x, y               Unary[T]
+// JoinKVIter - left join of 2 streams sorted by key: each pair of x is joined with pairs of y which keys start with key of x.
+// For example: accounts (key: address) with contract code hashes (key: address+incarnation) - instead of point-get per account.
+// Pair of x with N matching pairs of y is returned N times, pair of x without matching pairs - once, with nil yK and yV.
+// Pairs of y without pair of x are skipped.
+type JoinKVIter struct {
+	x, y               KV
 	xHasNext, yHasNext bool
-	xNextK, yNextK     T
-	err                error
-}
+	xK, xV             []byte
+	yK, yV             []byte
+	joined             bool // current pair of x is returned with pair of y
 
-func Intersect[T constraints.Ordered](x, y Unary[T]) Unary[T] {
-	if x == nil || y == nil {
-		return &EmptyUnary[T]{}
-	}
-	m := &IntersectIter[T]{x: x, y: y}
-	m.advance()
-	return m
+	hasNext                        bool
+	nextXK, nextXV, nextYK, nextYV []byte
+	err                            error
 }
-func (m *IntersectIter[T]) HasNext() bool { return m.xHasNext && m.yHasNext }
-func (m *IntersectIter[T]) advance() {
+
+func JoinKV(x, y KV) *JoinKVIter {
+	m := &JoinKVIter{x: x, y: y}
 	m.advanceX()
 	m.advanceY()
-	for m.xHasNext && m.yHasNext {
-		if m.err != nil {
-			break
-		}
-		if m.xNextK < m.yNextK {
-			m.advanceX()
-			continue
-		} else if m.xNextK == m.yNextK {
-			return
-		} else {
-			m.advanceY()
-			continue
-		}
-	}
-	m.xHasNext = false
+	m.advance()
+	return m
 }
-
-func (m *IntersectIter[T]) advanceX() {
+func (m *JoinKVIter) HasNext() bool { return m.err != nil || m.hasNext }
+func (m *JoinKVIter) advanceX() {
 	if m.err != nil {
 		return
 	}
+	m.joined = false
 	m.xHasNext = m.x.HasNext()
 	if m.xHasNext {
-		m.xNextK, m.err = m.x.Next()
+		m.xK, m.xV, m.err = m.x.Next()
 	}
 }
-func (m *IntersectIter[T]) advanceY() {
+func (m *JoinKVIter) advanceY() {
 	if m.err != nil {
 		return
 	}
 	m.yHasNext = m.y.HasNext()
 	if m.yHasNext {
-		m.yNextK, m.err = m.y.Next()
+		m.yK, m.yV, m.err = m.y.Next()
+	}
+}
+func (m *JoinKVIter) advance() {
+	m.hasNext = false
+	for m.err == nil && m.xHasNext {
+		for m.err == nil && m.yHasNext && bytes.Compare(m.yK, m.xK) < 0 {
+			m.advanceY()
+		}
+		if m.err != nil {
+			return
+		}
+		if m.yHasNext && bytes.HasPrefix(m.yK, m.xK) {
+			m.nextXK, m.nextXV, m.nextYK, m.nextYV = m.xK, m.xV, m.yK, m.yV
+			m.hasNext, m.joined = true, true
+			m.advanceY()
+			return
+		}
+		if !m.joined {
+			m.nextXK, m.nextXV, m.nextYK, m.nextYV = m.xK, m.xV, nil, nil
+			m.hasNext = true
+			m.advanceX()
+			return
+		}
+		m.advanceX()
 	}
 }
-func (m *IntersectIter[T]) Next() (T, error) {
-	k, err := m.xNextK, m.err
+func (m *JoinKVIter) Next() (xK, xV, yK, yV []byte, err error) {
+	if m.err != nil {
+		return nil, nil, nil, nil, m.err
+	}
+	xK, xV, yK, yV = m.nextXK, m.nextXV, m.nextYK, m.nextYV
 	m.advance()
-	return k, err
+	return xK, xV, yK, yV, nil
 }
 
 // TransformDualIter - analog `map` (in terms of map-filter-reduce pattern)
@@ -418,9 +589,16 @@ type Paginated[T any] struct {
 	nextPage      NextPageUnary[T]
 	nextPageToken string
 	initialized   bool
+	returned      int
+	resume        ResumeUnary[T]
 }
 
 func Paginate[T any](f NextPageUnary[T]) *Paginated[T] { return &Paginated[T]{nextPage: f} }
+
+// PaginateResumable - Paginate which provides ContinuationToken: `resume` makes token of next not-returned item
+func PaginateResumable[T any](f NextPageUnary[T], resume ResumeUnary[T]) *Paginated[T] {
+	return &Paginated[T]{nextPage: f, resume: resume}
+}
 func (it *Paginated[T]) HasNext() bool {
 	if it.err != nil || it.i < len(it.arr) {
 		return true
@@ -440,9 +618,24 @@ func (it *Paginated[T]) Next() (v T, err error) {
 	}
 	v = it.arr[it.i]
 	it.i++
+	it.returned++
 	return v, nil
 }
 
+// ContinuationToken - see Resumable
+func (it *Paginated[T]) ContinuationToken() (string, error) {
+	if it.resume == nil {
+		return "", fmt.Errorf("iter.Paginated: %w", ErrNotResumable)
+	}
+	if !it.HasNext() {
+		return "", nil
+	}
+	if it.err != nil {
+		return "", it.err
+	}
+	return it.resume(it.arr[it.i], it.returned)
+}
+
 type PaginatedDual[K, V any] struct {
 	keys          []K
 	values        []V
@@ -451,11 +644,18 @@ type PaginatedDual[K, V any] struct {
 	nextPage      NextPageDual[K, V]
 	nextPageToken string
 	initialized   bool
+	returned      int
+	resume        ResumeDual[K, V]
 }
 
 func PaginateDual[K, V any](f NextPageDual[K, V]) *PaginatedDual[K, V] {
 	return &PaginatedDual[K, V]{nextPage: f}
 }
+
+// PaginateDualResumable - PaginateDual which provides ContinuationToken: `resume` makes token of next not-returned pair
+func PaginateDualResumable[K, V any](f NextPageDual[K, V], resume ResumeDual[K, V]) *PaginatedDual[K, V] {
+	return &PaginatedDual[K, V]{nextPage: f, resume: resume}
+}
 func (it *PaginatedDual[K, V]) HasNext() bool {
 	if it.err != nil || it.i < len(it.keys) {
 		return true
@@ -475,5 +675,20 @@ func (it *PaginatedDual[K, V]) Next() (k K, v V, err error) {
 	}
 	k, v = it.keys[it.i], it.values[it.i]
 	it.i++
+	it.returned++
 	return k, v, nil
 }
+
+// ContinuationToken - see Resumable
+func (it *PaginatedDual[K, V]) ContinuationToken() (string, error) {
+	if it.resume == nil {
+		return "", fmt.Errorf("iter.PaginatedDual: %w", ErrNotResumable)
+	}
+	if !it.HasNext() {
+		return "", nil
+	}
+	if it.err != nil {
+		return "", it.err
+	}
+	return it.resume(it.keys[it.i], it.values[it.i], it.returned)
+}
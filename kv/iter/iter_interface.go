@@ -16,6 +16,11 @@
 
 package iter
 
+import (
+	"errors"
+	"fmt"
+)
+
 // Iterators - composable high-level abstraction to iterate over. It's more high-level than kv.Cursor and provides less controll, less features, but enough to build an app.
 //
 //	for s.HasNext() {
@@ -87,8 +92,31 @@ func TransformKV(it KV, transform func(k, v []byte) ([]byte, []byte, error)) *Tr
 type (
 	NextPageUnary[T any]   func(pageToken string) (arr []T, nextPageToken string, err error)
 	NextPageDual[K, V any] func(pageToken string) (keys []K, values []V, nextPageToken string, err error)
+
+	// ResumeUnary, ResumeDual - continuation token of position of next item, `returned` - amount of items returned before it
+	ResumeUnary[T any]   func(next T, returned int) (string, error)
+	ResumeDual[K, V any] func(nextK K, nextV V, returned int) (string, error)
 )
 
+var ErrNotResumable = errors.New("stream doesn't support continuation tokens")
+
+// Resumable - stream which can be continued from the next not-returned item: by another stream, maybe in another
+// transaction (for example: remote client stops Range after `limit` items and continues it later).
+// Position is defined by key of next item, not by offset: entries added/deleted between transactions are respected.
+type Resumable interface {
+	// ContinuationToken - "" if stream is exhausted. May read next page of stream.
+	ContinuationToken() (string, error)
+}
+
+// ContinuationToken - token to continue stream `it` from the next not-returned item, "" if stream is exhausted
+func ContinuationToken(it any) (string, error) {
+	r, ok := it.(Resumable)
+	if !ok {
+		return "", fmt.Errorf("%T: %w", it, ErrNotResumable)
+	}
+	return r.ContinuationToken()
+}
+
 func PaginateKV(f NextPageDual[[]byte, []byte]) *PaginatedDual[[]byte, []byte] {
 	return PaginateDual[[]byte, []byte](f)
 }
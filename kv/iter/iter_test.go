@@ -25,6 +25,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/iter"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 	"github.com/stretchr/testify/require"
 )
 
@@ -127,6 +128,57 @@ func TestUnionPairs(t *testing.T) {
 	})
 }
 
+func TestJoinKV(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	ctx := context.Background()
+	t.Run("join", func(t *testing.T) {
+		require := require.New(t)
+		tx, _ := db.BeginRw(ctx)
+		defer tx.Rollback()
+		_ = tx.Put(kv.PlainState, []byte{1}, []byte{10})
+		_ = tx.Put(kv.PlainState, []byte{2}, []byte{20})
+		_ = tx.Put(kv.PlainState, []byte{4}, []byte{40})
+		_ = tx.Put(kv.PlainContractCode, []byte{0, 9}, []byte{9})
+		_ = tx.Put(kv.PlainContractCode, []byte{1, 1}, []byte{11})
+		_ = tx.Put(kv.PlainContractCode, []byte{1, 2}, []byte{12})
+		_ = tx.Put(kv.PlainContractCode, []byte{3, 1}, []byte{31})
+		_ = tx.Put(kv.PlainContractCode, []byte{4, 1}, []byte{41})
+		it, _ := tx.Range(kv.PlainState, nil, nil)
+		it2, _ := tx.Range(kv.PlainContractCode, nil, nil)
+		var res []string
+		for m := iter.JoinKV(it, it2); m.HasNext(); {
+			xK, xV, yK, yV, err := m.Next()
+			require.NoError(err)
+			res = append(res, fmt.Sprintf("%x=%x:%x=%x", xK, xV, yK, yV))
+		}
+		require.Equal([]string{"01=0a:0101=0b", "01=0a:0102=0c", "02=14:=", "04=28:0401=29"}, res)
+	})
+	t.Run("empty 2nd", func(t *testing.T) {
+		require := require.New(t)
+		tx, _ := db.BeginRw(ctx)
+		defer tx.Rollback()
+		_ = tx.Put(kv.PlainState, []byte{1}, []byte{10})
+		it, _ := tx.Range(kv.PlainState, nil, nil)
+		it2, _ := tx.Range(kv.PlainContractCode, nil, nil)
+		m := iter.JoinKV(it, it2)
+		require.True(m.HasNext())
+		xK, _, yK, _, err := m.Next()
+		require.NoError(err)
+		require.Equal([]byte{1}, xK)
+		require.Nil(yK)
+		require.False(m.HasNext())
+	})
+	t.Run("error handling", func(t *testing.T) {
+		require := require.New(t)
+		m := iter.JoinKV(iter.PairsWithError(10), iter.PairsWithError(12))
+		var err error
+		for m.HasNext() && err == nil {
+			_, _, _, _, err = m.Next()
+		}
+		require.Equal("expected error at iteration: 10", err.Error())
+	})
+}
+
 func TestIntersect(t *testing.T) {
 	t.Run("intersect", func(t *testing.T) {
 		s1 := iter.Array[uint64]([]uint64{1, 3, 4, 5, 6, 7})
@@ -179,6 +231,115 @@ func TestIntersect(t *testing.T) {
 	})
 }
 
+// countedU64 - counts reads of underlying stream
+type countedU64 struct {
+	iter.U64
+	reads int
+}
+
+func (c *countedU64) Next() (uint64, error) { c.reads++; return c.U64.Next() }
+
+func TestCombinatorsLimit(t *testing.T) {
+	arr := func(a ...uint64) iter.U64 { return iter.Array[uint64](a) }
+	t.Run("union", func(t *testing.T) {
+		res, err := iter.ToU64Arr(iter.UnionLimit[uint64](arr(1, 3, 5), arr(2, 3, 6), order.Asc, 3))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 2, 3}, res)
+		res, err = iter.ToU64Arr(iter.UnionLimit[uint64](arr(5, 3, 1), arr(6, 3, 2), order.Desc, -1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{6, 5, 3, 2, 1}, res)
+		res, err = iter.ToU64Arr(iter.UnionLimit[uint64](arr(5, 3, 1), arr(6, 3, 2), order.Desc, 0))
+		require.NoError(t, err)
+		require.Nil(t, res)
+	})
+	t.Run("intersect", func(t *testing.T) {
+		res, err := iter.ToU64Arr(iter.IntersectLimit[uint64](arr(1, 3, 5, 7), arr(3, 4, 5, 7), order.Asc, 2))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{3, 5}, res)
+		res, err = iter.ToU64Arr(iter.IntersectLimit[uint64](arr(7, 5, 3, 1), arr(7, 5, 4, 3), order.Desc, -1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{7, 5, 3}, res)
+	})
+	t.Run("difference", func(t *testing.T) {
+		res, err := iter.ToU64Arr(iter.Difference[uint64](arr(1, 3, 5, 7, 9), arr(3, 4, 7), order.Asc, -1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 5, 9}, res)
+		res, err = iter.ToU64Arr(iter.Difference[uint64](arr(9, 7, 5, 3, 1), arr(7, 4, 3), order.Desc, 2))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{9, 5}, res)
+		res, err = iter.ToU64Arr(iter.Difference[uint64](arr(1, 3), nil, order.Asc, -1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 3}, res)
+		res, err = iter.ToU64Arr(iter.Difference[uint64](arr(1, 3), arr(1, 3), order.Asc, -1))
+		require.NoError(t, err)
+		require.Nil(t, res)
+	})
+	t.Run("dedup", func(t *testing.T) {
+		res, err := iter.ToU64Arr(iter.Dedup[uint64](arr(1, 1, 2, 3, 3, 3, 4), -1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 2, 3, 4}, res)
+		res, err = iter.ToU64Arr(iter.Dedup[uint64](arr(1, 1, 2, 3, 3, 3, 4), 3))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 2, 3}, res)
+	})
+	t.Run("lazy", func(t *testing.T) {
+		x, y := &countedU64{U64: iter.Range[uint64](0, 100)}, &countedU64{U64: iter.Range[uint64](50, 150)}
+		res, err := iter.ToU64Arr(iter.UnionLimit[uint64](x, y, order.Asc, 2))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0, 1}, res)
+		require.Equal(t, 2, x.reads) // no reads after limit
+		require.Equal(t, 1, y.reads)
+
+		x = &countedU64{U64: iter.Range[uint64](0, 100)}
+		res, err = iter.ToU64Arr(iter.Dedup[uint64](x, 5))
+		require.NoError(t, err)
+		require.Equal(t, 5, len(res))
+		require.Equal(t, 5, x.reads)
+	})
+}
+
+func TestMergePairs(t *testing.T) {
+	kvs := func(pairs ...string) iter.KV {
+		var keys, values [][]byte
+		for _, p := range pairs {
+			keys, values = append(keys, []byte(p[:1])), append(values, []byte(p[1:]))
+		}
+		return iter.PaginateKV(func(string) ([][]byte, [][]byte, string, error) { return keys, values, "", nil })
+	}
+	concat := func(k, xV, yV []byte) ([]byte, error) { return append(append([]byte{}, xV...), yV...), nil }
+	res := func(it iter.KV) []string {
+		keys, values, err := iter.ToKVArray(it)
+		require.NoError(t, err)
+		var res []string
+		for i := range keys {
+			res = append(res, string(keys[i])+string(values[i]))
+		}
+		return res
+	}
+
+	require.Equal(t, []string{"a1", "b2x", "c3", "dy"}, res(iter.MergePairs(kvs("a1", "b2", "c3"), kvs("bx", "dy"), order.Asc, -1, concat)))
+	require.Equal(t, []string{"dy", "c3", "b2x"}, res(iter.MergePairs(kvs("c3", "b2", "a1"), kvs("dy", "bx"), order.Desc, 3, concat)))
+	require.Equal(t, []string{"b2"}, res(iter.IntersectKV(kvs("a1", "b2", "c3"), kvs("bx", "dy"), order.Asc, -1)))
+	require.Equal(t, []string{"a1", "c3"}, res(iter.DifferenceKV(kvs("a1", "b2", "c3"), kvs("bx", "dy"), order.Asc, -1)))
+	require.Equal(t, []string{"a1", "b2"}, res(iter.DedupKV(kvs("a1", "a2", "b2", "b3"), -1)))
+	require.Equal(t, []string{"dy", "c3"}, res(iter.UnionKVLimit(kvs("c3", "b2", "a1"), kvs("dy", "bx"), order.Desc, 2)))
+
+	keys, _, err := iter.UnionKV(kvs("a1", "c3"), kvs("b2")).(*iter.UnionKVIter).ToArray()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{'a'}, {'b'}, {'c'}}, keys)
+
+	t.Run("error handling", func(t *testing.T) {
+		fail := func(k, xV, yV []byte) ([]byte, error) { return nil, fmt.Errorf("merge %s", k) }
+		keys, _, err := iter.ToKVArray(iter.MergePairs(kvs("a1", "b2"), kvs("bx"), order.Asc, -1, fail))
+		require.Equal(t, "merge b", err.Error())
+		require.Equal(t, 1, len(keys))
+
+		keys, _, err = iter.ToKVArray(iter.DifferenceKV(iter.PairsWithError(10), iter.PairsWithError(3), order.Asc, -1))
+		require.Equal(t, "expected error at iteration: 3", err.Error())
+		require.Equal(t, 0, len(keys))
+	})
+}
+
 func TestRange(t *testing.T) {
 	t.Run("range", func(t *testing.T) {
 		s1 := iter.Range[uint64](1, 4)
@@ -324,6 +485,53 @@ func TestPaginatedDual(t *testing.T) {
 		require.False(t, s1.HasNext())
 		require.False(t, s1.HasNext())
 	})
+	t.Run("continuation token", func(t *testing.T) {
+		// pages of [from, from+3) of [0, 7), token - next key
+		nextPage := func(pageToken string) (keys, values [][]byte, nextPageToken string, err error) {
+			from := byte(0)
+			if pageToken != "" {
+				from = pageToken[0]
+			}
+			for k := from; k < 7 && k < from+3; k++ {
+				keys, values = append(keys, []byte{k}), append(values, []byte{k})
+			}
+			if from+3 < 7 {
+				nextPageToken = string([]byte{from + 3})
+			}
+			return keys, values, nextPageToken, nil
+		}
+		var returnedBefore []int
+		resume := func(nextK, _ []byte, returned int) (string, error) {
+			returnedBefore = append(returnedBefore, returned)
+			return string(nextK), nil
+		}
+
+		s1 := iter.PaginateDualResumable(nextPage, resume)
+		for i := 0; i < 4 && s1.HasNext(); i++ { // stop in middle of 2-nd page
+			_, _, err := s1.Next()
+			require.NoError(t, err)
+		}
+		token, err := iter.ContinuationToken(s1)
+		require.NoError(t, err)
+		require.Equal(t, string([]byte{4}), token)
+		require.Equal(t, []int{4}, returnedBefore)
+
+		s2 := iter.PaginateDualResumable(func(pageToken string) (keys, values [][]byte, nextPageToken string, err error) {
+			if pageToken == "" {
+				pageToken = token
+			}
+			return nextPage(pageToken)
+		}, resume)
+		keys, _, err := iter.ToKVArray(s2)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{{4}, {5}, {6}}, keys)
+		token, err = iter.ContinuationToken(s2)
+		require.NoError(t, err)
+		require.Equal(t, "", token) // exhausted
+
+		_, err = iter.ContinuationToken(iter.PaginateKV(nextPage))
+		require.ErrorIs(t, err, iter.ErrNotResumable)
+	})
 }
 
 func TestFiler(t *testing.T) {
@@ -370,6 +370,14 @@ type BucketMigrator interface {
 	ExistsBucket(string) (bool, error)
 	ClearBucket(string) error
 	ListBuckets() ([]string, error)
+
+	// RenameBucket - content of table `from` replaces content of table `to`, `from` becomes empty (but exists).
+	// SwapBuckets - exchanges content of tables `a` and `b`.
+	// Tables must have same flags. Like any other change - visible to other transactions only after Commit, together
+	// with other changes of this tx: index can be rebuilt into shadow table and swapped with live one without read downtime.
+	// Open cursors of these tables must not be used after call.
+	RenameBucket(from, to string) error
+	SwapBuckets(a, b string) error
 }
 
 // Cursor - class for navigating through a database
@@ -449,6 +457,13 @@ type (
 	History     string
 	InvertedIdx string
 )
+
+const (
+	AccountsDomain Domain = "AccountsDomain"
+	StorageDomain  Domain = "StorageDomain"
+	CodeDomain     Domain = "CodeDomain"
+)
+
 type TemporalRoDb interface {
 	RoDB
 	BeginTemporalRo(ctx context.Context) (TemporalTx, error)
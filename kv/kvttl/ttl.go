@@ -0,0 +1,221 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kvttl - entries of tables which expire: peer records, temporary caches, metadata of pending pool.
+// Value of entry is prefixed by expiry: expiry_unix_u64 + value. Expiries are indexed in kv.TTLIndex (must be in
+// tables config of db): Janitor deletes expired entries by rate-limited batches without scan of tables.
+// Entries of TTL table must be written and deleted only by this package.
+package kvttl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+var expiredCounter = metrics.GetOrCreateCounter(`kv_ttl_expired_total`)
+
+const expirySize = 8
+
+// Put - writes entry which expires at `expiresAt`. Overwrite of entry replaces its expiry.
+func Put(tx kv.RwTx, table string, k, v []byte, expiresAt time.Time) error {
+	if err := Delete(tx, table, k); err != nil {
+		return err
+	}
+	expiry := uint64(expiresAt.Unix())
+	if err := tx.Put(kv.TTLIndex, indexKey(expiry, table, k), nil); err != nil {
+		return err
+	}
+	val := make([]byte, expirySize+len(v))
+	binary.BigEndian.PutUint64(val, expiry)
+	copy(val[expirySize:], v)
+	return tx.Put(table, k, val)
+}
+
+// Get - value of entry, nil if entry doesn't exist or is expired at `now` (but not deleted by Janitor yet)
+func Get(tx kv.Getter, table string, k []byte, now time.Time) ([]byte, error) {
+	v, err := tx.GetOne(table, k)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if len(v) < expirySize {
+		return nil, fmt.Errorf("kvttl: entry of %s without expiry: %x", table, k)
+	}
+	if binary.BigEndian.Uint64(v) <= uint64(now.Unix()) {
+		return nil, nil
+	}
+	return v[expirySize:], nil
+}
+
+// Delete - deletes entry and its expiry
+func Delete(tx kv.RwTx, table string, k []byte) error {
+	old, err := tx.GetOne(table, k)
+	if err != nil || old == nil {
+		return err
+	}
+	if len(old) >= expirySize {
+		if err := tx.Delete(kv.TTLIndex, indexKey(binary.BigEndian.Uint64(old), table, k)); err != nil {
+			return err
+		}
+	}
+	return tx.Delete(table, k)
+}
+
+// DeleteExpired - deletes entries (of all tables) expired at `now`, oldest first. Visits at most `limit` entries
+// of index: stale ones (entry was overwritten not by this package) are deleted too, but not counted in `deleted`.
+func DeleteExpired(tx kv.RwTx, now time.Time, limit int) (deleted int, err error) {
+	deleted, _, err = deleteExpired(tx, now, limit)
+	return deleted, err
+}
+
+func deleteExpired(tx kv.RwTx, now time.Time, limit int) (deleted, visited int, err error) {
+	c, err := tx.RwCursor(kv.TTLIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	nowSec := uint64(now.Unix())
+	defer func() { expiredCounter.Add(deleted) }()
+	for k, _, err := c.First(); k != nil && visited < limit; k, _, err = c.Next() {
+		if err != nil {
+			return deleted, visited, err
+		}
+		expiry, table, key, err := parseIndexKey(k)
+		if err != nil {
+			return deleted, visited, err
+		}
+		if expiry > nowSec {
+			break
+		}
+		visited++
+		v, err := tx.GetOne(table, key)
+		if err != nil {
+			return deleted, visited, err
+		}
+		if len(v) >= expirySize && binary.BigEndian.Uint64(v) == expiry { // else index entry is stale
+			if err = tx.Delete(table, key); err != nil {
+				return deleted, visited, err
+			}
+			deleted++
+		}
+		if err = c.DeleteCurrent(); err != nil {
+			return deleted, visited, err
+		}
+	}
+	return deleted, visited, nil
+}
+
+func indexKey(expiry uint64, table string, k []byte) []byte {
+	res := make([]byte, 8+1+len(table)+len(k))
+	binary.BigEndian.PutUint64(res, expiry)
+	res[8] = byte(len(table))
+	copy(res[9:], table)
+	copy(res[9+len(table):], k)
+	return res
+}
+
+func parseIndexKey(k []byte) (expiry uint64, table string, key []byte, err error) {
+	if len(k) < 9 || len(k) < 9+int(k[8]) {
+		return 0, "", nil, fmt.Errorf("kvttl: invalid index key %x", k)
+	}
+	tableLen := int(k[8])
+	return binary.BigEndian.Uint64(k), string(k[9 : 9+tableLen]), common.Copy(k[9+tableLen:]), nil
+}
+
+type JanitorCfg struct {
+	Interval   time.Duration // between checks of expired entries
+	BatchSize  int           // entries deleted by 1 RwTx
+	BatchPause time.Duration // between batches: writer slot is not held by janitor for long
+}
+
+func (cfg JanitorCfg) validate() error {
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("kvttl: janitor interval must be > 0, got %s", cfg.Interval)
+	}
+	if cfg.BatchSize <= 0 {
+		return fmt.Errorf("kvttl: janitor batch size must be > 0, got %d", cfg.BatchSize)
+	}
+	if cfg.BatchPause < 0 {
+		return fmt.Errorf("kvttl: negative janitor batch pause %s", cfg.BatchPause)
+	}
+	return nil
+}
+
+var DefaultJanitorCfg = JanitorCfg{Interval: time.Minute, BatchSize: 1_000, BatchPause: 10 * time.Millisecond}
+
+// Janitor - deletes expired entries of db in background
+type Janitor struct {
+	db     kv.RwDB
+	cfg    JanitorCfg
+	logger log.Logger
+	now    func() time.Time
+}
+
+func NewJanitor(db kv.RwDB, cfg JanitorCfg, logger log.Logger) (*Janitor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &Janitor{db: db, cfg: cfg, logger: logger, now: time.Now}, nil
+}
+
+// Run - deletes expired entries every cfg.Interval until ctx is done
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := j.RunOnce(ctx); err != nil && ctx.Err() == nil {
+				j.logger.Warn("[kvttl] delete expired", "err", err)
+			}
+		}
+	}
+}
+
+// RunOnce - deletes all entries expired by now, by batches of cfg.BatchSize
+func (j *Janitor) RunOnce(ctx context.Context) (deleted int, err error) {
+	for {
+		var n, visited int
+		if err = j.db.Update(ctx, func(tx kv.RwTx) error {
+			n, visited, err = deleteExpired(tx, j.now(), j.cfg.BatchSize)
+			return err
+		}); err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if visited < j.cfg.BatchSize {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		case <-time.After(j.cfg.BatchPause):
+		}
+	}
+	if deleted > 0 {
+		j.logger.Debug("[kvttl] deleted expired", "amount", deleted)
+	}
+	return deleted, nil
+}
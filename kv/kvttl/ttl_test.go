@@ -0,0 +1,122 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kvttl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+)
+
+func TestTTL(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	ctx := context.Background()
+	table := kv.PlainState
+	now := time.Unix(1_000_000, 0)
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		for i := byte(0); i < 10; i++ {
+			if err := Put(tx, table, []byte{i}, []byte{i, i}, now.Add(time.Duration(i)*time.Second)); err != nil {
+				return err
+			}
+		}
+		// overwrite: expiry of 0 is moved to future
+		return Put(tx, table, []byte{0}, []byte{42}, now.Add(time.Hour))
+	}))
+
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		v, err := Get(tx, table, []byte{0}, now)
+		require.NoError(t, err)
+		require.Equal(t, []byte{42}, v)
+		v, err = Get(tx, table, []byte{1}, now.Add(time.Second)) // expired, not deleted yet
+		require.NoError(t, err)
+		require.Nil(t, v)
+		v, err = Get(tx, table, []byte{5}, now)
+		require.NoError(t, err)
+		require.Equal(t, []byte{5, 5}, v)
+		return nil
+	}))
+
+	_, err := NewJanitor(db, JanitorCfg{Interval: time.Millisecond}, log.New())
+	require.Error(t, err)
+	_, err = NewJanitor(db, JanitorCfg{BatchSize: 2}, log.New())
+	require.Error(t, err)
+	j, err := NewJanitor(db, JanitorCfg{Interval: time.Millisecond, BatchSize: 2}, log.New())
+	require.NoError(t, err)
+	j.now = func() time.Time { return now.Add(5 * time.Second) }
+	deleted, err := j.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 5, deleted) // 1..5
+
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		for i := byte(0); i < 10; i++ {
+			v, err := tx.GetOne(table, []byte{i})
+			require.NoError(t, err)
+			require.Equal(t, i == 0 || i > 5, v != nil, i)
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		if err := Delete(tx, table, []byte{6}); err != nil {
+			return err
+		}
+		n, err := DeleteExpired(tx, now.Add(2*time.Hour), 100)
+		require.Equal(t, 4, n) // 0,7,8,9
+		return err
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		for _, tbl := range []string{table, kv.TTLIndex} {
+			c, err := tx.Cursor(tbl)
+			require.NoError(t, err)
+			k, _, err := c.First()
+			require.NoError(t, err)
+			require.Nil(t, k, tbl)
+			c.Close()
+		}
+		return nil
+	}))
+}
+
+func TestDeleteExpiredLimitsStale(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	ctx := context.Background()
+	now := time.Unix(1_000_000, 0)
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		for i := byte(0); i < 3; i++ { // stale: entries don't exist
+			if err := tx.Put(kv.TTLIndex, indexKey(uint64(now.Unix()), kv.PlainState, []byte{i}), nil); err != nil {
+				return err
+			}
+		}
+		n, err := DeleteExpired(tx, now, 2)
+		require.NoError(t, err)
+		require.Zero(t, n)
+		c, err := tx.Cursor(kv.TTLIndex)
+		require.NoError(t, err)
+		defer c.Close()
+		left, err := c.Count()
+		require.Equal(t, uint64(1), left) // only `limit` entries of index are visited
+		return err
+	}))
+}
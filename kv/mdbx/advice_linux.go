@@ -0,0 +1,32 @@
+//go:build linux
+
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import "golang.org/x/sys/unix"
+
+const (
+	adviceWillNeed = unix.MADV_WILLNEED
+	adviceCold     = unix.MADV_COLD // linux 5.4+, older kernels return EINVAL
+)
+
+// madvise - by address: pages of db are not Go memory. Errors are ignored - it's only a hint:
+// region may be already unmapped by env resize
+func madvise(addr, size uintptr, advice int) {
+	_, _, _ = unix.Syscall(unix.SYS_MADVISE, addr, size, uintptr(advice))
+}
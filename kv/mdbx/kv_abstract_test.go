@@ -17,17 +17,22 @@
 package mdbx_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"runtime"
 	"testing"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 	"github.com/ledgerwatch/erigon-lib/kv/remotedb"
 	"github.com/ledgerwatch/erigon-lib/kv/remotedbserver"
 	"github.com/ledgerwatch/log/v3"
@@ -328,6 +333,142 @@ func TestRemoteKvRange(t *testing.T) {
 		return nil
 	})
 	require.NoError(err)
+
+	// continuation token: Range stopped in one tx is resumed in another, across pages of server
+	const n = remotedbserver.PageSizeLimit + 100
+	key := func(i uint64) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, i)
+		return k
+	}
+	require.NoError(writeDB.Update(ctx, func(tx kv.RwTx) error {
+		for i := uint64(0); i < n; i++ {
+			if err := tx.Put(kv.Headers, key(i), key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	stopAt := func(it iter.KV, amount int) (last []byte, token string) {
+		for i := 0; i < amount && it.HasNext(); i++ {
+			k, _, err := it.Next()
+			require.NoError(err)
+			last = k
+		}
+		token, err := iter.ContinuationToken(it)
+		require.NoError(err)
+		return common.Copy(last), token
+	}
+	var token string
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		it, err := tx.RangeAscend(kv.Headers, nil, nil, n-50)
+		require.NoError(err)
+		last, tok := stopAt(it, 10)
+		require.Equal(key(9), last)
+		token = tok
+		return nil
+	}))
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		it, err := tx.(remotedb.ResumableTx).RangeResume(kv.Headers, nil, order.Asc, token)
+		require.NoError(err)
+		keys, _, err := iter.ToKVArray(it)
+		require.NoError(err)
+		require.Equal(n-60, len(keys)) // remaining limit
+		require.Equal(key(10), keys[0])
+		require.Equal(key(n-51), keys[len(keys)-1])
+		token, err = iter.ContinuationToken(it)
+		require.NoError(err)
+		require.Equal("", token)
+
+		it, err = tx.RangeDescend(kv.Headers, nil, nil, -1)
+		require.NoError(err)
+		last, tok := stopAt(it, 5)
+		require.Equal(key(n-5), last)
+		it, err = tx.(remotedb.ResumableTx).RangeResume(kv.Headers, nil, order.Desc, tok)
+		require.NoError(err)
+		keys, _, err = iter.ToKVArray(it)
+		require.NoError(err)
+		require.Equal(n-5, len(keys))
+		require.Equal(key(n-6), keys[0])
+		return nil
+	}))
+}
+
+func TestRemoteKvRecordReplay(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win please")
+	}
+	ctx, writeDB := context.Background(), memdb.NewTestDB(t)
+	require := require.New(t)
+	require.NoError(writeDB.Update(ctx, func(tx kv.RwTx) error {
+		wc, err := tx.RwCursorDupSort(kv.PlainState)
+		require.NoError(err)
+		require.NoError(wc.Append([]byte{1}, []byte{1}))
+		require.NoError(wc.Append([]byte{1}, []byte{2}))
+		require.NoError(wc.Append([]byte{2}, []byte{1}))
+		require.NoError(wc.Append([]byte{3}, []byte{1}))
+		return nil
+	}))
+
+	grpcServer, conn := grpc.NewServer(), bufconn.Listen(1024*1024)
+	go func() {
+		remote.RegisterKVServer(grpcServer, remotedbserver.NewKvServer(ctx, writeDB, nil, nil))
+		if err := grpcServer.Serve(conn); err != nil {
+			log.Error("private RPC server fail", "err", err)
+		}
+	}()
+	t.Cleanup(grpcServer.Stop)
+	cc, err := grpc.Dial("", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, url string) (net.Conn, error) { return conn.Dial() }))
+	require.NoError(err)
+
+	v := gointerfaces.VersionFromProto(remotedbserver.KvServiceAPIVersion)
+	read := func(db kv.RoDB) (res []string) {
+		require.True(db.(*remotedb.RemoteKV).EnsureVersionCompatibility())
+		require.NoError(db.View(ctx, func(tx kv.Tx) error {
+			c, err := tx.CursorDupSort(kv.PlainState)
+			require.NoError(err)
+			defer c.Close()
+			for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+				require.NoError(err)
+				res = append(res, fmt.Sprintf("cursor %x=%x", k, v))
+			}
+			v, err := c.SeekBothRange([]byte{1}, []byte{2})
+			require.NoError(err)
+			res = append(res, fmt.Sprintf("seekBothRange %x", v))
+			v, err = tx.GetOne(kv.PlainState, []byte{3})
+			require.NoError(err)
+			res = append(res, fmt.Sprintf("getOne %x", v))
+			it, err := tx.RangeDescend(kv.PlainState, []byte{3}, nil, 2)
+			require.NoError(err)
+			for it.HasNext() {
+				k, v, err := it.Next()
+				require.NoError(err)
+				res = append(res, fmt.Sprintf("range %x=%x", k, v))
+			}
+			return nil
+		}))
+		return res
+	}
+
+	var capture bytes.Buffer
+	recorder := remotedb.NewRecordingKVClient(remote.NewKVClient(cc), &capture)
+	db, err := remotedb.NewRemote(v, log.New(), recorder).Open()
+	require.NoError(err)
+	recorded := read(db)
+	require.NoError(recorder.Err())
+	require.Len(recorded, 8)
+
+	replayClient, err := remotedb.NewReplayKVClient(bytes.NewReader(capture.Bytes()))
+	require.NoError(err)
+	replayDB, err := remotedb.NewRemote(v, log.New(), replayClient).Open()
+	require.NoError(err)
+	require.Equal(recorded, read(replayDB))
+
+	// not recorded: new Tx stream and new request
+	_, err = replayDB.BeginRo(ctx)
+	require.ErrorContains(err, "only 1 Tx streams were recorded")
+	_, err = replayClient.Range(ctx, &remote.RangeReq{Table: kv.PlainState, Limit: 1})
+	require.ErrorContains(err, "was not recorded")
 }
 
 func setupDatabases(t *testing.T, logger log.Logger, f mdbx.TableCfgFunc) (writeDBs []kv.RwDB, readDBs []kv.RwDB) {
@@ -51,20 +51,32 @@ func WithChaindataTables(defaultBuckets kv.TableCfg) kv.TableCfg {
 type MdbxOpts struct {
 	// must be in the range from 12.5% (almost empty) to 50% (half empty)
 	// which corresponds to the range from 8192 and to 32768 in units respectively
-	log            log.Logger
-	roTxsLimiter   *semaphore.Weighted
-	bucketsCfg     TableCfgFunc
-	path           string
-	syncPeriod     time.Duration
-	mapSize        datasize.ByteSize
-	growthStep     datasize.ByteSize
-	flags          uint
-	pageSize       uint64
-	dirtySpace     uint64 // if exeed this space, modified pages will `spill` to disk
-	mergeThreshold uint64
-	verbosity      kv.DBVerbosityLvl
-	label          kv.Label // marker to distinct db instances - one process may open many databases. for example to collect metrics of only 1 database
-	inMem          bool
+	log             log.Logger
+	roTxsLimiter    *semaphore.Weighted
+	bucketsCfg      TableCfgFunc
+	path            string
+	syncPeriod      time.Duration
+	mapSize         datasize.ByteSize
+	growthStep      datasize.ByteSize
+	flags           uint
+	pageSize        uint64
+	dirtySpace      uint64 // if exeed this space, modified pages will `spill` to disk
+	dirtyPagesLimit uint64 // if > 0: overrides dirtySpace, see DirtyPagesLimit
+	mergeThreshold  uint64
+	verbosity       kv.DBVerbosityLvl
+	label           kv.Label // marker to distinct db instances - one process may open many databases. for example to collect metrics of only 1 database
+	inMem           bool
+	readAheadSet    bool // see ReadAhead
+
+	asyncSyncLag    uint64        // if > 0: fsync on background goroutine, Commit blocks only if more than this amount of commits are not synced
+	asyncSyncWindow time.Duration // background goroutine syncs at least once per this period
+
+	rwTxWatchdog time.Duration // if > 0: RwTx held longer is reported, see RwTxWatchdog
+
+	groupCommitDelay time.Duration // if > 0: UpdateAsync calls are committed in groups, see GroupCommit
+	groupCommitCalls int
+
+	takeoverTimeout time.Duration // see ExclusiveTakeover
 }
 
 func NewMDBX(log log.Logger) MdbxOpts {
@@ -161,6 +173,31 @@ func (opts MdbxOpts) SyncPeriod(period time.Duration) MdbxOpts {
 	return opts
 }
 
+// AsyncSync - commit doesn't wait for data-file fsync: it happens on background goroutine
+// while caller already prepares next RwTx. Durability window: not more than `maxLag` commits
+// and not more than `window` time (0 - no time limit). Use MdbxKV.SyncBarrier to wait for durability.
+func (opts MdbxOpts) AsyncSync(maxLag uint64, window time.Duration) MdbxOpts {
+	opts.asyncSyncLag = maxLag
+	opts.asyncSyncWindow = window
+	return opts
+}
+
+// RwTxWatchdog - RwTx held longer than `threshold` is reported to log (with stacks of its holder) and by
+// MdbxKV.LongRwTx: long RwTx silently blocks all other writers.
+func (opts MdbxOpts) RwTxWatchdog(threshold time.Duration) MdbxOpts {
+	opts.rwTxWatchdog = threshold
+	return opts
+}
+
+// GroupCommit - UpdateAsync calls of all goroutines are applied to one RwTx, which is committed after `maxDelay`
+// or `maxCalls` calls (0 - unlimited): fewer mdbx commits and fsyncs for write-heavy jobs of small batches.
+// Use MdbxKV.Flush as durability barrier. RwTx of group holds writer slot: other writers wait up to `maxDelay`.
+func (opts MdbxOpts) GroupCommit(maxDelay time.Duration, maxCalls int) MdbxOpts {
+	opts.groupCommitDelay = maxDelay
+	opts.groupCommitCalls = maxCalls
+	return opts
+}
+
 func (opts MdbxOpts) DBVerbosity(v kv.DBVerbosityLvl) MdbxOpts {
 	opts.verbosity = v
 	return opts
@@ -181,12 +218,24 @@ func (opts MdbxOpts) WriteMergeThreshold(v uint64) MdbxOpts {
 	return opts
 }
 
+// ReadAhead - OS read-ahead of pages of env. By default: enabled only if all tables have kv.AccessScans hint,
+// otherwise read-ahead pollutes page cache by neighbours of point reads (scan cursors do own read-ahead, see kv.AccessScans).
+func (opts MdbxOpts) ReadAhead(on bool) MdbxOpts {
+	opts.readAheadSet = true
+	if on {
+		opts.flags &^= mdbx.NoReadahead
+	} else {
+		opts.flags |= mdbx.NoReadahead
+	}
+	return opts
+}
+
 func (opts MdbxOpts) WithTableCfg(f TableCfgFunc) MdbxOpts {
 	opts.bucketsCfg = f
 	return opts
 }
 
-func (opts MdbxOpts) Open() (kv.RwDB, error) {
+func (opts MdbxOpts) open() (kv.RwDB, error) {
 	if dbg.WriteMap() {
 		opts = opts.WriteMap() //nolint
 	}
@@ -196,11 +245,21 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 	if dbg.NoSync() {
 		opts = opts.Flags(func(u uint) uint { return u | mdbx.SafeNoSync }) //nolint
 	}
+	if opts.asyncSyncLag > 0 && !opts.inMem && opts.flags&mdbx.Readonly == 0 {
+		opts = opts.Flags(func(u uint) uint { return u | mdbx.SafeNoSync }) //nolint
+	}
 	if dbg.MergeTr() > 0 {
 		opts = opts.WriteMergeThreshold(uint64(dbg.MergeTr() * 8192)) //nolint
 	}
 	if dbg.MdbxReadAhead() {
-		opts = opts.Flags(func(u uint) uint { return u &^ mdbx.NoReadahead }) //nolint
+		opts = opts.ReadAhead(true) //nolint
+	}
+	customBuckets := opts.bucketsCfg(kv.ChaindataTablesCfg)
+	if !opts.readAheadSet && scansOnly(customBuckets) {
+		opts = opts.ReadAhead(true) //nolint
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 	env, err := mdbx.NewEnv()
 	if err != nil {
@@ -242,9 +301,11 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 
 	err = env.Open(opts.path, opts.flags, 0664)
 	if err != nil {
-		if err != nil {
-			return nil, fmt.Errorf("%w, label: %s, trace: %s", err, opts.label.String(), stack2.Trace().String())
+		env.Close() // failed env can't be re-opened
+		if isBusy(err) {
+			return nil, fmt.Errorf("%w: %s, label: %s, path: %s", ErrEnvBusy, err, opts.label.String(), opts.path)
 		}
+		return nil, fmt.Errorf("%w, label: %s, trace: %s", err, opts.label.String(), stack2.Trace().String())
 	}
 
 	// mdbx will not change pageSize if db already exists. means need read real value after env.open()
@@ -262,7 +323,8 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 	}
 	// erigon using big transactions
 	// increase "page measured" options. need do it after env.Open() because default are depend on pageSize known only after env.Open()
-	if opts.flags&mdbx.Readonly == 0 {
+	// setting of option waits for RwTx of other processes: with Accede options of env are kept
+	if opts.flags&mdbx.Readonly == 0 && opts.flags&mdbx.Accede == 0 {
 		// 1/8 is good for transactions with a lot of modifications - to reduce invalidation size.
 		// But Erigon app now using Batch and etl.Collectors to avoid writing to DB frequently changing data.
 		// It means most of our writes are: APPEND or "single UPSERT per key during transaction"
@@ -285,7 +347,11 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 			return nil, err
 		}
 
-		if err = env.SetOption(mdbx.OptTxnDpLimit, opts.dirtySpace/opts.pageSize); err != nil {
+		dpLimit := opts.dirtyPagesLimit
+		if dpLimit == 0 {
+			dpLimit = opts.dirtySpace / opts.pageSize
+		}
+		if err = env.SetOption(mdbx.OptTxnDpLimit, dpLimit); err != nil {
 			return nil, err
 		}
 		// must be in the range from 12.5% (almost empty) to 50% (half empty)
@@ -322,9 +388,9 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 		buckets:      kv.TableCfg{},
 		txSize:       dirtyPagesLimit * opts.pageSize,
 		roTxsLimiter: opts.roTxsLimiter,
+		writers:      newWriterQueue(opts.label),
 	}
 
-	customBuckets := opts.bucketsCfg(kv.ChaindataTablesCfg)
 	for name, cfg := range customBuckets { // copy map to avoid changing global variable
 		db.buckets[name] = cfg
 	}
@@ -361,16 +427,38 @@ func (opts MdbxOpts) Open() (kv.RwDB, error) {
 	}
 
 	if !opts.inMem {
-		if staleReaders, err := db.env.ReaderCheck(); err != nil {
+		if _, err := db.ClearStaleReaders(); err != nil {
 			db.log.Error("failed ReaderCheck", "err", err)
-		} else if staleReaders > 0 {
-			db.log.Info("cleared reader slots from dead processes", "amount", staleReaders)
 		}
-
 	}
+	if opts.asyncSyncLag > 0 && !opts.inMem && opts.flags&mdbx.Readonly == 0 {
+		db.syncer = newAsyncSyncer(env, opts.asyncSyncLag, opts.asyncSyncWindow, opts.log)
+	}
+	if opts.rwTxWatchdog > 0 && opts.flags&mdbx.Readonly == 0 {
+		db.watchdog = newRwTxWatchdog(opts.label, opts.rwTxWatchdog, opts.log)
+	}
+	if opts.groupCommitDelay > 0 && opts.flags&mdbx.Readonly == 0 {
+		db.group = newGroupCommitter(db, opts.groupCommitDelay, opts.groupCommitCalls)
+	}
+	db.logOpened(in, dirtyPagesLimit)
 	return db, nil
 }
 
+// scansOnly - all tables are read by scans, see kv.AccessScans
+func scansOnly(cfg kv.TableCfg) bool {
+	n := 0
+	for _, item := range cfg {
+		if item.IsDeprecated {
+			continue
+		}
+		if item.Access != kv.AccessScans {
+			return false
+		}
+		n++
+	}
+	return n > 0
+}
+
 func (opts MdbxOpts) MustOpen() kv.RwDB {
 	db, err := opts.Open()
 	if err != nil {
@@ -388,11 +476,32 @@ type MdbxKV struct {
 	opts         MdbxOpts
 	txSize       uint64
 	closed       atomic.Bool
+	syncer       *asyncSyncer    // nil if AsyncSync option is not set
+	watchdog     *rwTxWatchdog   // nil if RwTxWatchdog option is not set
+	group        *groupCommitter // nil if GroupCommit option is not set
+	writers      *writerQueue
 }
 
 func (db *MdbxKV) PageSize() uint64 { return db.opts.pageSize }
 func (db *MdbxKV) ReadOnly() bool   { return db.opts.HasFlag(mdbx.Readonly) }
 
+// SyncBarrier - waits until all RwTx committed before this call are synced to disk.
+// Noop if AsyncSync option is not set.
+func (db *MdbxKV) SyncBarrier() error {
+	if db.syncer == nil {
+		return nil
+	}
+	return db.syncer.barrier()
+}
+
+// SyncLag - amount of committed but not yet synced RwTx
+func (db *MdbxKV) SyncLag() uint64 {
+	if db.syncer == nil {
+		return 0
+	}
+	return db.syncer.lag()
+}
+
 // openDBIs - first trying to open existing DBI's in RO transaction
 // otherwise re-try by RW transaction
 // it allow open DB from another process - even if main process holding long RW transaction
@@ -412,6 +521,29 @@ func (db *MdbxKV) openDBIs(buckets []string) error {
 			return err
 		}
 	} else {
+		// RwTx waits for RwTx of other processes: not needed if all tables exist
+		allExist := true
+		if err := db.View(context.Background(), func(tx kv.Tx) error {
+			for _, name := range buckets {
+				if db.buckets[name].IsDeprecated {
+					continue
+				}
+				exists, err := tx.(*MdbxTx).openExistingBucket(name)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					allExist = false
+					return nil
+				}
+			}
+			return tx.Commit() // DBI handles opened by RO transaction are kept only after commit
+		}); err != nil {
+			return err
+		}
+		if allExist {
+			return nil
+		}
 		if err := db.Update(context.Background(), func(tx kv.RwTx) error {
 			for _, name := range buckets {
 				if db.buckets[name].IsDeprecated {
@@ -436,7 +568,16 @@ func (db *MdbxKV) Close() {
 		return
 	}
 	db.closed.Store(true)
+	if db.group != nil {
+		db.group.close()
+	}
 	db.wg.Wait()
+	if db.syncer != nil {
+		db.syncer.close()
+	}
+	if db.watchdog != nil {
+		db.watchdog.close()
+	}
 	db.env.Close()
 	db.env = nil
 
@@ -505,6 +646,14 @@ func (db *MdbxKV) beginRw(ctx context.Context, flags uint) (txn kv.RwTx, err err
 	if db.closed.Load() {
 		return nil, fmt.Errorf("db closed")
 	}
+	if err := db.writers.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("BeginRw: waiting for writer slot: %w, label: %s", err, db.opts.label.String())
+	}
+	return db.beginRwAcquired(ctx, flags)
+}
+
+// beginRwAcquired - caller holds writer slot, it's released on error
+func (db *MdbxKV) beginRwAcquired(ctx context.Context, flags uint) (txn kv.RwTx, err error) {
 	runtime.LockOSThread()
 	defer func() {
 		if err == nil {
@@ -515,8 +664,15 @@ func (db *MdbxKV) beginRw(ctx context.Context, flags uint) (txn kv.RwTx, err err
 	tx, err := db.env.BeginTxn(nil, flags)
 	if err != nil {
 		runtime.UnlockOSThread() // unlock only in case of error. normal flow is "defer .Rollback()"
+		db.writers.release()
+		if flags&mdbx.TxTry != 0 && isBusy(err) {
+			return nil, fmt.Errorf("%w: in other process, label: %s", ErrWriterPresent, db.opts.label.String())
+		}
 		return nil, fmt.Errorf("%w, lable: %s, trace: %s", err, db.opts.label.String(), stack2.Trace().String())
 	}
+	if db.watchdog != nil {
+		db.watchdog.begin()
+	}
 	return &MdbxTx{
 		db:  db,
 		tx:  tx,
@@ -542,6 +698,7 @@ type MdbxCursor struct {
 	bucketCfg  kv.TableCfgItem
 	dbi        mdbx.DBI
 	id         uint64
+	scan       *scanAdvice // see kv.AccessScans
 }
 
 func (db *MdbxKV) Env() *mdbx.Env {
@@ -658,26 +815,35 @@ func (db *MdbxKV) Update(ctx context.Context, f func(tx kv.RwTx) error) (err err
 	return nil
 }
 
-func (tx *MdbxTx) CreateBucket(name string) error {
+// openExistingBucket - false if bucket doesn't exist
+func (tx *MdbxTx) openExistingBucket(name string) (bool, error) {
 	cnfCopy := tx.db.buckets[name]
 	dbi, err := tx.tx.OpenDBI(name, mdbx.DBAccede, nil, nil)
-	if err != nil && !mdbx.IsNotFound(err) {
-		return fmt.Errorf("create bucket: %s, %w", name, err)
-	}
-	if err == nil {
-		cnfCopy.DBI = kv.DBI(dbi)
-		var flags uint
-		flags, err = tx.tx.Flags(dbi)
-		if err != nil {
-			return err
+	if err != nil {
+		if mdbx.IsNotFound(err) {
+			return false, nil
 		}
-		cnfCopy.Flags = kv.TableFlags(flags)
+		return false, fmt.Errorf("create bucket: %s, %w", name, err)
+	}
+	cnfCopy.DBI = kv.DBI(dbi)
+	flags, err := tx.tx.Flags(dbi)
+	if err != nil {
+		return false, err
+	}
+	cnfCopy.Flags = kv.TableFlags(flags)
 
-		tx.db.buckets[name] = cnfCopy
-		return nil
+	tx.db.buckets[name] = cnfCopy
+	return true, nil
+}
+
+func (tx *MdbxTx) CreateBucket(name string) error {
+	exists, err := tx.openExistingBucket(name)
+	if err != nil || exists {
+		return err
 	}
 
 	// if bucket doesn't exists - create it
+	cnfCopy := tx.db.buckets[name]
 
 	var flags = tx.db.buckets[name].Flags
 	var nativeFlags uint
@@ -693,7 +859,7 @@ func (tx *MdbxTx) CreateBucket(name string) error {
 		return fmt.Errorf("some not supported flag provided for bucket")
 	}
 
-	dbi, err = tx.tx.OpenDBI(name, nativeFlags, nil, nil)
+	dbi, err := tx.tx.OpenDBI(name, nativeFlags, nil, nil)
 
 	if err != nil {
 		return fmt.Errorf("create bucket: %s, %w", name, err)
@@ -736,6 +902,88 @@ func (tx *MdbxTx) ClearBucket(bucket string) error {
 	return tx.tx.Drop(mdbx.DBI(dbi), false)
 }
 
+// RenameBucket - see kv.BucketMigrator. Libmdbx can't rename named databases: content is moved by copying.
+func (tx *MdbxTx) RenameBucket(from, to string) error {
+	fromDBI, toDBI, dupSort, err := tx.dbisToMove(from, to)
+	if err != nil {
+		return err
+	}
+	return tx.moveDBI(fromDBI, toDBI, dupSort)
+}
+
+// SwapBuckets - see kv.BucketMigrator. Content is exchanged by copying through temporary named database.
+func (tx *MdbxTx) SwapBuckets(a, b string) error {
+	aDBI, bDBI, dupSort, err := tx.dbisToMove(a, b)
+	if err != nil {
+		return err
+	}
+	flags := uint(mdbx.Create)
+	if dupSort {
+		flags |= mdbx.DupSort
+	}
+	tmp, err := tx.tx.OpenDBI("_swap_"+a, flags, nil, nil)
+	if err != nil {
+		return fmt.Errorf("swap buckets: %s, %s: %w", a, b, err)
+	}
+	if err = tx.moveDBI(aDBI, tmp, dupSort); err != nil {
+		return err
+	}
+	if err = tx.moveDBI(bDBI, aDBI, dupSort); err != nil {
+		return err
+	}
+	if err = tx.moveDBI(tmp, bDBI, dupSort); err != nil {
+		return err
+	}
+	return tx.tx.Drop(tmp, true)
+}
+
+func (tx *MdbxTx) dbisToMove(a, b string) (aDBI, bDBI mdbx.DBI, dupSort bool, err error) {
+	aCfg, bCfg := tx.db.buckets[a], tx.db.buckets[b]
+	if aCfg.DBI == NonExistingDBI || bCfg.DBI == NonExistingDBI {
+		return 0, 0, false, fmt.Errorf("move bucket: %s, %s: %w", a, b, kv.ErrUnknownBucket)
+	}
+	if aCfg.Flags != bCfg.Flags {
+		return 0, 0, false, fmt.Errorf("move bucket: %s, %s: different flags %d != %d", a, b, aCfg.Flags, bCfg.Flags)
+	}
+	return mdbx.DBI(aCfg.DBI), mdbx.DBI(bCfg.DBI), aCfg.Flags&kv.DupSort != 0, nil
+}
+
+// moveDBI - all pairs of `from` appended to cleared `to`, then `from` is cleared
+func (tx *MdbxTx) moveDBI(from, to mdbx.DBI, dupSort bool) error {
+	if err := tx.tx.Drop(to, false); err != nil {
+		return err
+	}
+	src, err := tx.tx.OpenCursor(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := tx.tx.OpenCursor(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	flags := uint(mdbx.Append)
+	if dupSort {
+		flags |= mdbx.AppendDup
+	}
+	var kBuf, vBuf []byte
+	for k, v, err := src.Get(nil, nil, mdbx.First); ; k, v, err = src.Get(nil, nil, mdbx.Next) {
+		if err != nil {
+			if mdbx.IsNotFound(err) {
+				break
+			}
+			return err
+		}
+		// k, v may point to dirty pages of this tx, which writes to `to` can spill
+		kBuf, vBuf = append(kBuf[:0], k...), append(vBuf[:0], v...)
+		if err = dst.Put(kBuf, vBuf, flags); err != nil {
+			return err
+		}
+	}
+	return tx.tx.Drop(from, false)
+}
+
 func (tx *MdbxTx) DropBucket(bucket string) error {
 	if cfg, ok := tx.db.buckets[bucket]; !(ok && cfg.IsDeprecated) {
 		return fmt.Errorf("%w, bucket: %s", kv.ErrAttemptToDeleteNonDeprecatedBucket, bucket)
@@ -761,7 +1009,11 @@ func (tx *MdbxTx) Commit() error {
 		if tx.readOnly {
 			tx.db.roTxsLimiter.Release(1)
 		} else {
+			if tx.db.watchdog != nil {
+				tx.db.watchdog.end()
+			}
 			runtime.UnlockOSThread()
+			tx.db.writers.release()
 		}
 	}()
 	tx.closeCursors()
@@ -798,6 +1050,10 @@ func (tx *MdbxTx) Commit() error {
 		//kv.DbGcSelfPnlMergeCalls.Set(uint64(latency.GCDetails.SelfPnlMergeCalls))
 	}
 
+	if !tx.readOnly && tx.db.syncer != nil {
+		return tx.db.syncer.onCommit()
+	}
+
 	return nil
 }
 
@@ -811,7 +1067,11 @@ func (tx *MdbxTx) Rollback() {
 		if tx.readOnly {
 			tx.db.roTxsLimiter.Release(1)
 		} else {
+			if tx.db.watchdog != nil {
+				tx.db.watchdog.end()
+			}
 			runtime.UnlockOSThread()
+			tx.db.writers.release()
 		}
 	}()
 	tx.closeCursors()
@@ -1026,7 +1286,7 @@ func (tx *MdbxTx) Cursor(bucket string) (kv.Cursor, error) {
 
 func (tx *MdbxTx) stdCursor(bucket string) (kv.RwCursor, error) {
 	b := tx.db.buckets[bucket]
-	c := &MdbxCursor{bucketName: bucket, tx: tx, bucketCfg: b, dbi: mdbx.DBI(tx.db.buckets[bucket].DBI), id: tx.cursorID}
+	c := &MdbxCursor{bucketName: bucket, tx: tx, bucketCfg: b, dbi: mdbx.DBI(tx.db.buckets[bucket].DBI), id: tx.cursorID, scan: newScanAdvice(tx, b)}
 	tx.cursorID++
 
 	var err error
@@ -1055,17 +1315,25 @@ func (tx *MdbxTx) CursorDupSort(bucket string) (kv.CursorDupSort, error) {
 	return tx.RwCursorDupSort(bucket)
 }
 
+func (c *MdbxCursor) get(k, v []byte, op uint) ([]byte, []byte, error) {
+	k, v, err := c.c.Get(k, v, op)
+	if c.scan != nil && err == nil {
+		c.scan.read(v)
+	}
+	return k, v, err
+}
+
 // methods here help to see better pprof picture
-func (c *MdbxCursor) set(k []byte) ([]byte, []byte, error) { return c.c.Get(k, nil, mdbx.Set) }
-func (c *MdbxCursor) getCurrent() ([]byte, []byte, error)  { return c.c.Get(nil, nil, mdbx.GetCurrent) }
-func (c *MdbxCursor) first() ([]byte, []byte, error)       { return c.c.Get(nil, nil, mdbx.First) }
-func (c *MdbxCursor) next() ([]byte, []byte, error)        { return c.c.Get(nil, nil, mdbx.Next) }
-func (c *MdbxCursor) nextDup() ([]byte, []byte, error)     { return c.c.Get(nil, nil, mdbx.NextDup) }
-func (c *MdbxCursor) nextNoDup() ([]byte, []byte, error)   { return c.c.Get(nil, nil, mdbx.NextNoDup) }
-func (c *MdbxCursor) prev() ([]byte, []byte, error)        { return c.c.Get(nil, nil, mdbx.Prev) }
-func (c *MdbxCursor) prevDup() ([]byte, []byte, error)     { return c.c.Get(nil, nil, mdbx.PrevDup) }
-func (c *MdbxCursor) prevNoDup() ([]byte, []byte, error)   { return c.c.Get(nil, nil, mdbx.PrevNoDup) }
-func (c *MdbxCursor) last() ([]byte, []byte, error)        { return c.c.Get(nil, nil, mdbx.Last) }
+func (c *MdbxCursor) set(k []byte) ([]byte, []byte, error) { return c.get(k, nil, mdbx.Set) }
+func (c *MdbxCursor) getCurrent() ([]byte, []byte, error)  { return c.get(nil, nil, mdbx.GetCurrent) }
+func (c *MdbxCursor) first() ([]byte, []byte, error)       { return c.get(nil, nil, mdbx.First) }
+func (c *MdbxCursor) next() ([]byte, []byte, error)        { return c.get(nil, nil, mdbx.Next) }
+func (c *MdbxCursor) nextDup() ([]byte, []byte, error)     { return c.get(nil, nil, mdbx.NextDup) }
+func (c *MdbxCursor) nextNoDup() ([]byte, []byte, error)   { return c.get(nil, nil, mdbx.NextNoDup) }
+func (c *MdbxCursor) prev() ([]byte, []byte, error)        { return c.get(nil, nil, mdbx.Prev) }
+func (c *MdbxCursor) prevDup() ([]byte, []byte, error)     { return c.get(nil, nil, mdbx.PrevDup) }
+func (c *MdbxCursor) prevNoDup() ([]byte, []byte, error)   { return c.get(nil, nil, mdbx.PrevNoDup) }
+func (c *MdbxCursor) last() ([]byte, []byte, error)        { return c.get(nil, nil, mdbx.Last) }
 func (c *MdbxCursor) delCurrent() error                    { return c.c.Del(mdbx.Current) }
 func (c *MdbxCursor) delAllDupData() error                 { return c.c.Del(mdbx.AllDups) }
 func (c *MdbxCursor) put(k, v []byte) error                { return c.c.Put(k, v, 0) }
@@ -1075,22 +1343,22 @@ func (c *MdbxCursor) putNoDupData(k, v []byte) error       { return c.c.Put(k, v
 func (c *MdbxCursor) append(k, v []byte) error             { return c.c.Put(k, v, mdbx.Append) }
 func (c *MdbxCursor) appendDup(k, v []byte) error          { return c.c.Put(k, v, mdbx.AppendDup) }
 func (c *MdbxCursor) getBoth(k, v []byte) ([]byte, error) {
-	_, v, err := c.c.Get(k, v, mdbx.GetBoth)
+	_, v, err := c.get(k, v, mdbx.GetBoth)
 	return v, err
 }
 func (c *MdbxCursor) setRange(k []byte) ([]byte, []byte, error) {
-	return c.c.Get(k, nil, mdbx.SetRange)
+	return c.get(k, nil, mdbx.SetRange)
 }
 func (c *MdbxCursor) getBothRange(k, v []byte) ([]byte, error) {
-	_, v, err := c.c.Get(k, v, mdbx.GetBothRange)
+	_, v, err := c.get(k, v, mdbx.GetBothRange)
 	return v, err
 }
 func (c *MdbxCursor) firstDup() ([]byte, error) {
-	_, v, err := c.c.Get(nil, nil, mdbx.FirstDup)
+	_, v, err := c.get(nil, nil, mdbx.FirstDup)
 	return v, err
 }
 func (c *MdbxCursor) lastDup() ([]byte, error) {
-	_, v, err := c.c.Get(nil, nil, mdbx.LastDup)
+	_, v, err := c.get(nil, nil, mdbx.LastDup)
 	return v, err
 }
 
@@ -1452,6 +1720,7 @@ func (c *MdbxCursor) Close() {
 		c.c.Close()
 		delete(c.tx.cursors, c.id)
 		c.c = nil
+		c.scan.cold()
 	}
 }
 
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+const (
+	scanPrefaultPages = 32   // read-ahead of scan, in os pages
+	scanMaxColdPages  = 4096 // pages are marked cold in batches, to limit memory of long scans
+)
+
+var osPageSize = uintptr(os.Getpagesize())
+
+// scanAdvice - page-cache hints of cursor of table with kv.AccessScans. Env read-ahead is usually off (it's good for point reads),
+// so cursor does own read-ahead: prefaults pages which follow page it reads, if reads go page by page.
+// Pages read by cursor are marked cold - first candidates for eviction, to not push out hot state.
+// Only for read-only transactions: they see only pages of mmap, dirty pages of RwTx are in process memory.
+type scanAdvice struct {
+	pages        map[uintptr]struct{} // os pages read or prefaulted by cursor, not marked cold yet
+	last         uintptr              // last page read
+	prefaultedTo uintptr
+}
+
+func newScanAdvice(tx *MdbxTx, cfg kv.TableCfgItem) *scanAdvice {
+	if !tx.readOnly || cfg.Access != kv.AccessScans {
+		return nil
+	}
+	return &scanAdvice{pages: map[uintptr]struct{}{}}
+}
+
+// read - v is value returned by mdbx: points to mmap. Key is not used: it may be memory of caller (Set)
+func (a *scanAdvice) read(v []byte) {
+	if a == nil || len(v) == 0 {
+		return
+	}
+	from := uintptr(unsafe.Pointer(&v[0])) &^ (osPageSize - 1)
+	to := uintptr(unsafe.Pointer(&v[len(v)-1])) &^ (osPageSize - 1)
+	for p := from; p <= to; p += osPageSize {
+		a.pages[p] = struct{}{}
+	}
+	if from == a.last+osPageSize && to+osPageSize >= a.prefaultedTo {
+		a.prefaultedTo = to + (scanPrefaultPages+1)*osPageSize
+		madvise(to+osPageSize, scanPrefaultPages*osPageSize, adviceWillNeed)
+		for p := to + osPageSize; p < a.prefaultedTo; p += osPageSize {
+			a.pages[p] = struct{}{}
+		}
+	}
+	a.last = to
+	if len(a.pages) >= scanMaxColdPages {
+		a.cold()
+	}
+}
+
+func (a *scanAdvice) cold() {
+	if a == nil {
+		return
+	}
+	for p := range a.pages {
+		madvise(p, osPageSize, adviceCold)
+		delete(a.pages, p)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+var errGroupCommitClosed = errors.New("group commit: db closed")
+
+// groupCommitter - applies UpdateAsync calls of many goroutines to one RwTx and commits it once per `maxDelay`
+// or `maxCalls` calls: one mdbx commit (and fsync) for many small logical commits.
+// RwTx lives on committer goroutine (mdbx binds RwTx to OS thread), callers send their functions to it.
+//
+// Each call is applied in nested RwTx: call which returns error doesn't leave changes, other calls of group are not
+// affected. Failed commit of group loses its calls (they are acknowledged already): error is returned by next Flush.
+type groupCommitter struct {
+	db       *MdbxKV
+	maxDelay time.Duration
+	maxCalls int // 0 - unlimited
+
+	calls   chan groupCall
+	flushes chan chan error
+	quit    chan struct{}
+	done    chan struct{}
+
+	// owned by loop goroutine
+	tx       *MdbxTx
+	applied  int              // calls of current group
+	deadline <-chan time.Time // commit of current group
+	err      error            // failed commit since last flush
+
+	commits    *metrics.Counter
+	groupCalls *metrics.Histogram
+}
+
+type groupCall struct {
+	f      func(tx kv.RwTx) error
+	result chan error
+}
+
+func newGroupCommitter(db *MdbxKV, maxDelay time.Duration, maxCalls int) *groupCommitter {
+	g := &groupCommitter{
+		db:         db,
+		maxDelay:   maxDelay,
+		maxCalls:   maxCalls,
+		calls:      make(chan groupCall),
+		flushes:    make(chan chan error),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		commits:    metrics.GetOrCreateCounter(fmt.Sprintf(`db_group_commits_total{label="%s"}`, db.opts.label)),
+		groupCalls: metrics.GetOrCreateHistogram(fmt.Sprintf(`db_group_commit_calls{label="%s"}`, db.opts.label)),
+	}
+	go g.loop()
+	return g
+}
+
+func (g *groupCommitter) loop() {
+	defer close(g.done)
+	for {
+		select {
+		case <-g.quit:
+			g.commit()
+			return
+		case c := <-g.calls:
+			c.result <- g.apply(c.f)
+			if g.maxCalls > 0 && g.applied >= g.maxCalls {
+				g.commit()
+			}
+		case <-g.deadline:
+			g.commit()
+		case res := <-g.flushes:
+			g.commit()
+			res <- g.err
+			g.err = nil
+		}
+	}
+}
+
+func (g *groupCommitter) apply(f func(tx kv.RwTx) error) error {
+	if g.tx == nil {
+		tx, err := g.db.BeginRw(context.Background())
+		if err != nil {
+			return err
+		}
+		g.tx, g.deadline = tx.(*MdbxTx), time.After(g.maxDelay)
+	}
+	// nested RwTx is committed into RwTx of group if f succeeds, aborted otherwise
+	if err := g.tx.tx.Sub(func(child *mdbx.Txn) error {
+		tx := &MdbxTx{db: g.db, tx: child, ctx: g.tx.ctx}
+		defer tx.closeCursors()
+		return f(tx)
+	}); err != nil {
+		return err
+	}
+	g.applied++
+	return nil
+}
+
+func (g *groupCommitter) commit() {
+	if g.tx == nil {
+		return
+	}
+	n := g.applied
+	err := g.tx.Commit()
+	g.tx, g.applied, g.deadline = nil, 0, nil
+	if err != nil {
+		if g.err == nil {
+			g.err = fmt.Errorf("group commit of %d calls: %w", n, err)
+		}
+		g.db.log.Error("[db] group commit failed", "label", g.db.opts.label, "calls", n, "err", err)
+		return
+	}
+	g.commits.Inc()
+	g.groupCalls.Update(float64(n))
+}
+
+func (g *groupCommitter) submit(ctx context.Context, f func(tx kv.RwTx) error) error {
+	c := groupCall{f: f, result: make(chan error, 1)}
+	select {
+	case g.calls <- c:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-g.done:
+		return errGroupCommitClosed
+	}
+	return <-c.result
+}
+
+func (g *groupCommitter) flush(ctx context.Context) error {
+	res := make(chan error, 1)
+	select {
+	case g.flushes <- res:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-g.done:
+		return errGroupCommitClosed
+	}
+	return <-res
+}
+
+// close - commits current group. Must be called before waiting for RwTx of db
+func (g *groupCommitter) close() {
+	close(g.quit)
+	<-g.done
+}
+
+// UpdateAsync - like Update, but with GroupCommit option `f` is applied to RwTx shared with other UpdateAsync calls
+// and returns before commit: changes are visible to readers after commit of group and durable after Flush.
+// Changes of `f` which returns error are dropped alone. Error of group commit is returned by next Flush: calls
+// acknowledged since previous Flush may be lost. Caller must not hold RwTx of db.
+func (db *MdbxKV) UpdateAsync(ctx context.Context, f func(tx kv.RwTx) error) error {
+	if db.group == nil {
+		return db.Update(ctx, f)
+	}
+	return db.group.submit(ctx, f)
+}
+
+// Flush - durability barrier: commits current group of UpdateAsync calls and waits until all commits done
+// before this call are on disk (with SafeNoSync or AsyncSync options commit doesn't fsync).
+func (db *MdbxKV) Flush(ctx context.Context) error {
+	if db.group != nil {
+		if err := db.group.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if db.syncer != nil {
+		return db.syncer.barrier()
+	}
+	if db.opts.inMem || db.opts.HasFlag(mdbx.Readonly) || db.opts.GetSyncMode() == SyncDurable {
+		return nil
+	}
+	return db.env.Sync(true, false)
+}
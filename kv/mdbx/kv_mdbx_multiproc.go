@@ -0,0 +1,104 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+var (
+	// ErrEnvBusy - env is used by other process (or other env of this process) in incompatible mode:
+	// one of them is opened with Exclusive
+	ErrEnvBusy = errors.New("mdbx: env is used by other process")
+	// ErrWriterPresent - TryBeginRw: RwTx is held by other process or other goroutine of this process
+	ErrWriterPresent = errors.New("mdbx: writer is already present")
+)
+
+// mdbxBusy - MDBX_BUSY is not exported by mdbx-go
+const mdbxBusy = mdbx.Errno(-30778)
+
+var takeoverRetryInterval = 100 * time.Millisecond
+
+func isBusy(err error) bool {
+	return mdbx.IsErrno(err, mdbxBusy) || mdbx.IsErrnoSys(err, syscall.EBUSY) || mdbx.IsErrnoSys(err, syscall.EAGAIN)
+}
+
+// Accede - open env which is already used by other processes with their mode, geometry and dirty pages options
+// (options of this process are ignored instead of error). Open doesn't wait for RwTx of other processes if all tables exist.
+func (opts MdbxOpts) Accede() MdbxOpts {
+	opts.flags |= mdbx.Accede
+	return opts
+}
+
+// ExclusiveTakeover - open env exclusively (see Exclusive), waiting up to `timeout` while other processes close it.
+// Open returns ErrEnvBusy if they didn't.
+func (opts MdbxOpts) ExclusiveTakeover(timeout time.Duration) MdbxOpts {
+	opts.flags |= mdbx.Exclusive
+	opts.takeoverTimeout = timeout
+	return opts
+}
+
+func (opts MdbxOpts) Open() (kv.RwDB, error) {
+	deadline := time.Now().Add(opts.takeoverTimeout)
+	for {
+		db, err := opts.open()
+		if !errors.Is(err, ErrEnvBusy) || opts.takeoverTimeout <= 0 || time.Now().After(deadline) {
+			return db, err
+		}
+		opts.log.Debug("[db] waiting for other processes to close db", "label", opts.label, "path", opts.path)
+		time.Sleep(takeoverRetryInterval)
+	}
+}
+
+// TryBeginRw - like BeginRw, but doesn't wait if RwTx is held by other process or goroutine: returns ErrWriterPresent.
+func (db *MdbxKV) TryBeginRw(ctx context.Context) (kv.RwTx, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if db.closed.Load() {
+		return nil, fmt.Errorf("db closed")
+	}
+	if !db.writers.tryAcquire() {
+		return nil, fmt.Errorf("%w: in this process, label: %s", ErrWriterPresent, db.opts.label.String())
+	}
+	return db.beginRwAcquired(ctx, mdbx.TxTry)
+}
+
+// ClearStaleReaders - releases reader slots of dead processes: their stale read transactions hold pages
+// from re-use and db grows. Done by Open, call it after crash of other process which used db. Returns amount of cleared slots.
+func (db *MdbxKV) ClearStaleReaders() (int, error) {
+	if db.closed.Load() {
+		return 0, fmt.Errorf("db closed")
+	}
+	cleared, err := db.env.ReaderCheck()
+	if err != nil {
+		return 0, err
+	}
+	if cleared > 0 {
+		db.log.Info("cleared reader slots from dead processes", "label", db.opts.label, "amount", cleared)
+	}
+	return cleared, nil
+}
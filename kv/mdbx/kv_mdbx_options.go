@@ -0,0 +1,153 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// SyncMode - durability of commits, see MdbxOpts.SyncMode
+type SyncMode uint8
+
+const (
+	// SyncDurable - commit does fsync of data and meta pages: nothing is lost on crash
+	SyncDurable SyncMode = iota
+	// SyncSafeNoSync - commit doesn't fsync: db is consistent after OS crash, but last commits may be lost.
+	// Use with SyncPeriod or AsyncSync to bound amount of lost commits
+	SyncSafeNoSync
+	// SyncUtterlyNoSync - no fsync at all: db may be corrupted by OS crash. For temporary dbs only
+	SyncUtterlyNoSync
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncDurable:
+		return "durable"
+	case SyncSafeNoSync:
+		return "safe_no_sync"
+	case SyncUtterlyNoSync:
+		return "utterly_no_sync"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(m))
+	}
+}
+
+const syncModeFlags = mdbx.Durable | mdbx.SafeNoSync | mdbx.UtterlyNoSync
+
+const (
+	minPageSize = 256 // limits of mdbx: MDBX_MIN_PAGESIZE, MDBX_MAX_PAGESIZE
+	maxPageSize = 64 * 1024
+
+	minMergeThreshold = 8192 // 16dot16 percent: 12.5%
+	maxMergeThreshold = 32768
+)
+
+// SyncMode - replaces sync flags of env. Default: SyncDurable
+func (opts MdbxOpts) SyncMode(m SyncMode) MdbxOpts {
+	opts.flags &^= syncModeFlags
+	switch m {
+	case SyncSafeNoSync:
+		opts.flags |= mdbx.SafeNoSync
+	case SyncUtterlyNoSync:
+		opts.flags |= mdbx.UtterlyNoSync
+	}
+	return opts
+}
+
+func (opts MdbxOpts) GetSyncMode() SyncMode {
+	switch {
+	case opts.flags&mdbx.UtterlyNoSync == mdbx.UtterlyNoSync:
+		return SyncUtterlyNoSync
+	case opts.flags&mdbx.SafeNoSync != 0:
+		return SyncSafeNoSync
+	default:
+		return SyncDurable
+	}
+}
+
+// MaxSize - upper bound of db file size (same as MapSize). Default: 3TB
+func (opts MdbxOpts) MaxSize(sz datasize.ByteSize) MdbxOpts { return opts.MapSize(sz) }
+
+// DirtyPagesLimit - limit of modified pages of RwTx in pages, above it pages spill to disk.
+// Unlike DirtySpace doesn't depend on page size of existing db. 0 - use DirtySpace
+func (opts MdbxOpts) DirtyPagesLimit(pages uint64) MdbxOpts {
+	opts.dirtyPagesLimit = pages
+	return opts
+}
+
+func (opts MdbxOpts) GetMapSize() datasize.ByteSize    { return opts.mapSize }
+func (opts MdbxOpts) GetGrowthStep() datasize.ByteSize { return opts.growthStep }
+func (opts MdbxOpts) GetDirtySpace() uint64            { return opts.dirtySpace }
+func (opts MdbxOpts) GetReadAhead() bool               { return opts.flags&mdbx.NoReadahead == 0 }
+
+// Validate - checks options before creating env. Called by Open
+func (opts MdbxOpts) Validate() error {
+	if opts.path == "" {
+		return fmt.Errorf("mdbx options: path is not set, label: %s", opts.label)
+	}
+	if opts.flags&mdbx.Readonly != 0 || opts.flags&mdbx.Accede != 0 {
+		return nil // geometry and page options of existing db are used
+	}
+	if opts.pageSize < minPageSize || opts.pageSize > maxPageSize || opts.pageSize&(opts.pageSize-1) != 0 {
+		return fmt.Errorf("mdbx options: page size %d must be power of 2 in range [%d, %d]", opts.pageSize, minPageSize, maxPageSize)
+	}
+	if !opts.inMem {
+		if opts.growthStep == 0 {
+			return fmt.Errorf("mdbx options: growth step must be > 0")
+		}
+		if opts.mapSize > 0 && opts.growthStep > opts.mapSize {
+			return fmt.Errorf("mdbx options: growth step %s is bigger than max size %s", opts.growthStep.HR(), opts.mapSize.HR())
+		}
+	}
+	if opts.mapSize > 0 && uint64(opts.mapSize) < opts.pageSize {
+		return fmt.Errorf("mdbx options: max size %s is less than page size %d", opts.mapSize.HR(), opts.pageSize)
+	}
+	if opts.dirtyPagesLimit == 0 && opts.dirtySpace < opts.pageSize {
+		return fmt.Errorf("mdbx options: dirty space %d is less than page size %d", opts.dirtySpace, opts.pageSize)
+	}
+	if opts.mergeThreshold < minMergeThreshold || opts.mergeThreshold > maxMergeThreshold {
+		return fmt.Errorf("mdbx options: merge threshold %d must be in range [%d, %d]", opts.mergeThreshold, minMergeThreshold, maxMergeThreshold)
+	}
+	if opts.syncPeriod < 0 || opts.asyncSyncWindow < 0 || opts.rwTxWatchdog < 0 || opts.groupCommitDelay < 0 {
+		return fmt.Errorf("mdbx options: negative period")
+	}
+	if opts.groupCommitCalls < 0 {
+		return fmt.Errorf("mdbx options: negative group commit calls")
+	}
+	if opts.groupCommitDelay > 0 && opts.flags&mdbx.WriteMap != 0 {
+		return fmt.Errorf("mdbx options: GroupCommit needs nested transactions, they are not supported with WriteMap")
+	}
+	if opts.GetSyncMode() == SyncUtterlyNoSync && opts.asyncSyncLag > 0 {
+		return fmt.Errorf("mdbx options: AsyncSync is not compatible with %s", SyncUtterlyNoSync)
+	}
+	return nil
+}
+
+// logOpened - effective options: page size and geometry of existing db may differ from requested
+func (db *MdbxKV) logOpened(in *mdbx.EnvInfo, dirtyPagesLimit uint64) {
+	if db.opts.inMem {
+		return
+	}
+	db.log.Info("[db] opened", "label", db.opts.label, "path", db.opts.path,
+		"page_size", db.opts.pageSize, "size", datasize.ByteSize(in.Geo.Current).HR(), "max_size", datasize.ByteSize(in.Geo.Upper).HR(),
+		"growth_step", datasize.ByteSize(in.Geo.Grow).HR(), "dirty_pages_limit", dirtyPagesLimit,
+		"merge_threshold", db.opts.mergeThreshold, "sync", db.opts.GetSyncMode(), "sync_period", db.opts.syncPeriod,
+		"read_ahead", db.opts.GetReadAhead(), "write_map", db.opts.HasFlag(mdbx.WriteMap), "readonly", db.opts.HasFlag(mdbx.Readonly))
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// asyncSyncer - flushes data-file to disk on background goroutine.
+// DB opened with SafeNoSync: Commit doesn't wait for fsync, but only notifies syncer.
+// It allows preparing next RwTx (for example: aggregator Flush) while disk is busy with previous one.
+//
+// Durability window is bounded:
+//   - by amount of commits: Commit will block while more than `maxLag` commits are not synced yet
+//   - by time: syncer wakes up at least once per `window` even if nobody asked
+//
+// Failed fsync is not sticky: it's retried by next wake up (commit, barrier or window tick).
+// Data of commit is already in DB, so Commit never returns fsync error - only barrier does, for commits it waits for.
+type asyncSyncer struct {
+	env    *mdbx.Env
+	sync   func() error // fsync of env, replaced in tests
+	logger log.Logger
+	maxLag uint64
+	window time.Duration
+
+	lock      sync.Mutex
+	cond      *sync.Cond
+	committed uint64 // amount of commits done
+	synced    uint64 // amount of commits which are on disk
+	failures  uint64 // amount of failed fsync attempts
+	err       error  // error of last failed fsync attempt
+	closed    bool
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newAsyncSyncer(env *mdbx.Env, maxLag uint64, window time.Duration, logger log.Logger) *asyncSyncer {
+	if maxLag == 0 {
+		maxLag = 1
+	}
+	s := &asyncSyncer{
+		env:    env,
+		logger: logger,
+		maxLag: maxLag,
+		window: window,
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if env != nil {
+		s.sync = func() error { return env.Sync(true, false) }
+	}
+	s.cond = sync.NewCond(&s.lock)
+	go s.loop()
+	return s
+}
+
+func (s *asyncSyncer) loop() {
+	defer close(s.done)
+	var tick <-chan time.Time
+	if s.window > 0 {
+		ticker := time.NewTicker(s.window)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.quit:
+			s.syncOnce()
+			return
+		case <-s.wake:
+		case <-tick:
+		}
+		s.syncOnce()
+	}
+}
+
+func (s *asyncSyncer) syncOnce() {
+	s.lock.Lock()
+	target, synced := s.committed, s.synced
+	s.lock.Unlock()
+	if target == synced {
+		return
+	}
+
+	err := s.sync()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.failures++
+		s.err = fmt.Errorf("mdbx async sync: %w", err)
+		s.logger.Error("[mdbx] async sync failed, will retry", "err", err, "not_synced", s.committed-s.synced)
+	} else if target > s.synced {
+		s.synced = target
+	}
+	s.cond.Broadcast()
+}
+
+func (s *asyncSyncer) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// onCommit - must be called after each successful RwTx commit.
+// blocks while amount of not-synced commits exceeds `maxLag`, but not longer than until next failed fsync:
+// commit is already done, fsync error is reported by barrier.
+func (s *asyncSyncer) onCommit() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.committed++
+	s.notify()
+	failures := s.failures
+	for !s.closed && s.failures == failures && s.committed-s.synced > s.maxLag {
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// barrier - waits until all commits done before this call are on disk.
+// Returns error if fsync attempt made after this call failed, next barrier retries.
+func (s *asyncSyncer) barrier() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	target := s.committed
+	s.notify()
+	failures := s.failures
+	for s.synced < target {
+		if s.closed {
+			return fmt.Errorf("mdbx async sync: db closed")
+		}
+		if s.failures != failures {
+			return s.err
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+func (s *asyncSyncer) lag() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.committed - s.synced
+}
+
+// close - does final sync and stops background goroutine. must be called before env.Close()
+func (s *asyncSyncer) close() {
+	close(s.quit)
+	<-s.done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -17,13 +17,25 @@
 package mdbx
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+	"go.uber.org/atomic"
 )
 
 func BaseCase(t *testing.T) (kv.RwDB, kv.RwTx, kv.RwCursorDupSort) {
@@ -699,3 +711,482 @@ func TestAutoConversionSeekBothRange(t *testing.T) {
 	require.NoError(t, err)
 	assert.Nil(t, v)
 }
+
+func TestAsyncSync(t *testing.T) {
+	path := t.TempDir()
+	logger := log.New()
+	table := "Table"
+	db := NewMDBX(logger).Path(path).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{
+			table: kv.TableCfgItem{},
+		}
+	}).AsyncSync(2, time.Second).MustOpen()
+	t.Cleanup(db.Close)
+	mdbxDB := db.(*MdbxKV)
+	require.True(t, mdbxDB.opts.HasFlag(mdbx.SafeNoSync))
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		err := db.Update(ctx, func(tx kv.RwTx) error {
+			return tx.Put(table, []byte{byte(i)}, []byte{byte(i)})
+		})
+		require.NoError(t, err)
+		require.LessOrEqual(t, mdbxDB.SyncLag(), uint64(2))
+	}
+	require.NoError(t, mdbxDB.SyncBarrier())
+	require.Zero(t, mdbxDB.SyncLag())
+
+	err := db.View(ctx, func(tx kv.Tx) error {
+		v, err := tx.GetOne(table, []byte{9})
+		require.NoError(t, err)
+		require.Equal(t, []byte{9}, v)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestAsyncSyncRetry(t *testing.T) {
+	var lock sync.Mutex
+	failing := true
+	s := newAsyncSyncer(nil, 1, 0, log.New())
+	s.sync = func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			return fmt.Errorf("disk is busy")
+		}
+		return nil
+	}
+	defer s.close()
+
+	// commits are not failed by fsync error, barrier reports it
+	require.NoError(t, s.onCommit())
+	require.NoError(t, s.onCommit())
+	require.ErrorContains(t, s.barrier(), "disk is busy")
+	require.NoError(t, s.onCommit())
+
+	// error is not sticky: next barrier retries
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	require.NoError(t, s.barrier())
+	require.Zero(t, s.lag())
+	require.NoError(t, s.onCommit())
+	require.NoError(t, s.barrier())
+}
+
+func TestGroupCommit(t *testing.T) {
+	table := "Table"
+	db := NewMDBX(log.New()).Path(t.TempDir()).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{table: kv.TableCfgItem{}}
+	}).SyncMode(SyncSafeNoSync).GroupCommit(time.Hour, 0).MustOpen()
+	t.Cleanup(db.Close)
+	mdbxDB := db.(*MdbxKV)
+	ctx := context.Background()
+
+	count := func() (n int) {
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			c, err := tx.Cursor(table)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			cnt, err := c.Count()
+			n = int(cnt)
+			return err
+		}))
+		return n
+	}
+
+	var wg sync.WaitGroup
+	var executed atomic.Int32
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, mdbxDB.UpdateAsync(ctx, func(tx kv.RwTx) error {
+				executed.Inc()
+				return tx.Put(table, []byte{byte(i)}, []byte{byte(i)})
+			}))
+		}()
+	}
+	wg.Wait()
+	require.Zero(t, count()) // group is not committed yet
+
+	err := mdbxDB.UpdateAsync(ctx, func(tx kv.RwTx) error {
+		if err := tx.Put(table, []byte{100}, []byte{100}); err != nil {
+			return err
+		}
+		if err := tx.Delete(table, []byte{1}); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed call")
+	})
+	require.Error(t, err)
+	require.NoError(t, mdbxDB.UpdateAsync(ctx, func(tx kv.RwTx) error {
+		return tx.Put(table, []byte{101}, []byte{101})
+	}))
+	require.NoError(t, mdbxDB.Flush(ctx))
+	require.Equal(t, 11, count())                // changes of failed call are dropped, other calls stay
+	require.Equal(t, int32(10), executed.Load()) // calls are not re-executed
+
+	db2 := NewMDBX(log.New()).InMem(t.TempDir()).GroupCommit(time.Hour, 3).MustOpen()
+	t.Cleanup(db2.Close)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db2.(*MdbxKV).UpdateAsync(ctx, func(tx kv.RwTx) error {
+			return tx.Put(kv.Sequence, []byte{byte(i)}, []byte{1})
+		}))
+	}
+	require.NoError(t, db2.View(ctx, func(tx kv.Tx) error { // committed by maxCalls
+		c, err := tx.Cursor(kv.Sequence)
+		require.NoError(t, err)
+		defer c.Close()
+		cnt, err := c.Count()
+		require.Equal(t, uint64(3), cnt)
+		return err
+	}))
+}
+
+func TestMultiProcessOpen(t *testing.T) {
+	if path := os.Getenv("MDBX_TEST_WRITER_PATH"); path != "" { // other process: holds RwTx until stdin is closed
+		db := NewMDBX(log.New()).Path(path).MustOpen()
+		tx, err := db.BeginRw(context.Background())
+		require.NoError(t, err)
+		fmt.Println("ready")
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		tx.Rollback()
+		db.Close()
+		return
+	}
+
+	path := t.TempDir()
+	NewMDBX(log.New()).Path(path).MustOpen().Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMultiProcessOpen$")
+	cmd.Env = append(os.Environ(), "MDBX_TEST_WRITER_PATH="+path)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill() //nolint:errcheck
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", line)
+
+	ctx := context.Background()
+	db, err := NewMDBX(log.New()).Path(path).Accede().Open()
+	require.NoError(t, err)
+	_, err = db.(*MdbxKV).TryBeginRw(ctx)
+	require.ErrorIs(t, err, ErrWriterPresent)
+	cleared, err := db.(*MdbxKV).ClearStaleReaders()
+	require.NoError(t, err)
+	require.Zero(t, cleared)
+	db.Close()
+
+	_, err = NewMDBX(log.New()).Path(path).Exclusive().Open()
+	require.ErrorIs(t, err, ErrEnvBusy)
+	_, err = NewMDBX(log.New()).Path(path).ExclusiveTakeover(300 * time.Millisecond).Open()
+	require.ErrorIs(t, err, ErrEnvBusy)
+
+	require.NoError(t, stdin.Close())
+	db, err = NewMDBX(log.New()).Path(path).ExclusiveTakeover(time.Minute).Open()
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, cmd.Wait())
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := db.(*MdbxKV).TryBeginRw(ctx)
+		require.ErrorIs(t, err, ErrWriterPresent)
+	}()
+	<-done
+	tx.Rollback()
+	tx, err = db.(*MdbxKV).TryBeginRw(ctx)
+	require.NoError(t, err)
+	tx.Rollback()
+}
+
+func TestRwTxWatchdog(t *testing.T) {
+	db := NewMDBX(log.New()).InMem(t.TempDir()).RwTxWatchdog(20 * time.Millisecond).MustOpen()
+	t.Cleanup(db.Close)
+	mdbxDB := db.(*MdbxKV)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	_, ok := mdbxDB.LongRwTx()
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		_, ok := mdbxDB.LongRwTx()
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+	r, _ := mdbxDB.LongRwTx()
+	require.GreaterOrEqual(t, r.Held, 20*time.Millisecond)
+	require.Contains(t, r.BeginStack, "TestRwTxWatchdog")
+	require.Contains(t, r.Stack, "TestRwTxWatchdog")
+
+	tx.Rollback()
+	_, ok = mdbxDB.LongRwTx()
+	require.False(t, ok)
+}
+
+func TestBeginRwQueue(t *testing.T) {
+	db := NewMDBX(log.New()).InMem(t.TempDir()).MustOpen()
+	t.Cleanup(db.Close)
+	mdbxDB := db.(*MdbxKV)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = db.BeginRw(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, mdbxDB.WritersWaiting())
+
+	var lock sync.Mutex
+	var order []int
+	positions := map[int][]int{}
+	done := make(chan struct{}, 2)
+	for i := 1; i <= 2; i++ {
+		i := i
+		ctx := WithWriterQueueReport(context.Background(), func(position int) {
+			lock.Lock()
+			defer lock.Unlock()
+			positions[i] = append(positions[i], position)
+		})
+		go func() {
+			tx, err := db.BeginRw(ctx)
+			require.NoError(t, err)
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			tx.Rollback()
+			done <- struct{}{}
+		}()
+		require.Eventually(t, func() bool { return mdbxDB.WritersWaiting() == i }, 5*time.Second, time.Millisecond)
+	}
+	tx.Rollback()
+	<-done
+	<-done
+	require.Equal(t, []int{1, 2}, order)
+	require.Equal(t, []int{1}, positions[1])
+	require.Equal(t, []int{2, 1}, positions[2])
+	require.Zero(t, mdbxDB.WritersWaiting())
+}
+
+func TestPreset(t *testing.T) {
+	opts := NewMDBX(log.New()).Preset(TxPoolPreset())
+	require.True(t, opts.HasFlag(mdbx.SafeNoSync))
+	require.Equal(t, time.Second, opts.syncPeriod)
+	require.Equal(t, uint64(4096), opts.GetPageSize())
+
+	opts = NewMDBX(log.New()).Preset(ArchivePreset()).PageSize(8192)
+	require.Equal(t, uint64(8192), opts.GetPageSize()) // options after preset override it
+	require.Equal(t, uint64(2), opts.asyncSyncLag)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	logger := log.New()
+	opts := NewMDBX(logger).Path(t.TempDir())
+	require.NoError(t, opts.Validate())
+	require.Error(t, NewMDBX(logger).Validate()) // no path
+	require.Error(t, opts.PageSize(3000).Validate())
+	require.Error(t, opts.PageSize(128*1024).Validate())
+	require.Error(t, opts.MaxSize(datasize.GB).GrowthStep(2*datasize.GB).Validate())
+	require.Error(t, opts.WriteMergeThreshold(100).Validate())
+	require.Error(t, opts.DirtySpace(100).Validate())
+	require.NoError(t, opts.DirtySpace(100).DirtyPagesLimit(1024).Validate())
+	require.Error(t, opts.SyncMode(SyncUtterlyNoSync).AsyncSync(2, 0).Validate())
+	require.Error(t, opts.WriteMap().GroupCommit(time.Second, 0).Validate())
+
+	opts = opts.SyncMode(SyncUtterlyNoSync)
+	require.Equal(t, SyncUtterlyNoSync, opts.GetSyncMode())
+	opts = opts.SyncMode(SyncSafeNoSync)
+	require.Equal(t, SyncSafeNoSync, opts.GetSyncMode())
+	require.False(t, opts.HasFlag(mdbx.UtterlyNoSync&^mdbx.SafeNoSync))
+	require.Equal(t, SyncDurable, opts.SyncMode(SyncDurable).GetSyncMode())
+
+	_, err := opts.PageSize(1000).Open()
+	require.Error(t, err)
+
+	db := opts.PageSize(8192).MaxSize(4 * datasize.GB).GrowthStep(64 * datasize.MB).DirtyPagesLimit(1024).ReadAhead(true).MustOpen()
+	defer db.Close()
+	require.Equal(t, uint64(8192), db.PageSize())
+	require.Equal(t, 1024*uint64(8192), db.(*MdbxKV).txSize)
+}
+
+func TestMigratePageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	logger := log.New()
+	tableCfg := func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{
+			"Plain": kv.TableCfgItem{},
+			"Dup":   kv.TableCfgItem{Flags: kv.DupSort},
+		}
+	}
+	ctx := context.Background()
+	db := NewMDBX(logger).Path(path).PageSize(4096).WithTableCfg(tableCfg).MustOpen()
+	err := db.Update(ctx, func(tx kv.RwTx) error {
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key%04d", i))
+			if err := tx.Put("Plain", k, bytes.Repeat([]byte{byte(i)}, i)); err != nil {
+				return err
+			}
+			for j := 0; j < 3; j++ {
+				if err := tx.Put("Dup", k, []byte(fmt.Sprintf("value%d", j))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	backup, err := MigratePageSize(ctx, logger, path, 8192, tableCfg)
+	require.NoError(t, err)
+	require.Equal(t, path+".bak", backup)
+
+	db = NewMDBX(logger).Path(path).WithTableCfg(tableCfg).MustOpen()
+	require.Equal(t, uint64(8192), db.PageSize())
+	err = db.View(ctx, func(tx kv.Tx) error {
+		v, err := tx.GetOne("Plain", []byte("key0999"))
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{231}, 999), v)
+		c, err := tx.CursorDupSort("Dup")
+		require.NoError(t, err)
+		defer c.Close()
+		_, _, err = c.SeekExact([]byte("key0500"))
+		require.NoError(t, err)
+		n, err := c.CountDuplicates()
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), n)
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	// already migrated
+	backup, err = MigratePageSize(ctx, logger, path, 8192, tableCfg)
+	require.NoError(t, err)
+	require.Equal(t, "", backup)
+}
+
+func TestSwapBuckets(t *testing.T) {
+	logger := log.New()
+	db := NewMDBX(logger).InMem(t.TempDir()).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{
+			"Live":   kv.TableCfgItem{Flags: kv.DupSort},
+			"Shadow": kv.TableCfgItem{Flags: kv.DupSort},
+			"Plain":  kv.TableCfgItem{},
+		}
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	ctx := context.Background()
+	dump := func(tx kv.Tx, table string) (res []string) {
+		t.Helper()
+		require.NoError(t, tx.ForEach(table, nil, func(k, v []byte) error {
+			res = append(res, string(k)+"="+string(v))
+			return nil
+		}))
+		return res
+	}
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		require.NoError(t, tx.Put("Live", []byte("a"), []byte("1")))
+		require.NoError(t, tx.Put("Live", []byte("a"), []byte("2")))
+		return tx.Put("Live", []byte("b"), []byte("1"))
+	}))
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	for i := 0; i < 1000; i++ { // shadow is built in same tx: its pages are dirty
+		require.NoError(t, tx.Put("Shadow", []byte(fmt.Sprintf("k%04d", i/2)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, tx.SwapBuckets("Live", "Shadow"))
+	require.Len(t, dump(tx, "Live"), 1000)
+	require.Equal(t, []string{"a=1", "a=2", "b=1"}, dump(tx, "Shadow"))
+	require.Equal(t, []string{"a=1", "a=2", "b=1"}, dump(roTx, "Live")) // readers see old content until commit
+	require.Empty(t, dump(roTx, "Shadow"))
+
+	require.NoError(t, tx.RenameBucket("Live", "Shadow"))
+	require.Empty(t, dump(tx, "Live"))
+	shadow := dump(tx, "Shadow")
+	require.Len(t, shadow, 1000)
+	require.Equal(t, "k0000=v0", shadow[0])
+	require.Equal(t, "k0499=v999", shadow[999])
+
+	require.Error(t, tx.SwapBuckets("Live", "Plain"))
+	require.Error(t, tx.RenameBucket("Live", "NotExists"))
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		require.Empty(t, dump(tx, "Live"))
+		require.Len(t, dump(tx, "Shadow"), 1000)
+		buckets, err := tx.(*MdbxTx).ListBuckets()
+		require.NoError(t, err)
+		require.NotContains(t, buckets, "_swap_Live")
+		return nil
+	}))
+}
+
+func TestTableAccessHints(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New()
+	open := func(cfg kv.TableCfg) kv.RwDB {
+		db := NewMDBX(logger).Path(t.TempDir()).WithTableCfg(func(kv.TableCfg) kv.TableCfg { return cfg }).MustOpen()
+		t.Cleanup(db.Close)
+		return db
+	}
+	noReadahead := func(db kv.RwDB) bool {
+		flags, err := db.(*MdbxKV).Env().Flags()
+		require.NoError(t, err)
+		return flags&mdbx.NoReadahead != 0
+	}
+	require.False(t, noReadahead(open(kv.TableCfg{"Scans": {Access: kv.AccessScans}})))
+
+	db := open(kv.TableCfg{"Scans": {Access: kv.AccessScans}, "Points": {}})
+	require.True(t, noReadahead(db))
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		c, err := tx.RwCursor("Scans")
+		require.NoError(t, err)
+		defer c.Close()
+		require.Nil(t, c.(*MdbxCursor).scan) // RwTx may return dirty pages
+		for i := 0; i < 1_000; i++ {
+			if err := c.Append([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte{byte(i)}, 512)); err != nil {
+				return err
+			}
+		}
+		return tx.Put("Points", []byte("k"), []byte("v"))
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		c, err := tx.Cursor("Points")
+		require.NoError(t, err)
+		defer c.Close()
+		require.Nil(t, c.(*MdbxCursor).scan)
+
+		c, err = tx.Cursor("Scans")
+		require.NoError(t, err)
+		scan := c.(*MdbxCursor).scan
+		require.NotNil(t, scan)
+		n := 0
+		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+			require.NoError(t, err)
+			require.Equal(t, bytes.Repeat([]byte{byte(n)}, 512), v)
+			n++
+		}
+		require.Equal(t, 1_000, n)
+		require.NotEmpty(t, scan.pages)
+		c.Close()
+		require.Empty(t, scan.pages)
+		return nil
+	}))
+}
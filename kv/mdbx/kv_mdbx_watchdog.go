@@ -0,0 +1,190 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+var longRwTxCounter = metrics.GetOrCreateCounter(`db_long_rw_tx`) //nolint
+
+// RwTxReport - RwTx which is held longer than threshold of watchdog, see MdbxOpts.RwTxWatchdog
+type RwTxReport struct {
+	Label      kv.Label
+	Started    time.Time
+	Held       time.Duration // at detection time
+	Goroutine  uint64        // holder of RwTx
+	BeginStack string        // where RwTx was opened
+	Stack      string        // what holder is doing: its stack at detection time
+}
+
+func (r RwTxReport) String() string {
+	return fmt.Sprintf("RwTx of %s db held %s by goroutine %d\nopened at:\n%s\nnow at:\n%s", r.Label, r.Held, r.Goroutine, r.BeginStack, r.Stack)
+}
+
+// rwTxWatchdog - detects RwTx held longer than `threshold`: stuck writer (aggregator Flush, migration, ...)
+// silently blocks all other writers. Holder is reported once per RwTx: to log and by MdbxKV.LongRwTx.
+type rwTxWatchdog struct {
+	label     kv.Label
+	threshold time.Duration
+	logger    log.Logger
+
+	lock       sync.Mutex
+	active     bool
+	started    time.Time
+	goroutine  uint64
+	beginStack []byte
+	report     *RwTxReport // of active RwTx, nil - not detected yet
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newRwTxWatchdog(label kv.Label, threshold time.Duration, logger log.Logger) *rwTxWatchdog {
+	w := &rwTxWatchdog{
+		label:     label,
+		threshold: threshold,
+		logger:    logger,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// begin - called by holder goroutine
+func (w *rwTxWatchdog) begin() {
+	stack := stackOf(false)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.active, w.started, w.report = true, time.Now(), nil
+	w.goroutine, w.beginStack = goroutineID(stack), stack
+}
+
+func (w *rwTxWatchdog) end() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.report != nil {
+		w.logger.Info("[db] long RwTx finished", "label", w.label, "held", time.Since(w.started), "goroutine", w.goroutine)
+	}
+	w.active, w.report, w.beginStack = false, nil, nil
+}
+
+func (w *rwTxWatchdog) loop() {
+	defer close(w.done)
+	interval := w.threshold / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *rwTxWatchdog) check() {
+	w.lock.Lock()
+	if !w.active || w.report != nil || time.Since(w.started) < w.threshold {
+		w.lock.Unlock()
+		return
+	}
+	goroutine := w.goroutine
+	w.lock.Unlock()
+
+	stack := goroutineStack(goroutine) // all goroutines are stopped while dumping: outside of lock
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.active || w.goroutine != goroutine || w.report != nil { // finished while dumping
+		return
+	}
+	w.report = &RwTxReport{Label: w.label, Started: w.started, Held: time.Since(w.started), Goroutine: goroutine, BeginStack: string(w.beginStack), Stack: stack}
+	longRwTxCounter.Inc()
+	w.logger.Warn("[db] long RwTx blocks other writers", "label", w.label, "held", w.report.Held, "goroutine", goroutine, "stack", w.report.String())
+}
+
+func (w *rwTxWatchdog) longRwTx() (RwTxReport, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.report == nil {
+		return RwTxReport{}, false
+	}
+	r := *w.report
+	r.Held = time.Since(w.started)
+	return r, true
+}
+
+func (w *rwTxWatchdog) close() {
+	close(w.quit)
+	<-w.done
+}
+
+// LongRwTx - RwTx held longer than threshold of watchdog, false if there is no such RwTx or watchdog is disabled.
+// See MdbxOpts.RwTxWatchdog
+func (db *MdbxKV) LongRwTx() (RwTxReport, bool) {
+	if db.watchdog == nil {
+		return RwTxReport{}, false
+	}
+	return db.watchdog.longRwTx()
+}
+
+func stackOf(all bool) []byte {
+	buf := make([]byte, 16*1024)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineID - from header of stack: "goroutine 18 [running]:"
+func goroutineID(stack []byte) uint64 {
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		id, _ := strconv.ParseUint(string(stack[:i]), 10, 64)
+		return id
+	}
+	return 0
+}
+
+// goroutineStack - current stack of goroutine `id`, "" if it doesn't exist anymore
+func goroutineStack(id uint64) string {
+	for _, s := range bytes.Split(stackOf(true), []byte("\n\n")) {
+		if goroutineID(s) == id {
+			return string(s)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// writerQueue - single writer slot of MdbxKV. Writers wait for it in FIFO order before mdbx's own write lock
+// (which can't be interrupted): BeginRw respects deadline and cancellation of ctx, latency-sensitive writers
+// (txpool commits) fail instead of stalling behind long aggregation flush. Queue orders only writers of this process.
+type writerQueue struct {
+	lock    sync.Mutex
+	busy    bool
+	waiters *list.List // of *writerWaiter, in order of arrival
+
+	waitSeconds *metrics.Histogram
+	timeouts    *metrics.Counter
+	queueLen    *metrics.Gauge
+}
+
+type writerWaiter struct {
+	ready  chan struct{} // closed when slot is handed to waiter
+	report func(position int)
+}
+
+func newWriterQueue(label kv.Label) *writerQueue {
+	q := &writerQueue{
+		waiters:     list.New(),
+		waitSeconds: metrics.GetOrCreateHistogram(fmt.Sprintf(`db_writer_wait_seconds{label="%s"}`, label)),
+		timeouts:    metrics.GetOrCreateCounter(fmt.Sprintf(`db_writer_timeout_total{label="%s"}`, label)),
+		queueLen:    metrics.GetOrCreateGauge(fmt.Sprintf(`db_writer_queue{label="%s"}`, label), nil),
+	}
+	return q
+}
+
+type writerQueueReportKey struct{}
+
+// WithWriterQueueReport - BeginRw(ctx) which has to wait for writer slot calls `report` with position of caller in
+// queue of writers: when it's enqueued and every time position changes. 1 - caller gets slot next.
+func WithWriterQueueReport(ctx context.Context, report func(position int)) context.Context {
+	return context.WithValue(ctx, writerQueueReportKey{}, report)
+}
+
+// acquire - waits for writer slot. Error is ctx.Err() if ctx is done before slot is acquired.
+func (q *writerQueue) acquire(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { q.waitSeconds.UpdateDuration(start) }()
+
+	q.lock.Lock()
+	if !q.busy {
+		q.busy = true
+		q.lock.Unlock()
+		return nil
+	}
+	w := &writerWaiter{ready: make(chan struct{})}
+	w.report, _ = ctx.Value(writerQueueReportKey{}).(func(int))
+	elem := q.waiters.PushBack(w)
+	q.queueLen.Set(float64(q.waiters.Len()))
+	q.notify(q.waiters.Len()-1, nil)
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	q.lock.Lock()
+	select {
+	case <-w.ready: // slot was handed over concurrently with cancellation: pass it on
+		q.releaseLocked()
+		return q.notify(0, ctx.Err())
+	default:
+	}
+	removed := 0
+	for e := q.waiters.Front(); e != elem; e = e.Next() {
+		removed++
+	}
+	q.waiters.Remove(elem)
+	q.queueLen.Set(float64(q.waiters.Len()))
+	q.timeouts.Inc()
+	return q.notify(removed, ctx.Err())
+}
+
+// tryAcquire - takes slot only if it's free: there are no waiters while slot is free
+func (q *writerQueue) tryAcquire() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.busy {
+		return false
+	}
+	q.busy = true
+	return true
+}
+
+func (q *writerQueue) release() {
+	q.lock.Lock()
+	q.releaseLocked()
+	_ = q.notify(0, nil)
+}
+
+// releaseLocked - hands slot to first waiter, busy stays true
+func (q *writerQueue) releaseLocked() {
+	front := q.waiters.Front()
+	if front == nil {
+		q.busy = false
+		return
+	}
+	q.waiters.Remove(front)
+	q.queueLen.Set(float64(q.waiters.Len()))
+	close(front.Value.(*writerWaiter).ready)
+}
+
+// notify - unlocks queue and reports positions to waiters starting from `from`-th: their position changed
+func (q *writerQueue) notify(from int, err error) error {
+	type report struct {
+		f        func(int)
+		position int
+	}
+	var reports []report
+	i := 0
+	for e := q.waiters.Front(); e != nil; e = e.Next() {
+		if f := e.Value.(*writerWaiter).report; i >= from && f != nil {
+			reports = append(reports, report{f, i + 1})
+		}
+		i++
+	}
+	q.lock.Unlock()
+	for _, r := range reports {
+		r.f(r.position)
+	}
+	return err
+}
+
+func (q *writerQueue) waiting() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.waiters.Len()
+}
+
+// WritersWaiting - amount of BeginRw waiting for writer slot
+func (db *MdbxKV) WritersWaiting() int { return db.writers.waiting() }
@@ -0,0 +1,216 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const migrateBatchSize = 256 * datasize.MB // commit of target db after copy of this amount of data
+
+// MigratePageSize - guided dump/restore of db to new page size (mdbx can't change page size of existing db):
+//  1. copies all tables of db at `path` into new db `path.migrating` with pageSize,
+//  2. checks that amount of entries of each table is same,
+//  3. renames db to `path.bak` and new db to `path`.
+//
+// Db must not be opened by anyone. Tables which are not in tableCfg are copied with their flags.
+// Returns path of backup - remove it after checking new db. Returns "" if db already has pageSize.
+// Interrupted migration can be started again: old db is not changed until last step.
+func MigratePageSize(ctx context.Context, logger log.Logger, path string, pageSize uint64, tableCfg TableCfgFunc) (backup string, err error) {
+	backup, tmp := path+".bak", path+".migrating"
+	src, err := NewMDBX(logger).Path(path).WithTableCfg(tableCfg).Exclusive().Open()
+	if err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+	defer func() {
+		if src != nil {
+			src.Close()
+		}
+	}()
+	if src.PageSize() == pageSize {
+		return "", nil
+	}
+	if dir.Exist(backup) {
+		return "", fmt.Errorf("migrate page size: backup %s already exists", backup)
+	}
+	names, err := listTables(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+	cfg := kv.TableCfg{}
+	for _, name := range names {
+		item := src.AllBuckets()[name]
+		item.IsDeprecated = false
+		cfg[name] = item
+	}
+
+	if err = os.RemoveAll(tmp); err != nil { // left from interrupted migration
+		return "", err
+	}
+	dst, err := NewMDBX(logger).Path(tmp).PageSize(pageSize).WithTableCfg(func(kv.TableCfg) kv.TableCfg { return cfg }).Exclusive().Open()
+	if err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+	defer func() {
+		if dst != nil {
+			dst.Close()
+		}
+	}()
+	logger.Info("[mdbx] migrate page size", "path", path, "from", datasize.ByteSize(src.PageSize()).HR(), "to", datasize.ByteSize(pageSize).HR(), "tables", len(names))
+	if err = CopyTables(ctx, logger, src, dst, names); err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+	if err = compareCounts(ctx, src, dst, names); err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+
+	src.Close()
+	dst.Close()
+	src, dst = nil, nil
+	if err = os.Rename(path, backup); err != nil {
+		return "", fmt.Errorf("migrate page size: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("migrate page size: %w, old db is in %s", err, backup)
+	}
+	logger.Info("[mdbx] migrate page size done", "path", path, "backup", backup)
+	return backup, nil
+}
+
+// listTables - existing tables of db, sorted
+func listTables(ctx context.Context, db kv.RwDB) (names []string, err error) {
+	err = db.View(ctx, func(tx kv.Tx) error {
+		names, err = tx.(kv.BucketMigrator).ListBuckets()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, ok := db.AllBuckets()[name]; ok && db.AllBuckets()[name].DBI != NonExistingDBI {
+				continue
+			}
+			if err = tx.(kv.BucketMigrator).CreateBucket(name); err != nil { // not in config: opens it and reads its flags
+				return err
+			}
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// CopyTables - copies content of tables from src to dst (tables in dst must be empty, with same flags)
+func CopyTables(ctx context.Context, logger log.Logger, src kv.RoDB, dst kv.RwDB, tables []string) error {
+	srcTx, err := src.BeginRo(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcTx.Rollback()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	for _, name := range tables {
+		if err := copyTable(ctx, logger, srcTx, dst, name, logEvery); err != nil {
+			return fmt.Errorf("copy %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func copyTable(ctx context.Context, logger log.Logger, srcTx kv.Tx, dst kv.RwDB, name string, logEvery *time.Ticker) error {
+	c, err := srcTx.Cursor(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	cfg := dst.AllBuckets()[name]
+	isDupSort := cfg.Flags&kv.DupSort != 0 && !cfg.AutoDupSortKeysConversion
+	k, v, err := c.First()
+	for k != nil && err == nil {
+		var tx kv.RwTx
+		if tx, err = dst.BeginRw(ctx); err != nil {
+			return err
+		}
+		var size uint64
+		for ; k != nil && err == nil && size < uint64(migrateBatchSize); k, v, err = c.Next() {
+			switch {
+			case cfg.AutoDupSortKeysConversion:
+				err = tx.Put(name, k, v)
+			case isDupSort:
+				err = tx.AppendDup(name, k, v)
+			default:
+				err = tx.Append(name, k, v)
+			}
+			if err != nil {
+				break
+			}
+			size += uint64(len(k) + len(v))
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			select {
+			case <-logEvery.C:
+				logger.Info("[mdbx] copy", "table", name, "key", fmt.Sprintf("%x", k))
+			default:
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func compareCounts(ctx context.Context, src, dst kv.RoDB, tables []string) error {
+	count := func(db kv.RoDB, name string) (n uint64, err error) {
+		err = db.View(ctx, func(tx kv.Tx) error {
+			c, err := tx.Cursor(name)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			n, err = c.Count()
+			return err
+		})
+		return n, err
+	}
+	for _, name := range tables {
+		srcCount, err := count(src, name)
+		if err != nil {
+			return err
+		}
+		dstCount, err := count(dst, name)
+		if err != nil {
+			return err
+		}
+		if srcCount != dstCount {
+			return fmt.Errorf("table %s: %d entries copied of %d", name, dstCount, srcCount)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/pbnjay/memory"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// Preset - options tuned for workload. Zero fields keep defaults of NewMDBX.
+// Usage: `NewMDBX(logger).Preset(mdbx.RPCPreset()).Path(path)` - options set after Preset override it.
+type Preset struct {
+	Name           string
+	PageSize       uint64 // applied only when db is created, see MigratePageSize
+	DirtySpace     uint64 // modified pages above this size spill to disk
+	GrowthStep     datasize.ByteSize
+	MergeThreshold uint64 // 16dot16 percent: from 8192 (12.5%) to 32768 (50%)
+
+	SafeNoSync      bool          // commit doesn't fsync: db is consistent after crash, but last commits may be lost
+	SyncPeriod      time.Duration // with SafeNoSync: background fsync period
+	AsyncSyncLag    uint64        // see MdbxOpts.AsyncSync
+	AsyncSyncWindow time.Duration
+}
+
+// ArchivePreset - history of archive node: big write transactions of sequential appends.
+// Bigger pages - lower tree and less pages per appended value, big dirty space - less spills,
+// fsync is off the commit path.
+func ArchivePreset() Preset {
+	return Preset{
+		Name:            "archive",
+		PageSize:        uint64(16 * datasize.KB),
+		DirtySpace:      memory.TotalMemory() / 8,
+		GrowthStep:      4 * datasize.GB,
+		MergeThreshold:  3 * 8192,
+		AsyncSyncLag:    2,
+		AsyncSyncWindow: time.Minute,
+	}
+}
+
+// RPCPreset - read-heavy: random point reads. Small pages - less bytes read per lookup,
+// pages are merged aggressively to keep tree compact, writes are rare and durable.
+func RPCPreset() Preset {
+	return Preset{
+		Name:           "rpc",
+		PageSize:       uint64(4 * datasize.KB),
+		DirtySpace:     uint64(64 * datasize.MB),
+		GrowthStep:     2 * datasize.GB,
+		MergeThreshold: 32768,
+	}
+}
+
+// TxPoolPreset - small db with frequent small commits. Data can be re-fetched from peers,
+// so fsync of every commit is replaced by periodic one.
+func TxPoolPreset() Preset {
+	return Preset{
+		Name:           "txpool",
+		PageSize:       uint64(4 * datasize.KB),
+		DirtySpace:     uint64(32 * datasize.MB),
+		GrowthStep:     16 * datasize.MB,
+		MergeThreshold: 3 * 8192,
+		SafeNoSync:     true,
+		SyncPeriod:     time.Second,
+	}
+}
+
+func (opts MdbxOpts) Preset(p Preset) MdbxOpts {
+	if p.PageSize > 0 {
+		opts.pageSize = p.PageSize
+	}
+	if p.DirtySpace > 0 {
+		opts.dirtySpace = p.DirtySpace
+	}
+	if p.GrowthStep > 0 {
+		opts.growthStep = p.GrowthStep
+	}
+	if p.MergeThreshold > 0 {
+		opts.mergeThreshold = p.MergeThreshold
+	}
+	if p.SafeNoSync {
+		opts.flags |= mdbx.SafeNoSync
+	}
+	if p.SyncPeriod > 0 {
+		opts.syncPeriod = p.SyncPeriod
+	}
+	if p.AsyncSyncLag > 0 {
+		opts = opts.AsyncSync(p.AsyncSyncLag, p.AsyncSyncWindow)
+	}
+	return opts
+}
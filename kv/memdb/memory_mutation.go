@@ -16,7 +16,9 @@ package memdb
 import (
 	"bytes"
 	"context"
+	"fmt"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/kv/iter"
 	"github.com/ledgerwatch/log/v3"
 
@@ -28,6 +30,7 @@ type MemoryMutation struct {
 	memTx            kv.RwTx
 	memDb            kv.RwDB
 	deletedEntries   map[string]map[string]struct{}
+	deletedDups      map[string]map[dupEntry]struct{} // DeleteExact of DupSort tables
 	clearedTables    map[string]struct{}
 	db               kv.Tx
 	statelessCursors map[string]kv.RwCursor
@@ -56,10 +59,17 @@ func NewMemoryBatch(tx kv.Tx, tmpDir string) *MemoryMutation {
 		memDb:          tmpDB,
 		memTx:          memTx,
 		deletedEntries: make(map[string]map[string]struct{}),
+		deletedDups:    make(map[string]map[dupEntry]struct{}),
 		clearedTables:  make(map[string]struct{}),
 	}
 }
 
+var _ kv.RwTx = &MemoryMutation{}
+
+type dupEntry struct {
+	key, value string
+}
+
 func (m *MemoryMutation) UpdateTxn(tx kv.Tx) {
 	m.db = tx
 	m.statelessCursors = nil
@@ -79,8 +89,43 @@ func (m *MemoryMutation) isEntryDeleted(table string, key []byte) bool {
 	return ok
 }
 
+func (m *MemoryMutation) isDupDeleted(table string, key, value []byte) bool {
+	_, ok := m.deletedDups[table][dupEntry{string(key), string(value)}]
+	return ok
+}
+
+// deleteDup - removes `value` of `key` in DupSort table, other values of key stay
+func (m *MemoryMutation) deleteDup(table string, key, value []byte) error {
+	if _, ok := m.deletedDups[table]; !ok {
+		m.deletedDups[table] = make(map[dupEntry]struct{})
+	}
+	m.deletedDups[table][dupEntry{string(key), string(value)}] = struct{}{}
+	c, err := m.memTx.RwCursorDupSort(table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.DeleteExact(key, value)
+}
+
+// undeleteDup - value is put back after DeleteExact
+func (m *MemoryMutation) undeleteDup(table string, key, value []byte) {
+	if dups, ok := m.deletedDups[table]; ok {
+		delete(dups, dupEntry{string(key), string(value)})
+	}
+}
+
+// DBSize - size of underlying db plus size of overlay
 func (m *MemoryMutation) DBSize() (uint64, error) {
-	panic("not implemented")
+	dbSize, err := m.db.DBSize()
+	if err != nil {
+		return 0, err
+	}
+	memSize, err := m.memTx.DBSize()
+	if err != nil {
+		return 0, err
+	}
+	return dbSize + memSize, nil
 }
 
 func initSequences(db kv.Tx, memTx kv.RwTx) error {
@@ -156,7 +201,12 @@ func (m *MemoryMutation) GetOne(table string, key []byte) ([]byte, error) {
 }
 
 func (m *MemoryMutation) Last(table string) ([]byte, []byte, error) {
-	panic("not implemented. (MemoryMutation.Last)")
+	c, err := m.Cursor(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+	return c.Last()
 }
 
 // Has return whether a key is present in a certain table.
@@ -173,6 +223,7 @@ func (m *MemoryMutation) Has(table string, key []byte) (bool, error) {
 }
 
 func (m *MemoryMutation) Put(table string, k, v []byte) error {
+	m.undeleteDup(table, k, v)
 	return m.memTx.Put(table, k, v)
 }
 
@@ -214,22 +265,22 @@ func (m *MemoryMutation) Prefix(table string, prefix []byte) (iter.KV, error) {
 	return m.Stream(table, prefix, nextPrefix)
 }
 func (m *MemoryMutation) Stream(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
-	panic("please implement me")
+	return m.Range(table, fromPrefix, toPrefix)
 }
 func (m *MemoryMutation) StreamAscend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
-	panic("please implement me")
+	return m.RangeAscend(table, fromPrefix, toPrefix, limit)
 }
 func (m *MemoryMutation) StreamDescend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
-	panic("please implement me")
+	return m.RangeDescend(table, fromPrefix, toPrefix, limit)
 }
 func (m *MemoryMutation) Range(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
-	panic("please implement me")
+	return m.RangeAscend(table, fromPrefix, toPrefix, -1)
 }
 func (m *MemoryMutation) RangeAscend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
-	panic("please implement me")
+	return m.rangeOrderLimit(table, fromPrefix, toPrefix, true, limit)
 }
 func (m *MemoryMutation) RangeDescend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
-	panic("please implement me")
+	return m.rangeOrderLimit(table, fromPrefix, toPrefix, false, limit)
 }
 
 func (m *MemoryMutation) ForPrefix(bucket string, prefix []byte, walker func(k, v []byte) error) error {
@@ -280,16 +331,78 @@ func (m *MemoryMutation) BucketSize(bucket string) (uint64, error) {
 	return m.memTx.BucketSize(bucket)
 }
 
+// DropBucket - table is cleared: overlay can't drop tables of underlying db
 func (m *MemoryMutation) DropBucket(bucket string) error {
-	panic("Not implemented")
+	return m.ClearBucket(bucket)
 }
 
 func (m *MemoryMutation) ExistsBucket(bucket string) (bool, error) {
-	panic("Not implemented")
+	if migrator, ok := m.db.(kv.BucketMigrator); ok {
+		if exists, err := migrator.ExistsBucket(bucket); err != nil || exists {
+			return exists, err
+		}
+	}
+	return m.memTx.ExistsBucket(bucket)
 }
 
 func (m *MemoryMutation) ListBuckets() ([]string, error) {
-	panic("Not implemented")
+	if migrator, ok := m.db.(kv.BucketMigrator); ok {
+		return migrator.ListBuckets()
+	}
+	return m.memTx.ListBuckets()
+}
+
+// RenameBucket - overlay can't rename tables of underlying db: content of `from` is copied into cleared `to`,
+// then `from` is cleared
+func (m *MemoryMutation) RenameBucket(from, to string) error {
+	if err := m.copyBucket(from, to); err != nil {
+		return fmt.Errorf("rename bucket: %s, %s: %w", from, to, err)
+	}
+	return m.ClearBucket(from)
+}
+
+// SwapBuckets - as RenameBucket, content is copied: content of `a` is held in memory meanwhile
+func (m *MemoryMutation) SwapBuckets(a, b string) error {
+	var pairs [][2][]byte
+	if err := m.ForEach(a, nil, func(k, v []byte) error {
+		pairs = append(pairs, [2][]byte{common.Copy(k), common.Copy(v)})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("swap buckets: %s, %s: %w", a, b, err)
+	}
+	if err := m.copyBucket(b, a); err != nil {
+		return fmt.Errorf("swap buckets: %s, %s: %w", a, b, err)
+	}
+	if err := m.ClearBucket(b); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := m.memTx.Put(b, p[0], p[1]); err != nil {
+			return fmt.Errorf("swap buckets: %s, %s: %w", a, b, err)
+		}
+	}
+	return nil
+}
+
+// copyBucket - content of `to` is replaced by content of `from` (of overlay and underlying db)
+func (m *MemoryMutation) copyBucket(from, to string) error {
+	if err := m.ClearBucket(to); err != nil {
+		return err
+	}
+	c, err := m.Cursor(from)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err := m.memTx.Put(to, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *MemoryMutation) ClearBucket(bucket string) error {
@@ -324,6 +437,11 @@ func (m *MemoryMutation) Flush(tx kv.RwTx) error {
 			}
 		}
 	}
+	for bucket, dups := range m.deletedDups {
+		if err := deleteDups(tx, bucket, dups); err != nil {
+			return err
+		}
+	}
 	// Iterate over each bucket and apply changes accordingly.
 	for _, bucket := range buckets {
 		if isTablePurelyDupsort(bucket) {
@@ -364,6 +482,89 @@ func (m *MemoryMutation) Flush(tx kv.RwTx) error {
 	return nil
 }
 
+func deleteDups(tx kv.RwTx, bucket string, dups map[dupEntry]struct{}) error {
+	c, err := tx.RwCursorDupSort(bucket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for dup := range dups {
+		if err := c.DeleteExact([]byte(dup.key), []byte(dup.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collector - receiver of FlushToCollectors, implemented by etl.Collector
+type Collector interface {
+	Collect(k, v []byte) error
+}
+
+// FlushToCollectors - like Flush, but changes of each table go to collector `collectors(table)` instead of db: for
+// speculative changes which are too big for one RwTx or are applied later by etl. Deleted keys are collected with
+// empty values (etl.Collector.Load deletes such keys). Collector doesn't keep order of same keys, so cleared tables,
+// deleted values of DupSort tables and deleted then re-put keys of DupSort tables can't be expressed: error is returned.
+func (m *MemoryMutation) FlushToCollectors(collectors func(table string) Collector) error {
+	for bucket := range m.clearedTables {
+		return fmt.Errorf("FlushToCollectors: table %s is cleared", bucket)
+	}
+	for bucket, dups := range m.deletedDups {
+		if len(dups) > 0 {
+			return fmt.Errorf("FlushToCollectors: values of table %s are deleted", bucket)
+		}
+	}
+	for bucket, keys := range m.deletedEntries {
+		c := collectors(bucket)
+		for key := range keys {
+			reput, err := m.memTx.Has(bucket, []byte(key))
+			if err != nil {
+				return err
+			}
+			if reput { // new value replaces deleted one
+				if isTablePurelyDupsort(bucket) {
+					return fmt.Errorf("FlushToCollectors: key %x of table %s is deleted and put again", key, bucket)
+				}
+				continue
+			}
+			if err := c.Collect([]byte(key), nil); err != nil {
+				return err
+			}
+		}
+	}
+	buckets, err := m.memTx.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err := m.collectTable(bucket, collectors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryMutation) collectTable(bucket string, collectors func(table string) Collector) error {
+	c, err := m.memTx.Cursor(bucket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var collector Collector
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if collector == nil {
+			collector = collectors(bucket)
+		}
+		if err := collector.Collect(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Check if a bucket is dupsorted and has dupsort conversion off
 func isTablePurelyDupsort(bucket string) bool {
 	config, ok := kv.ChaindataTablesCfg[bucket]
@@ -414,5 +615,5 @@ func (m *MemoryMutation) Cursor(bucket string) (kv.Cursor, error) {
 }
 
 func (m *MemoryMutation) ViewID() uint64 {
-	panic("ViewID Not implemented")
+	return m.db.ViewID()
 }
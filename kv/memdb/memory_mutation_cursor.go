@@ -54,6 +54,9 @@ func (m *memoryMutationCursor) isTableCleared() bool {
 }
 
 func (m *memoryMutationCursor) isEntryDeleted(key []byte, value []byte, t NextType) bool {
+	if m.mutation.isDupDeleted(m.table, key, value) {
+		return true
+	}
 	if t == Normal {
 		return m.mutation.isEntryDeleted(m.table, key)
 	} else {
@@ -304,6 +307,11 @@ func (m *memoryMutationCursor) SeekExact(seek []byte) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
+	if dbKey != nil && m.mutation.isDupDeleted(m.table, dbKey, dbValue) {
+		if dbKey, dbValue, err = m.getNextOnDb(Dup); err != nil {
+			return nil, nil, err
+		}
+	}
 	if dbKey != nil && !m.mutation.isEntryDeleted(m.table, seek) {
 		m.currentDbEntry.key = dbKey
 		m.currentDbEntry.value = dbValue
@@ -325,6 +333,7 @@ func (m *memoryMutationCursor) Append(k []byte, v []byte) error {
 }
 
 func (m *memoryMutationCursor) AppendDup(k []byte, v []byte) error {
+	m.mutation.undeleteDup(m.table, k, v)
 	return m.memCursor.AppendDup(common.Copy(k), common.Copy(v))
 }
 
@@ -336,11 +345,28 @@ func (m *memoryMutationCursor) Delete(k []byte) error {
 	return m.mutation.Delete(m.table, k)
 }
 
+// DeleteCurrent - in DupSort tables deletes only current value of key
 func (m *memoryMutationCursor) DeleteCurrent() error {
-	panic("DeleteCurrent Not implemented")
+	k, v, err := m.Current()
+	if err != nil || k == nil {
+		return err
+	}
+	if isTablePurelyDupsort(m.table) {
+		return m.mutation.deleteDup(m.table, k, v)
+	}
+	return m.Delete(k)
 }
+
+// DeleteExact - deletes `k2` value of `k1` key, other values of DupSort table stay
 func (m *memoryMutationCursor) DeleteExact(k1, k2 []byte) error {
-	panic("DeleteExact Not implemented")
+	if isTablePurelyDupsort(m.table) {
+		return m.mutation.deleteDup(m.table, common.Copy(k1), common.Copy(k2))
+	}
+	v, err := m.mutation.GetOne(m.table, k1)
+	if err != nil || !bytes.Equal(v, k2) {
+		return err
+	}
+	return m.Delete(k1)
 }
 
 func (m *memoryMutationCursor) DeleteCurrentDuplicates() error {
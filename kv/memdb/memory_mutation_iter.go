@@ -0,0 +1,122 @@
+/*
+   Copyright 2023 Erigon contributors
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+       http://www.apache.org/licenses/LICENSE-2.0
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package memdb
+
+import (
+	"bytes"
+
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+)
+
+// overlayIter - Range of MemoryMutation: merges ranges of overlay and underlying tx. Entries of underlying tx which
+// are deleted by overlay are skipped. For same key overlay wins (for same key and value in DupSort tables).
+type overlayIter struct {
+	m       *MemoryMutation
+	table   string
+	mem, db iter.KV
+	asc     bool
+	dupSort bool
+	limit   int
+
+	memHas, dbHas bool
+	memK, memV    []byte
+	dbK, dbV      []byte
+	err           error
+}
+
+func (m *MemoryMutation) rangeOrderLimit(table string, fromPrefix, toPrefix []byte, asc bool, limit int) (iter.KV, error) {
+	it := &overlayIter{m: m, table: table, asc: asc, dupSort: isTablePurelyDupsort(table), limit: limit}
+	var err error
+	if asc {
+		it.mem, err = m.memTx.RangeAscend(table, fromPrefix, toPrefix, -1)
+	} else {
+		it.mem, err = m.memTx.RangeDescend(table, fromPrefix, toPrefix, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case m.isTableCleared(table):
+		it.db = iter.EmptyKV
+	case asc:
+		it.db, err = m.db.RangeAscend(table, fromPrefix, toPrefix, -1)
+	default:
+		it.db, err = m.db.RangeDescend(table, fromPrefix, toPrefix, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.advanceMem()
+	it.advanceDb()
+	return it, nil
+}
+
+func (it *overlayIter) advanceMem() {
+	if it.err != nil {
+		return
+	}
+	if it.memHas = it.mem.HasNext(); it.memHas {
+		it.memK, it.memV, it.err = it.mem.Next()
+	}
+}
+
+func (it *overlayIter) advanceDb() {
+	for it.err == nil {
+		if it.dbHas = it.db.HasNext(); !it.dbHas {
+			return
+		}
+		if it.dbK, it.dbV, it.err = it.db.Next(); it.err != nil {
+			return
+		}
+		if !it.m.isEntryDeleted(it.table, it.dbK) && !it.m.isDupDeleted(it.table, it.dbK, it.dbV) {
+			return
+		}
+	}
+}
+
+func (it *overlayIter) HasNext() bool {
+	return it.err != nil || (it.limit != 0 && (it.memHas || it.dbHas))
+}
+
+func (it *overlayIter) Next() ([]byte, []byte, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	it.limit--
+	var c int
+	switch {
+	case !it.dbHas:
+		c = -1
+	case !it.memHas:
+		c = 1
+	default:
+		if c = bytes.Compare(it.memK, it.dbK); c == 0 && it.dupSort {
+			c = bytes.Compare(it.memV, it.dbV)
+		}
+		if !it.asc {
+			c = -c
+		}
+	}
+	if c > 0 {
+		k, v := it.dbK, it.dbV
+		it.advanceDb()
+		return k, v, nil
+	}
+	k, v := it.memK, it.memV
+	it.advanceMem()
+	if c == 0 {
+		it.advanceDb()
+	}
+	return k, v, nil
+}
@@ -19,7 +19,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
 )
 
 func initializeDbNonDupSort(rwTx kv.RwTx) {
@@ -664,3 +666,153 @@ func TestAutoConversionSeekBothRange(t *testing.T) {
 	require.NoError(t, err)
 	assert.Nil(t, v)
 }
+
+func rangeToStrings(t *testing.T, it iter.KV, err error) (res []string) {
+	t.Helper()
+	require.NoError(t, err)
+	for it.HasNext() {
+		k, v, err := it.Next()
+		require.NoError(t, err)
+		res = append(res, string(k)+"="+string(v))
+	}
+	return res
+}
+
+func TestRange(t *testing.T) {
+	_, rwTx := NewTestTx(t)
+	initializeDbNonDupSort(rwTx)
+
+	batch := NewMemoryBatch(rwTx, "")
+	defer batch.Close()
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("BAAA"), []byte("value4")))
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("CAAA"), []byte("value1.1")))
+	require.NoError(t, batch.Delete(kv.HashedAccounts, []byte("CBAA")))
+
+	it, err := batch.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"AAAA=value", "BAAA=value4", "CAAA=value1.1", "CCAA=value3"}, rangeToStrings(t, it, err))
+	it, err = batch.RangeDescend(kv.HashedAccounts, nil, nil, -1)
+	require.Equal(t, []string{"CCAA=value3", "CAAA=value1.1", "BAAA=value4", "AAAA=value"}, rangeToStrings(t, it, err))
+	it, err = batch.RangeAscend(kv.HashedAccounts, []byte("B"), []byte("CC"), -1)
+	require.Equal(t, []string{"BAAA=value4", "CAAA=value1.1"}, rangeToStrings(t, it, err))
+	it, err = batch.RangeDescend(kv.HashedAccounts, []byte("CBAA"), nil, 2)
+	require.Equal(t, []string{"CAAA=value1.1", "BAAA=value4"}, rangeToStrings(t, it, err))
+	it, err = batch.Prefix(kv.HashedAccounts, []byte("C"))
+	require.Equal(t, []string{"CAAA=value1.1", "CCAA=value3"}, rangeToStrings(t, it, err))
+
+	require.NoError(t, batch.ClearBucket(kv.HashedAccounts))
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("DAAA"), []byte("value5")))
+	it, err = batch.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"DAAA=value5"}, rangeToStrings(t, it, err))
+}
+
+func TestDupSortOverlay(t *testing.T) {
+	_, rwTx := NewTestTx(t)
+	initializeDbDupSort(rwTx)
+
+	batch := NewMemoryBatch(rwTx, "")
+	defer batch.Close()
+	require.NoError(t, batch.Put(kv.AccountChangeSet, []byte("key1"), []byte("value1.2")))
+	require.NoError(t, batch.Put(kv.AccountChangeSet, []byte("key1"), []byte("value1.1"))) // same as in db
+	c, err := batch.RwCursorDupSort(kv.AccountChangeSet)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.DeleteExact([]byte("key3"), []byte("value3.1")))
+
+	it, err := batch.Range(kv.AccountChangeSet, nil, nil)
+	require.Equal(t, []string{"key1=value1.1", "key1=value1.2", "key1=value1.3", "key3=value3.3"}, rangeToStrings(t, it, err))
+	it, err = batch.RangeDescend(kv.AccountChangeSet, nil, nil, -1)
+	require.Equal(t, []string{"key3=value3.3", "key1=value1.3", "key1=value1.2", "key1=value1.1"}, rangeToStrings(t, it, err))
+
+	k, v, err := c.SeekExact([]byte("key3"))
+	require.NoError(t, err)
+	require.Equal(t, "key3", string(k))
+	require.Equal(t, "value3.3", string(v))
+	_, v, err = c.NextDup()
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	require.NoError(t, batch.Flush(rwTx))
+	it, err = rwTx.Range(kv.AccountChangeSet, nil, nil)
+	require.Equal(t, []string{"key1=value1.1", "key1=value1.2", "key1=value1.3", "key3=value3.3"}, rangeToStrings(t, it, err))
+}
+
+func TestFlushToCollectors(t *testing.T) {
+	_, rwTx := NewTestTx(t)
+	initializeDbNonDupSort(rwTx)
+
+	batch := NewMemoryBatch(rwTx, "")
+	defer batch.Close()
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("BAAA"), []byte("value4")))
+	require.NoError(t, batch.Delete(kv.HashedAccounts, []byte("CBAA")))
+	require.NoError(t, batch.Delete(kv.HashedAccounts, []byte("CCAA")))
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("CCAA"), []byte("value3.1")))
+
+	collectors := map[string]*etl.Collector{}
+	require.NoError(t, batch.FlushToCollectors(func(table string) Collector {
+		if _, ok := collectors[table]; !ok {
+			collectors[table] = etl.NewCollector(table, t.TempDir(), etl.NewSortableBuffer(etl.BufferOptimalSize))
+		}
+		return collectors[table]
+	}))
+	require.Len(t, collectors, 1)
+	require.NoError(t, collectors[kv.HashedAccounts].Load(rwTx, kv.HashedAccounts, etl.IdentityLoadFunc, etl.TransformArgs{}))
+	it, err := rwTx.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"AAAA=value", "BAAA=value4", "CAAA=value1", "CCAA=value3.1"}, rangeToStrings(t, it, err))
+
+	require.NoError(t, batch.ClearBucket(kv.HashedAccounts))
+	require.Error(t, batch.FlushToCollectors(func(table string) Collector { return collectors[table] }))
+}
+
+func TestLastDBSize(t *testing.T) {
+	_, rwTx := NewTestTx(t)
+	initializeDbNonDupSort(rwTx)
+
+	batch := NewMemoryBatch(rwTx, "")
+	defer batch.Close()
+	k, v, err := batch.Last(kv.HashedAccounts)
+	require.NoError(t, err)
+	require.Equal(t, "CCAA=value3", string(k)+"="+string(v))
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("DAAA"), []byte("value4")))
+	k, v, err = batch.Last(kv.HashedAccounts)
+	require.NoError(t, err)
+	require.Equal(t, "DAAA=value4", string(k)+"="+string(v))
+	require.NoError(t, batch.Delete(kv.HashedAccounts, []byte("DAAA")))
+	k, _, err = batch.Last(kv.HashedAccounts)
+	require.NoError(t, err)
+	require.Equal(t, "CCAA", string(k))
+
+	dbSize, err := rwTx.DBSize()
+	require.NoError(t, err)
+	size, err := batch.DBSize()
+	require.NoError(t, err)
+	require.Greater(t, size, dbSize)
+}
+
+func TestRenameSwapBuckets(t *testing.T) {
+	_, rwTx := NewTestTx(t)
+	initializeDbNonDupSort(rwTx)
+	require.NoError(t, rwTx.Put(kv.Code, []byte("code"), []byte("value")))
+
+	batch := NewMemoryBatch(rwTx, "")
+	defer batch.Close()
+	require.NoError(t, batch.Put(kv.HashedAccounts, []byte("BAAA"), []byte("value4")))
+	require.NoError(t, batch.Delete(kv.HashedAccounts, []byte("CBAA")))
+
+	require.NoError(t, batch.SwapBuckets(kv.HashedAccounts, kv.Code))
+	it, err := batch.Range(kv.Code, nil, nil)
+	require.Equal(t, []string{"AAAA=value", "BAAA=value4", "CAAA=value1", "CCAA=value3"}, rangeToStrings(t, it, err))
+	it, err = batch.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"code=value"}, rangeToStrings(t, it, err))
+
+	require.NoError(t, batch.RenameBucket(kv.Code, kv.HashedAccounts))
+	it, err = batch.Range(kv.Code, nil, nil)
+	require.Empty(t, rangeToStrings(t, it, err))
+	it, err = batch.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"AAAA=value", "BAAA=value4", "CAAA=value1", "CCAA=value3"}, rangeToStrings(t, it, err))
+
+	require.NoError(t, batch.Flush(rwTx))
+	it, err = rwTx.Range(kv.Code, nil, nil)
+	require.Empty(t, rangeToStrings(t, it, err))
+	it, err = rwTx.Range(kv.HashedAccounts, nil, nil)
+	require.Equal(t, []string{"AAAA=value", "BAAA=value4", "CAAA=value1", "CCAA=value3"}, rangeToStrings(t, it, err))
+}
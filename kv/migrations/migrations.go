@@ -0,0 +1,220 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Migration - named change of db layout, applied once. Migrations are applied in order of Migrator's list:
+// new migration is appended to the end, applied migration is never renamed.
+type Migration struct {
+	Name string
+	// Up - applies migration. Work is committed by `commit` with RwTx of changes: progress is persisted atomically
+	// with them. Long migration commits by portions with isDone=false, after crash or cancellation Up is called again
+	// with last committed progress. Last portion (or the only RwTx of short migration) is committed with isDone=true.
+	Up func(ctx context.Context, db kv.RwDB, progress []byte, commit Commit) error
+	// DryRun - optional: describes what Up would do (amount of affected records, ...) without changes
+	DryRun func(ctx context.Context, tx kv.Tx, progress []byte) (string, error)
+}
+
+// Commit - persists progress of migration (or marks it applied if isDone) in tx and commits tx
+type Commit func(tx kv.RwTx, progress []byte, isDone bool) error
+
+// Plan - pending migration, see Migrator.DryRun
+type Plan struct {
+	Name     string
+	Progress []byte // not nil - migration was interrupted, Up will continue from it
+	Summary  string // of Migration.DryRun, empty if it's not set
+}
+
+// Migrator - applies not yet applied migrations of db. State is kept in kv.Migrations table:
+// name -> time of apply, progressPrefix+name -> progress of interrupted migration.
+type Migrator struct {
+	migrations []Migration
+	logger     log.Logger
+}
+
+const progressPrefix = "_progress_"
+
+func NewMigrator(logger log.Logger, migrations ...Migration) (*Migrator, error) {
+	names := map[string]struct{}{}
+	for _, m := range migrations {
+		if m.Name == "" || m.Up == nil {
+			return nil, fmt.Errorf("migration %q: name and Up are required", m.Name)
+		}
+		if strings.HasPrefix(m.Name, progressPrefix) {
+			return nil, fmt.Errorf("migration %q: name can't start with %s", m.Name, progressPrefix)
+		}
+		if _, ok := names[m.Name]; ok {
+			return nil, fmt.Errorf("migration %q: duplicated name", m.Name)
+		}
+		names[m.Name] = struct{}{}
+	}
+	return &Migrator{migrations: migrations, logger: logger}, nil
+}
+
+// Applied - name of applied migration -> time of apply. Includes migrations unknown to this Migrator.
+func Applied(tx kv.Tx) (map[string]time.Time, error) {
+	res := map[string]time.Time{}
+	if err := tx.ForEach(kv.Migrations, nil, func(k, v []byte) error {
+		if bytes.HasPrefix(k, []byte(progressPrefix)) {
+			return nil
+		}
+		var at time.Time
+		if len(v) == 8 {
+			at = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		}
+		res[string(k)] = at
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Pending - names of not applied migrations, in order of apply
+func (m *Migrator) Pending(tx kv.Tx) ([]string, error) {
+	applied, err := Applied(tx)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, mg := range m.migrations {
+		if _, ok := applied[mg.Name]; !ok {
+			res = append(res, mg.Name)
+		}
+	}
+	return res, nil
+}
+
+// DryRun - plan of Apply: pending migrations with their progress and summaries. db is not changed.
+func (m *Migrator) DryRun(ctx context.Context, db kv.RoDB) (plans []Plan, err error) {
+	err = db.View(ctx, func(tx kv.Tx) error {
+		pending, err := m.Pending(tx)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.byNames(pending) {
+			p := Plan{Name: mg.Name}
+			if p.Progress, err = progress(tx, mg.Name); err != nil {
+				return err
+			}
+			if mg.DryRun != nil {
+				if p.Summary, err = mg.DryRun(ctx, tx, p.Progress); err != nil {
+					return fmt.Errorf("migration %s: dry run: %w", mg.Name, err)
+				}
+			}
+			plans = append(plans, p)
+		}
+		return nil
+	})
+	return plans, err
+}
+
+// Apply - applies pending migrations in order. Stops on first error: next Apply continues from progress of failed migration.
+func (m *Migrator) Apply(ctx context.Context, db kv.RwDB) error {
+	var pending []string
+	if err := db.View(ctx, func(tx kv.Tx) (err error) {
+		pending, err = m.Pending(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, mg := range m.byNames(pending) {
+		if err := m.apply(ctx, db, mg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, db kv.RwDB, mg Migration) error {
+	var p []byte
+	if err := db.View(ctx, func(tx kv.Tx) (err error) {
+		p, err = progress(tx, mg.Name)
+		return err
+	}); err != nil {
+		return err
+	}
+	start := time.Now()
+	m.logger.Info("[migrations] apply", "name", mg.Name, "resume", p != nil)
+	done := false
+	commit := func(tx kv.RwTx, progress []byte, isDone bool) error {
+		if done {
+			return fmt.Errorf("migration %s: commit after isDone", mg.Name)
+		}
+		if isDone {
+			var at [8]byte
+			binary.BigEndian.PutUint64(at[:], uint64(time.Now().Unix()))
+			if err := tx.Put(kv.Migrations, []byte(mg.Name), at[:]); err != nil {
+				return err
+			}
+			if err := tx.Delete(kv.Migrations, []byte(progressPrefix+mg.Name)); err != nil {
+				return err
+			}
+		} else if err := tx.Put(kv.Migrations, []byte(progressPrefix+mg.Name), common.Copy(progress)); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		done = isDone
+		if !isDone {
+			m.logger.Info("[migrations] progress", "name", mg.Name, "progress", fmt.Sprintf("%x", progress))
+		}
+		return nil
+	}
+	if err := mg.Up(ctx, db, p, commit); err != nil {
+		return fmt.Errorf("migration %s: %w", mg.Name, err)
+	}
+	if !done {
+		return fmt.Errorf("migration %s: Up returned without commit with isDone=true", mg.Name)
+	}
+	m.logger.Info("[migrations] applied", "name", mg.Name, "took", time.Since(start))
+	return nil
+}
+
+func (m *Migrator) byNames(names []string) []Migration {
+	res := make([]Migration, 0, len(names))
+	for _, name := range names {
+		for _, mg := range m.migrations {
+			if mg.Name == name {
+				res = append(res, mg)
+			}
+		}
+	}
+	return res
+}
+
+func progress(tx kv.Tx, name string) ([]byte, error) {
+	v, err := tx.GetOne(kv.Migrations, []byte(progressPrefix+name))
+	if err != nil {
+		return nil, err
+	}
+	return common.Copy(v), nil
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package migrations
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+)
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	db := memdb.NewTestDB(t)
+	logger := log.New()
+
+	var calls int
+	short := Migration{
+		Name: "short",
+		Up: func(ctx context.Context, db kv.RwDB, progress []byte, commit Commit) error {
+			calls++
+			tx, err := db.BeginRw(ctx)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := tx.Put(kv.DatabaseInfo, []byte("short"), []byte{1}); err != nil {
+				return err
+			}
+			return commit(tx, nil, true)
+		},
+	}
+	failAt := uint64(5)
+	long := Migration{
+		Name: "long",
+		Up: func(ctx context.Context, db kv.RwDB, progress []byte, commit Commit) error {
+			var from uint64
+			if progress != nil {
+				from = binary.BigEndian.Uint64(progress)
+			}
+			for from < 10 {
+				tx, err := db.BeginRw(ctx)
+				if err != nil {
+					return err
+				}
+				defer tx.Rollback()
+				to := from + 3
+				if to > 10 {
+					to = 10
+				}
+				for i := from; i < to; i++ {
+					if i == failAt {
+						return fmt.Errorf("crash")
+					}
+					k := u64(i)
+					if err := tx.Put(kv.DatabaseInfo, k, k); err != nil {
+						return err
+					}
+				}
+				if err := commit(tx, u64(to), to == 10); err != nil {
+					return err
+				}
+				from = to
+			}
+			return nil
+		},
+		DryRun: func(ctx context.Context, tx kv.Tx, progress []byte) (string, error) {
+			return fmt.Sprintf("resume=%t", progress != nil), nil
+		},
+	}
+	m, err := NewMigrator(logger, short, long)
+	require.NoError(t, err)
+
+	plans, err := m.DryRun(ctx, db)
+	require.NoError(t, err)
+	require.Equal(t, []Plan{{Name: "short"}, {Name: "long", Summary: "resume=false"}}, plans)
+
+	require.ErrorContains(t, m.Apply(ctx, db), "migration long: crash")
+	err = db.View(ctx, func(tx kv.Tx) error {
+		pending, err := m.Pending(tx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"long"}, pending)
+		v, err := tx.GetOne(kv.DatabaseInfo, u64(2)) // committed portion
+		require.NoError(t, err)
+		require.NotNil(t, v)
+		return nil
+	})
+	require.NoError(t, err)
+	plans, err = m.DryRun(ctx, db)
+	require.NoError(t, err)
+	require.Equal(t, []Plan{{Name: "long", Progress: u64(3), Summary: "resume=true"}}, plans)
+
+	failAt = 100
+	require.NoError(t, m.Apply(ctx, db))
+	require.NoError(t, m.Apply(ctx, db))
+	require.Equal(t, 1, calls)
+	err = db.View(ctx, func(tx kv.Tx) error {
+		applied, err := Applied(tx)
+		require.NoError(t, err)
+		require.Len(t, applied, 2)
+		for i := uint64(0); i < 10; i++ {
+			v, err := tx.GetOne(kv.DatabaseInfo, u64(i))
+			require.NoError(t, err)
+			require.NotNil(t, v)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = NewMigrator(logger, short, short)
+	require.Error(t, err)
+	notDone, err := NewMigrator(logger, Migration{Name: "not_done", Up: func(context.Context, kv.RwDB, []byte, Commit) error { return nil }})
+	require.NoError(t, err)
+	require.ErrorContains(t, notDone.Apply(ctx, db), "without commit")
+}
+
+func u64(i uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], i)
+	return b[:]
+}
@@ -0,0 +1,493 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package multienv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+)
+
+// Route - tables stored in DB (separate env: for example txpool tables on tmpfs, history keys on big disk)
+type Route struct {
+	DB     kv.RwDB
+	Tables []string
+}
+
+// DB - kv.RwDB over several envs: tables of routes are stored in their envs, all other tables - in main env.
+// Tx of DB consists of sub-transactions of envs:
+//   - RoTx opens sub-transaction of env on first access to its table. Sub-transactions don't share snapshot:
+//     consistency between envs is not guaranteed for readers
+//   - RwTx begins sub-transactions of all envs at once, in order of envs (main env first): writers can't deadlock
+//     by waiting for each other's envs
+//   - Commit commits routed envs first (in order of routes) and main env last: progress kept in main env
+//     never runs ahead of data in routed envs. If some commit fails, previous commits are not reverted.
+//
+// DB owns envs: Close closes all of them.
+type DB struct {
+	envs   []kv.RwDB      // main env is envs[0]
+	routes map[string]int // table -> index in envs, absent - main env
+}
+
+var _ kv.RwDB = &DB{}
+
+// New - each env must be used once: main env can't be route's DB and 2 routes can't share DB
+// (RwTx begins write transaction in each env, 2nd one in same env would wait for 1st forever).
+func New(main kv.RwDB, routes ...Route) (*DB, error) {
+	db := &DB{envs: []kv.RwDB{main}, routes: map[string]int{}}
+	for ri, r := range routes {
+		for i, env := range db.envs {
+			if env != r.DB {
+				continue
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("multienv: route %d uses main env", ri)
+			}
+			return nil, fmt.Errorf("multienv: route %d uses env of route %d", ri, i-1)
+		}
+		db.envs = append(db.envs, r.DB)
+		for _, table := range r.Tables {
+			if _, ok := db.routes[table]; ok {
+				return nil, fmt.Errorf("multienv: table %s is routed twice", table)
+			}
+			if _, ok := r.DB.AllBuckets()[table]; !ok {
+				return nil, fmt.Errorf("multienv: table %s is not configured in its env", table)
+			}
+			db.routes[table] = len(db.envs) - 1
+		}
+	}
+	return db, nil
+}
+
+func (db *DB) env(table string) int { return db.routes[table] } // absent - 0: main env
+
+func (db *DB) ReadOnly() bool   { return db.envs[0].ReadOnly() }
+func (db *DB) PageSize() uint64 { return db.envs[0].PageSize() }
+
+// AllBuckets - config of each table is taken from env which stores it
+func (db *DB) AllBuckets() kv.TableCfg {
+	res := kv.TableCfg{}
+	for i, env := range db.envs {
+		for table, cfg := range env.AllBuckets() {
+			if db.env(table) == i {
+				res[table] = cfg
+			}
+		}
+	}
+	return res
+}
+
+func (db *DB) Close() {
+	for i := len(db.envs) - 1; i >= 0; i-- {
+		db.envs[i].Close()
+	}
+}
+
+func (db *DB) BeginRo(ctx context.Context) (kv.Tx, error) {
+	return &Tx{db: db, ctx: ctx, txs: make([]kv.Tx, len(db.envs))}, nil
+}
+
+func (db *DB) BeginRw(ctx context.Context) (kv.RwTx, error) { return db.beginRw(ctx, false) }
+func (db *DB) BeginRwNosync(ctx context.Context) (kv.RwTx, error) {
+	return db.beginRw(ctx, true)
+}
+
+func (db *DB) beginRw(ctx context.Context, nosync bool) (kv.RwTx, error) {
+	tx := &Tx{db: db, ctx: ctx, rw: true, txs: make([]kv.Tx, len(db.envs))}
+	for i, env := range db.envs {
+		var sub kv.RwTx
+		var err error
+		if nosync {
+			sub, err = env.BeginRwNosync(ctx)
+		} else {
+			sub, err = env.BeginRw(ctx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("multienv: begin env %d: %w", i, err)
+		}
+		tx.txs[i] = sub
+	}
+	return tx, nil
+}
+
+func (db *DB) View(ctx context.Context, f func(tx kv.Tx) error) error {
+	tx, err := db.BeginRo(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return f(tx)
+}
+
+func (db *DB) Update(ctx context.Context, f func(tx kv.RwTx) error) error {
+	return db.update(ctx, false, f)
+}
+func (db *DB) UpdateNosync(ctx context.Context, f func(tx kv.RwTx) error) error {
+	return db.update(ctx, true, f)
+}
+
+func (db *DB) update(ctx context.Context, nosync bool, f func(tx kv.RwTx) error) error {
+	tx, err := db.beginRw(ctx, nosync)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Tx - see DB
+type Tx struct {
+	db  *DB
+	ctx context.Context
+	rw  bool
+	txs []kv.Tx // by index of env, nil - not opened yet
+}
+
+var _ kv.RwTx = &Tx{}
+
+func (tx *Tx) sub(table string) (kv.Tx, error) {
+	i := tx.db.env(table)
+	if tx.txs[i] == nil {
+		sub, err := tx.db.envs[i].BeginRo(tx.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("multienv: begin env %d: %w", i, err)
+		}
+		tx.txs[i] = sub
+	}
+	return tx.txs[i], nil
+}
+
+func (tx *Tx) rwSub(table string) (kv.RwTx, error) {
+	if !tx.rw {
+		return nil, fmt.Errorf("multienv: write to %s in read-only transaction", table)
+	}
+	return tx.txs[tx.db.env(table)].(kv.RwTx), nil
+}
+
+// Commit - routed envs first, main env last
+func (tx *Tx) Commit() error {
+	defer tx.Rollback()
+	for i := 1; i < len(tx.txs); i++ {
+		if err := tx.commitSub(i); err != nil {
+			return err
+		}
+	}
+	return tx.commitSub(0)
+}
+
+func (tx *Tx) commitSub(i int) error {
+	if tx.txs[i] == nil {
+		return nil
+	}
+	if err := tx.txs[i].Commit(); err != nil {
+		return fmt.Errorf("multienv: commit env %d: %w", i, err)
+	}
+	tx.txs[i] = nil
+	return nil
+}
+
+func (tx *Tx) Rollback() {
+	for i := len(tx.txs) - 1; i >= 0; i-- {
+		if tx.txs[i] != nil {
+			tx.txs[i].Rollback()
+			tx.txs[i] = nil
+		}
+	}
+}
+
+// ViewID - of main env
+func (tx *Tx) ViewID() uint64 {
+	sub, err := tx.sub("")
+	if err != nil {
+		return 0
+	}
+	return sub.ViewID()
+}
+
+func (tx *Tx) DBSize() (size uint64, err error) {
+	for i := range tx.db.envs {
+		if tx.txs[i] == nil {
+			if tx.txs[i], err = tx.db.envs[i].BeginRo(tx.ctx); err != nil {
+				return 0, err
+			}
+		}
+		s, err := tx.txs[i].DBSize()
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	return size, nil
+}
+
+func (tx *Tx) CollectMetrics() {
+	for _, sub := range tx.txs {
+		if rw, ok := sub.(kv.RwTx); ok {
+			rw.CollectMetrics()
+		}
+	}
+}
+
+func (tx *Tx) Has(table string, key []byte) (bool, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return false, err
+	}
+	return sub.Has(table, key)
+}
+
+func (tx *Tx) GetOne(table string, key []byte) ([]byte, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.GetOne(table, key)
+}
+
+func (tx *Tx) ReadSequence(table string) (uint64, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return 0, err
+	}
+	return sub.ReadSequence(table)
+}
+
+func (tx *Tx) BucketSize(table string) (uint64, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return 0, err
+	}
+	return sub.BucketSize(table)
+}
+
+func (tx *Tx) Cursor(table string) (kv.Cursor, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Cursor(table)
+}
+
+func (tx *Tx) CursorDupSort(table string) (kv.CursorDupSort, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.CursorDupSort(table)
+}
+
+func (tx *Tx) Range(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Range(table, fromPrefix, toPrefix)
+}
+
+func (tx *Tx) RangeAscend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.RangeAscend(table, fromPrefix, toPrefix, limit)
+}
+
+func (tx *Tx) RangeDescend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.RangeDescend(table, fromPrefix, toPrefix, limit)
+}
+
+func (tx *Tx) Prefix(table string, prefix []byte) (iter.KV, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Prefix(table, prefix)
+}
+
+func (tx *Tx) ForEach(table string, fromPrefix []byte, walker func(k, v []byte) error) error {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return err
+	}
+	return sub.ForEach(table, fromPrefix, walker)
+}
+
+func (tx *Tx) ForPrefix(table string, prefix []byte, walker func(k, v []byte) error) error {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return err
+	}
+	return sub.ForPrefix(table, prefix, walker)
+}
+
+func (tx *Tx) ForAmount(table string, prefix []byte, amount uint32, walker func(k, v []byte) error) error {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return err
+	}
+	return sub.ForAmount(table, prefix, amount, walker)
+}
+
+func (tx *Tx) Put(table string, k, v []byte) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.Put(table, k, v)
+}
+
+func (tx *Tx) Delete(table string, k []byte) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.Delete(table, k)
+}
+
+func (tx *Tx) IncrementSequence(table string, amount uint64) (uint64, error) {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return 0, err
+	}
+	return sub.IncrementSequence(table, amount)
+}
+
+func (tx *Tx) Append(table string, k, v []byte) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.Append(table, k, v)
+}
+
+func (tx *Tx) AppendDup(table string, k, v []byte) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.AppendDup(table, k, v)
+}
+
+func (tx *Tx) RwCursor(table string) (kv.RwCursor, error) {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.RwCursor(table)
+}
+
+func (tx *Tx) RwCursorDupSort(table string) (kv.RwCursorDupSort, error) {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return nil, err
+	}
+	return sub.RwCursorDupSort(table)
+}
+
+func (tx *Tx) DropBucket(table string) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.DropBucket(table)
+}
+
+func (tx *Tx) CreateBucket(table string) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.CreateBucket(table)
+}
+
+func (tx *Tx) ClearBucket(table string) error {
+	sub, err := tx.rwSub(table)
+	if err != nil {
+		return err
+	}
+	return sub.ClearBucket(table)
+}
+
+func (tx *Tx) ExistsBucket(table string) (bool, error) {
+	sub, err := tx.sub(table)
+	if err != nil {
+		return false, err
+	}
+	if m, ok := sub.(kv.BucketMigrator); ok {
+		return m.ExistsBucket(table)
+	}
+	return false, fmt.Errorf("multienv: ExistsBucket is not supported by env of %s", table)
+}
+
+// ListBuckets - tables of all envs, each table is listed only by env which stores it
+func (tx *Tx) ListBuckets() (res []string, err error) {
+	for i := range tx.db.envs {
+		if tx.txs[i] == nil {
+			if tx.txs[i], err = tx.db.envs[i].BeginRo(tx.ctx); err != nil {
+				return nil, err
+			}
+		}
+		m, ok := tx.txs[i].(kv.BucketMigrator)
+		if !ok {
+			return nil, fmt.Errorf("multienv: ListBuckets is not supported by env %d", i)
+		}
+		tables, err := m.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			if tx.db.env(table) == i {
+				res = append(res, table)
+			}
+		}
+	}
+	return res, nil
+}
+
+// RenameBucket - tables must be stored in same env
+func (tx *Tx) RenameBucket(from, to string) error {
+	if tx.db.env(from) != tx.db.env(to) {
+		return fmt.Errorf("multienv: RenameBucket: tables %s and %s are stored in different envs", from, to)
+	}
+	sub, err := tx.rwSub(from)
+	if err != nil {
+		return err
+	}
+	return sub.RenameBucket(from, to)
+}
+
+// SwapBuckets - tables must be stored in same env
+func (tx *Tx) SwapBuckets(a, b string) error {
+	if tx.db.env(a) != tx.db.env(b) {
+		return fmt.Errorf("multienv: SwapBuckets: tables %s and %s are stored in different envs", a, b)
+	}
+	sub, err := tx.rwSub(a)
+	if err != nil {
+		return err
+	}
+	return sub.SwapBuckets(a, b)
+}
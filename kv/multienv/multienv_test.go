@@ -0,0 +1,90 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package multienv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+)
+
+func TestRouting(t *testing.T) {
+	ctx := context.Background()
+	main, small, other := memdb.NewTestDB(t), memdb.NewTestDB(t), memdb.NewTestDB(t)
+	_, err := New(main, Route{DB: small, Tables: []string{kv.HeaderNumber}}, Route{DB: other, Tables: []string{kv.HeaderNumber}})
+	require.ErrorContains(t, err, "routed twice")
+	_, err = New(main, Route{DB: small, Tables: []string{kv.HeaderNumber}}, Route{DB: small, Tables: []string{kv.Headers}})
+	require.ErrorContains(t, err, "uses env of route 0")
+	_, err = New(main, Route{DB: main, Tables: []string{kv.HeaderNumber}})
+	require.ErrorContains(t, err, "uses main env")
+	db, err := New(main, Route{DB: small, Tables: []string{kv.HeaderNumber}})
+	require.NoError(t, err)
+
+	err = db.Update(ctx, func(tx kv.RwTx) error {
+		require.NoError(t, tx.Put(kv.HeaderNumber, []byte("hash"), []byte{1}))
+		require.NoError(t, tx.Put(kv.Headers, []byte{1}, []byte("header")))
+		id, err := tx.IncrementSequence(kv.HeaderNumber, 5)
+		require.NoError(t, err)
+		require.Zero(t, id)
+		require.Error(t, tx.RenameBucket(kv.HeaderNumber, kv.Headers))
+		return nil
+	})
+	require.NoError(t, err)
+
+	get := func(db kv.RoDB, table string, k []byte) (v []byte) {
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) (err error) {
+			v, err = tx.GetOne(table, k)
+			return err
+		}))
+		return v
+	}
+	require.Equal(t, []byte{1}, get(small, kv.HeaderNumber, []byte("hash")))
+	require.Nil(t, get(main, kv.HeaderNumber, []byte("hash")))
+	require.Equal(t, []byte("header"), get(main, kv.Headers, []byte{1}))
+	require.Nil(t, get(small, kv.Headers, []byte{1}))
+	require.Equal(t, []byte{1}, get(db, kv.HeaderNumber, []byte("hash")))
+	require.Equal(t, []byte("header"), get(db, kv.Headers, []byte{1}))
+
+	err = db.View(ctx, func(tx kv.Tx) error {
+		seq, err := tx.ReadSequence(kv.HeaderNumber)
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), seq)
+		require.Error(t, tx.(kv.RwTx).Put(kv.Headers, []byte{2}, nil)) // read-only
+
+		tables, err := tx.(kv.BucketMigrator).ListBuckets()
+		require.NoError(t, err)
+		seen := map[string]int{}
+		for _, table := range tables {
+			seen[table]++
+		}
+		require.Equal(t, 1, seen[kv.HeaderNumber])
+		require.Equal(t, 1, seen[kv.Headers])
+		return nil
+	})
+	require.NoError(t, err)
+	require.Contains(t, db.AllBuckets(), kv.HeaderNumber)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(kv.HeaderNumber, []byte("hash2"), []byte{2}))
+	tx.Rollback()
+	require.Nil(t, get(small, kv.HeaderNumber, []byte("hash2")))
+}
@@ -19,6 +19,7 @@ package remotedb
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"runtime"
@@ -28,6 +29,7 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	"github.com/ledgerwatch/erigon-lib/gointerfaces"
@@ -35,11 +37,13 @@ import (
 	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/remotedbserver"
 )
 
 // generate the messages and services
 type remoteOpts struct {
 	remoteKV    remote.KVClient
+	temporalKV  remotedbserver.TemporalKVClient
 	log         log.Logger
 	bucketsCfg  mdbx.TableCfgFunc
 	DialAddress string
@@ -88,6 +92,12 @@ func (opts remoteOpts) WithBucketsConfig(f mdbx.TableCfgFunc) remoteOpts {
 	return opts
 }
 
+// WithTemporalKV - client of remotedbserver.TemporalKV service (usually on same connection as KV): enables HistoryRange
+func (opts remoteOpts) WithTemporalKV(c remotedbserver.TemporalKVClient) remoteOpts {
+	opts.temporalKV = c
+	return opts
+}
+
 func (opts remoteOpts) Open() (*RemoteKV, error) {
 	targetSemCount := int64(runtime.GOMAXPROCS(-1)) - 1
 	if targetSemCount <= 1 {
@@ -195,6 +205,24 @@ func (db *RemoteKV) View(ctx context.Context, f func(tx kv.Tx) error) (err error
 	return f(tx)
 }
 
+// BeginTemporalRo - remote tx implements kv.TemporalTx: temporal methods are served by KvServer if server's DB is temporal
+func (db *RemoteKV) BeginTemporalRo(ctx context.Context) (kv.TemporalTx, error) {
+	tx, err := db.BeginRo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tx.(kv.TemporalTx), nil
+}
+
+func (db *RemoteKV) ViewTemporal(ctx context.Context, f func(tx kv.TemporalTx) error) error {
+	tx, err := db.BeginTemporalRo(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return f(tx)
+}
+
 func (db *RemoteKV) Update(ctx context.Context, f func(tx kv.RwTx) error) (err error) {
 	return fmt.Errorf("remote db provider doesn't support .Update method")
 }
@@ -627,9 +655,17 @@ func (tx *remoteTx) HistoryGet(name kv.History, k []byte, ts uint64) (v []byte,
 	return reply.V, reply.Ok, nil
 }
 
-func (tx *remoteTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs, limit int) (timestamps iter.U64, err error) {
+func (tx *remoteTx) DomainGet(name kv.Domain, k, k2 []byte, ts uint64) (v []byte, ok bool, err error) {
+	reply, err := tx.db.remoteKV.DomainGet(tx.ctx, &remote.DomainGetReq{TxId: tx.id, Table: string(name), K: k, K2: k2, Ts: ts})
+	if err != nil {
+		return nil, false, err
+	}
+	return reply.V, reply.Ok, nil
+}
+
+func (tx *remoteTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int) (timestamps iter.U64, err error) {
 	return iter.PaginateU64(func(pageToken string) (arr []uint64, nextPageToken string, err error) {
-		req := &remote.IndexRangeReq{TxId: tx.id, Table: string(name), K: k, FromTs: int64(fromTs), ToTs: int64(toTs), Limit: int64(limit)}
+		req := &remote.IndexRangeReq{TxId: tx.id, Table: string(name), K: k, FromTs: int64(fromTs), ToTs: int64(toTs), OrderAscend: bool(asc), Limit: int64(limit), PageToken: pageToken}
 		reply, err := tx.db.remoteKV.IndexRange(tx.ctx, req)
 		if err != nil {
 			return nil, "", err
@@ -638,6 +674,25 @@ func (tx *remoteTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs, limi
 	}), nil
 }
 
+// HistoryRange - requires remotedbserver.TemporalKV client, see remoteOpts.WithTemporalKV. Only ascending order.
+func (tx *remoteTx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int) (it iter.KV, err error) {
+	if tx.db.opts.temporalKV == nil {
+		return nil, fmt.Errorf("remote HistoryRange: %w: no TemporalKV client", kv.ErrNotSupported)
+	}
+	return iter.PaginateKV(func(pageToken string) (keys [][]byte, values [][]byte, nextPageToken string, err error) {
+		req := &remote.IndexRangeReq{TxId: tx.id, Table: string(name), FromTs: int64(fromTs), ToTs: int64(toTs), OrderAscend: bool(asc), Limit: int64(limit), PageToken: pageToken}
+		reply, err := tx.db.opts.temporalKV.HistoryRange(tx.ctx, req)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return reply.Keys, reply.Values, reply.NextPageToken, nil
+	}), nil
+}
+
+func (tx *remoteTx) DomainRange(name kv.Domain, k1, k2 []byte, asOfTs uint64, asc order.By, limit int) (it iter.KV, err error) {
+	return nil, fmt.Errorf("remote DomainRange: %w", kv.ErrNotSupported)
+}
+
 func (tx *remoteTx) Prefix(table string, prefix []byte) (iter.KV, error) {
 	nextPrefix, ok := kv.NextSubtree(prefix)
 	if !ok {
@@ -684,14 +739,66 @@ func (tx *remoteTx) StreamDescend(table string, fromPrefix, toPrefix []byte, lim
 */
 
 func (tx *remoteTx) rangeOrderLimit(table string, fromPrefix, toPrefix []byte, asc order.By, limit int) (iter.KV, error) {
-	return iter.PaginateKV(func(pageToken string) (keys [][]byte, values [][]byte, nextPageToken string, err error) {
-		req := &remote.RangeReq{TxId: tx.id, Table: table, FromPrefix: fromPrefix, ToPrefix: toPrefix, OrderAscend: bool(asc), Limit: int64(limit)}
+	return tx.rangePaginated(table, fromPrefix, toPrefix, asc, limit, ""), nil
+}
+
+// rangePaginated - Range which provides iter.ContinuationToken. Not empty `continuationToken` - position to start from
+// (instead of `fromPrefix`) and remaining limit.
+func (tx *remoteTx) rangePaginated(table string, fromPrefix, toPrefix []byte, asc order.By, limit int, continuationToken string) *iter.PaginatedDual[[]byte, []byte] {
+	return iter.PaginateDualResumable(func(pageToken string) (keys [][]byte, values [][]byte, nextPageToken string, err error) {
+		if pageToken == "" { // first page
+			pageToken = continuationToken
+		}
+		req := &remote.RangeReq{TxId: tx.id, Table: table, FromPrefix: fromPrefix, ToPrefix: toPrefix, OrderAscend: bool(asc), Limit: int64(limit), PageToken: pageToken}
 		reply, err := tx.db.remoteKV.Range(tx.ctx, req)
 		if err != nil {
 			return nil, nil, "", err
 		}
 		return reply.Keys, reply.Values, reply.NextPageToken, nil
-	}), nil
+	}, func(nextK, _ []byte, returned int) (string, error) {
+		remaining := limit
+		if limit > 0 {
+			remaining -= returned
+		}
+		return marshalPagination(&remote.ParisPagination{NextKey: nextK, Limit: int64(remaining)})
+	})
+}
+
+// ResumableTx - remote tx which can continue Range of another tx, see iter.ContinuationToken
+type ResumableTx interface {
+	RangeResume(table string, toPrefix []byte, asc order.By, continuationToken string) (iter.KV, error)
+}
+
+var _ ResumableTx = (*remoteTx)(nil)
+
+// RangeResume - continues Range (maybe of another tx) from iter.ContinuationToken of its stream, `toPrefix` and `asc`
+// must be same as of original Range. For DupSort tables position is precise to key: values of key are returned again.
+func (tx *remoteTx) RangeResume(table string, toPrefix []byte, asc order.By, continuationToken string) (iter.KV, error) {
+	if continuationToken == "" {
+		return iter.EmptyKV, nil
+	}
+	var pagination remote.ParisPagination
+	if err := unmarshalPagination(continuationToken, &pagination); err != nil {
+		return nil, fmt.Errorf("RangeResume: %w", err)
+	}
+	return tx.rangePaginated(table, nil, toPrefix, asc, int(pagination.Limit), continuationToken), nil
+}
+
+// marshalPagination - same encoding of tokens as by remotedbserver
+func marshalPagination(m proto.Message) (string, error) {
+	pageToken, err := proto.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pageToken), nil
+}
+
+func unmarshalPagination(pageToken string, m proto.Message) error {
+	token, err := base64.StdEncoding.DecodeString(pageToken)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(token, m)
 }
 func (tx *remoteTx) Range(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
 	return tx.rangeOrderLimit(table, fromPrefix, toPrefix, order.Asc, -1)
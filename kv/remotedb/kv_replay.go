@@ -0,0 +1,326 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remotedb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ledgerwatch/log/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/ledgerwatch/erigon-lib/gointerfaces"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/grpcutil"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/types"
+)
+
+// Capture - json lines of captureRecord, written by RecordingKVClient and served by ReplayKVClient:
+// integration tests of RPC features run hermetically - without kv server and without database.
+//
+// Unary calls are matched by method and request. Tx streams are matched by order of opening: replay is exact
+// if test opens transactions in same order as during recording (it's true for sequential tests).
+
+// captureRecord - 1 request/response exchange. Messages are proto-encoded.
+type captureRecord struct {
+	Method string `json:"method"`
+	Stream int    `json:"stream"` // number of Tx stream in order of opening, -1 for unary calls
+	Req    []byte `json:"req,omitempty"`
+	Resp   []byte `json:"resp,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+const txMethod = "Tx"
+
+var marshalOpts = proto.MarshalOptions{Deterministic: true} // same request - same bytes: it's key of unary calls
+
+// RecordingKVClient - proxy which writes all requests and responses of wrapped client to capture
+type RecordingKVClient struct {
+	remote.KVClient
+	lock    sync.Mutex
+	enc     *json.Encoder
+	streams int
+	err     error
+}
+
+func NewRecordingKVClient(client remote.KVClient, w io.Writer) *RecordingKVClient {
+	return &RecordingKVClient{KVClient: client, enc: json.NewEncoder(w)}
+}
+
+// Err - first error of writing to capture
+func (r *RecordingKVClient) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *RecordingKVClient) write(rec captureRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(rec)
+}
+
+func recordUnary[Req, Resp proto.Message](r *RecordingKVClient, method string, req Req, resp Resp, err error) (Resp, error) {
+	rec := captureRecord{Method: method, Stream: -1}
+	var mErr error
+	if rec.Req, mErr = marshalOpts.Marshal(req); mErr != nil {
+		return resp, mErr
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	} else if rec.Resp, mErr = marshalOpts.Marshal(resp); mErr != nil {
+		return resp, mErr
+	}
+	r.write(rec)
+	return resp, err
+}
+
+func (r *RecordingKVClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*types.VersionReply, error) {
+	resp, err := r.KVClient.Version(ctx, in, opts...)
+	return recordUnary(r, "Version", in, resp, err)
+}
+func (r *RecordingKVClient) Snapshots(ctx context.Context, in *remote.SnapshotsRequest, opts ...grpc.CallOption) (*remote.SnapshotsReply, error) {
+	resp, err := r.KVClient.Snapshots(ctx, in, opts...)
+	return recordUnary(r, "Snapshots", in, resp, err)
+}
+func (r *RecordingKVClient) DomainGet(ctx context.Context, in *remote.DomainGetReq, opts ...grpc.CallOption) (*remote.DomainGetReply, error) {
+	resp, err := r.KVClient.DomainGet(ctx, in, opts...)
+	return recordUnary(r, "DomainGet", in, resp, err)
+}
+func (r *RecordingKVClient) HistoryGet(ctx context.Context, in *remote.HistoryGetReq, opts ...grpc.CallOption) (*remote.HistoryGetReply, error) {
+	resp, err := r.KVClient.HistoryGet(ctx, in, opts...)
+	return recordUnary(r, "HistoryGet", in, resp, err)
+}
+func (r *RecordingKVClient) IndexRange(ctx context.Context, in *remote.IndexRangeReq, opts ...grpc.CallOption) (*remote.IndexRangeReply, error) {
+	resp, err := r.KVClient.IndexRange(ctx, in, opts...)
+	return recordUnary(r, "IndexRange", in, resp, err)
+}
+func (r *RecordingKVClient) Range(ctx context.Context, in *remote.RangeReq, opts ...grpc.CallOption) (*remote.Pairs, error) {
+	resp, err := r.KVClient.Range(ctx, in, opts...)
+	return recordUnary(r, "Range", in, resp, err)
+}
+
+func (r *RecordingKVClient) Tx(ctx context.Context, opts ...grpc.CallOption) (remote.KV_TxClient, error) {
+	stream, err := r.KVClient.Tx(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	id := r.streams
+	r.streams++
+	r.lock.Unlock()
+	return &recordingTxStream{KV_TxClient: stream, r: r, id: id}, nil
+}
+
+// recordingTxStream - every Recv is recorded together with preceding Send (first Recv of stream has no request)
+type recordingTxStream struct {
+	remote.KV_TxClient
+	r       *RecordingKVClient
+	id      int
+	pending []byte
+}
+
+func (s *recordingTxStream) Send(c *remote.Cursor) error {
+	var err error
+	if s.pending, err = marshalOpts.Marshal(c); err != nil {
+		return err
+	}
+	return s.KV_TxClient.Send(c)
+}
+
+func (s *recordingTxStream) Recv() (*remote.Pair, error) {
+	pair, err := s.KV_TxClient.Recv()
+	if err != nil && grpcutil.IsEndOfStream(err) {
+		return pair, err // replay ends stream when records are over
+	}
+	rec := captureRecord{Method: txMethod, Stream: s.id, Req: s.pending}
+	s.pending = nil
+	if err != nil {
+		rec.Err = err.Error()
+	} else {
+		var mErr error
+		if rec.Resp, mErr = marshalOpts.Marshal(pair); mErr != nil {
+			return nil, mErr
+		}
+	}
+	s.r.write(rec)
+	return pair, err
+}
+
+// ReplayKVClient - remote.KVClient which serves responses from capture written by RecordingKVClient.
+// Request which was not recorded returns error. StateChanges is not supported.
+type ReplayKVClient struct {
+	lock    sync.Mutex
+	unary   map[string][]captureRecord // method+request -> responses in order of recording
+	streams [][]captureRecord
+	opened  int
+}
+
+func NewReplayKVClient(r io.Reader) (*ReplayKVClient, error) {
+	c := &ReplayKVClient{unary: map[string][]captureRecord{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("replay: %w", err)
+		}
+		if rec.Stream < 0 {
+			key := rec.Method + string(rec.Req)
+			c.unary[key] = append(c.unary[key], rec)
+			continue
+		}
+		for len(c.streams) <= rec.Stream {
+			c.streams = append(c.streams, nil)
+		}
+		c.streams[rec.Stream] = append(c.streams[rec.Stream], rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	return c, nil
+}
+
+// OpenReplay - read-only db served from capture file, see RecordingKVClient
+func OpenReplay(path string, v gointerfaces.Version, logger log.Logger) (*RemoteKV, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	client, err := NewReplayKVClient(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewRemote(v, logger, client).Open()
+}
+
+func replayUnary[Req, Resp proto.Message](c *ReplayKVClient, method string, req Req, resp Resp) (Resp, error) {
+	reqBytes, err := marshalOpts.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	key := method + string(reqBytes)
+	c.lock.Lock()
+	recs := c.unary[key]
+	if len(recs) > 1 { // last response is repeated
+		c.unary[key] = recs[1:]
+	}
+	c.lock.Unlock()
+	if len(recs) == 0 {
+		return resp, fmt.Errorf("replay: %s request was not recorded: %v", method, req)
+	}
+	if recs[0].Err != "" {
+		return resp, errors.New(recs[0].Err)
+	}
+	if err = proto.Unmarshal(recs[0].Resp, resp); err != nil {
+		return resp, fmt.Errorf("replay: %s: %w", method, err)
+	}
+	return resp, nil
+}
+
+func (c *ReplayKVClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*types.VersionReply, error) {
+	return replayUnary(c, "Version", in, &types.VersionReply{})
+}
+func (c *ReplayKVClient) Snapshots(ctx context.Context, in *remote.SnapshotsRequest, opts ...grpc.CallOption) (*remote.SnapshotsReply, error) {
+	return replayUnary(c, "Snapshots", in, &remote.SnapshotsReply{})
+}
+func (c *ReplayKVClient) DomainGet(ctx context.Context, in *remote.DomainGetReq, opts ...grpc.CallOption) (*remote.DomainGetReply, error) {
+	return replayUnary(c, "DomainGet", in, &remote.DomainGetReply{})
+}
+func (c *ReplayKVClient) HistoryGet(ctx context.Context, in *remote.HistoryGetReq, opts ...grpc.CallOption) (*remote.HistoryGetReply, error) {
+	return replayUnary(c, "HistoryGet", in, &remote.HistoryGetReply{})
+}
+func (c *ReplayKVClient) IndexRange(ctx context.Context, in *remote.IndexRangeReq, opts ...grpc.CallOption) (*remote.IndexRangeReply, error) {
+	return replayUnary(c, "IndexRange", in, &remote.IndexRangeReply{})
+}
+func (c *ReplayKVClient) Range(ctx context.Context, in *remote.RangeReq, opts ...grpc.CallOption) (*remote.Pairs, error) {
+	return replayUnary(c, "Range", in, &remote.Pairs{})
+}
+func (c *ReplayKVClient) StateChanges(ctx context.Context, in *remote.StateChangeRequest, opts ...grpc.CallOption) (remote.KV_StateChangesClient, error) {
+	return nil, fmt.Errorf("replay: StateChanges is not supported")
+}
+
+func (c *ReplayKVClient) Tx(ctx context.Context, opts ...grpc.CallOption) (remote.KV_TxClient, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.opened >= len(c.streams) {
+		return nil, fmt.Errorf("replay: only %d Tx streams were recorded", len(c.streams))
+	}
+	s := &replayTxStream{ctx: ctx, id: c.opened, recs: c.streams[c.opened]}
+	c.opened++
+	return s, nil
+}
+
+type replayTxStream struct {
+	ctx     context.Context
+	id      int
+	recs    []captureRecord
+	i       int
+	pending []byte
+}
+
+func (s *replayTxStream) Send(cursor *remote.Cursor) (err error) {
+	s.pending, err = marshalOpts.Marshal(cursor)
+	return err
+}
+
+func (s *replayTxStream) Recv() (*remote.Pair, error) {
+	if s.i >= len(s.recs) {
+		return nil, io.EOF
+	}
+	rec := s.recs[s.i]
+	if string(rec.Req) != string(s.pending) {
+		return nil, fmt.Errorf("replay: Tx stream %d, message %d: request differs from recorded", s.id, s.i)
+	}
+	s.i++
+	s.pending = nil
+	if rec.Err != "" {
+		return nil, errors.New(rec.Err)
+	}
+	pair := &remote.Pair{}
+	if err := proto.Unmarshal(rec.Resp, pair); err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	return pair, nil
+}
+
+func (s *replayTxStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *replayTxStream) Trailer() metadata.MD         { return nil }
+func (s *replayTxStream) CloseSend() error             { return nil }
+func (s *replayTxStream) Context() context.Context     { return s.ctx }
+func (s *replayTxStream) SendMsg(m interface{}) error  { return s.Send(m.(*remote.Cursor)) }
+func (s *replayTxStream) RecvMsg(m interface{}) error {
+	pair, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(*remote.Pair), pair)
+	return nil
+}
@@ -64,7 +64,8 @@ const MaxTxTTL = 60 * time.Second
 // 6.0.0 - Blocks now have system-txs - in the begin/end of block
 // 6.1.0 - Add methods Range, IndexRange, HistoryGet, HistoryRange
 // 6.2.0 - Add HistoryFiles to reply of Snapshots() method
-var KvServiceAPIVersion = &types.VersionReply{Major: 6, Minor: 2, Patch: 0}
+// 6.3.0 - Add TemporalKV service of remotedbserver (not in kv.proto) with HistoryRange method, IndexRange respects page size
+var KvServiceAPIVersion = &types.VersionReply{Major: 6, Minor: 3, Patch: 0}
 
 type KvServer struct {
 	remote.UnimplementedKVServer // must be embedded to have forward compatible implementations.
@@ -578,6 +579,9 @@ const PageSizeLimit = 4 * 4096
 func (s *KvServer) IndexRange(ctx context.Context, req *remote.IndexRangeReq) (*remote.IndexRangeReply, error) {
 	reply := &remote.IndexRangeReply{}
 	from, limit := int(req.FromTs), int(req.Limit)
+	if limit <= 0 {
+		limit = -1
+	}
 	if req.PageToken != "" {
 		var pagination remote.IndexPagination
 		if err := unmarshalPagination(req.PageToken, &pagination); err != nil {
@@ -598,7 +602,7 @@ func (s *KvServer) IndexRange(ctx context.Context, req *remote.IndexRangeReq) (*
 		if err != nil {
 			return err
 		}
-		for it.HasNext() {
+		for it.HasNext() && len(reply.Timestamps) < int(req.PageSize) {
 			v, err := it.Next()
 			if err != nil {
 				return err
@@ -606,7 +610,7 @@ func (s *KvServer) IndexRange(ctx context.Context, req *remote.IndexRangeReq) (*
 			reply.Timestamps = append(reply.Timestamps, v)
 			limit--
 		}
-		if len(reply.Timestamps) == PageSizeLimit && it.HasNext() {
+		if len(reply.Timestamps) == int(req.PageSize) && it.HasNext() {
 			next, err := it.Next()
 			if err != nil {
 				return err
@@ -623,6 +627,68 @@ func (s *KvServer) IndexRange(ctx context.Context, req *remote.IndexRangeReq) (*
 	return reply, nil
 }
 
+// historyRangeTx - temporal tx which can continue HistoryRange from given key, see temporal.Tx
+type historyRangeTx interface {
+	HistoryRangeFrom(name kv.History, fromTs, toTs int, fromKey []byte, asc order.By, limit int) (iter.KV, error)
+}
+
+// HistoryRange - method of TemporalKV service: keys changed in [FromTs, ToTs) with values before change,
+// paginated by key. Register by RegisterTemporalKVServer.
+func (s *KvServer) HistoryRange(ctx context.Context, req *remote.IndexRangeReq) (*remote.Pairs, error) {
+	if !req.OrderAscend {
+		return nil, fmt.Errorf("HistoryRange: %w: descending order", kv.ErrNotSupported)
+	}
+	from, limit := req.K, int(req.Limit)
+	if limit <= 0 {
+		limit = -1
+	}
+	if req.PageToken != "" {
+		var pagination remote.ParisPagination
+		if err := unmarshalPagination(req.PageToken, &pagination); err != nil {
+			return nil, err
+		}
+		from, limit = pagination.NextKey, int(pagination.Limit)
+	}
+	if req.PageSize <= 0 || req.PageSize > PageSizeLimit {
+		req.PageSize = PageSizeLimit
+	}
+
+	reply := &remote.Pairs{}
+	if err := s.with(req.TxId, func(tx kv.Tx) error {
+		htx, ok := tx.(historyRangeTx)
+		if !ok {
+			return fmt.Errorf("server DB doesn't implement kv.Temporal interface")
+		}
+		it, err := htx.HistoryRangeFrom(kv.History(req.Table), int(req.FromTs), int(req.ToTs), from, order.Asc, -1)
+		if err != nil {
+			return err
+		}
+		for it.HasNext() && limit != 0 && len(reply.Keys) < int(req.PageSize) {
+			k, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			reply.Keys = append(reply.Keys, bytesCopy(k))
+			reply.Values = append(reply.Values, bytesCopy(v))
+			limit--
+		}
+		if limit != 0 && len(reply.Keys) == int(req.PageSize) && it.HasNext() {
+			nextK, _, err := it.Next()
+			if err != nil {
+				return err
+			}
+			reply.NextPageToken, err = marshalPagination(&remote.ParisPagination{NextKey: nextK, Limit: int64(limit)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 /*
 func (s *KvServer) Stream(req *remote.RangeReq, stream remote.KV_StreamServer) error {
 	orderAscend, fromPrefix, toPrefix := req.OrderAscend, req.FromPrefix, req.ToPrefix
@@ -737,16 +803,19 @@ func (s *KvServer) Range(ctx context.Context, req *remote.RangeReq) (*remote.Pai
 				return err
 			}
 		}
-		for it.HasNext() {
+		for it.HasNext() && limit != 0 && len(reply.Keys) < int(req.PageSize) {
 			k, v, err := it.Next()
 			if err != nil {
 				return err
 			}
-			reply.Keys = append(reply.Keys, k)
-			reply.Values = append(reply.Values, v)
-			limit--
+			reply.Keys = append(reply.Keys, bytesCopy(k))
+			reply.Values = append(reply.Values, bytesCopy(v))
+			if limit > 0 {
+				limit--
+			}
 		}
-		if len(reply.Keys) == PageSizeLimit && it.HasNext() {
+		// token is position of next key, not of tx: it's valid also for Range of another tx
+		if limit != 0 && len(reply.Keys) == int(req.PageSize) && it.HasNext() {
 			nextK, _, err := it.Next()
 			if err != nil {
 				return err
@@ -0,0 +1,91 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remotedbserver
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"google.golang.org/grpc"
+)
+
+// TemporalKV - gRPC service with temporal methods which are not in KV service of remote/kv.proto yet.
+// It's private protocol of KvServer and remotedb: not generated, not part of gointerfaces.
+// Remove it when HistoryRange (with own request message) is added to kv.proto.
+//
+// HistoryRange - keys of history `Table` changed in [FromTs, ToTs) with their values before change. Only ascending
+// order. Request re-uses remote.IndexRangeReq: K - first key (nil - from start of history).
+// NextPageToken of reply - marshaled remote.ParisPagination.
+type TemporalKVClient interface {
+	HistoryRange(ctx context.Context, in *remote.IndexRangeReq, opts ...grpc.CallOption) (*remote.Pairs, error)
+}
+
+type temporalKVClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTemporalKVClient(cc grpc.ClientConnInterface) TemporalKVClient {
+	return &temporalKVClient{cc}
+}
+
+func (c *temporalKVClient) HistoryRange(ctx context.Context, in *remote.IndexRangeReq, opts ...grpc.CallOption) (*remote.Pairs, error) {
+	out := new(remote.Pairs)
+	if err := c.cc.Invoke(ctx, "/remotedbserver.TemporalKV/HistoryRange", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type temporalKVServer interface {
+	HistoryRange(context.Context, *remote.IndexRangeReq) (*remote.Pairs, error)
+}
+
+// RegisterTemporalKVServer - serves TemporalKV service by KvServer, usually on same server as remote.KV
+func RegisterTemporalKVServer(s grpc.ServiceRegistrar, srv *KvServer) {
+	s.RegisterService(&temporalKVServiceDesc, srv)
+}
+
+func temporalKVHistoryRangeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(remote.IndexRangeReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(temporalKVServer).HistoryRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/remotedbserver.TemporalKV/HistoryRange",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(temporalKVServer).HistoryRange(ctx, req.(*remote.IndexRangeReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var temporalKVServiceDesc = grpc.ServiceDesc{
+	ServiceName: "remotedbserver.TemporalKV",
+	HandlerType: (*temporalKVServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "HistoryRange",
+			Handler:    temporalKVHistoryRangeHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "kv/remotedbserver/temporal_grpc.go",
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ringbuf
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// RingBuffer - bounded append-only log (circular buffer) on top of non-dupsort kv table.
+// Can be used for event journals and diagnostics: writers only Append, oldest entries are trimmed
+// in the same RwTx when MaxEntries or MaxBytes limit is exceeded.
+//
+// Table layout:
+//   - key 0: metadata [head 8][nextSeq 8][totalBytes 8]
+//   - keys 1..: BigEndian(seq) -> entry. Entries are never updated, keys are contiguous: [head, nextSeq)
+//
+// Table must be used only by one RingBuffer.
+type RingBuffer struct {
+	table      string
+	maxEntries uint64 // 0 - unlimited
+	maxBytes   uint64 // 0 - unlimited. sum of sizes of entries
+}
+
+var metaKey = make([]byte, 8)
+
+func New(table string, maxEntries, maxBytes uint64) *RingBuffer {
+	return &RingBuffer{table: table, maxEntries: maxEntries, maxBytes: maxBytes}
+}
+
+type meta struct {
+	head, nextSeq uint64
+	totalBytes    uint64
+}
+
+func (m meta) entries() uint64 { return m.nextSeq - m.head }
+
+func (r *RingBuffer) readMeta(tx kv.Getter) (m meta, err error) {
+	v, err := tx.GetOne(r.table, metaKey)
+	if err != nil {
+		return m, err
+	}
+	if len(v) == 0 {
+		return meta{head: 1, nextSeq: 1}, nil
+	}
+	if len(v) != 24 {
+		return m, fmt.Errorf("ringbuf %s: invalid metadata len %d", r.table, len(v))
+	}
+	return meta{head: binary.BigEndian.Uint64(v), nextSeq: binary.BigEndian.Uint64(v[8:]), totalBytes: binary.BigEndian.Uint64(v[16:])}, nil
+}
+
+func (r *RingBuffer) writeMeta(tx kv.RwTx, m meta) error {
+	var v [24]byte
+	binary.BigEndian.PutUint64(v[:], m.head)
+	binary.BigEndian.PutUint64(v[8:], m.nextSeq)
+	binary.BigEndian.PutUint64(v[16:], m.totalBytes)
+	return tx.Put(r.table, metaKey, v[:])
+}
+
+func (r *RingBuffer) overflow(m meta) bool {
+	return (r.maxBytes > 0 && m.totalBytes > r.maxBytes) || (r.maxEntries > 0 && m.entries() > r.maxEntries)
+}
+
+// Append - adds entry to the end of buffer and trims head of buffer if limits are exceeded.
+// Last appended entry is never trimmed, even if it's bigger than MaxBytes.
+func (r *RingBuffer) Append(tx kv.RwTx, entry []byte) (seq uint64, err error) {
+	m, err := r.readMeta(tx)
+	if err != nil {
+		return 0, err
+	}
+	seq = m.nextSeq
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], seq)
+	if err = tx.Append(r.table, k[:], entry); err != nil {
+		return 0, fmt.Errorf("ringbuf %s: append %d: %w", r.table, seq, err)
+	}
+	m.nextSeq++
+	m.totalBytes += uint64(len(entry))
+	if r.overflow(m) {
+		if m, err = r.trim(tx, m); err != nil {
+			return 0, err
+		}
+	}
+	if err = r.writeMeta(tx, m); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (r *RingBuffer) trim(tx kv.RwTx, m meta) (meta, error) {
+	c, err := tx.RwCursor(r.table)
+	if err != nil {
+		return m, err
+	}
+	defer c.Close()
+	var from [8]byte
+	binary.BigEndian.PutUint64(from[:], m.head)
+	for k, v, err := c.Seek(from[:]); k != nil && r.overflow(m) && m.entries() > 1; k, v, err = c.Next() {
+		if err != nil {
+			return m, err
+		}
+		seq, size := binary.BigEndian.Uint64(k), uint64(len(v)) // k, v are not valid after delete
+		if err = c.DeleteCurrent(); err != nil {
+			return m, err
+		}
+		m.head = seq + 1
+		m.totalBytes -= size
+	}
+	return m, nil
+}
+
+// Stats - amount of entries and their total size
+func (r *RingBuffer) Stats(tx kv.Tx) (entries, totalBytes uint64, err error) {
+	m, err := r.readMeta(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return m.entries(), m.totalBytes, nil
+}
+
+// Walk - entries with seq >= fromSeq from oldest to newest. `v` is valid only during `walker` call.
+func (r *RingBuffer) Walk(tx kv.Tx, fromSeq uint64, walker func(seq uint64, v []byte) (bool, error)) error {
+	if fromSeq == 0 {
+		fromSeq = 1
+	}
+	c, err := tx.Cursor(r.table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var from [8]byte
+	binary.BigEndian.PutUint64(from[:], fromSeq)
+	for k, v, err := c.Seek(from[:]); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		ok, err := walker(binary.BigEndian.Uint64(k), v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+	}
+	return nil
+}
+
+// Clear - removes all entries. Sequence numbers are not reset.
+func (r *RingBuffer) Clear(tx kv.RwTx) error {
+	m, err := r.readMeta(tx)
+	if err != nil {
+		return err
+	}
+	m.totalBytes, m.head = 0, m.nextSeq
+	c, err := tx.RwCursor(r.table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var from [8]byte
+	binary.BigEndian.PutUint64(from[:], 1)
+	for k, _, err := c.Seek(from[:]); k != nil; k, _, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err = c.DeleteCurrent(); err != nil {
+			return err
+		}
+	}
+	return r.writeMeta(tx, m)
+}
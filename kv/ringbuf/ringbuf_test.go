@@ -0,0 +1,110 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ringbuf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+const testTable = "RingBuffer"
+
+func testTx(t *testing.T) kv.RwTx {
+	t.Helper()
+	db := mdbx.NewMDBX(log.New()).InMem(t.TempDir()).WithTableCfg(func(kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{testTable: kv.TableCfgItem{}}
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(tx.Rollback)
+	return tx
+}
+
+func entries(t *testing.T, tx kv.Tx, r *RingBuffer, fromSeq uint64) (seqs []uint64, vals []string) {
+	t.Helper()
+	require.NoError(t, r.Walk(tx, fromSeq, func(seq uint64, v []byte) (bool, error) {
+		seqs = append(seqs, seq)
+		vals = append(vals, string(v))
+		return true, nil
+	}))
+	return seqs, vals
+}
+
+func TestRingBufferMaxEntries(t *testing.T) {
+	tx := testTx(t)
+	r := New(testTable, 3, 0)
+	for i := 0; i < 5; i++ {
+		seq, err := r.Append(tx, []byte(fmt.Sprintf("e%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), seq)
+	}
+	seqs, vals := entries(t, tx, r, 0)
+	require.Equal(t, []uint64{3, 4, 5}, seqs)
+	require.Equal(t, []string{"e2", "e3", "e4"}, vals)
+	n, size, err := r.Stats(tx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n)
+	require.Equal(t, uint64(6), size)
+
+	seqs, _ = entries(t, tx, r, 5)
+	require.Equal(t, []uint64{5}, seqs)
+
+	require.NoError(t, r.Clear(tx))
+	seqs, _ = entries(t, tx, r, 0)
+	require.Empty(t, seqs)
+	seq, err := r.Append(tx, []byte("after clear"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), seq)
+	n, size, err = r.Stats(tx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	require.Equal(t, uint64(len("after clear")), size)
+}
+
+func TestRingBufferMaxBytes(t *testing.T) {
+	tx := testTx(t)
+	r := New(testTable, 0, 10)
+	for _, e := range []string{"aaaa", "bbbb", "cc"} {
+		_, err := r.Append(tx, []byte(e))
+		require.NoError(t, err)
+	}
+	_, vals := entries(t, tx, r, 0)
+	require.Equal(t, []string{"aaaa", "bbbb", "cc"}, vals)
+
+	_, err := r.Append(tx, []byte("ddd"))
+	require.NoError(t, err)
+	_, vals = entries(t, tx, r, 0)
+	require.Equal(t, []string{"bbbb", "cc", "ddd"}, vals)
+
+	// entry bigger than limit: keep only it
+	_, err = r.Append(tx, []byte("eeeeeeeeeeeeeeee"))
+	require.NoError(t, err)
+	seqs, vals := entries(t, tx, r, 0)
+	require.Equal(t, []uint64{5}, seqs)
+	require.Equal(t, []string{"eeeeeeeeeeeeeeee"}, vals)
+	n, size, err := r.Stats(tx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	require.Equal(t, uint64(16), size)
+}
@@ -346,6 +346,9 @@ const (
 
 	Sequence = "Sequence" // tbl_name -> seq_u64
 
+	// TTLIndex - expiry_u64 + tbl_name_len_u8 + tbl_name + key -> nil: expiry of entries of tables with TTL, see kvttl
+	TTLIndex = "TTLIndex"
+
 	Epoch        = "DevEpoch"        // block_num_u64+block_hash->transition_proof
 	PendingEpoch = "DevPendingEpoch" // block_num_u64+block_hash->transition_proof
 
@@ -516,6 +519,7 @@ var ChaindataTables = []string{
 	CumulativeTransactionIndex,
 	Log,
 	Sequence,
+	TTLIndex,
 	EthTx,
 	EthTxV3,
 	NonCanonicalTxs,
@@ -606,8 +610,11 @@ var TxPoolTables = []string{
 	RecentLocalTransaction,
 	PoolTransaction,
 	PoolInfo,
+	TTLIndex,
+}
+var SentryTables = []string{
+	TTLIndex,
 }
-var SentryTables = []string{}
 var DownloaderTables = []string{
 	BittorrentCompletion,
 	BittorrentInfo,
@@ -659,8 +666,21 @@ type TableCfgItem struct {
 	// Works only if AutoDupSortKeysConversion enabled
 	DupFromLen int
 	DupToLen   int
+	// Access - hint of access pattern, see TableAccess
+	Access TableAccess
 }
 
+// TableAccess - hint how table is read: translated by db to read-ahead of env and to page-cache hints of cursors
+type TableAccess uint8
+
+const (
+	AccessPointReads TableAccess = iota // default: random point reads of hot state - no read-ahead
+	// AccessScans - table is mostly read by long range scans (history, changesets): cursors of read-only transactions
+	// prefault pages ahead of scan and mark scanned pages as first candidates for eviction from page cache,
+	// to not push out pages of point reads
+	AccessScans
+)
+
 var ChaindataTablesCfg = TableCfg{
 	HashedStorage: {
 		Flags:                     DupSort,
@@ -668,8 +688,8 @@ var ChaindataTablesCfg = TableCfg{
 		DupFromLen:                72,
 		DupToLen:                  40,
 	},
-	AccountChangeSet: {Flags: DupSort},
-	StorageChangeSet: {Flags: DupSort},
+	AccountChangeSet: {Flags: DupSort, Access: AccessScans},
+	StorageChangeSet: {Flags: DupSort, Access: AccessScans},
 	PlainState: {
 		Flags:                     DupSort,
 		AutoDupSortKeysConversion: true,
@@ -679,24 +699,24 @@ var ChaindataTablesCfg = TableCfg{
 	CallTraceSet: {Flags: DupSort},
 
 	AccountKeys:           {Flags: DupSort},
-	AccountHistoryKeys:    {Flags: DupSort},
+	AccountHistoryKeys:    {Flags: DupSort, Access: AccessScans},
 	AccountIdx:            {Flags: DupSort},
 	StorageKeys:           {Flags: DupSort},
-	StorageHistoryKeys:    {Flags: DupSort},
+	StorageHistoryKeys:    {Flags: DupSort, Access: AccessScans},
 	StorageIdx:            {Flags: DupSort},
 	CodeKeys:              {Flags: DupSort},
-	CodeHistoryKeys:       {Flags: DupSort},
+	CodeHistoryKeys:       {Flags: DupSort, Access: AccessScans},
 	CodeIdx:               {Flags: DupSort},
 	CommitmentKeys:        {Flags: DupSort},
-	CommitmentHistoryKeys: {Flags: DupSort},
+	CommitmentHistoryKeys: {Flags: DupSort, Access: AccessScans},
 	CommitmentIdx:         {Flags: DupSort},
-	LogAddressKeys:        {Flags: DupSort},
+	LogAddressKeys:        {Flags: DupSort, Access: AccessScans},
 	LogAddressIdx:         {Flags: DupSort},
-	LogTopicsKeys:         {Flags: DupSort},
+	LogTopicsKeys:         {Flags: DupSort, Access: AccessScans},
 	LogTopicsIdx:          {Flags: DupSort},
-	TracesFromKeys:        {Flags: DupSort},
+	TracesFromKeys:        {Flags: DupSort, Access: AccessScans},
 	TracesFromIdx:         {Flags: DupSort},
-	TracesToKeys:          {Flags: DupSort},
+	TracesToKeys:          {Flags: DupSort, Access: AccessScans},
 	TracesToIdx:           {Flags: DupSort},
 	RAccountKeys:          {Flags: DupSort},
 	RAccountIdx:           {Flags: DupSort},
@@ -704,6 +724,11 @@ var ChaindataTablesCfg = TableCfg{
 	RStorageIdx:           {Flags: DupSort},
 	RCodeKeys:             {Flags: DupSort},
 	RCodeIdx:              {Flags: DupSort},
+
+	AccountHistoryVals:    {Access: AccessScans},
+	StorageHistoryVals:    {Access: AccessScans},
+	CodeHistoryVals:       {Access: AccessScans},
+	CommitmentHistoryVals: {Access: AccessScans},
 }
 
 var TxpoolTablesCfg = TableCfg{}
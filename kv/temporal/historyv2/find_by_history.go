@@ -54,7 +54,7 @@ func FindByHistory(indexC kv.Cursor, changesC kv.CursorDupSort, storage bool, ke
 		}
 	}
 	index := roaring64.New()
-	if _, err := index.ReadFrom(bytes.NewReader(v)); err != nil {
+	if err := bitmapdb.DecodeChunk64(v, index); err != nil {
 		return nil, false, err
 	}
 	found, ok := bitmapdb.SeekInBitmap64(index, timestamp)
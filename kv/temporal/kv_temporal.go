@@ -0,0 +1,273 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package temporal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+// DB - implements kv.TemporalRwDB on top of any kv.RwDB (usually mdbx) and state.AggregatorV3:
+//   - history and inverted indices are read from AggregatorV3 (files + recent data in DB)
+//   - latest values of domains are read by LatestStateReader - because layout of latest state is defined by application
+//
+// Example:
+//
+//	db := temporal.New(chainDB, agg, myLatestStateReader)
+//	tx, err := db.BeginTemporalRo(ctx)
+//	v, ok, err := tx.DomainGet(temporal.AccountsDomain, addr, nil, txNum)
+
+const (
+	AccountsDomain = kv.AccountsDomain
+	StorageDomain  = kv.StorageDomain
+	CodeDomain     = kv.CodeDomain
+)
+
+const (
+	AccountsHistory kv.History = "AccountsHistory"
+	StorageHistory  kv.History = "StorageHistory"
+	CodeHistory     kv.History = "CodeHistory"
+)
+
+const (
+	AccountsHistoryIdx kv.InvertedIdx = "AccountsHistoryIdx"
+	StorageHistoryIdx  kv.InvertedIdx = "StorageHistoryIdx"
+	CodeHistoryIdx     kv.InvertedIdx = "CodeHistoryIdx"
+
+	LogTopicIdx   kv.InvertedIdx = "LogTopicIdx"
+	LogAddrIdx    kv.InvertedIdx = "LogAddrIdx"
+	TracesFromIdx kv.InvertedIdx = "TracesFromIdx"
+	TracesToIdx   kv.InvertedIdx = "TracesToIdx"
+)
+
+type DB struct {
+	kv.RwDB
+	agg    *state.AggregatorV3
+	latest state.LatestStateReader
+}
+
+// New - `latest` can be nil, then DomainGet returns kv.ErrNotSupported if value wasn't changed after `ts`.
+// For storage domain `latest` receives address+location as key.
+func New(db kv.RwDB, agg *state.AggregatorV3, latest state.LatestStateReader) *DB {
+	return &DB{RwDB: db, agg: agg, latest: latest}
+}
+
+func (db *DB) Agg() *state.AggregatorV3 { return db.agg }
+
+func (db *DB) BeginTemporalRo(ctx context.Context) (kv.TemporalTx, error) {
+	kvTx, err := db.RwDB.BeginRo(ctx) //nolint:gocritic
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: kvTx, db: db, agg: db.agg.GetContext()}, nil
+}
+
+func (db *DB) ViewTemporal(ctx context.Context, f func(tx kv.TemporalTx) error) error {
+	tx, err := db.BeginTemporalRo(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return f(tx)
+}
+
+// BeginRo - returns kv.TemporalTx, so callers can type-assert
+func (db *DB) BeginRo(ctx context.Context) (kv.Tx, error) {
+	return db.BeginTemporalRo(ctx)
+}
+
+func (db *DB) View(ctx context.Context, f func(tx kv.Tx) error) error {
+	tx, err := db.BeginTemporalRo(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return f(tx)
+}
+
+type Tx struct {
+	kv.Tx
+	db  *DB
+	agg *state.AggregatorV3Context
+
+	resourcesToClose []kv.Closer
+}
+
+func (tx *Tx) AggCtx() *state.AggregatorV3Context { return tx.agg }
+
+func (tx *Tx) Rollback() {
+	tx.close()
+	tx.Tx.Rollback()
+}
+
+// Commit - releases resources of Tx (as Rollback does), read-only transactions usually commit to finish read
+func (tx *Tx) Commit() error {
+	tx.close()
+	return tx.Tx.Commit()
+}
+
+func (tx *Tx) close() {
+	for _, closer := range tx.resourcesToClose {
+		closer.Close()
+	}
+	tx.resourcesToClose = nil
+	if tx.agg != nil {
+		tx.db.agg.PutContext(tx.agg)
+		tx.agg = nil
+	}
+}
+
+// DomainGet - value of key as of `ts` (before applying changes of txNum=ts).
+// Resolves by history (frozen files and recent DB) first, if value didn't change after `ts` - reads latest state.
+func (tx *Tx) DomainGet(name kv.Domain, k, k2 []byte, ts uint64) (v []byte, ok bool, err error) {
+	switch name {
+	case AccountsDomain:
+		v, ok, err = tx.HistoryGet(AccountsHistory, k, ts)
+	case StorageDomain:
+		v, ok, err = tx.agg.ReadAccountStorageNoStateWithRecent(k, k2, ts, tx.Tx)
+	case CodeDomain:
+		v, ok, err = tx.HistoryGet(CodeHistory, k, ts)
+	default:
+		return nil, false, fmt.Errorf("unexpected domain: %s", name)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		return v, len(v) > 0, nil // empty value in history means: key didn't exist at `ts`
+	}
+	if tx.db.latest == nil {
+		return nil, false, fmt.Errorf("%w: DomainGet(%s) of latest state without LatestStateReader", kv.ErrNotSupported, name)
+	}
+	if len(k2) > 0 {
+		k = append(append(make([]byte, 0, len(k)+len(k2)), k...), k2...)
+	}
+	return tx.db.latest(tx.Tx, name, k)
+}
+
+// HistoryGet - `ok=false` means value wasn't changed after `ts` (then it's equal to latest value)
+func (tx *Tx) HistoryGet(name kv.History, k []byte, ts uint64) (v []byte, ok bool, err error) {
+	switch name {
+	case AccountsHistory:
+		return tx.agg.ReadAccountDataNoStateWithRecent(k, ts, tx.Tx)
+	case StorageHistory:
+		return tx.agg.ReadAccountStorageNoStateWithRecent2(k, ts, tx.Tx)
+	case CodeHistory:
+		return tx.agg.ReadAccountCodeNoStateWithRecent(k, ts, tx.Tx)
+	default:
+		return nil, false, fmt.Errorf("unexpected history name: %s", name)
+	}
+}
+
+func (tx *Tx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int) (timestamps iter.U64, err error) {
+	var it *state.InvertedIterator
+	switch name {
+	case AccountsHistoryIdx:
+		it, err = tx.agg.AccountHistoyIdxIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case StorageHistoryIdx:
+		it, err = tx.agg.StorageHistoyIdxIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case CodeHistoryIdx:
+		it, err = tx.agg.CodeHistoyIdxIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case LogTopicIdx:
+		it, err = tx.agg.LogTopicIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case LogAddrIdx:
+		it, err = tx.agg.LogAddrIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case TracesFromIdx:
+		it, err = tx.agg.TraceFromIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	case TracesToIdx:
+		it, err = tx.agg.TraceToIterator(k, fromTs, toTs, asc, limit, tx.Tx)
+	default:
+		return nil, fmt.Errorf("unexpected inverted index name: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, it)
+	return it, nil
+}
+
+// HistoryRange - keys changed in [fromTs, toTs) with their values before change
+func (tx *Tx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int) (it iter.KV, err error) {
+	return tx.HistoryRangeFrom(name, fromTs, toTs, nil, asc, limit)
+}
+
+// HistoryRangeFrom - same as HistoryRange, but starts from key `fromKey` (nil - from first key): continuation of
+// iteration, for example next page of remote HistoryRange. Only ascending order without limit is supported.
+func (tx *Tx) HistoryRangeFrom(name kv.History, fromTs, toTs int, fromKey []byte, asc order.By, limit int) (it iter.KV, err error) {
+	if asc == order.Desc || limit >= 0 {
+		return nil, fmt.Errorf("%w: HistoryRange(%s) with asc=%t, limit=%d", kv.ErrNotSupported, name, bool(asc), limit)
+	}
+	if fromTs < 0 || toTs < 0 {
+		return nil, fmt.Errorf("%w: HistoryRange(%s) of unbounded range [%d, %d)", kv.ErrNotSupported, name, fromTs, toTs)
+	}
+	var hit *state.HistoryChangesIter
+	switch name {
+	case AccountsHistory:
+		hit = tx.agg.AccountHistoryIterateChanged(fromTs, toTs, fromKey, nil, asc, limit, tx.Tx)
+	case StorageHistory:
+		hit = tx.agg.StorageHistoryIterateChanged(fromTs, toTs, fromKey, nil, asc, limit, tx.Tx)
+	case CodeHistory:
+		hit = tx.agg.CodeHistoryIterateChanged(fromTs, toTs, fromKey, nil, asc, limit, tx.Tx)
+	default:
+		return nil, fmt.Errorf("unexpected history name: %s", name)
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, hit)
+	return hit, nil
+}
+
+// HistoryChanges - changes of keys with `prefix` in [fromTs, toTs) as (key, txNum, value before change) stream,
+// ordered by (key, txNum) or (txNum, key). Merges recent history in DB with frozen files.
+func (tx *Tx) HistoryChanges(name kv.History, fromTs, toTs uint64, prefix []byte, orderBy state.ChangesOrder) (it *state.HistoryChangesStream, err error) {
+	switch name {
+	case AccountsHistory:
+		it, err = tx.agg.AccountHistoryChanges(fromTs, toTs, prefix, orderBy, tx.Tx)
+	case StorageHistory:
+		it, err = tx.agg.StorageHistoryChanges(fromTs, toTs, prefix, orderBy, tx.Tx)
+	case CodeHistory:
+		it, err = tx.agg.CodeHistoryChanges(fromTs, toTs, prefix, orderBy, tx.Tx)
+	default:
+		return nil, fmt.Errorf("unexpected history name: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, it)
+	return it, nil
+}
+
+// DomainRange - keys in [k1, k2) with values as of `asOfTs`. Keys which didn't change after `asOfTs` are not returned:
+// caller must merge result with latest state.
+func (tx *Tx) DomainRange(name kv.Domain, k1, k2 []byte, asOfTs uint64, asc order.By, limit int) (it iter.KV, err error) {
+	var sit *state.StateAsOfIter
+	switch name {
+	case AccountsDomain:
+		sit = tx.agg.AccountHistoricalStateRange(asOfTs, k1, k2, asc, limit, tx.Tx)
+	case StorageDomain:
+		sit = tx.agg.StorageHistoricalStateRange(asOfTs, k1, k2, asc, limit, tx.Tx)
+	case CodeDomain:
+		sit = tx.agg.CodeHistoricalStateRange(asOfTs, k1, k2, asc, limit, tx.Tx)
+	default:
+		return nil, fmt.Errorf("unexpected domain: %s", name)
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, sit)
+	return sit, nil
+}
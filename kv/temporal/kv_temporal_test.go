@@ -0,0 +1,218 @@
+package temporal
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/ledgerwatch/erigon-lib/gointerfaces"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/kv/remotedb"
+	"github.com/ledgerwatch/erigon-lib/kv/remotedbserver"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+func TestTemporalTx(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	dir := t.TempDir()
+	db := mdbx.NewMDBX(log.New()).InMem(filepath.Join(dir, "db")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	defer db.Close()
+	agg, err := state.NewAggregatorV3(ctx, dir, filepath.Join(dir, "tmp"), 16, db)
+	require.NoError(err)
+	defer agg.Close()
+
+	addr := []byte("addr")
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	agg.SetTxNum(10)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v0")))
+	require.NoError(agg.AddLogAddr(addr))
+	agg.SetTxNum(20)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v1")))
+	require.NoError(agg.AddLogAddr(addr))
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	latest := func(tx kv.Tx, name kv.Domain, key []byte) ([]byte, bool, error) {
+		return []byte("v2"), true, nil
+	}
+	tdb := New(db, agg, latest)
+	err = tdb.ViewTemporal(ctx, func(tx kv.TemporalTx) error {
+		for _, tt := range []struct {
+			ts uint64
+			v  string
+		}{{5, "v0"}, {10, "v0"}, {15, "v1"}, {20, "v1"}, {25, "v2"}} {
+			v, ok, err := tx.DomainGet(AccountsDomain, addr, nil, tt.ts)
+			require.NoError(err)
+			require.True(ok)
+			require.Equal(tt.v, string(v), tt.ts)
+		}
+		_, ok, err := tx.HistoryGet(AccountsHistory, addr, 25)
+		require.NoError(err)
+		require.False(ok)
+
+		it, err := tx.IndexRange(LogAddrIdx, addr, -1, -1, order.Asc, -1)
+		require.NoError(err)
+		txNums, err := iter.ToU64Arr(it)
+		require.NoError(err)
+		require.Equal([]uint64{10, 20}, txNums)
+
+		_, err = tx.IndexRange("unknown", addr, -1, -1, order.Asc, -1)
+		require.Error(err)
+
+		changes, err := tx.(*Tx).HistoryChanges(AccountsHistory, 0, 30, addr, state.ChangesByTxNum)
+		require.NoError(err)
+		for _, want := range []string{"v0", "v1"} {
+			require.True(changes.HasNext())
+			k, _, v, err := changes.Next()
+			require.NoError(err)
+			require.Equal(addr, k)
+			require.Equal(want, string(v))
+		}
+		require.False(changes.HasNext())
+
+		_, err = tx.HistoryRange(AccountsHistory, 0, 30, order.Desc, -1)
+		require.ErrorIs(err, kv.ErrNotSupported)
+		_, err = tx.HistoryRange(AccountsHistory, 0, 30, order.Asc, 10)
+		require.ErrorIs(err, kv.ErrNotSupported)
+		_, err = tx.HistoryRange(AccountsHistory, -1, 30, order.Asc, -1)
+		require.ErrorIs(err, kv.ErrNotSupported)
+		return nil
+	})
+	require.NoError(err)
+
+	// Commit releases context of aggregator as Rollback does
+	ttx, err := tdb.BeginTemporalRo(ctx)
+	require.NoError(err)
+	require.NotNil(ttx.(*Tx).AggCtx())
+	require.NoError(ttx.Commit())
+	require.Nil(ttx.(*Tx).AggCtx())
+
+	err = New(db, agg, nil).ViewTemporal(ctx, func(tx kv.TemporalTx) error {
+		_, _, err := tx.DomainGet(AccountsDomain, addr, nil, 25)
+		require.ErrorIs(err, kv.ErrNotSupported)
+		return nil
+	})
+	require.NoError(err)
+
+	// storage key of latest state is address+location
+	keyAsValue := func(tx kv.Tx, name kv.Domain, key []byte) ([]byte, bool, error) { return key, true, nil }
+	err = New(db, agg, keyAsValue).ViewTemporal(ctx, func(tx kv.TemporalTx) error {
+		v, ok, err := tx.DomainGet(StorageDomain, addr, []byte("loc"), 25)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal("addrloc", string(v))
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestRemoteTemporalTx(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	dir := t.TempDir()
+	db := mdbx.NewMDBX(log.New()).InMem(filepath.Join(dir, "db")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	defer db.Close()
+	agg, err := state.NewAggregatorV3(ctx, dir, filepath.Join(dir, "tmp"), 16, db)
+	require.NoError(err)
+	defer agg.Close()
+
+	const n = remotedbserver.PageSizeLimit + 100 // more than 1 page
+	addr := []byte("addr")
+	key := func(i uint64) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, i)
+		return k
+	}
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	agg.SetTxNum(1)
+	for i := uint64(0); i < n; i++ {
+		require.NoError(agg.AddAccountPrev(key(i), []byte("v0")))
+	}
+	for txNum := uint64(1); txNum <= n; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddLogAddr(addr))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	kvServer := remotedbserver.NewKvServer(ctx, New(db, agg, nil), nil, nil)
+	grpcServer, conn := grpc.NewServer(), bufconn.Listen(1024*1024)
+	remote.RegisterKVServer(grpcServer, kvServer)
+	remotedbserver.RegisterTemporalKVServer(grpcServer, kvServer)
+	go grpcServer.Serve(conn) //nolint
+	defer grpcServer.Stop()
+	cc, err := grpc.Dial("", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(func(ctx context.Context, url string) (net.Conn, error) { return conn.Dial() }))
+	require.NoError(err)
+	defer cc.Close()
+	rdb, err := remotedb.NewRemote(gointerfaces.VersionFromProto(remotedbserver.KvServiceAPIVersion), log.New(), remote.NewKVClient(cc)).
+		WithTemporalKV(remotedbserver.NewTemporalKVClient(cc)).Open()
+	require.NoError(err)
+
+	var _ kv.TemporalRoDb = rdb
+	err = rdb.ViewTemporal(ctx, func(tx kv.TemporalTx) error {
+		v, ok, err := tx.HistoryGet(AccountsHistory, key(7), 1)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal("v0", string(v))
+		v, ok, err = tx.DomainGet(AccountsDomain, key(7), nil, 1)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal("v0", string(v))
+
+		it, err := tx.IndexRange(LogAddrIdx, addr, -1, -1, order.Asc, -1)
+		require.NoError(err)
+		txNums, err := iter.ToU64Arr(it)
+		require.NoError(err)
+		require.Equal(n, len(txNums))
+		require.Equal(uint64(n), txNums[n-1])
+		it, err = tx.IndexRange(LogAddrIdx, addr, 10, -1, order.Asc, 3)
+		require.NoError(err)
+		txNums, err = iter.ToU64Arr(it)
+		require.NoError(err)
+		require.Equal([]uint64{10, 11, 12}, txNums)
+
+		hit, err := tx.HistoryRange(AccountsHistory, 0, 2, order.Asc, -1)
+		require.NoError(err)
+		var cnt uint64
+		for hit.HasNext() {
+			k, v, err := hit.Next()
+			require.NoError(err)
+			require.Equal(cnt, binary.BigEndian.Uint64(k))
+			require.Equal("v0", string(v))
+			cnt++
+		}
+		require.Equal(uint64(n), cnt)
+		hit, err = tx.HistoryRange(AccountsHistory, 0, 2, order.Desc, -1)
+		require.NoError(err)
+		require.True(hit.HasNext()) // error comes with first page
+		_, _, err = hit.Next()
+		require.ErrorContains(err, "not supported")
+		return nil
+	})
+	require.NoError(err)
+}
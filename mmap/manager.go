@@ -0,0 +1,281 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Advice - access pattern of mapped file, see madvise(2)
+type Advice int
+
+const (
+	Random     Advice = iota // default: files are read by random lookups, no read-ahead
+	Sequential               // aggressive read-ahead, pages may be freed soon after access
+	Normal
+	WillNeed // read-ahead of whole file in background
+)
+
+func (a Advice) String() string {
+	switch a {
+	case Random:
+		return "random"
+	case Sequential:
+		return "sequential"
+	case Normal:
+		return "normal"
+	case WillNeed:
+		return "willneed"
+	default:
+		return fmt.Sprintf("advice(%d)", int(a))
+	}
+}
+
+func madvise(b []byte, a Advice) error {
+	switch a {
+	case Sequential:
+		return MadviseSequential(b)
+	case Normal:
+		return MadviseNormal(b)
+	case WillNeed:
+		return MadviseWillNeed(b)
+	default:
+		return MadviseRandom(b)
+	}
+}
+
+// NumaPolicy - placement of page cache of mapped files on NUMA machines.
+// Page cache of shared file mappings is allocated by memory policy of thread which reads the pages (mbind(2) is ignored for them),
+// so policy is applied when Manager reads files ahead: on WillNeed advice. Pages faulted in by random reads use default policy.
+type NumaPolicy int
+
+const (
+	NumaDefault    NumaPolicy = iota // kernel default: local node of reading thread
+	NumaInterleave                   // pages interleaved across nodes
+	NumaBind                         // pages only on given nodes
+)
+
+// Region - one mapped file
+type Region struct {
+	m       *Manager
+	path    string
+	handle1 []byte
+	handle2 *[MaxMapSize]byte // used on windows to unmap
+	advice  Advice
+}
+
+func (r *Region) Bytes() []byte              { return r.handle1 }
+func (r *Region) Handle2() *[MaxMapSize]byte { return r.handle2 }
+func (r *Region) Path() string               { return r.path }
+func (r *Region) Size() int                  { return len(r.handle1) }
+
+// Advice - current access pattern of region
+func (r *Region) Advice() Advice {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+	return r.advice
+}
+
+// Advise - changes access pattern of region. Used for temporary changes of single file (like sequential read during merge).
+func (r *Region) Advise(a Advice) error {
+	if r == nil || r.handle1 == nil {
+		return nil
+	}
+	r.m.lock.Lock()
+	r.advice = a
+	numa, nodes := r.m.numa, r.m.numaNodes
+	r.m.lock.Unlock()
+	return adviseRegion(r.handle1, a, numa, nodes)
+}
+
+// ResetAdvice - returns region to access pattern of Manager's policy (undo of Advise)
+func (r *Region) ResetAdvice() error {
+	if r == nil || r.handle1 == nil {
+		return nil
+	}
+	r.m.lock.Lock()
+	r.advice = r.m.adviceFor(r.path)
+	a, numa, nodes := r.advice, r.m.numa, r.m.numaNodes
+	r.m.lock.Unlock()
+	return adviseRegion(r.handle1, a, numa, nodes)
+}
+
+// Unmap - region must not be used after this call
+func (r *Region) Unmap() error {
+	if r == nil || r.handle1 == nil {
+		return nil
+	}
+	r.m.lock.Lock()
+	if _, ok := r.m.regions[r]; ok {
+		delete(r.m.regions, r)
+		r.m.mapped -= int64(len(r.handle1))
+	}
+	r.m.lock.Unlock()
+	err := Munmap(r.handle1, r.handle2)
+	r.handle1, r.handle2 = nil, nil
+	return err
+}
+
+// Manager - registry of read-only mapped files. Tracks total mapped bytes and applies madvise and NUMA policies centrally:
+// policy set by SetAdvice is applied to already mapped files and to files which will be mapped later (including lazy-opened ones).
+type Manager struct {
+	lock      sync.Mutex
+	regions   map[*Region]struct{}
+	mapped    int64
+	policies  map[string]AdvicePolicy // path prefix -> policy
+	numa      NumaPolicy
+	numaNodes []int
+}
+
+func NewManager() *Manager {
+	return &Manager{regions: map[*Region]struct{}{}, policies: map[string]AdvicePolicy{}}
+}
+
+// DefaultManager - used by compress.Decompressor and recsplit.Index
+var DefaultManager = NewManager()
+
+// Map - maps whole file read-only. Advice of region is taken from policy of longest matching prefix, Random if there is no such policy.
+func (m *Manager) Map(f *os.File, size int) (*Region, error) {
+	handle1, handle2, err := Mmap(f, size)
+	if err != nil {
+		return nil, err
+	}
+	r := &Region{m: m, path: f.Name(), handle1: handle1, handle2: handle2}
+	m.lock.Lock()
+	r.advice = m.adviceFor(r.path)
+	m.regions[r] = struct{}{}
+	m.mapped += int64(size)
+	numa, nodes := m.numa, m.numaNodes
+	m.lock.Unlock()
+	if r.advice != Random { // Mmap already advised Random
+		if err = adviseRegion(handle1, r.advice, numa, nodes); err != nil {
+			_ = r.Unmap()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (m *Manager) adviceFor(path string) Advice {
+	var policy AdvicePolicy
+	prefixLen := -1
+	for prefix, p := range m.policies {
+		if len(prefix) > prefixLen && strings.HasPrefix(path, prefix) {
+			policy, prefixLen = p, len(prefix)
+		}
+	}
+	if policy == nil {
+		return Random
+	}
+	return policy(path)
+}
+
+// AdvicePolicy - chooses access pattern of file by its path (for example by age of file).
+// Called under Manager's lock: must be fast and must not call Manager.
+type AdvicePolicy func(path string) Advice
+
+// SetAdvice - sets access pattern of all files which path starts with `prefix` (usually directory): for mapped files and for files mapped later.
+// SetAdvice(prefix, Random) removes policy of prefix.
+func (m *Manager) SetAdvice(prefix string, a Advice) error {
+	if a == Random {
+		return m.SetAdvicePolicy(prefix, nil)
+	}
+	return m.SetAdvicePolicy(prefix, func(string) Advice { return a })
+}
+
+// SetAdvicePolicy - same as SetAdvice, but access pattern is chosen per file. Prefix has 1 policy: last set wins.
+// nil - removes policy of prefix.
+func (m *Manager) SetAdvicePolicy(prefix string, policy AdvicePolicy) error {
+	m.lock.Lock()
+	if policy == nil {
+		delete(m.policies, prefix)
+	} else {
+		m.policies[prefix] = policy
+	}
+	m.lock.Unlock()
+	return m.apply(prefix, false)
+}
+
+// Reapply - re-evaluates policies of mapped files under prefix, after inputs of policy changed.
+// Only files which access pattern changed are advised.
+func (m *Manager) Reapply(prefix string) error { return m.apply(prefix, true) }
+
+func (m *Manager) apply(prefix string, onlyChanged bool) error {
+	m.lock.Lock()
+	var regions []*Region
+	for r := range m.regions {
+		if !strings.HasPrefix(r.path, prefix) {
+			continue
+		}
+		a := m.adviceFor(r.path)
+		if onlyChanged && a == r.advice {
+			continue
+		}
+		r.advice = a
+		regions = append(regions, r)
+	}
+	numa, nodes := m.numa, m.numaNodes
+	m.lock.Unlock()
+
+	var firstErr error
+	for _, r := range regions {
+		if err := adviseRegion(r.handle1, r.advice, numa, nodes); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", r.path, err)
+		}
+	}
+	return firstErr
+}
+
+// SetNumaPolicy - nodes: for NumaInterleave - empty means all online nodes, for NumaBind - required.
+// On machines with 1 node (and on not-linux OS) policy has no effect.
+func (m *Manager) SetNumaPolicy(p NumaPolicy, nodes ...int) error {
+	if p == NumaBind && len(nodes) == 0 {
+		return fmt.Errorf("mmap: NumaBind requires list of nodes")
+	}
+	if p == NumaInterleave && len(nodes) == 0 {
+		var err error
+		if nodes, err = OnlineNumaNodes(); err != nil {
+			return err
+		}
+	}
+	for _, n := range nodes {
+		if n < 0 || n >= maxNumaNodes {
+			return fmt.Errorf("mmap: invalid numa node %d", n)
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.numa, m.numaNodes = p, nodes
+	return nil
+}
+
+// MappedBytes - total size of mapped files
+func (m *Manager) MappedBytes() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.mapped
+}
+
+// Regions - amount of mapped files
+func (m *Manager) Regions() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.regions)
+}
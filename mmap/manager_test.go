@@ -0,0 +1,119 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string, size int) *os.File {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	m := NewManager()
+	require.NoError(t, m.SetAdvice(filepath.Join(dir, "a"), Sequential))
+
+	a, err := m.Map(open("a.seg", 4096), 4096)
+	require.NoError(t, err)
+	b, err := m.Map(open("b.seg", 8192), 8192)
+	require.NoError(t, err)
+	require.Equal(t, int64(4096+8192), m.MappedBytes())
+	require.Equal(t, 2, m.Regions())
+	require.Equal(t, 4096, len(a.Bytes()))
+	require.Equal(t, Sequential, a.Advice()) // policy applied to files mapped later
+	require.Equal(t, Random, b.Advice())
+
+	// policy of directory applies to mapped files, longer prefix wins
+	require.NoError(t, m.SetAdvice(dir, WillNeed))
+	require.Equal(t, Sequential, a.Advice())
+	require.Equal(t, WillNeed, b.Advice())
+
+	// per-file change is temporary
+	require.NoError(t, b.Advise(Normal))
+	require.Equal(t, Normal, b.Advice())
+	require.NoError(t, b.ResetAdvice())
+	require.Equal(t, WillNeed, b.Advice())
+
+	require.NoError(t, m.SetAdvice(dir, Random))
+	require.Equal(t, Random, b.Advice())
+
+	require.NoError(t, a.Unmap())
+	require.NoError(t, a.Unmap())
+	require.Equal(t, int64(8192), m.MappedBytes())
+	require.Equal(t, 1, m.Regions())
+	require.NoError(t, b.Unmap())
+	require.Zero(t, m.MappedBytes())
+
+	require.Error(t, m.SetNumaPolicy(NumaBind))
+	nodes, err := OnlineNumaNodes()
+	require.NoError(t, err)
+	require.NotEmpty(t, nodes)
+	require.NoError(t, m.SetNumaPolicy(NumaInterleave))
+	c, err := m.Map(open("c.seg", 4096), 4096)
+	require.NoError(t, err)
+	require.NoError(t, c.Advise(WillNeed))
+	require.NoError(t, c.Unmap())
+}
+
+func TestManagerAdvicePolicy(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager()
+	hot := "a.seg"
+	require.NoError(t, m.SetAdvicePolicy(dir, func(path string) Advice {
+		if filepath.Base(path) == hot {
+			return WillNeed
+		}
+		return Random
+	}))
+	regions := map[string]*Region{}
+	for _, name := range []string{"a.seg", "b.seg"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, make([]byte, 4096), 0644))
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		r, err := m.Map(f, 4096)
+		require.NoError(t, err)
+		defer r.Unmap()
+		regions[name] = r
+	}
+	require.Equal(t, WillNeed, regions["a.seg"].Advice())
+	require.Equal(t, Random, regions["b.seg"].Advice())
+
+	// inputs of policy changed
+	hot = "b.seg"
+	require.Equal(t, WillNeed, regions["a.seg"].Advice())
+	require.NoError(t, m.Reapply(dir))
+	require.Equal(t, Random, regions["a.seg"].Advice())
+	require.Equal(t, WillNeed, regions["b.seg"].Advice())
+
+	// static advice replaces policy of same prefix
+	require.NoError(t, m.SetAdvice(dir, Normal))
+	require.Equal(t, Normal, regions["a.seg"].Advice())
+	require.NoError(t, m.SetAdvicePolicy(dir, nil))
+	require.Equal(t, Random, regions["b.seg"].Advice())
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxNumaNodes = 1024
+
+// see linux/mempolicy.h
+const (
+	mpolDefault    = 0
+	mpolBind       = 2
+	mpolInterleave = 3
+)
+
+// OnlineNumaNodes - list of online nodes, format of /sys/devices/system/node/online is "0-3,5"
+func OnlineNumaNodes() ([]int, error) {
+	data, err := os.ReadFile("/sys/devices/system/node/online")
+	if err != nil {
+		if os.IsNotExist(err) { // kernel without NUMA support
+			return []int{0}, nil
+		}
+		return nil, err
+	}
+	var nodes []int
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("parse numa nodes %q: %w", data, err)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil {
+				return nil, fmt.Errorf("parse numa nodes %q: %w", data, err)
+			}
+		}
+		for n := first; n <= last; n++ {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func setMempolicy(mode int, nodes []int) error {
+	var mask [maxNumaNodes / 64]uint64
+	for _, n := range nodes {
+		if n < 0 || n >= maxNumaNodes {
+			return fmt.Errorf("numa node %d out of range [0, %d)", n, maxNumaNodes)
+		}
+		mask[n/64] |= 1 << (n % 64)
+	}
+	var maskPtr, maxNode uintptr
+	if mode != mpolDefault {
+		maskPtr, maxNode = uintptr(unsafe.Pointer(&mask[0])), maxNumaNodes+1
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SET_MEMPOLICY, uintptr(mode), maskPtr, maxNode); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// adviseRegion - read-ahead by WillNeed allocates page cache by memory policy of current thread,
+// so thread is locked and policy is set only for duration of madvise call.
+// If policy can't be reset - thread stays locked: it exits with goroutine instead of serving other goroutines with policy.
+func adviseRegion(b []byte, a Advice, p NumaPolicy, nodes []int) error {
+	if a != WillNeed || p == NumaDefault || (p == NumaInterleave && len(nodes) < 2) {
+		return madvise(b, a)
+	}
+	mode := mpolInterleave
+	if p == NumaBind {
+		mode = mpolBind
+	}
+	runtime.LockOSThread()
+	if err := setMempolicy(mode, nodes); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("set_mempolicy: %w", err)
+	}
+	err := madvise(b, a)
+	if resetErr := setMempolicy(mpolDefault, nil); resetErr != nil {
+		if err == nil {
+			err = fmt.Errorf("set_mempolicy: %w", resetErr)
+		}
+		return err
+	}
+	runtime.UnlockOSThread()
+	return err
+}
@@ -214,6 +214,14 @@ func (ef *EliasFano) Search(offset uint64) (uint64, bool) {
 	return 0, false
 }
 
+// Rank returns amount of values in the sequence, lower than given value
+func (ef *EliasFano) Rank(offset uint64) uint64 {
+	return uint64(sort.Search(int(ef.count+1), func(i int) bool {
+		val, _, _, _, _ := ef.get(uint64(i))
+		return val >= offset
+	}))
+}
+
 func (ef *EliasFano) Max() uint64 {
 	return ef.maxOffset
 }
@@ -284,6 +292,24 @@ func (efi *EliasFanoIter) Next() (uint64, error) {
 	return val, nil
 }
 
+// Seek - moves iterator to the first value equal or greater than given value. Values before it are not decoded:
+// position is found by binary search (see Rank). Doesn't move iterator back.
+func (efi *EliasFanoIter) Seek(v uint64) {
+	i := efi.ef.Rank(v)
+	if i <= efi.idx {
+		return
+	}
+	efi.idx = i
+	if i > efi.ef.count {
+		return
+	}
+	_, _, sel, currWord, _ := efi.ef.get(i)
+	efi.lowerIdx = i * efi.ef.l
+	efi.upperIdx = currWord
+	efi.upperMask = uint64(1) << sel
+	efi.upper = (currWord*64 + uint64(sel) - i) << efi.ef.l
+}
+
 // Write outputs the state of golomb rice encoding into a writer, which can be recovered later by Read
 func (ef *EliasFano) Write(w io.Writer) error {
 	var numBuf [8]byte
@@ -316,14 +342,18 @@ func (ef *EliasFano) AppendBytes(buf []byte) []byte {
 
 // Read inputs the state of golomb rice encoding from a reader s
 func ReadEliasFano(r []byte) (*EliasFano, int) {
-	ef := &EliasFano{
-		count: binary.BigEndian.Uint64(r[:8]),
-		u:     binary.BigEndian.Uint64(r[8:16]),
-		data:  unsafe.Slice((*uint64)(unsafe.Pointer(&r[16])), (len(r)-16)/uint64Size),
-	}
+	ef := &EliasFano{}
+	ef.Reset(r)
+	return ef, 16 + 8*len(ef.data)
+}
+
+// Reset - re-reads ef from r: allocation-free alternative of ReadEliasFano for hot loops
+func (ef *EliasFano) Reset(r []byte) {
+	ef.count = binary.BigEndian.Uint64(r[:8])
+	ef.u = binary.BigEndian.Uint64(r[8:16])
+	ef.data = unsafe.Slice((*uint64)(unsafe.Pointer(&r[16])), (len(r)-16)/uint64Size)
 	ef.maxOffset = ef.u - 1
 	ef.deriveFields()
-	return ef, 16 + 8*len(ef.data)
 }
 
 func Max(r []byte) uint64   { return binary.BigEndian.Uint64(r[8:16]) - 1 }
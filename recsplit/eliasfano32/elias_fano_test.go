@@ -53,6 +53,11 @@ func TestEliasFano(t *testing.T) {
 	v, ok = ef.Search(11)
 	assert.True(t, ok, "search4")
 	assert.Equal(t, uint64(14), v, "search4")
+	assert.Equal(t, uint64(0), ef.Rank(0), "rank1")
+	assert.Equal(t, uint64(0), ef.Rank(1), "rank2")
+	assert.Equal(t, uint64(5), ef.Rank(11), "rank3")
+	assert.Equal(t, uint64(10), ef.Rank(37), "rank4")
+	assert.Equal(t, count, ef.Rank(100), "rank5")
 
 	buf := bytes.NewBuffer(nil)
 	ef.Write(buf)
@@ -64,6 +69,17 @@ func TestEliasFano(t *testing.T) {
 	assert.Equal(t, ef2.Max(), Max(buf.Bytes()))
 	assert.Equal(t, ef2.Min(), Min(buf.Bytes()))
 	assert.Equal(t, ef2.Count(), Count(buf.Bytes()))
+
+	var ef3 EliasFano
+	allocs := testing.AllocsPerRun(10, func() {
+		ef3.Reset(buf.Bytes())
+		v, ok = ef3.Search(20)
+	})
+	assert.Zero(t, allocs, "reset")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(22), v)
+	assert.Equal(t, ef2.Max(), ef3.Max())
+	assert.Equal(t, ef2.Count(), ef3.Count())
 }
 
 func TestIterator(t *testing.T) {
@@ -91,3 +107,46 @@ func TestIterator(t *testing.T) {
 	}
 	iter.ExpectEqualU64(t, iter.ReverseArray(values), ef.ReverseIterator())
 }
+
+func TestIteratorSeek(t *testing.T) {
+	var offsets []uint64
+	for v := uint64(3); len(offsets) < 3000; v += uint64(len(offsets)%7) + 1 {
+		offsets = append(offsets, v)
+	}
+	ef := NewEliasFano(uint64(len(offsets)), offsets[len(offsets)-1])
+	for _, offset := range offsets {
+		ef.AddOffset(offset)
+	}
+	ef.Build()
+	drain := func(efi *EliasFanoIter) (res []uint64) {
+		for efi.HasNext() {
+			v, _ := efi.Next()
+			res = append(res, v)
+		}
+		return res
+	}
+	for _, seek := range []uint64{0, 3, 4, 100, 1000, 4095, 4096, offsets[len(offsets)-1], offsets[len(offsets)-1] + 1} {
+		efi := ef.Iterator()
+		efi.Seek(seek)
+		var expect []uint64
+		for _, v := range offsets {
+			if v >= seek {
+				expect = append(expect, v)
+			}
+		}
+		assert.Equal(t, expect, drain(efi), "seek %d", seek)
+	}
+
+	efi := ef.Iterator()
+	for i := 0; i < 10; i++ {
+		efi.Next()
+	}
+	efi.Seek(0) // doesn't move back
+	v, _ := efi.Next()
+	assert.Equal(t, offsets[10], v)
+	efi.Seek(offsets[100] - 1)
+	v, _ = efi.Next()
+	assert.Equal(t, offsets[100], v)
+	v, _ = efi.Next()
+	assert.Equal(t, offsets[101], v)
+}
@@ -20,12 +20,10 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"math/bits"
 	"os"
 	"path/filepath"
 	"time"
-	"unsafe"
 
 	"github.com/ledgerwatch/erigon-lib/mmap"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano16"
@@ -37,14 +35,13 @@ import (
 type Index struct {
 	offsetEf           *eliasfano32.EliasFano
 	f                  *os.File
-	mmapHandle2        *[mmap.MaxMapSize]byte // mmap handle for windows (this is used to close mmap)
+	region             *mmap.Region // mapped file, registered in mmap.DefaultManager
 	filePath, fileName string
 
 	grData             []uint64
 	data               []byte // slice of correct size for the index to work with
 	startSeed          []uint64
 	golombRice         []uint32
-	mmapHandle1        []byte // mmap handle for unix (this is used to close mmap)
 	ef                 eliasfano16.DoubleEliasFano
 	bucketSize         int
 	size               int64
@@ -59,6 +56,7 @@ type Index struct {
 	secondaryAggrBound uint16 // The lower bound for secondary key aggregation (computed from leadSize)
 	primaryAggrBound   uint16 // The lower bound for primary key aggregation (computed from leafSize)
 	enums              bool
+	header             IndexHeader
 }
 
 func MustOpen(indexFile string) *Index {
@@ -86,75 +84,40 @@ func OpenIndex(indexFilePath string) (*Index, error) {
 	}
 	idx.size = stat.Size()
 	idx.modTime = stat.ModTime()
-	if idx.mmapHandle1, idx.mmapHandle2, err = mmap.Mmap(idx.f, int(idx.size)); err != nil {
+	if idx.region, err = mmap.DefaultManager.Map(idx.f, int(idx.size)); err != nil {
 		return nil, err
 	}
-	idx.data = idx.mmapHandle1[:idx.size]
-	// Read number of keys and bytes per record
-	idx.baseDataID = binary.BigEndian.Uint64(idx.data[:8])
-	idx.keyCount = binary.BigEndian.Uint64(idx.data[8:16])
-	idx.bytesPerRec = int(idx.data[16])
-	idx.recMask = (uint64(1) << (8 * idx.bytesPerRec)) - 1
-	offset := 16 + 1 + int(idx.keyCount)*idx.bytesPerRec
-
-	if offset < 0 {
-		return nil, fmt.Errorf("offset is: %d which is below zero, the file: %s is broken", offset, indexFilePath)
+	idx.data = idx.region.Bytes()[:idx.size]
+	if err = idx.init(); err != nil {
+		return nil, err
 	}
+	return idx, nil
+}
 
-	// Bucket count, bucketSize, leafSize
-	idx.bucketCount = binary.BigEndian.Uint64(idx.data[offset:])
-	offset += 8
-	idx.bucketSize = int(binary.BigEndian.Uint16(idx.data[offset:]))
-	offset += 2
-	idx.leafSize = binary.BigEndian.Uint16(idx.data[offset:])
-	offset += 2
-	idx.primaryAggrBound = idx.leafSize * uint16(math.Max(2, math.Ceil(0.35*float64(idx.leafSize)+1./2.)))
-	if idx.leafSize < 7 {
-		idx.secondaryAggrBound = idx.primaryAggrBound * 2
-	} else {
-		idx.secondaryAggrBound = idx.primaryAggrBound * uint16(math.Ceil(0.21*float64(idx.leafSize)+9./10.))
-	}
-	// Salt
-	idx.salt = binary.BigEndian.Uint32(idx.data[offset:])
-	offset += 4
-	// Start seed
-	startSeedLen := int(idx.data[offset])
-	offset++
-	idx.startSeed = make([]uint64, startSeedLen)
-	for i := 0; i < startSeedLen; i++ {
-		idx.startSeed[i] = binary.BigEndian.Uint64(idx.data[offset:])
-		offset += 8
-	}
-	idx.enums = idx.data[offset] != 0
-	offset++
-	if idx.enums {
-		var size int
-		idx.offsetEf, size = eliasfano32.ReadEliasFano(idx.data[offset:])
-		offset += size
+// NewIndexFromData - opens index which is stored as part of bigger file (already mmapped by caller).
+// Returned Index doesn't own `data`: caller must keep it mapped while Index is used, Close is no-op.
+func NewIndexFromData(filePath string, data []byte) (*Index, error) {
+	_, fName := filepath.Split(filePath)
+	idx := &Index{
+		filePath: filePath,
+		fileName: fName,
+		data:     data,
+		size:     int64(len(data)),
 	}
-	// Size of golomb rice params
-	golombParamSize := binary.BigEndian.Uint16(idx.data[offset:])
-	offset += 4
-	idx.golombRice = make([]uint32, golombParamSize)
-	for i := uint16(0); i < golombParamSize; i++ {
-		if i == 0 {
-			idx.golombRice[i] = (bijMemo[i] << 27) | bijMemo[i]
-		} else if i <= idx.leafSize {
-			idx.golombRice[i] = (bijMemo[i] << 27) | (uint32(1) << 16) | bijMemo[i]
-		} else {
-			computeGolombRice(i, idx.golombRice, idx.leafSize, idx.primaryAggrBound, idx.secondaryAggrBound)
-		}
+	if err := idx.init(); err != nil {
+		return nil, err
 	}
-
-	l := binary.BigEndian.Uint64(idx.data[offset:])
-	offset += 8
-	p := (*[maxDataSize / 8]uint64)(unsafe.Pointer(&idx.data[offset]))
-	idx.grData = p[:l]
-	offset += 8 * int(l)
-	idx.ef.Read(idx.data[offset:])
 	return idx, nil
 }
 
+func (idx *Index) init() error {
+	h, err := parseIndexHeader(idx.data)
+	if err != nil {
+		return fmt.Errorf("%w, the file: %s is broken", err, idx.filePath)
+	}
+	return idx.initFromHeader(h)
+}
+
 func (idx *Index) Size() int64        { return idx.size }
 func (idx *Index) ModTime() time.Time { return idx.modTime }
 func (idx *Index) BaseDataID() uint64 { return idx.baseDataID }
@@ -162,10 +125,10 @@ func (idx *Index) FilePath() string   { return idx.filePath }
 func (idx *Index) FileName() string   { return idx.fileName }
 
 func (idx *Index) Close() error {
-	if idx == nil {
+	if idx == nil || idx.f == nil {
 		return nil
 	}
-	if err := mmap.Munmap(idx.mmapHandle1, idx.mmapHandle2); err != nil {
+	if err := idx.region.Unmap(); err != nil {
 		log.Trace("unmap", "err", err, "file", idx.FileName())
 	}
 	if err := idx.f.Close(); err != nil {
@@ -324,21 +287,31 @@ func (idx *Index) RewriteWithOffsets(w *bufio.Writer, m map[uint64]uint64) error
 }
 
 // DisableReadAhead - usage: `defer d.EnableReadAhead().DisableReadAhead()`. Please don't use this funcs without `defer` to avoid leak.
+// Returns file to access pattern of mmap.DefaultManager policy.
 func (idx *Index) DisableReadAhead() {
-	if idx == nil || idx.mmapHandle1 == nil {
+	if idx == nil {
 		return
 	}
-	_ = mmap.MadviseRandom(idx.mmapHandle1)
+	_ = idx.region.ResetAdvice()
 }
 func (idx *Index) EnableReadAhead() *Index {
-	_ = mmap.MadviseSequential(idx.mmapHandle1)
+	if idx == nil {
+		return idx
+	}
+	_ = idx.region.Advise(mmap.Sequential)
 	return idx
 }
 func (idx *Index) EnableMadvNormal() *Index {
-	_ = mmap.MadviseNormal(idx.mmapHandle1)
+	if idx == nil {
+		return idx
+	}
+	_ = idx.region.Advise(mmap.Normal)
 	return idx
 }
 func (idx *Index) EnableWillNeed() *Index {
-	_ = mmap.MadviseWillNeed(idx.mmapHandle1)
+	if idx == nil {
+		return idx
+	}
+	_ = idx.region.Advise(mmap.WillNeed)
 	return idx
 }
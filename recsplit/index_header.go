@@ -0,0 +1,208 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recsplit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/mmap"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// IndexHeader - parsed metadata of index file: scalars of header and offsets of its sections. Parsing of header
+// touches pages all over the file (sections follow arrays of keyCount size), so callers which re-open many
+// indices (on startup) can persist headers and re-open by OpenIndexWithHeader.
+// Size and ModTime identify version of file: header of other version is ignored.
+type IndexHeader struct {
+	Size            int64
+	ModTime         int64 // UnixNano
+	BaseDataID      uint64
+	KeyCount        uint64
+	BytesPerRec     int
+	BucketCount     uint64
+	BucketSize      int
+	LeafSize        uint16
+	Salt            uint32
+	StartSeed       []uint64
+	Enums           bool
+	OffsetEfPos     int // position of Elias-Fano of offsets, if Enums
+	GolombParamSize uint16
+	GrDataPos       int
+	GrDataLen       uint64
+	EfPos           int
+}
+
+func parseIndexHeader(data []byte) (h IndexHeader, err error) {
+	if len(data) < 17 {
+		return h, fmt.Errorf("too short: %d bytes", len(data))
+	}
+	h.BaseDataID = binary.BigEndian.Uint64(data[:8])
+	h.KeyCount = binary.BigEndian.Uint64(data[8:16])
+	h.BytesPerRec = int(data[16])
+	offset := 16 + 1 + int(h.KeyCount)*h.BytesPerRec
+	if offset < 0 || offset+8+2+2+4+1 > len(data) {
+		return h, fmt.Errorf("offset is: %d which is out of file", offset)
+	}
+	h.BucketCount = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	h.BucketSize = int(binary.BigEndian.Uint16(data[offset:]))
+	offset += 2
+	h.LeafSize = binary.BigEndian.Uint16(data[offset:])
+	offset += 2
+	h.Salt = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	startSeedLen := int(data[offset])
+	offset++
+	h.StartSeed = make([]uint64, startSeedLen)
+	for i := 0; i < startSeedLen; i++ {
+		h.StartSeed[i] = binary.BigEndian.Uint64(data[offset:])
+		offset += 8
+	}
+	h.Enums = data[offset] != 0
+	offset++
+	if h.Enums {
+		h.OffsetEfPos = offset
+		_, size := eliasfano32.ReadEliasFano(data[offset:])
+		offset += size
+	}
+	h.GolombParamSize = binary.BigEndian.Uint16(data[offset:])
+	offset += 4
+	h.GrDataLen = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	h.GrDataPos = offset
+	h.EfPos = offset + 8*int(h.GrDataLen)
+	return h, nil
+}
+
+// fits - offsets of header point inside of file of `size` bytes and sections don't overlap.
+// Cached header is trusted after size and mtime match: damaged or foreign cache must not cause reads out of file.
+func (h IndexHeader) fits(size int) bool {
+	if h.KeyCount > uint64(size) || h.BytesPerRec < 0 || h.GrDataLen > uint64(size)/8 {
+		return false
+	}
+	recordsEnd := 16 + 1 + int(h.KeyCount)*h.BytesPerRec
+	if h.GrDataPos < recordsEnd || h.GrDataPos+8*int(h.GrDataLen) != h.EfPos || h.EfPos >= size {
+		return false
+	}
+	if h.Enums && (h.OffsetEfPos < recordsEnd || h.OffsetEfPos >= h.GrDataPos) {
+		return false
+	}
+	return true
+}
+
+func (idx *Index) initFromHeader(h IndexHeader) error {
+	if !h.fits(len(idx.data)) {
+		return fmt.Errorf("header doesn't match the file: %s", idx.filePath)
+	}
+	idx.baseDataID, idx.keyCount, idx.bytesPerRec = h.BaseDataID, h.KeyCount, h.BytesPerRec
+	idx.recMask = (uint64(1) << (8 * idx.bytesPerRec)) - 1
+	idx.bucketCount, idx.bucketSize, idx.leafSize = h.BucketCount, h.BucketSize, h.LeafSize
+	idx.primaryAggrBound = idx.leafSize * uint16(math.Max(2, math.Ceil(0.35*float64(idx.leafSize)+1./2.)))
+	if idx.leafSize < 7 {
+		idx.secondaryAggrBound = idx.primaryAggrBound * 2
+	} else {
+		idx.secondaryAggrBound = idx.primaryAggrBound * uint16(math.Ceil(0.21*float64(idx.leafSize)+9./10.))
+	}
+	idx.salt, idx.startSeed, idx.enums = h.Salt, h.StartSeed, h.Enums
+	if idx.enums {
+		idx.offsetEf, _ = eliasfano32.ReadEliasFano(idx.data[h.OffsetEfPos:])
+	}
+	idx.golombRice = golombRiceTable(h.GolombParamSize, idx.leafSize, idx.primaryAggrBound, idx.secondaryAggrBound)
+	if h.GrDataLen > 0 {
+		p := (*[maxDataSize / 8]uint64)(unsafe.Pointer(&idx.data[h.GrDataPos]))
+		idx.grData = p[:h.GrDataLen]
+	}
+	idx.ef.Read(idx.data[h.EfPos:])
+	idx.header = h
+	return nil
+}
+
+// Header - parsed header of index, see OpenIndexWithHeader
+func (idx *Index) Header() IndexHeader {
+	h := idx.header
+	h.Size, h.ModTime = idx.size, idx.modTime.UnixNano()
+	return h
+}
+
+// OpenIndexWithHeader - same as OpenIndex, but doesn't parse header of file if `h` (from Index.Header) matches
+// size and modification time of the file. `h=nil` or mismatching `h` is parsed as usual.
+func OpenIndexWithHeader(indexFilePath string, h *IndexHeader) (*Index, error) {
+	if h == nil {
+		return OpenIndex(indexFilePath)
+	}
+	_, fName := filepath.Split(indexFilePath)
+	idx := &Index{
+		filePath: indexFilePath,
+		fileName: fName,
+	}
+	var err error
+	if idx.f, err = os.Open(indexFilePath); err != nil {
+		return nil, err
+	}
+	stat, err := idx.f.Stat()
+	if err != nil {
+		idx.f.Close()
+		return nil, err
+	}
+	idx.size, idx.modTime = stat.Size(), stat.ModTime()
+	if idx.region, err = mmap.DefaultManager.Map(idx.f, int(idx.size)); err != nil {
+		idx.f.Close()
+		return nil, err
+	}
+	idx.data = idx.region.Bytes()[:idx.size]
+	if h.Size != idx.size || h.ModTime != idx.modTime.UnixNano() || idx.initFromHeader(*h) != nil {
+		err = idx.init()
+	}
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+type golombRiceKey struct {
+	size, leafSize uint16
+}
+
+var golombRiceTables sync.Map // golombRiceKey -> []uint32
+
+// golombRiceTable - table depends only on leafSize and amount of params: computed once and shared by all
+// indices. Read-only.
+func golombRiceTable(size, leafSize, primaryAggrBound, secondaryAggrBound uint16) []uint32 {
+	key := golombRiceKey{size: size, leafSize: leafSize}
+	if t, ok := golombRiceTables.Load(key); ok {
+		return t.([]uint32)
+	}
+	t := make([]uint32, size)
+	for i := uint16(0); i < size; i++ {
+		if i == 0 {
+			t[i] = (bijMemo[i] << 27) | bijMemo[i]
+		} else if i <= leafSize {
+			t[i] = (bijMemo[i] << 27) | (uint32(1) << 16) | bijMemo[i]
+		} else {
+			computeGolombRice(i, t, leafSize, primaryAggrBound, secondaryAggrBound)
+		}
+	}
+	actual, _ := golombRiceTables.LoadOrStore(key, t)
+	return actual.([]uint32)
+}
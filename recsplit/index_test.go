@@ -75,3 +75,58 @@ func TestReWriteIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenIndexWithHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	indexFile := filepath.Join(tmpDir, "index")
+	rs, err := NewRecSplit(RecSplitArgs{
+		KeyCount:   100,
+		BucketSize: 10,
+		Salt:       0,
+		TmpDir:     tmpDir,
+		IndexFile:  indexFile,
+		LeafSize:   8,
+		Enums:      true,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, rs.AddKey([]byte(fmt.Sprintf("key %d", i)), uint64(i*17)))
+	}
+	require.NoError(t, rs.Build())
+
+	idx := MustOpen(indexFile)
+	h := idx.Header()
+	idx.Close()
+	require.Equal(t, uint64(100), h.KeyCount)
+
+	check := func(h *IndexHeader) {
+		idx, err := OpenIndexWithHeader(indexFile, h)
+		require.NoError(t, err)
+		defer idx.Close()
+		reader := NewIndexReader(idx)
+		for i := 0; i < 100; i++ {
+			e := reader.Lookup([]byte(fmt.Sprintf("key %d", i)))
+			require.Equal(t, uint64(i*17), idx.OrdinalLookup(e))
+		}
+	}
+	check(&h)
+	check(nil)
+	// header of other version of file is ignored
+	broken := h
+	broken.ModTime++
+	broken.EfPos, broken.GrDataPos = 1, 1
+	check(&broken)
+	// header of same version of file is checked against bounds of file: parsed if doesn't fit
+	for _, damage := range []func(h *IndexHeader){
+		func(h *IndexHeader) { h.GrDataPos, h.EfPos = int(h.Size)+8, int(h.Size)+8+8*int(h.GrDataLen) },
+		func(h *IndexHeader) { h.GrDataLen, h.EfPos = 1<<62, h.GrDataPos },
+		func(h *IndexHeader) { h.GrDataPos, h.EfPos = -8, -8+8*int(h.GrDataLen) },
+		func(h *IndexHeader) { h.Enums, h.OffsetEfPos = true, int(h.Size) },
+		func(h *IndexHeader) { h.KeyCount = uint64(h.Size) },
+	} {
+		broken = h
+		broken.StartSeed = append([]uint64{}, h.StartSeed...)
+		damage(&broken)
+		check(&broken)
+	}
+}
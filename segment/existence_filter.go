@@ -0,0 +1,95 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// ExistenceFilter - bloom filter of keys of segment: allows to skip lookup of recsplit index
+// (which always returns some offset) for keys which are not in segment.
+// File format: 8 bytes amount of bits, 1 byte amount of hash functions, bits as big-endian uint64 words.
+type ExistenceFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint8
+}
+
+// NewExistenceFilter - false-positive rate fpRate for keyCount keys
+func NewExistenceFilter(keyCount uint64, fpRate float64) *ExistenceFilter {
+	if keyCount == 0 {
+		keyCount = 1
+	}
+	m := uint64(math.Ceil(-float64(keyCount) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	hashes := uint8(math.Max(1, math.Round(float64(m)/float64(keyCount)*math.Ln2)))
+	return &ExistenceFilter{bits: make([]uint64, m/64), m: m, hashes: hashes}
+}
+
+func (f *ExistenceFilter) AddKey(key []byte) {
+	h1, h2 := murmur3.Sum128(key)
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// ContainsKey - false means key is not in segment, true means it's probably there
+func (f *ExistenceFilter) ContainsKey(key []byte) bool {
+	h1, h2 := murmur3.Sum128(key)
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Write - atomic: readers never see partially written filter
+func (f *ExistenceFilter) Write(filePath string) error {
+	data := make([]byte, 9+8*len(f.bits))
+	binary.BigEndian.PutUint64(data, f.m)
+	data[8] = f.hashes
+	for i, w := range f.bits {
+		binary.BigEndian.PutUint64(data[9+8*i:], w)
+	}
+	return writeAtomic(filePath, data)
+}
+
+func OpenExistenceFilter(filePath string) (*ExistenceFilter, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 9 || (len(data)-9)%8 != 0 {
+		return nil, fmt.Errorf("existence filter %s: unexpected size %d", filePath, len(data))
+	}
+	f := &ExistenceFilter{m: binary.BigEndian.Uint64(data), hashes: data[8], bits: make([]uint64, (len(data)-9)/8)}
+	if f.m != uint64(len(f.bits))*64 || f.hashes == 0 {
+		return nil, fmt.Errorf("existence filter %s: corrupted header", filePath)
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(data[9+8*i:])
+	}
+	return f, nil
+}
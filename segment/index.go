@@ -0,0 +1,73 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package segment
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+type IndexArgs struct {
+	IndexFile string
+	TmpDir    string
+	KeyCount  int
+	LogLvl    log.Lvl // 0 - log.LvlTrace
+}
+
+// BuildIndex - builds recsplit index of keys which `walk` passes to `add`.
+// On collision `walk` is called again (with next salt): it must add same keys.
+func BuildIndex(ctx context.Context, args IndexArgs, walk func(add func(key []byte, offset uint64) error) error) error {
+	rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   args.KeyCount,
+		Enums:      false,
+		BucketSize: 2000,
+		LeafSize:   8,
+		TmpDir:     args.TmpDir,
+		IndexFile:  args.IndexFile,
+	})
+	if err != nil {
+		return fmt.Errorf("create recsplit: %w", err)
+	}
+	defer rs.Close()
+	lvl := args.LogLvl
+	if lvl == 0 {
+		lvl = log.LvlTrace
+	}
+	rs.LogLvl(lvl)
+	for {
+		if err = ctx.Err(); err != nil {
+			log.Warn("recsplit index building cancelled", "err", err)
+			return err
+		}
+		if err = walk(rs.AddKey); err != nil {
+			return err
+		}
+		if err = rs.Build(); err != nil {
+			if rs.Collision() {
+				log.Info("Building recsplit. Collision happened. It's ok. Restarting...")
+				rs.ResetNextSalt()
+				continue
+			}
+			return fmt.Errorf("build idx: %w", err)
+		}
+		return nil
+	}
+}
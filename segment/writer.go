@@ -0,0 +1,212 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package segment - "indexed segment": compressed data file of (key, value) pairs and files built next to it
+// (recsplit index of keys, existence filter, stats sidecar). Writer produces all of them, with same naming.
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+const StatsSuffix = ".stats" // sidecar of data file: accounts.0-1.ef.stats
+
+// FileName - name of file of step range [fromStep; toStep): accounts.0-1.ef
+func FileName(base string, fromStep, toStep uint64, ext string) string {
+	return fmt.Sprintf("%s.%d-%d.%s", base, fromStep, toStep, ext)
+}
+
+// Stats - accumulates content of segment, written as json sidecar of data file (see StatsSuffix)
+type Stats interface {
+	AddPair(key, value []byte)
+}
+
+// WriteStats - atomic: readers never see partially written sidecar
+func WriteStats(dataPath string, stats any) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	if err = writeAtomic(dataPath+StatsSuffix, data); err != nil {
+		return fmt.Errorf("write stats of %s: %w", filepath.Base(dataPath), err)
+	}
+	return nil
+}
+
+func writeAtomic(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+type WriterArgs struct {
+	DataPath   string
+	IndexPath  string  // "" - no index
+	FilterPath string  // "" - no existence filter
+	FilterFP   float64 // false-positive rate of existence filter, 0 - 1%
+	TmpDir     string
+	Workers    int
+	LogLvl     log.Lvl // 0 - log.LvlTrace
+	Stats      Stats   // nil - no sidecar
+	// CompressTmp - ETL temp files of compressor are compressed, see compress.Compressor.SetCompressTmpFiles
+	CompressTmp bool
+
+	// Sealed - called when data file and its sidecar are written, before data file is opened: see content-addressed names
+	Sealed func(dataPath string) error
+}
+
+// Files - result of Writer.Build, owned by caller
+type Files struct {
+	Decomp *compress.Decompressor
+	Index  *recsplit.Index
+	Filter *ExistenceFilter
+}
+
+func (f Files) Close() {
+	if f.Decomp != nil {
+		f.Decomp.Close()
+	}
+	if f.Index != nil {
+		f.Index.Close()
+	}
+}
+
+// Writer - single pass: Add pairs sorted by key, then Build. Close is no-op after successful Build.
+type Writer struct {
+	ctx  context.Context
+	args WriterArgs
+	comp *compress.Compressor
+	keys int
+}
+
+func NewWriter(ctx context.Context, logPrefix string, args WriterArgs) (*Writer, error) {
+	if args.LogLvl == 0 {
+		args.LogLvl = log.LvlTrace
+	}
+	if args.FilterFP == 0 {
+		args.FilterFP = 0.01
+	}
+	comp, err := compress.NewCompressor(ctx, logPrefix, args.DataPath, args.TmpDir, compress.MinPatternScore, args.Workers, args.LogLvl)
+	if err != nil {
+		return nil, fmt.Errorf("create %s compressor: %w", filepath.Base(args.DataPath), err)
+	}
+	comp.SetCompressTmpFiles(args.CompressTmp)
+	return &Writer{ctx: ctx, args: args, comp: comp}, nil
+}
+
+func (w *Writer) Add(key, value []byte) error {
+	if err := w.comp.AddUncompressedWord(key); err != nil {
+		return fmt.Errorf("add %s key [%x]: %w", filepath.Base(w.args.DataPath), key, err)
+	}
+	if err := w.comp.AddUncompressedWord(value); err != nil {
+		return fmt.Errorf("add %s val: %w", filepath.Base(w.args.DataPath), err)
+	}
+	if w.args.Stats != nil {
+		w.args.Stats.AddPair(key, value)
+	}
+	w.keys++
+	return nil
+}
+
+func (w *Writer) Close() {
+	if w.comp != nil {
+		w.comp.Close()
+		w.comp = nil
+	}
+}
+
+// Build - compresses data file, writes sidecar, opens data file, builds index and filter
+func (w *Writer) Build() (res Files, err error) {
+	defer func() {
+		if err != nil {
+			res.Close()
+			res = Files{}
+		}
+	}()
+	name := filepath.Base(w.args.DataPath)
+	if err = w.comp.Compress(); err != nil {
+		return res, fmt.Errorf("compress %s: %w", name, err)
+	}
+	w.Close()
+	if w.args.Stats != nil {
+		if err = WriteStats(w.args.DataPath, w.args.Stats); err != nil {
+			return res, err
+		}
+	}
+	if w.args.Sealed != nil {
+		if err = w.args.Sealed(w.args.DataPath); err != nil {
+			return res, err
+		}
+	}
+	if res.Decomp, err = compress.NewDecompressor(w.args.DataPath); err != nil {
+		return res, fmt.Errorf("open %s decompressor: %w", name, err)
+	}
+	if w.args.IndexPath == "" && w.args.FilterPath == "" {
+		return res, nil
+	}
+	if w.args.FilterPath != "" {
+		res.Filter = NewExistenceFilter(uint64(w.keys), w.args.FilterFP)
+	}
+	walk := func(add func(key []byte, offset uint64) error) error {
+		var keyPos uint64
+		key := make([]byte, 0, 256)
+		g := res.Decomp.MakeGetter()
+		for g.HasNext() {
+			key, _ = g.Next(key[:0])
+			if add != nil {
+				if err := add(key, keyPos); err != nil {
+					return fmt.Errorf("add %s idx key [%x]: %w", name, key, err)
+				}
+			}
+			if res.Filter != nil {
+				res.Filter.AddKey(key)
+			}
+			keyPos = g.Skip()
+		}
+		return nil
+	}
+	defer res.Decomp.EnableMadvNormal().DisableReadAhead()
+	if w.args.IndexPath == "" {
+		err = walk(nil)
+	} else {
+		err = BuildIndex(w.ctx, IndexArgs{IndexFile: w.args.IndexPath, TmpDir: w.args.TmpDir, KeyCount: w.keys, LogLvl: w.args.LogLvl}, walk)
+	}
+	if err != nil {
+		return res, fmt.Errorf("build %s idx: %w", name, err)
+	}
+	if res.Filter != nil {
+		if err = res.Filter.Write(w.args.FilterPath); err != nil {
+			return res, fmt.Errorf("write %s existence filter: %w", name, err)
+		}
+	}
+	if w.args.IndexPath != "" {
+		if res.Index, err = recsplit.OpenIndex(w.args.IndexPath); err != nil {
+			return res, fmt.Errorf("open %s idx: %w", name, err)
+		}
+	}
+	return res, nil
+}
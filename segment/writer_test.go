@@ -0,0 +1,104 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package segment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+type testStats struct{ Pairs, ValuesBytes int }
+
+func (s *testStats) AddPair(_, v []byte) { s.Pairs++; s.ValuesBytes += len(v) }
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, FileName("test", 0, 1, "ef"))
+	require.Equal(t, "test.0-1.ef", filepath.Base(dataPath))
+	var sealed string
+	stats := &testStats{}
+	w, err := NewWriter(context.Background(), "test", WriterArgs{
+		DataPath:   dataPath,
+		IndexPath:  filepath.Join(dir, FileName("test", 0, 1, "efi")),
+		FilterPath: filepath.Join(dir, FileName("test", 0, 1, "efei")),
+		TmpDir:     dir,
+		Workers:    1,
+		Stats:      stats,
+		Sealed:     func(p string) error { sealed = p; return nil },
+	})
+	require.NoError(t, err)
+	defer w.Close()
+	const count = 1000
+	for i := 0; i < count; i++ {
+		require.NoError(t, w.Add([]byte(fmt.Sprintf("key %05d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	files, err := w.Build()
+	require.NoError(t, err)
+	defer files.Close()
+	require.Equal(t, dataPath, sealed)
+	require.Equal(t, 2*count, files.Decomp.Count())
+
+	r := recsplit.NewIndexReader(files.Index)
+	g := files.Decomp.MakeGetter()
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key %05d", i))
+		require.True(t, files.Filter.ContainsKey(key))
+		g.Reset(r.Lookup(key))
+		k, _ := g.Next(nil)
+		require.Equal(t, key, k)
+		v, _ := g.Next(nil)
+		require.Equal(t, fmt.Sprintf("value %d", i), string(v))
+	}
+	var falsePositives int
+	for i := count; i < 2*count; i++ {
+		if files.Filter.ContainsKey([]byte(fmt.Sprintf("key %05d", i))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, count/20)
+
+	filter, err := OpenExistenceFilter(filepath.Join(dir, "test.0-1.efei"))
+	require.NoError(t, err)
+	require.Equal(t, files.Filter, filter)
+
+	data, err := os.ReadFile(dataPath + StatsSuffix)
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"Pairs":%d,"ValuesBytes":%d}`, stats.Pairs, stats.ValuesBytes), string(data))
+	require.Equal(t, count, stats.Pairs)
+}
+
+func TestWriterWithoutIndex(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(context.Background(), "test", WriterArgs{DataPath: filepath.Join(dir, "test.0-1.ef"), TmpDir: dir, Workers: 1})
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.Add([]byte("k"), []byte("v")))
+	files, err := w.Build()
+	require.NoError(t, err)
+	defer files.Close()
+	require.Nil(t, files.Index)
+	require.Nil(t, files.Filter)
+	_, err = os.Stat(filepath.Join(dir, "test.0-1.ef"+StatsSuffix))
+	require.True(t, os.IsNotExist(err))
+}
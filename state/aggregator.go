@@ -233,6 +233,10 @@ func (a *Aggregator) SetCommitmentMode(mode CommitmentMode) {
 	a.commitment.mode = mode
 }
 
+func (a *Aggregator) SetCommitmentScheme(s commitment.Scheme) error {
+	return a.commitment.SetCommitmentScheme(s)
+}
+
 func (a *Aggregator) EndTxNumMinimax() uint64 {
 	min := a.accounts.endTxNumMinimax()
 	if txNum := a.storage.endTxNumMinimax(); txNum < min {
@@ -774,6 +778,7 @@ func (a *AggregatorContext) accountFn(plainKey []byte, cell *commitment.Cell) er
 	}
 	cell.Nonce = 0
 	cell.Balance.Clear()
+	cell.ExtraLen = 0
 	copy(cell.CodeHash[:], commitment.EmptyCodeHash)
 	if len(encAccount) > 0 {
 		nonce, balance, chash := DecodeAccountBytes(encAccount)
@@ -782,6 +787,9 @@ func (a *AggregatorContext) accountFn(plainKey []byte, cell *commitment.Cell) er
 		if chash != nil {
 			copy(cell.CodeHash[:], chash)
 		}
+		if decodeExtra := a.a.commitment.patriciaTrie.Scheme().DecodeAccountExtra; decodeExtra != nil {
+			cell.SetAccountExtra(decodeExtra(encAccount))
+		}
 	}
 
 	code, err := a.ReadAccountCode(plainKey, a.a.rwTx)
@@ -0,0 +1,269 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+const (
+	exportManifestName    = "manifest.json"
+	exportManifestVersion = 1
+)
+
+// ExportManifest - last entry of archive produced by AggregatorV3.Export
+type ExportManifest struct {
+	Version          int
+	AggregationStep  uint64
+	FromStep, ToStep uint64
+	Files            []ExportedFile
+}
+
+type ExportedFile struct {
+	Name   string
+	Size   int64
+	SHA256 string // hex
+}
+
+var exportFileNameRe = regexp.MustCompile(`^([a-z]+)\.([0-9]+)-([0-9]+)\.(v|vi|vb|vbi|ef|efi|efbt|v\.stats|ef\.stats)$`)
+
+// Export - writes tar archive of history and inverted index files (with their indices and stats) of steps [fromStep; toStep)
+// followed by manifest with sizes and checksums of files. Files which are already merged into bigger ones are skipped.
+// Doesn't block merge: files are opened before writing, so deleted ones are still readable.
+func (a *AggregatorV3) Export(ctx context.Context, w io.Writer, fromStep, toStep uint64) error {
+	var infos []FileInfo
+	for _, fi := range a.FilesInfo() {
+		if fi.Kind == FileKindLocality || fi.FromStep < fromStep || fi.ToStep > toStep {
+			continue
+		}
+		infos = append(infos, fi)
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	a.openCloseLock.Lock()
+	for _, fi := range infos {
+		if isSubsetOfAnother(fi, infos) {
+			continue
+		}
+		names := []string{fi.Name, fi.IdxName, fi.Name + fileStatsSuffix}
+		if fi.Kind == FileKindHistory {
+			names = append(names, fi.Name+"b", fi.Name+"bi") // .vb, .vbi
+		} else {
+			names = append(names, fi.Name+"bt") // .efbt
+		}
+		for i, name := range names {
+			if name == "" {
+				continue
+			}
+			f, err := os.Open(filepath.Join(a.dir, name))
+			if i >= 2 && errors.Is(err, os.ErrNotExist) { // file built without stats, large values or .efbt
+				continue
+			}
+			if err != nil {
+				a.openCloseLock.Unlock()
+				return fmt.Errorf("export: %w", err)
+			}
+			files = append(files, f)
+		}
+	}
+	a.openCloseLock.Unlock()
+
+	tw := tar.NewWriter(w)
+	manifest := ExportManifest{Version: exportManifestVersion, AggregationStep: a.aggregationStep, FromStep: fromStep, ToStep: toStep}
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: st.Name(), Size: st.Size(), Mode: 0644, ModTime: st.ModTime()}); err != nil {
+			return fmt.Errorf("export %s: %w", st.Name(), err)
+		}
+		h := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(tw, h), f); err != nil {
+			return fmt.Errorf("export %s: %w", st.Name(), err)
+		}
+		manifest.Files = append(manifest.Files, ExportedFile{Name: st.Name(), Size: st.Size(), SHA256: hex.EncodeToString(h.Sum(nil))})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: exportManifestName, Size: int64(len(data)), Mode: 0644}); err != nil {
+		return fmt.Errorf("export manifest: %w", err)
+	}
+	if _, err = tw.Write(data); err != nil {
+		return fmt.Errorf("export manifest: %w", err)
+	}
+	return tw.Close()
+}
+
+func isSubsetOfAnother(fi FileInfo, infos []FileInfo) bool {
+	for _, other := range infos {
+		if other.Entity == fi.Entity && other.Kind == fi.Kind && other.FromStep <= fi.FromStep && other.ToStep >= fi.ToStep &&
+			(other.FromStep != fi.FromStep || other.ToStep != fi.ToStep) {
+			return true
+		}
+	}
+	return false
+}
+
+// Import - reads archive produced by Export: files are written to staging dir, validated by manifest
+// (aggregation step, names, sizes, checksums) and only then moved to aggregator's dir and opened.
+// Files which already exist with same size are skipped, existing files with other size - error.
+func (a *AggregatorV3) Import(ctx context.Context, r io.Reader) error {
+	staging, err := os.MkdirTemp(a.dir, ".import-")
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	received := map[string]ExportedFile{}
+	var manifest *ExportManifest
+	tr := tar.NewReader(r)
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != hdr.Name || hdr.Name == "." || hdr.Name == ".." {
+			return fmt.Errorf("import: unexpected entry %q", hdr.Name)
+		}
+		if manifest != nil {
+			return fmt.Errorf("import: entry %q after manifest", hdr.Name)
+		}
+		if hdr.Name == exportManifestName {
+			manifest = &ExportManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return fmt.Errorf("import manifest: %w", err)
+			}
+			continue
+		}
+		if _, ok := received[hdr.Name]; ok {
+			return fmt.Errorf("import: duplicated entry %q", hdr.Name)
+		}
+		ef, err := receiveFile(filepath.Join(staging, hdr.Name), tr)
+		if err != nil {
+			return fmt.Errorf("import %s: %w", hdr.Name, err)
+		}
+		ef.Name = hdr.Name
+		received[hdr.Name] = ef
+	}
+	if manifest == nil {
+		return fmt.Errorf("import: no manifest, archive is truncated")
+	}
+	if err = a.validateImport(manifest, received); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	var installed int
+	for _, f := range manifest.Files {
+		to := filepath.Join(a.dir, f.Name)
+		if st, err := os.Stat(to); err == nil {
+			if st.Size() != f.Size {
+				return fmt.Errorf("import: %s already exists with different size", f.Name)
+			}
+			continue
+		}
+		if err = os.Rename(filepath.Join(staging, f.Name), to); err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		installed++
+	}
+	log.Info("[snapshots] import", "steps", fmt.Sprintf("%d-%d", manifest.FromStep, manifest.ToStep), "files", len(manifest.Files), "installed", installed)
+	return a.ReopenFolder()
+}
+
+func receiveFile(path string, r io.Reader) (ef ExportedFile, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return ef, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if ef.Size, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return ef, err
+	}
+	if err = f.Sync(); err != nil {
+		return ef, err
+	}
+	ef.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return ef, nil
+}
+
+func (a *AggregatorV3) validateImport(m *ExportManifest, received map[string]ExportedFile) error {
+	if m.Version != exportManifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.AggregationStep != a.aggregationStep {
+		return fmt.Errorf("aggregation step of archive %d, expected %d", m.AggregationStep, a.aggregationStep)
+	}
+	entities := map[string]bool{}
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		entities[h.filenameBase] = true
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		entities[ii.filenameBase] = true
+	}
+	if len(m.Files) != len(received) {
+		return fmt.Errorf("manifest has %d files, archive - %d", len(m.Files), len(received))
+	}
+	for _, f := range m.Files {
+		subs := exportFileNameRe.FindStringSubmatch(f.Name)
+		if len(subs) != 5 || !entities[subs[1]] {
+			return fmt.Errorf("unexpected file %s", f.Name)
+		}
+		fromStep, _ := strconv.ParseUint(subs[2], 10, 64)
+		toStep, _ := strconv.ParseUint(subs[3], 10, 64)
+		if fromStep >= toStep || fromStep < m.FromStep || toStep > m.ToStep {
+			return fmt.Errorf("file %s is out of steps range %d-%d", f.Name, m.FromStep, m.ToStep)
+		}
+		got, ok := received[f.Name]
+		if !ok {
+			return fmt.Errorf("file %s is missing in archive", f.Name)
+		}
+		if got.Size != f.Size || got.SHA256 != f.SHA256 {
+			return fmt.Errorf("file %s is corrupted: size %d, expected %d", f.Name, got.Size, f.Size)
+		}
+	}
+	return nil
+}
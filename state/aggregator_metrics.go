@@ -0,0 +1,157 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+// aggMetrics - metrics of AggregatorV3 operations. nil - metrics are not registered, all methods are no-op.
+type aggMetrics struct {
+	buildSeconds *metrics.Histogram
+	buildBytes   *metrics.Counter
+	mergeSeconds *metrics.Histogram
+	mergeBytes   *metrics.Counter
+	mergedFiles  *metrics.Counter
+	pruneSeconds *metrics.Histogram
+	flushSeconds *metrics.Histogram
+
+	lookupSeconds map[kv.Domain]*metrics.Histogram
+	lookupHistory *metrics.Counter // GetAsOf resolved by history
+	lookupLatest  *metrics.Counter // GetAsOf resolved by latest state
+
+	ctxHit, ctxMiss *metrics.Counter // GetContext re-used pooled context or created new one
+}
+
+// RegisterMetrics - registers metrics of files build, merge, prune, flush, GetAsOf lookups and contexts cache in s
+// (usually metrics.DefaultRegistry). Must be called before any work with aggregator. Takes Registry, not
+// VictoriaMetrics set as before: to expose metrics in own set use metrics.NewVMRegistry(set).
+func (a *AggregatorV3) RegisterMetrics(s *metrics.Registry) {
+	a.metrics = &aggMetrics{
+		buildSeconds:  s.GetOrCreateHistogram(`aggregator_build_seconds`),
+		buildBytes:    s.GetOrCreateCounter(`aggregator_build_bytes_total`),
+		mergeSeconds:  s.GetOrCreateHistogram(`aggregator_merge_seconds`),
+		mergeBytes:    s.GetOrCreateCounter(`aggregator_merge_bytes_total`),
+		mergedFiles:   s.GetOrCreateCounter(`aggregator_merged_files_total`),
+		pruneSeconds:  s.GetOrCreateHistogram(`aggregator_prune_seconds`),
+		flushSeconds:  s.GetOrCreateHistogram(`aggregator_flush_seconds`),
+		lookupHistory: s.GetOrCreateCounter(`aggregator_lookup_total{source="history"}`),
+		lookupLatest:  s.GetOrCreateCounter(`aggregator_lookup_total{source="latest"}`),
+		ctxHit:        s.GetOrCreateCounter(`aggregator_context_cache_total{result="hit"}`),
+		ctxMiss:       s.GetOrCreateCounter(`aggregator_context_cache_total{result="miss"}`),
+		lookupSeconds: map[kv.Domain]*metrics.Histogram{},
+	}
+	for d, h := range map[kv.Domain]*History{kv.AccountsDomain: a.accounts, kv.StorageDomain: a.storage, kv.CodeDomain: a.code} {
+		a.metrics.lookupSeconds[d] = s.GetOrCreateHistogram(fmt.Sprintf(`aggregator_lookup_seconds{domain="%s"}`, h.filenameBase))
+	}
+}
+
+func (m *aggMetrics) built(start time.Time, sf AggV3StaticFiles) {
+	if m == nil {
+		return
+	}
+	m.buildSeconds.UpdateDuration(start)
+	m.buildBytes.Add(int(sf.size()))
+}
+
+func (m *aggMetrics) merged(start time.Time, outs SelectedStaticFilesV3, in MergedFilesV3) {
+	if m == nil {
+		return
+	}
+	m.mergeSeconds.UpdateDuration(start)
+	var files int
+	for _, group := range [][]*filesItem{outs.accountsIdx, outs.accountsHist, outs.storageIdx, outs.storageHist, outs.codeIdx, outs.codeHist,
+		outs.logAddrs, outs.logTopics, outs.tracesFrom, outs.tracesTo} {
+		files += len(group)
+	}
+	m.mergedFiles.Add(files)
+	m.mergeBytes.Add(int(in.size()))
+}
+
+func (m *aggMetrics) pruned(start time.Time) {
+	if m != nil {
+		m.pruneSeconds.UpdateDuration(start)
+	}
+}
+
+func (m *aggMetrics) flushed(start time.Time) {
+	if m != nil {
+		m.flushSeconds.UpdateDuration(start)
+	}
+}
+
+func (m *aggMetrics) lookup(start time.Time, domain kv.Domain, inHistory bool) {
+	if m == nil {
+		return
+	}
+	if h, ok := m.lookupSeconds[domain]; ok {
+		h.UpdateDuration(start)
+	}
+	if inHistory {
+		m.lookupHistory.Inc()
+	} else {
+		m.lookupLatest.Inc()
+	}
+}
+
+func (m *aggMetrics) context(reused bool) {
+	if m == nil {
+		return
+	}
+	if reused {
+		m.ctxHit.Inc()
+	} else {
+		m.ctxMiss.Inc()
+	}
+}
+
+// size - bytes of histories and indices files (without latest state)
+func (sf AggV3StaticFiles) size() (size uint64) {
+	for _, f := range []HistoryFiles{sf.accounts, sf.storage, sf.code} {
+		size += filesSize(f.historyDecomp, f.historyIdx) + filesSize(f.efHistoryDecomp, f.efHistoryIdx)
+	}
+	for _, f := range []InvertedFiles{sf.logAddrs, sf.logTopics, sf.tracesFrom, sf.tracesTo} {
+		size += filesSize(f.decomp, f.index)
+	}
+	return size
+}
+
+func (mf MergedFilesV3) size() (size uint64) {
+	for _, item := range []*filesItem{mf.accountsIdx, mf.accountsHist, mf.storageIdx, mf.storageHist, mf.codeIdx, mf.codeHist,
+		mf.logAddrs, mf.logTopics, mf.tracesFrom, mf.tracesTo} {
+		if item != nil {
+			size += filesSize(item.decompressor, item.index)
+		}
+	}
+	return size
+}
+
+func filesSize(d *compress.Decompressor, idx *recsplit.Index) (size uint64) {
+	if d != nil {
+		size += uint64(d.Size())
+	}
+	if idx != nil {
+		size += uint64(idx.Size())
+	}
+	return size
+}
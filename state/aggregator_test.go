@@ -14,6 +14,7 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ledgerwatch/erigon-lib/commitment"
 	"github.com/ledgerwatch/erigon-lib/common/length"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
@@ -426,4 +427,74 @@ func Test_EncodeCommitmentState(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualValues(t, cs.txNum, dec.txNum)
 	require.EqualValues(t, cs.trieState, dec.trieState)
+	require.EqualValues(t, "", dec.scheme)
+
+	cs.scheme = "custom"
+	buf, err = cs.Encode()
+	require.NoError(t, err)
+	err = dec.Decode(buf)
+	require.NoError(t, err)
+	require.EqualValues(t, cs.trieState, dec.trieState)
+	require.EqualValues(t, "custom", dec.scheme)
+
+	// state written before scheme was stored - ethereum
+	legacy := buf[:18+len(cs.trieState)]
+	err = dec.Decode(legacy)
+	require.NoError(t, err)
+	require.EqualValues(t, commitment.EthereumScheme.Name, dec.scheme)
+	require.Error(t, dec.Decode(legacy[:len(legacy)-1]))
+}
+
+func TestAggregator_CommitmentSchemeAccountExtra(t *testing.T) {
+	// application keeps one chain-specific byte after regular account fields
+	scheme := commitment.Scheme{
+		Name:         "eth-extra",
+		NewKeyHasher: commitment.EthereumScheme.NewKeyHasher,
+		EncodeAccount: func(buf []byte, cell *commitment.Cell, storageRootHash [length.Hash]byte) []byte {
+			buf = commitment.EncodeEthAccount(buf, cell, storageRootHash)
+			return append(buf, cell.Extra[:cell.ExtraLen]...)
+		},
+		DecodeAccountExtra: func(encAccount []byte) []byte { return encAccount[len(encAccount)-1:] },
+	}
+
+	rootHash := func(t *testing.T, mode CommitmentMode, s *commitment.Scheme, extra byte) []byte {
+		t.Helper()
+		_, db, agg := testDbAndAggregator(t, 0, 16)
+		agg.SetCommitmentMode(mode)
+		if s != nil {
+			require.NoError(t, agg.SetCommitmentScheme(*s))
+		}
+		tx, err := db.BeginRw(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		agg.SetTx(tx)
+		defer agg.StartWrites().FinishWrites()
+
+		rnd := rand.New(rand.NewSource(0))
+		for txNum := uint64(1); txNum <= 8; txNum++ {
+			agg.SetTxNum(txNum)
+			addr := make([]byte, length.Addr)
+			_, err = rnd.Read(addr)
+			require.NoError(t, err)
+			acc := append(EncodeAccountBytes(txNum, uint256.NewInt(txNum*100), nil, 0), extra)
+			require.NoError(t, agg.UpdateAccountData(addr, acc))
+			require.NoError(t, agg.FinishTx())
+		}
+		root, err := agg.ComputeCommitment(false, false)
+		require.NoError(t, err)
+		return root
+	}
+
+	for _, mode := range []CommitmentMode{CommitmentModeDirect, CommitmentModeUpdate} {
+		mode := mode
+		t.Run(fmt.Sprintf("mode=%d", mode), func(t *testing.T) {
+			// extra bytes are ignored by schemes which do not decode them
+			require.EqualValues(t, rootHash(t, mode, nil, 1), rootHash(t, mode, nil, 2))
+
+			root1 := rootHash(t, mode, &scheme, 1)
+			require.EqualValues(t, root1, rootHash(t, mode, &scheme, 1))
+			require.NotEqualValues(t, root1, rootHash(t, mode, &scheme, 2))
+			require.NotEqualValues(t, root1, rootHash(t, mode, nil, 1))
+		})
+	}
 }
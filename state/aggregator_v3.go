@@ -22,14 +22,17 @@ import (
 	"errors"
 	"fmt"
 	math2 "math"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/mmap"
 	"github.com/ledgerwatch/log/v3"
 	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
@@ -37,9 +40,11 @@ import (
 
 	common2 "github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/cmp"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
-	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
 )
 
 type AggregatorV3 struct {
@@ -60,22 +65,49 @@ type AggregatorV3 struct {
 	aggregationStep  uint64
 	keepInDB         uint64
 	maxTxNum         atomic.Uint64
+	maxTxNumSubs     subs[uint64]     // see OnMaxTxNumAdvance
+	filesSubs        subs[FilesEvent] // see OnNewFiles
+	warmup           warmupScheduler
+	madvPolicy       atomic.Pointer[MadvPolicy] // see SetMadvPolicy
 
 	openCloseLock sync.Mutex
+	// filesLock - serializes changes of files set: build, merge and expiry write new files into folder before
+	// they are integrated, ReopenFolder would open them second time. Readers don't need it: see newFilesTree
+	filesLock sync.Mutex
 
 	working                atomic.Bool
 	workingMerge           atomic.Bool
 	workingOptionalIndices atomic.Bool
-	warmupWorking          atomic.Bool
+	workingTranscode       atomic.Bool   // see TranscodeFilesInBackground
+	written                atomic.Uint64 // bytes of built and merged files, see RetireBlocksUpTo
 	ctx                    context.Context
 	ctxCancel              context.CancelFunc
 
+	// filesGen - incremented after each change of files set (or closing of idle files).
+	// contexts in ctxPool can be reused only if files set didn't change. See GetContext.
+	filesGen atomic.Uint64
+	ctxPool  sync.Pool
+
+	pruneHorizons *PruneHorizons
+
+	latestStateReader LatestStateReader // see GetAsOf
+	latest            *latestState      // see EnableLatestState
+
+	commitmentInvalidator atomic.Pointer[CommitmentInvalidator] // see SetCommitmentInvalidator
+
+	cpuLimit      *background.CPULimit // see SetBackgroundCPULimit
+	cold          *coldStorage         // see SetColdStorage
+	metrics       *aggMetrics          // see RegisterMetrics
+	collateBudget *memBudget           // see SetCollateMemBudget
+	idxHeaders    *indexHeaderCache    // headers of recsplit indices, re-used by ReopenFolder
+	stepParts     uint64               // see SetStepParts
+
 	wg sync.WaitGroup
 }
 
 func NewAggregatorV3(ctx context.Context, dir, tmpdir string, aggregationStep uint64, db kv.RoDB) (*AggregatorV3, error) {
 	ctx, ctxCancel := context.WithCancel(ctx)
-	a := &AggregatorV3{ctx: ctx, ctxCancel: ctxCancel, dir: dir, tmpdir: tmpdir, aggregationStep: aggregationStep, backgroundResult: &BackgroundResult{}, db: db, keepInDB: 2 * aggregationStep}
+	a := &AggregatorV3{ctx: ctx, ctxCancel: ctxCancel, dir: dir, tmpdir: tmpdir, aggregationStep: aggregationStep, backgroundResult: &BackgroundResult{}, db: db, keepInDB: 2 * aggregationStep, pruneHorizons: NewPruneHorizons()}
 	var err error
 	if a.accounts, err = NewHistory(dir, a.tmpdir, aggregationStep, "accounts", kv.AccountHistoryKeys, kv.AccountIdx, kv.AccountHistoryVals, kv.AccountSettings, false /* compressVals */, nil); err != nil {
 		return nil, fmt.Errorf("ReopenFolder: %w", err)
@@ -98,13 +130,25 @@ func NewAggregatorV3(ctx context.Context, dir, tmpdir string, aggregationStep ui
 	if a.tracesTo, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "tracesto", kv.TracesToKeys, kv.TracesToIdx, false, nil); err != nil {
 		return nil, fmt.Errorf("ReopenFolder: %w", err)
 	}
+	a.collateBudget = newMemBudget(nil)
+	a.idxHeaders = newIndexHeaderCache(dir)
+	for _, ii := range a.invertedIndices() {
+		ii.collateBudget.parent = a.collateBudget
+		ii.idxHeaders = a.idxHeaders
+	}
+	a.loadDisabledIndices()
 	a.recalcMaxTxNum()
 	return a, nil
 }
 
+func (a *AggregatorV3) invertedIndices() []*InvertedIndex {
+	return []*InvertedIndex{a.accounts.InvertedIndex, a.storage.InvertedIndex, a.code.InvertedIndex, a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo}
+}
+
+// ReopenFolder - re-scans files of folder. Readers are not blocked, waits for current build or merge step.
 func (a *AggregatorV3) ReopenFolder() error {
-	a.openCloseLock.Lock()
-	defer a.openCloseLock.Unlock()
+	a.filesLock.Lock()
+	defer a.filesLock.Unlock()
 	var err error
 	if err = a.accounts.reOpenFolder(); err != nil {
 		return fmt.Errorf("ReopenFolder: %w", err)
@@ -127,17 +171,27 @@ func (a *AggregatorV3) ReopenFolder() error {
 	if err = a.tracesTo.reOpenFolder(); err != nil {
 		return fmt.Errorf("ReopenFolder: %w", err)
 	}
+	if err = a.latest.reOpenFolder(); err != nil {
+		return fmt.Errorf("ReopenFolder: %w", err)
+	}
+	if err = a.repairStepGaps(a.ctx); err != nil {
+		return fmt.Errorf("ReopenFolder: %w", err)
+	}
 	a.recalcMaxTxNum()
+	a.filesGen.Add(1)
+	a.saveIndexHeaders()
 	return nil
 }
 
 func (a *AggregatorV3) Close() {
 	a.ctxCancel()
+	a.CancelWarmup()
 	a.wg.Wait()
 
 	a.openCloseLock.Lock()
 	defer a.openCloseLock.Unlock()
 
+	a.saveIndexHeaders() // with files produced by merges since ReopenFolder
 	a.accounts.Close()
 	a.storage.Close()
 	a.code.Close()
@@ -145,22 +199,11 @@ func (a *AggregatorV3) Close() {
 	a.logTopics.Close()
 	a.tracesFrom.Close()
 	a.tracesTo.Close()
+	a.latest.close()
 }
 
-/*
-// CleanDir - remove all useless files. call it manually on startup of Main application (don't call it from utilities)
-func (a *AggregatorV3) CleanDir() {
-	a.accounts.CleanupDir()
-	a.storage.CleanupDir()
-	a.code.CleanupDir()
-	a.logAddrs.CleanupDir()
-	a.logTopics.CleanupDir()
-	a.tracesFrom.CleanupDir()
-	a.tracesTo.CleanupDir()
-}
-*/
-
 func (a *AggregatorV3) SetWorkers(i int) {
+	i = a.cpuLimit.Workers(i)
 	a.accounts.compressWorkers = i
 	a.storage.compressWorkers = i
 	a.code.compressWorkers = i
@@ -170,6 +213,121 @@ func (a *AggregatorV3) SetWorkers(i int) {
 	a.tracesTo.compressWorkers = i
 }
 
+// SetCompressTmpFiles - collation and build of files compress their ETL temp files: less temp-disk usage and IO
+// (which are tens of GB per step), more CPU
+func (a *AggregatorV3) SetCompressTmpFiles(v bool) {
+	a.accounts.compressTmp = v
+	a.storage.compressTmp = v
+	a.code.compressTmp = v
+	a.logAddrs.compressTmp = v
+	a.logTopics.compressTmp = v
+	a.tracesFrom.compressTmp = v
+	a.tracesTo.compressTmp = v
+}
+
+// SetCollateMemBudget - RAM budget of index bitmaps collected by collation, shared by all entities (0 - unlimited).
+// Bitmaps of step which don't fit into budget are spilled to tmpdir - collation becomes slower, but doesn't OOM.
+// Only bitmaps are budgeted: history values are streamed into compressor, and etl buffers (WAL collectors,
+// spill buffers) have fixed sizes of their own - account for them separately.
+// Per-entity budgets: SetCollateEntityMemBudget.
+func (a *AggregatorV3) SetCollateMemBudget(limit datasize.ByteSize) {
+	a.collateBudget.limit.Store(limit.Bytes())
+}
+
+// SetCollateEntityMemBudget - RAM budget of index bitmaps collected by collation of `entity` ("accounts", "storage",
+// "code", "logaddrs", "logtopics", "tracesfrom", "tracesto"), 0 - unlimited. Global budget is respected too, see
+// SetCollateMemBudget.
+func (a *AggregatorV3) SetCollateEntityMemBudget(entity string, limit datasize.ByteSize) error {
+	for _, ii := range a.invertedIndices() {
+		if ii.filenameBase == entity {
+			ii.collateBudget.limit.Store(limit.Bytes())
+			return nil
+		}
+	}
+	return fmt.Errorf("SetCollateEntityMemBudget: unknown entity %s", entity)
+}
+
+// SetLocalityIndexShards - see LocalityIndex.SetShards
+func (a *AggregatorV3) SetLocalityIndexShards(bits uint8, workers int) {
+	workers = a.cpuLimit.Workers(workers)
+	a.accounts.localityIndex.SetShards(bits, workers)
+	a.storage.localityIndex.SetShards(bits, workers)
+	a.code.localityIndex.SetShards(bits, workers)
+}
+
+// SetDedupHistoryValues - see History.SetDedupValues: for code and storage, which values are big and rarely change.
+// Must be same across restarts of node.
+func (a *AggregatorV3) SetDedupHistoryValues(v bool) {
+	a.storage.SetDedupValues(v)
+	a.code.SetDedupValues(v)
+}
+
+// SetSkipNoopHistoryWrites - see History.SetSkipNoopWrites: no-op SSTOREs and touches of accounts without change
+// are not recorded. Can be changed between restarts of node.
+func (a *AggregatorV3) SetSkipNoopHistoryWrites(v bool) {
+	a.accounts.SetSkipNoopWrites(v)
+	a.storage.SetSkipNoopWrites(v)
+	a.code.SetSkipNoopWrites(v)
+}
+
+// SetHistoryBlobThreshold - see History.SetBlobThreshold: for code, which values are multi-kilobyte contracts.
+// Must be same across restarts of node.
+func (a *AggregatorV3) SetHistoryBlobThreshold(n int) {
+	a.code.SetBlobThreshold(n)
+}
+
+// SetHistoryBtIndex - see InvertedIndex.SetBtIndex: WalkAsOf and IterateChanged of narrow ranges don't read files from start.
+// Missing .efbt files are built by BuildMissedIndices.
+func (a *AggregatorV3) SetHistoryBtIndex(v bool) {
+	a.accounts.SetBtIndex(v)
+	a.storage.SetBtIndex(v)
+	a.code.SetBtIndex(v)
+}
+
+// SetBackgroundCPULimit - all background work (collate and build of files, merge, build of indices and locality indices)
+// uses at most l.Limit() CPUs together - to not starve blocks execution. Compression and locality index workers
+// are capped by limit. nil - no limit.
+func (a *AggregatorV3) SetBackgroundCPULimit(l *background.CPULimit) {
+	a.cpuLimit = l
+	a.SetWorkers(a.accounts.compressWorkers)
+	a.SetLocalityIndexShards(a.accounts.localityIndex.shardBits, a.accounts.localityIndex.shardWorkers)
+	a.accounts.cpuLimit = l
+	a.storage.cpuLimit = l
+	a.code.cpuLimit = l
+	a.logAddrs.cpuLimit = l
+	a.logTopics.cpuLimit = l
+	a.tracesFrom.cpuLimit = l
+	a.tracesTo.cpuLimit = l
+}
+
+// SetLazyOpen - files will be opened on first use instead of ReopenFolder. Must be called before ReopenFolder.
+// Useful for archives with thousands of files: faster startup and less address space.
+func (a *AggregatorV3) SetLazyOpen(v bool) {
+	a.accounts.SetLazyOpen(v)
+	a.storage.SetLazyOpen(v)
+	a.code.SetLazyOpen(v)
+	a.logAddrs.SetLazyOpen(v)
+	a.logTopics.SetLazyOpen(v)
+	a.tracesFrom.SetLazyOpen(v)
+	a.tracesTo.SetLazyOpen(v)
+}
+
+// CloseIdleFiles - closes lazy-opened files which are not used by any open context (for example under memory pressure).
+// They will be re-opened on next use. Files used by contexts or by steps (see MakeSteps) are not closed.
+func (a *AggregatorV3) CloseIdleFiles() (closed int) {
+	a.openCloseLock.Lock()
+	defer a.openCloseLock.Unlock()
+	a.filesGen.Add(1) // before closing: GetContext which re-acquires files concurrently drops re-used context
+	closed += a.accounts.closeIdleFiles()
+	closed += a.storage.closeIdleFiles()
+	closed += a.code.closeIdleFiles()
+	closed += a.logAddrs.closeIdleFiles()
+	closed += a.logTopics.closeIdleFiles()
+	closed += a.tracesFrom.closeIdleFiles()
+	closed += a.tracesTo.closeIdleFiles()
+	return closed
+}
+
 func (a *AggregatorV3) Files() (res []string) {
 	a.openCloseLock.Lock()
 	defer a.openCloseLock.Unlock()
@@ -181,6 +339,7 @@ func (a *AggregatorV3) Files() (res []string) {
 	res = append(res, a.logTopics.Files()...)
 	res = append(res, a.tracesFrom.Files()...)
 	res = append(res, a.tracesTo.Files()...)
+	res = append(res, a.latest.files()...)
 	return res
 }
 func (a *AggregatorV3) BuildOptionalMissedIndicesInBackground(ctx context.Context, workers int) {
@@ -202,43 +361,54 @@ func (a *AggregatorV3) BuildOptionalMissedIndicesInBackground(ctx context.Contex
 func (a *AggregatorV3) BuildOptionalMissedIndices(ctx context.Context, workers int) error {
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(workers)
-	if a.accounts != nil {
-		g.Go(func() error { return a.accounts.BuildOptionalMissedIndices(ctx) })
-	}
-	if a.storage != nil {
-		g.Go(func() error { return a.storage.BuildOptionalMissedIndices(ctx) })
-	}
-	if a.code != nil {
-		g.Go(func() error { return a.code.BuildOptionalMissedIndices(ctx) })
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		if h == nil {
+			continue
+		}
+		h := h
+		g.Go(func() error {
+			return a.cpuLimit.Do(ctx, h.localityIndex.shardWorkers, func(int) error { return h.BuildOptionalMissedIndices(ctx) })
+		})
 	}
-	return g.Wait()
+	err := g.Wait()
+	a.filesGen.Add(1)
+	return err
 }
 
+// BuildMissedIndices - builds indices of all files which don't have them.
+// Can be interrupted: after restart only not completed indices are built.
 func (a *AggregatorV3) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighted) error {
+	return a.BuildMissedIndicesWithProgress(ctx, sem, nil)
+}
+
+// BuildMissedIndicesWithProgress - BuildMissedIndices, progress of each index is added to ps (may be nil)
+func (a *AggregatorV3) BuildMissedIndicesWithProgress(ctx context.Context, sem *semaphore.Weighted, ps *background.ProgressSet) error {
 	g, ctx := errgroup.WithContext(ctx)
 	if a.accounts != nil {
-		g.Go(func() error { return a.accounts.BuildMissedIndices(ctx, sem) })
+		g.Go(func() error { return a.accounts.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
 	if a.storage != nil {
-		g.Go(func() error { return a.storage.BuildMissedIndices(ctx, sem) })
+		g.Go(func() error { return a.storage.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
 	if a.code != nil {
-		g.Go(func() error { return a.code.BuildMissedIndices(ctx, sem) })
+		g.Go(func() error { return a.code.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
-	if a.logAddrs != nil {
-		g.Go(func() error { return a.logAddrs.BuildMissedIndices(ctx, sem) })
+	if a.logAddrs != nil && !a.logAddrs.disabled.Load() {
+		g.Go(func() error { return a.logAddrs.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
-	if a.logTopics != nil {
-		g.Go(func() error { return a.logTopics.BuildMissedIndices(ctx, sem) })
+	if a.logTopics != nil && !a.logTopics.disabled.Load() {
+		g.Go(func() error { return a.logTopics.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
-	if a.tracesFrom != nil {
-		g.Go(func() error { return a.tracesFrom.BuildMissedIndices(ctx, sem) })
+	if a.tracesFrom != nil && !a.tracesFrom.disabled.Load() {
+		g.Go(func() error { return a.tracesFrom.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
-	if a.tracesTo != nil {
-		g.Go(func() error { return a.tracesTo.BuildMissedIndices(ctx, sem) })
+	if a.tracesTo != nil && !a.tracesTo.disabled.Load() {
+		g.Go(func() error { return a.tracesTo.BuildMissedIndicesWithProgress(ctx, sem, ps) })
 	}
 
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	a.filesGen.Add(1)
+	if err != nil {
 		return err
 	}
 	return a.BuildOptionalMissedIndices(ctx, 4)
@@ -269,10 +439,10 @@ func (a *AggregatorV3) SetTxNum(txNum uint64) {
 }
 
 type AggV3Collation struct {
-	logAddrs   map[string]*roaring64.Bitmap
-	logTopics  map[string]*roaring64.Bitmap
-	tracesFrom map[string]*roaring64.Bitmap
-	tracesTo   map[string]*roaring64.Bitmap
+	logAddrs   *collatedBitmaps
+	logTopics  *collatedBitmaps
+	tracesFrom *collatedBitmaps
+	tracesTo   *collatedBitmaps
 	accounts   HistoryCollation
 	storage    HistoryCollation
 	code       HistoryCollation
@@ -283,18 +453,10 @@ func (c AggV3Collation) Close() {
 	c.storage.Close()
 	c.code.Close()
 
-	for _, b := range c.logAddrs {
-		bitmapdb.ReturnToPool64(b)
-	}
-	for _, b := range c.logTopics {
-		bitmapdb.ReturnToPool64(b)
-	}
-	for _, b := range c.tracesFrom {
-		bitmapdb.ReturnToPool64(b)
-	}
-	for _, b := range c.tracesTo {
-		bitmapdb.ReturnToPool64(b)
-	}
+	c.logAddrs.close()
+	c.logTopics.close()
+	c.tracesFrom.close()
+	c.tracesTo.close()
 }
 
 func (a *AggregatorV3) buildFiles(ctx context.Context, step uint64, txFrom, txTo uint64, db kv.RoDB) (AggV3StaticFiles, error) {
@@ -303,6 +465,9 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step uint64, txFrom, txTo
 	defer func(t time.Time) {
 		log.Info(fmt.Sprintf("[snapshot] build %d-%d", step, step+1), "took", time.Since(t))
 	}(time.Now())
+	if a.stepParts > 1 {
+		return a.buildFilesByParts(ctx, step, txFrom, txTo, db)
+	}
 	var sf AggV3StaticFiles
 	var ac AggV3Collation
 	closeColl := true
@@ -366,65 +531,73 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step uint64, txFrom, txTo
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = db.View(ctx, func(tx kv.Tx) error {
-		ac.logAddrs, err = a.logAddrs.collate(ctx, txFrom, txTo, tx, logEvery)
-		return err
-	}); err != nil {
-		return sf, err
-		//errCh <- err
-	}
+	if !a.logAddrs.disabled.Load() {
+		if err = db.View(ctx, func(tx kv.Tx) error {
+			ac.logAddrs, err = a.logAddrs.collate(ctx, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 
-	if sf.logAddrs, err = a.logAddrs.buildFiles(ctx, step, ac.logAddrs); err != nil {
-		return sf, err
-		//errCh <- err
+		if sf.logAddrs, err = a.logAddrs.buildFiles(ctx, step, ac.logAddrs); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 	}
 	//}()
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = db.View(ctx, func(tx kv.Tx) error {
-		ac.logTopics, err = a.logTopics.collate(ctx, txFrom, txTo, tx, logEvery)
-		return err
-	}); err != nil {
-		return sf, err
-		//errCh <- err
-	}
+	if !a.logTopics.disabled.Load() {
+		if err = db.View(ctx, func(tx kv.Tx) error {
+			ac.logTopics, err = a.logTopics.collate(ctx, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 
-	if sf.logTopics, err = a.logTopics.buildFiles(ctx, step, ac.logTopics); err != nil {
-		return sf, err
-		//errCh <- err
+		if sf.logTopics, err = a.logTopics.buildFiles(ctx, step, ac.logTopics); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 	}
 	//}()
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = db.View(ctx, func(tx kv.Tx) error {
-		ac.tracesFrom, err = a.tracesFrom.collate(ctx, txFrom, txTo, tx, logEvery)
-		return err
-	}); err != nil {
-		return sf, err
-		//errCh <- err
-	}
+	if !a.tracesFrom.disabled.Load() {
+		if err = db.View(ctx, func(tx kv.Tx) error {
+			ac.tracesFrom, err = a.tracesFrom.collate(ctx, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 
-	if sf.tracesFrom, err = a.tracesFrom.buildFiles(ctx, step, ac.tracesFrom); err != nil {
-		return sf, err
-		//errCh <- err
+		if sf.tracesFrom, err = a.tracesFrom.buildFiles(ctx, step, ac.tracesFrom); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 	}
 	//}()
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = db.View(ctx, func(tx kv.Tx) error {
-		ac.tracesTo, err = a.tracesTo.collate(ctx, txFrom, txTo, tx, logEvery)
-		return err
-	}); err != nil {
-		return sf, err
-		//errCh <- err
-	}
+	if !a.tracesTo.disabled.Load() {
+		if err = db.View(ctx, func(tx kv.Tx) error {
+			ac.tracesTo, err = a.tracesTo.collate(ctx, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+			//errCh <- err
+		}
 
-	if sf.tracesTo, err = a.tracesTo.buildFiles(ctx, step, ac.tracesTo); err != nil {
-		return sf, err
-		//		errCh <- err
+		if sf.tracesTo, err = a.tracesTo.buildFiles(ctx, step, ac.tracesTo); err != nil {
+			return sf, err
+			//		errCh <- err
+		}
 	}
 	//}()
 	//go func() {
@@ -438,6 +611,9 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step uint64, txFrom, txTo
 	//	}
 	//}
 	//if lastError == nil {
+	if sf.latest, err = a.latest.buildFiles(ctx, step, txFrom, txTo, db, logEvery); err != nil {
+		return sf, err
+	}
 	closeColl = false
 	//}
 	return sf, nil
@@ -451,6 +627,7 @@ type AggV3StaticFiles struct {
 	logTopics  InvertedFiles
 	tracesFrom InvertedFiles
 	tracesTo   InvertedFiles
+	latest     latestStateFiles
 }
 
 func (sf AggV3StaticFiles) Close() {
@@ -461,6 +638,7 @@ func (sf AggV3StaticFiles) Close() {
 	sf.logTopics.Close()
 	sf.tracesFrom.Close()
 	sf.tracesTo.Close()
+	sf.latest.Close()
 }
 
 func (a *AggregatorV3) BuildFiles(ctx context.Context, db kv.RoDB) (err error) {
@@ -485,26 +663,41 @@ func (a *AggregatorV3) BuildFiles(ctx context.Context, db kv.RoDB) (err error) {
 }
 
 func (a *AggregatorV3) buildFilesInBackground(ctx context.Context, step uint64, db kv.RoDB) (err error) {
+	a.filesLock.Lock()
+	defer a.filesLock.Unlock()
 	closeAll := true
 	log.Info("[snapshots] history build", "step", fmt.Sprintf("%d-%d", step, step+1))
-	sf, err := a.buildFiles(ctx, step, step*a.aggregationStep, (step+1)*a.aggregationStep, db)
-	if err != nil {
+	var sf AggV3StaticFiles
+	start := time.Now()
+	if err = a.cpuLimit.Do(ctx, a.accounts.compressWorkers, func(int) error {
+		sf, err = a.buildFiles(ctx, step, step*a.aggregationStep, (step+1)*a.aggregationStep, db)
+		return err
+	}); err != nil {
 		return err
 	}
+	a.metrics.built(start, sf)
+	a.written.Add(sf.size())
 	defer func() {
 		if closeAll {
 			sf.Close()
 		}
 	}()
 	a.integrateFiles(sf, step*a.aggregationStep, (step+1)*a.aggregationStep)
+	a.removeParts(step + 1)
 
 	closeAll = false
 	return nil
 }
 
 func (a *AggregatorV3) mergeLoopStep(ctx context.Context, workers int) (somethingDone bool, err error) {
+	a.filesLock.Lock()
+	defer a.filesLock.Unlock()
 	closeAll := true
 	maxSpan := a.aggregationStep * StepsInBiggestFile
+	if somethingDone, err = a.latest.mergeLoopStep(ctx, a.maxTxNum.Load(), maxSpan, workers); somethingDone {
+		a.filesGen.Add(1)
+		return somethingDone, err
+	}
 	r := a.findMergeRange(a.maxTxNum.Load(), maxSpan)
 	if !r.any() {
 		return false, nil
@@ -523,16 +716,23 @@ func (a *AggregatorV3) mergeLoopStep(ctx context.Context, workers int) (somethin
 		return false, err
 	}
 
+	start := time.Now()
 	in, err := a.mergeFiles(ctx, outs, r, maxSpan, workers)
 	if err != nil {
 		return true, err
 	}
+	a.metrics.merged(start, outs, in)
+	a.written.Add(in.size())
 	defer func() {
 		if closeAll {
 			in.Close()
 		}
 	}()
+	if err = a.markLeased(ctx, outs); err != nil {
+		return true, err
+	}
 	a.integrateMergedFiles(outs, in)
+	a.updateLocalityIndices(ctx, in)
 	a.cleanAfterFreeze(in)
 	closeAll = false
 	return true, nil
@@ -553,24 +753,29 @@ func (a *AggregatorV3) integrateFiles(sf AggV3StaticFiles, txNumFrom, txNumTo ui
 	a.accounts.integrateFiles(sf.accounts, txNumFrom, txNumTo)
 	a.storage.integrateFiles(sf.storage, txNumFrom, txNumTo)
 	a.code.integrateFiles(sf.code, txNumFrom, txNumTo)
-	a.logAddrs.integrateFiles(sf.logAddrs, txNumFrom, txNumTo)
-	a.logTopics.integrateFiles(sf.logTopics, txNumFrom, txNumTo)
-	a.tracesFrom.integrateFiles(sf.tracesFrom, txNumFrom, txNumTo)
-	a.tracesTo.integrateFiles(sf.tracesTo, txNumFrom, txNumTo)
+	for _, f := range []struct {
+		ii *InvertedIndex
+		sf InvertedFiles
+	}{{a.logAddrs, sf.logAddrs}, {a.logTopics, sf.logTopics}, {a.tracesFrom, sf.tracesFrom}, {a.tracesTo, sf.tracesTo}} {
+		if !f.ii.disabled.Load() { // files of disabled index are not built
+			f.ii.integrateFiles(f.sf, txNumFrom, txNumTo)
+		}
+	}
+	a.latest.integrateFiles(sf.latest, txNumFrom, txNumTo)
+	a.filesGen.Add(1)
 	a.recalcMaxTxNum()
+	if f := a.commitmentInvalidator.Load(); f != nil {
+		a.latest.notify(*f, txNumFrom/a.aggregationStep, sf.latest)
+	}
+	a.notifyNewFiles(false, sf.fileNames(), nil)
 }
 
+// Unwind - restores state of accounts and storage to txUnwindTo (via stateLoad into kv.PlainState) and removes all history after it.
+// Accounts and storage histories are unwound in 1 pass, see unwindHistories.
 func (a *AggregatorV3) Unwind(ctx context.Context, txUnwindTo uint64, stateLoad etl.LoadFunc) error {
 	stateChanges := etl.NewCollector(a.logPrefix, a.tmpdir, etl.NewOldestEntryBuffer(etl.BufferOptimalSize))
 	defer stateChanges.Close()
-	if err := a.accounts.pruneF(txUnwindTo, math2.MaxUint64, func(_ uint64, k, v []byte) error {
-		return stateChanges.Collect(k, v)
-	}); err != nil {
-		return err
-	}
-	if err := a.storage.pruneF(txUnwindTo, math2.MaxUint64, func(_ uint64, k, v []byte) error {
-		return stateChanges.Collect(k, v)
-	}); err != nil {
+	if err := unwindHistories(ctx, a.logPrefix, a.tmpdir, txUnwindTo, stateChanges.Collect, a.accounts, a.storage); err != nil {
 		return err
 	}
 
@@ -594,50 +799,6 @@ func (a *AggregatorV3) Unwind(ctx context.Context, txUnwindTo uint64, stateLoad
 	return nil
 }
 
-func (a *AggregatorV3) Warmup(ctx context.Context, txFrom, limit uint64) {
-	if a.db == nil {
-		return
-	}
-	if limit < 10_000 {
-		return
-	}
-	if a.warmupWorking.Load() {
-		return
-	}
-	a.warmupWorking.Store(true)
-	a.wg.Add(1)
-	go func() {
-		defer a.wg.Done()
-		defer a.warmupWorking.Store(false)
-		if err := a.db.View(ctx, func(tx kv.Tx) error {
-			if err := a.accounts.warmup(ctx, txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.storage.warmup(ctx, txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.code.warmup(ctx, txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.logAddrs.warmup(txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.logTopics.warmup(txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.tracesFrom.warmup(txFrom, limit, tx); err != nil {
-				return err
-			}
-			if err := a.tracesTo.warmup(txFrom, limit, tx); err != nil {
-				return err
-			}
-			return nil
-		}); err != nil {
-			log.Warn("[snapshots] prune warmup", "err", err)
-		}
-	}()
-}
-
 // StartWrites - pattern: `defer agg.StartWrites().FinishWrites()`
 func (a *AggregatorV3) DiscardHistory() *AggregatorV3 {
 	a.accounts.DiscardHistory(a.tmpdir)
@@ -686,6 +847,7 @@ func (a *AggregatorV3) Flush(ctx context.Context, tx kv.RwTx) error {
 		a.tracesTo.Rotate(),
 	}
 	defer func(t time.Time) { log.Debug("[snapshots] history flush", "took", time.Since(t)) }(time.Now())
+	defer a.metrics.flushed(time.Now())
 	for _, f := range flushers {
 		if err := f.Flush(ctx, tx); err != nil {
 			return err
@@ -694,29 +856,64 @@ func (a *AggregatorV3) Flush(ctx context.Context, tx kv.RwTx) error {
 	return nil
 }
 
-func (a *AggregatorV3) CanPrune(tx kv.Tx) bool { return a.CanPruneFrom(tx) < a.maxTxNum.Load() }
+// CanPrune - true if any entity has in db data which is already in files and is not held by prune horizons or leases
+func (a *AggregatorV3) CanPrune(tx kv.Tx) bool { return a.canPrune(tx, a.maxTxNum.Load()) }
+
+func (a *AggregatorV3) canPrune(tx kv.Tx, txTo uint64) bool {
+	ls, err := a.activeLeases(tx)
+	if err != nil {
+		return true // let Prune report error
+	}
+	historyTxTo := ls.pruneLimit(0, txTo)
+	for name, from := range a.PruneFrontiers(tx) {
+		if from < a.pruneHorizons.limit(name, historyTxTo) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPruneFrom - minimal prune frontier of all entities, math.MaxUint64 if db has nothing to prune
 func (a *AggregatorV3) CanPruneFrom(tx kv.Tx) uint64 {
-	fst, _ := kv.FirstKey(tx, kv.TracesToKeys)
-	fst2, _ := kv.FirstKey(tx, kv.StorageHistoryKeys)
-	if len(fst) > 0 && len(fst2) > 0 {
-		fstInDb := binary.BigEndian.Uint64(fst)
-		fstInDb2 := binary.BigEndian.Uint64(fst2)
-		return cmp.Min(fstInDb, fstInDb2)
+	res := uint64(math2.MaxUint64)
+	for _, from := range a.PruneFrontiers(tx) {
+		res = cmp.Min(res, from)
 	}
-	return math2.MaxUint64
+	return res
 }
 
-func (a *AggregatorV3) PruneWithTiemout(ctx context.Context, timeout time.Duration) error {
+// PruneFrontiers - first txNum in db of each entity ("accounts", "storage", "code", "logaddrs", "logtopics", "tracesfrom",
+// "tracesto"): everything below it is pruned already. math.MaxUint64 - entity has no data in db.
+// Disabled indices are not pruned, so they are not reported.
+func (a *AggregatorV3) PruneFrontiers(tx kv.Tx) map[string]uint64 {
+	res := make(map[string]uint64, 7)
+	for _, ii := range []*InvertedIndex{a.accounts.InvertedIndex, a.storage.InvertedIndex, a.code.InvertedIndex,
+		a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if ii.disabled.Load() {
+			continue
+		}
+		res[ii.filenameBase] = ii.pruneFrontier(tx)
+	}
+	return res
+}
+
+// PruneWithTiemout - prunes by small portions until nothing to prune or `timeout`. Stat of all portions is accumulated.
+func (a *AggregatorV3) PruneWithTiemout(ctx context.Context, timeout time.Duration) (*PruneStat, error) {
 	t := time.Now()
+	stat := &PruneStat{}
 	for a.CanPrune(a.rwTx) && time.Since(t) < timeout {
-		if err := a.Prune(ctx, 1_000); err != nil { // prune part of retired data, before commit
-			return err
+		s, err := a.Prune(ctx, 1_000) // prune part of retired data, before commit
+		if err != nil {
+			return stat, err
 		}
+		stat.Accumulate(s)
 	}
-	return nil
+	return stat, nil
 }
 
-func (a *AggregatorV3) Prune(ctx context.Context, limit uint64) error {
+// Prune - removes from db data which is already in files: at most `limit` txs of each entity.
+// Returned stat is not nil: on error it has stat of entities pruned before error.
+func (a *AggregatorV3) Prune(ctx context.Context, limit uint64) (*PruneStat, error) {
 	//ctx, cancel := context.WithCancel(ctx)
 	//defer cancel()
 	//go func() {
@@ -725,29 +922,73 @@ func (a *AggregatorV3) Prune(ctx context.Context, limit uint64) error {
 	return a.prune(ctx, 0, a.maxTxNum.Load(), limit)
 }
 
-func (a *AggregatorV3) prune(ctx context.Context, txFrom, txTo, limit uint64) error {
+func (a *AggregatorV3) prune(ctx context.Context, txFrom, txTo, limit uint64) (*PruneStat, error) {
+	stat := &PruneStat{}
+	defer func(t time.Time) { stat.Took = time.Since(t) }(time.Now())
+	defer a.metrics.pruned(time.Now())
+	defer a.warmup.trackPrune(a.rwTx, a.warmupTargets())()
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
-	if err := a.accounts.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	if err := a.pruneExpiredLeases(a.rwTx); err != nil {
+		return stat, err
 	}
-	if err := a.storage.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	ls, err := a.activeLeases(a.rwTx)
+	if err != nil {
+		return stat, err
 	}
-	if err := a.code.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	hs := a.pruneHorizons
+	historyTxTo := ls.pruneLimit(txFrom, txTo)
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		if err := h.pruneWithStat(ctx, txFrom, hs.limit(h.filenameBase, historyTxTo), limit, logEvery, stat.entity(h.filenameBase)); err != nil {
+			return stat, err
+		}
 	}
-	if err := a.logAddrs.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if ii.disabled.Load() { // db keeps data of disabled index for catch-up by EnableIndex
+			continue
+		}
+		if err := ii.pruneWithStat(ctx, txFrom, hs.limit(ii.filenameBase, historyTxTo), limit, logEvery, stat.entity(ii.filenameBase)); err != nil {
+			return stat, err
+		}
 	}
-	if err := a.logTopics.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	return stat, a.latest.prune(ctx, txTo, logEvery, stat)
+}
+
+// RegisterPruneHorizon - reader of inverted index `index` ("logaddrs", "logtopics", "tracesfrom", "tracesto",
+// "accounts", "storage", "code") declares oldest txNum it still needs. Prune of this index in DB and expiry of its files
+// (see ExpireHistory) respect the deepest registration. Call Release when reader doesn't need data anymore.
+func (a *AggregatorV3) RegisterPruneHorizon(index string, oldestNeededTxNum uint64) (*PruneHorizon, error) {
+	switch index {
+	case a.accounts.filenameBase, a.storage.filenameBase, a.code.filenameBase,
+		a.logAddrs.filenameBase, a.logTopics.filenameBase, a.tracesFrom.filenameBase, a.tracesTo.filenameBase:
+	default:
+		return nil, fmt.Errorf("RegisterPruneHorizon: unknown index %s", index)
 	}
-	if err := a.tracesFrom.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	return a.pruneHorizons.Register(index, oldestNeededTxNum), nil
+}
+
+func (a *AggregatorV3) PruneHorizons() *PruneHorizons { return a.pruneHorizons }
+
+// ExpireHistory - permanently removes histories and indices older than horizonTxNum (partial-archive node).
+// Horizon of each index is limited by its prune horizons (see RegisterPruneHorizon).
+// Reads below horizon return ErrHistoryPruned. See InvertedIndex.ExpireHistory.
+func (a *AggregatorV3) ExpireHistory(ctx context.Context, horizonTxNum uint64) error {
+	if !a.workingMerge.CompareAndSwap(false, true) {
+		return fmt.Errorf("ExpireHistory: merge is in progress")
 	}
-	if err := a.tracesTo.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	defer a.workingMerge.Store(false)
+	a.filesLock.Lock()
+	defer a.filesLock.Unlock()
+	defer a.filesGen.Add(1)
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		if err := h.ExpireHistory(ctx, a.pruneHorizons.limit(h.filenameBase, horizonTxNum)); err != nil {
+			return err
+		}
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if err := ii.ExpireHistory(ctx, a.pruneHorizons.limit(ii.filenameBase, horizonTxNum)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -757,8 +998,8 @@ func (a *AggregatorV3) LogStats(tx kv.Tx, tx2block func(endTxNumMinimax uint64)
 		return
 	}
 	histBlockNumProgress := tx2block(a.maxTxNum.Load())
-	str := make([]string, 0, a.accounts.InvertedIndex.files.Len())
-	a.accounts.InvertedIndex.files.Walk(func(items []*filesItem) bool {
+	str := make([]string, 0, a.accounts.InvertedIndex.files.Load().Len())
+	a.accounts.InvertedIndex.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			bn := tx2block(item.endTxNum)
 			str = append(str, fmt.Sprintf("%d=%dK", item.endTxNum/a.aggregationStep, bn/1_000))
@@ -801,27 +1042,120 @@ func (a *AggregatorV3) EndTxNumFrozenAndIndexed() uint64 {
 		a.code.endIndexedTxNumMinimax(true),
 	)
 }
+
+// recalcMaxTxNum - minimum of memoized endTxNum of all domains (updated on each change of their files), notifies
+// subscribers of OnMaxTxNumAdvance if it advanced
 func (a *AggregatorV3) recalcMaxTxNum() {
 	min := a.accounts.endTxNumMinimax()
-	if txNum := a.storage.endTxNumMinimax(); txNum < min {
-		min = txNum
+	for _, h := range []*History{a.storage, a.code} {
+		if txNum := h.endTxNumMinimax(); txNum < min {
+			min = txNum
+		}
 	}
-	if txNum := a.code.endTxNumMinimax(); txNum < min {
-		min = txNum
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if ii.disabled.Load() {
+			continue
+		}
+		if txNum := ii.endTxNumMinimax(); txNum < min {
+			min = txNum
+		}
 	}
-	if txNum := a.logAddrs.endTxNumMinimax(); txNum < min {
-		min = txNum
+	if prev := a.maxTxNum.Swap(min); min > prev {
+		a.reapplyMadvPolicy()
+		a.maxTxNumSubs.pub(min)
 	}
-	if txNum := a.logTopics.endTxNumMinimax(); txNum < min {
-		min = txNum
+}
+
+// OnMaxTxNumAdvance - subscription to advance of EndTxNumMinimax (instead of polling it): channel receives new value
+// after files of all domains cover more txs. Slow reader looses old values, not new ones. Call unsubscribe when done.
+func (a *AggregatorV3) OnMaxTxNumAdvance() (ch <-chan uint64, unsubscribe func()) {
+	return a.maxTxNumSubs.sub()
+}
+
+// FilesEvent - files were integrated into aggregator, see OnNewFiles
+type FilesEvent struct {
+	MaxTxNum uint64   // EndTxNumMinimax after integration
+	Merged   bool     // Files are result of merge, otherwise of freeze of 1 step
+	Files    []string // names of new .v and .ef files
+	Replaced []string // names of files replaced by merged Files: they are removed when not used anymore
+}
+
+// OnNewFiles - subscription to integration of new files (after freeze of step and after merge): dependent services
+// (seeding, caches, stats) don't need to poll EndTxNumMinimax. Slow reader looses old events, not new ones:
+// it can re-read Files(). Call unsubscribe when done.
+func (a *AggregatorV3) OnNewFiles() (ch <-chan FilesEvent, unsubscribe func()) {
+	return a.filesSubs.sub()
+}
+
+func (a *AggregatorV3) notifyNewFiles(merged bool, files, replaced []string) {
+	if len(files) == 0 {
+		return
 	}
-	if txNum := a.tracesFrom.endTxNumMinimax(); txNum < min {
-		min = txNum
+	a.filesSubs.pub(FilesEvent{MaxTxNum: a.maxTxNum.Load(), Merged: merged, Files: files, Replaced: replaced})
+}
+
+func (sf AggV3StaticFiles) fileNames() (res []string) {
+	for _, h := range []HistoryFiles{sf.accounts, sf.storage, sf.code} {
+		for _, d := range []*compress.Decompressor{h.historyDecomp, h.efHistoryDecomp} {
+			if d != nil {
+				res = append(res, d.FileName())
+			}
+		}
 	}
-	if txNum := a.tracesTo.endTxNumMinimax(); txNum < min {
-		min = txNum
+	for _, ii := range []InvertedFiles{sf.logAddrs, sf.logTopics, sf.tracesFrom, sf.tracesTo} {
+		if ii.decomp != nil {
+			res = append(res, ii.decomp.FileName())
+		}
+	}
+	return res
+}
+
+func filesItemNames(res []string, items ...*filesItem) []string {
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		if item.decompressor != nil {
+			res = append(res, item.decompressor.FileName())
+		} else if item.datPath != "" {
+			res = append(res, filepath.Base(item.datPath))
+		}
+	}
+	return res
+}
+
+// subs - subscribers of aggregator's events
+type subs[T any] struct {
+	chans map[uint64]chan T
+	id    uint64
+	lock  sync.Mutex
+}
+
+func (s *subs[T]) sub() (<-chan T, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.chans == nil {
+		s.chans = make(map[uint64]chan T)
+	}
+	s.id++
+	id, ch := s.id, make(chan T, 8)
+	s.chans[id] = ch
+	return ch, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if ch, ok := s.chans[id]; ok {
+			close(ch)
+			delete(s.chans, id)
+		}
+	}
+}
+
+func (s *subs[T]) pub(v T) {
+	s.lock.Lock() // not RLock: senders must not race for place in full channel
+	defer s.lock.Unlock()
+	for _, ch := range s.chans {
+		common2.PrioritizedSend(ch, v)
 	}
-	a.maxTxNum.Store(min)
 }
 
 type RangesV3 struct {
@@ -851,10 +1185,18 @@ func (a *AggregatorV3) findMergeRange(maxEndTxNum, maxSpan uint64) RangesV3 {
 	r.accounts = a.accounts.findMergeRange(maxEndTxNum, maxSpan)
 	r.storage = a.storage.findMergeRange(maxEndTxNum, maxSpan)
 	r.code = a.code.findMergeRange(maxEndTxNum, maxSpan)
-	r.logAddrs, r.logAddrsStartTxNum, r.logAddrsEndTxNum = a.logAddrs.findMergeRange(maxEndTxNum, maxSpan)
-	r.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum = a.logTopics.findMergeRange(maxEndTxNum, maxSpan)
-	r.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum = a.tracesFrom.findMergeRange(maxEndTxNum, maxSpan)
-	r.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum = a.tracesTo.findMergeRange(maxEndTxNum, maxSpan)
+	if !a.logAddrs.disabled.Load() {
+		r.logAddrs, r.logAddrsStartTxNum, r.logAddrsEndTxNum = a.logAddrs.findMergeRange(maxEndTxNum, maxSpan)
+	}
+	if !a.logTopics.disabled.Load() {
+		r.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum = a.logTopics.findMergeRange(maxEndTxNum, maxSpan)
+	}
+	if !a.tracesFrom.disabled.Load() {
+		r.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum = a.tracesFrom.findMergeRange(maxEndTxNum, maxSpan)
+	}
+	if !a.tracesTo.disabled.Load() {
+		r.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum = a.tracesTo.findMergeRange(maxEndTxNum, maxSpan)
+	}
 	//log.Info(fmt.Sprintf("findMergeRange(%d, %d)=%+v\n", maxEndTxNum, maxSpan, r))
 	return r
 }
@@ -966,52 +1308,66 @@ func (a *AggregatorV3) mergeFiles(ctx context.Context, files SelectedStaticFiles
 	}()
 	if r.accounts.any() {
 		g.Go(func() error {
-			var err error
-			mf.accountsIdx, mf.accountsHist, err = a.accounts.mergeFiles(ctx, files.accountsIdx, files.accountsHist, r.accounts, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.accountsIdx, mf.accountsHist, err = a.accounts.mergeFiles(ctx, files.accountsIdx, files.accountsHist, r.accounts, workers)
+				return err
+			})
 		})
 	}
 
 	if r.storage.any() {
 		g.Go(func() error {
-			var err error
-			mf.storageIdx, mf.storageHist, err = a.storage.mergeFiles(ctx, files.storageIdx, files.storageHist, r.storage, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.storageIdx, mf.storageHist, err = a.storage.mergeFiles(ctx, files.storageIdx, files.storageHist, r.storage, workers)
+				return err
+			})
 		})
 	}
 	if r.code.any() {
 		g.Go(func() error {
-			var err error
-			mf.codeIdx, mf.codeHist, err = a.code.mergeFiles(ctx, files.codeIdx, files.codeHist, r.code, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.codeIdx, mf.codeHist, err = a.code.mergeFiles(ctx, files.codeIdx, files.codeHist, r.code, workers)
+				return err
+			})
 		})
 	}
 	if r.logAddrs {
 		g.Go(func() error {
-			var err error
-			mf.logAddrs, err = a.logAddrs.mergeFiles(ctx, files.logAddrs, r.logAddrsStartTxNum, r.logAddrsEndTxNum, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.logAddrs, err = a.logAddrs.mergeFiles(ctx, files.logAddrs, r.logAddrsStartTxNum, r.logAddrsEndTxNum, workers)
+				return err
+			})
 		})
 	}
 	if r.logTopics {
 		g.Go(func() error {
-			var err error
-			mf.logTopics, err = a.logTopics.mergeFiles(ctx, files.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.logTopics, err = a.logTopics.mergeFiles(ctx, files.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum, workers)
+				return err
+			})
 		})
 	}
 	if r.tracesFrom {
 		g.Go(func() error {
-			var err error
-			mf.tracesFrom, err = a.tracesFrom.mergeFiles(ctx, files.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.tracesFrom, err = a.tracesFrom.mergeFiles(ctx, files.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum, workers)
+				return err
+			})
 		})
 	}
 	if r.tracesTo {
 		g.Go(func() error {
-			var err error
-			mf.tracesTo, err = a.tracesTo.mergeFiles(ctx, files.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum, workers)
-			return err
+			return a.cpuLimit.Do(ctx, workers, func(workers int) error {
+				var err error
+				mf.tracesTo, err = a.tracesTo.mergeFiles(ctx, files.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum, workers)
+				return err
+			})
 		})
 	}
 	err := g.Wait()
@@ -1029,7 +1385,38 @@ func (a *AggregatorV3) integrateMergedFiles(outs SelectedStaticFilesV3, in Merge
 	a.logTopics.integrateMergedFiles(outs.logTopics, in.logTopics)
 	a.tracesFrom.integrateMergedFiles(outs.tracesFrom, in.tracesFrom)
 	a.tracesTo.integrateMergedFiles(outs.tracesTo, in.tracesTo)
+	a.filesGen.Add(1)
+
+	files := filesItemNames(nil, in.accountsHist, in.accountsIdx, in.storageHist, in.storageIdx, in.codeHist, in.codeIdx,
+		in.logAddrs, in.logTopics, in.tracesFrom, in.tracesTo)
+	var replaced []string
+	for _, group := range [][]*filesItem{outs.accountsHist, outs.accountsIdx, outs.storageHist, outs.storageIdx, outs.codeHist, outs.codeIdx,
+		outs.logAddrs, outs.logTopics, outs.tracesFrom, outs.tracesTo} {
+		replaced = filesItemNames(replaced, group...)
+	}
+	a.notifyNewFiles(true, files, replaced)
+}
+
+// updateLocalityIndices - locality indices of histories gain column of new frozen file, see LocalityIndex.onFrozenFile.
+// Caller holds context: it removes previous generation of index on Close. Indices are optional: on error they are
+// built later by BuildOptionalMissedIndices.
+func (a *AggregatorV3) updateLocalityIndices(ctx context.Context, in MergedFilesV3) {
+	for _, f := range []struct {
+		h  *History
+		in *filesItem
+	}{{a.accounts, in.accountsIdx}, {a.storage, in.storageIdx}, {a.code, in.codeIdx}} {
+		if f.h.withoutIdx || f.in == nil || !f.in.frozen {
+			continue
+		}
+		if err := a.cpuLimit.Do(ctx, f.h.localityIndex.shardWorkers, func(int) error {
+			return f.h.localityIndex.onFrozenFile(ctx, f.h.InvertedIndex, f.in)
+		}); err != nil {
+			log.Warn("[snapshots] locality index update", "name", f.h.filenameBase, "err", err)
+		}
+	}
+	a.filesGen.Add(1)
 }
+
 func (a *AggregatorV3) cleanAfterFreeze(in MergedFilesV3) {
 	a.accounts.cleanAfterFreeze(in.accountsHist)
 	a.storage.cleanAfterFreeze(in.storageHist)
@@ -1038,6 +1425,7 @@ func (a *AggregatorV3) cleanAfterFreeze(in MergedFilesV3) {
 	a.logTopics.cleanAfterFreeze(in.logTopics)
 	a.tracesFrom.cleanAfterFreeze(in.tracesFrom)
 	a.tracesTo.cleanAfterFreeze(in.tracesTo)
+	a.filesGen.Add(1)
 }
 
 // KeepInDB - usually equal to one a.aggregationStep, but when we exec blocks from snapshots
@@ -1146,43 +1534,27 @@ func (a *AggregatorV3) AddLogTopic(topic []byte) error {
 }
 
 // DisableReadAhead - usage: `defer d.EnableReadAhead().DisableReadAhead()`. Please don't use this funcs without `defer` to avoid leak.
+// Policy is set for whole a.dir in mmap.DefaultManager: it also applies to files opened or built while it's enabled.
+// Returns files to MadvPolicy if it's set.
 func (a *AggregatorV3) DisableReadAhead() {
-	a.accounts.DisableReadAhead()
-	a.storage.DisableReadAhead()
-	a.code.DisableReadAhead()
-	a.logAddrs.DisableReadAhead()
-	a.logTopics.DisableReadAhead()
-	a.tracesFrom.DisableReadAhead()
-	a.tracesTo.DisableReadAhead()
+	if p := a.madvPolicy.Load(); p != nil {
+		_ = a.SetMadvPolicy(p)
+		return
+	}
+	_ = mmap.DefaultManager.SetAdvice(a.dir, mmap.Random)
 }
 func (a *AggregatorV3) EnableReadAhead() *AggregatorV3 {
-	a.accounts.EnableReadAhead()
-	a.storage.EnableReadAhead()
-	a.code.EnableReadAhead()
-	a.logAddrs.EnableReadAhead()
-	a.logTopics.EnableReadAhead()
-	a.tracesFrom.EnableReadAhead()
-	a.tracesTo.EnableReadAhead()
+	_ = mmap.DefaultManager.SetAdvice(a.dir, mmap.Sequential)
 	return a
 }
 func (a *AggregatorV3) EnableMadvWillNeed() *AggregatorV3 {
-	a.accounts.EnableMadvWillNeed()
-	a.storage.EnableMadvWillNeed()
-	a.code.EnableMadvWillNeed()
-	a.logAddrs.EnableMadvWillNeed()
-	a.logTopics.EnableMadvWillNeed()
-	a.tracesFrom.EnableMadvWillNeed()
-	a.tracesTo.EnableMadvWillNeed()
+	a.madvPolicy.Store(nil)
+	_ = mmap.DefaultManager.SetAdvice(a.dir, mmap.WillNeed)
 	return a
 }
 func (a *AggregatorV3) EnableMadvNormal() *AggregatorV3 {
-	a.accounts.EnableMadvNormalReadAhead()
-	a.storage.EnableMadvNormalReadAhead()
-	a.code.EnableMadvNormalReadAhead()
-	a.logAddrs.EnableMadvNormalReadAhead()
-	a.logTopics.EnableMadvNormalReadAhead()
-	a.tracesFrom.EnableMadvNormalReadAhead()
-	a.tracesTo.EnableMadvNormalReadAhead()
+	a.madvPolicy.Store(nil)
+	_ = mmap.DefaultManager.SetAdvice(a.dir, mmap.Normal)
 	return a
 }
 
@@ -1212,8 +1584,77 @@ func (ac *AggregatorV3Context) CodeHistoyIdxIterator(addr []byte, startTxNum, en
 	return ac.code.ic.IterateRange(addr, startTxNum, endTxNum, asc, limit, tx)
 }
 
+// LogAddrCount - see InvertedIndexContext.IdxCount
+func (ac *AggregatorV3Context) LogAddrCount(addr []byte, startTxNum, endTxNum int, tx kv.Tx) (uint64, error) {
+	return ac.logAddrs.IdxCount(addr, startTxNum, endTxNum, tx)
+}
+func (ac *AggregatorV3Context) LogTopicCount(topic []byte, startTxNum, endTxNum int, tx kv.Tx) (uint64, error) {
+	return ac.logTopics.IdxCount(topic, startTxNum, endTxNum, tx)
+}
+
+// PlanLogFilter - see LogFilterPlan. addrs: any of addresses; topics[i]: any of topics at position i (empty means any topic)
+func (ac *AggregatorV3Context) PlanLogFilter(addrs [][]byte, topics [][][]byte, startTxNum, endTxNum int, tx kv.Tx) (*LogFilterPlan, error) {
+	return planLogFilter(ac.logAddrs, ac.logTopics, addrs, topics, startTxNum, endTxNum, tx)
+}
+
+// LogFilterIterator - txNums matching plan in ascending order
+func (ac *AggregatorV3Context) LogFilterIterator(plan *LogFilterPlan, tx kv.Tx) (iter.U64, error) {
+	return iterateLogFilter(ac.logAddrs, ac.logTopics, plan, tx)
+}
+func (ac *AggregatorV3Context) TraceFromCount(addr []byte, startTxNum, endTxNum int, tx kv.Tx) (uint64, error) {
+	return ac.tracesFrom.IdxCount(addr, startTxNum, endTxNum, tx)
+}
+func (ac *AggregatorV3Context) TraceToCount(addr []byte, startTxNum, endTxNum int, tx kv.Tx) (uint64, error) {
+	return ac.tracesTo.IdxCount(addr, startTxNum, endTxNum, tx)
+}
+
 // -- range end
 
+// LatestStateReader - reads latest value of domain's key (storage key is address+location).
+// Layout of latest state is defined by application. `ok=false` means key doesn't exist.
+type LatestStateReader func(tx kv.Tx, domain kv.Domain, key []byte) (v []byte, ok bool, err error)
+
+func (a *AggregatorV3) SetLatestStateReader(f LatestStateReader) { a.latestStateReader = f }
+
+// GetAsOf - value of domain's key as of txNum (before applying changes of txNum), `found=false` if key didn't exist.
+// Resolves by frozen files, then by recent history in DB, then - if value didn't change after txNum - by latest state:
+// LatestStateReader, or GetLatest if latest state is enabled.
+func (ac *AggregatorV3Context) GetAsOf(domain kv.Domain, key []byte, txNum uint64, tx kv.Tx) (v []byte, found bool, err error) {
+	var hc *HistoryContext
+	switch domain {
+	case kv.AccountsDomain:
+		hc = ac.accounts
+	case kv.StorageDomain:
+		hc = ac.storage
+	case kv.CodeDomain:
+		hc = ac.code
+	default:
+		return nil, false, fmt.Errorf("GetAsOf: unexpected domain %s", domain)
+	}
+	start := time.Now()
+	v, inHistory, err := hc.GetNoStateWithRecent(key, txNum, tx)
+	if err != nil {
+		return nil, false, err
+	}
+	if inHistory {
+		ac.a.metrics.lookup(start, domain, true)
+		return v, len(v) > 0, nil // empty value in history: key didn't exist at txNum
+	}
+	switch {
+	case ac.a.latestStateReader != nil:
+		v, found, err = ac.a.latestStateReader(tx, domain, key)
+	case ac.latest != nil:
+		v, found, err = ac.GetLatest(domain, key, tx)
+	default:
+		return nil, false, fmt.Errorf("%w: GetAsOf(%s) of latest state without LatestStateReader", kv.ErrNotSupported, domain)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	ac.a.metrics.lookup(start, domain, false)
+	return v, found, nil
+}
+
 func (ac *AggregatorV3Context) ReadAccountDataNoStateWithRecent(addr []byte, txNum uint64, tx kv.Tx) ([]byte, bool, error) {
 	return ac.accounts.GetNoStateWithRecent(addr, txNum, tx)
 }
@@ -1269,28 +1710,40 @@ func (ac *AggregatorV3Context) ReadAccountCodeSizeNoState(addr []byte, txNum uin
 	return len(code), noState, nil
 }
 
-func (ac *AggregatorV3Context) AccountHistoryIterateChanged(startTxNum, endTxNum int, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
-	return ac.accounts.IterateChanged(startTxNum, endTxNum, asc, limit, tx)
+func (ac *AggregatorV3Context) AccountHistoryIterateChanged(startTxNum, endTxNum int, from, to []byte, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
+	return ac.accounts.IterateChanged(startTxNum, endTxNum, from, to, asc, limit, tx)
+}
+
+func (ac *AggregatorV3Context) StorageHistoryIterateChanged(startTxNum, endTxNum int, from, to []byte, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
+	return ac.storage.IterateChanged(startTxNum, endTxNum, from, to, asc, limit, tx)
+}
+
+func (ac *AggregatorV3Context) CodeHistoryIterateChanged(startTxNum, endTxNum int, from, to []byte, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
+	return ac.code.IterateChanged(startTxNum, endTxNum, from, to, asc, limit, tx)
+}
+
+func (ac *AggregatorV3Context) AccountHistoryChanges(startTxNum, endTxNum uint64, prefix []byte, orderBy ChangesOrder, tx kv.Tx) (*HistoryChangesStream, error) {
+	return ac.accounts.IterateChangesOrdered(startTxNum, endTxNum, prefix, orderBy, tx)
 }
 
-func (ac *AggregatorV3Context) StorageHistoryIterateChanged(startTxNum, endTxNum int, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
-	return ac.storage.IterateChanged(startTxNum, endTxNum, asc, limit, tx)
+func (ac *AggregatorV3Context) StorageHistoryChanges(startTxNum, endTxNum uint64, prefix []byte, orderBy ChangesOrder, tx kv.Tx) (*HistoryChangesStream, error) {
+	return ac.storage.IterateChangesOrdered(startTxNum, endTxNum, prefix, orderBy, tx)
 }
 
-func (ac *AggregatorV3Context) CodeHistoryIterateChanged(startTxNum, endTxNum int, asc order.By, limit int, tx kv.Tx) *HistoryChangesIter {
-	return ac.code.IterateChanged(startTxNum, endTxNum, asc, limit, tx)
+func (ac *AggregatorV3Context) CodeHistoryChanges(startTxNum, endTxNum uint64, prefix []byte, orderBy ChangesOrder, tx kv.Tx) (*HistoryChangesStream, error) {
+	return ac.code.IterateChangesOrdered(startTxNum, endTxNum, prefix, orderBy, tx)
 }
 
-func (ac *AggregatorV3Context) AccountHistoricalStateRange(startTxNum uint64, from, to []byte, limit int, tx kv.Tx) *StateAsOfIter {
-	return ac.accounts.WalkAsOf(startTxNum, from, to, tx, limit)
+func (ac *AggregatorV3Context) AccountHistoricalStateRange(startTxNum uint64, from, to []byte, asc order.By, limit int, tx kv.Tx) *StateAsOfIter {
+	return ac.accounts.WalkAsOf(startTxNum, from, to, asc, tx, limit)
 }
 
-func (ac *AggregatorV3Context) StorageHistoricalStateRange(startTxNum uint64, from, to []byte, limit int, tx kv.Tx) *StateAsOfIter {
-	return ac.storage.WalkAsOf(startTxNum, from, to, tx, limit)
+func (ac *AggregatorV3Context) StorageHistoricalStateRange(startTxNum uint64, from, to []byte, asc order.By, limit int, tx kv.Tx) *StateAsOfIter {
+	return ac.storage.WalkAsOf(startTxNum, from, to, asc, tx, limit)
 }
 
-func (ac *AggregatorV3Context) CodeHistoricalStateRange(startTxNum uint64, from, to []byte, limit int, tx kv.Tx) *StateAsOfIter {
-	return ac.code.WalkAsOf(startTxNum, from, to, tx, limit)
+func (ac *AggregatorV3Context) CodeHistoricalStateRange(startTxNum uint64, from, to []byte, asc order.By, limit int, tx kv.Tx) *StateAsOfIter {
+	return ac.code.WalkAsOf(startTxNum, from, to, asc, tx, limit)
 }
 
 type FilesStats22 struct {
@@ -1314,12 +1767,16 @@ type AggregatorV3Context struct {
 	logTopics  *InvertedIndexContext
 	tracesFrom *InvertedIndexContext
 	tracesTo   *InvertedIndexContext
+	latest     *latestStateContext // nil if latest state is not enabled
 	keyBuf     []byte
+	filesGen   uint64       // AggregatorV3.filesGen at creation time
+	tracer     *queryTracer // see EnableTracing
 }
 
 func (a *AggregatorV3) MakeContext() *AggregatorV3Context {
 	return &AggregatorV3Context{
 		a:          a,
+		filesGen:   a.filesGen.Load(),
 		accounts:   a.accounts.MakeContext(),
 		storage:    a.storage.MakeContext(),
 		code:       a.code.MakeContext(),
@@ -1327,6 +1784,7 @@ func (a *AggregatorV3) MakeContext() *AggregatorV3Context {
 		logTopics:  a.logTopics.MakeContext(),
 		tracesFrom: a.tracesFrom.MakeContext(),
 		tracesTo:   a.tracesTo.MakeContext(),
+		latest:     a.latest.makeContext(),
 	}
 }
 func (ac *AggregatorV3Context) Close() {
@@ -1337,6 +1795,56 @@ func (ac *AggregatorV3Context) Close() {
 	ac.logTopics.Close()
 	ac.tracesFrom.Close()
 	ac.tracesTo.Close()
+	ac.latest.close()
+}
+
+// GetContext - same as MakeContext, but re-uses context returned by PutContext if files set didn't change since then.
+// Saves allocation of sub-contexts and their getters/readers - for short-lived contexts (like 1 per RPC request).
+func (a *AggregatorV3) GetContext() *AggregatorV3Context {
+	for {
+		v := a.ctxPool.Get()
+		if v == nil {
+			break
+		}
+		ac := v.(*AggregatorV3Context)
+		if ac.filesGen != a.filesGen.Load() { // files set changed - context is useless, just drop it
+			continue
+		}
+		ac.reuse()
+		// files set changed (or idle files were closed) while reuse acquired files: getters may be of closed files.
+		// CloseIdleFiles changes generation before closing and doesn't close acquired files, so re-check after reuse
+		// is enough: context is equal to one made by MakeContext before the change.
+		if ac.filesGen != a.filesGen.Load() {
+			ac.Close()
+			continue
+		}
+		a.metrics.context(true)
+		return ac
+	}
+	a.metrics.context(false)
+	return a.MakeContext()
+}
+
+// PutContext - closes context and keeps it for re-use by GetContext. Context must not be used after this call.
+func (a *AggregatorV3) PutContext(ac *AggregatorV3Context) {
+	ac.Close()
+	if ac.filesGen != a.filesGen.Load() {
+		return
+	}
+	a.ctxPool.Put(ac)
+}
+
+// reuse - re-acquires files of closed context. Valid only if files set didn't change since context creation.
+func (ac *AggregatorV3Context) reuse() {
+	ac.setTracer(nil)
+	ac.accounts.reuse()
+	ac.storage.reuse()
+	ac.code.reuse()
+	ac.logAddrs.reuse()
+	ac.logTopics.reuse()
+	ac.tracesFrom.reuse()
+	ac.tracesTo.reuse()
+	ac.latest.reuse()
 }
 
 // BackgroundResult - used only indicate that some work is done
@@ -1378,11 +1886,31 @@ type AggregatorStep struct {
 }
 
 func (a *AggregatorV3) MakeSteps() ([]*AggregatorStep, error) {
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		if h.withoutIdx {
+			return nil, fmt.Errorf("MakeSteps: %w", h.errWithoutIndex())
+		}
+	}
 	frozenAndIndexed := a.EndTxNumFrozenAndIndexed()
-	accountSteps := a.accounts.MakeSteps(frozenAndIndexed)
-	codeSteps := a.code.MakeSteps(frozenAndIndexed)
-	storageSteps := a.storage.MakeSteps(frozenAndIndexed)
+	accountSteps, err := a.accounts.MakeSteps(frozenAndIndexed)
+	if err != nil {
+		return nil, err
+	}
+	codeSteps, err := a.code.MakeSteps(frozenAndIndexed)
+	if err != nil {
+		closeSteps(accountSteps)
+		return nil, err
+	}
+	storageSteps, err := a.storage.MakeSteps(frozenAndIndexed)
+	if err != nil {
+		closeSteps(accountSteps)
+		closeSteps(codeSteps)
+		return nil, err
+	}
 	if len(accountSteps) != len(storageSteps) || len(storageSteps) != len(codeSteps) {
+		closeSteps(accountSteps)
+		closeSteps(codeSteps)
+		closeSteps(storageSteps)
 		return nil, fmt.Errorf("different limit of steps (try merge snapshots): accountSteps=%d, storageSteps=%d, codeSteps=%d", len(accountSteps), len(storageSteps), len(codeSteps))
 	}
 	steps := make([]*AggregatorStep, len(accountSteps))
@@ -1413,11 +1941,11 @@ func (as *AggregatorStep) IterateCodeTxs() *ScanIteratorInc {
 	return as.code.iterateTxs()
 }
 
-func (as *AggregatorStep) ReadAccountDataNoState(addr []byte, txNum uint64) ([]byte, bool, uint64) {
+func (as *AggregatorStep) ReadAccountDataNoState(addr []byte, txNum uint64) ([]byte, bool, uint64, error) {
 	return as.accounts.GetNoState(addr, txNum)
 }
 
-func (as *AggregatorStep) ReadAccountStorageNoState(addr []byte, loc []byte, txNum uint64) ([]byte, bool, uint64) {
+func (as *AggregatorStep) ReadAccountStorageNoState(addr []byte, loc []byte, txNum uint64) ([]byte, bool, uint64, error) {
 	if cap(as.keyBuf) < len(addr)+len(loc) {
 		as.keyBuf = make([]byte, len(addr)+len(loc))
 	} else if len(as.keyBuf) != len(addr)+len(loc) {
@@ -1428,13 +1956,13 @@ func (as *AggregatorStep) ReadAccountStorageNoState(addr []byte, loc []byte, txN
 	return as.storage.GetNoState(as.keyBuf, txNum)
 }
 
-func (as *AggregatorStep) ReadAccountCodeNoState(addr []byte, txNum uint64) ([]byte, bool, uint64) {
+func (as *AggregatorStep) ReadAccountCodeNoState(addr []byte, txNum uint64) ([]byte, bool, uint64, error) {
 	return as.code.GetNoState(addr, txNum)
 }
 
-func (as *AggregatorStep) ReadAccountCodeSizeNoState(addr []byte, txNum uint64) (int, bool, uint64) {
-	code, noState, stateTxNum := as.code.GetNoState(addr, txNum)
-	return len(code), noState, stateTxNum
+func (as *AggregatorStep) ReadAccountCodeSizeNoState(addr []byte, txNum uint64) (int, bool, uint64, error) {
+	code, noState, stateTxNum, err := as.code.GetNoState(addr, txNum)
+	return len(code), noState, stateTxNum, err
 }
 
 func (as *AggregatorStep) MaxTxNumAccounts(addr []byte) (bool, uint64) {
@@ -1468,6 +1996,19 @@ func (as *AggregatorStep) IterateCodeHistory(txNum uint64) *HistoryIteratorInc {
 	return as.code.interateHistoryBeforeTxNum(txNum)
 }
 
+// IterateStoragePrefix - all changes of storage of addr within step: keys (addr+loc) in ascending order,
+// changes of each key in ascending order of txNum
+func (as *AggregatorStep) IterateStoragePrefix(addr []byte) *HistoryPrefixIteratorInc {
+	return as.storage.iteratePrefix(addr)
+}
+
+// Close - releases files of step, see HistoryStep.Close
+func (as *AggregatorStep) Close() {
+	as.accounts.Close()
+	as.storage.Close()
+	as.code.Close()
+}
+
 func (as *AggregatorStep) Clone() *AggregatorStep {
 	return &AggregatorStep{
 		a:        as.a,
@@ -1476,3 +2017,56 @@ func (as *AggregatorStep) Clone() *AggregatorStep {
 		code:     as.code.Clone(),
 	}
 }
+
+// AggregatorStepContext - per-worker context of AggregatorStep for recon workloads. Unlike Clone, lookups
+// don't allocate: getters, readers and buffers are created once and reused. Files are shared with step (mmap).
+// Not thread-safe, returned values are valid until next call of any method of context.
+type AggregatorStepContext struct {
+	accounts *historyStepReader
+	storage  *historyStepReader
+	code     *historyStepReader
+	keyBuf   []byte
+}
+
+func (as *AggregatorStep) MakeContext() *AggregatorStepContext {
+	return &AggregatorStepContext{
+		accounts: as.accounts.makeReader(),
+		storage:  as.storage.makeReader(),
+		code:     as.code.makeReader(),
+		keyBuf:   make([]byte, 0, length.Addr+length.Hash),
+	}
+}
+
+func (sc *AggregatorStepContext) storageKey(addr, loc []byte) []byte {
+	sc.keyBuf = append(append(sc.keyBuf[:0], addr...), loc...)
+	return sc.keyBuf
+}
+
+func (sc *AggregatorStepContext) ReadAccountDataNoState(addr []byte, txNum uint64) ([]byte, bool, uint64, error) {
+	return sc.accounts.GetNoState(addr, txNum)
+}
+
+func (sc *AggregatorStepContext) ReadAccountStorageNoState(addr []byte, loc []byte, txNum uint64) ([]byte, bool, uint64, error) {
+	return sc.storage.GetNoState(sc.storageKey(addr, loc), txNum)
+}
+
+func (sc *AggregatorStepContext) ReadAccountCodeNoState(addr []byte, txNum uint64) ([]byte, bool, uint64, error) {
+	return sc.code.GetNoState(addr, txNum)
+}
+
+func (sc *AggregatorStepContext) ReadAccountCodeSizeNoState(addr []byte, txNum uint64) (int, bool, uint64, error) {
+	code, noState, stateTxNum, err := sc.code.GetNoState(addr, txNum)
+	return len(code), noState, stateTxNum, err
+}
+
+func (sc *AggregatorStepContext) MaxTxNumAccounts(addr []byte) (bool, uint64) {
+	return sc.accounts.hs.MaxTxNum(addr)
+}
+
+func (sc *AggregatorStepContext) MaxTxNumStorage(addr []byte, loc []byte) (bool, uint64) {
+	return sc.storage.hs.MaxTxNum(sc.storageKey(addr, loc))
+}
+
+func (sc *AggregatorStepContext) MaxTxNumCode(addr []byte) (bool, uint64) {
+	return sc.code.hs.MaxTxNum(addr)
+}
@@ -0,0 +1,589 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	atomic2 "go.uber.org/atomic"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/cmp"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// latestState - latest values of accounts, storage and code in .kv files of Domain (like Domains of Aggregator):
+// file of each step has latest values of keys changed in this step, DB has only values of steps not yet in files.
+// Domains share dir, aggregationStep, tx and txNum with histories of AggregatorV3. See AggregatorV3.EnableLatestState.
+type latestState struct {
+	accounts *Domain
+	storage  *Domain
+	code     *Domain
+
+	prunedToStep atomic2.Uint64 // steps before it are already removed from DB, see prune
+}
+
+// newLatestDomain - Domain which values are written by putLatest and history - by owner of `h`
+func newLatestDomain(h *History, keysTable, valsTable string, prefixLen int) (*Domain, error) {
+	d := &Domain{
+		History:   h,
+		keysTable: keysTable,
+		valsTable: valsTable,
+		prefixLen: prefixLen,
+		files:     *atomic2.NewPointer(newFilesTree()),
+		roFiles:   *atomic2.NewPointer(&[]ctxItem{}),
+	}
+	if err := d.reOpenValues(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reOpenValues - re-scans .kv files, files of History are not touched. Copy-on-write, see newFilesTree
+func (d *Domain) reOpenValues() error {
+	dc := d.makeValuesContext() // dropped files are closed by Close of this context, if nobody else uses them
+	defer dc.Close()
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	prev, next := d.files.Load(), newFilesTree()
+	_ = d.scanStateFilesTo(next, files)
+	reuseOpenedItems(prev, next, d.lazyOpen)
+	if err = d.openFilesOf(next); err != nil {
+		retireDroppedItems(next, prev)
+		return err
+	}
+	d.files.Store(next)
+	d.reCalcRoFiles()
+	retireDroppedItems(prev, next)
+	return nil
+}
+
+// putLatest - as Put, but doesn't read previous value and doesn't write history: it's written by History.AddPrevValue
+func (d *Domain) putLatest(key1, key2, val []byte) error {
+	keySuffix := make([]byte, len(key1)+len(key2)+8)
+	copy(keySuffix, key1)
+	copy(keySuffix[len(key1):], key2)
+	key, invertedStep := keySuffix[:len(key1)+len(key2)], keySuffix[len(key1)+len(key2):]
+	binary.BigEndian.PutUint64(invertedStep, ^(d.txNum / d.aggregationStep))
+	if err := d.tx.Put(d.keysTable, key, invertedStep); err != nil {
+		return err
+	}
+	return d.tx.Put(d.valsTable, keySuffix, val)
+}
+
+// deleteLatest - as Delete, see putLatest. Deleted key has empty value in file of step.
+func (d *Domain) deleteLatest(key1, key2 []byte) error {
+	keySuffix := make([]byte, len(key1)+len(key2)+8)
+	copy(keySuffix, key1)
+	copy(keySuffix[len(key1):], key2)
+	key, invertedStep := keySuffix[:len(key1)+len(key2)], keySuffix[len(key1)+len(key2):]
+	binary.BigEndian.PutUint64(invertedStep, ^(d.txNum / d.aggregationStep))
+	if err := d.tx.Put(d.keysTable, key, invertedStep); err != nil {
+		return err
+	}
+	return d.tx.Delete(d.valsTable, keySuffix)
+}
+
+// collateValues - values of keys changed in step, [txFrom; txTo). Unlike collate, key is collated even if DB has
+// its values of other steps.
+func (d *Domain) collateValues(ctx context.Context, step, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.Ticker) (Collation, error) {
+	valuesPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, step, step+1))
+	valuesComp, err := compress.NewCompressor(context.Background(), "collate values", valuesPath, d.tmpdir, compress.MinPatternScore, 1, log.LvlTrace)
+	if err != nil {
+		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
+	}
+	valuesComp.SetCompressTmpFiles(d.compressTmp)
+	closeComp := true
+	defer func() {
+		if closeComp {
+			valuesComp.Close()
+		}
+	}()
+	keysCursor, err := roTx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+	}
+	defer keysCursor.Close()
+
+	var invertedStep [8]byte
+	binary.BigEndian.PutUint64(invertedStep[:], ^step)
+	var (
+		prefix      []byte // Track prefix to insert it before entries
+		k, v        []byte
+		valuesCount int
+		changed     [][]byte
+	)
+	for k, v, err = keysCursor.First(); err == nil && k != nil; k, v, err = keysCursor.Next() {
+		select {
+		case <-logEvery.C:
+			log.Info("[snapshots] collate latest state", "name", d.filenameBase,
+				"range", fmt.Sprintf("%.2f-%.2f", float64(txFrom)/float64(d.aggregationStep), float64(txTo)/float64(d.aggregationStep)))
+		case <-ctx.Done():
+			return Collation{}, ctx.Err()
+		default:
+		}
+		if !bytes.Equal(v, invertedStep[:]) {
+			continue
+		}
+		if p := k[:cmp.Min(d.prefixLen, len(k))]; d.prefixLen == 0 {
+			changed = append(changed, common.Copy(k))
+		} else if len(changed) == 0 || !bytes.Equal(changed[len(changed)-1], p) {
+			changed = append(changed, common.Copy(p))
+		}
+		keySuffix := make([]byte, len(k)+8)
+		copy(keySuffix, k)
+		copy(keySuffix[len(k):], v)
+		val, err := roTx.GetOne(d.valsTable, keySuffix)
+		if err != nil {
+			return Collation{}, fmt.Errorf("find %s value for aggregation step k=[%x]: %w", d.filenameBase, k, err)
+		}
+		if d.prefixLen > 0 && (prefix == nil || !bytes.HasPrefix(k, prefix)) {
+			prefix = append(prefix[:0], k[:d.prefixLen]...)
+			if err = valuesComp.AddUncompressedWord(prefix); err != nil {
+				return Collation{}, fmt.Errorf("add %s values prefix [%x]: %w", d.filenameBase, prefix, err)
+			}
+			if err = valuesComp.AddUncompressedWord(nil); err != nil {
+				return Collation{}, fmt.Errorf("add %s values prefix val [%x]: %w", d.filenameBase, prefix, err)
+			}
+			valuesCount++
+		}
+		if err = valuesComp.AddUncompressedWord(k); err != nil {
+			return Collation{}, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+		}
+		valuesCount++ // Only counting keys, not values
+		if err = valuesComp.AddUncompressedWord(val); err != nil {
+			return Collation{}, fmt.Errorf("add %s values val [%x]=>[%x]: %w", d.filenameBase, k, val, err)
+		}
+	}
+	if err != nil {
+		return Collation{}, fmt.Errorf("iterate over %s keys cursor: %w", d.filenameBase, err)
+	}
+	closeComp = false
+	return Collation{valuesPath: valuesPath, valuesComp: valuesComp, valuesCount: valuesCount, changedPrefixes: changed}, nil
+}
+
+// pruneValues - removes from DB values of steps before toStep. Their keys are in files: with this value,
+// or with value of later step.
+func (d *Domain) pruneValues(ctx context.Context, toStep uint64, logEvery *time.Ticker, stat *EntityPruneStat) error {
+	// keysTable first: `get` doesn't look into valsTable for key without record in keysTable
+	keysCursor, err := d.tx.RwCursorDupSort(d.keysTable)
+	if err != nil {
+		return fmt.Errorf("%s keys cursor: %w", d.filenameBase, err)
+	}
+	defer keysCursor.Close()
+	var k, v []byte
+	for k, v, err = keysCursor.First(); err == nil && k != nil; k, v, err = keysCursor.Next() {
+		select {
+		case <-logEvery.C:
+			log.Info("[snapshots] prune latest state", "name", d.filenameBase, "stage", "prune keys", "to", toStep)
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if ^binary.BigEndian.Uint64(v) < toStep {
+			stat.deleted(d.keysTable, k, v)
+			if err = keysCursor.DeleteCurrent(); err != nil {
+				return fmt.Errorf("clean up %s for [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("iterate of %s keys: %w", d.filenameBase, err)
+	}
+	valsCursor, err := d.tx.RwCursor(d.valsTable)
+	if err != nil {
+		return fmt.Errorf("%s vals cursor: %w", d.filenameBase, err)
+	}
+	defer valsCursor.Close()
+	for k, v, err = valsCursor.First(); err == nil && k != nil; k, v, err = valsCursor.Next() {
+		select {
+		case <-logEvery.C:
+			log.Info("[snapshots] prune latest state", "name", d.filenameBase, "stage", "prune values", "to", toStep)
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if ^binary.BigEndian.Uint64(k[len(k)-8:]) < toStep {
+			stat.deleted(d.valsTable, k, v)
+			if err = valsCursor.DeleteCurrent(); err != nil {
+				return fmt.Errorf("clean up %s for [%x]: %w", d.filenameBase, k, err)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("iterate over %s vals: %w", d.filenameBase, err)
+	}
+	return nil
+}
+
+// makeValuesContext - MakeContext without HistoryContext: history of domain is read by its owner
+func (d *Domain) makeValuesContext() *DomainContext {
+	return &DomainContext{d: d, files: acquireRoFiles(&d.roFiles)}
+}
+
+// reuse - re-acquires files of closed context. Valid only if files set didn't change since context creation.
+func (dc *DomainContext) reuse() {
+	if dc.hc != nil {
+		dc.hc.reuse()
+	}
+	if !acquireAll(dc.files) { // some file was removed meanwhile: context sees current files
+		dc.files, dc.getters, dc.readers = acquireRoFiles(&dc.d.roFiles), nil, nil
+	}
+}
+
+// getLatest - latest value of key: by newest step in DB, then by newest file which has key.
+// `found=false` if there is no such key or it's deleted.
+func (dc *DomainContext) getLatest(key []byte, roTx kv.Tx) ([]byte, bool, error) {
+	keyCursor, err := roTx.CursorDupSort(dc.d.keysTable)
+	if err != nil {
+		return nil, false, err
+	}
+	defer keyCursor.Close()
+	_, foundInvStep, err := keyCursor.SeekExact(key) // first dup is newest step
+	if err != nil {
+		return nil, false, err
+	}
+	if len(foundInvStep) == 0 {
+		v, _, err := dc.readFromFiles(key, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		return v, len(v) > 0, nil
+	}
+	copy(dc.keyBuf[:], key)
+	copy(dc.keyBuf[len(key):], foundInvStep)
+	v, err := roTx.GetOne(dc.d.valsTable, dc.keyBuf[:len(key)+8])
+	if err != nil {
+		return nil, false, err
+	}
+	return v, len(v) > 0, nil
+}
+
+func (ls *latestState) domain(domain kv.Domain) (*Domain, error) {
+	if ls == nil {
+		return nil, fmt.Errorf("%w: latest state of %s is not enabled, see EnableLatestState", kv.ErrNotSupported, domain)
+	}
+	switch domain {
+	case kv.AccountsDomain:
+		return ls.accounts, nil
+	case kv.StorageDomain:
+		return ls.storage, nil
+	case kv.CodeDomain:
+		return ls.code, nil
+	default:
+		return nil, fmt.Errorf("unexpected domain %s", domain)
+	}
+}
+
+func (ls *latestState) domains() []*Domain {
+	if ls == nil {
+		return nil
+	}
+	return []*Domain{ls.accounts, ls.storage, ls.code}
+}
+
+func (ls *latestState) reOpenFolder() error {
+	for _, d := range ls.domains() {
+		if err := d.reOpenValues(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close - closes only .kv files: histories are closed by AggregatorV3
+func (ls *latestState) close() {
+	for _, d := range ls.domains() {
+		if d != nil {
+			d.closeFiles()
+		}
+	}
+}
+
+func (ls *latestState) files() (res []string) {
+	for _, d := range ls.domains() {
+		d.files.Load().Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				for _, part := range item.allParts() {
+					if part.decompressor != nil {
+						res = append(res, filepath.Join("history", part.decompressor.FileName()))
+					} else if part.datPath != "" {
+						res = append(res, filepath.Join("history", filepath.Base(part.datPath)))
+					}
+				}
+			}
+			return true
+		})
+	}
+	return res
+}
+
+type latestStateFiles struct {
+	accounts StaticFiles
+	storage  StaticFiles
+	code     StaticFiles
+
+	changed map[kv.Domain][][]byte // see CommitmentInvalidator
+}
+
+func (sf latestStateFiles) Close() {
+	sf.accounts.Close()
+	sf.storage.Close()
+	sf.code.Close()
+}
+
+func (ls *latestState) buildFiles(ctx context.Context, step, txFrom, txTo uint64, db kv.RoDB, logEvery *time.Ticker) (sf latestStateFiles, err error) {
+	if ls == nil {
+		return sf, nil
+	}
+	sf.changed = map[kv.Domain][][]byte{}
+	for _, f := range []struct {
+		domain kv.Domain
+		d      *Domain
+		sf     *StaticFiles
+	}{{kv.AccountsDomain, ls.accounts, &sf.accounts}, {kv.StorageDomain, ls.storage, &sf.storage}, {kv.CodeDomain, ls.code, &sf.code}} {
+		var collation Collation
+		if err = db.View(ctx, func(tx kv.Tx) error {
+			collation, err = f.d.collateValues(ctx, step, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			sf.Close()
+			return latestStateFiles{}, err
+		}
+		sf.changed[f.domain] = collation.changedPrefixes
+		*f.sf, err = f.d.buildValuesFiles(ctx, step, collation)
+		collation.Close()
+		if err != nil {
+			sf.Close()
+			return latestStateFiles{}, err
+		}
+	}
+	return sf, nil
+}
+
+func (ls *latestState) integrateFiles(sf latestStateFiles, txNumFrom, txNumTo uint64) {
+	if ls == nil {
+		return
+	}
+	ls.accounts.integrateValuesFiles(sf.accounts, txNumFrom, txNumTo)
+	ls.storage.integrateValuesFiles(sf.storage, txNumFrom, txNumTo)
+	ls.code.integrateValuesFiles(sf.code, txNumFrom, txNumTo)
+}
+
+// notify - passes changes of step to invalidator, domains without changes are skipped
+func (ls *latestState) notify(invalidator CommitmentInvalidator, step uint64, sf latestStateFiles) {
+	if ls == nil || invalidator == nil {
+		return
+	}
+	for _, domain := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain} {
+		if prefixes := sf.changed[domain]; len(prefixes) > 0 {
+			invalidator(step, domain, prefixes)
+		}
+	}
+}
+
+// prune - removes from DB values of steps which are in files of all domains and before txTo. Full scan of tables,
+// so it's done once per step (if tx of prune is rolled back - by prune of next step).
+func (ls *latestState) prune(ctx context.Context, txTo uint64, logEvery *time.Ticker, stat *PruneStat) error {
+	if ls == nil {
+		return nil
+	}
+	toStep := txTo / ls.accounts.aggregationStep
+	for _, d := range ls.domains() {
+		if s := d.valuesEndTxNum.Load() / d.aggregationStep; s < toStep {
+			toStep = s
+		}
+	}
+	if toStep <= ls.prunedToStep.Load() {
+		return nil
+	}
+	for _, d := range ls.domains() {
+		es := stat.entity("latest." + d.filenameBase)
+		start := time.Now()
+		if err := d.pruneValues(ctx, toStep, logEvery, es); err != nil {
+			return err
+		}
+		es.PrunedTo, es.Took = toStep*d.aggregationStep, time.Since(start)
+	}
+	ls.prunedToStep.Store(toStep)
+	return nil
+}
+
+// mergeLoopStep - merges .kv files of 1 range of 1 domain, false if there is nothing to merge
+func (ls *latestState) mergeLoopStep(ctx context.Context, maxEndTxNum, maxSpan uint64, workers int) (bool, error) {
+	for _, d := range ls.domains() {
+		ok, startTxNum, endTxNum := d.findValuesMergeRange(maxEndTxNum, maxSpan)
+		if !ok {
+			continue
+		}
+		dc := d.makeValuesContext() // merged files are not removed while merge reads them
+		outs, _ := d.valuesFilesInRange(startTxNum, endTxNum)
+		in, err := d.mergeValuesFiles(ctx, outs, startTxNum, endTxNum, workers)
+		if err != nil {
+			dc.Close()
+			return true, err
+		}
+		d.integrateMergedValuesFiles(outs, in)
+		dc.Close()
+		return true, nil
+	}
+	return false, nil
+}
+
+type latestStateContext struct {
+	accounts *DomainContext
+	storage  *DomainContext
+	code     *DomainContext
+}
+
+func (ls *latestState) makeContext() *latestStateContext {
+	if ls == nil {
+		return nil
+	}
+	return &latestStateContext{
+		accounts: ls.accounts.makeValuesContext(),
+		storage:  ls.storage.makeValuesContext(),
+		code:     ls.code.makeValuesContext(),
+	}
+}
+
+func (lc *latestStateContext) domain(domain kv.Domain) (*DomainContext, error) {
+	if lc == nil {
+		return nil, fmt.Errorf("%w: latest state of %s is not enabled, see EnableLatestState", kv.ErrNotSupported, domain)
+	}
+	switch domain {
+	case kv.AccountsDomain:
+		return lc.accounts, nil
+	case kv.StorageDomain:
+		return lc.storage, nil
+	case kv.CodeDomain:
+		return lc.code, nil
+	default:
+		return nil, fmt.Errorf("unexpected domain %s", domain)
+	}
+}
+
+func (lc *latestStateContext) close() {
+	if lc == nil {
+		return
+	}
+	lc.accounts.Close()
+	lc.storage.Close()
+	lc.code.Close()
+}
+
+func (lc *latestStateContext) reuse() {
+	if lc == nil {
+		return
+	}
+	lc.accounts.reuse()
+	lc.storage.reuse()
+	lc.code.reuse()
+}
+
+// EnableLatestState - AggregatorV3 keeps latest values of accounts, storage and code (written by PutLatest and
+// DeleteLatest) in .kv files of each step, and prunes from DB values of steps which are in files: PlainState can
+// live in snapshots, DB has only recent steps. Read by AggregatorV3Context.GetLatest, and by GetAsOf if there is
+// no LatestStateReader.
+// Must be called before ReopenFolder and writes. Must be enabled from first step and on each start of node:
+// .kv files of steps built without it are not restored.
+func (a *AggregatorV3) EnableLatestState() (err error) {
+	a.openCloseLock.Lock()
+	defer a.openCloseLock.Unlock()
+	if a.latest != nil {
+		return nil
+	}
+	ls := &latestState{}
+	defer func() {
+		if err != nil {
+			ls.close()
+		}
+	}()
+	if ls.accounts, err = newLatestDomain(a.accounts, kv.AccountKeys, kv.AccountVals, 0); err != nil {
+		return fmt.Errorf("EnableLatestState: %w", err)
+	}
+	if ls.storage, err = newLatestDomain(a.storage, kv.StorageKeys, kv.StorageVals, length.Addr); err != nil {
+		return fmt.Errorf("EnableLatestState: %w", err)
+	}
+	if ls.code, err = newLatestDomain(a.code, kv.CodeKeys, kv.CodeVals, 0); err != nil {
+		return fmt.Errorf("EnableLatestState: %w", err)
+	}
+	a.latest = ls
+	a.filesGen.Add(1)
+	return nil
+}
+
+// PutLatest - latest value of domain's key (storage: key1 - address, key2 - location) as of current txNum.
+// History of change is written separately: by AddAccountPrev, AddStoragePrev, AddCodePrev.
+func (a *AggregatorV3) PutLatest(domain kv.Domain, key1, key2, val []byte) error {
+	d, err := a.latest.domain(domain)
+	if err != nil {
+		return fmt.Errorf("PutLatest: %w", err)
+	}
+	return d.putLatest(key1, key2, val)
+}
+
+// DeleteLatest - see PutLatest
+func (a *AggregatorV3) DeleteLatest(domain kv.Domain, key1, key2 []byte) error {
+	d, err := a.latest.domain(domain)
+	if err != nil {
+		return fmt.Errorf("DeleteLatest: %w", err)
+	}
+	return d.deleteLatest(key1, key2)
+}
+
+// GetLatest - latest value of domain's key (storage key is address+location) written by PutLatest: by recent steps
+// in tx, then by files. `found=false` if key doesn't exist. See EnableLatestState.
+func (ac *AggregatorV3Context) GetLatest(domain kv.Domain, key []byte, tx kv.Tx) (v []byte, found bool, err error) {
+	dc, err := ac.latest.domain(domain)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetLatest: %w", err)
+	}
+	return dc.getLatest(key, tx)
+}
+
+// GetLatest - same as AggregatorV3Context.GetLatest, by tx of writer (see SetTx): sees not committed changes
+func (a *AggregatorV3) GetLatest(domain kv.Domain, key []byte) (v []byte, found bool, err error) {
+	ac := a.GetContext()
+	defer a.PutContext(ac)
+	if v, found, err = ac.GetLatest(domain, key, a.rwTx); err != nil || !found {
+		return nil, found, err
+	}
+	return common.Copy(v), true, nil
+}
+
+// CommitmentInvalidator - receives distinct sorted prefixes of keys of latest state changed in step: addresses
+// for accounts and code, addresses of changed slots for storage. Called after .kv files of step are integrated,
+// so values are readable by GetLatest - commitment can recalculate root of step incrementally, from files.
+// Called by goroutine which builds files, must not block for long.
+type CommitmentInvalidator func(step uint64, domain kv.Domain, prefixes [][]byte)
+
+// SetCommitmentInvalidator - see CommitmentInvalidator, nil - disables. Steps built before call are not reported.
+func (a *AggregatorV3) SetCommitmentInvalidator(f CommitmentInvalidator) {
+	a.commitmentInvalidator.Store(&f)
+}
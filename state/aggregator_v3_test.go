@@ -0,0 +1,1854 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/common/metrics"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/mmap"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+func testDbAndAggregatorV3(t *testing.T, aggStep uint64) (string, kv.RwDB, *AggregatorV3) {
+	t.Helper()
+	path := t.TempDir()
+	t.Cleanup(func() { os.RemoveAll(path) })
+	logger := log.New()
+	db := mdbx.NewMDBX(logger).InMem(filepath.Join(path, "db4")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	agg, err := NewAggregatorV3(context.Background(), path, filepath.Join(path, "e4tmp"), aggStep, db)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	return path, db, agg
+}
+
+func TestAggregatorV3_ContextPool(t *testing.T) {
+	_, _, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	ac := agg.GetContext()
+	require.Equal(agg.filesGen.Load(), ac.filesGen)
+	agg.PutContext(ac)
+
+	ac2 := agg.GetContext()
+	require.Equal(agg.filesGen.Load(), ac2.filesGen)
+	agg.PutContext(ac2)
+
+	// files set changed: pooled context must not be re-used
+	require.NoError(agg.ReopenFolder())
+	ac3 := agg.GetContext()
+	require.NotSame(ac2, ac3)
+	require.Equal(agg.filesGen.Load(), ac3.filesGen)
+	agg.PutContext(ac3)
+}
+
+func TestAggregatorV3_ContextPoolCloseIdle(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+	agg.Close()
+
+	agg, err = NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+	require.NoError(err)
+	defer agg.Close()
+	agg.SetLazyOpen(true)
+	require.NoError(agg.ReopenFolder())
+
+	// pooled contexts are re-used while idle files are closed concurrently: reads never see closed files
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				agg.CloseIdleFiles()
+			}
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		ac := agg.GetContext()
+		v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), 20)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal([]byte{20}, v)
+		agg.PutContext(ac)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestAggregatorV3_ReopenFolderConcurrentMerge(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	for step := uint64(0); step < 32; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step, db))
+	}
+
+	// ReopenFolder runs while merge writes new files into folder: merged files must be integrated once
+	done := make(chan error, 1)
+	go func() { done <- agg.MergeLoop(ctx, 1) }()
+	for merging := true; merging; {
+		select {
+		case err = <-done:
+			require.NoError(err)
+			merging = false
+		default:
+			require.NoError(agg.ReopenFolder())
+		}
+		ac := agg.GetContext()
+		v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), 20)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal([]byte{20}, v)
+		agg.PutContext(ac)
+	}
+	require.NoError(agg.ReopenFolder())
+
+	ac := agg.MakeContext()
+	defer ac.Close()
+	var endTxNum uint64
+	for _, item := range ac.accounts.files {
+		require.Equal(endTxNum, item.startTxNum)
+		endTxNum = item.endTxNum
+	}
+	require.Equal(uint64(64), endTxNum)
+	require.Equal(1, ac.accounts.h.files.Load().Len())
+}
+
+func TestAggregatorV3_PruneHorizons(t *testing.T) {
+	_, _, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	_, err := agg.RegisterPruneHorizon("unknown", 1)
+	require.Error(err)
+
+	hs := agg.PruneHorizons()
+	require.Equal(uint64(100), hs.limit("logaddrs", 100))
+
+	logs, err := agg.RegisterPruneHorizon("logaddrs", 10)
+	require.NoError(err)
+	logs2, err := agg.RegisterPruneHorizon("logaddrs", 50)
+	require.NoError(err)
+	traces, err := agg.RegisterPruneHorizon("tracesto", 90)
+	require.NoError(err)
+
+	require.Equal(uint64(10), hs.limit("logaddrs", 100))   // deepest registration wins
+	require.Equal(uint64(90), hs.limit("tracesto", 100))   // independent from other indices
+	require.Equal(uint64(100), hs.limit("logtopics", 100)) // no registrations
+	require.Equal(uint64(5), hs.limit("logaddrs", 5))      // horizon doesn't allow prune more than requested
+
+	logs.Update(70)
+	require.Equal(uint64(50), hs.limit("logaddrs", 100))
+	logs2.Release()
+	require.Equal(uint64(70), hs.limit("logaddrs", 100))
+	logs.Release()
+	traces.Release()
+	_, ok := hs.Horizon("logaddrs")
+	require.False(ok)
+}
+
+func TestAggregatorV3_ExpireHistoryPruneHorizons(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+
+	h, err := agg.RegisterPruneHorizon("logaddrs", 11)
+	require.NoError(err)
+	defer h.Release()
+	require.NoError(agg.ExpireHistory(ctx, 40))
+	require.Equal(uint64(40), agg.accounts.HistoryHorizon())
+	require.Equal(uint64(10), agg.logAddrs.HistoryHorizon()) // limited by registration, rounded down to step
+	require.Equal(uint64(40), agg.logTopics.HistoryHorizon())
+
+	ac := agg.MakeContext()
+	defer ac.Close()
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	it, err := ac.LogAddrIterator([]byte("log"), 11, 20, order.Asc, -1, roTx)
+	require.NoError(err)
+	txNums, err := iter.ToU64Arr(it)
+	require.NoError(err)
+	require.Equal([]uint64{11, 12, 13, 14, 15, 16, 17, 18, 19}, txNums)
+}
+
+func TestAggregatorV3_GetAsOf(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	addr, addr2 := []byte("addr"), []byte("addr2")
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	agg.SetTxNum(10)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v0")))
+	require.NoError(agg.AddAccountPrev(addr2, nil)) // created at txNum=10
+	agg.SetTxNum(20)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v1")))
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+
+	ac := agg.MakeContext()
+	defer ac.Close()
+	_, _, err = ac.GetAsOf(kv.AccountsDomain, addr, 25, tx)
+	require.ErrorIs(err, kv.ErrNotSupported)
+
+	agg.SetLatestStateReader(func(tx kv.Tx, domain kv.Domain, key []byte) ([]byte, bool, error) {
+		return append([]byte("latest_"), key...), true, nil
+	})
+	for _, tt := range []struct {
+		key   []byte
+		txNum uint64
+		v     string
+		found bool
+	}{
+		{addr, 5, "v0", true},
+		{addr, 15, "v1", true},
+		{addr, 25, "latest_addr", true},
+		{addr2, 5, "", false},
+		{addr2, 11, "latest_addr2", true},
+	} {
+		v, found, err := ac.GetAsOf(kv.AccountsDomain, tt.key, tt.txNum, tx)
+		require.NoError(err)
+		require.Equal(tt.found, found, tt.txNum)
+		require.Equal(tt.v, string(v), tt.txNum)
+	}
+	_, _, err = ac.GetAsOf("unknown", addr, 1, tx)
+	require.Error(err)
+}
+
+func TestAggregatorV3_Metrics(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+	s := metrics.NewRegistry()
+	agg.RegisterMetrics(s)
+	agg.SetLatestStateReader(func(tx kv.Tx, domain kv.Domain, key []byte) ([]byte, bool, error) { return nil, false, nil })
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	agg.SetTxNum(10)
+	require.NoError(agg.AddAccountPrev([]byte("addr"), []byte("v0")))
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+
+	agg.PutContext(agg.GetContext())
+	ac := agg.GetContext()
+	_, _, err = ac.GetAsOf(kv.AccountsDomain, []byte("addr"), 5, tx)
+	require.NoError(err)
+	_, _, err = ac.GetAsOf(kv.AccountsDomain, []byte("addr"), 15, tx)
+	require.NoError(err)
+	agg.PutContext(ac)
+
+	var buf bytes.Buffer
+	require.NoError(s.WritePrometheus(&buf))
+	out := buf.String()
+	require.Contains(out, `aggregator_context_cache_total{result="hit"} 1`)
+	require.Contains(out, `aggregator_context_cache_total{result="miss"} 1`)
+	require.Contains(out, `aggregator_lookup_total{source="history"} 1`)
+	require.Contains(out, `aggregator_lookup_total{source="latest"} 1`)
+	require.Contains(out, `aggregator_lookup_seconds_count{domain="accounts"} 2`)
+	require.Contains(out, `aggregator_flush_seconds_count 1`)
+}
+
+func TestAggregatorV3_OnMaxTxNumAdvance(t *testing.T) {
+	_, _, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	ch, unsubscribe := agg.OnMaxTxNumAdvance()
+	agg.integrateFiles(AggV3StaticFiles{}, 0, 16)
+	require.Equal(uint64(16), agg.EndTxNumMinimax())
+	require.Equal(uint64(16), <-ch)
+
+	agg.recalcMaxTxNum() // no advance - no notification
+	agg.integrateFiles(AggV3StaticFiles{}, 16, 32)
+	require.Equal(uint64(32), <-ch)
+
+	unsubscribe()
+	_, ok := <-ch
+	require.False(ok)
+	agg.integrateFiles(AggV3StaticFiles{}, 32, 48)
+	require.Equal(uint64(48), agg.EndTxNumMinimax())
+}
+
+func TestAggregatorV3_OnNewFiles(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 8; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	ch, unsubscribe := agg.OnNewFiles()
+	defer unsubscribe()
+	res, err := agg.Freeze(ctx, 8)
+	require.NoError(err)
+
+	var events []FilesEvent
+	for len(ch) > 0 {
+		events = append(events, <-ch)
+	}
+	require.Equal(res.BuiltSteps+res.Merges, len(events))
+	require.False(events[0].Merged)
+	require.Equal(uint64(2), events[0].MaxTxNum)
+	require.Contains(events[0].Files, "accounts.0-1.v")
+	require.Contains(events[0].Files, "logaddrs.0-1.ef")
+	require.Empty(events[0].Replaced)
+
+	last := events[len(events)-1]
+	require.True(last.Merged)
+	require.Equal(uint64(8), last.MaxTxNum)
+	require.Contains(last.Files, "accounts.0-4.v")
+	require.Contains(last.Replaced, "accounts.0-2.v")
+	require.Contains(last.Replaced, "accounts.3-4.v")
+}
+
+func TestAggregatorV3_MadvPolicy(t *testing.T) {
+	p := DefaultMadvPolicy
+	require.Equal(t, mmap.Random, p.advice("accounts.0-32.v", 64))
+	require.Equal(t, mmap.Normal, p.advice("accounts.32-48.ef", 64))
+	require.Equal(t, mmap.WillNeed, p.advice("/dir/accounts.62-63.kvi", 64))
+	require.Equal(t, mmap.WillNeed, p.advice("accounts.32-64.v", 64)) // newest data is hot even in frozen file
+	require.Equal(t, mmap.Normal, p.advice("salt.txt", 64))
+
+	dir, _, agg := testDbAndAggregatorV3(t, 16)
+	path := filepath.Join(dir, "accounts.2-3.v")
+	require.NoError(t, os.WriteFile(path, make([]byte, 4096), 0644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	region, err := mmap.DefaultManager.Map(f, 4096)
+	require.NoError(t, err)
+	defer region.Unmap()
+	require.Equal(t, mmap.Random, region.Advice())
+
+	agg.maxTxNum.Store(3 * 16)
+	require.NoError(t, agg.SetMadvPolicy(&p))
+	require.Equal(t, mmap.WillNeed, region.Advice())
+
+	// temporary read-ahead returns to policy
+	agg.EnableReadAhead()
+	require.Equal(t, mmap.Sequential, region.Advice())
+	agg.DisableReadAhead()
+	require.Equal(t, mmap.WillNeed, region.Advice())
+
+	// new files are built: file is not hot anymore
+	agg.maxTxNum.Store(10 * 16)
+	agg.reapplyMadvPolicy()
+	require.Equal(t, mmap.Normal, region.Advice())
+
+	require.NoError(t, agg.SetMadvPolicy(nil))
+	require.Equal(t, mmap.Random, region.Advice())
+}
+
+func TestAggregatorV3_ExportImport(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 40; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	for step := uint64(0); step < 2; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step, db))
+	}
+	require.Equal(uint64(32), agg.EndTxNumMinimax())
+
+	var archive bytes.Buffer
+	require.NoError(agg.Export(ctx, &archive, 0, 2))
+	data := archive.Bytes()
+
+	_, _, agg2 := testDbAndAggregatorV3(t, 16)
+	require.NoError(agg2.Import(ctx, bytes.NewReader(data)))
+	require.Equal(agg.Files(), agg2.Files())
+	require.Equal(uint64(32), agg2.EndTxNumMinimax())
+
+	// again: files exist
+	require.NoError(agg2.Import(ctx, bytes.NewReader(data)))
+
+	// corrupted and truncated archives are rejected, nothing is installed
+	_, _, agg3 := testDbAndAggregatorV3(t, 16)
+	corrupted := append([]byte{}, data...)
+	corrupted[1024] ^= 0xff
+	require.Error(agg3.Import(ctx, bytes.NewReader(corrupted)))
+	require.Error(agg3.Import(ctx, bytes.NewReader(data[:len(data)/2])))
+	require.Empty(agg3.Files())
+
+	_, _, agg4 := testDbAndAggregatorV3(t, 8)
+	require.ErrorContains(agg4.Import(ctx, bytes.NewReader(data)), "aggregation step")
+}
+
+func TestAggregatorV3_FilesStats(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 40; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum), 0}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+		if txNum%2 == 0 {
+			require.NoError(agg.AddLogAddr([]byte("log2")))
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	for step := uint64(0); step < 2; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step, db))
+	}
+
+	total, files, missing := agg.FilesStats("accounts", FileKindHistory, 0, 2)
+	require.Equal(2, files)
+	require.Zero(missing)
+	require.Equal(FileStats{Keys: 2, Values: 31, ValuesBytes: 62, MinTxNum: 1, MaxTxNum: 31}, total)
+
+	total, files, _ = agg.FilesStats("logaddrs", FileKindInvertedIndex, 1, 2)
+	require.Equal(1, files)
+	require.Equal(uint64(2), total.Keys)
+	require.Equal(uint64(16+8), total.Values)
+	require.Equal(uint64(16), total.MinTxNum)
+	require.Equal(uint64(31), total.MaxTxNum)
+
+	// merged file has stats of both: distinct keys are counted once
+	_, err = agg.mergeLoopStep(ctx, 1)
+	require.NoError(err)
+	total, files, missing = agg.FilesStats("accounts", FileKindHistory, 0, 2)
+	require.Equal(1, files)
+	require.Zero(missing)
+	require.Equal(FileStats{Keys: 1, Values: 31, ValuesBytes: 62, MinTxNum: 1, MaxTxNum: 31}, total)
+	total, _, _ = agg.FilesStats("logaddrs", FileKindInvertedIndex, 0, 2)
+	require.Equal(uint64(2), total.Keys)
+	require.Equal(uint64(31+15), total.Values)
+
+	// files built before stats existed are reported as missing
+	require.NoError(os.Remove(filepath.Join(agg.dir, "accounts.0-2.v"+fileStatsSuffix)))
+	_, files, missing = agg.FilesStats("accounts", FileKindHistory, 0, 2)
+	require.Equal(1, files)
+	require.Equal(1, missing)
+}
+
+func TestConvertV2Files(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregator(t, 0, 16)
+	require := require.New(t)
+	addr := make([]byte, length.Addr)
+	addr[0] = 1
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 80; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(1), nil, 0)))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+		require.NoError(agg.FinishTx())
+	}
+	require.NoError(agg.Flush(ctx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	agg.Close()
+	kvFiles, _ := filepath.Glob(filepath.Join(path, "*.kv"))
+	require.NotEmpty(kvFiles)
+
+	args := ConvertV2Args{Tmpdir: path, AggregationStep: 16, AccountValue: func(v2 []byte) ([]byte, error) {
+		return append([]byte{0xff}, v2...), nil
+	}}
+	converted, err := ConvertV2Files(ctx, path, args)
+	require.NoError(err)
+	require.True(converted)
+	kvFiles, _ = filepath.Glob(filepath.Join(path, "*.kv"))
+	require.Empty(kvFiles)
+	commitmentFiles, _ := filepath.Glob(filepath.Join(path, "commitment.*"))
+	require.Empty(commitmentFiles)
+	kvFiles, _ = filepath.Glob(filepath.Join(path, v2BackupDir, "*.kv"))
+	require.NotEmpty(kvFiles)
+
+	// again: nothing to do
+	converted, err = ConvertV2Files(ctx, path, args)
+	require.NoError(err)
+	require.False(converted)
+
+	agg3, err := NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 16, db)
+	require.NoError(err)
+	defer agg3.Close()
+	require.NoError(agg3.ReopenFolder())
+	require.NotZero(agg3.EndTxNumMinimax())
+	ac := agg3.MakeContext()
+	defer ac.Close()
+	v, ok, err := ac.ReadAccountDataNoState(addr, 20)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(append([]byte{0xff}, EncodeAccountBytes(19, uint256.NewInt(1), nil, 0)...), v) // value before txNum 20
+}
+
+func TestAggregatorV3_Freeze(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	_, err = agg.Freeze(ctx, 100)
+	require.ErrorContains(err, "db has data up to")
+
+	res, err := agg.Freeze(ctx, 65)
+	require.NoError(err)
+	require.Equal(32, res.BuiltSteps)
+	require.Equal(uint64(0), res.FromTxNum)
+	require.Equal(uint64(64), res.ToTxNum)
+	require.NotZero(res.Merges)
+	require.Equal(uint64(64), res.EndTxNum)
+	require.Equal(uint64(64), res.FrozenTxNum)
+	require.Equal(uint64(64), agg.FrozenTxNum())
+	var locality int
+	for _, fi := range res.Files {
+		require.Equal(uint64(0), fi.FromStep)
+		require.Equal(uint64(StepsInBiggestFile), fi.ToStep)
+		if fi.Kind == FileKindLocality { // built on merge of frozen file, rebuilt on next one
+			locality++
+			continue
+		}
+		require.True(fi.Frozen)
+	}
+	require.Equal(3, locality) // accounts, storage, code
+
+	// nothing to do
+	res, err = agg.Freeze(ctx, 65)
+	require.NoError(err)
+	require.Zero(res.BuiltSteps)
+	require.Zero(res.Merges)
+	require.Empty(res.Files)
+}
+
+func TestAggregatorV3_Tracing(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	_, _, err = ac.ReadAccountDataNoStateWithRecent([]byte("addr"), 20, roTx)
+	require.NoError(err)
+	require.Empty(ac.Traces()) // disabled by default
+
+	ac.EnableTracing(0)
+	v, ok, err := ac.ReadAccountDataNoStateWithRecent([]byte("addr"), 20, roTx)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{20}, v)
+	v, ok, err = ac.ReadAccountDataNoStateWithRecent([]byte("addr"), 68, roTx) // not frozen
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{68}, v)
+	it, err := ac.LogAddrIterator([]byte("log"), 10, 20, order.Asc, -1, roTx)
+	require.NoError(err)
+	for it.HasNext() {
+		_, err = it.Next()
+		require.NoError(err)
+	}
+	it.Close()
+
+	traces := ac.Traces()
+	require.Equal(3, len(traces))
+	require.Equal("accounts.GetNoStateWithRecent", traces[0].Op)
+	require.Equal([]byte("addr"), traces[0].Key)
+	require.Equal(uint64(20), traces[0].TxNum)
+	require.Zero(traces[0].DBReads)
+	require.Equal([]FileProbe{{File: "accounts.0-32.ef", IndexLookups: 1, Bytes: traces[0].Files[0].Bytes, Found: true}, {File: "accounts.0-32.v", IndexLookups: 1, Bytes: 1, Found: true}}, traces[0].Files)
+	require.Equal(2, traces[0].IndexLookups())
+	require.Equal(1, traces[1].DBReads)
+	require.Equal("logaddrs.IterateRange", traces[2].Op)
+	require.Equal("logaddrs.0-32.ef", traces[2].Files[0].File)
+	require.True(traces[2].Files[0].Found)
+
+	ac.ResetTraces()
+	require.Empty(ac.Traces())
+	ac.EnableTracing(2)
+	for i := 0; i < 3; i++ {
+		_, _, err = ac.ReadAccountDataNoStateWithRecent([]byte("addr"), uint64(10+i), roTx)
+		require.NoError(err)
+	}
+	traces = ac.Traces()
+	require.Equal(2, len(traces))
+	require.Equal(uint64(11), traces[0].TxNum) // oldest is dropped
+}
+
+func TestAggregatorV3_PruneStat(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	stat, err := agg.Prune(ctx, 1_000)
+	require.NoError(err)
+	accounts := stat.entity("accounts")
+	require.Equal(map[string]uint64{kv.AccountHistoryKeys: 63, kv.AccountIdx: 63, kv.AccountHistoryVals: 63}, accounts.Deleted)
+	require.Equal(uint64(64), accounts.PrunedTo)
+	require.Equal(uint64(63*(8+4+8)+63*(4+8)+63*(8+1)), accounts.Bytes) // keys: txNum=>addr+valNum, idx: addr=>txNum, vals: valNum=>v
+	logAddrs := stat.entity("logaddrs")
+	require.Equal(map[string]uint64{kv.LogAddressKeys: 63, kv.LogAddressIdx: 63}, logAddrs.Deleted)
+	require.Equal(uint64(63*5), stat.Records())
+	require.Contains(stat.String(), "logaddrs: 126 records")
+
+	stat, err = agg.PruneWithTiemout(ctx, time.Second)
+	require.NoError(err)
+	require.Zero(stat.Records())
+	require.Equal("nothing pruned", stat.String())
+}
+
+func TestAggregatorV3_CanPrune(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 10; txNum++ { // storage and traces are empty
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		if txNum > 4 {
+			require.NoError(agg.AddLogAddr([]byte("log")))
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 8)
+	require.NoError(err)
+
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	frontiers := agg.PruneFrontiers(tx)
+	require.Equal(uint64(1), frontiers["accounts"])
+	require.Equal(uint64(5), frontiers["logaddrs"])
+	require.Equal(uint64(math.MaxUint64), frontiers["storage"])
+	require.Equal(uint64(1), agg.CanPruneFrom(tx))
+	require.True(agg.CanPrune(tx))
+
+	h, err := agg.RegisterPruneHorizon("accounts", 1) // only accounts are prunable, but held by horizon
+	require.NoError(err)
+	_, err = agg.Prune(ctx, 1_000)
+	require.NoError(err)
+	require.Equal(uint64(1), agg.PruneFrontiers(tx)["accounts"])
+	require.Equal(uint64(8), agg.PruneFrontiers(tx)["logaddrs"])
+	require.False(agg.CanPrune(tx))
+
+	h.Release()
+	require.True(agg.CanPrune(tx))
+	stat, err := agg.PruneWithTiemout(ctx, time.Minute)
+	require.NoError(err)
+	require.Equal(uint64(7), stat.entity("accounts").Deleted[kv.AccountHistoryKeys])
+	require.Equal(uint64(8), agg.CanPruneFrom(tx))
+	require.False(agg.CanPrune(tx))
+}
+
+func TestAggregatorV3_RetireBlocksUpTo(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 10; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	stat, err := agg.RetireBlocksUpTo(ctx, db, 8, RetireOpts{DryRun: true})
+	require.NoError(err)
+	require.Equal(uint64(0), stat.Plan.BuildFrom)
+	require.Equal(uint64(4), stat.Plan.BuildTo)
+	require.Equal(uint64(8), stat.Plan.Prune["accounts"])
+	require.Zero(agg.EndTxNumMinimax())
+
+	stat, err = agg.RetireBlocksUpTo(ctx, db, 8, RetireOpts{IOBudget: 1})
+	require.NoError(err)
+	require.True(stat.Interrupted)
+	require.Equal(uint64(1), stat.Built)
+	require.Equal(uint64(2), agg.EndTxNumMinimax())
+
+	var phases []RetirePhase
+	stat, err = agg.RetireBlocksUpTo(ctx, db, 8, RetireOpts{Progress: func(p RetireProgress) {
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+	}})
+	require.NoError(err)
+	require.False(stat.Interrupted)
+	require.Equal(uint64(1), stat.Plan.BuildFrom)
+	require.Equal(uint64(3), stat.Built)
+	require.Positive(stat.Merges)
+	require.Positive(stat.Written)
+	require.Equal(uint64(7), stat.Prune.entity("accounts").Deleted[kv.AccountHistoryKeys])
+	require.Equal([]RetirePhase{RetireBuild, RetireMerge, RetireLocality, RetirePrune, RetireDone}, phases)
+	require.Equal(uint64(8), agg.EndTxNumMinimax())
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	require.Equal(uint64(8), agg.PruneFrontiers(roTx)["accounts"])
+	require.False(agg.CanPrune(roTx))
+}
+
+func TestAggregatorV3_ColdStorage(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+	agg.Close()
+
+	remote := t.TempDir()
+	open := func() *AggregatorV3 {
+		agg, err := NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+		require.NoError(err)
+		t.Cleanup(agg.Close)
+		agg.SetColdStorage(ColdStorageCfg{Fetcher: DirFetcher{Dir: remote}})
+		require.NoError(agg.ReopenFolder())
+		return agg
+	}
+	agg = open()
+	uploaded, evicted, err := agg.OffloadFrozenFiles(ctx)
+	require.NoError(err)
+	require.Equal(10, uploaded) // .v of 3 histories, .ef of 3 histories and 4 inverted indices
+	require.Equal(10, evicted)
+	require.NoFileExists(filepath.Join(path, "accounts.0-32.v"))
+	require.FileExists(filepath.Join(path, "accounts.0-32.v"+remoteSuffix))
+	require.FileExists(filepath.Join(remote, "accounts.0-32.vi"))
+
+	// fetched on access, not evicted while context is open
+	ac := agg.MakeContext()
+	v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), 20)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{20}, v)
+	require.FileExists(filepath.Join(path, "accounts.0-32.v"))
+	_, evicted, err = agg.OffloadFrozenFiles(ctx)
+	require.NoError(err)
+	require.Zero(evicted)
+	ac.Close()
+	agg.CloseIdleFiles()
+	uploaded, evicted, err = agg.OffloadFrozenFiles(ctx)
+	require.NoError(err)
+	require.Zero(uploaded)
+	require.NotZero(evicted)
+	require.NoFileExists(filepath.Join(path, "accounts.0-32.v"))
+	agg.Close()
+
+	// offloaded files are visible after restart
+	agg = open()
+	require.Equal(uint64(64), agg.EndTxNumMinimax())
+	ac = agg.MakeContext()
+	defer ac.Close()
+	v, ok, err = ac.ReadAccountDataNoState([]byte("addr"), 40)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{40}, v)
+}
+
+func TestAggregatorStep_IterateStoragePrefix(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i))
+		return a
+	}
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev(addr(0), []byte{byte(txNum)}))
+		for i := 0; i < 20; i++ { // 1400 keys: more than seekIndexEvery
+			require.NoError(agg.AddStoragePrev(addr(int(txNum)*20+i), []byte{1}, []byte{byte(txNum)}))
+		}
+		if txNum%10 == 0 {
+			for loc := byte(0); loc < 3; loc++ {
+				require.NoError(agg.AddStoragePrev(addr(2000), []byte{loc}, []byte{byte(txNum), loc}))
+			}
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+
+	steps, err := agg.MakeSteps()
+	require.NoError(err)
+	require.Len(steps, 1)
+	defer steps[0].Close()
+	var got []string
+	for it := steps[0].Clone().IterateStoragePrefix(addr(2000)); it.HasNext(); {
+		k, v, txNum, err := it.Next()
+		require.NoError(err)
+		require.Equal(addr(2000), k[:length.Addr])
+		require.Equal([]byte{byte(txNum), k[length.Addr]}, v)
+		got = append(got, fmt.Sprintf("%x:%d", k[length.Addr:], txNum))
+	}
+	require.Equal([]string{"00:10", "00:20", "00:30", "00:40", "00:50", "00:60",
+		"01:10", "01:20", "01:30", "01:40", "01:50", "01:60",
+		"02:10", "02:20", "02:30", "02:40", "02:50", "02:60"}, got)
+
+	it := steps[0].IterateStoragePrefix(addr(701))
+	require.True(it.HasNext())
+	k, _, txNum, _ := it.Next()
+	require.Equal(append(addr(701), 1), k)
+	require.Equal(uint64(35), txNum)
+	require.False(it.HasNext())
+	require.False(steps[0].IterateStoragePrefix(addr(3000)).HasNext())
+}
+
+func TestAggregatorStepContext_NoAllocs(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i))
+		return a
+	}
+	loc := make([]byte, length.Hash)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		for i := 0; i < 10; i++ {
+			require.NoError(agg.AddAccountPrev(addr(i), []byte{byte(txNum), byte(i)}))
+			require.NoError(agg.AddStoragePrev(addr(i), loc, []byte{byte(txNum)}))
+		}
+		if txNum%5 == 0 {
+			require.NoError(agg.AddCodePrev(addr(0), []byte{byte(txNum), 1, 2}))
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 64)
+	require.NoError(err)
+
+	steps, err := agg.MakeSteps()
+	require.NoError(err)
+	require.Len(steps, 1)
+	defer steps[0].Close()
+	step := steps[0].Clone()
+	sc := steps[0].MakeContext()
+	for i := 0; i < 11; i++ {
+		for _, txNum := range []uint64{0, 7, 33, 64, 100} {
+			v, ok, stateTxNum, err := step.ReadAccountDataNoState(addr(i), txNum)
+			require.NoError(err)
+			v2, ok2, stateTxNum2, err := sc.ReadAccountDataNoState(addr(i), txNum)
+			require.NoError(err)
+			require.Equal(v, v2)
+			require.Equal(ok, ok2)
+			require.Equal(stateTxNum, stateTxNum2)
+			v, ok, stateTxNum, err = step.ReadAccountStorageNoState(addr(i), loc, txNum)
+			require.NoError(err)
+			v2, ok2, stateTxNum2, err = sc.ReadAccountStorageNoState(addr(i), loc, txNum)
+			require.NoError(err)
+			require.Equal(v, v2)
+			require.Equal(ok, ok2)
+			require.Equal(stateTxNum, stateTxNum2)
+			v, ok, stateTxNum, err = step.ReadAccountCodeNoState(addr(i), txNum)
+			require.NoError(err)
+			v2, ok2, stateTxNum2, err = sc.ReadAccountCodeNoState(addr(i), txNum)
+			require.NoError(err)
+			require.Equal(v, v2)
+			require.Equal(ok, ok2)
+			require.Equal(stateTxNum, stateTxNum2)
+		}
+	}
+	v, ok, _, err := sc.ReadAccountStorageNoState(addr(3), loc, 33)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{33}, v)
+
+	key := addr(3)
+	allocs := testing.AllocsPerRun(100, func() {
+		sc.ReadAccountDataNoState(key, 33)
+		sc.ReadAccountStorageNoState(key, loc, 33)
+		sc.ReadAccountCodeNoState(key, 33)
+		sc.MaxTxNumStorage(key, loc)
+	})
+	require.Zero(allocs)
+}
+
+func TestAggregatorV3_ContentAddressedNames(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	build := func(divergentTxNum uint64) (string, *AggregatorV3) {
+		path, db, agg := testDbAndAggregatorV3(t, 2)
+		agg.SetContentAddressedNames(true)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		agg.SetTx(tx)
+		agg.StartWrites()
+		for txNum := uint64(1); txNum <= 70; txNum++ {
+			agg.SetTxNum(txNum)
+			v := []byte{byte(txNum)}
+			if txNum == divergentTxNum {
+				v = []byte{0xff}
+			}
+			require.NoError(agg.AddAccountPrev([]byte("addr"), v))
+			require.NoError(agg.AddLogAddr([]byte("log")))
+		}
+		require.NoError(agg.Flush(ctx, tx))
+		agg.FinishWrites()
+		require.NoError(tx.Commit())
+		_, err = agg.Freeze(ctx, 65)
+		require.NoError(err)
+		return path, agg
+	}
+	contentNames := func(agg *AggregatorV3) map[string]string {
+		names := map[string]string{}
+		for _, fi := range agg.FilesInfo() {
+			if fi.Kind != FileKindLocality {
+				names[fi.Name] = fi.ContentName
+			}
+		}
+		return names
+	}
+
+	path, agg := build(0)
+	_, agg2 := build(0)
+	_, agg3 := build(5)
+	names := contentNames(agg)
+	require.NotEmpty(names)
+	for name, content := range names {
+		require.NotEmpty(content, name)
+		require.True(contentNameRe.MatchString(content), content)
+	}
+	require.Equal(names, contentNames(agg2))
+	names3 := contentNames(agg3)
+	require.NotEqual(names["accounts.0-32.v"], names3["accounts.0-32.v"])
+	require.Equal(names["accounts.0-32.ef"], names3["accounts.0-32.ef"])
+
+	// merged files are removed together with their content
+	entries, err := os.ReadDir(path)
+	require.NoError(err)
+	var contentFiles int
+	for _, e := range entries {
+		if contentNameRe.MatchString(e.Name()) {
+			contentFiles++
+		}
+	}
+	require.Equal(len(names), contentFiles)
+
+	require.NoError(agg.ReopenFolder())
+	require.Equal(names, contentNames(agg))
+	ac := agg.MakeContext()
+	defer ac.Close()
+	v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), 10)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{10}, v)
+}
+
+func TestAggregatorV3_DisableIndex(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	_, err = agg.Freeze(ctx, 33)
+	require.NoError(err)
+	require.ErrorContains(agg.DisableIndex("accounts"), "can't be disabled")
+	require.NoError(agg.DisableIndex("logaddrs"))
+	require.Equal([]string{"logaddrs"}, agg.DisabledIndices())
+
+	res, err := agg.Freeze(ctx, 65)
+	require.NoError(err)
+	require.Equal(uint64(64), res.EndTxNum)
+	require.Equal(uint64(64), res.FrozenTxNum)
+	require.Equal(uint64(32), agg.logAddrs.endTxNumMinimax()) // files are retained, but not built
+	require.Equal(uint64(64), agg.tracesTo.endTxNumMinimax())
+	for _, fi := range res.Files {
+		require.NotEqual("logaddrs", fi.Entity)
+	}
+
+	// disabled state survives restart
+	agg.Close()
+	agg, err = NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.ReopenFolder())
+	require.Equal([]string{"logaddrs"}, agg.DisabledIndices())
+	require.Equal(uint64(64), agg.EndTxNumMinimax())
+
+	require.NoError(agg.EnableIndex(ctx, "logaddrs"))
+	require.Empty(agg.DisabledIndices())
+	require.Equal(uint64(64), agg.logAddrs.endTxNumMinimax())
+	require.Equal(uint64(64), agg.FrozenTxNum()) // caught-up steps are merged
+	require.NoFileExists(filepath.Join(path, "logaddrs.disabled"))
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	it, err := ac.LogAddrIterator([]byte("log"), 0, 64, order.Asc, -1, roTx)
+	require.NoError(err)
+	var cnt int
+	for it.HasNext() {
+		_, err = it.Next()
+		require.NoError(err)
+		cnt++
+	}
+	require.Equal(63, cnt)
+}
+
+func TestAggregatorV3_VerifyFiles(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+	agg.SetContentAddressedNames(true)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 65)
+	require.NoError(err)
+
+	// .torrent as downloader creates it
+	info := metainfo.Info{PieceLength: 256}
+	require.NoError(info.BuildFromFilePath(filepath.Join(path, contentName(filepath.Join(path, "accounts.0-32.v")))))
+	info.Name = "accounts.0-32.v"
+	mi := metainfo.MetaInfo{}
+	mi.InfoBytes, err = bencode.Marshal(info)
+	require.NoError(err)
+	torrentFile, err := os.Create(filepath.Join(path, "accounts.0-32.v.torrent"))
+	require.NoError(err)
+	require.NoError(mi.Write(torrentFile))
+	require.NoError(torrentFile.Close())
+
+	progress := &background.Progress{}
+	res, err := agg.VerifyFiles(ctx, 4, progress)
+	require.NoError(err)
+	require.Len(res, 11) // 10 content-addressed .v and .ef, 1 torrent
+	for _, r := range res {
+		require.True(r.OK(), r.Name)
+	}
+	require.Equal(progress.Total.Load(), progress.Processed.Load())
+
+	// corruption of content-addressed file is detected by both: name and .torrent
+	f, err := os.OpenFile(filepath.Join(path, "accounts.0-32.v"), os.O_RDWR, 0)
+	require.NoError(err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 3)
+	require.NoError(err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, 3)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	res, err = agg.VerifyFiles(ctx, 4, nil)
+	require.NoError(err)
+	var bad []string
+	for _, r := range res {
+		if !r.OK() {
+			bad = append(bad, r.Name)
+		}
+	}
+	require.Len(bad, 2)
+	require.Equal("accounts.0-32.v", bad[0])
+	require.True(strings.HasPrefix(bad[1], "accounts.0-32."))
+}
+
+func TestAggregatorV3_LatestState(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+	require.ErrorIs(agg.PutLatest(kv.AccountsDomain, []byte("addr"), nil, []byte("v")), kv.ErrNotSupported)
+	require.NoError(agg.EnableLatestState())
+	require.NoError(agg.ReopenFolder())
+
+	addr, addr2 := bytes.Repeat([]byte{0xaa}, length.Addr), bytes.Repeat([]byte{0xbb}, length.Addr)
+	loc := func(i uint64) []byte { return bytes.Repeat([]byte{byte(i)}, length.Hash) }
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 40; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev(addr, []byte{byte(txNum - 1)}))
+		require.NoError(agg.PutLatest(kv.AccountsDomain, addr, nil, []byte{byte(txNum)}))
+		require.NoError(agg.AddStoragePrev(addr, loc(txNum%3), nil))
+		require.NoError(agg.PutLatest(kv.StorageDomain, addr, loc(txNum%3), []byte{byte(txNum)}))
+		switch txNum {
+		case 5:
+			require.NoError(agg.AddAccountPrev(addr2, nil))
+			require.NoError(agg.PutLatest(kv.AccountsDomain, addr2, nil, []byte("addr2")))
+			require.NoError(agg.AddCodePrev(addr2, nil))
+			require.NoError(agg.PutLatest(kv.CodeDomain, addr2, nil, []byte("code")))
+		case 39:
+			require.NoError(agg.AddStoragePrev(addr, loc(0), []byte{39}))
+			require.NoError(agg.DeleteLatest(kv.StorageDomain, addr, loc(0)))
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	_, err = agg.Freeze(ctx, 37) // steps [0, 18) in files
+	require.NoError(err)
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	_, err = agg.Prune(ctx, 1_000)
+	require.NoError(err)
+	require.NoError(tx.Commit())
+	require.Contains(agg.Files(), filepath.Join("history", "accounts.0-16.kv"))
+
+	check := func(agg *AggregatorV3) {
+		t.Helper()
+		roTx, err := db.BeginRo(ctx)
+		require.NoError(err)
+		defer roTx.Rollback()
+		// only values of steps which are not in files are left in db
+		require.NoError(roTx.ForEach(kv.AccountVals, nil, func(k, v []byte) error {
+			require.GreaterOrEqual(^binary.BigEndian.Uint64(k[len(k)-8:]), uint64(18))
+			return nil
+		}))
+		ac := agg.MakeContext()
+		defer ac.Close()
+		for _, tt := range []struct {
+			domain kv.Domain
+			key    []byte
+			v      []byte
+			found  bool
+		}{
+			{kv.AccountsDomain, addr, []byte{40}, true},       // db
+			{kv.AccountsDomain, addr2, []byte("addr2"), true}, // files
+			{kv.CodeDomain, addr2, []byte("code"), true},
+			{kv.CodeDomain, addr, nil, false},
+			{kv.StorageDomain, append(common.Copy(addr), loc(1)...), []byte{40}, true},
+			{kv.StorageDomain, append(common.Copy(addr), loc(2)...), []byte{38}, true},
+			{kv.StorageDomain, append(common.Copy(addr), loc(0)...), nil, false}, // deleted
+			{kv.StorageDomain, append(common.Copy(addr2), loc(1)...), nil, false},
+		} {
+			v, found, err := ac.GetLatest(tt.domain, tt.key, roTx)
+			require.NoError(err)
+			require.Equal(tt.found, found, "%s %x", tt.domain, tt.key)
+			require.Equal(tt.v, v, "%s %x", tt.domain, tt.key)
+		}
+		// GetAsOf uses latest state if there is no LatestStateReader
+		v, found, err := ac.GetAsOf(kv.AccountsDomain, addr2, 30, roTx)
+		require.NoError(err)
+		require.True(found)
+		require.Equal([]byte("addr2"), v)
+	}
+	check(agg)
+
+	agg2, err := NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+	require.NoError(err)
+	defer agg2.Close()
+	require.NoError(agg2.EnableLatestState())
+	require.NoError(agg2.ReopenFolder())
+	check(agg2)
+}
+
+func TestAggregatorV3_LocalityIndexOnMerge(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 1)
+	require := require.New(t)
+
+	write := func(from, to uint64) {
+		tx, err := db.BeginRw(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		agg.SetTx(tx)
+		agg.StartWrites()
+		for txNum := from; txNum < to; txNum++ {
+			agg.SetTxNum(txNum)
+			require.NoError(agg.AddAccountPrev([]byte{byte(txNum % 7)}, []byte{byte(txNum)}))
+		}
+		require.NoError(agg.Flush(ctx, tx))
+		agg.FinishWrites()
+		require.NoError(tx.Commit())
+	}
+	li := agg.accounts.localityIndex
+	write(0, 40)
+	_, err := agg.Freeze(ctx, 33)
+	require.NoError(err)
+	require.NotNil(li.file)
+	require.Equal(uint64(StepsInBiggestFile), li.file.endTxNum)
+	require.FileExists(filepath.Join(path, "accounts.0-32.li"))
+
+	ac := agg.MakeContext() // keeps previous generation of index
+	write(40, 70)
+	_, err = agg.Freeze(ctx, 65)
+	require.NoError(err)
+	require.Equal(uint64(2*StepsInBiggestFile), li.file.endTxNum)
+	require.FileExists(filepath.Join(path, "accounts.0-64.l"))
+	require.FileExists(filepath.Join(path, "accounts.0-32.li"))
+	ac.Close()
+	require.NoFileExists(filepath.Join(path, "accounts.0-32.li"))
+	require.NoFileExists(filepath.Join(path, "accounts.0-32.l"))
+
+	// new generation is used by lookups
+	ac = agg.MakeContext()
+	defer ac.Close()
+	r := li.NewIdxReader()
+	files, err := li.bm.At(r.Lookup([]byte{3}))
+	require.NoError(err)
+	require.Equal([]uint64{0, 1}, files)
+	v, ok, err := ac.ReadAccountDataNoState([]byte{3}, 10)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{10}, v)
+}
+
+func TestAggregatorV3_CommitmentInvalidator(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+	require.NoError(agg.EnableLatestState())
+	require.NoError(agg.ReopenFolder())
+
+	type change struct {
+		step     uint64
+		domain   kv.Domain
+		prefixes [][]byte
+	}
+	var (
+		mu      sync.Mutex
+		changes []change
+	)
+	agg.SetCommitmentInvalidator(func(step uint64, domain kv.Domain, prefixes [][]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, change{step, domain, prefixes})
+	})
+
+	addr := func(i byte) []byte { return bytes.Repeat([]byte{i}, length.Addr) }
+	loc := func(i byte) []byte { return bytes.Repeat([]byte{i}, length.Hash) }
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 8; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev(addr(byte(txNum/2)), nil))
+		require.NoError(agg.PutLatest(kv.AccountsDomain, addr(byte(txNum/2)), nil, []byte{byte(txNum)}))
+		if txNum == 3 {
+			for _, a := range []byte{9, 8} {
+				for _, l := range []byte{2, 1} {
+					require.NoError(agg.AddStoragePrev(addr(a), loc(l), nil))
+					require.NoError(agg.PutLatest(kv.StorageDomain, addr(a), loc(l), []byte{a, l}))
+				}
+			}
+		}
+	}
+	// writer sees not committed values
+	v, found, err := agg.GetLatest(kv.StorageDomain, append(addr(9), loc(2)...))
+	require.NoError(err)
+	require.True(found)
+	require.Equal([]byte{9, 2}, v)
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	_, err = agg.Freeze(ctx, 7) // steps [0, 3) in files
+	require.NoError(err)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal([]change{
+		{0, kv.AccountsDomain, [][]byte{addr(0)}},
+		{1, kv.AccountsDomain, [][]byte{addr(1)}},
+		{1, kv.StorageDomain, [][]byte{addr(8), addr(9)}},
+		{2, kv.AccountsDomain, [][]byte{addr(2)}},
+	}, changes)
+}
+
+func TestAggregatorV3_Leases(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 1)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	require.Error(agg.Lease(tx, "rpc", 4, 2, time.Hour))
+	require.NoError(agg.Lease(tx, "rpc", 2, 4, time.Hour))
+	require.NoError(agg.Lease(tx, "expired", 0, 40, time.Nanosecond))
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(0); txNum < 40; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte{byte(txNum % 7)}, []byte{byte(txNum)}))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	// merge replaces small files, but leased ones stay on disk
+	_, err = agg.Freeze(ctx, 33)
+	require.NoError(err)
+	require.Contains(agg.Files(), "accounts.0-32.ef")
+	require.NotContains(agg.Files(), "accounts.2-3.ef")
+	require.FileExists(filepath.Join(path, "accounts.2-3.ef"))
+	require.FileExists(filepath.Join(path, "accounts.2-3.v"))
+	require.NoFileExists(filepath.Join(path, "accounts.0-1.ef"))
+	require.NoFileExists(filepath.Join(path, "accounts.4-5.ef"))
+
+	// prune keeps leased range in db, expired lease is removed
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	_, err = agg.Prune(ctx, 1_000)
+	require.NoError(err)
+	leases, err := agg.Leases(tx)
+	require.NoError(err)
+	require.Len(leases, 1)
+	require.Equal("rpc", leases[0].Name)
+	require.Equal([2]uint64{2, 4}, [2]uint64{leases[0].FromTxNum, leases[0].ToTxNum})
+	require.False(leases[0].Expired(time.Now()))
+	first, err := kv.FirstKey(tx, kv.AccountHistoryKeys)
+	require.NoError(err)
+	require.Equal(uint64(2), binary.BigEndian.Uint64(first))
+	require.NoError(tx.Commit())
+
+	// after restart leased files survive cleanup, until lease is released
+	agg.Close()
+	agg2, err := NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 1, db)
+	require.NoError(err)
+	defer agg2.Close()
+	require.NoError(agg2.CleanDirWithLeases(ctx))
+	require.FileExists(filepath.Join(path, "accounts.2-3.ef"))
+	require.NoError(db.Update(ctx, func(tx kv.RwTx) error { return agg2.ReleaseLease(tx, "rpc") }))
+	agg2.CleanDir()
+	require.NoFileExists(filepath.Join(path, "accounts.2-3.ef"))
+	require.NoFileExists(filepath.Join(path, "accounts.2-3.v"))
+}
+
+func TestAggregatorV3_StepParts(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+	require.ErrorContains(agg.SetStepParts(3), "not divisible")
+	require.NoError(agg.SetStepParts(4))
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 40; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+
+	// part 1 of step 0 was built before restart: it's reused, even if db has no its data anymore
+	logEvery := time.NewTicker(time.Minute)
+	defer logEvery.Stop()
+	b := &stepPartsBuilder{dir: agg.partsDir(0), partSize: 4, parts: 4, db: db, logEvery: logEvery, mergeLimit: 1}
+	require.NoError(os.MkdirAll(b.dir, 0755))
+	pii, err := b.newInvertedIndex(agg.logAddrs)
+	require.NoError(err)
+	require.NoError(db.Update(ctx, func(tx kv.RwTx) error {
+		bitmaps, err := pii.collate(ctx, 4, 8, tx, logEvery)
+		require.NoError(err)
+		sf, err := pii.buildFiles(ctx, 1, bitmaps)
+		require.NoError(err)
+		sf.Close()
+		require.NoError(os.WriteFile(b.doneMarker("logaddrs", 1), nil, 0644))
+		for txNum := uint64(4); txNum < 8; txNum++ {
+			require.NoError(tx.Delete(kv.LogAddressKeys, hexutility.EncodeTs(txNum)))
+		}
+		return nil
+	}))
+
+	res, err := agg.Freeze(ctx, 33)
+	require.NoError(err)
+	require.Equal(2, res.BuiltSteps)
+	require.Equal(uint64(32), agg.EndTxNumMinimax())
+	require.NoDirExists(agg.partsDir(0))
+	require.NoDirExists(agg.partsDir(1))
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	it, err := ac.LogAddrIterator([]byte("log"), 0, 32, order.Asc, -1, roTx)
+	require.NoError(err)
+	var cnt int
+	for it.HasNext() {
+		_, err = it.Next()
+		require.NoError(err)
+		cnt++
+	}
+	require.Equal(31, cnt)
+	for _, txNum := range []uint64{1, 5, 16, 30} {
+		v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), txNum)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal([]byte{byte(txNum)}, v)
+	}
+}
+
+func TestAggregatorV3_TranscodeFiles(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 20; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+		require.NoError(agg.AddLogAddr([]byte("log")))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 9)
+	require.NoError(err)
+
+	_, err = agg.TranscodeFiles(ctx, "unknown", 0)
+	require.ErrorContains(err, "unknown format")
+	n, err := agg.TranscodeFiles(ctx, compress.FormatV1.Name, 64*datasize.MB)
+	require.NoError(err)
+	require.NotZero(n)
+	n, err = agg.TranscodeFiles(ctx, compress.FormatV1.Name, 0)
+	require.NoError(err)
+	require.Zero(n)
+
+	// mixed formats after restart: steps built later are legacy
+	agg.Close()
+	agg, err = NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.ReopenFolder())
+	require.NoError(agg.buildFilesInBackground(ctx, agg.EndTxNumMinimax()/2, db))
+	ac := agg.MakeContext()
+	defer ac.Close()
+	formats := map[string]int{}
+	for _, item := range ac.accounts.files {
+		formats[item.src.decompressor.Format()]++
+	}
+	require.Equal(2, len(formats))
+	for _, txNum := range []uint64{1, 7, 9} {
+		v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), txNum)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal([]byte{byte(txNum)}, v)
+	}
+}
+
+func TestAggregatorV3_ExportHistory(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 10; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("a1"), []byte{byte(txNum)}))
+		if txNum%3 == 0 {
+			require.NoError(agg.AddAccountPrev([]byte("b2"), []byte{byte(txNum), 1}))
+			require.NoError(agg.AddLogAddr([]byte("log")))
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 5) // part of range is in files, part - in db
+	require.NoError(err)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+
+	var buf bytes.Buffer
+	w, err := NewCSVHistoryWriter(&buf, nil)
+	require.NoError(err)
+	rows, err := agg.ExportHistory(ctx, roTx, HistoryExportCfg{Entity: "accounts", FromTxNum: 2, ToTxNum: 8}, w)
+	require.NoError(err)
+	require.Equal(uint64(8), rows)
+	require.Equal("key,txnum,value\n"+
+		"6131,2,02\n6131,3,03\n6131,4,04\n6131,5,05\n6131,6,06\n6131,7,07\n"+
+		"6232,3,0301\n6232,6,0601\n", buf.String())
+
+	buf.Reset()
+	w, err = NewCSVHistoryWriter(&buf, []string{ExportColumnTxNum})
+	require.NoError(err)
+	_, err = agg.ExportHistory(ctx, roTx, HistoryExportCfg{Entity: "accounts", FromTxNum: 1, ToTxNum: 11, KeyPrefix: []byte("b"), WithoutValues: true}, w)
+	require.NoError(err)
+	require.Equal("txnum\n3\n6\n9\n", buf.String())
+
+	buf.Reset()
+	w, err = NewCSVHistoryWriter(&buf, []string{ExportColumnKey, ExportColumnTxNum})
+	require.NoError(err)
+	_, err = agg.ExportHistory(ctx, roTx, HistoryExportCfg{Entity: "logaddrs", FromTxNum: 1, ToTxNum: 11, KeyFilter: func(k []byte) bool { return string(k) == "log" }}, w)
+	require.NoError(err)
+	require.Equal("key,txnum\n6c6f67,3\n6c6f67,6\n6c6f67,9\n", buf.String())
+
+	_, err = NewCSVHistoryWriter(&buf, []string{"unknown"})
+	require.ErrorContains(err, "unknown column")
+	_, err = agg.ExportHistory(ctx, roTx, HistoryExportCfg{Entity: "unknown", FromTxNum: 1, ToTxNum: 2}, w)
+	require.ErrorContains(err, "unknown entity")
+}
+
+func TestAggregatorV3_IndexHeadersCache(t *testing.T) {
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 20; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(agg.AddAccountPrev([]byte("addr"), []byte{byte(txNum)}))
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 9)
+	require.NoError(err)
+	agg.Close() // saves headers of merged files
+
+	cached := func() map[string]recsplit.IndexHeader {
+		data, err := os.ReadFile(filepath.Join(path, indexHeadersFileName))
+		require.NoError(err)
+		var headers map[string]recsplit.IndexHeader
+		require.NoError(json.Unmarshal(data, &headers))
+		return headers
+	}
+	headers := cached()
+	require.Contains(headers, "accounts.0-4.vi")
+	require.Contains(headers, "accounts.0-4.efi")
+	require.NotContains(headers, "accounts.0-1.vi") // merged
+	require.Equal(uint64(1), headers["accounts.0-4.efi"].KeyCount)
+
+	for i := 0; i < 2; i++ { // by parsed and by cached headers
+		agg, err = NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+		require.NoError(err)
+		require.NoError(agg.ReopenFolder())
+		ac := agg.MakeContext()
+		for _, txNum := range []uint64{1, 5, 7} {
+			v, ok, err := ac.ReadAccountDataNoState([]byte("addr"), txNum)
+			require.NoError(err)
+			require.True(ok)
+			require.Equal([]byte{byte(txNum)}, v)
+		}
+		ac.Close()
+		agg.Close()
+		require.Equal(headers, cached())
+	}
+}
+
+func TestAggregatorV3_HistoryChanges(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 2)
+	require := require.New(t)
+
+	type change struct {
+		k     string
+		txNum uint64
+		v     string
+	}
+	var all []change
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 20; txNum++ {
+		agg.SetTxNum(txNum)
+		for _, k := range []string{"a1", "b2", "b3"} {
+			if k == "b2" && txNum%3 != 0 || k == "b3" && txNum != 5 && txNum != 15 {
+				continue
+			}
+			v := fmt.Sprintf("%s-%d", k, txNum)
+			require.NoError(agg.AddAccountPrev([]byte(k), []byte(v)))
+			all = append(all, change{k, txNum, v})
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	_, err = agg.Freeze(ctx, 9) // part of range is in files, part - in db
+	require.NoError(err)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	read := func(from, to uint64, prefix string, orderBy ChangesOrder) (res []change) {
+		it, err := ac.AccountHistoryChanges(from, to, []byte(prefix), orderBy, roTx)
+		require.NoError(err)
+		defer it.Close()
+		for it.HasNext() {
+			k, txNum, v, err := it.Next()
+			require.NoError(err)
+			res = append(res, change{string(k), txNum, string(v)})
+		}
+		return res
+	}
+	expect := func(from, to uint64, prefix string, orderBy ChangesOrder) (res []change) {
+		for _, c := range all {
+			if c.txNum >= from && c.txNum < to && strings.HasPrefix(c.k, prefix) {
+				res = append(res, c)
+			}
+		}
+		sort.Slice(res, func(i, j int) bool {
+			if orderBy == ChangesByKey && res[i].k != res[j].k {
+				return res[i].k < res[j].k
+			}
+			if res[i].txNum != res[j].txNum {
+				return res[i].txNum < res[j].txNum
+			}
+			return res[i].k < res[j].k
+		})
+		return res
+	}
+	for _, orderBy := range []ChangesOrder{ChangesByKey, ChangesByTxNum} {
+		for _, r := range [][2]uint64{{0, 21}, {2, 18}, {5, 6}, {12, 21}} {
+			for _, prefix := range []string{"", "b", "a1", "c"} {
+				require.Equal(expect(r[0], r[1], prefix, orderBy), read(r[0], r[1], prefix, orderBy), "order=%d range=%v prefix=%s", orderBy, r, prefix)
+			}
+		}
+	}
+}
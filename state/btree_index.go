@@ -0,0 +1,446 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/mmap"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// BtIndex - sorted index of file of (key, value) words with keys in ascending order (.kv, .ef). Unlike recsplit
+// it can find first key >= given one: Seek and prefix iteration inside of file. File format (numbers are BigEndian uint64):
+//
+//	count, fanout, offsets of key words [count], nodes amount, nodes key ends [nodes], nodes keys
+//
+// Node j is key of entry j*fanout - 2-level b-tree: Seek finds node by binary search in index, then entry
+// by binary search in data file among `fanout` entries of node.
+type BtIndex struct {
+	f        *os.File
+	filePath string
+	region   *mmap.Region
+
+	count, fanout uint64
+	offsets       []byte
+	nodeEnds      []byte
+	nodeKeys      []byte
+}
+
+const btFanout = 256
+
+func OpenBtIndex(filePath string) (bt *BtIndex, err error) {
+	bt = &BtIndex{filePath: filePath}
+	if bt.f, err = os.Open(filePath); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			bt.Close()
+		}
+	}()
+	st, err := bt.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < 24 {
+		return nil, fmt.Errorf("bt index is truncated: %s", filePath)
+	}
+	if bt.region, err = mmap.DefaultManager.Map(bt.f, int(st.Size())); err != nil {
+		return nil, err
+	}
+	data := bt.region.Bytes()[:st.Size()]
+	bt.count, bt.fanout = binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[8:])
+	pos := 16 + bt.count*8
+	if bt.fanout == 0 || pos+8 > uint64(len(data)) {
+		return nil, fmt.Errorf("bt index is truncated: %s", filePath)
+	}
+	bt.offsets = data[16:pos]
+	nodes := binary.BigEndian.Uint64(data[pos:])
+	pos += 8
+	if nodes != (bt.count+bt.fanout-1)/bt.fanout || pos+nodes*8 > uint64(len(data)) {
+		return nil, fmt.Errorf("bt index is truncated: %s", filePath)
+	}
+	bt.nodeEnds, bt.nodeKeys = data[pos:pos+nodes*8], data[pos+nodes*8:]
+	if nodes > 0 && binary.BigEndian.Uint64(bt.nodeEnds[(nodes-1)*8:]) != uint64(len(bt.nodeKeys)) {
+		return nil, fmt.Errorf("bt index is truncated: %s", filePath)
+	}
+	return bt, nil
+}
+
+func (bt *BtIndex) KeyCount() uint64 { return bt.count }
+func (bt *BtIndex) FilePath() string { return bt.filePath }
+func (bt *BtIndex) FileName() string { return filepath.Base(bt.filePath) }
+func (bt *BtIndex) Size() int64 {
+	if bt.region == nil {
+		return 0
+	}
+	return int64(bt.region.Size())
+}
+
+// Offset - offset of key word of i-th key in data file
+func (bt *BtIndex) Offset(i uint64) uint64 { return binary.BigEndian.Uint64(bt.offsets[i*8:]) }
+
+func (bt *BtIndex) nodeKey(j int) []byte {
+	var from uint64
+	if j > 0 {
+		from = binary.BigEndian.Uint64(bt.nodeEnds[(j-1)*8:])
+	}
+	return bt.nodeKeys[from:binary.BigEndian.Uint64(bt.nodeEnds[j*8:])]
+}
+
+// Seek - number of first key >= `key`, KeyCount() if there is no such key. `g` - getter of data file, its position is changed.
+func (bt *BtIndex) Seek(g *compress.Getter, key []byte) uint64 {
+	nodes := len(bt.nodeEnds) / 8
+	j := sort.Search(nodes, func(j int) bool { return bytes.Compare(bt.nodeKey(j), key) > 0 }) - 1
+	if j < 0 {
+		return 0
+	}
+	from := uint64(j) * bt.fanout
+	to := from + bt.fanout
+	if to > bt.count {
+		to = bt.count
+	}
+	return from + uint64(sort.Search(int(to-from), func(n int) bool {
+		g.Reset(bt.Offset(from + uint64(n)))
+		k, _ := g.NextUncompressed()
+		return bytes.Compare(k, key) >= 0
+	}))
+}
+
+// SeekOffset - offset of key word of first key >= `key`, false if there is no such key
+func (bt *BtIndex) SeekOffset(g *compress.Getter, key []byte) (uint64, bool) {
+	i := bt.Seek(g, key)
+	if i == bt.count {
+		return 0, false
+	}
+	return bt.Offset(i), true
+}
+
+func (bt *BtIndex) Close() {
+	if bt == nil || bt.f == nil {
+		return
+	}
+	if err := bt.region.Unmap(); err != nil {
+		log.Trace("unmap", "err", err, "file", bt.filePath)
+	}
+	if err := bt.f.Close(); err != nil {
+		log.Trace("close", "err", err, "file", bt.filePath)
+	}
+	bt.f, bt.region = nil, nil
+}
+
+// buildBtIndex - .bt of data file `d` of (key, value) words, keys must be uncompressed and ascending
+func buildBtIndex(ctx context.Context, d *compress.Decompressor, btPath string, p *background.Progress) (*BtIndex, error) {
+	tmpPath := btPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer os.Remove(tmpPath)
+	defer d.EnableMadvNormal().DisableReadAhead()
+
+	w := bufio.NewWriterSize(f, 1024*1024)
+	var numBuf [8]byte
+	put := func(v uint64) error {
+		binary.BigEndian.PutUint64(numBuf[:], v)
+		_, err := w.Write(numBuf[:])
+		return err
+	}
+	count := uint64(d.Count() / 2)
+	if err = put(count); err != nil {
+		return nil, err
+	}
+	if err = put(btFanout); err != nil {
+		return nil, err
+	}
+	var nodeKeys, prevKey []byte
+	var nodeEnds []uint64
+	var i, keyPos uint64
+	for g := d.MakeGetter(); g.HasNext(); i++ {
+		if i%1024 == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if p != nil {
+			p.Processed.Inc()
+		}
+		key, _ := g.NextUncompressed()
+		if i > 0 && bytes.Compare(prevKey, key) >= 0 {
+			return nil, fmt.Errorf("build %s: keys are not ascending: %x after %x", btPath, key, prevKey)
+		}
+		prevKey = append(prevKey[:0], key...)
+		if i%btFanout == 0 {
+			nodeKeys = append(nodeKeys, key...)
+			nodeEnds = append(nodeEnds, uint64(len(nodeKeys)))
+		}
+		if err = put(keyPos); err != nil {
+			return nil, err
+		}
+		if !g.HasNext() {
+			return nil, fmt.Errorf("build %s: key %x without value", btPath, key)
+		}
+		keyPos = g.Skip()
+	}
+	if i != count {
+		return nil, fmt.Errorf("build %s: expected %d keys, got %d", btPath, count, i)
+	}
+	if err = put(uint64(len(nodeEnds))); err != nil {
+		return nil, err
+	}
+	for _, end := range nodeEnds {
+		if err = put(end); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = w.Write(nodeKeys); err != nil {
+		return nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, btPath); err != nil {
+		return nil, err
+	}
+	return OpenBtIndex(btPath)
+}
+
+// lookupKey - offset of `key` word in .ef file `src`: by .efi reader `r`, or by .efbt if file has no .efi
+// (see SetWithoutIndex). If key is not in file - offset of some other key or false, callers compare keys.
+func lookupKey(src *filesItem, r *recsplit.IndexReader, g *compress.Getter, key []byte) (uint64, bool) {
+	if r != nil {
+		if r.Empty() {
+			return 0, false
+		}
+		return r.Lookup(key), true
+	}
+	if src.bt == nil {
+		return 0, false
+	}
+	return src.bt.SeekOffset(g, key)
+}
+
+// SetBtIndex - build .efbt (see BtIndex) of each .ef file: WalkAsOf seeks inside of files, and keys are found by it
+// in files without .efi (see SetWithoutIndex). Missing .efbt of existing files are built by BuildMissedIndices.
+func (ii *InvertedIndex) SetBtIndex(v bool) { ii.btIndex = v }
+
+func (ii *InvertedIndex) btPath(fromStep, toStep uint64) string {
+	return filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efbt", ii.filenameBase, fromStep, toStep))
+}
+
+// openBt - opens .efbt of item if it exists
+func (ii *InvertedIndex) openBt(item *filesItem) error {
+	return openBtOf(item, ii.btPath(item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep), ii.lazyOpen)
+}
+
+// openBtOf - opens index `btPath` of item if it exists, in lazy-open mode only remembers path
+func openBtOf(item *filesItem, btPath string, lazyOpen bool) (err error) {
+	if item.hasBt() || !dir.FileExist(btPath) {
+		return nil
+	}
+	if lazyOpen {
+		item.btPath = btPath
+		return nil
+	}
+	item.bt, err = OpenBtIndex(btPath)
+	return err
+}
+
+// buildBt - .efbt of new .ef file, nil if disabled
+func (ii *InvertedIndex) buildBt(ctx context.Context, decomp *compress.Decompressor, fromStep, toStep uint64) (*BtIndex, error) {
+	if !ii.btIndex {
+		return nil, nil
+	}
+	bt, err := buildBtIndex(ctx, decomp, ii.btPath(fromStep, toStep), nil)
+	if err != nil {
+		return nil, fmt.Errorf("build %s efbt: %w", ii.filenameBase, err)
+	}
+	return bt, nil
+}
+
+// missedBtFiles - .bt is written to temporary file and renamed: unlike recsplit it needs no build markers
+func (ii *InvertedIndex) missedBtFiles() (l []*filesItem) {
+	if !ii.btIndex {
+		return nil
+	}
+	ii.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if !item.hasBt() && !dir.FileExist(ii.btPath(item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep)) {
+				l = append(l, item)
+			}
+		}
+		return true
+	})
+	return l
+}
+
+// buildMissedBt - like buildMissedIdx, but without build markers
+func buildMissedBt(ctx context.Context, ps *background.ProgressSet, d *compress.Decompressor, btPath string) error {
+	p := &background.Progress{}
+	p.Name.Store(filepath.Base(btPath))
+	p.Total.Store(uint64(d.Count() / 2))
+	ps.Add(p)
+	defer ps.Delete(p)
+	bt, err := buildBtIndex(ctx, d, btPath, p)
+	if err != nil {
+		return err
+	}
+	bt.Close() // opened by openFiles
+	return nil
+}
+
+// SetBtIndex - build .bt (see BtIndex) of each .kv file (and .efbt of history): IteratePrefix seeks inside of files
+// by prefix of any length, and keys are found by it in files without .kvi. Missing .bt of existing files are built
+// by BuildMissedIndices.
+func (d *Domain) SetBtIndex(v bool) {
+	d.kvBtIndex = v
+	d.History.SetBtIndex(v)
+}
+
+// openKvBt - opens .bt of part p of file item
+func (d *Domain) openKvBt(item *filesItem, p int) error {
+	fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+	return openBtOf(item.part(p), d.kvFilePath(fromStep, toStep, "bt", p), d.lazyOpen)
+}
+
+// buildKvBt - .bt of part p of new .kv file, nil if disabled
+func (d *Domain) buildKvBt(ctx context.Context, decomp *compress.Decompressor, fromStep, toStep uint64, p int) (*BtIndex, error) {
+	if !d.kvBtIndex {
+		return nil, nil
+	}
+	bt, err := buildBtIndex(ctx, decomp, d.kvFilePath(fromStep, toStep, "bt", p), nil)
+	if err != nil {
+		return nil, fmt.Errorf("build %s bt: %w", d.filenameBase, err)
+	}
+	return bt, nil
+}
+
+// openKvBts - opens .bt of all parts of file item
+func (d *Domain) openKvBts(item *filesItem) error {
+	for p := 0; p < item.partsCount(); p++ {
+		if err := d.openKvBt(item, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Domain) buildMissedKvBts(ctx context.Context, sem *semaphore.Weighted, ps *background.ProgressSet) error {
+	if !d.kvBtIndex {
+		return nil
+	}
+	type missedBt struct {
+		part   *filesItem
+		btPath string
+	}
+	var missed []missedBt
+	d.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			for p, part := range item.allParts() {
+				if btPath := d.kvFilePath(fromStep, toStep, "bt", p); !part.hasBt() && !dir.FileExist(btPath) {
+					missed = append(missed, missedBt{part: part, btPath: btPath})
+				}
+			}
+		}
+		return true
+	})
+	g, ctx := errgroup.WithContext(ctx)
+	for _, m := range missed {
+		m := m
+		g.Go(func() error {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+			if _, err := d.cpuLimit.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer d.cpuLimit.Release(1)
+			log.Info("[snapshots] build idx", "file", filepath.Base(m.btPath))
+			if err := m.part.open(); err != nil {
+				return err
+			}
+			return buildMissedBt(ctx, ps, m.part.decompressor, m.btPath)
+		})
+	}
+	return g.Wait()
+}
+
+// lookupItem - file i with own getter and reader for lookupKey
+func (ic *InvertedIndexContext) lookupItem(i int) (ctxItem, error) {
+	item := ic.files[i]
+	src := item.src
+	if err := src.open(); err != nil {
+		return item, err
+	}
+	if src.index == nil && src.bt == nil {
+		return item, ic.ii.errWithoutIndex()
+	}
+	item.getter = src.decompressor.MakeGetter()
+	if src.index != nil {
+		item.reader = recsplit.NewIndexReader(src.index)
+	}
+	return item, nil
+}
+
+// lookup - lookupKey in file i by stateless getter and reader
+func (ic *InvertedIndexContext) lookup(i int, key []byte) (uint64, bool, error) {
+	src := ic.files[i].src
+	if err := src.open(); err != nil {
+		return 0, false, err
+	}
+	src.reads.lookup()
+	if src.index != nil {
+		reader, err := ic.statelessIdxReader(i)
+		if err != nil {
+			return 0, false, err
+		}
+		offset, ok := lookupKey(src, reader, nil, key)
+		return offset, ok, nil
+	}
+	if src.bt == nil {
+		return 0, false, ic.ii.errWithoutIndex()
+	}
+	g, err := ic.statelessGetter(i)
+	if err != nil {
+		return 0, false, err
+	}
+	offset, ok := lookupKey(src, nil, g, key)
+	return offset, ok, nil
+}
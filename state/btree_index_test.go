@@ -0,0 +1,106 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTestBtIndex(t *testing.T, keys [][]byte) (*compress.Decompressor, *BtIndex) {
+	t.Helper()
+	dir := t.TempDir()
+	datPath := filepath.Join(dir, "test.0-1.ef")
+	comp, err := compress.NewCompressor(context.Background(), t.Name(), datPath, dir, compress.MinPatternScore, 1, log.LvlDebug)
+	require.NoError(t, err)
+	defer comp.Close()
+	for i, k := range keys {
+		require.NoError(t, comp.AddUncompressedWord(k))
+		require.NoError(t, comp.AddUncompressedWord([]byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, comp.Compress())
+	d, err := compress.NewDecompressor(datPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { d.Close() })
+	bt, err := buildBtIndex(context.Background(), d, filepath.Join(dir, "test.0-1.efbt"), nil)
+	require.NoError(t, err)
+	bt.Close()
+	bt, err = OpenBtIndex(filepath.Join(dir, "test.0-1.efbt"))
+	require.NoError(t, err)
+	t.Cleanup(bt.Close)
+	return d, bt
+}
+
+func TestBtIndex(t *testing.T) {
+	// keys of different length: several nodes of fanout and last incomplete node
+	var keys [][]byte
+	for i := 1; i <= 3*btFanout+7; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%06d%s", 2*i, strings.Repeat("x", i%3))))
+	}
+	d, bt := buildTestBtIndex(t, keys)
+	require.Equal(t, uint64(len(keys)), bt.KeyCount())
+	g := d.MakeGetter()
+
+	for i, k := range keys {
+		require.Equal(t, uint64(i), bt.Seek(g, k), "key %x", k)
+		offset, ok := bt.SeekOffset(g, k)
+		require.True(t, ok)
+		g.Reset(offset)
+		found, _ := g.NextUncompressed()
+		require.Equal(t, k, found)
+		v, _ := g.NextUncompressed()
+		require.Equal(t, fmt.Sprintf("value%d", i), string(v))
+	}
+	for i := 1; i < len(keys); i++ { // key between keys[i-1] and keys[i]
+		between := append(append([]byte{}, keys[i-1]...), 0)
+		require.Equal(t, uint64(i), bt.Seek(g, between), "key %x", between)
+	}
+	require.Equal(t, uint64(0), bt.Seek(g, nil))
+	require.Equal(t, bt.KeyCount(), bt.Seek(g, []byte{0xff}))
+	_, ok := bt.SeekOffset(g, []byte{0xff})
+	require.False(t, ok)
+
+	d, bt = buildTestBtIndex(t, nil)
+	require.Equal(t, uint64(0), bt.KeyCount())
+	_, ok = bt.SeekOffset(d.MakeGetter(), nil)
+	require.False(t, ok)
+}
+
+func TestBtIndexUnsorted(t *testing.T) {
+	dir := t.TempDir()
+	datPath := filepath.Join(dir, "test.0-1.ef")
+	comp, err := compress.NewCompressor(context.Background(), t.Name(), datPath, dir, compress.MinPatternScore, 1, log.LvlDebug)
+	require.NoError(t, err)
+	defer comp.Close()
+	for _, w := range []string{"b", "1", "a", "2"} {
+		require.NoError(t, comp.AddUncompressedWord([]byte(w)))
+	}
+	require.NoError(t, comp.Compress())
+	d, err := compress.NewDecompressor(datPath)
+	require.NoError(t, err)
+	defer d.Close()
+	_, err = buildBtIndex(context.Background(), d, filepath.Join(dir, "test.0-1.efbt"), nil)
+	require.Error(t, err)
+	require.NoFileExists(t, filepath.Join(dir, "test.0-1.efbt"))
+}
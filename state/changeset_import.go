@@ -0,0 +1,118 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+)
+
+// ChangeSource - stream of changes in order of blocks: key (legacy layout, see ChangesetReader) and its value
+// before block. Implemented by ChangesetReader: legacy changesets of db are read by NewChangesetReader of non-temporal tx.
+type ChangeSource interface {
+	ForEachChange(storage bool, fromBlock, toBlock uint64, walker func(blockN uint64, k, v []byte) error) error
+}
+
+type ChangesetImportResult struct {
+	Blocks         uint64
+	AccountChanges uint64
+	StorageChanges uint64
+	ToTxNum        uint64 // first txNum after imported blocks: files of imported history are built by Freeze(ToTxNum)
+}
+
+// ImportChangesets - writes changes of blocks [fromBlock; toBlock) from `src` into account and storage histories, as
+// if they were written during execution: then they are collated and built into files by usual BuildFiles/Freeze.
+// Allows to migrate history of archive node without re-execution. Blocks are mapped to txNums by rawdbv3.TxNums
+// (must be filled for imported blocks) and history granularity is block: change is recorded at first txNum of block,
+// so reads inside of block return value before block. Incarnations of storage keys are dropped, code history
+// is not imported (legacy changesets have no code). Imported range must be after existing files.
+func (a *AggregatorV3) ImportChangesets(ctx context.Context, tx kv.RwTx, src ChangeSource, fromBlock, toBlock uint64) (res ChangesetImportResult, err error) {
+	if fromBlock >= toBlock {
+		return res, nil
+	}
+	fromTxNum, err := rawdbv3.TxNums.Min(tx, fromBlock)
+	if err != nil {
+		return res, err
+	}
+	if endTxNum := a.EndTxNumMinimax(); fromTxNum < endTxNum {
+		return res, fmt.Errorf("ImportChangesets: block %d (txNum %d) is covered by files up to txNum %d", fromBlock, fromTxNum, endTxNum)
+	}
+	lastTxNum, err := rawdbv3.TxNums.Max(tx, toBlock-1)
+	if err != nil {
+		return res, err
+	}
+	if minTxNum, err := rawdbv3.TxNums.Min(tx, toBlock-1); err != nil {
+		return res, err
+	} else if minTxNum > lastTxNum {
+		return res, fmt.Errorf("ImportChangesets: no txNums of block %d", toBlock-1)
+	}
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	a.SetTx(tx)
+	a.StartWrites()
+	defer a.FinishWrites()
+	for _, storage := range []bool{false, true} {
+		h, name := a.accounts, "accounts"
+		if storage {
+			h, name = a.storage, "storage"
+		}
+		curBlock := fromBlock
+		h.SetTxNum(fromTxNum)
+		if err = src.ForEachChange(storage, fromBlock, toBlock, func(blockN uint64, k, v []byte) error {
+			if blockN != curBlock {
+				txNum, err := rawdbv3.TxNums.Min(tx, blockN)
+				if err != nil {
+					return err
+				}
+				h.SetTxNum(txNum)
+				curBlock = blockN
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-logEvery.C:
+					log.Info("[snapshots] import changesets", "history", name, "block", blockN, "to", toBlock)
+				default:
+				}
+			}
+			if !storage {
+				res.AccountChanges++
+				return h.AddPrevValue(k, nil, v)
+			}
+			if len(k) != length.Addr+length.Incarnation+length.Hash {
+				return fmt.Errorf("unexpected storage key length %d, block %d", len(k), blockN)
+			}
+			res.StorageChanges++
+			return h.AddPrevValue(k[:length.Addr], k[length.Addr+length.Incarnation:], v)
+		}); err != nil {
+			return res, fmt.Errorf("ImportChangesets: %s: %w", name, err)
+		}
+	}
+	if err = a.Flush(ctx, tx); err != nil {
+		return res, err
+	}
+	res.Blocks, res.ToTxNum = toBlock-fromBlock, lastTxNum+1
+	a.SetTxNum(lastTxNum)
+	return res, nil
+}
@@ -0,0 +1,281 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+)
+
+// FileFetcher - remote storage of files (S3, GCS, ...). Objects are addressed by file name.
+// Implementations must be safe for concurrent use.
+type FileFetcher interface {
+	Upload(ctx context.Context, name, localPath string) error
+	Fetch(ctx context.Context, name, localPath string) error
+}
+
+// DirFetcher - FileFetcher over directory: mounted bucket (s3fs, gcsfuse), NFS, or local dir in tests
+type DirFetcher struct{ Dir string }
+
+func (f DirFetcher) Upload(ctx context.Context, name, localPath string) error {
+	return copyFile(localPath, filepath.Join(f.Dir, name))
+}
+func (f DirFetcher) Fetch(ctx context.Context, name, localPath string) error {
+	return copyFile(filepath.Join(f.Dir, name), localPath)
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(to+".tmp", to)
+}
+
+// remoteSuffix - stub of offloaded file: accounts.0-32.ef.remote. Offloaded file is visible to scan of dir
+// as long as stub exists, local copy of it may be evicted.
+const remoteSuffix = ".remote"
+
+func fileOrStubExist(path string) bool {
+	return dir.FileExist(path) || dir.FileExist(path+remoteSuffix)
+}
+
+// withOffloadedFiles - adds to entries of dir offloaded files which have no local copy
+func withOffloadedFiles(files []fs.DirEntry) []fs.DirEntry {
+	local := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		local[f.Name()] = struct{}{}
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), remoteSuffix)
+		if name == f.Name() || !f.Type().IsRegular() {
+			continue
+		}
+		if _, ok := local[name]; !ok {
+			files = append(files, offloadedEntry{name})
+		}
+	}
+	return files
+}
+
+type offloadedEntry struct{ name string }
+
+func (e offloadedEntry) Name() string               { return e.name }
+func (e offloadedEntry) IsDir() bool                { return false }
+func (e offloadedEntry) Type() fs.FileMode          { return 0 }
+func (e offloadedEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrNotExist }
+
+// ColdStorageCfg - see AggregatorV3.SetColdStorage
+type ColdStorageCfg struct {
+	Fetcher FileFetcher
+	// CacheSize - max size of local copies of offloaded files. Least recently opened idle files are evicted above it,
+	// files used by open contexts are not evicted.
+	CacheSize uint64
+}
+
+// coldStorage - local cache of offloaded files, shared by all entities of aggregator
+type coldStorage struct {
+	ctx context.Context
+	ColdStorageCfg
+
+	lock  sync.Mutex
+	items map[string]*coldItem // by datPath
+	tick  uint64
+}
+
+type coldItem struct {
+	item     *filesItem
+	lastUse  uint64
+	size     uint64 // of local copies, 0 - evicted
+	uploaded bool   // stubs of data and index exist
+}
+
+func newColdStorage(ctx context.Context, cfg ColdStorageCfg) *coldStorage {
+	return &coldStorage{ctx: ctx, ColdStorageCfg: cfg, items: map[string]*coldItem{}}
+}
+
+func localSize(paths ...string) (size uint64) {
+	for _, p := range paths {
+		if p != "" {
+			size += uint64(fileSize(p))
+		}
+	}
+	return size
+}
+
+// register - called by openFiles in lazy-open mode for each file
+func (c *coldStorage) register(item *filesItem) {
+	item.cold = c
+	if !item.frozen {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items[item.datPath] = &coldItem{item: item, size: localSize(item.datPath, item.idxPath), uploaded: dir.FileExist(item.datPath + remoteSuffix)}
+}
+
+func (c *coldStorage) forget(datPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.items, datPath)
+}
+
+// fetch - downloads evicted data and index files of item. Called under item.openLock.
+func (c *coldStorage) fetch(item *filesItem) error {
+	for _, p := range []string{item.datPath, item.idxPath} {
+		if p == "" || dir.FileExist(p) || !dir.FileExist(p+remoteSuffix) {
+			continue
+		}
+		log.Debug("[snapshots] fetch offloaded file", "file", filepath.Base(p))
+		if err := c.Fetcher.Fetch(c.ctx, filepath.Base(p), p); err != nil {
+			return fmt.Errorf("fetch %s: %w", filepath.Base(p), err)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ci, ok := c.items[item.datPath]; ok {
+		c.tick++
+		ci.lastUse, ci.size = c.tick, localSize(item.datPath, item.idxPath)
+	}
+	return nil
+}
+
+// evictOverBudget - removes local copies of least recently used offloaded files until cache fits CacheSize
+func (c *coldStorage) evictOverBudget() (evicted int) {
+	for {
+		c.lock.Lock()
+		var total uint64
+		var lru *coldItem
+		for _, ci := range c.items {
+			if !ci.uploaded || ci.size == 0 {
+				continue
+			}
+			total += ci.size
+			if ci.item.readers.Load() == 0 && (lru == nil || ci.lastUse < lru.lastUse) {
+				lru = ci
+			}
+		}
+		c.lock.Unlock()
+		if total <= c.CacheSize || lru == nil || !lru.item.evictLocal() {
+			return evicted
+		}
+		c.lock.Lock()
+		lru.size = 0
+		c.lock.Unlock()
+		evicted++
+	}
+}
+
+// upload - offloads data and index of frozen file: uploads them and writes stubs
+func (c *coldStorage) upload(ctx context.Context, ci *coldItem) error {
+	for _, p := range []string{ci.item.datPath, ci.item.idxPath} {
+		if p == "" || dir.FileExist(p+remoteSuffix) {
+			continue
+		}
+		if err := c.Fetcher.Upload(ctx, filepath.Base(p), p); err != nil {
+			return fmt.Errorf("upload %s: %w", filepath.Base(p), err)
+		}
+		if err := os.WriteFile(p+remoteSuffix, nil, 0644); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ci.uploaded = true
+	return nil
+}
+
+// evictLocal - closes file and removes its local copies if no context is using it. Stubs stay.
+func (i *filesItem) evictLocal() bool {
+	if i.readers.Load() > 0 || i.canDelete.Load() {
+		return false
+	}
+	i.closeIdle()
+	i.openLock.Lock()
+	defer i.openLock.Unlock()
+	if i.readers.Load() > 0 || i.decompressor != nil || i.index != nil {
+		return false
+	}
+	for _, p := range []string{i.datPath, i.idxPath} {
+		if p != "" && dir.FileExist(p+remoteSuffix) {
+			_ = removeDataFile(p)
+		}
+	}
+	return true
+}
+
+// SetColdStorage - frozen files can be offloaded to remote storage by OffloadFrozenFiles, their local copies
+// are fetched on first use and kept in local cache of cfg.CacheSize. Enables lazy-open mode. Must be called before ReopenFolder.
+func (a *AggregatorV3) SetColdStorage(cfg ColdStorageCfg) {
+	a.SetLazyOpen(true)
+	a.cold = newColdStorage(a.ctx, cfg)
+	for _, ii := range []*InvertedIndex{a.accounts.InvertedIndex, a.storage.InvertedIndex, a.code.InvertedIndex, a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		ii.cold = a.cold
+	}
+}
+
+// OffloadFrozenFiles - uploads frozen files (with their indices) which are not uploaded yet and evicts local copies
+// above cache size. Returns amount of uploaded and evicted files. Objects in remote storage are never removed.
+func (a *AggregatorV3) OffloadFrozenFiles(ctx context.Context) (uploaded, evicted int, err error) {
+	if a.cold == nil {
+		return 0, 0, fmt.Errorf("offload: cold storage is not set")
+	}
+	a.cold.lock.Lock()
+	var toUpload []*coldItem
+	for _, ci := range a.cold.items {
+		if !ci.uploaded {
+			toUpload = append(toUpload, ci)
+		}
+	}
+	a.cold.lock.Unlock()
+	for _, ci := range toUpload {
+		if err = ctx.Err(); err != nil {
+			return uploaded, evicted, err
+		}
+		if err = a.cold.upload(ctx, ci); err != nil {
+			return uploaded, evicted, fmt.Errorf("offload: %w", err)
+		}
+		uploaded++
+	}
+	evicted = a.cold.evictOverBudget()
+	if uploaded > 0 || evicted > 0 {
+		log.Info("[snapshots] offload frozen files", "uploaded", uploaded, "evicted", evicted)
+	}
+	return uploaded, evicted, nil
+}
@@ -0,0 +1,290 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/exp/slices"
+
+	atomic2 "go.uber.org/atomic"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+)
+
+// memBudget - RAM budget of index bitmaps of collate phase, 0 - unlimited. Etl buffers are not counted. Budget of entity has global budget (shared by all
+// entities of AggregatorV3) as parent: reservation must fit into both.
+type memBudget struct {
+	limit  atomic2.Uint64
+	used   atomic2.Uint64
+	parent *memBudget
+}
+
+func newMemBudget(parent *memBudget) *memBudget { return &memBudget{parent: parent} }
+
+// reserve - false if budget is exceeded, then nothing is reserved
+func (b *memBudget) reserve(n uint64) bool {
+	if b == nil {
+		return true
+	}
+	if used := b.used.Add(n); b.limit.Load() > 0 && used > b.limit.Load() {
+		b.used.Sub(n)
+		return false
+	}
+	if !b.parent.reserve(n) {
+		b.used.Sub(n)
+		return false
+	}
+	return true
+}
+
+func (b *memBudget) release(n uint64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.used.Sub(n)
+	b.parent.release(n)
+}
+
+const (
+	collateKeyOverhead = 96 // map entry and empty roaring bitmap
+	collateTxNumSize   = 2  // roaring array container
+)
+
+var collateReserveStep = uint64(64 * datasize.KB) // granularity of reservations in memBudget
+
+// collatedBitmaps - key => txNums of collated range. Kept in RAM while they fit into memBudget, otherwise
+// spilled to tmpdir: sorted by etl, bitmaps of same key from different spills merged by finish.
+// Owned by collation: close returns bitmaps to pool and removes tmp files.
+type collatedBitmaps struct {
+	name        string
+	tmpdir      string
+	compressTmp bool
+	budget      *memBudget
+
+	m        map[string]*roaring64.Bitmap
+	size     uint64 // estimated size of `m`
+	reserved uint64 // in budget
+
+	spill   *etl.Collector // nil - nothing was spilled
+	spilled *os.File       // merged spills, records: uvarint(len(key)) key uvarint(len(bitmap)) bitmap
+}
+
+func newCollatedBitmaps(ii *InvertedIndex) *collatedBitmaps {
+	return &collatedBitmaps{name: ii.filenameBase, tmpdir: ii.tmpdir, compressTmp: ii.compressTmp, budget: ii.collateBudget, m: map[string]*roaring64.Bitmap{}}
+}
+
+func (b *collatedBitmaps) add(key []byte, txNum uint64) error {
+	bitmap, ok := b.m[string(key)]
+	if !ok {
+		bitmap = bitmapdb.NewBitmap64()
+		b.m[string(key)] = bitmap
+		b.size += uint64(len(key)) + collateKeyOverhead
+	}
+	bitmap.Add(txNum)
+	b.size += collateTxNumSize
+	if b.size <= b.reserved {
+		return nil
+	}
+	if b.budget.reserve(collateReserveStep) {
+		b.reserved += collateReserveStep
+		return nil
+	}
+	return b.spillToDisk()
+}
+
+func (b *collatedBitmaps) spillToDisk() error {
+	if len(b.m) == 0 {
+		return nil
+	}
+	if b.spill == nil {
+		// buffer of spill is RAM too: at most half of entity's budget
+		bufSize := etl.BufferOptimalSize / 8
+		if limit := datasize.ByteSize(b.budget.limit.Load()); limit > 0 && bufSize > limit/2 {
+			bufSize = limit / 2
+		}
+		b.spill = etl.NewCollector(b.name+"_collate", b.tmpdir, etl.NewSortableBuffer(bufSize))
+		b.spill.LogLvl(log.LvlTrace)
+		b.spill.SetCompressTmpFiles(b.compressTmp)
+		log.Debug("[snapshots] collate spills to disk", "name", b.name, "budget", datasize.ByteSize(b.budget.limit.Load()).HR())
+	}
+	for key, bitmap := range b.m {
+		bitmap.RunOptimize()
+		data, err := bitmap.ToBytes()
+		if err != nil {
+			return err
+		}
+		if err = b.spill.Collect([]byte(key), data); err != nil {
+			return err
+		}
+		bitmapdb.ReturnToPool64(bitmap)
+	}
+	b.m = map[string]*roaring64.Bitmap{}
+	b.size = 0
+	b.budget.release(b.reserved)
+	b.reserved = 0
+	return nil
+}
+
+// finish - must be called after last add
+func (b *collatedBitmaps) finish() error {
+	if b.spill == nil {
+		return nil
+	}
+	if err := b.spillToDisk(); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(b.tmpdir, "erigon-collate-")
+	if err != nil {
+		return err
+	}
+	b.spilled = f
+	w := bufio.NewWriterSize(f, etl.BufIOSize)
+	var curKey []byte
+	cur := bitmapdb.NewBitmap64()
+	defer bitmapdb.ReturnToPool64(cur)
+	var numBuf [binary.MaxVarintLen64]byte
+	write := func() error {
+		cur.RunOptimize()
+		data, err := cur.ToBytes()
+		if err != nil {
+			return err
+		}
+		for _, s := range [][]byte{curKey, data} {
+			n := binary.PutUvarint(numBuf[:], uint64(len(s)))
+			if _, err = w.Write(numBuf[:n]); err != nil {
+				return err
+			}
+			if _, err = w.Write(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	next := bitmapdb.NewBitmap64()
+	defer bitmapdb.ReturnToPool64(next)
+	if err = b.spill.Load(nil, "", func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		if curKey != nil && !bytes.Equal(k, curKey) {
+			if err := write(); err != nil {
+				return err
+			}
+			cur.Clear()
+		}
+		curKey = append(curKey[:0], k...)
+		next.Clear()
+		if err := next.UnmarshalBinary(v); err != nil {
+			return err
+		}
+		cur.Or(next)
+		return nil
+	}, etl.TransformArgs{}); err != nil {
+		return fmt.Errorf("merge %s collate spills: %w", b.name, err)
+	}
+	if curKey != nil {
+		if err = write(); err != nil {
+			return err
+		}
+	}
+	b.spill.Close()
+	b.spill = nil
+	return w.Flush()
+}
+
+// forEach - in order of keys, can be called many times. `bitmap` is valid only until `f` returns
+func (b *collatedBitmaps) forEach(f func(key []byte, bitmap *roaring64.Bitmap) error) error {
+	if b.spilled == nil {
+		keys := make([]string, 0, len(b.m))
+		for key := range b.m {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := f([]byte(key), b.m[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, err := b.spilled.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(b.spilled, etl.BufIOSize)
+	bitmap := bitmapdb.NewBitmap64()
+	defer bitmapdb.ReturnToPool64(bitmap)
+	var key, data []byte
+	read := func(buf []byte) ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		_, err = io.ReadFull(r, buf)
+		return buf, err
+	}
+	for {
+		var err error
+		if key, err = read(key); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if data, err = read(data); err != nil {
+			return err
+		}
+		bitmap.Clear()
+		if err = bitmap.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		if err = f(key, bitmap); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *collatedBitmaps) close() {
+	if b == nil {
+		return
+	}
+	for _, bitmap := range b.m {
+		bitmapdb.ReturnToPool64(bitmap)
+	}
+	b.m = nil
+	b.budget.release(b.reserved)
+	b.reserved = 0
+	if b.spill != nil {
+		b.spill.Close()
+		b.spill = nil
+	}
+	if b.spilled != nil {
+		_ = b.spilled.Close()
+		_ = os.Remove(b.spilled.Name())
+		b.spilled = nil
+	}
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+func collatedToMap(t *testing.T, b *collatedBitmaps) map[string][]uint64 {
+	t.Helper()
+	res := map[string][]uint64{}
+	var prev []byte
+	require.NoError(t, b.forEach(func(key []byte, bitmap *roaring64.Bitmap) error {
+		require.Less(t, string(prev), string(key)) // sorted, without duplicates
+		prev = append(prev[:0], key...)
+		res[string(key)] = bitmap.ToArray()
+		return nil
+	}))
+	return res
+}
+
+func TestCollateMemBudget(t *testing.T) {
+	_, db, ii, _ := filledInvIndex(t)
+	ctx := context.Background()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	global := newMemBudget(nil)
+	ii.collateBudget.parent = global
+
+	bs, err := ii.collate(ctx, 0, 5*ii.aggregationStep, tx, logEvery)
+	require.NoError(t, err)
+	require.Nil(t, bs.spilled)
+	require.NotZero(t, global.used.Load())
+	expect := collatedToMap(t, bs)
+	bs.close()
+	require.Zero(t, global.used.Load())
+	require.Zero(t, ii.collateBudget.used.Load())
+
+	// each added txNum exceeds budget: bitmaps of same key are merged from many spills
+	global.limit.Store(1)
+	bs, err = ii.collate(ctx, 0, 5*ii.aggregationStep, tx, logEvery)
+	require.NoError(t, err)
+	require.NotNil(t, bs.spilled)
+	require.Zero(t, len(bs.m))
+	require.Equal(t, expect, collatedToMap(t, bs))
+	require.Equal(t, expect, collatedToMap(t, bs)) // can be read many times
+
+	sf, err := ii.buildFiles(ctx, 0, bs) // closes bitmaps
+	require.NoError(t, err)
+	sf.Close()
+	entries, err := os.ReadDir(ii.tmpdir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasPrefix(e.Name(), "erigon-collate-") || strings.HasPrefix(e.Name(), "erigon-sortable-buf-"), e.Name())
+	}
+	require.Zero(t, global.used.Load())
+}
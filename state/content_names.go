@@ -0,0 +1,118 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/verify"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// contentHashLen - amount of bytes of sha256 of file content embedded in name
+const contentHashLen = 8
+
+var contentNameRe = regexp.MustCompile(`^([a-z]+)\.([0-9]+)-([0-9]+)\.([0-9a-f]{16})\.(v|ef)$`)
+
+// contentAddressedName - accounts.0-32.ef -> accounts.0-32.<hash>.ef
+func contentAddressedName(name, hash string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+func fileContentHash(path string) (string, error) {
+	h, err := verify.HashFile(path, verify.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h[:contentHashLen]), nil
+}
+
+// addressByContent - moves data file to name with short hash of its content and leaves in its place
+// relative symlink with step-range name: files are found, opened and exported by step-range names as before.
+// Identical files built by different nodes have same names: distribution layers can deduplicate them,
+// different names for same step range mean divergent files.
+func addressByContent(datPath string) error {
+	hash, err := fileContentHash(datPath)
+	if err != nil {
+		return fmt.Errorf("content hash of %s: %w", filepath.Base(datPath), err)
+	}
+	name := contentAddressedName(filepath.Base(datPath), hash)
+	if err = os.Rename(datPath, filepath.Join(filepath.Dir(datPath), name)); err != nil {
+		return err
+	}
+	return os.Symlink(name, datPath)
+}
+
+// isDataFileEntry - regular file or step-range link to content-addressed file
+func isDataFileEntry(e fs.DirEntry) bool {
+	return e.Type().IsRegular() || e.Type()&fs.ModeSymlink != 0
+}
+
+// contentName - name of content-addressed file which data file links to, empty if data file is not a link
+func contentName(datPath string) string {
+	target, err := os.Readlink(datPath)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// removeDataFile - removes data file and content-addressed file it links to
+func removeDataFile(datPath string) error {
+	if name := contentName(datPath); name != "" {
+		if err := os.Remove(filepath.Join(filepath.Dir(datPath), name)); err != nil && !os.IsNotExist(err) {
+			log.Trace("remove", "err", err, "file", name)
+		}
+	}
+	return os.Remove(datPath)
+}
+
+// removeOrphanContentFiles - content-addressed files of entity which no step-range link points to:
+// leftovers of interrupted build or of files replaced by Repack
+func removeOrphanContentFiles(dir, filenameBase string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		subs := contentNameRe.FindStringSubmatch(e.Name())
+		if len(subs) != 6 || subs[1] != filenameBase || !e.Type().IsRegular() {
+			continue
+		}
+		link := filepath.Join(dir, fmt.Sprintf("%s.%s-%s.%s", subs[1], subs[2], subs[3], subs[5]))
+		if contentName(link) == e.Name() {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, e.Name()))
+		log.Debug("[clean] remove", "file", e.Name(), "err", err)
+	}
+}
+
+// SetContentAddressedNames - built and merged history and inverted index files (.v, .ef) are named by hash
+// of their content, see addressByContent. Indices are not: they depend on random salt. Files built before are kept as is.
+func (a *AggregatorV3) SetContentAddressedNames(v bool) {
+	for _, ii := range []*InvertedIndex{a.accounts.InvertedIndex, a.storage.InvertedIndex, a.code.InvertedIndex, a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		ii.contentAddressed = v
+	}
+}
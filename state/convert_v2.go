@@ -0,0 +1,185 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+const (
+	v2BackupDir     = "v2"        // subdir of aggregator's dir: files of Aggregator which are not used by AggregatorV3
+	v2ConvertedMark = "converted" // file in v2BackupDir: conversion is done
+)
+
+var v2FileNameRe = regexp.MustCompile(`^([a-z]+)\.([0-9]+)-([0-9]+)\.([a-z.]+)$`)
+
+// ConvertV2Args - settings of ConvertV2Files
+type ConvertV2Args struct {
+	Tmpdir          string
+	AggregationStep uint64
+	Workers         int // compression workers, 0 - 1
+	// AccountValue - re-encodes value of account history from format written by user of Aggregator
+	// to format of AggregatorV3's user. nil - values are kept as is.
+	AccountValue func(v2 []byte) ([]byte, error)
+}
+
+// ConvertV2Files - converts files of Aggregator (v2) in dir to files of AggregatorV3, without re-execution:
+//   - history (.v/.ef) and inverted index (.ef) files have same format in both and are kept,
+//     values of account history are re-encoded if ConvertV2Args.AccountValue is set,
+//   - files of domain values (.kv/.kvi/.bt) and of commitment domain are not used by AggregatorV3:
+//     they are moved to subdir "v2" - remove it after checking converted files,
+//   - missing indices (.vi/.efi) are built.
+//
+// Must run before AggregatorV3 is opened on dir. Interrupted conversion can be started again,
+// dir without files of Aggregator is not changed. Returns false if there was nothing to convert.
+func ConvertV2Files(ctx context.Context, dirPath string, args ConvertV2Args) (converted bool, err error) {
+	backup := filepath.Join(dirPath, v2BackupDir)
+	if dir.FileExist(filepath.Join(backup, v2ConvertedMark)) {
+		return false, nil
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	var v2Only, accountVals []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		subs := v2FileNameRe.FindStringSubmatch(e.Name())
+		if len(subs) != 5 {
+			continue
+		}
+		switch {
+		case subs[1] == "commitment", subs[4] == "kv", subs[4] == "kvi", subs[4] == "bt":
+			v2Only = append(v2Only, e.Name())
+		case subs[1] == "accounts" && subs[4] == "v":
+			accountVals = append(accountVals, e.Name())
+		}
+	}
+	if len(v2Only) == 0 && !dir.Exist(backup) { // not a dir of Aggregator or already converted
+		return false, nil
+	}
+	if err = os.MkdirAll(backup, 0755); err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	log.Info("[snapshots] convert v2 files", "dir", dirPath, "unused", len(v2Only), "accounts history", len(accountVals))
+
+	if args.AccountValue != nil {
+		// files moved to backup by interrupted conversion
+		backupEntries, err := os.ReadDir(backup)
+		if err != nil {
+			return false, fmt.Errorf("convert v2: %w", err)
+		}
+		for _, e := range backupEntries {
+			if subs := v2FileNameRe.FindStringSubmatch(e.Name()); len(subs) == 5 && subs[1] == "accounts" && subs[4] == "v" && !dir.FileExist(filepath.Join(dirPath, e.Name())) {
+				accountVals = append(accountVals, e.Name())
+			}
+		}
+		for _, name := range accountVals {
+			if err = convertV2AccountVals(ctx, dirPath, backup, name, args); err != nil {
+				return false, fmt.Errorf("convert v2 %s: %w", name, err)
+			}
+		}
+	}
+	for _, name := range v2Only {
+		if err = os.Rename(filepath.Join(dirPath, name), filepath.Join(backup, name)); err != nil {
+			return false, fmt.Errorf("convert v2: %w", err)
+		}
+	}
+
+	agg, err := NewAggregatorV3(ctx, dirPath, args.Tmpdir, args.AggregationStep, nil)
+	if err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	defer agg.Close()
+	if err = agg.ReopenFolder(); err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	if err = agg.BuildMissedIndices(ctx, semaphore.NewWeighted(4)); err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(backup, v2ConvertedMark), nil, 0644); err != nil {
+		return false, fmt.Errorf("convert v2: %w", err)
+	}
+	log.Info("[snapshots] convert v2 files done", "dir", dirPath, "backup", backup)
+	return true, nil
+}
+
+// convertV2AccountVals - moves .v (with its .vi and stats) to backup and writes re-encoded .v instead.
+// File which exists in both dirs is already converted.
+func convertV2AccountVals(ctx context.Context, dirPath, backup, name string, args ConvertV2Args) error {
+	from, to := filepath.Join(backup, name), filepath.Join(dirPath, name)
+	if !dir.FileExist(from) {
+		for _, n := range []string{name, name + "i", name + fileStatsSuffix} {
+			if !dir.FileExist(filepath.Join(dirPath, n)) {
+				continue
+			}
+			if err := os.Rename(filepath.Join(dirPath, n), filepath.Join(backup, n)); err != nil {
+				return err
+			}
+		}
+	} else if dir.FileExist(to) {
+		return nil
+	}
+
+	decomp, err := compress.NewDecompressor(from)
+	if err != nil {
+		return err
+	}
+	defer decomp.Close()
+	workers := args.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	tmpPath := to + ".tmp"
+	comp, err := compress.NewCompressor(ctx, "convert v2", tmpPath, args.Tmpdir, compress.MinPatternScore, workers, log.LvlTrace)
+	if err != nil {
+		return err
+	}
+	defer comp.Close()
+	var v []byte
+	g := decomp.MakeGetter() // accounts history is written without compression of values
+	for g.HasNext() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		v, _ = g.NextUncompressed()
+		newV, err := args.AccountValue(v)
+		if err != nil {
+			return err
+		}
+		if err = comp.AddUncompressedWord(newV); err != nil {
+			return err
+		}
+	}
+	if err = comp.Compress(); err != nil {
+		return err
+	}
+	comp.Close()
+	return os.Rename(tmpPath, to)
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// optionalIndices - indices which can be disabled: nothing else depends on them
+func (a *AggregatorV3) optionalIndices() []*InvertedIndex {
+	return []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo}
+}
+
+func (a *AggregatorV3) optionalIndex(name string) (*InvertedIndex, error) {
+	for _, ii := range a.optionalIndices() {
+		if ii.filenameBase == name {
+			return ii, nil
+		}
+	}
+	return nil, fmt.Errorf("index %q can't be disabled: only logaddrs, logtopics, tracesfrom, tracesto", name)
+}
+
+// disabledMarker - presence of file means index is disabled, survives restarts
+func (ii *InvertedIndex) disabledMarker() string {
+	return filepath.Join(ii.dir, ii.filenameBase+".disabled")
+}
+
+func (a *AggregatorV3) loadDisabledIndices() {
+	for _, ii := range a.optionalIndices() {
+		if _, err := os.Stat(ii.disabledMarker()); err == nil {
+			ii.disabled.Store(true)
+		}
+	}
+}
+
+// DisabledIndices - names of indices disabled by DisableIndex
+func (a *AggregatorV3) DisabledIndices() (names []string) {
+	for _, ii := range a.optionalIndices() {
+		if ii.disabled.Load() {
+			names = append(names, ii.filenameBase)
+		}
+	}
+	return names
+}
+
+// DisableIndex - soft-delete of optional index: its files are kept and readable, but build, merge, prune, warmup
+// and building of missed indices don't touch it, and it doesn't hold back EndTxNumMinimax/FrozenTxNum.
+// Writes to db continue and are not pruned - EnableIndex builds files of missed range from them.
+func (a *AggregatorV3) DisableIndex(name string) error {
+	ii, err := a.optionalIndex(name)
+	if err != nil {
+		return err
+	}
+	if ii.disabled.Load() {
+		return nil
+	}
+	if err = os.WriteFile(ii.disabledMarker(), nil, 0644); err != nil {
+		return fmt.Errorf("disable %s: %w", name, err)
+	}
+	ii.disabled.Store(true)
+	a.recalcMaxTxNum()
+	return nil
+}
+
+// EnableIndex - undelete of index disabled by DisableIndex: collates from db steps which were built for other
+// entities while index was disabled, merges them, and only then returns index to build/merge/prune loops.
+// Waits for background build and merge.
+func (a *AggregatorV3) EnableIndex(ctx context.Context, name string) error {
+	ii, err := a.optionalIndex(name)
+	if err != nil {
+		return err
+	}
+	if !ii.disabled.Load() {
+		return nil
+	}
+	if err = acquireFlag(ctx, &a.working); err != nil {
+		return err
+	}
+	defer a.working.Store(false)
+	if err = acquireFlag(ctx, &a.workingMerge); err != nil {
+		return err
+	}
+	defer a.workingMerge.Store(false)
+
+	logEvery := time.NewTicker(60 * time.Second)
+	defer logEvery.Stop()
+	fromStep, toStep := ii.endTxNumMinimax()/a.aggregationStep, a.maxTxNum.Load()/a.aggregationStep
+	for step := fromStep; step < toStep; step++ {
+		txFrom, txTo := step*a.aggregationStep, (step+1)*a.aggregationStep
+		var bitmaps *collatedBitmaps
+		if err = a.db.View(ctx, func(tx kv.Tx) (err error) {
+			bitmaps, err = ii.collate(ctx, txFrom, txTo, tx, logEvery)
+			return err
+		}); err != nil {
+			return fmt.Errorf("enable %s: %w", name, err)
+		}
+		if err = a.buildIndexStep(ctx, ii, step, bitmaps); err != nil {
+			return fmt.Errorf("enable %s: %w", name, err)
+		}
+	}
+
+	ii.disabled.Store(false)
+	if err = os.Remove(ii.disabledMarker()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("enable %s: %w", name, err)
+	}
+	a.recalcMaxTxNum()
+	for {
+		merged, err := a.mergeLoopStep(ctx, 1)
+		if err != nil {
+			return fmt.Errorf("enable %s: %w", name, err)
+		}
+		if !merged {
+			break
+		}
+	}
+	log.Info("[snapshots] index enabled", "name", name, "caught_up_steps", toStep-fromStep)
+	return nil
+}
+
+// buildIndexStep - builds and integrates files of 1 step of ii, under AggregatorV3.filesLock
+func (a *AggregatorV3) buildIndexStep(ctx context.Context, ii *InvertedIndex, step uint64, bitmaps *collatedBitmaps) error {
+	a.filesLock.Lock()
+	defer a.filesLock.Unlock()
+	sf, err := ii.buildFiles(ctx, step, bitmaps)
+	if err != nil {
+		return err
+	}
+	ii.integrateFiles(sf, step*a.aggregationStep, (step+1)*a.aggregationStep)
+	a.filesGen.Add(1)
+	return nil
+}
@@ -28,10 +28,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
 	"github.com/ledgerwatch/log/v3"
 	btree2 "github.com/tidwall/btree"
@@ -39,11 +39,13 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/erigon-lib/segment"
 )
 
 var (
@@ -63,11 +65,133 @@ type filesItem struct {
 	frozen   bool           // immutable, don't need atomic
 	refcount atomic2.Uint64 // only for `frozen=false`
 
-	// file can be deleted in 2 cases: 1. when `refcount == 0 && canDelete == true` 2. on app startup when `file.isSubsetOfFrozenFile()`
+	// file can be deleted in 2 cases: 1. when `readers == 0 && canDelete == true` (see markDeleted) 2. on app startup when `file.isSubsetOfFrozenFile()`
 	// other processes (which also reading files, may have same logic)
 	canDelete atomic2.Bool
+	// files on disk were replaced by files with same name (see History.Repack): on delete only close them
+	replaced atomic2.Bool
+	// merged into bigger file, but range is leased by external reader (see AggregatorV3.Lease): on delete only close them
+	leased atomic2.Bool
+
+	// lazy-open mode: decompressor/index stay nil until first use (see `open`) and can be closed by `closeIdle`
+	// paths are set only in lazy-open mode
+	datPath, idxPath string
+	openLock         sync.Mutex
+	readers          atomic2.Int32 // amount of open contexts which see this file (including frozen), -1 - closed and removed
+	cold             *coldStorage  // files may be offloaded: fetched by `open`, see AggregatorV3.SetColdStorage
+	reads            fileReads     // see FileInfo.Reads
+
+	// key-range parts 1..N of Domain file split by Domain.SetMaxFileSize, item itself is part 0.
+	// parts are sorted by firstKey and share startTxNum/endTxNum/frozen of item.
+	parts    []*filesItem
+	firstKey []byte // first key of part, nil for part 0
+
+	// overflow store of History file (.vb + .vbi, see History.SetBlobThreshold), nil if file has no large values.
+	// Opened, closed and removed together with item.
+	blobs *filesItem
+
+	// sorted index of .ef/.kv (see InvertedIndex.SetBtIndex, Domain.SetBtIndex), nil if file has no such index.
+	// btPath is set only in lazy-open mode, like idxPath.
+	bt     *BtIndex
+	btPath string
 }
 
+// open - opens decompressor and index (if .idx file exists) if they are not opened yet. Thread-safe.
+// In lazy-open mode decompressor/index/bt may be read only by holder of reference (see acquire) after open:
+// closeIdle takes openLock and skips files with readers, so reads are ordered after open and before release.
+func (i *filesItem) open() (err error) {
+	if i.datPath == "" { // not lazy - always opened
+		return nil
+	}
+	if i.cold != nil && i.decompressor == nil {
+		defer i.cold.evictOverBudget() // after unlock: eviction locks other items
+	}
+	i.openLock.Lock()
+	defer i.openLock.Unlock()
+	if i.decompressor == nil {
+		if i.cold != nil {
+			if err = i.cold.fetch(i); err != nil {
+				return err
+			}
+		}
+		if i.decompressor, err = compress.NewDecompressor(i.datPath); err != nil {
+			return fmt.Errorf("lazy open %s: %w", i.datPath, err)
+		}
+	}
+	if i.index == nil && i.idxPath != "" {
+		if i.index, err = recsplit.OpenIndex(i.idxPath); err != nil {
+			return fmt.Errorf("lazy open %s: %w", i.idxPath, err)
+		}
+	}
+	if i.bt == nil && i.btPath != "" {
+		if i.bt, err = OpenBtIndex(i.btPath); err != nil {
+			return fmt.Errorf("lazy open %s: %w", i.btPath, err)
+		}
+	}
+	for _, p := range i.parts {
+		if err = p.open(); err != nil {
+			return err
+		}
+	}
+	if i.blobs != nil {
+		return i.blobs.open()
+	}
+	return nil
+}
+
+// openFiles - lazy-opens files selected for merge, files are protected from closeIdle by readers of merging context
+func openFiles(files []*filesItem) error {
+	for _, f := range files {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeIdle - closes decompressor and index of lazy-opened file if no context is using it
+func (i *filesItem) closeIdle() (closed bool) {
+	if i.datPath == "" || i.readers.Load() > 0 || i.canDelete.Load() {
+		return false
+	}
+	i.openLock.Lock()
+	defer i.openLock.Unlock()
+	if i.readers.Load() > 0 {
+		return false
+	}
+	for _, p := range i.parts {
+		if p.closeIdle() {
+			closed = true
+		}
+	}
+	if i.blobs != nil && i.blobs.closeIdle() {
+		closed = true
+	}
+	if i.decompressor != nil {
+		if err := i.decompressor.Close(); err != nil {
+			log.Trace("close", "err", err, "file", i.decompressor.FileName())
+		}
+		i.decompressor = nil
+		closed = true
+	}
+	if i.index != nil {
+		if err := i.index.Close(); err != nil {
+			log.Trace("close", "err", err, "file", i.index.FileName())
+		}
+		i.index = nil
+		closed = true
+	}
+	if i.bt != nil {
+		i.bt.Close()
+		i.bt = nil
+		closed = true
+	}
+	return closed
+}
+
+func (i *filesItem) hasIndex() bool { return i.index != nil || i.idxPath != "" }
+func (i *filesItem) hasBt() bool    { return i.bt != nil || i.btPath != "" }
+
 func (i *filesItem) isSubsetOf(j *filesItem) bool {
 	return (j.startTxNum <= i.startTxNum && i.endTxNum <= j.endTxNum) && (j.startTxNum != i.startTxNum || i.endTxNum != j.endTxNum)
 }
@@ -78,13 +202,112 @@ func filesItemLess(i, j *filesItem) bool {
 	}
 	return i.endTxNum < j.endTxNum
 }
+
+// acquire - reference of context to file. False if file is already closed and removed (readers == -1):
+// context loaded list of files before file was superseded, it must re-load roFiles
+func (i *filesItem) acquire() bool {
+	for {
+		n := i.readers.Load()
+		if n < 0 {
+			return false
+		}
+		if i.readers.CAS(n, n+1) {
+			if !i.frozen {
+				i.refcount.Inc()
+			}
+			return true
+		}
+	}
+}
+
+// release - last context which sees superseded file (canDelete) closes and removes it
+func (i *filesItem) release() {
+	if !i.frozen {
+		i.refcount.Dec()
+	}
+	if i.readers.Dec() == 0 && i.canDelete.Load() {
+		i.tryRemove()
+	}
+}
+
+// markDeleted - file is superseded (merge, freeze, rescan, ...): closed and removed right away if no context uses it,
+// otherwise by release of last context. Call it after file is excluded from roFiles.
+func (i *filesItem) markDeleted() {
+	i.canDelete.Store(true)
+	i.tryRemove()
+}
+
+// tryRemove - only once: readers switched to -1, acquire of removed file fails
+func (i *filesItem) tryRemove() {
+	if i.readers.CAS(0, -1) {
+		i.closeFilesAndRemove()
+	}
+}
+
+// acquireAll - references of context to all files. On false nothing is acquired
+func acquireAll(files []ctxItem) bool {
+	for j, item := range files {
+		if !item.src.acquire() {
+			releaseAll(files[:j])
+			return false
+		}
+	}
+	return true
+}
+
+func releaseAll(files []ctxItem) {
+	for _, item := range files {
+		item.src.release()
+	}
+}
+
+// acquireRoFiles - files visible for new contexts, with references of context
+func acquireRoFiles(roFiles *atomic2.Pointer[[]ctxItem]) []ctxItem {
+	for {
+		if files := *roFiles.Load(); acquireAll(files) {
+			return files
+		}
+	}
+}
+
 func (i *filesItem) closeFilesAndRemove() {
+	remove := !i.replaced.Load() && !i.leased.Load()
+	for _, p := range i.parts {
+		p.replaced.Store(!remove)
+		p.closeFilesAndRemove()
+	}
+	if i.blobs != nil {
+		i.blobs.replaced.Store(!remove)
+		i.blobs.closeFilesAndRemove()
+	}
+	if i.cold != nil && remove {
+		i.cold.forget(i.datPath)
+		for _, p := range []string{i.datPath, i.idxPath} {
+			if p != "" {
+				_ = os.Remove(p + remoteSuffix)
+			}
+		}
+	}
+	if i.decompressor == nil && i.datPath != "" && remove { // lazy and never opened
+		if err := removeDataFile(i.datPath); err != nil {
+			log.Trace("close", "err", err, "file", i.datPath)
+		}
+		removeFileStats(i.datPath)
+	}
+	if i.index == nil && i.idxPath != "" && remove {
+		if err := os.Remove(i.idxPath); err != nil {
+			log.Trace("close", "err", err, "file", i.idxPath)
+		}
+	}
 	if i.decompressor != nil {
 		if err := i.decompressor.Close(); err != nil {
 			log.Trace("close", "err", err, "file", i.decompressor.FileName())
 		}
-		if err := os.Remove(i.decompressor.FilePath()); err != nil {
-			log.Trace("close", "err", err, "file", i.decompressor.FileName())
+		if remove {
+			if err := removeDataFile(i.decompressor.FilePath()); err != nil {
+				log.Trace("close", "err", err, "file", i.decompressor.FileName())
+			}
+			removeFileStats(i.decompressor.FilePath())
 		}
 		i.decompressor = nil
 	}
@@ -92,11 +315,27 @@ func (i *filesItem) closeFilesAndRemove() {
 		if err := i.index.Close(); err != nil {
 			log.Trace("close", "err", err, "file", i.index.FileName())
 		}
-		if err := os.Remove(i.index.FilePath()); err != nil {
-			log.Trace("close", "err", err, "file", i.index.FileName())
+		if remove {
+			if err := os.Remove(i.index.FilePath()); err != nil {
+				log.Trace("close", "err", err, "file", i.index.FileName())
+			}
 		}
 		i.index = nil
 	}
+	if i.bt == nil && i.btPath != "" && remove {
+		if err := os.Remove(i.btPath); err != nil {
+			log.Trace("close", "err", err, "file", i.btPath)
+		}
+	}
+	if i.bt != nil {
+		i.bt.Close()
+		if remove {
+			if err := os.Remove(i.bt.FilePath()); err != nil {
+				log.Trace("close", "err", err, "file", i.bt.FileName())
+			}
+		}
+		i.bt = nil
+	}
 }
 
 type DomainStats struct {
@@ -120,7 +359,7 @@ func (ds *DomainStats) Accumulate(other DomainStats) {
 // Domain should not have any go routines or locks
 type Domain struct {
 	*History
-	files *btree2.BTreeG[*filesItem] // thread-safe, but maybe need 1 RWLock for all trees in AggregatorV3
+	files atomic2.Pointer[btree2.BTreeG[*filesItem]] // thread-safe tree, replaced as a whole by reOpenFolder (see newFilesTree)
 	// roFiles derivative from field `file`, but without garbage (canDelete=true, overlaps, etc...)
 	// MakeContext() using this field in zero-copy way
 	roFiles     atomic2.Pointer[[]ctxItem]
@@ -128,8 +367,12 @@ type Domain struct {
 	keysTable   string // key -> invertedStep , invertedStep = ^(txNum / aggregationStep), Needs to be table with DupSort
 	valsTable   string // key + invertedStep -> values
 	stats       DomainStats
-	prefixLen   int // Number of bytes in the keys that can be used for prefix iteration
+	prefixLen   int    // Number of bytes in the keys that can be used for prefix iteration
+	maxFileSize uint64 // Merged files bigger than this are split by key range, see SetMaxFileSize
+	kvBtIndex   bool   // .bt files are built, see SetBtIndex
 	mergesCount uint64
+
+	valuesEndTxNum atomic2.Uint64 // endTxNum of last .kv file, see endTxNumMinimax
 }
 
 func NewDomain(
@@ -149,7 +392,7 @@ func NewDomain(
 		keysTable: keysTable,
 		valsTable: valsTable,
 		prefixLen: prefixLen,
-		files:     btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false}),
+		files:     *atomic2.NewPointer(newFilesTree()),
 		roFiles:   *atomic2.NewPointer(&[]ctxItem{}),
 	}
 
@@ -166,6 +409,7 @@ func NewDomain(
 	if err = d.openFiles(); err != nil {
 		return nil, err
 	}
+	d.reCalcRoFiles()
 	d.defaultDc = d.MakeContext()
 	return d, nil
 }
@@ -179,6 +423,10 @@ func (d *Domain) GetAndResetStats() DomainStats {
 }
 
 func (d *Domain) scanStateFiles(files []fs.DirEntry) (uselessFiles []string) {
+	return d.scanStateFilesTo(d.files.Load(), files)
+}
+
+func (d *Domain) scanStateFilesTo(tree *btree2.BTreeG[*filesItem], files []fs.DirEntry) (uselessFiles []string) {
 	re := regexp.MustCompile("^" + d.filenameBase + ".([0-9]+)-([0-9]+).kv$")
 	var err error
 	for _, f := range files {
@@ -212,7 +460,7 @@ func (d *Domain) scanStateFiles(files []fs.DirEntry) (uselessFiles []string) {
 		{
 			var subSets []*filesItem
 			var superSet *filesItem
-			d.files.Walk(func(items []*filesItem) bool {
+			tree.Walk(func(items []*filesItem) bool {
 				for _, item := range items {
 					if item.isSubsetOf(newFile) {
 						subSets = append(subSets, item)
@@ -223,44 +471,56 @@ func (d *Domain) scanStateFiles(files []fs.DirEntry) (uselessFiles []string) {
 				return true
 			})
 			for _, subSet := range subSets {
-				d.files.Delete(subSet)
-				uselessFiles = append(uselessFiles,
-					fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, subSet.startTxNum/d.aggregationStep, subSet.endTxNum/d.aggregationStep),
-					fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, subSet.startTxNum/d.aggregationStep, subSet.endTxNum/d.aggregationStep),
-				)
+				tree.Delete(subSet)
+				uselessFiles = append(uselessFiles, d.partFileNames(subSet.startTxNum/d.aggregationStep, subSet.endTxNum/d.aggregationStep)...)
 			}
 			if superSet != nil {
-				uselessFiles = append(uselessFiles,
-					fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, startStep, endStep),
-					fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, startStep, endStep),
-				)
+				uselessFiles = append(uselessFiles, d.partFileNames(startStep, endStep)...)
 				continue
 			}
 		}
-		d.files.Set(newFile)
+		tree.Set(newFile)
 	}
-	d.reCalcRoFiles()
 	return uselessFiles
 }
 
 func (d *Domain) openFiles() error {
+	err := d.openFilesOf(d.files.Load())
+	d.valuesEndTxNum.Store(lastFileEndTxNum(d.files.Load()))
+	return err
+}
+
+// openFilesOf - opens files of `tree`, items of missing files are removed from it
+func (d *Domain) openFilesOf(tree *btree2.BTreeG[*filesItem]) error {
 	var err error
 	var totalKeys uint64
 
 	invalidFileItems := make([]*filesItem, 0)
-	d.files.Walk(func(items []*filesItem) bool {
+	tree.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				item.decompressor.Close()
-			}
 			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
 			datPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, fromStep, toStep))
 			if !dir.FileExist(datPath) {
 				invalidFileItems = append(invalidFileItems, item)
 				continue
 			}
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				return false
+			if d.lazyOpen {
+				item.datPath = datPath // opened items are shared with contexts: only missed indices are added
+				if idxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, fromStep, toStep)); item.idxPath == "" && dir.FileExist(idxPath) {
+					item.idxPath = idxPath
+				}
+				if err = d.openParts(item); err != nil {
+					return false
+				}
+				if err = d.openKvBts(item); err != nil {
+					return false
+				}
+				continue
+			}
+			if item.decompressor == nil {
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					return false
+				}
 			}
 
 			if item.index == nil {
@@ -273,6 +533,12 @@ func (d *Domain) openFiles() error {
 					totalKeys += item.index.KeyCount()
 				}
 			}
+			if err = d.openParts(item); err != nil {
+				return false
+			}
+			if err = d.openKvBts(item); err != nil {
+				return false
+			}
 		}
 		return true
 	})
@@ -280,14 +546,19 @@ func (d *Domain) openFiles() error {
 		return err
 	}
 	for _, item := range invalidFileItems {
-		d.files.Delete(item)
+		tree.Delete(item)
 	}
 	return nil
 }
 
 func (d *Domain) closeFiles() {
-	d.files.Walk(func(items []*filesItem) bool {
+	d.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			for _, part := range item.parts {
+				part.replaced.Store(true)
+				part.closeFilesAndRemove()
+			}
+			item.parts = nil
 			if item.decompressor != nil {
 				if err := item.decompressor.Close(); err != nil {
 					log.Trace("close", "err", err, "file", item.index.FileName())
@@ -300,17 +571,32 @@ func (d *Domain) closeFiles() {
 				}
 				item.index = nil
 			}
+			item.bt.Close()
+			item.bt = nil
 		}
 		return true
 	})
-	d.files.Clear()
+	d.files.Load().Clear()
 	d.reCalcRoFiles()
 }
 
+func (d *Domain) closeIdleFiles() (closed int) {
+	closed = d.History.closeIdleFiles()
+	d.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.closeIdle() {
+				closed++
+			}
+		}
+		return true
+	})
+	return closed
+}
+
 func (d *Domain) reCalcRoFiles() {
-	roFiles := make([]ctxItem, 0, d.files.Len())
+	roFiles := make([]ctxItem, 0, d.files.Load().Len())
 	var prevStart uint64
-	d.files.Walk(func(items []*filesItem) bool {
+	d.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.canDelete.Load() {
 				continue
@@ -346,6 +632,7 @@ func (d *Domain) reCalcRoFiles() {
 		roFiles = []ctxItem{}
 	}
 	d.roFiles.Store(&roFiles)
+	d.valuesEndTxNum.Store(lastFileEndTxNum(d.files.Load()))
 }
 
 func (d *Domain) Close() {
@@ -369,8 +656,7 @@ func (dc *DomainContext) get(key []byte, fromTxNum uint64, roTx kv.Tx) ([]byte,
 	}
 	if len(foundInvStep) == 0 {
 		atomic.AddUint64(&dc.d.stats.HistoryQueries, 1)
-		v, found := dc.readFromFiles(key, fromTxNum)
-		return v, found, nil
+		return dc.readFromFiles(key, fromTxNum)
 	}
 	//keySuffix := make([]byte, len(key)+8)
 	copy(dc.keyBuf[:], key)
@@ -469,6 +755,7 @@ type CursorItem struct {
 	c        kv.CursorDupSort
 	dg       *compress.Getter
 	dg2      *compress.Getter
+	blobs    *filesItem // overflow store of dg2, see filesItem.blobs
 	key      []byte
 	val      []byte
 	endTxNum uint64
@@ -523,8 +810,9 @@ type ctxItem struct {
 }
 
 type ctxLocalityItem struct {
-	reader *recsplit.IndexReader
+	reader *LocalityIdxReader
 	bm     *bitmapdb.FixedSizeBitmaps
+	shards *localityShards
 
 	file *filesItem
 }
@@ -540,37 +828,50 @@ func ctxItemLess(i, j ctxItem) bool { //nolint
 type DomainContext struct {
 	d       *Domain
 	files   []ctxItem
-	getters []*compress.Getter
-	readers []*recsplit.IndexReader
+	getters [][]*compress.Getter // by file and part
+	readers [][]*recsplit.IndexReader
 	hc      *HistoryContext
 	keyBuf  [60]byte // 52b key and 8b for inverted step
 	numBuf  [8]byte
 }
 
-func (dc *DomainContext) statelessGetter(i int) *compress.Getter {
+// statelessGetter - getter of part p of file i, see filesItem.partIdx
+func (dc *DomainContext) statelessGetter(i, p int) (*compress.Getter, error) {
 	if dc.getters == nil {
-		dc.getters = make([]*compress.Getter, len(dc.files))
+		dc.getters = make([][]*compress.Getter, len(dc.files))
+	}
+	if dc.getters[i] == nil {
+		dc.getters[i] = make([]*compress.Getter, dc.files[i].src.partsCount())
 	}
-	r := dc.getters[i]
+	r := dc.getters[i][p]
 	if r == nil {
-		r = dc.files[i].src.decompressor.MakeGetter()
-		dc.getters[i] = r
+		if err := dc.files[i].src.open(); err != nil {
+			return nil, err
+		}
+		r = dc.files[i].src.part(p).decompressor.MakeGetter()
+		dc.getters[i][p] = r
 	}
-	return r
+	return r, nil
 }
-func (dc *DomainContext) statelessIdxReader(i int) *recsplit.IndexReader {
+func (dc *DomainContext) statelessIdxReader(i, p int) (*recsplit.IndexReader, error) {
 	if dc.readers == nil {
-		dc.readers = make([]*recsplit.IndexReader, len(dc.files))
+		dc.readers = make([][]*recsplit.IndexReader, len(dc.files))
 	}
-	r := dc.readers[i]
+	if dc.readers[i] == nil {
+		dc.readers[i] = make([]*recsplit.IndexReader, dc.files[i].src.partsCount())
+	}
+	r := dc.readers[i][p]
 	if r == nil {
-		r = recsplit.NewIndexReader(dc.files[i].src.index)
-		dc.readers[i] = r
+		if err := dc.files[i].src.open(); err != nil {
+			return nil, err
+		}
+		r = recsplit.NewIndexReader(dc.files[i].src.part(p).index)
+		dc.readers[i][p] = r
 	}
-	return r
+	return r, nil
 }
 func (d *Domain) collectFilesStats() (datsz, idxsz, files uint64) {
-	d.History.files.Walk(func(items []*filesItem) bool {
+	d.History.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.index == nil {
 				return false
@@ -582,14 +883,16 @@ func (d *Domain) collectFilesStats() (datsz, idxsz, files uint64) {
 		return true
 	})
 
-	d.files.Walk(func(items []*filesItem) bool {
+	d.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.index == nil {
 				return false
 			}
-			datsz += uint64(item.decompressor.Size())
-			idxsz += uint64(item.index.Size())
-			files += 2
+			for _, part := range item.allParts() {
+				datsz += uint64(part.decompressor.Size())
+				idxsz += uint64(part.index.Size())
+				files += 2
+			}
 		}
 		return true
 	})
@@ -605,29 +908,17 @@ func (d *Domain) MakeContext() *DomainContext {
 	dc := &DomainContext{
 		d:     d,
 		hc:    d.History.MakeContext(),
-		files: *d.roFiles.Load(),
-	}
-	for _, item := range dc.files {
-		if !item.src.frozen {
-			item.src.refcount.Inc()
-		}
+		files: acquireRoFiles(&d.roFiles),
 	}
-
 	return dc
 }
 
 func (dc *DomainContext) Close() {
-	for _, item := range dc.files {
-		if item.src.frozen {
-			continue
-		}
-		refCnt := item.src.refcount.Dec()
-		//GC: last reader responsible to remove useles files: close it and delete
-		if refCnt == 0 && item.src.canDelete.Load() {
-			item.src.closeFilesAndRemove()
-		}
+	//GC: last reader responsible to remove useles files: close it and delete
+	releaseAll(dc.files)
+	if dc.hc != nil {
+		dc.hc.Close()
 	}
-	dc.hc.Close()
 }
 
 // IteratePrefix iterates over key-value pairs of the domain that start with given prefix
@@ -663,19 +954,38 @@ func (dc *DomainContext) IteratePrefix(prefix []byte, it func(k, v []byte)) erro
 		heap.Push(&cp, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(v), c: keysCursor, endTxNum: txNum, reverse: true})
 	}
 	for i, item := range dc.files {
-		reader := dc.statelessIdxReader(i)
-		if reader.Empty() {
-			continue
-		}
-		offset := reader.Lookup(prefix)
+		p := item.src.partIdx(prefix) // keys with same prefix are never split between parts
 		// Creating dedicated getter because the one in the item may be used to delete storage, for example
-		g := dc.statelessGetter(i)
-		g.Reset(offset)
-		if g.HasNext() {
-			if keyMatch, _ := g.Match(prefix); !keyMatch {
+		g, err := dc.statelessGetter(i, p)
+		if err != nil {
+			return err
+		}
+		if bt := item.src.part(p).bt; bt != nil {
+			offset, ok := bt.SeekOffset(g, prefix)
+			if !ok {
 				continue
 			}
-			g.Skip()
+			g.Reset(offset)
+			if key, _ := g.NextUncompressed(); bytes.Equal(key, prefix) {
+				g.Skip()
+			} else {
+				g.Reset(offset)
+			}
+		} else {
+			reader, err := dc.statelessIdxReader(i, p)
+			if err != nil {
+				return err
+			}
+			if reader.Empty() {
+				continue
+			}
+			g.Reset(reader.Lookup(prefix))
+			if g.HasNext() {
+				if keyMatch, _ := g.Match(prefix); !keyMatch {
+					continue
+				}
+				g.Skip()
+			}
 		}
 		if g.HasNext() {
 			key, _ := g.Next(nil)
@@ -735,20 +1045,26 @@ func (dc *DomainContext) IteratePrefix(prefix []byte, it func(k, v []byte)) erro
 type Collation struct {
 	valuesComp   *compress.Compressor
 	historyComp  *compress.Compressor
-	indexBitmaps map[string]*roaring64.Bitmap
+	historyBlobs *blobsWriter
+	indexBitmaps *collatedBitmaps
 	valuesPath   string
 	historyPath  string
 	valuesCount  int
 	historyCount int
+	historySize  uint64
+
+	changedPrefixes [][]byte // only by collateValues: see CommitmentInvalidator
 }
 
 func (c Collation) Close() {
 	if c.valuesComp != nil {
 		c.valuesComp.Close()
 	}
+	c.historyBlobs.close()
 	if c.historyComp != nil {
 		c.historyComp.Close()
 	}
+	c.indexBitmaps.close()
 }
 
 // collate gathers domain changes over the specified step, using read-only transaction,
@@ -773,6 +1089,7 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	if valuesComp, err = compress.NewCompressor(context.Background(), "collate values", valuesPath, d.tmpdir, compress.MinPatternScore, 1, log.LvlTrace); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
+	valuesComp.SetCompressTmpFiles(d.compressTmp)
 	keysCursor, err := roTx.CursorDupSort(d.keysTable)
 	if err != nil {
 		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
@@ -844,7 +1161,9 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 		valuesCount:  int(valuesCount),
 		historyPath:  hCollation.historyPath,
 		historyComp:  hCollation.historyComp,
+		historyBlobs: hCollation.blobs,
 		historyCount: hCollation.historyCount,
+		historySize:  hCollation.historySize,
 		indexBitmaps: hCollation.indexBitmaps,
 	}, nil
 }
@@ -856,9 +1175,18 @@ type StaticFiles struct {
 	historyIdx      *recsplit.Index
 	efHistoryDecomp *compress.Decompressor
 	efHistoryIdx    *recsplit.Index
+	efHistoryBt     *BtIndex
+	valuesBt        *BtIndex
+	historyBlobs    *filesItem
 }
 
 func (sf StaticFiles) Close() {
+	sf.valuesBt.Close()
+	sf.efHistoryBt.Close()
+	if sf.historyBlobs != nil {
+		sf.historyBlobs.decompressor.Close()
+		sf.historyBlobs.index.Close()
+	}
 	if sf.valuesDecomp != nil {
 		sf.valuesDecomp.Close()
 	}
@@ -885,19 +1213,38 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 	hStaticFiles, err := d.History.buildFiles(ctx, step, HistoryCollation{
 		historyPath:  collation.historyPath,
 		historyComp:  collation.historyComp,
+		blobs:        collation.historyBlobs,
 		historyCount: collation.historyCount,
+		historySize:  collation.historySize,
 		indexBitmaps: collation.indexBitmaps,
 	})
 	if err != nil {
 		return StaticFiles{}, err
 	}
+	valuesFiles, err := d.buildValuesFiles(ctx, step, collation)
+	if err != nil {
+		hStaticFiles.Close()
+		return StaticFiles{}, err
+	}
+	valuesFiles.efHistoryBt = hStaticFiles.efHistoryBt
+	valuesFiles.historyDecomp = hStaticFiles.historyDecomp
+	valuesFiles.historyIdx = hStaticFiles.historyIdx
+	valuesFiles.efHistoryDecomp = hStaticFiles.efHistoryDecomp
+	valuesFiles.efHistoryIdx = hStaticFiles.efHistoryIdx
+	valuesFiles.historyBlobs = hStaticFiles.blobs
+	return valuesFiles, nil
+}
+
+// buildValuesFiles - .kv, .kvi (and .bt) of collated values, without history
+func (d *Domain) buildValuesFiles(ctx context.Context, step uint64, collation Collation) (StaticFiles, error) {
 	valuesComp := collation.valuesComp
 	var valuesDecomp *compress.Decompressor
 	var valuesIdx *recsplit.Index
+	var valuesBt *BtIndex
 	closeComp := true
 	defer func() {
 		if closeComp {
-			hStaticFiles.Close()
+			valuesBt.Close()
 			if valuesComp != nil {
 				valuesComp.Close()
 			}
@@ -910,6 +1257,7 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 		}
 	}()
 	valuesIdxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, step, step+1))
+	var err error
 	if err = valuesComp.Compress(); err != nil {
 		return StaticFiles{}, fmt.Errorf("compress %s values: %w", d.filenameBase, err)
 	}
@@ -918,22 +1266,22 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 	if valuesDecomp, err = compress.NewDecompressor(collation.valuesPath); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s values decompressor: %w", d.filenameBase, err)
 	}
-	if valuesIdx, err = buildIndex(ctx, valuesDecomp, valuesIdxPath, d.tmpdir, collation.valuesCount, false); err != nil {
+	if valuesIdx, err = buildIndex(ctx, valuesDecomp, valuesIdxPath, d.tmpdir, collation.valuesCount, false, nil); err != nil {
 		return StaticFiles{}, fmt.Errorf("build %s values idx: %w", d.filenameBase, err)
 	}
+	if valuesBt, err = d.buildKvBt(ctx, valuesDecomp, step, step+1, 0); err != nil {
+		return StaticFiles{}, err
+	}
 	closeComp = false
 	return StaticFiles{
-		valuesDecomp:    valuesDecomp,
-		valuesIdx:       valuesIdx,
-		historyDecomp:   hStaticFiles.historyDecomp,
-		historyIdx:      hStaticFiles.historyIdx,
-		efHistoryDecomp: hStaticFiles.efHistoryDecomp,
-		efHistoryIdx:    hStaticFiles.efHistoryIdx,
+		valuesDecomp: valuesDecomp,
+		valuesIdx:    valuesIdx,
+		valuesBt:     valuesBt,
 	}, nil
 }
 
 func (d *Domain) missedIdxFiles() (l []*filesItem) {
-	d.files.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
+	d.files.Load().Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
 			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
 			if !dir.FileExist(filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, fromStep, toStep))) {
@@ -947,69 +1295,56 @@ func (d *Domain) missedIdxFiles() (l []*filesItem) {
 
 // BuildMissedIndices - produce .efi/.vi/.kvi from .ef/.v/.kv
 func (d *Domain) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighted) (err error) {
-	if err := d.History.BuildMissedIndices(ctx, sem); err != nil {
+	return d.BuildMissedIndicesWithProgress(ctx, sem, nil)
+}
+
+// BuildMissedIndicesWithProgress - BuildMissedIndices, progress of each index is added to ps (may be nil)
+func (d *Domain) BuildMissedIndicesWithProgress(ctx context.Context, sem *semaphore.Weighted, ps *background.ProgressSet) (err error) {
+	if err := d.History.BuildMissedIndicesWithProgress(ctx, sem, ps); err != nil {
 		return err
 	}
 	for _, item := range d.missedIdxFiles() {
 		//TODO: build .kvi
 		_ = item
 	}
+	if err := d.buildMissedKvBts(ctx, sem, ps); err != nil {
+		return err
+	}
 	return d.openFiles()
 }
 
-func buildIndex(ctx context.Context, d *compress.Decompressor, idxPath, tmpdir string, count int, values bool) (*recsplit.Index, error) {
-	var rs *recsplit.RecSplit
-	var err error
-	if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
-		KeyCount:   count,
-		Enums:      false,
-		BucketSize: 2000,
-		LeafSize:   8,
-		TmpDir:     tmpdir,
-		IndexFile:  idxPath,
-	}); err != nil {
-		return nil, fmt.Errorf("create recsplit: %w", err)
-	}
-	defer rs.Close()
-	rs.LogLvl(log.LvlTrace)
+func buildIndex(ctx context.Context, d *compress.Decompressor, idxPath, tmpdir string, count int, values bool, p *background.Progress) (*recsplit.Index, error) {
 	defer d.EnableMadvNormal().DisableReadAhead()
 
 	word := make([]byte, 0, 256)
-	var keyPos, valPos uint64
 	g := d.MakeGetter()
-	for {
-		if err := ctx.Err(); err != nil {
-			log.Warn("recsplit index building cancelled", "err", err)
-			return nil, err
-		}
+	if err := segment.BuildIndex(ctx, segment.IndexArgs{IndexFile: idxPath, TmpDir: tmpdir, KeyCount: count}, func(add func(key []byte, offset uint64) error) error {
+		var keyPos, valPos uint64
 		g.Reset(0)
+		if p != nil {
+			p.Processed.Store(0)
+		}
 		for g.HasNext() {
+			if p != nil {
+				p.Processed.Inc()
+			}
 			word, valPos = g.Next(word[:0])
+			offset := keyPos
 			if values {
-				if err = rs.AddKey(word, valPos); err != nil {
-					return nil, fmt.Errorf("add idx key [%x]: %w", word, err)
-				}
-			} else {
-				if err = rs.AddKey(word, keyPos); err != nil {
-					return nil, fmt.Errorf("add idx key [%x]: %w", word, err)
-				}
+				offset = valPos
+			}
+			if err := add(word, offset); err != nil {
+				return fmt.Errorf("add idx key [%x]: %w", word, err)
 			}
 			// Skip value
 			keyPos = g.Skip()
 		}
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Info("Building recsplit. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return nil, fmt.Errorf("build idx: %w", err)
-			}
-		} else {
-			break
-		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	var idx *recsplit.Index
-	if idx, err = recsplit.OpenIndex(idxPath); err != nil {
+	idx, err := recsplit.OpenIndex(idxPath)
+	if err != nil {
 		return nil, fmt.Errorf("open idx: %w", err)
 	}
 	return idx, nil
@@ -1021,13 +1356,20 @@ func (d *Domain) integrateFiles(sf StaticFiles, txNumFrom, txNumTo uint64) {
 		historyIdx:      sf.historyIdx,
 		efHistoryDecomp: sf.efHistoryDecomp,
 		efHistoryIdx:    sf.efHistoryIdx,
+		efHistoryBt:     sf.efHistoryBt,
+		blobs:           sf.historyBlobs,
 	}, txNumFrom, txNumTo)
-	d.files.Set(&filesItem{
+	d.integrateValuesFiles(sf, txNumFrom, txNumTo)
+}
+
+func (d *Domain) integrateValuesFiles(sf StaticFiles, txNumFrom, txNumTo uint64) {
+	d.files.Load().Set(&filesItem{
 		frozen:       (txNumTo-txNumFrom)/d.aggregationStep == StepsInBiggestFile,
 		startTxNum:   txNumFrom,
 		endTxNum:     txNumTo,
 		decompressor: sf.valuesDecomp,
 		index:        sf.valuesIdx,
+		bt:           sf.valuesBt,
 	})
 	d.reCalcRoFiles()
 }
@@ -1168,10 +1510,11 @@ func (d *Domain) warmup(ctx context.Context, txFrom, limit uint64, tx kv.Tx) err
 		return fmt.Errorf("iterate over %s domain keys: %w", d.filenameBase, err)
 	}
 
-	return d.History.warmup(ctx, txFrom, limit, tx)
+	_, _, err = d.History.warmup(ctx, txFrom, txTo, 0, tx)
+	return err
 }
 
-func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte, bool) {
+func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte, bool, error) {
 	var val []byte
 	var found bool
 
@@ -1179,12 +1522,19 @@ func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte
 		if dc.files[i].endTxNum < fromTxNum {
 			break
 		}
-		reader := dc.statelessIdxReader(i)
+		p := dc.files[i].src.partIdx(filekey)
+		reader, err := dc.statelessIdxReader(i, p)
+		if err != nil {
+			return nil, false, err
+		}
 		if reader.Empty() {
 			continue
 		}
 		offset := reader.Lookup(filekey)
-		g := dc.statelessGetter(i)
+		g, err := dc.statelessGetter(i, p)
+		if err != nil {
+			return nil, false, err
+		}
 		g.Reset(offset)
 		if g.HasNext() {
 			if keyMatch, _ := g.Match(filekey); keyMatch {
@@ -1194,7 +1544,7 @@ func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte
 			}
 		}
 	}
-	return val, found
+	return val, found, nil
 }
 
 // historyBeforeTxNum searches history for a value of specified key before txNum
@@ -1218,9 +1568,15 @@ func (dc *DomainContext) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx
 			continue
 		}
 		anyItem = true
-		reader := dc.hc.ic.statelessIdxReader(item.i)
+		reader, err := dc.hc.ic.statelessIdxReader(item.i)
+		if err != nil {
+			return nil, false, err
+		}
 		offset := reader.Lookup(key)
-		g := dc.hc.ic.statelessGetter(item.i)
+		g, err := dc.hc.ic.statelessGetter(item.i)
+		if err != nil {
+			return nil, false, err
+		}
 		g.Reset(offset)
 		if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
 			eliasVal, _ := g.NextUncompressed()
@@ -1247,12 +1603,19 @@ func (dc *DomainContext) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx
 				if dc.files[i].startTxNum > topState.startTxNum {
 					continue
 				}
-				reader := dc.statelessIdxReader(i)
+				p := dc.files[i].src.partIdx(key)
+				reader, err := dc.statelessIdxReader(i, p)
+				if err != nil {
+					return nil, false, err
+				}
 				if reader.Empty() {
 					continue
 				}
 				offset := reader.Lookup(key)
-				g := dc.statelessGetter(i)
+				g, err := dc.statelessGetter(i, p)
+				if err != nil {
+					return nil, false, err
+				}
 				g.Reset(offset)
 				if g.HasNext() {
 					if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
@@ -1311,15 +1674,19 @@ func (dc *DomainContext) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx
 	if !ok {
 		return nil, false, fmt.Errorf("no %s file found for [%x]", dc.d.filenameBase, key)
 	}
-	reader := dc.hc.statelessIdxReader(historyItem.i)
+	reader, err := dc.hc.statelessIdxReader(historyItem.i)
+	if err != nil {
+		return nil, false, err
+	}
 	offset := reader.Lookup2(txKey[:], key)
-	g := dc.hc.statelessGetter(historyItem.i)
-	g.Reset(offset)
-	if dc.d.compressVals {
-		v, _ := g.Next(nil)
-		return v, true, nil
+	g, err := dc.hc.statelessGetter(historyItem.i)
+	if err != nil {
+		return nil, false, err
+	}
+	v, err := historyVal(g, reader, historyItem.src.blobs, key, offset, dc.d.compressVals, dc.d.taggedVals(), nil)
+	if err != nil {
+		return nil, false, err
 	}
-	v, _ := g.NextUncompressed()
 	return v, true, nil
 }
 
@@ -73,6 +73,12 @@ func (d *DomainCommitted) SetKeyReplacer(vm ValueMerger) { d.keyReplaceFn = vm }
 
 func (d *DomainCommitted) SetCommitmentMode(m CommitmentMode) { d.mode = m }
 
+// SetCommitmentScheme - key hashing and account serialization of commitment trie. Scheme name is stored
+// with commitment state, SeekCommitment will fail if existing state was built by another scheme.
+func (d *DomainCommitted) SetCommitmentScheme(s commitment.Scheme) error {
+	return d.patriciaTrie.SetScheme(s)
+}
+
 // TouchPlainKey marks plainKey as updated and applies different fn for different key types
 // (different behaviour for Code, Account and Storage key modifications).
 func (d *DomainCommitted) TouchPlainKey(key, val []byte, fn func(c *CommitmentItem, val []byte)) {
@@ -93,6 +99,14 @@ func (d *DomainCommitted) TouchPlainKeyAccount(c *CommitmentItem, val []byte) {
 	}
 	c.update.DecodeForStorage(val)
 	c.update.Flags = commitment.BALANCE_UPDATE | commitment.NONCE_UPDATE
+	if decodeExtra := d.patriciaTrie.Scheme().DecodeAccountExtra; decodeExtra != nil {
+		c.update.Flags |= commitment.EXTRA_UPDATE
+		extra := decodeExtra(val)
+		if len(extra) > commitment.MaxAccountExtraLen {
+			extra = extra[:commitment.MaxAccountExtraLen]
+		}
+		c.update.Extra = append(c.update.Extra[:0], extra...)
+	}
 	item, found := d.commTree.Get(&CommitmentItem{hashedKey: c.hashedKey})
 	if !found {
 		return
@@ -130,6 +144,10 @@ func (d *DomainCommitted) TouchPlainKeyCode(c *CommitmentItem, val []byte) {
 		c.update.Flags |= commitment.NONCE_UPDATE
 		c.update.Nonce = item.update.Nonce
 	}
+	if item.update.Flags&commitment.EXTRA_UPDATE != 0 {
+		c.update.Flags |= commitment.EXTRA_UPDATE
+		c.update.Extra = append(c.update.Extra[:0], item.update.Extra...)
+	}
 	if item.update.Flags == commitment.DELETE_UPDATE && len(val) == 0 {
 		c.update.Flags = commitment.DELETE_UPDATE
 	} else {
@@ -168,27 +186,8 @@ func (d *DomainCommitted) TouchedKeyList() ([][]byte, [][]byte, []commitment.Upd
 	return plainKeys, hashedKeys, updates
 }
 
-// TODO(awskii): let trie define hashing function
 func (d *DomainCommitted) hashAndNibblizeKey(key []byte) []byte {
-	hashedKey := make([]byte, length.Hash)
-
-	d.keccak.Reset()
-	d.keccak.Write(key[:length.Addr])
-	copy(hashedKey[:length.Hash], d.keccak.Sum(nil))
-
-	if len(key[length.Addr:]) > 0 {
-		hashedKey = append(hashedKey, make([]byte, length.Hash)...)
-		d.keccak.Reset()
-		d.keccak.Write(key[length.Addr:])
-		copy(hashedKey[length.Hash:], d.keccak.Sum(nil))
-	}
-
-	nibblized := make([]byte, len(hashedKey)*2)
-	for i, b := range hashedKey {
-		nibblized[i*2] = (b >> 4) & 0xf
-		nibblized[i*2+1] = b & 0xf
-	}
-	return nibblized
+	return d.patriciaTrie.HashAndNibblizeKey(key)
 }
 
 func (d *DomainCommitted) storeCommitmentState(blockNum, txNum uint64) error {
@@ -196,7 +195,7 @@ func (d *DomainCommitted) storeCommitmentState(blockNum, txNum uint64) error {
 	if err != nil {
 		return err
 	}
-	cs := &commitmentState{txNum: txNum, trieState: state, blockNum: blockNum}
+	cs := &commitmentState{txNum: txNum, trieState: state, blockNum: blockNum, scheme: d.patriciaTrie.Scheme().Name}
 	encoded, err := cs.Encode()
 	if err != nil {
 		return err
@@ -212,10 +211,16 @@ func (d *DomainCommitted) storeCommitmentState(blockNum, txNum uint64) error {
 }
 
 // nolint
-func (d *DomainCommitted) replaceKeyWithReference(fullKey, shortKey []byte, typeAS string, list ...*filesItem) bool {
+func (d *DomainCommitted) replaceKeyWithReference(fullKey, shortKey []byte, typeAS string, list ...*filesItem) (bool, error) {
 	numBuf := [2]byte{}
 	var found bool
 	for _, item := range list {
+		if len(item.parts) > 0 { // reference is offset in single file
+			continue
+		}
+		if err := item.open(); err != nil {
+			return false, err
+		}
 		g := item.decompressor.MakeGetter()
 		index := recsplit.NewIndexReader(item.index)
 
@@ -237,10 +242,10 @@ func (d *DomainCommitted) replaceKeyWithReference(fullKey, shortKey []byte, type
 			break
 		}
 	}
-	return found
+	return found, nil
 }
 
-func (d *DomainCommitted) lookupShortenedKey(shortKey, fullKey []byte, typAS string, list []*filesItem) bool {
+func (d *DomainCommitted) lookupShortenedKey(shortKey, fullKey []byte, typAS string, list []*filesItem) (bool, error) {
 	fileStep, offset := shortenedKey(shortKey)
 	expected := uint64(fileStep) * d.aggregationStep
 	var size uint64
@@ -250,7 +255,7 @@ func (d *DomainCommitted) lookupShortenedKey(shortKey, fullKey []byte, typAS str
 	case "storage":
 		size = length.Addr + length.Hash
 	default:
-		return false
+		return false, nil
 	}
 
 	var found bool
@@ -258,6 +263,9 @@ func (d *DomainCommitted) lookupShortenedKey(shortKey, fullKey []byte, typAS str
 		if item.startTxNum > expected || item.endTxNum < expected {
 			continue
 		}
+		if err := item.open(); err != nil {
+			return false, err
+		}
 		g := item.decompressor.MakeGetter()
 		if uint64(g.Size()) <= offset+size {
 			continue
@@ -270,7 +278,7 @@ func (d *DomainCommitted) lookupShortenedKey(shortKey, fullKey []byte, typAS str
 		found = true
 		break
 	}
-	return found
+	return found, nil
 }
 
 // commitmentValTransform parses the value of the commitment record to extract references
@@ -292,12 +300,17 @@ func (d *DomainCommitted) commitmentValTransform(files *SelectedStaticFiles, mer
 			// Non-optimised key originating from a database record
 			apkBuf = append(apkBuf[:0], accountPlainKey...)
 		} else {
-			f := d.lookupShortenedKey(accountPlainKey, apkBuf, "account", files.accounts)
+			f, err := d.lookupShortenedKey(accountPlainKey, apkBuf, "account", files.accounts)
+			if err != nil {
+				return nil, err
+			}
 			if !f {
 				fmt.Printf("lost key %x\n", accountPlainKeys)
 			}
 		}
-		d.replaceKeyWithReference(apkBuf, accountPlainKey, "account", merged.accounts)
+		if _, err := d.replaceKeyWithReference(apkBuf, accountPlainKey, "account", merged.accounts); err != nil {
+			return nil, err
+		}
 		transAccountPks = append(transAccountPks, accountPlainKey)
 	}
 
@@ -308,13 +321,18 @@ func (d *DomainCommitted) commitmentValTransform(files *SelectedStaticFiles, mer
 			spkBuf = append(spkBuf[:0], storagePlainKey...)
 		} else {
 			// Optimised key referencing a state file record (file number and offset within the file)
-			f := d.lookupShortenedKey(storagePlainKey, spkBuf, "storage", files.storage)
+			f, err := d.lookupShortenedKey(storagePlainKey, spkBuf, "storage", files.storage)
+			if err != nil {
+				return nil, err
+			}
 			if !f {
 				fmt.Printf("lost skey %x\n", storagePlainKey)
 			}
 		}
 
-		d.replaceKeyWithReference(spkBuf, storagePlainKey, "storage", merged.storage)
+		if _, err := d.replaceKeyWithReference(spkBuf, storagePlainKey, "storage", merged.storage); err != nil {
+			return nil, err
+		}
 		transStoragePks = append(transStoragePks, storagePlainKey)
 	}
 
@@ -499,7 +517,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 		if valuesIn.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
-		if valuesIn.index, err = buildIndex(ctx, valuesIn.decompressor, idxPath, d.dir, keyCount, false /* values */); err != nil {
+		if valuesIn.index, err = buildIndex(ctx, valuesIn.decompressor, idxPath, d.dir, keyCount, false /* values */, nil); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
 	}
@@ -576,6 +594,9 @@ func (d *DomainCommitted) SeekCommitment(aggStep, sinceTx uint64) (uint64, error
 	if err := latest.Decode(latestState); err != nil {
 		return 0, nil
 	}
+	if configured := d.patriciaTrie.Scheme().Name; latest.scheme != configured {
+		return 0, fmt.Errorf("commitment state at txNum=%d built with scheme %q, but %q configured", latest.txNum, latest.scheme, configured)
+	}
 
 	if err := d.patriciaTrie.SetState(latest.trieState); err != nil {
 		return 0, err
@@ -583,14 +604,18 @@ func (d *DomainCommitted) SeekCommitment(aggStep, sinceTx uint64) (uint64, error
 	return latest.txNum, nil
 }
 
+// commitmentState - stored in commitment domain once per step (and goes to domain files):
+// [txNum 8][blockNum 8][trieStateLen 2][trieState][schemeLen 1][scheme]
+// scheme - name of commitment.Scheme used to build the trie. States without it were built by commitment.EthereumScheme.
 type commitmentState struct {
 	txNum     uint64
 	blockNum  uint64
 	trieState []byte
+	scheme    string
 }
 
 func (cs *commitmentState) Decode(buf []byte) error {
-	if len(buf) < 10 {
+	if len(buf) < 18 {
 		return fmt.Errorf("ivalid commitment state buffer size")
 	}
 	pos := 0
@@ -600,10 +625,21 @@ func (cs *commitmentState) Decode(buf []byte) error {
 	pos += 8
 	cs.trieState = make([]byte, binary.BigEndian.Uint16(buf[pos:pos+2]))
 	pos += 2
-	if len(cs.trieState) == 0 && len(buf) == 10 {
-		return nil
+	if len(buf) < pos+len(cs.trieState) {
+		return fmt.Errorf("ivalid commitment state buffer size: trie state")
 	}
 	copy(cs.trieState, buf[pos:pos+len(cs.trieState)])
+	pos += len(cs.trieState)
+	if pos == len(buf) {
+		cs.scheme = commitment.EthereumScheme.Name
+		return nil
+	}
+	schemeLen := int(buf[pos])
+	pos++
+	if len(buf) < pos+schemeLen {
+		return fmt.Errorf("ivalid commitment state buffer size: scheme")
+	}
+	cs.scheme = string(buf[pos : pos+schemeLen])
 	return nil
 }
 
@@ -619,6 +655,15 @@ func (cs *commitmentState) Encode() ([]byte, error) {
 	if _, err := buf.Write(cs.trieState); err != nil {
 		return nil, err
 	}
+	if len(cs.scheme) > 255 {
+		return nil, fmt.Errorf("commitment scheme name is too long: %q", cs.scheme)
+	}
+	if err := buf.WriteByte(byte(len(cs.scheme))); err != nil {
+		return nil, err
+	}
+	if _, err := buf.WriteString(cs.scheme); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
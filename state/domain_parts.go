@@ -0,0 +1,233 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+// SetMaxFileSize - caps size of .kv files produced by merge: bigger output is split by key range into parts
+// `name.from-to.kv`, `name.from-to.kv1`, `name.from-to.kv2`, ... (and `.kvi`, `.kvi1`, ... indices).
+// Size is counted by keys and values added to file before compression. Keys which share prefix of prefixLen
+// always stay in 1 part (prefix iteration reads them sequentially), so part may exceed cap by size of 1 such group.
+// 0 - no cap. Not applied to commitment domain: references to keys of accounts/storage are offsets in single file,
+// so keys of split files are not replaced by references.
+func (d *Domain) SetMaxFileSize(bytes uint64) { d.maxFileSize = bytes }
+
+func partExt(ext string, part int) string {
+	if part == 0 {
+		return ext
+	}
+	return ext + strconv.Itoa(part)
+}
+
+func (d *Domain) kvFilePath(fromStep, toStep uint64, ext string, part int) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.%s", d.filenameBase, fromStep, toStep, partExt(ext, part)))
+}
+
+// partFileNames - names of .kv and .kvi (and .bt if exists) files of all parts of file
+func (d *Domain) partFileNames(fromStep, toStep uint64) []string {
+	names := []string{
+		fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, fromStep, toStep),
+		fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, fromStep, toStep),
+	}
+	for p := 1; dir.FileExist(d.kvFilePath(fromStep, toStep, "kv", p)); p++ {
+		names = append(names, filepath.Base(d.kvFilePath(fromStep, toStep, "kv", p)), filepath.Base(d.kvFilePath(fromStep, toStep, "kvi", p)))
+	}
+	for p := 0; dir.FileExist(d.kvFilePath(fromStep, toStep, "bt", p)); p++ {
+		names = append(names, filepath.Base(d.kvFilePath(fromStep, toStep, "bt", p)))
+	}
+	return names
+}
+
+// part - 0 is item itself, see filesItem.parts
+func (i *filesItem) part(p int) *filesItem {
+	if p == 0 {
+		return i
+	}
+	return i.parts[p-1]
+}
+
+func (i *filesItem) partsCount() int { return len(i.parts) + 1 }
+
+// partIdx - part which may contain key
+func (i *filesItem) partIdx(key []byte) int {
+	return sort.Search(len(i.parts), func(j int) bool { return bytes.Compare(i.parts[j].firstKey, key) > 0 })
+}
+
+// allParts - item and its parts, in order of keys
+func (i *filesItem) allParts() []*filesItem {
+	if len(i.parts) == 0 {
+		return []*filesItem{i}
+	}
+	return append([]*filesItem{i}, i.parts...)
+}
+
+// openParts - finds parts 1..N of item on disk. In lazy-open mode parts are opened only to read their first keys.
+func (d *Domain) openParts(item *filesItem) error {
+	if item.parts != nil {
+		return nil
+	}
+	fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+	for p := 1; ; p++ {
+		datPath, idxPath := d.kvFilePath(fromStep, toStep, "kv", p), d.kvFilePath(fromStep, toStep, "kvi", p)
+		if !dir.FileExist(datPath) {
+			return nil
+		}
+		part := &filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, frozen: item.frozen}
+		var err error
+		if part.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+			return err
+		}
+		g := part.decompressor.MakeGetter()
+		if !g.HasNext() {
+			part.decompressor.Close()
+			return fmt.Errorf("empty part %s", datPath)
+		}
+		part.firstKey, _ = g.NextUncompressed()
+		part.firstKey = common.Copy(part.firstKey)
+		if d.lazyOpen {
+			part.decompressor.Close()
+			part.decompressor, part.datPath = nil, datPath
+			if dir.FileExist(idxPath) {
+				part.idxPath = idxPath
+			}
+		} else if dir.FileExist(idxPath) {
+			if part.index, err = recsplit.OpenIndex(idxPath); err != nil {
+				part.decompressor.Close()
+				return err
+			}
+		}
+		item.parts = append(item.parts, part)
+	}
+}
+
+// domainPartsWriter - writes merged .kv file, starts new part when size of current one reaches maxFileSize
+type domainPartsWriter struct {
+	d                *Domain
+	ctx              context.Context
+	workers          int
+	fromStep, toStep uint64
+
+	comp     *compress.Compressor
+	parts    []*filesItem
+	firstKey []byte
+	keyCount int
+	size     uint64
+}
+
+func (w *domainPartsWriter) add(key, val []byte) (err error) {
+	if w.comp != nil && w.d.maxFileSize > 0 && w.size >= w.d.maxFileSize && (w.d.prefixLen == 0 || len(key) == w.d.prefixLen) {
+		if err = w.finishPart(); err != nil {
+			return err
+		}
+	}
+	if w.comp == nil {
+		if err = w.startPart(key); err != nil {
+			return err
+		}
+	}
+	if err = w.comp.AddUncompressedWord(key); err != nil {
+		return err
+	}
+	w.keyCount++ // Only counting keys, not values
+	if w.d.compressVals {
+		err = w.comp.AddWord(val)
+	} else {
+		err = w.comp.AddUncompressedWord(val)
+	}
+	w.size += uint64(len(key) + len(val))
+	return err
+}
+
+func (w *domainPartsWriter) startPart(firstKey []byte) (err error) {
+	datPath := w.d.kvFilePath(w.fromStep, w.toStep, "kv", len(w.parts))
+	if w.comp, err = compress.NewCompressor(w.ctx, "merge", datPath, w.d.tmpdir, compress.MinPatternScore, w.workers, log.LvlTrace); err != nil {
+		return fmt.Errorf("merge %s history compressor: %w", w.d.filenameBase, err)
+	}
+	w.keyCount, w.size = 0, 0
+	w.firstKey = common.Copy(firstKey)
+	return nil
+}
+
+func (w *domainPartsWriter) finishPart() (err error) {
+	if err = w.comp.Compress(); err != nil {
+		return err
+	}
+	w.comp.Close()
+	w.comp = nil
+	p := len(w.parts)
+	part := &filesItem{startTxNum: w.fromStep * w.d.aggregationStep, endTxNum: w.toStep * w.d.aggregationStep, frozen: w.toStep-w.fromStep == StepsInBiggestFile}
+	if p > 0 {
+		part.firstKey = w.firstKey
+	}
+	w.parts = append(w.parts, part)
+	if part.decompressor, err = compress.NewDecompressor(w.d.kvFilePath(w.fromStep, w.toStep, "kv", p)); err != nil {
+		return fmt.Errorf("merge %s decompressor [%d-%d]: %w", w.d.filenameBase, w.fromStep, w.toStep, err)
+	}
+	if part.index, err = buildIndex(w.ctx, part.decompressor, w.d.kvFilePath(w.fromStep, w.toStep, "kvi", p), w.d.tmpdir, w.keyCount, false /* values */, nil); err != nil {
+		return fmt.Errorf("merge %s buildIndex [%d-%d]: %w", w.d.filenameBase, w.fromStep, w.toStep, err)
+	}
+	if part.bt, err = w.d.buildKvBt(w.ctx, part.decompressor, w.fromStep, w.toStep, p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// finish - returns part 0 with other parts attached
+func (w *domainPartsWriter) finish() (*filesItem, error) {
+	if w.comp == nil && len(w.parts) == 0 { // no keys: empty file, as without split
+		if err := w.startPart(nil); err != nil {
+			return nil, err
+		}
+	}
+	if w.comp != nil {
+		if err := w.finishPart(); err != nil {
+			return nil, err
+		}
+	}
+	item := w.parts[0]
+	item.parts = w.parts[1:]
+	if len(item.parts) == 0 {
+		item.parts = nil
+	}
+	w.parts = nil
+	return item, nil
+}
+
+func (w *domainPartsWriter) close() {
+	if w.comp != nil {
+		w.comp.Close()
+		w.comp = nil
+	}
+	for _, part := range w.parts {
+		part.closeFilesAndRemove()
+	}
+	w.parts = nil
+}
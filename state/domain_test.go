@@ -17,11 +17,13 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -30,6 +32,8 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
+	atomic2 "go.uber.org/atomic"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
@@ -98,9 +102,9 @@ func TestCollationBuild(t *testing.T) {
 	require.Equal(t, 2, c.valuesCount)
 	require.True(t, strings.HasSuffix(c.historyPath, "base.0-1.v"))
 	require.Equal(t, 3, c.historyCount)
-	require.Equal(t, 2, len(c.indexBitmaps))
-	require.Equal(t, []uint64{3}, c.indexBitmaps["key2"].ToArray())
-	require.Equal(t, []uint64{2, 6}, c.indexBitmaps["key1"].ToArray())
+	require.Equal(t, 2, len(c.indexBitmaps.m))
+	require.Equal(t, []uint64{3}, c.indexBitmaps.m["key2"].ToArray())
+	require.Equal(t, []uint64{2, 6}, c.indexBitmaps.m["key1"].ToArray())
 
 	sf, err := d.buildFiles(ctx, 0, c)
 	require.NoError(t, err)
@@ -346,9 +350,16 @@ func TestHistory(t *testing.T) {
 }
 
 func TestIterationMultistep(t *testing.T) {
+	t.Run("kvi", func(t *testing.T) { testIterationMultistep(t, false) })
+	t.Run("bt", func(t *testing.T) { testIterationMultistep(t, true) })
+}
+
+func testIterationMultistep(t *testing.T, btIndex bool) {
+	t.Helper()
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
 	_, db, d := testDbAndDomain(t, 5 /* prefixLen */)
+	d.SetBtIndex(btIndex)
 	ctx := context.Background()
 	tx, err := db.BeginRw(ctx)
 	require.NoError(t, err)
@@ -514,6 +525,80 @@ func TestScanFiles(t *testing.T) {
 	checkHistory(t, db, d, txs)
 }
 
+func TestMergeFilesMaxFileSize(t *testing.T) {
+	path, db, d, txs := filledDomain(t)
+	d.SetMaxFileSize(100) // 31 keys of 16 bytes with values: 5 parts
+	collateAndMerge(t, db, nil, d, txs)
+
+	var split int
+	d.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum-item.startTxNum > d.aggregationStep {
+				require.Equal(t, 5, item.partsCount())
+				split++
+			}
+			for p := 1; p < item.partsCount(); p++ {
+				require.FileExists(t, d.kvFilePath(item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep, "kvi", p))
+				require.Equal(t, 1, bytes.Compare(item.part(p).firstKey, item.part(p-1).firstKey))
+			}
+		}
+		return true
+	})
+	require.NotZero(t, split)
+	checkHistory(t, db, d, txs)
+	parts, err := filepath.Glob(filepath.Join(path, "base.*.kv[0-9]*"))
+	require.NoError(t, err)
+	require.Len(t, parts, split*4, "parts of merged away files must be removed")
+
+	// parts are found by scan after restart
+	txNum := d.txNum
+	d.Close()
+	d, err = NewDomain(path, path, d.aggregationStep, d.filenameBase, d.keysTable, d.valsTable, d.indexKeysTable, d.historyValsTable, d.settingsTable, d.indexTable, d.prefixLen, d.compressVals)
+	require.NoError(t, err)
+	require.NoError(t, d.reOpenFolder())
+	defer d.Close()
+	d.SetTxNum(txNum)
+	checkHistory(t, db, d, txs)
+}
+
+func TestDomainBtIndex(t *testing.T) {
+	path, db, d, txs := filledDomain(t)
+	d.SetBtIndex(true)
+	d.SetMaxFileSize(100)
+	collateAndMerge(t, db, nil, d, txs)
+
+	var bts []string
+	d.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			for p := 0; p < item.partsCount(); p++ {
+				require.NotNil(t, item.part(p).bt)
+				bts = append(bts, d.kvFilePath(item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep, "bt", p))
+			}
+		}
+		return true
+	})
+	require.Greater(t, len(bts), 1)
+	for _, f := range bts {
+		require.FileExists(t, f)
+	}
+	checkHistory(t, db, d, txs)
+
+	// missing .bt of part is built by BuildMissedIndices
+	txNum := d.txNum
+	d.Close()
+	require.NoError(t, os.Remove(bts[len(bts)-1]))
+	d, err := NewDomain(path, path, d.aggregationStep, d.filenameBase, d.keysTable, d.valsTable, d.indexKeysTable, d.historyValsTable, d.settingsTable, d.indexTable, d.prefixLen, d.compressVals)
+	require.NoError(t, err)
+	defer d.Close()
+	d.SetBtIndex(true)
+	d.SetMaxFileSize(100)
+	require.NoError(t, d.reOpenFolder())
+	require.NoError(t, d.BuildMissedIndices(context.Background(), semaphore.NewWeighted(4)))
+	require.FileExists(t, bts[len(bts)-1])
+	d.SetTxNum(txNum)
+	checkHistory(t, db, d, txs)
+}
+
 func TestDelete(t *testing.T) {
 	_, db, d := testDbAndDomain(t, 0 /* prefixLen */)
 	ctx := context.Background()
@@ -749,7 +834,7 @@ func TestDomain_PruneOnWrite(t *testing.T) {
 
 func TestScanStaticFilesD(t *testing.T) {
 	ii := &Domain{History: &History{InvertedIndex: &InvertedIndex{filenameBase: "test", aggregationStep: 1}},
-		files: btree2.NewBTreeG[*filesItem](filesItemLess),
+		files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess)),
 	}
 	ffs := fstest.MapFS{
 		"test.0-1.kv": {},
@@ -763,7 +848,7 @@ func TestScanStaticFilesD(t *testing.T) {
 	require.NoError(t, err)
 	ii.scanStateFiles(files)
 	var found []string
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			found = append(found, fmt.Sprintf("%d-%d", item.startTxNum, item.endTxNum))
 		}
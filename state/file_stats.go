@@ -0,0 +1,109 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/erigon-lib/segment"
+)
+
+const fileStatsSuffix = segment.StatsSuffix
+
+// FileStats - content of data file, written next to it when file is built or merged.
+// Allows capacity planning without opening and scanning of data files.
+type FileStats struct {
+	Keys        uint64 // distinct keys
+	Values      uint64 // .ef: txNums, .v: history values
+	ValuesBytes uint64 // uncompressed size of values
+	MinTxNum    uint64
+	MaxTxNum    uint64
+}
+
+func (s *FileStats) addTxNums(min, max uint64) {
+	if s.Values == 0 || min < s.MinTxNum {
+		s.MinTxNum = min
+	}
+	if max > s.MaxTxNum {
+		s.MaxTxNum = max
+	}
+}
+
+// addEf - accounts key of inverted index with its elias-fano list of txNums
+func (s *FileStats) addEf(ef []byte) {
+	s.addTxNums(eliasfano32.Min(ef), eliasfano32.Max(ef))
+	s.Keys++
+	s.Values += eliasfano32.Count(ef)
+	s.ValuesBytes += uint64(len(ef))
+}
+
+// AddPair - see segment.Stats: accounts pair of .ef file
+func (s *FileStats) AddPair(_, ef []byte) { s.addEf(ef) }
+
+// Add - sums stats of 2 files. Keys are summed too: key present in both files counted twice.
+func (s *FileStats) Add(other FileStats) {
+	if other.Values > 0 {
+		s.addTxNums(other.MinTxNum, other.MaxTxNum)
+	}
+	s.Keys += other.Keys
+	s.Values += other.Values
+	s.ValuesBytes += other.ValuesBytes
+}
+
+func writeFileStats(datPath string, s FileStats) error { return segment.WriteStats(datPath, s) }
+
+// readFileStats - false if file has no sidecar (built before stats were introduced) or it's corrupted
+func readFileStats(datPath string) (s FileStats, ok bool) {
+	data, err := os.ReadFile(datPath + fileStatsSuffix)
+	if err != nil {
+		return s, false
+	}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return s, false
+	}
+	return s, true
+}
+
+func removeFileStats(datPath string) { _ = os.Remove(datPath + fileStatsSuffix) }
+
+// FilesStats - sum of stats of visible data files of entity (accounts, logaddrs, ...) of given kind within steps [fromStep; toStep).
+// Files which are merged into bigger ones are skipped. missing - amount of files without stats: they are not in sum.
+func (a *AggregatorV3) FilesStats(entity string, kind FileKind, fromStep, toStep uint64) (total FileStats, files, missing int) {
+	var infos []FileInfo
+	for _, fi := range a.FilesInfo() {
+		if fi.Entity != entity || fi.Kind != kind || fi.FromStep < fromStep || fi.ToStep > toStep {
+			continue
+		}
+		infos = append(infos, fi)
+	}
+	for _, fi := range infos {
+		if isSubsetOfAnother(fi, infos) {
+			continue
+		}
+		files++
+		s, ok := readFileStats(filepath.Join(a.dir, fi.Name))
+		if !ok {
+			missing++
+			continue
+		}
+		total.Add(s)
+	}
+	return total, files, missing
+}
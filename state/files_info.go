@@ -0,0 +1,170 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	btree2 "github.com/tidwall/btree"
+	atomic2 "go.uber.org/atomic"
+)
+
+// FileKind - kind of data file, defines extensions of data and index files
+type FileKind string
+
+const (
+	FileKindHistory       FileKind = "history"        // .v + .vi
+	FileKindInvertedIndex FileKind = "inverted_index" // .ef + .efi
+	FileKindLocality      FileKind = "locality"       // .l + .li
+)
+
+func (k FileKind) exts() (data, idx string) {
+	switch k {
+	case FileKindHistory:
+		return "v", "vi"
+	case FileKindInvertedIndex:
+		return "ef", "efi"
+	case FileKindLocality:
+		return "l", "li"
+	default:
+		panic(fmt.Sprintf("unknown file kind %s", k))
+	}
+}
+
+// FileInfo - metadata of 1 data file and its index
+type FileInfo struct {
+	Entity           string // filenameBase: accounts, storage, code, logaddrs, ...
+	Kind             FileKind
+	FromStep, ToStep uint64
+	Name             string // name of data file
+	Size             int64  // size of data file
+	IdxName          string // name of index file, empty if there is no index
+	IdxSize          int64
+	Frozen           bool   // file of StepsInBiggestFile steps: never merged
+	Open             bool   // data file is open (always true if lazy-open mode is disabled)
+	ContentName      string // content-addressed file which data file links to, empty if it's not content-addressed
+	Reads            FileReads
+}
+
+// FileReads - point reads of file since it was opened by this process. Small files which are read often
+// are worth merging early (less lookups per read), rarely read ones - can wait
+type FileReads struct {
+	Lookups uint64 // lookups of key by index
+	Hits    uint64 // lookups which found key
+	Bytes   uint64 // bytes decompressed by hits
+}
+
+type fileReads struct {
+	lookups, hits, bytes atomic2.Uint64
+}
+
+func (s *fileReads) lookup() { s.lookups.Inc() }
+func (s *fileReads) hit(bytes int) {
+	s.hits.Inc()
+	s.bytes.Add(uint64(bytes))
+}
+func (s *fileReads) get() FileReads {
+	return FileReads{Lookups: s.lookups.Load(), Hits: s.hits.Load(), Bytes: s.bytes.Load()}
+}
+
+func (f FileInfo) HasIndex() bool { return f.IdxName != "" }
+
+func fileSize(path string) int64 {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
+
+func filesInfo(files *btree2.BTreeG[*filesItem], dir, entity string, kind FileKind, aggregationStep uint64) (res []FileInfo) {
+	dataExt, _ := kind.exts()
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := item.startTxNum/aggregationStep, item.endTxNum/aggregationStep
+			fi := FileInfo{
+				Entity:   entity,
+				Kind:     kind,
+				FromStep: fromStep,
+				ToStep:   toStep,
+				Name:     fmt.Sprintf("%s.%d-%d.%s", entity, fromStep, toStep, dataExt),
+				Frozen:   item.frozen,
+				Reads:    item.reads.get(),
+			}
+			if item.decompressor != nil {
+				fi.Open, fi.Size = true, item.decompressor.Size()
+			} else {
+				fi.Size = fileSize(filepath.Join(dir, fi.Name))
+			}
+			fi.ContentName = contentName(filepath.Join(dir, fi.Name))
+			if item.index != nil {
+				fi.IdxName, fi.IdxSize = item.index.FileName(), item.index.Size()
+			} else if item.idxPath != "" {
+				fi.IdxName, fi.IdxSize = filepath.Base(item.idxPath), fileSize(item.idxPath)
+			}
+			res = append(res, fi)
+		}
+		return true
+	})
+	return res
+}
+
+func (li *LocalityIndex) FilesInfo() []FileInfo {
+	if li == nil || li.file == nil {
+		return nil
+	}
+	fromStep, toStep := li.file.startTxNum/li.aggregationStep, li.file.endTxNum/li.aggregationStep
+	dataExt, idxExt := FileKindLocality.exts()
+	fi := FileInfo{
+		Entity:   li.filenameBase,
+		Kind:     FileKindLocality,
+		FromStep: fromStep,
+		ToStep:   toStep,
+		Name:     fmt.Sprintf("%s.%d-%d.%s", li.filenameBase, fromStep, toStep, dataExt),
+		IdxName:  fmt.Sprintf("%s.%d-%d.%s", li.filenameBase, fromStep, toStep, idxExt),
+		Open:     li.bm != nil, // not Frozen: rebuilt when new frozen file appears
+	}
+	fi.Size, fi.IdxSize = fileSize(filepath.Join(li.dir, fi.Name)), fileSize(filepath.Join(li.dir, fi.IdxName))
+	return []FileInfo{fi}
+}
+
+// FilesInfo - files of Files() and locality index, with metadata
+func (ii *InvertedIndex) FilesInfo() []FileInfo {
+	return append(filesInfo(ii.files.Load(), ii.dir, ii.filenameBase, FileKindInvertedIndex, ii.aggregationStep), ii.localityIndex.FilesInfo()...)
+}
+
+// FilesInfo - files of Files() and locality index, with metadata
+func (h *History) FilesInfo() []FileInfo {
+	return append(filesInfo(h.files.Load(), h.dir, h.filenameBase, FileKindHistory, h.aggregationStep), h.InvertedIndex.FilesInfo()...)
+}
+
+// FilesInfo - files of Files() and locality indices, with metadata: for monitoring and downloader
+func (a *AggregatorV3) FilesInfo() (res []FileInfo) {
+	a.openCloseLock.Lock()
+	defer a.openCloseLock.Unlock()
+
+	res = append(res, a.accounts.FilesInfo()...)
+	res = append(res, a.storage.FilesInfo()...)
+	res = append(res, a.code.FilesInfo()...)
+	res = append(res, a.logAddrs.FilesInfo()...)
+	res = append(res, a.logTopics.FilesInfo()...)
+	res = append(res, a.tracesFrom.FilesInfo()...)
+	res = append(res, a.tracesTo.FilesInfo()...)
+	return res
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// FilesIntegrity - result of cross-file consistency check of 1 range of files: .ef vs .efi, and (for History) .ef vs .v vs .vi
+type FilesIntegrity struct {
+	Entity           string
+	FromStep, ToStep uint64
+
+	EfKeys      int // keys in .ef
+	EfTxNums    int // (key, txNum) pairs in .ef
+	EfiKeys     int // keys in .efi, -1 if there is no .efi
+	EfiMismatch int // keys of .ef which .efi doesn't resolve to their offset in .ef
+
+	HasHistory bool
+	VWords     int // values in .v
+	ViKeys     int // keys in .vi
+	ViMismatch int // (key, txNum) pairs of .ef which .vi doesn't resolve to offset of their value in .v
+}
+
+// OK - all keys of .ef resolve in indices and .v, and every key of indices and every value of .v belongs to .ef
+func (r FilesIntegrity) OK() bool {
+	if r.EfiMismatch > 0 || r.ViMismatch > 0 {
+		return false
+	}
+	if r.EfiKeys >= 0 && r.EfiKeys != r.EfKeys {
+		return false
+	}
+	return !r.HasHistory || (r.VWords == r.EfTxNums && r.ViKeys == r.EfTxNums)
+}
+
+func (r FilesIntegrity) String() string {
+	s := fmt.Sprintf("%s.%d-%d: ef keys=%d, txNums=%d", r.Entity, r.FromStep, r.ToStep, r.EfKeys, r.EfTxNums)
+	if r.EfiKeys >= 0 {
+		s += fmt.Sprintf("; efi keys=%d, mismatch=%d", r.EfiKeys, r.EfiMismatch)
+	}
+	if r.HasHistory {
+		s += fmt.Sprintf("; v words=%d; vi keys=%d, mismatch=%d", r.VWords, r.ViKeys, r.ViMismatch)
+	}
+	return s
+}
+
+// checkFiles - walks .ef once: checks .efi lookup of every key and (if historyItem != nil) .vi lookup of every (key, txNum),
+// offsets of values in .v are taken from sequential read of .v - in same order as they were written by buildVi
+func checkFiles(ctx context.Context, entity string, aggregationStep uint64, iiItem, historyItem *filesItem, compressVals bool) (FilesIntegrity, error) {
+	r := FilesIntegrity{
+		Entity:   entity,
+		FromStep: iiItem.startTxNum / aggregationStep,
+		ToStep:   iiItem.endTxNum / aggregationStep,
+		EfiKeys:  -1,
+	}
+	if err := iiItem.open(); err != nil {
+		return r, err
+	}
+	var efiReader *recsplit.IndexReader
+	if iiItem.index != nil {
+		efiReader = recsplit.NewIndexReader(iiItem.index)
+		r.EfiKeys = int(iiItem.index.KeyCount())
+	}
+	var viReader *recsplit.IndexReader
+	var vG *compress.Getter
+	if historyItem != nil {
+		if err := historyItem.open(); err != nil {
+			return r, err
+		}
+		if historyItem.index == nil {
+			return r, fmt.Errorf("%s: .vi is not open", historyItem.decompressor.FileName())
+		}
+		r.HasHistory = true
+		r.VWords = historyItem.decompressor.Count()
+		r.ViKeys = int(historyItem.index.KeyCount())
+		viReader = recsplit.NewIndexReader(historyItem.index)
+		vG = historyItem.decompressor.MakeGetter()
+	}
+
+	g := iiItem.decompressor.MakeGetter()
+	efiG := iiItem.decompressor.MakeGetter()
+	var keyBuf, valBuf, efiKey, historyKey []byte
+	var txKey [8]byte
+	var valOffset uint64
+	for g.HasNext() {
+		keyBuf, _ = g.NextUncompressed()
+		r.EfKeys++
+		if efiReader != nil {
+			efiG.Reset(efiReader.Lookup(keyBuf))
+			if !efiG.HasNext() {
+				r.EfiMismatch++
+			} else if efiKey, _ = efiG.NextUncompressed(); !bytes.Equal(efiKey, keyBuf) {
+				r.EfiMismatch++
+			}
+		}
+		if !g.HasNext() {
+			return r, fmt.Errorf("%s: key %x without value", iiItem.decompressor.FileName(), keyBuf)
+		}
+		valBuf, _ = g.NextUncompressed()
+		ef, _ := eliasfano32.ReadEliasFano(valBuf)
+		efIt := ef.Iterator()
+		for efIt.HasNext() {
+			txNum, _ := efIt.Next()
+			r.EfTxNums++
+			if viReader == nil {
+				continue
+			}
+			if !vG.HasNext() { // .v is shorter than .ef: counted by VWords
+				r.ViMismatch++
+				continue
+			}
+			binary.BigEndian.PutUint64(txKey[:], txNum)
+			historyKey = append(append(historyKey[:0], txKey[:]...), keyBuf...)
+			if viReader.Lookup(historyKey) != valOffset {
+				r.ViMismatch++
+			}
+			if compressVals {
+				valOffset = vG.Skip()
+			} else {
+				valOffset = vG.SkipUncompressed()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return r, ctx.Err()
+		default:
+		}
+	}
+	return r, nil
+}
+
+// CheckFilesIntegrity - verifies .ef and .efi of all files, see FilesIntegrity.
+// Reads all files completely: for detection of corruption after crash or disk failure, not for regular use.
+func (ii *InvertedIndex) CheckFilesIntegrity(ctx context.Context) ([]FilesIntegrity, error) {
+	ic := ii.MakeContext()
+	defer ic.Close()
+	res := make([]FilesIntegrity, 0, len(ic.files))
+	for _, item := range ic.files {
+		r, err := checkFiles(ctx, ii.filenameBase, ii.aggregationStep, item.src, nil, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ii.filenameBase, err)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// CheckFilesIntegrity - verifies .ef, .efi, .v and .vi of all files, see FilesIntegrity
+func (h *History) CheckFilesIntegrity(ctx context.Context) ([]FilesIntegrity, error) {
+	hc := h.MakeContext()
+	defer hc.Close()
+	if len(hc.files) != len(hc.ic.files) {
+		return nil, fmt.Errorf("%s: history and index files are not aligned", h.filenameBase)
+	}
+	res := make([]FilesIntegrity, 0, len(hc.files))
+	for i := range hc.files {
+		item, iiItem := hc.files[i].src, hc.ic.files[i].src
+		if item.startTxNum != iiItem.startTxNum || item.endTxNum != iiItem.endTxNum {
+			return nil, fmt.Errorf("%s: history and index files are not aligned at txNum=%d", h.filenameBase, item.startTxNum)
+		}
+		r, err := checkFiles(ctx, h.filenameBase, h.aggregationStep, iiItem, item, h.compressVals)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", h.filenameBase, err)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// CheckFilesIntegrity - verifies files of all histories and inverted indices, see FilesIntegrity
+func (a *AggregatorV3) CheckFilesIntegrity(ctx context.Context) ([]FilesIntegrity, error) {
+	var res []FilesIntegrity
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		rs, err := h.CheckFilesIntegrity(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rs...)
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		rs, err := ii.CheckFilesIntegrity(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rs...)
+	}
+	return res, nil
+}
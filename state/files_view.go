@@ -0,0 +1,72 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	btree2 "github.com/tidwall/btree"
+)
+
+// Re-scan of folder is copy-on-write: new registry of files is scanned and opened aside of current one,
+// files which are already open are moved to new registry (contexts of old and new view share them),
+// then visible files (roFiles) are swapped by reCalcRoFiles. Contexts made before swap keep their view:
+// dropped files are closed by last context which sees them. Readers never see closed or partially scanned folder.
+
+func newFilesTree() *btree2.BTreeG[*filesItem] {
+	return btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false})
+}
+
+// isOpened - item was opened by openFiles in given lazy-open mode (in lazy mode: only paths are set)
+func (i *filesItem) isOpened(lazy bool) bool {
+	if lazy {
+		return i.datPath != ""
+	}
+	return i.decompressor != nil
+}
+
+// reuseOpenedItems - items of `next` (just scanned) are replaced by opened items of `prev` with same range
+func reuseOpenedItems(prev, next *btree2.BTreeG[*filesItem], lazy bool) {
+	var reused []*filesItem
+	next.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if old, ok := prev.Get(item); ok && old.isOpened(lazy) && !old.canDelete.Load() {
+				reused = append(reused, old)
+			}
+		}
+		return true
+	})
+	for _, old := range reused {
+		next.Set(old)
+	}
+}
+
+// retireDroppedItems - items of `prev` which are not in `next` are closed by last context which sees them.
+// Files stay on disk: item is dropped from registry, not merged.
+func retireDroppedItems(prev, next *btree2.BTreeG[*filesItem]) {
+	var dropped []*filesItem
+	prev.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if cur, ok := next.Get(item); !ok || cur != item {
+				dropped = append(dropped, item)
+			}
+		}
+		return true
+	})
+	for _, item := range dropped {
+		item.replaced.Store(true)
+		item.markDeleted()
+	}
+}
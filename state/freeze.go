@@ -0,0 +1,123 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	"go.uber.org/atomic"
+)
+
+// FreezeResult - what Freeze did
+type FreezeResult struct {
+	FromTxNum, ToTxNum uint64 // range of built files, empty if all steps were already in files
+	BuiltSteps         int
+	Merges             int
+	Files              []FileInfo // new files: built or merged, which are still visible after merges
+	EndTxNum           uint64     // EndTxNumMinimax after Freeze
+	FrozenTxNum        uint64     // FrozenTxNum after Freeze
+	Took               time.Duration
+}
+
+// FrozenTxNum - end of frozen (of StepsInBiggestFile steps, never merged again) and indexed files of all entities.
+// Files before it don't change: they can be published as snapshots.
+func (a *AggregatorV3) FrozenTxNum() uint64 {
+	min := a.accounts.endIndexedTxNumMinimax(true)
+	for _, h := range []*History{a.storage, a.code} {
+		if txNum := h.endIndexedTxNumMinimax(true); txNum < min {
+			min = txNum
+		}
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if ii.disabled.Load() {
+			continue
+		}
+		if txNum := ii.endIndexedTxNumMinimax(true); txNum < min {
+			min = txNum
+		}
+	}
+	return min
+}
+
+// Freeze - synchronously builds files of all steps which end before uptoTxNum (rounded down to step) and merges them.
+// Unlike BuildFilesInBackground ignores KeepInDB and doesn't prune. Waits for background build and merge.
+// Returns error if db doesn't have data up to uptoTxNum.
+func (a *AggregatorV3) Freeze(ctx context.Context, uptoTxNum uint64) (res FreezeResult, err error) {
+	start := time.Now()
+	toStep := uptoTxNum / a.aggregationStep
+	if lastInDB := lastIdInDB(a.db, a.accounts.indexKeysTable); toStep > 0 && lastInDB < toStep*a.aggregationStep {
+		return res, fmt.Errorf("freeze up to %d: db has data up to txNum %d", toStep*a.aggregationStep, lastInDB)
+	}
+	if err = acquireFlag(ctx, &a.working); err != nil {
+		return res, err
+	}
+	defer a.working.Store(false)
+	if err = acquireFlag(ctx, &a.workingMerge); err != nil {
+		return res, err
+	}
+	defer a.workingMerge.Store(false)
+
+	before := map[string]struct{}{}
+	for _, fi := range a.FilesInfo() {
+		before[fi.Name] = struct{}{}
+	}
+	fromStep := a.EndTxNumMinimax() / a.aggregationStep
+	for step := fromStep; step < toStep; step++ {
+		if err = a.buildFilesInBackground(ctx, step, a.db); err != nil {
+			return res, fmt.Errorf("freeze: %w", err)
+		}
+		res.BuiltSteps++
+	}
+	if res.BuiltSteps > 0 {
+		res.FromTxNum, res.ToTxNum = fromStep*a.aggregationStep, toStep*a.aggregationStep
+	}
+	for {
+		merged, err := a.mergeLoopStep(ctx, 1)
+		if err != nil {
+			return res, fmt.Errorf("freeze: %w", err)
+		}
+		if !merged {
+			break
+		}
+		res.Merges++
+	}
+
+	for _, fi := range a.FilesInfo() {
+		if _, ok := before[fi.Name]; !ok {
+			res.Files = append(res.Files, fi)
+		}
+	}
+	res.EndTxNum, res.FrozenTxNum, res.Took = a.EndTxNumMinimax(), a.FrozenTxNum(), time.Since(start)
+	log.Info("[snapshots] freeze", "upto", toStep*a.aggregationStep, "built_steps", res.BuiltSteps, "merges", res.Merges,
+		"new_files", len(res.Files), "frozen", res.FrozenTxNum, "took", res.Took)
+	return res, nil
+}
+
+// acquireFlag - waits until background work marked by flag is done and marks it as own
+func acquireFlag(ctx context.Context, flag *atomic.Bool) error {
+	for !flag.CompareAndSwap(false, true) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return nil
+}
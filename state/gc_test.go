@@ -26,7 +26,7 @@ func TestGCReadAfterRemoveFile(t *testing.T) {
 		// - make sure there is no canDelete file
 		hc := h.MakeContext()
 		_ = hc
-		lastOnFs, _ := h.files.Max()
+		lastOnFs, _ := h.files.Load().Max()
 		require.False(lastOnFs.frozen) // prepared dataset must have some non-frozen files. or it's bad dataset.
 		h.integrateMergedFiles(nil, []*filesItem{lastOnFs}, nil, nil)
 		require.NotNil(lastOnFs.decompressor)
@@ -50,7 +50,7 @@ func TestGCReadAfterRemoveFile(t *testing.T) {
 		require.Nil(lastOnFs.decompressor)
 		require.NotNil(loc.file)
 
-		nonDeletedOnFs, _ := h.files.Max()
+		nonDeletedOnFs, _ := h.files.Load().Max()
 		require.False(nonDeletedOnFs.frozen)
 		require.NotNil(nonDeletedOnFs.decompressor) // non-canDelete files are not closed
 
@@ -70,7 +70,7 @@ func TestGCReadAfterRemoveFile(t *testing.T) {
 		// - del cold file
 		// - new reader must not see canDelete file
 		hc := h.MakeContext()
-		lastOnFs, _ := h.files.Max()
+		lastOnFs, _ := h.files.Load().Max()
 		require.False(lastOnFs.frozen) // prepared dataset must have some non-frozen files. or it's bad dataset.
 		h.integrateMergedFiles(nil, []*filesItem{lastOnFs}, nil, nil)
 
@@ -41,14 +41,15 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/cmp"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
-	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/erigon-lib/segment"
 )
 
 type History struct {
@@ -57,7 +58,7 @@ type History struct {
 	// Files:
 	//  .v - list of values
 	//  .vi - txNum+key -> offset in .v
-	files *btree2.BTreeG[*filesItem] // thread-safe, but maybe need 1 RWLock for all trees in AggregatorV3
+	files atomic2.Pointer[btree2.BTreeG[*filesItem]] // thread-safe tree, replaced as a whole by reOpenFolder (see newFilesTree)
 
 	// roFiles derivative from field `file`, but without garbage (canDelete=true, overlaps, etc...)
 	// MakeContext() using this field in zero-copy way
@@ -67,7 +68,11 @@ type History struct {
 	settingsTable           string
 	compressWorkers         int
 	compressVals            bool
+	dedupVals               bool // see SetDedupValues
+	blobThreshold           int  // see SetBlobThreshold
+	skipNoopWrites          bool // see SetSkipNoopWrites
 	integrityFileExtensions []string
+	historyEndTxNum         atomic2.Uint64 // endTxNum of last .v file, see endTxNumMinimax
 
 	wal     *historyWAL
 	walLock sync.RWMutex
@@ -85,7 +90,7 @@ func NewHistory(
 	integrityFileExtensions []string,
 ) (*History, error) {
 	h := History{
-		files:                   btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false}),
+		files:                   *atomic2.NewPointer(newFilesTree()),
 		roFiles:                 *atomic2.NewPointer(&[]ctxItem{}),
 		historyValsTable:        historyValsTable,
 		settingsTable:           settingsTable,
@@ -105,27 +110,47 @@ func NewHistory(
 	//}
 	return &h, nil
 }
+
+// reOpenFolder - copy-on-write, see newFilesTree
 func (h *History) reOpenFolder() error {
-	h.closeFiles()
+	hc := h.MakeContext() // dropped files are closed by Close of this context, if nobody else uses them
+	defer hc.Close()
+	if err := h.loadHistoryHorizon(); err != nil { // files below horizon are not opened
+		return fmt.Errorf("NewHistory.loadHistoryHorizon: %s, %w", h.filenameBase, err)
+	}
 	files, err := os.ReadDir(h.dir)
 	if err != nil {
 		return err
 	}
-	_ = h.scanStateFiles(files, h.integrityFileExtensions)
-	if err = h.openFiles(); err != nil {
+	prev, next := h.files.Load(), newFilesTree()
+	_ = h.scanStateFilesTo(next, withOffloadedFiles(files), h.integrityFileExtensions)
+	reuseOpenedItems(prev, next, h.lazyOpen)
+	if err = h.openFilesOf(next); err != nil {
+		retireDroppedItems(next, prev)
 		return fmt.Errorf("NewHistory.openFiles: %s, %w", h.filenameBase, err)
 	}
-	return h.InvertedIndex.reOpenFolder()
+	if err = h.InvertedIndex.reOpenFolder(); err != nil {
+		retireDroppedItems(next, prev)
+		return err
+	}
+	h.files.Store(next)
+	h.reCalcRoFiles()
+	retireDroppedItems(prev, next)
+	return nil
 }
 
 // scanStateFiles
 // returns `uselessFiles` where file "is useless" means: it's subset of frozen file. such files can be safely deleted. subset of non-frozen file may be useful
 func (h *History) scanStateFiles(files []fs.DirEntry, integrityFileExtensions []string) (uselessFiles []*filesItem) {
+	return h.scanStateFilesTo(h.files.Load(), files, integrityFileExtensions)
+}
+
+func (h *History) scanStateFilesTo(tree *btree2.BTreeG[*filesItem], files []fs.DirEntry, integrityFileExtensions []string) (uselessFiles []*filesItem) {
 	re := regexp.MustCompile("^" + h.filenameBase + ".([0-9]+)-([0-9]+).v$")
 	var err error
 Loop:
 	for _, f := range files {
-		if !f.Type().IsRegular() {
+		if !isDataFileEntry(f) {
 			continue
 		}
 
@@ -153,10 +178,14 @@ Loop:
 
 		startTxNum, endTxNum := startStep*h.aggregationStep, endStep*h.aggregationStep
 		frozen := endStep-startStep == StepsInBiggestFile
+		if h.isExpiredFile("v", startTxNum, endTxNum) {
+			log.Debug(fmt.Sprintf("[snapshots] skip %s because it's below history horizon", name))
+			continue
+		}
 
 		for _, ext := range integrityFileExtensions {
 			requiredFile := fmt.Sprintf("%s.%d-%d.%s", h.filenameBase, startStep, endStep, ext)
-			if !dir.FileExist(filepath.Join(h.dir, requiredFile)) {
+			if !fileOrStubExist(filepath.Join(h.dir, requiredFile)) {
 				log.Debug(fmt.Sprintf("[snapshots] skip %s because %s doesn't exists", name, requiredFile))
 				continue Loop
 			}
@@ -165,7 +194,7 @@ Loop:
 		var newFile = &filesItem{startTxNum: startTxNum, endTxNum: endTxNum, frozen: frozen}
 		addNewFile := true
 		var subSets []*filesItem
-		h.files.Walk(func(items []*filesItem) bool {
+		tree.Walk(func(items []*filesItem) bool {
 			for _, item := range items {
 				if item.isSubsetOf(newFile) {
 					subSets = append(subSets, item)
@@ -183,44 +212,63 @@ Loop:
 			return true
 		})
 		//for _, subSet := range subSets {
-		//	h.files.Delete(subSet)
+		//	tree.Delete(subSet)
 		//}
-		if addNewFile {
-			h.files.Set(newFile)
+		if _, ok := tree.Get(newFile); addNewFile && !ok { // keep opened item: cleanupDir scans live registry
+			tree.Set(newFile)
 		}
 	}
-	h.reCalcRoFiles()
 	return uselessFiles
 }
 
 func (h *History) openFiles() error {
-	var totalKeys uint64
+	err := h.openFilesOf(h.files.Load())
+	h.historyEndTxNum.Store(lastFileEndTxNum(h.files.Load()))
+	return err
+}
+
+// openFilesOf - opens files of `tree`, items of missing files are removed from it
+func (h *History) openFilesOf(tree *btree2.BTreeG[*filesItem]) error {
 	var err error
+	var pending []pendingIndex
 
 	invalidFileItems := make([]*filesItem, 0)
-	h.files.Walk(func(items []*filesItem) bool {
+	tree.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				item.decompressor.Close()
-			}
 			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
 			datPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep))
-			if !dir.FileExist(datPath) {
+			if !fileOrStubExist(datPath) {
 				invalidFileItems = append(invalidFileItems, item)
 				continue
 			}
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				log.Debug("Hisrory.openFiles: %w, %s", err, datPath)
-				return false
+			if item.blobs == nil {
+				if err = h.openBlobs(item); err != nil {
+					log.Debug(fmt.Errorf("Hisrory.openFiles: %w, %s", err, datPath).Error())
+					return false
+				}
+			}
+			if h.lazyOpen {
+				if item.datPath == "" { // opened items are shared with contexts: only missed indices are added
+					item.datPath = datPath
+					if h.cold != nil {
+						h.cold.register(item)
+					}
+				}
+				if idxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep)); item.idxPath == "" && fileOrStubExist(idxPath) {
+					item.idxPath = idxPath
+				}
+				continue
+			}
+			if item.decompressor == nil {
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					log.Debug("Hisrory.openFiles: %w, %s", err, datPath)
+					return false
+				}
 			}
 			if item.index == nil {
 				idxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep))
 				if dir.FileExist(idxPath) {
-					if item.index, err = recsplit.OpenIndex(idxPath); err != nil {
-						log.Debug(fmt.Errorf("Hisrory.openFiles: %w, %s", err, idxPath).Error())
-						return false
-					}
-					totalKeys += item.index.KeyCount()
+					pending = append(pending, pendingIndex{item: item, path: idxPath})
 				}
 			}
 		}
@@ -229,16 +277,29 @@ func (h *History) openFiles() error {
 	if err != nil {
 		return err
 	}
+	if err = h.idxHeaders.openIndices(pending); err != nil {
+		log.Debug(fmt.Errorf("Hisrory.openFiles: %w", err).Error())
+		return err
+	}
 	for _, item := range invalidFileItems {
-		h.files.Delete(item)
+		tree.Delete(item)
 	}
 
 	return nil
 }
 
 func (h *History) closeFiles() {
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.blobs != nil {
+				if item.blobs.decompressor != nil {
+					item.blobs.decompressor.Close()
+				}
+				if item.blobs.index != nil {
+					item.blobs.index.Close()
+				}
+				item.blobs = nil
+			}
 			if item.decompressor != nil {
 				if err := item.decompressor.Close(); err != nil {
 					log.Trace("close", "err", err, "file", item.decompressor.FileName())
@@ -254,7 +315,7 @@ func (h *History) closeFiles() {
 		}
 		return true
 	})
-	h.files.Clear()
+	h.files.Load().Clear()
 	h.reCalcRoFiles()
 }
 
@@ -263,12 +324,28 @@ func (h *History) Close() {
 	h.closeFiles()
 }
 
+func (h *History) closeIdleFiles() (closed int) {
+	closed = h.InvertedIndex.closeIdleFiles()
+	h.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.closeIdle() {
+				closed++
+			}
+		}
+		return true
+	})
+	return closed
+}
+
 func (h *History) Files() (res []string) {
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.decompressor != nil {
 				_, fName := filepath.Split(item.decompressor.FilePath())
 				res = append(res, filepath.Join("history", fName))
+			} else if item.datPath != "" {
+				_, fName := filepath.Split(item.datPath)
+				res = append(res, filepath.Join("history", fName))
 			}
 		}
 		return true
@@ -278,10 +355,10 @@ func (h *History) Files() (res []string) {
 }
 
 func (h *History) missedIdxFiles() (l []*filesItem) {
-	h.files.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
+	h.files.Load().Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
 			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
-			if !dir.FileExist(filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep))) {
+			if !idxBuilt(item, filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep))) {
 				l = append(l, item)
 			}
 		}
@@ -292,11 +369,19 @@ func (h *History) missedIdxFiles() (l []*filesItem) {
 
 // BuildMissedIndices - produce .efi/.vi/.kvi from .ef/.v/.kv
 func (h *History) BuildOptionalMissedIndices(ctx context.Context) (err error) {
+	if h.withoutIdx {
+		return nil
+	}
 	return h.localityIndex.BuildMissedIndices(ctx, h.InvertedIndex)
 }
 
 func (h *History) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighted) (err error) {
-	if err := h.InvertedIndex.BuildMissedIndices(ctx, sem); err != nil {
+	return h.BuildMissedIndicesWithProgress(ctx, sem, nil)
+}
+
+// BuildMissedIndicesWithProgress - BuildMissedIndices, progress of each index is added to ps (may be nil)
+func (h *History) BuildMissedIndicesWithProgress(ctx context.Context, sem *semaphore.Weighted, ps *background.ProgressSet) (err error) {
+	if err := h.InvertedIndex.BuildMissedIndicesWithProgress(ctx, sem, ps); err != nil {
 		return err
 	}
 	missedFiles := h.missedIdxFiles()
@@ -308,9 +393,13 @@ func (h *History) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighte
 				return err
 			}
 			defer sem.Release(1)
+			if _, err := h.cpuLimit.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer h.cpuLimit.Release(1)
 
 			search := &filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum}
-			iiItem, ok := h.InvertedIndex.files.Get(search)
+			iiItem, ok := h.InvertedIndex.files.Load().Get(search)
 			if !ok {
 				return nil
 			}
@@ -323,7 +412,9 @@ func (h *History) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighte
 			if err != nil {
 				return err
 			}
-			return buildVi(item, iiItem, idxPath, h.tmpdir, count, false /* values */, h.compressVals)
+			return buildMissedIdx(ps, idxPath, count, func(p *background.Progress) error {
+				return buildVi(item, iiItem, idxPath, h.tmpdir, count, false /* values */, h.compressVals, p)
+			})
 		})
 	}
 	if err := g.Wait(); err != nil {
@@ -334,6 +425,12 @@ func (h *History) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighte
 }
 
 func iterateForVi(historyItem, iiItem *filesItem, compressVals bool, f func(v []byte) error) (count int, err error) {
+	if err = historyItem.open(); err != nil {
+		return 0, err
+	}
+	if err = iiItem.open(); err != nil {
+		return 0, err
+	}
 	var cp CursorHeap
 	heap.Init(&cp)
 	g := iiItem.decompressor.MakeGetter()
@@ -389,9 +486,15 @@ func iterateForVi(historyItem, iiItem *filesItem, compressVals bool, f func(v []
 	return count, nil
 }
 
-func buildVi(historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, count int, values, compressVals bool) error {
+func buildVi(historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, count int, values, compressVals bool, p *background.Progress) error {
 	_, fName := filepath.Split(historyIdxPath)
 	log.Debug("[snapshots] build idx", "file", fName)
+	if err := historyItem.open(); err != nil {
+		return err
+	}
+	if err := iiItem.open(); err != nil {
+		return err
+	}
 	rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
 		KeyCount:    count,
 		Enums:       false,
@@ -420,6 +523,9 @@ func buildVi(historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, coun
 		g.Reset(0)
 		g2.Reset(0)
 		valOffset = 0
+		if p != nil {
+			p.Processed.Store(0)
+		}
 		for g.HasNext() {
 			keyBuf, _ = g.NextUncompressed()
 			valBuf, _ = g.NextUncompressed()
@@ -432,6 +538,9 @@ func buildVi(historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, coun
 				if err = rs.AddKey(historyKey, valOffset); err != nil {
 					return err
 				}
+				if p != nil {
+					p.Processed.Inc()
+				}
 				if compressVals {
 					valOffset = g2.Skip()
 				} else {
@@ -472,6 +581,9 @@ func (h *History) StartWrites(tmpdir string) {
 	defer h.walLock.Unlock()
 	h.wal = h.newWriter(tmpdir, true, false)
 }
+
+// FinishWrites - closes WAL: changes added after last Rotate (flush) are dropped, including last changes of keys kept
+// by SetSkipNoopWrites
 func (h *History) FinishWrites() {
 	h.InvertedIndex.FinishWrites()
 	h.walLock.Lock()
@@ -483,19 +595,25 @@ func (h *History) FinishWrites() {
 func (h *History) Rotate() historyFlusher {
 	h.walLock.Lock()
 	defer h.walLock.Unlock()
+	var pending []pendingWrite
 	if h.wal != nil {
+		pending = h.wal.takePending()
 		h.wal.historyValsFlushing, h.wal.historyVals = h.wal.historyVals, h.wal.historyValsFlushing
 		h.wal.autoIncrementFlush = h.wal.autoIncrement
 	}
-	return historyFlusher{h.wal, h.InvertedIndex.Rotate()}
+	return historyFlusher{h.wal, h.InvertedIndex.Rotate(), pending}
 }
 
 type historyFlusher struct {
-	h *historyWAL
-	i *invertedIndexWAL
+	h       *historyWAL
+	i       *invertedIndexWAL
+	pending []pendingWrite // taken from WAL by Rotate
 }
 
 func (f historyFlusher) Flush(ctx context.Context, tx kv.RwTx) error {
+	if err := f.h.writePending(f.i, f.pending, tx); err != nil {
+		return fmt.Errorf("%s: write of pending history: %w", f.h.h.filenameBase, err)
+	}
 	if err := f.i.Flush(ctx, tx); err != nil {
 		return err
 	}
@@ -516,6 +634,15 @@ type historyWAL struct {
 	autoIncrementFlush  uint64
 	buffered            bool
 	discard             bool
+
+	pending map[string]*pendingPrevValue // see History.SetSkipNoopWrites
+}
+
+// pendingPrevValue - last recorded change of key, not written yet: it's dropped if next change of key in same step
+// has same original value
+type pendingPrevValue struct {
+	txNum    uint64
+	original []byte
 }
 
 func (h *historyWAL) close() {
@@ -536,6 +663,9 @@ func (h *History) newWriter(tmpdir string, buffered, discard bool) *historyWAL {
 		autoIncrementBuf: make([]byte, 8),
 		historyKey:       make([]byte, 0, 128),
 	}
+	if h.skipNoopWrites {
+		w.pending = map[string]*pendingPrevValue{}
+	}
 	if buffered {
 		w.historyVals = etl.NewCollector(h.historyValsTable, tmpdir, etl.NewSortableBuffer(WALCollectorRam))
 		w.historyValsFlushing = etl.NewCollector(h.historyValsTable, tmpdir, etl.NewSortableBuffer(WALCollectorRam))
@@ -570,38 +700,87 @@ func (h *historyWAL) flush(ctx context.Context, tx kv.RwTx) error {
 	return nil
 }
 
+// SetSkipNoopWrites - AddPrevValue doesn't record change of key which didn't change its value (like no-op SSTORE):
+// it's detected by next change of key in same step - which has same original value. Last change of each key is kept
+// in memory until Rotate (flush). Smaller files and faster collation. Lookups return same values. Applied on StartWrites.
+func (h *History) SetSkipNoopWrites(v bool) { h.skipNoopWrites = v }
+
 func (h *historyWAL) addPrevValue(key1, key2, original []byte) error {
 	if h.discard {
 		return nil
 	}
+	if h.pending == nil {
+		return h.writePrevValue(h.h.txNum, key1, key2, original)
+	}
+	txNum := h.h.txNum
+	k := string(key1) + string(key2)
+	p, ok := h.pending[k]
+	if !ok {
+		h.pending[k] = &pendingPrevValue{txNum: txNum, original: common.Copy(original)}
+		return nil
+	}
+	sameStep := p.txNum/h.h.aggregationStep == txNum/h.h.aggregationStep
+	if !sameStep || !bytes.Equal(p.original, original) { // otherwise: value didn't change at p.txNum
+		if err := h.writePrevValue(p.txNum, []byte(k), nil, p.original); err != nil {
+			return err
+		}
+	}
+	p.txNum, p.original = txNum, append(p.original[:0], original...)
+	return nil
+}
+
+// pendingWrite - last change of key taken from historyWAL.pending by Rotate, valNum is reserved at that moment
+type pendingWrite struct {
+	txNum    uint64
+	valNum   uint64 // 0 - empty original, not stored in historyValsTable
+	key      []byte
+	original []byte
+}
 
-	/*
-		lk := len(key1) + len(key2)
-		historyKey := make([]byte, lk+8)
-		copy(historyKey, key1)
-		if len(key2) > 0 {
-			copy(historyKey[len(key1):], key2)
+// takePending - takes last changes of keys out of WAL, see SetSkipNoopWrites. They are written by
+// historyFlusher.Flush: Rotate has no way to report errors.
+func (h *historyWAL) takePending() []pendingWrite {
+	if len(h.pending) == 0 {
+		return nil
+	}
+	res := make([]pendingWrite, 0, len(h.pending))
+	for k, p := range h.pending {
+		w := pendingWrite{txNum: p.txNum, key: []byte(k), original: p.original}
+		if len(p.original) > 0 {
+			h.autoIncrement++
+			w.valNum = h.autoIncrement
 		}
-		if len(original) > 0 {
-			val, err := h.h.tx.GetOne(h.h.settingsTable, historyValCountKey)
-			if err != nil {
-				return err
-			}
-			var valNum uint64
-			if len(val) > 0 {
-				valNum = binary.BigEndian.Uint64(val)
-			}
-			valNum++
-			binary.BigEndian.PutUint64(historyKey[lk:], valNum)
-			if err = h.h.tx.Put(h.h.settingsTable, historyValCountKey, historyKey[lk:]); err != nil {
-				return err
-			}
-			if err = h.h.tx.Put(h.h.historyValsTable, historyKey[lk:], original); err != nil {
+		res = append(res, w)
+	}
+	h.pending = map[string]*pendingPrevValue{}
+	return res
+}
+
+// writePending - writes changes taken by Rotate into flushing collectors (or directly into tx if WAL isn't buffered)
+func (h *historyWAL) writePending(ii *invertedIndexWAL, pending []pendingWrite, tx kv.RwTx) error {
+	var txNum, valNum [8]byte
+	for _, p := range pending {
+		historyKey := append(append(h.historyKey[:0], p.key...), valNum[:]...)
+		binary.BigEndian.PutUint64(historyKey[len(p.key):], p.valNum)
+		if p.valNum > 0 {
+			if h.buffered {
+				if err := h.historyValsFlushing.Collect(historyKey[len(p.key):], p.original); err != nil {
+					return err
+				}
+			} else if err := tx.Put(h.h.historyValsTable, historyKey[len(p.key):], p.original); err != nil {
 				return err
 			}
 		}
-	*/
+		binary.BigEndian.PutUint64(txNum[:], p.txNum)
+		if err := ii.addFlushing(tx, txNum[:], historyKey, p.key); err != nil {
+			return err
+		}
+		h.historyKey = historyKey
+	}
+	return nil
+}
 
+func (h *historyWAL) writePrevValue(txNum uint64, key1, key2, original []byte) error {
 	lk := len(key1) + len(key2)
 	historyKey := h.historyKey[:lk+8]
 	copy(historyKey, key1)
@@ -628,7 +807,9 @@ func (h *historyWAL) addPrevValue(key1, key2, original []byte) error {
 		binary.BigEndian.PutUint64(historyKey[lk:], 0)
 	}
 
-	if err := h.h.InvertedIndex.add(historyKey, historyKey[:lk]); err != nil {
+	var txNumBytes [8]byte
+	binary.BigEndian.PutUint64(txNumBytes[:], txNum)
+	if err := h.h.InvertedIndex.addAt(txNumBytes[:], historyKey, historyKey[:lk]); err != nil {
 		return err
 	}
 	return nil
@@ -636,41 +817,46 @@ func (h *historyWAL) addPrevValue(key1, key2, original []byte) error {
 
 type HistoryCollation struct {
 	historyComp  *compress.Compressor
-	indexBitmaps map[string]*roaring64.Bitmap
+	blobs        *blobsWriter // nil if History has no blobThreshold
+	indexBitmaps *collatedBitmaps
 	historyPath  string
 	historyCount int
+	historySize  uint64 // uncompressed size of values
 }
 
 func (c HistoryCollation) Close() {
 	if c.historyComp != nil {
 		c.historyComp.Close()
 	}
-	for _, b := range c.indexBitmaps {
-		bitmapdb.ReturnToPool64(b)
-	}
+	c.blobs.close()
+	c.indexBitmaps.close()
 }
 
 func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.Ticker) (HistoryCollation, error) {
 	var historyComp *compress.Compressor
 	var err error
+	blobs := h.newBlobsWriter(step, step+1)
+	indexBitmaps := newCollatedBitmaps(h.InvertedIndex)
 	closeComp := true
 	defer func() {
 		if closeComp {
 			if historyComp != nil {
 				historyComp.Close()
 			}
+			blobs.close()
+			indexBitmaps.close()
 		}
 	}()
 	historyPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, step, step+1))
 	if historyComp, err = compress.NewCompressor(context.Background(), "collate history", historyPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace); err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
 	}
+	historyComp.SetCompressTmpFiles(h.compressTmp)
 	keysCursor, err := roTx.CursorDupSort(h.indexKeysTable)
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
 	}
 	defer keysCursor.Close()
-	indexBitmaps := map[string]*roaring64.Bitmap{}
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 	var val []byte
@@ -680,40 +866,34 @@ func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.
 		if txNum >= txTo {
 			break
 		}
-		var bitmap *roaring64.Bitmap
-		var ok bool
-		if bitmap, ok = indexBitmaps[string(v[:len(v)-8])]; !ok {
-			bitmap = bitmapdb.NewBitmap64()
-			indexBitmaps[string(v[:len(v)-8])] = bitmap
+		if err = indexBitmaps.add(v[:len(v)-8], txNum); err != nil {
+			break
 		}
-		bitmap.Add(txNum)
 		select {
 		case <-logEvery.C:
 			log.Info("[snapshots] collate history", "name", h.filenameBase, "range", fmt.Sprintf("%.2f-%.2f", float64(txNum)/float64(h.aggregationStep), float64(txTo)/float64(h.aggregationStep)))
-			bitmap.RunOptimize()
 		default:
 		}
 	}
+	if err == nil {
+		err = indexBitmaps.finish()
+	}
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("iterate over %s history cursor: %w", h.filenameBase, err)
 	}
-	keys := make([]string, 0, len(indexBitmaps))
-	for key := range indexBitmaps {
-		keys = append(keys, key)
-	}
-	slices.Sort(keys)
 	historyCount := 0
-	for _, key := range keys {
-		bitmap := indexBitmaps[key]
+	var historySize uint64
+	enc := h.newValsEncoder(blobs)
+	if err = indexBitmaps.forEach(func(key []byte, bitmap *roaring64.Bitmap) error {
 		it := bitmap.Iterator()
 		for it.HasNext() {
 			txNum := it.Next()
 			binary.BigEndian.PutUint64(txKey[:], txNum)
-			v, err := keysCursor.SeekBothRange(txKey[:], []byte(key))
+			v, err := keysCursor.SeekBothRange(txKey[:], key)
 			if err != nil {
-				return HistoryCollation{}, err
+				return err
 			}
-			if !bytes.HasPrefix(v, []byte(key)) {
+			if !bytes.HasPrefix(v, key) {
 				continue
 			}
 			valNum := binary.BigEndian.Uint64(v[len(v)-8:])
@@ -721,20 +901,31 @@ func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.
 				val = nil
 			} else {
 				if val, err = roTx.GetOne(h.historyValsTable, v[len(v)-8:]); err != nil {
-					return HistoryCollation{}, fmt.Errorf("get %s history val [%x]=>%d: %w", h.filenameBase, k, valNum, err)
+					return fmt.Errorf("get %s history val [%x]=>%d: %w", h.filenameBase, k, valNum, err)
+				}
+			}
+			historySize += uint64(len(val))
+			if h.taggedVals() {
+				if val, err = enc.encode(key, txNum, val); err != nil {
+					return err
 				}
 			}
 			if err = historyComp.AddUncompressedWord(val); err != nil {
-				return HistoryCollation{}, fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, k, val, err)
+				return fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, k, val, err)
 			}
 			historyCount++
 		}
+		return nil
+	}); err != nil {
+		return HistoryCollation{}, err
 	}
 	closeComp = false
 	return HistoryCollation{
 		historyPath:  historyPath,
 		historyComp:  historyComp,
+		blobs:        blobs,
 		historyCount: historyCount,
+		historySize:  historySize,
 		indexBitmaps: indexBitmaps,
 	}, nil
 }
@@ -744,9 +935,16 @@ type HistoryFiles struct {
 	historyIdx      *recsplit.Index
 	efHistoryDecomp *compress.Decompressor
 	efHistoryIdx    *recsplit.Index
+	efHistoryBt     *BtIndex
+	blobs           *filesItem // see filesItem.blobs
 }
 
 func (sf HistoryFiles) Close() {
+	if sf.blobs != nil {
+		sf.blobs.decompressor.Close()
+		sf.blobs.index.Close()
+	}
+	sf.efHistoryBt.Close()
 	if sf.historyDecomp != nil {
 		sf.historyDecomp.Close()
 	}
@@ -761,9 +959,9 @@ func (sf HistoryFiles) Close() {
 	}
 }
 func (h *History) reCalcRoFiles() {
-	roFiles := make([]ctxItem, 0, h.files.Len())
+	roFiles := make([]ctxItem, 0, h.files.Load().Len())
 	var prevStart uint64
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.canDelete.Load() {
 				continue
@@ -799,137 +997,88 @@ func (h *History) reCalcRoFiles() {
 		roFiles = []ctxItem{}
 	}
 	h.roFiles.Store(&roFiles)
+	h.historyEndTxNum.Store(lastFileEndTxNum(h.files.Load()))
 }
 
 // buildFiles performs potentially resource intensive operations of creating
 // static files and their indices
 func (h *History) buildFiles(ctx context.Context, step uint64, collation HistoryCollation) (HistoryFiles, error) {
+	defer collation.indexBitmaps.close()
 	historyComp := collation.historyComp
-	var historyDecomp, efHistoryDecomp *compress.Decompressor
-	var historyIdx, efHistoryIdx *recsplit.Index
-	var efHistoryComp *compress.Compressor
-	var rs *recsplit.RecSplit
+	var historyDecomp *compress.Decompressor
+	var historyIdx *recsplit.Index
+	var ef InvertedFiles
+	var blobs *filesItem
 	closeComp := true
 	defer func() {
 		if closeComp {
+			ef.Close()
 			if historyComp != nil {
 				historyComp.Close()
 			}
+			collation.blobs.close()
+			if blobs != nil {
+				blobs.decompressor.Close()
+				blobs.index.Close()
+			}
 			if historyDecomp != nil {
 				historyDecomp.Close()
 			}
 			if historyIdx != nil {
 				historyIdx.Close()
 			}
-			if efHistoryComp != nil {
-				efHistoryComp.Close()
-			}
-			if efHistoryDecomp != nil {
-				efHistoryDecomp.Close()
-			}
-			if efHistoryIdx != nil {
-				efHistoryIdx.Close()
-			}
-			if rs != nil {
-				rs.Close()
-			}
 		}
 	}()
-	historyIdxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, step, step+1))
+	historyIdxPath := filepath.Join(h.dir, segment.FileName(h.filenameBase, step, step+1, "vi"))
 	if err := historyComp.Compress(); err != nil {
 		return HistoryFiles{}, fmt.Errorf("compress %s history: %w", h.filenameBase, err)
 	}
 	historyComp.Close()
 	historyComp = nil
 	var err error
-	if historyDecomp, err = compress.NewDecompressor(collation.historyPath); err != nil {
-		return HistoryFiles{}, fmt.Errorf("open %s history decompressor: %w", h.filenameBase, err)
+	if blobs, err = collation.blobs.build(ctx); err != nil {
+		return HistoryFiles{}, err
 	}
 	// Build history ef
-	efHistoryPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.ef", h.filenameBase, step, step+1))
-	efHistoryComp, err = compress.NewCompressor(ctx, "ef history", efHistoryPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace)
-	if err != nil {
-		return HistoryFiles{}, fmt.Errorf("create %s ef history compressor: %w", h.filenameBase, err)
+	var efStats FileStats
+	if ef, efStats, err = h.InvertedIndex.buildEfFiles(ctx, step, collation.indexBitmaps, h.compressWorkers); err != nil {
+		return HistoryFiles{}, fmt.Errorf("build %s ef history: %w", h.filenameBase, err)
 	}
-	var buf []byte
-	keys := make([]string, 0, len(collation.indexBitmaps))
-	for key := range collation.indexBitmaps {
-		keys = append(keys, key)
+	historyStats := efStats
+	historyStats.Values, historyStats.ValuesBytes = uint64(collation.historyCount), collation.historySize
+	if err = writeFileStats(collation.historyPath, historyStats); err != nil {
+		return HistoryFiles{}, err
 	}
-	slices.Sort(keys)
-	for _, key := range keys {
-		if err = efHistoryComp.AddUncompressedWord([]byte(key)); err != nil {
-			return HistoryFiles{}, fmt.Errorf("add %s ef history key [%x]: %w", h.InvertedIndex.filenameBase, key, err)
+	if h.contentAddressed {
+		if err = addressByContent(collation.historyPath); err != nil {
+			return HistoryFiles{}, err
 		}
-		bitmap := collation.indexBitmaps[key]
-		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
-		it := bitmap.Iterator()
-		for it.HasNext() {
-			txNum := it.Next()
-			ef.AddOffset(txNum)
-		}
-		ef.Build()
-		buf = ef.AppendBytes(buf[:0])
-		if err = efHistoryComp.AddUncompressedWord(buf); err != nil {
-			return HistoryFiles{}, fmt.Errorf("add %s ef history val: %w", h.filenameBase, err)
-		}
-	}
-	if err = efHistoryComp.Compress(); err != nil {
-		return HistoryFiles{}, fmt.Errorf("compress %s ef history: %w", h.filenameBase, err)
-	}
-	efHistoryComp.Close()
-	efHistoryComp = nil
-	if efHistoryDecomp, err = compress.NewDecompressor(efHistoryPath); err != nil {
-		return HistoryFiles{}, fmt.Errorf("open %s ef history decompressor: %w", h.filenameBase, err)
-	}
-	efHistoryIdxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.efi", h.filenameBase, step, step+1))
-	if efHistoryIdx, err = buildIndex(ctx, efHistoryDecomp, efHistoryIdxPath, h.tmpdir, len(keys), false /* values */); err != nil {
-		return HistoryFiles{}, fmt.Errorf("build %s ef history idx: %w", h.filenameBase, err)
 	}
-	if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
-		KeyCount:   collation.historyCount,
-		Enums:      false,
-		BucketSize: 2000,
-		LeafSize:   8,
-		TmpDir:     h.tmpdir,
-		IndexFile:  historyIdxPath,
-	}); err != nil {
-		return HistoryFiles{}, fmt.Errorf("create recsplit: %w", err)
+	if historyDecomp, err = compress.NewDecompressor(collation.historyPath); err != nil {
+		return HistoryFiles{}, fmt.Errorf("open %s history decompressor: %w", h.filenameBase, err)
 	}
-	rs.LogLvl(log.LvlTrace)
 	var historyKey []byte
 	var txKey [8]byte
-	var valOffset uint64
 	g := historyDecomp.MakeGetter()
-	for {
+	if err = segment.BuildIndex(ctx, segment.IndexArgs{IndexFile: historyIdxPath, TmpDir: h.tmpdir, KeyCount: collation.historyCount}, func(add func(key []byte, offset uint64) error) error {
 		g.Reset(0)
-		valOffset = 0
-		for _, key := range keys {
-			bitmap := collation.indexBitmaps[key]
+		var valOffset uint64
+		return collation.indexBitmaps.forEach(func(key []byte, bitmap *roaring64.Bitmap) error {
 			it := bitmap.Iterator()
 			for it.HasNext() {
 				txNum := it.Next()
 				binary.BigEndian.PutUint64(txKey[:], txNum)
 				historyKey = append(append(historyKey[:0], txKey[:]...), key...)
-				if err = rs.AddKey(historyKey, valOffset); err != nil {
-					return HistoryFiles{}, fmt.Errorf("add %s history idx [%x]: %w", h.filenameBase, historyKey, err)
+				if err := add(historyKey, valOffset); err != nil {
+					return fmt.Errorf("add %s history idx [%x]: %w", h.filenameBase, historyKey, err)
 				}
 				valOffset = g.Skip()
 			}
-		}
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Info("Building recsplit. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return HistoryFiles{}, fmt.Errorf("build idx: %w", err)
-			}
-		} else {
-			break
-		}
+			return nil
+		})
+	}); err != nil {
+		return HistoryFiles{}, err
 	}
-	rs.Close()
-	rs = nil
 	if historyIdx, err = recsplit.OpenIndex(historyIdxPath); err != nil {
 		return HistoryFiles{}, fmt.Errorf("open idx: %w", err)
 	}
@@ -937,8 +1086,10 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 	return HistoryFiles{
 		historyDecomp:   historyDecomp,
 		historyIdx:      historyIdx,
-		efHistoryDecomp: efHistoryDecomp,
-		efHistoryIdx:    efHistoryIdx,
+		efHistoryDecomp: ef.decomp,
+		efHistoryIdx:    ef.index,
+		efHistoryBt:     ef.bt,
+		blobs:           blobs,
 	}, nil
 }
 
@@ -946,69 +1097,74 @@ func (h *History) integrateFiles(sf HistoryFiles, txNumFrom, txNumTo uint64) {
 	h.InvertedIndex.integrateFiles(InvertedFiles{
 		decomp: sf.efHistoryDecomp,
 		index:  sf.efHistoryIdx,
+		bt:     sf.efHistoryBt,
 	}, txNumFrom, txNumTo)
-	h.files.Set(&filesItem{
+	h.files.Load().Set(&filesItem{
 		frozen:       (txNumTo-txNumFrom)/h.aggregationStep == StepsInBiggestFile,
 		startTxNum:   txNumFrom,
 		endTxNum:     txNumTo,
 		decompressor: sf.historyDecomp,
 		index:        sf.historyIdx,
+		blobs:        sf.blobs,
 	})
 	h.reCalcRoFiles()
 }
 
-func (h *History) warmup(ctx context.Context, txFrom, limit uint64, tx kv.Tx) error {
+// warmup - same as InvertedIndex.warmup, also reads history values
+func (h *History) warmup(ctx context.Context, txFrom, txTo, budget uint64, tx kv.Tx) (warmedTo, size uint64, err error) {
 	historyKeysCursor, err := tx.CursorDupSort(h.indexKeysTable)
 	if err != nil {
-		return fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
+		return 0, 0, fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
 	}
 	defer historyKeysCursor.Close()
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 	idxC, err := tx.CursorDupSort(h.indexTable)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer idxC.Close()
 	valsC, err := tx.Cursor(h.historyValsTable)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer valsC.Close()
-	k, v, err := historyKeysCursor.Seek(txKey[:])
-	if err != nil {
-		return err
-	}
-	if k == nil {
-		return nil
-	}
-	txFrom = binary.BigEndian.Uint64(k)
-	txTo := txFrom + h.aggregationStep
-	if limit != math.MaxUint64 && limit != 0 {
-		txTo = txFrom + limit
-	}
-	for ; err == nil && k != nil; k, v, err = historyKeysCursor.Next() {
-		if err != nil {
-			return err
-		}
+	warmedTo = txTo
+	var prevTxNum uint64
+	var k, v, val []byte
+	for k, v, err = historyKeysCursor.Seek(txKey[:]); err == nil && k != nil; k, v, err = historyKeysCursor.Next() {
 		if err = ctx.Err(); err != nil {
-			return err
+			return 0, 0, err
 		}
 		txNum := binary.BigEndian.Uint64(k)
 		if txNum >= txTo {
 			break
 		}
-		_, _, _ = valsC.Seek(v[len(v)-8:])
+		if budget > 0 && size >= budget && txNum != prevTxNum {
+			warmedTo = txNum
+			break
+		}
+		prevTxNum = txNum
+		_, val, _ = valsC.Seek(v[len(v)-8:])
 		_, _ = idxC.SeekBothRange(v[:len(v)-8], k)
+		size += uint64(len(k) + 2*len(v) + len(val))
 	}
 	if err != nil {
-		return fmt.Errorf("iterate over %s history keys: %w", h.filenameBase, err)
+		return 0, 0, fmt.Errorf("iterate over %s history keys: %w", h.filenameBase, err)
 	}
-
-	return nil
+	return warmedTo, size, nil
 }
 
 func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+	return h.pruneWithStat(ctx, txFrom, txTo, limit, logEvery, nil)
+}
+
+// pruneWithStat - prune which counts deleted records into `stat`, if it's not nil
+func (h *History) pruneWithStat(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker, stat *EntityPruneStat) error {
+	if stat != nil {
+		defer func(t time.Time) { stat.Took += time.Since(t) }(time.Now())
+		stat.PrunedTo = txTo
+	}
 	historyKeysCursor, err := h.tx.RwCursorDupSort(h.indexKeysTable)
 	if err != nil {
 		return fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
@@ -1028,6 +1184,9 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 	if limit != math.MaxUint64 && limit != 0 {
 		txTo = cmp.Min(txTo, txFrom+limit)
 	}
+	if stat != nil {
+		stat.PrunedTo = txTo
+	}
 	if txFrom >= txTo {
 		return nil
 	}
@@ -1051,6 +1210,11 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 			break
 		}
 		for ; err == nil && k != nil; k, v, err = historyKeysCursor.NextDup() {
+			if stat != nil && binary.BigEndian.Uint64(v[len(v)-8:]) != 0 { // 0 - empty value, not stored
+				if val, err := h.tx.GetOne(h.historyValsTable, v[len(v)-8:]); err == nil && val != nil {
+					stat.deleted(h.historyValsTable, v[len(v)-8:], val)
+				}
+			}
 			if err = valsC.Delete(v[len(v)-8:]); err != nil {
 				return err
 			}
@@ -1058,6 +1222,8 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 			if err = idxC.DeleteExact(v[:len(v)-8], k); err != nil {
 				return err
 			}
+			stat.deleted(h.indexTable, v[:len(v)-8], k)
+			stat.deleted(h.indexKeysTable, k, v)
 			//for vv, err := idxC.SeekBothRange(v[:len(v)-8], k); vv != nil; _, vv, err = idxC.NextDup() {
 			//	if err != nil {
 			//		return err
@@ -1078,6 +1244,9 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 
 		select {
 		case <-ctx.Done():
+			if stat != nil {
+				stat.PrunedTo = txNum + 1
+			}
 			return nil
 		case <-logEvery.C:
 			log.Info("[snapshots] prune history", "name", h.filenameBase, "range", fmt.Sprintf("%.2f-%.2f", float64(txNum)/float64(h.aggregationStep), float64(txTo)/float64(h.aggregationStep)))
@@ -1151,61 +1320,62 @@ type HistoryContext struct {
 	getters []*compress.Getter
 	readers []*recsplit.IndexReader
 
-	trace bool
+	trace  bool
+	tracer *queryTracer // see AggregatorV3Context.EnableTracing
+	qt     *QueryTrace  // trace of current Get call
 }
 
 func (h *History) MakeContext() *HistoryContext {
 	var hc = HistoryContext{
 		h:     h,
 		ic:    h.InvertedIndex.MakeContext(),
-		files: *h.roFiles.Load(),
+		files: acquireRoFiles(&h.roFiles),
 
 		trace: false,
 	}
-	for _, item := range hc.files {
-		if !item.src.frozen {
-			item.src.refcount.Inc()
-		}
-	}
-
 	return &hc
 }
 
-func (hc *HistoryContext) statelessGetter(i int) *compress.Getter {
+// reuse - see InvertedIndexContext.reuse
+func (hc *HistoryContext) reuse() {
+	hc.ic.reuse()
+	if !acquireAll(hc.files) {
+		hc.files, hc.getters, hc.readers = acquireRoFiles(&hc.h.roFiles), nil, nil
+	}
+}
+
+func (hc *HistoryContext) statelessGetter(i int) (*compress.Getter, error) {
 	if hc.getters == nil {
 		hc.getters = make([]*compress.Getter, len(hc.files))
 	}
 	r := hc.getters[i]
 	if r == nil {
+		if err := hc.files[i].src.open(); err != nil {
+			return nil, err
+		}
 		r = hc.files[i].src.decompressor.MakeGetter()
 		hc.getters[i] = r
 	}
-	return r
+	return r, nil
 }
-func (hc *HistoryContext) statelessIdxReader(i int) *recsplit.IndexReader {
+func (hc *HistoryContext) statelessIdxReader(i int) (*recsplit.IndexReader, error) {
 	if hc.readers == nil {
 		hc.readers = make([]*recsplit.IndexReader, len(hc.files))
 	}
 	r := hc.readers[i]
 	if r == nil {
+		if err := hc.files[i].src.open(); err != nil {
+			return nil, err
+		}
 		r = recsplit.NewIndexReader(hc.files[i].src.index)
 		hc.readers[i] = r
 	}
-	return r
+	return r, nil
 }
 
 func (hc *HistoryContext) Close() {
 	hc.ic.Close()
-	for _, item := range hc.files {
-		if item.src.frozen {
-			continue
-		}
-		refCnt := item.src.refcount.Dec()
-		//GC: last reader responsible to remove useles files: close it and delete
-		if refCnt == 0 && item.src.canDelete.Load() {
-			item.src.closeFilesAndRemove()
-		}
-	}
+	releaseAll(hc.files) // see InvertedIndexContext.Close
 }
 
 func (hc *HistoryContext) getFile(from, to uint64) (it ctxItem, ok bool) {
@@ -1218,6 +1388,32 @@ func (hc *HistoryContext) getFile(from, to uint64) (it ctxItem, ok bool) {
 }
 
 func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, error) {
+	if hc.tracer != nil {
+		defer hc.tracer.done(hc.startTrace("GetNoState", key, txNum), time.Now())
+	}
+	return hc.getNoState(key, txNum)
+}
+
+func (hc *HistoryContext) startTrace(op string, key []byte, txNum uint64) *QueryTrace {
+	qt := hc.tracer.start(hc.h.filenameBase+"."+op, key, txNum)
+	hc.qt = qt
+	return qt
+}
+
+func (hc *HistoryContext) getNoState(key []byte, txNum uint64) ([]byte, bool, error) {
+	if err := hc.h.checkHistoryHorizon(txNum); err != nil {
+		return nil, false, err
+	}
+	if hc.h.withoutIdx {
+		for _, item := range hc.ic.files {
+			if err := item.src.open(); err != nil {
+				return nil, false, err
+			}
+			if !item.src.hasBt() {
+				return nil, false, hc.h.errWithoutIndex()
+			}
+		}
+	}
 	exactStep1, exactStep2, lastIndexedTxNum, foundExactShard1, foundExactShard2 := hc.h.localityIndex.lookupIdxFiles(hc.ic.loc.reader, hc.ic.loc.bm, hc.ic.loc.file, key, txNum)
 
 	//fmt.Printf("GetNoState [%x] %d\n", key, txNum)
@@ -1225,25 +1421,37 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 	var foundEndTxNum uint64
 	var foundStartTxNum uint64
 	var found bool
+	var findErr error
 	var findInFile = func(item ctxItem) bool {
-		reader := hc.ic.statelessIdxReader(item.i)
-		if reader.Empty() {
+		offset, ok, err := hc.ic.lookup(item.i, key)
+		if err != nil {
+			findErr = err
+			return false
+		}
+		if !ok {
+			hc.tracer.probe(hc.qt, item.src.decompressor.FileName(), 1, 0, false)
 			return true
 		}
-		offset := reader.Lookup(key)
-		g := hc.ic.statelessGetter(item.i)
+		g, err := hc.ic.statelessGetter(item.i)
+		if err != nil {
+			findErr = err
+			return false
+		}
 		g.Reset(offset)
 		k, _ := g.NextUncompressed()
 
 		if !bytes.Equal(k, key) {
+			hc.tracer.probe(hc.qt, item.src.decompressor.FileName(), 1, len(k), false)
 			//if bytes.Equal(key, hex.MustDecodeString("009ba32869045058a3f05d6f3dd2abb967e338f6")) {
 			//	fmt.Printf("not in this shard: %x, %d, %d-%d\n", k, txNum, item.startTxNum/hc.h.aggregationStep, item.endTxNum/hc.h.aggregationStep)
 			//}
 			return true
 		}
 		eliasVal, _ := g.NextUncompressed()
+		item.src.reads.hit(len(eliasVal))
 		ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 		n, ok := ef.Search(txNum)
+		hc.tracer.probe(hc.qt, item.src.decompressor.FileName(), 1, len(k)+len(eliasVal), ok)
 		if hc.trace {
 			n2, _ := ef.Search(n + 1)
 			n3, _ := ef.Search(n - 1)
@@ -1266,6 +1474,8 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		item, ok := hc.ic.getFile(from, to)
 		if ok {
 			findInFile(item)
+		} else {
+			lastIndexedTxNum = 0 // file was replaced by ExpireHistory - LocalityIndex is stale
 		}
 		//for _, item := range hc.invIndexFiles {
 		//	if item.startTxNum == from && item.endTxNum == to {
@@ -1277,11 +1487,13 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		//	findInFile(exactShard1)
 		//}
 	}
-	if !found && foundExactShard2 {
+	if !found && findErr == nil && foundExactShard2 {
 		from, to := exactStep2*hc.h.aggregationStep, (exactStep2+StepsInBiggestFile)*hc.h.aggregationStep
 		item, ok := hc.ic.getFile(from, to)
 		if ok {
 			findInFile(item)
+		} else {
+			lastIndexedTxNum = 0
 		}
 		//exactShard2, ok := hc.invIndexFiles.Get(ctxItem{startTxNum: exactStep2 * hc.h.aggregationStep, endTxNum: (exactStep2 + StepsInBiggestFile) * hc.h.aggregationStep})
 		//if ok {
@@ -1293,7 +1505,7 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 	// if there is no LocaliyIndex available
 	// -- LocaliyIndex opimization End --
 
-	if !found {
+	if !found && findErr == nil {
 		for _, item := range hc.ic.files {
 			if item.endTxNum <= lastIndexedTxNum {
 				continue
@@ -1304,6 +1516,9 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		}
 		//hc.invIndexFiles.AscendGreaterOrEqual(ctxItem{startTxNum: lastIndexedTxNum, endTxNum: lastIndexedTxNum}, findInFile)
 	}
+	if findErr != nil {
+		return nil, false, findErr
+	}
 
 	if found {
 		historyItem, ok := hc.getFile(foundStartTxNum, foundEndTxNum)
@@ -1312,52 +1527,57 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		}
 		var txKey [8]byte
 		binary.BigEndian.PutUint64(txKey[:], foundTxNum)
-		reader := hc.statelessIdxReader(historyItem.i)
+		reader, err := hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			return nil, false, err
+		}
 		offset := reader.Lookup2(txKey[:], key)
 		//fmt.Printf("offset = %d, txKey=[%x], key=[%x]\n", offset, txKey[:], key)
-		g := hc.statelessGetter(historyItem.i)
-		g.Reset(offset)
-		if hc.h.compressVals {
-			v, _ := g.Next(nil)
-			return v, true, nil
+		g, err := hc.statelessGetter(historyItem.i)
+		if err != nil {
+			return nil, false, err
 		}
-		v, _ := g.NextUncompressed()
+		v, err := historyVal(g, reader, historyItem.src.blobs, key, offset, hc.h.compressVals, hc.h.taggedVals(), nil)
+		if err != nil {
+			return nil, false, err
+		}
+		historyItem.src.reads.lookup()
+		historyItem.src.reads.hit(len(v))
+		hc.tracer.probe(hc.qt, historyItem.src.decompressor.FileName(), 1, len(v), true)
 		return v, true, nil
 	}
 	return nil, false, nil
 }
 
-func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint64) {
+func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint64, error) {
 	//fmt.Printf("GetNoState [%x] %d\n", key, txNum)
 	if hs.indexFile.reader.Empty() {
-		return nil, false, txNum
+		return nil, false, txNum, nil
 	}
 	offset := hs.indexFile.reader.Lookup(key)
 	g := hs.indexFile.getter
 	g.Reset(offset)
 	k, _ := g.NextUncompressed()
 	if !bytes.Equal(k, key) {
-		return nil, false, txNum
+		return nil, false, txNum, nil
 	}
 	//fmt.Printf("Found key=%x\n", k)
 	eliasVal, _ := g.NextUncompressed()
 	ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 	n, ok := ef.Search(txNum)
 	if !ok {
-		return nil, false, ef.Max()
+		return nil, false, ef.Max(), nil
 	}
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], n)
 	offset = hs.historyFile.reader.Lookup2(txKey[:], key)
 	//fmt.Printf("offset = %d, txKey=[%x], key=[%x]\n", offset, txKey[:], key)
 	g = hs.historyFile.getter
-	g.Reset(offset)
-	if hs.compressVals {
-		v, _ := g.Next(nil)
-		return v, true, txNum
+	v, err := historyVal(g, hs.historyFile.reader, hs.historyItem.blobs, key, offset, hs.compressVals, hs.taggedVals, nil)
+	if err != nil {
+		return nil, false, txNum, err
 	}
-	v, _ := g.NextUncompressed()
-	return v, true, txNum
+	return v, true, txNum, nil
 }
 
 func (hs *HistoryStep) MaxTxNum(key []byte) (bool, uint64) {
@@ -1379,7 +1599,10 @@ func (hs *HistoryStep) MaxTxNum(key []byte) (bool, uint64) {
 // GetNoStateWithRecent searches history for a value of specified key before txNum
 // second return value is true if the value is found in the history (even if it is nil)
 func (hc *HistoryContext) GetNoStateWithRecent(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
-	v, ok, err := hc.GetNoState(key, txNum)
+	if hc.tracer != nil {
+		defer hc.tracer.done(hc.startTrace("GetNoStateWithRecent", key, txNum), time.Now())
+	}
+	v, ok, err := hc.getNoState(key, txNum)
 	if err != nil {
 		return nil, ok, err
 	}
@@ -1391,6 +1614,7 @@ func (hc *HistoryContext) GetNoStateWithRecent(key []byte, txNum uint64, roTx kv
 	if roTx == nil {
 		return nil, false, fmt.Errorf("roTx is nil")
 	}
+	hc.tracer.db(hc.qt)
 	v, ok, err = hc.getNoStateFromDB(key, txNum, roTx)
 	if err != nil {
 		return nil, ok, err
@@ -1444,33 +1668,58 @@ func (hc *HistoryContext) getNoStateFromDB(key []byte, txNum uint64, tx kv.Tx) (
 	return nil, false, nil
 }
 
-func (hc *HistoryContext) WalkAsOf(startTxNum uint64, from, to []byte, roTx kv.Tx, amount int) *StateAsOfIter {
+// WalkAsOf - keys with their values as of `startTxNum` (only keys which changed at or after `startTxNum`).
+// Asc: keys in [from, to). Desc: keys in [from, to) with from > to - same as kv.Tx.RangeDescend. nil means unbounded.
+// Desc walks files backward with bounded memory, see descFileIter.
+func (hc *HistoryContext) WalkAsOf(startTxNum uint64, from, to []byte, asc order.By, roTx kv.Tx, amount int) *StateAsOfIter {
 	hi := StateAsOfIter{
 		hasNextInDb:  true,
 		roTx:         roTx,
 		indexTable:   hc.h.indexTable,
 		idxKeysTable: hc.h.indexKeysTable,
 		valsTable:    hc.h.historyValsTable,
+		orderAscend:  asc,
 		from:         from, to: to, limit: amount,
 	}
+	hi.hc = hc
+	hi.compressVals = hc.h.compressVals
+	hi.taggedVals = hc.h.taggedVals()
+	hi.startTxNum = startTxNum
+	if hi.err = hc.h.checkHistoryHorizon(startTxNum); hi.err != nil {
+		return &hi
+	}
+	binary.BigEndian.PutUint64(hi.startTxKey[:], startTxNum)
 	for _, item := range hc.ic.files {
 		if item.endTxNum <= startTxNum {
 			continue
 		}
-		// TODO: seek(from)
-		g := item.src.decompressor.MakeGetter()
+		if hi.err = item.src.open(); hi.err != nil {
+			return &hi
+		}
+		src := item.src
+		g := src.decompressor.MakeGetter()
 		g.Reset(0)
+		hi.total += uint64(g.Size())
+		if asc && from != nil && src.bt != nil {
+			offset, ok := src.bt.SeekOffset(g, from)
+			if !ok {
+				continue
+			}
+			g.Reset(offset)
+		}
+		if !asc {
+			if it := newDescFileIter(g, src.bt, item.startTxNum, item.endTxNum, from, to); it.next() {
+				heap.Push(&hi.descFiles, it)
+				hi.hasNextInFiles = true
+			}
+			continue
+		}
 		if g.HasNext() {
 			key, offset := g.NextUncompressed()
 			heap.Push(&hi.h, &ReconItem{g: g, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
 			hi.hasNextInFiles = true
 		}
-		hi.total += uint64(item.getter.Size())
 	}
-	hi.hc = hc
-	hi.compressVals = hc.h.compressVals
-	hi.startTxNum = startTxNum
-	binary.BigEndian.PutUint64(hi.startTxKey[:], startTxNum)
 	hi.advanceInDb()
 	hi.advanceInFiles()
 	hi.advance()
@@ -1486,8 +1735,10 @@ type StateAsOfIter struct {
 	idxKeysTable  string
 	indexTable    string
 
-	from, to []byte
-	limit    int
+	from, to    []byte
+	limit       int
+	orderAscend order.By
+	descFiles   descHeap // order.Desc: files positioned at their next key
 
 	nextFileKey []byte
 	nextDbKey   []byte
@@ -1506,6 +1757,8 @@ type StateAsOfIter struct {
 	hasNextInFiles bool
 	hasNextInDb    bool
 	compressVals   bool
+	taggedVals     bool
+	err            error // ErrHistoryPruned: returned by first Next
 
 	k, v, kBackup, vBackup []byte
 }
@@ -1523,6 +1776,10 @@ func (hi *StateAsOfIter) Close() {
 
 func (hi *StateAsOfIter) advanceInFiles() {
 	hi.advFileCnt++
+	if !hi.orderAscend {
+		hi.advanceInFilesDesc()
+		return
+	}
 	for hi.h.Len() > 0 {
 		top := heap.Pop(&hi.h).(*ReconItem)
 		key := top.key
@@ -1560,16 +1817,22 @@ func (hi *StateAsOfIter) advanceInFiles() {
 		binary.BigEndian.PutUint64(hi.txnKey[:], n)
 		historyItem, ok := hi.hc.getFile(top.startTxNum, top.endTxNum)
 		if !ok {
-			panic(fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextFileKey))
+			hi.err = fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextFileKey)
+			return
+		}
+		reader, err := hi.hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
 		}
-		reader := hi.hc.statelessIdxReader(historyItem.i)
 		offset := reader.Lookup2(hi.txnKey[:], hi.nextFileKey)
-		g := hi.hc.statelessGetter(historyItem.i)
-		g.Reset(offset)
-		if hi.compressVals {
-			hi.nextFileVal, _ = g.Next(nil)
-		} else {
-			hi.nextFileVal, _ = g.NextUncompressed()
+		g, err := hi.hc.statelessGetter(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
+		}
+		if hi.nextFileVal, hi.err = historyVal(g, reader, historyItem.src.blobs, hi.nextFileKey, offset, hi.compressVals, hi.taggedVals, nil); hi.err != nil {
+			return
 		}
 		hi.nextFileKey = key
 		return
@@ -1577,6 +1840,59 @@ func (hi *StateAsOfIter) advanceInFiles() {
 	hi.hasNextInFiles = false
 }
 
+func (hi *StateAsOfIter) advanceInFilesDesc() {
+	for hi.descFiles.Len() > 0 {
+		top := hi.descFiles[0]
+		key, idxVal := top.key, top.value()
+		skip := bytes.Equal(key, hi.nextFileKey)
+		var n uint64
+		if !skip {
+			ef, _ := eliasfano32.ReadEliasFano(idxVal)
+			var ok bool
+			n, ok = ef.Search(hi.startTxNum)
+			skip = !ok
+		}
+		if skip {
+			hi.nextDesc(top)
+			continue
+		}
+
+		hi.nextFileKey = append(hi.nextFileKey[:0], key...)
+		hi.nextDesc(top)
+		binary.BigEndian.PutUint64(hi.txnKey[:], n)
+		historyItem, ok := hi.hc.getFile(top.startTxNum, top.endTxNum)
+		if !ok {
+			hi.err = fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextFileKey)
+			return
+		}
+		reader, err := hi.hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
+		}
+		offset := reader.Lookup2(hi.txnKey[:], hi.nextFileKey)
+		g, err := hi.hc.statelessGetter(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
+		}
+		if hi.nextFileVal, hi.err = historyVal(g, reader, historyItem.src.blobs, hi.nextFileKey, offset, hi.compressVals, hi.taggedVals, nil); hi.err != nil {
+			return
+		}
+		return
+	}
+	hi.hasNextInFiles = false
+}
+
+// nextDesc - moves file at top of descFiles to its next key
+func (hi *StateAsOfIter) nextDesc(top *descFileIter) {
+	if top.next() {
+		heap.Fix(&hi.descFiles, 0)
+	} else {
+		heap.Pop(&hi.descFiles)
+	}
+}
+
 func (hi *StateAsOfIter) advanceInDb() {
 	hi.advDbCnt++
 	var k []byte
@@ -1589,21 +1905,23 @@ func (hi *StateAsOfIter) advanceInDb() {
 		if hi.txNum2kCursor, err = hi.roTx.CursorDupSort(hi.idxKeysTable); err != nil {
 			panic(err)
 		}
-		if k, _, err = hi.idxCursor.Seek(hi.from); err != nil {
+		if k, err = hi.seekInDb(); err != nil {
 			// TODO pass error properly around
 			panic(err)
 		}
 	} else {
-		if k, _, err = hi.idxCursor.NextNoDup(); err != nil {
+		if k, _, err = hi.nextInDb(); err != nil {
 			panic(err)
 		}
 	}
-	for ; k != nil; k, _, err = hi.idxCursor.NextNoDup() {
+	for ; k != nil; k, _, err = hi.nextInDb() {
 		if err != nil {
 			panic(err)
 		}
-		if hi.to != nil && bytes.Compare(k, hi.to) >= 0 {
-			break
+		if hi.to != nil {
+			if c := bytes.Compare(k, hi.to); (hi.orderAscend && c >= 0) || (!hi.orderAscend && c <= 0) {
+				break
+			}
 		}
 
 		foundTxNumVal, err := hi.idxCursor.SeekBothRange(k, hi.startTxKey[:])
@@ -1640,10 +1958,44 @@ func (hi *StateAsOfIter) advanceInDb() {
 	hi.hasNextInDb = false
 }
 
+func (hi *StateAsOfIter) seekInDb() (k []byte, err error) {
+	if hi.orderAscend {
+		k, _, err = hi.idxCursor.Seek(hi.from)
+		return k, err
+	}
+	if hi.from == nil {
+		k, _, err = hi.idxCursor.Last()
+		return k, err
+	}
+	// exactly `from` or previous key
+	if k, _, err = hi.idxCursor.Seek(hi.from); err != nil {
+		return nil, err
+	}
+	if k == nil {
+		k, _, err = hi.idxCursor.Last()
+		return k, err
+	}
+	if bytes.Equal(k, hi.from) {
+		return k, nil
+	}
+	k, _, err = hi.idxCursor.PrevNoDup()
+	return k, err
+}
+
+func (hi *StateAsOfIter) nextInDb() ([]byte, []byte, error) {
+	if hi.orderAscend {
+		return hi.idxCursor.NextNoDup()
+	}
+	return hi.idxCursor.PrevNoDup()
+}
+
 func (hi *StateAsOfIter) advance() {
 	if hi.hasNextInFiles {
 		if hi.hasNextInDb {
 			c := bytes.Compare(hi.nextFileKey, hi.nextDbKey)
+			if !hi.orderAscend {
+				c = -c
+			}
 			if c < 0 {
 				hi.nextKey = append(hi.nextKey[:0], hi.nextFileKey...)
 				hi.nextVal = append(hi.nextVal[:0], hi.nextFileVal...)
@@ -1674,10 +2026,13 @@ func (hi *StateAsOfIter) advance() {
 }
 
 func (hi *StateAsOfIter) HasNext() bool {
-	return hi.limit != 0 && (hi.hasNextInFiles || hi.hasNextInDb || hi.nextKey != nil)
+	return hi.err != nil || (hi.limit != 0 && (hi.hasNextInFiles || hi.hasNextInDb || hi.nextKey != nil))
 }
 
 func (hi *StateAsOfIter) Next() ([]byte, []byte, error) {
+	if hi.err != nil {
+		return nil, nil, hi.err
+	}
 	hi.limit--
 	hi.k, hi.v = append(hi.k[:0], hi.nextKey...), append(hi.v[:0], hi.nextVal...)
 
@@ -1687,7 +2042,10 @@ func (hi *StateAsOfIter) Next() ([]byte, []byte, error) {
 	return hi.kBackup, hi.vBackup, nil
 }
 
-func (hc *HistoryContext) IterateChanged(fromTxNum, toTxNum int, asc order.By, limit int, roTx kv.Tx) *HistoryChangesIter {
+// IterateChanged - keys changed in [fromTxNum, toTxNum) with their values before change.
+// `from`, `to` - keys bounds [from, to), nil means unbounded.
+// To iterate over keys with given prefix: `from = prefix, to, _ = kv.NextSubtree(prefix)`
+func (hc *HistoryContext) IterateChanged(fromTxNum, toTxNum int, from, to []byte, asc order.By, limit int, roTx kv.Tx) *HistoryChangesIter {
 	if asc == order.Desc {
 		panic("not supported yet")
 	}
@@ -1708,6 +2066,10 @@ func (hc *HistoryContext) IterateChanged(fromTxNum, toTxNum int, asc order.By, l
 		indexTable:   hc.h.indexTable,
 		idxKeysTable: hc.h.indexKeysTable,
 		valsTable:    hc.h.historyValsTable,
+		from:         from, to: to,
+	}
+	if hi.err = hc.h.checkHistoryHorizon(startTxNum); hi.err != nil {
+		return &hi
 	}
 
 	for _, item := range hc.ic.files {
@@ -1720,10 +2082,20 @@ func (hc *HistoryContext) IterateChanged(fromTxNum, toTxNum int, asc order.By, l
 		if item.startTxNum >= endTxNum {
 			break
 		}
-		g := item.src.decompressor.MakeGetter()
+		if hi.err = item.src.open(); hi.err != nil {
+			return &hi
+		}
+		src := item.src
+		g := src.decompressor.MakeGetter()
 		g.Reset(0)
-		if g.HasNext() {
-			key, offset := g.NextUncompressed()
+		if from != nil && src.bt != nil {
+			if offset, ok := src.bt.SeekOffset(g, from); ok {
+				g.Reset(offset)
+			} else {
+				g.Reset(uint64(g.Size()))
+			}
+		}
+		if key, offset, ok := hi.seekInFile(g); ok {
 			heap.Push(&hi.h, &ReconItem{g: g, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
 			hi.hasNextInFiles = true
 		}
@@ -1731,6 +2103,7 @@ func (hc *HistoryContext) IterateChanged(fromTxNum, toTxNum int, asc order.By, l
 	}
 	hi.hc = hc
 	hi.compressVals = hc.h.compressVals
+	hi.taggedVals = hc.h.taggedVals()
 	hi.startTxNum = startTxNum
 	hi.endTxNum = endTxNum
 	binary.BigEndian.PutUint64(hi.startTxKey[:], startTxNum)
@@ -1748,6 +2121,7 @@ type HistoryChangesIter struct {
 	valsTable      string
 	idxKeysTable   string
 	indexTable     string
+	from, to       []byte
 	nextFileKey    []byte
 	nextDbKey      []byte
 	nextDbVal      []byte
@@ -1765,6 +2139,8 @@ type HistoryChangesIter struct {
 	hasNextInFiles bool
 	hasNextInDb    bool
 	compressVals   bool
+	taggedVals     bool
+	err            error // ErrHistoryPruned: returned by first Next
 
 	k, v []byte
 }
@@ -1780,6 +2156,36 @@ func (hi *HistoryChangesIter) Close() {
 	}
 }
 
+// seekInFile - skips keys of .ef file which are less than `hi.from` (without reading their values).
+// Returns false if there are no keys in [from, to) range.
+func (hi *HistoryChangesIter) seekInFile(g *compress.Getter) (key []byte, offset uint64, ok bool) {
+	if !g.HasNext() {
+		return nil, 0, false
+	}
+	key, offset = g.NextUncompressed()
+	for {
+		if hi.to != nil && bytes.Compare(key, hi.to) >= 0 {
+			return nil, 0, false
+		}
+		if hi.from == nil || bytes.Compare(key, hi.from) >= 0 {
+			return key, offset, true
+		}
+		if hi.compressVals {
+			g.Skip()
+		} else {
+			g.SkipUncompressed()
+		}
+		if !g.HasNext() {
+			return nil, 0, false
+		}
+		if hi.compressVals {
+			key, offset = g.Next(nil)
+		} else {
+			key, offset = g.NextUncompressed()
+		}
+	}
+}
+
 func (hi *HistoryChangesIter) advanceInFiles() {
 	hi.advFileCnt++
 	for hi.h.Len() > 0 {
@@ -1797,7 +2203,9 @@ func (hi *HistoryChangesIter) advanceInFiles() {
 			} else {
 				top.key, _ = top.g.NextUncompressed()
 			}
-			heap.Push(&hi.h, top)
+			if hi.to == nil || bytes.Compare(top.key, hi.to) < 0 {
+				heap.Push(&hi.h, top)
+			}
 		}
 
 		if bytes.Equal(key, hi.nextFileKey) {
@@ -1816,16 +2224,22 @@ func (hi *HistoryChangesIter) advanceInFiles() {
 		binary.BigEndian.PutUint64(hi.txnKey[:], n)
 		historyItem, ok := hi.hc.getFile(top.startTxNum, top.endTxNum)
 		if !ok {
-			panic(fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextFileKey))
+			hi.err = fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextFileKey)
+			return
+		}
+		reader, err := hi.hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
 		}
-		reader := hi.hc.statelessIdxReader(historyItem.i)
 		offset := reader.Lookup2(hi.txnKey[:], hi.nextFileKey)
-		g := hi.hc.statelessGetter(historyItem.i)
-		g.Reset(offset)
-		if hi.compressVals {
-			hi.nextFileVal, _ = g.Next(nil)
-		} else {
-			hi.nextFileVal, _ = g.NextUncompressed()
+		g, err := hi.hc.statelessGetter(historyItem.i)
+		if err != nil {
+			hi.err = err
+			return
+		}
+		if hi.nextFileVal, hi.err = historyVal(g, reader, historyItem.src.blobs, hi.nextFileKey, offset, hi.compressVals, hi.taggedVals, nil); hi.err != nil {
+			return
 		}
 		hi.nextFileKey = key
 		return
@@ -1846,7 +2260,7 @@ func (hi *HistoryChangesIter) advanceInDb() {
 			panic(err)
 		}
 
-		if k, _, err = hi.idxCursor.First(); err != nil {
+		if k, _, err = hi.idxCursor.Seek(hi.from); err != nil {
 			// TODO pass error properly around
 			panic(err)
 		}
@@ -1859,6 +2273,9 @@ func (hi *HistoryChangesIter) advanceInDb() {
 		if err != nil {
 			panic(err)
 		}
+		if hi.to != nil && bytes.Compare(k, hi.to) >= 0 {
+			break
+		}
 		foundTxNumVal, err := hi.idxCursor.SeekBothRange(k, hi.startTxKey[:])
 		if err != nil {
 			panic(err)
@@ -1927,10 +2344,13 @@ func (hi *HistoryChangesIter) advance() {
 }
 
 func (hi *HistoryChangesIter) HasNext() bool {
-	return hi.hasNextInFiles || hi.hasNextInDb || hi.nextKey != nil
+	return hi.err != nil || hi.hasNextInFiles || hi.hasNextInDb || hi.nextKey != nil
 }
 
 func (hi *HistoryChangesIter) Next() ([]byte, []byte, error) {
+	if hi.err != nil {
+		return nil, nil, hi.err
+	}
 	hi.k = append(hi.k[:0], hi.nextKey...)
 	hi.v = append(hi.v[:0], hi.nextVal...)
 	hi.advance()
@@ -2065,8 +2485,11 @@ func (hi *HistoryIterator2) Next() ([]byte, []byte, error) {
 
 func (h *History) DisableReadAhead() {
 	h.InvertedIndex.DisableReadAhead()
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.DisableReadAhead()
 			if item.index != nil {
 				item.index.DisableReadAhead()
@@ -2078,8 +2501,11 @@ func (h *History) DisableReadAhead() {
 
 func (h *History) EnableReadAhead() *History {
 	h.InvertedIndex.EnableReadAhead()
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableReadAhead()
 			if item.index != nil {
 				item.index.EnableReadAhead()
@@ -2091,8 +2517,11 @@ func (h *History) EnableReadAhead() *History {
 }
 func (h *History) EnableMadvWillNeed() *History {
 	h.InvertedIndex.EnableMadvWillNeed()
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableWillNeed()
 			if item.index != nil {
 				item.index.EnableWillNeed()
@@ -2104,8 +2533,11 @@ func (h *History) EnableMadvWillNeed() *History {
 }
 func (h *History) EnableMadvNormalReadAhead() *History {
 	h.InvertedIndex.EnableMadvNormalReadAhead()
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableMadvNormal()
 			if item.index != nil {
 				item.index.EnableMadvNormal()
@@ -2119,42 +2551,68 @@ func (h *History) EnableMadvNormalReadAhead() *History {
 // HistoryStep used for incremental state reconsitution, it isolates only one snapshot interval
 type HistoryStep struct {
 	compressVals bool
+	taggedVals   bool
 	indexItem    *filesItem
 	indexFile    ctxItem
 	historyItem  *filesItem
 	historyFile  ctxItem
+	seekIdx      []seekPoint // sparse index of keys of indexFile, built on first prefix iteration
 }
 
-// MakeSteps [0, toTxNum)
-func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
+// MakeSteps [0, toTxNum). Each step holds a reference (acquire) to its files, so they are not closed by
+// CloseIdleFiles nor removed by merge until HistoryStep.Close. Clones share references of the step they were made from.
+func (h *History) MakeSteps(toTxNum uint64) ([]*HistoryStep, error) {
 	var steps []*HistoryStep
-	h.InvertedIndex.files.Walk(func(items []*filesItem) bool {
+	var err error
+	h.InvertedIndex.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
+			if !item.hasIndex() || !item.frozen || item.startTxNum >= toTxNum {
 				continue
 			}
-
+			if !item.acquire() {
+				err = fmt.Errorf("MakeSteps: file %s is already removed", item.datPath)
+				return false
+			}
 			step := &HistoryStep{
 				compressVals: h.compressVals,
+				taggedVals:   h.taggedVals(),
 				indexItem:    item,
-				indexFile: ctxItem{
-					startTxNum: item.startTxNum,
-					endTxNum:   item.endTxNum,
-					getter:     item.decompressor.MakeGetter(),
-					reader:     recsplit.NewIndexReader(item.index),
-				},
 			}
 			steps = append(steps, step)
+			if err = item.open(); err != nil {
+				return false
+			}
+			step.indexFile = ctxItem{
+				startTxNum: item.startTxNum,
+				endTxNum:   item.endTxNum,
+				getter:     item.decompressor.MakeGetter(),
+				reader:     recsplit.NewIndexReader(item.index),
+			}
 		}
 		return true
 	})
+	if err != nil {
+		closeSteps(steps)
+		return nil, err
+	}
 	i := 0
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
+			if !item.hasIndex() || !item.frozen || item.startTxNum >= toTxNum {
 				continue
 			}
+			if i >= len(steps) {
+				err = fmt.Errorf("MakeSteps: more %s files than index files", h.filenameBase)
+				return false
+			}
+			if !item.acquire() {
+				err = fmt.Errorf("MakeSteps: file %s is already removed", item.datPath)
+				return false
+			}
 			steps[i].historyItem = item
+			if err = item.open(); err != nil {
+				return false
+			}
 			steps[i].historyFile = ctxItem{
 				startTxNum: item.startTxNum,
 				endTxNum:   item.endTxNum,
@@ -2165,12 +2623,35 @@ func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
 		}
 		return true
 	})
-	return steps
+	if err != nil {
+		closeSteps(steps)
+		return nil, err
+	}
+	return steps, nil
+}
+
+func closeSteps(steps []*HistoryStep) {
+	for _, step := range steps {
+		step.Close()
+	}
+}
+
+// Close - releases files of step made by MakeSteps. Clones of step must not be used after Close.
+func (hs *HistoryStep) Close() {
+	if hs.indexItem != nil {
+		hs.indexItem.release()
+		hs.indexItem = nil
+	}
+	if hs.historyItem != nil {
+		hs.historyItem.release()
+		hs.historyItem = nil
+	}
 }
 
 func (hs *HistoryStep) Clone() *HistoryStep {
 	return &HistoryStep{
 		compressVals: hs.compressVals,
+		taggedVals:   hs.taggedVals,
 		indexItem:    hs.indexItem,
 		indexFile: ctxItem{
 			startTxNum: hs.indexFile.startTxNum,
@@ -2185,9 +2666,55 @@ func (hs *HistoryStep) Clone() *HistoryStep {
 			getter:     hs.historyItem.decompressor.MakeGetter(),
 			reader:     recsplit.NewIndexReader(hs.historyItem.index),
 		},
+		seekIdx: hs.seekIdx,
 	}
 }
 
+// historyStepReader - reader of HistoryStep owned by one worker: has own getters and readers over shared mmap of files,
+// reuses elias-fano and buffers between lookups. GetNoState doesn't allocate, returned value is valid until next call.
+type historyStepReader struct {
+	hs     *HistoryStep
+	ef     eliasfano32.EliasFano
+	txKey  [8]byte
+	valBuf []byte
+}
+
+func (hs *HistoryStep) makeReader() *historyStepReader {
+	return &historyStepReader{hs: hs.Clone()}
+}
+
+// GetNoState - same as HistoryStep.GetNoState
+func (r *historyStepReader) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint64, error) {
+	hs := r.hs
+	if hs.indexFile.reader.Empty() {
+		return nil, false, txNum, nil
+	}
+	offset := hs.indexFile.reader.Lookup(key)
+	g := hs.indexFile.getter
+	g.Reset(offset)
+	k, _ := g.NextUncompressed()
+	if !bytes.Equal(k, key) {
+		return nil, false, txNum, nil
+	}
+	eliasVal, _ := g.NextUncompressed()
+	r.ef.Reset(eliasVal)
+	n, ok := r.ef.Search(txNum)
+	if !ok {
+		return nil, false, r.ef.Max(), nil
+	}
+	binary.BigEndian.PutUint64(r.txKey[:], n)
+	offset = hs.historyFile.reader.Lookup2(r.txKey[:], key)
+	g = hs.historyFile.getter
+	v, err := historyVal(g, hs.historyFile.reader, hs.historyItem.blobs, key, offset, hs.compressVals, hs.taggedVals, r.valBuf)
+	if err != nil {
+		return nil, false, txNum, err
+	}
+	if hs.compressVals {
+		r.valBuf = v
+	}
+	return v, true, txNum, nil
+}
+
 func u64or0(in []byte) (v uint64) {
 	if len(in) > 0 {
 		v = binary.BigEndian.Uint64(in)
@@ -2195,7 +2722,12 @@ func u64or0(in []byte) (v uint64) {
 	return v
 }
 
-func (h *History) CleanupDir() {
+func (h *History) CleanupDir() { h.cleanupDir(nil) }
+
+// cleanupDir - files for which `keep` returns true stay on disk
+func (h *History) cleanupDir(keep func(f *filesItem) bool) {
+	// first: .ef files are scanned only if .v exists
+	h.InvertedIndex.cleanupDir(keep)
 	files, err := os.ReadDir(h.dir)
 	if err != nil {
 		log.Warn("[clean] can't read dir", "err", err, "dir", h.dir)
@@ -2203,12 +2735,19 @@ func (h *History) CleanupDir() {
 	}
 	uselessFiles := h.scanStateFiles(files, h.integrityFileExtensions)
 	for _, f := range uselessFiles {
+		if keep != nil && keep(f) {
+			continue
+		}
 		fName := fmt.Sprintf("%s.%d-%d.v", h.filenameBase, f.startTxNum/h.aggregationStep, f.endTxNum/h.aggregationStep)
-		err = os.Remove(filepath.Join(h.dir, fName))
+		err = removeDataFile(filepath.Join(h.dir, fName))
 		log.Debug("[clean] remove", "file", fName, "err", err)
+		removeFileStats(filepath.Join(h.dir, fName))
 		fIdxName := fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, f.startTxNum/h.aggregationStep, f.endTxNum/h.aggregationStep)
 		err = os.Remove(filepath.Join(h.dir, fIdxName))
 		log.Debug("[clean] remove", "file", fName, "err", err)
+		blobsPath, blobsIdxPath := h.blobsPaths(f.startTxNum/h.aggregationStep, f.endTxNum/h.aggregationStep)
+		_ = os.Remove(blobsPath)
+		_ = os.Remove(blobsIdxPath)
 	}
-	h.InvertedIndex.CleanupDir()
+	removeOrphanContentFiles(h.dir, h.filenameBase)
 }
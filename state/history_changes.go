@@ -0,0 +1,262 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// ChangesOrder - order of HistoryChangesStream
+type ChangesOrder uint8
+
+const (
+	ChangesByKey   ChangesOrder = iota // (key, txNum)
+	ChangesByTxNum                     // (txNum, key)
+)
+
+type historyChange struct {
+	key   []byte
+	txNum uint64
+}
+
+// HistoryChangesStream - changes of history as (key, txNum, value before txNum), ascending.
+//   - ChangesByKey: changed keys and their txNums are merged from files and DB (as IterateChangedKeys, IterateRange)
+//   - ChangesByTxNum: files are read one by one (keys of file within range are sorted by txNum in RAM), then
+//     txNum->key DB table is scanned
+//
+// k, v returned by Next are valid until next call of Next.
+type HistoryChangesStream struct {
+	hc       *HistoryContext
+	roTx     kv.Tx
+	from, to uint64
+	prefix   []byte
+	orderBy  ChangesOrder
+
+	// ChangesByKey
+	keys      InvertedIterator1
+	txNums    *InvertedIterator
+	key       []byte
+	lastTxNum uint64
+	hasLast   bool
+
+	// ChangesByTxNum
+	fileI    int
+	filesEnd uint64
+	buf      []historyChange
+	bufI     int
+	cursor   kv.CursorDupSort
+
+	nextK, nextV []byte
+	nextTxNum    uint64
+	hasNext      bool
+	err          error
+}
+
+// IterateChangesOrdered - changes of keys with `prefix` (nil - all keys) in [fromTxNum, toTxNum), see HistoryChangesStream
+func (hc *HistoryContext) IterateChangesOrdered(fromTxNum, toTxNum uint64, prefix []byte, orderBy ChangesOrder, roTx kv.Tx) (*HistoryChangesStream, error) {
+	if err := hc.h.checkHistoryHorizon(fromTxNum); err != nil {
+		return nil, err
+	}
+	it := &HistoryChangesStream{hc: hc, roTx: roTx, from: fromTxNum, to: toTxNum, prefix: prefix, orderBy: orderBy}
+	if orderBy == ChangesByKey {
+		it.keys = hc.ic.IterateChangedKeys(fromTxNum, toTxNum, roTx)
+	} else {
+		for _, item := range hc.ic.files {
+			if item.endTxNum > it.filesEnd {
+				it.filesEnd = item.endTxNum
+			}
+		}
+	}
+	it.advance()
+	return it, nil
+}
+
+func (it *HistoryChangesStream) HasNext() bool { return it.err != nil || it.hasNext }
+
+func (it *HistoryChangesStream) Next() (k []byte, txNum uint64, v []byte, err error) {
+	if it.err != nil {
+		return nil, 0, nil, it.err
+	}
+	k, txNum, v = it.nextK, it.nextTxNum, it.nextV
+	it.advance()
+	return k, txNum, v, nil
+}
+
+func (it *HistoryChangesStream) Close() {
+	if it.txNums != nil {
+		it.txNums.Close()
+		it.txNums = nil
+	}
+	if it.cursor != nil {
+		it.cursor.Close()
+		it.cursor = nil
+	}
+	it.keys.Close()
+}
+
+func (it *HistoryChangesStream) advance() {
+	if it.orderBy == ChangesByKey {
+		it.err = it.advanceByKey()
+	} else {
+		it.err = it.advanceByTxNum()
+	}
+}
+
+func (it *HistoryChangesStream) setNext(k []byte, txNum uint64) (err error) {
+	it.nextK, it.nextTxNum, it.hasNext = k, txNum, true
+	it.nextV, _, err = it.hc.GetNoStateWithRecent(k, txNum, it.roTx)
+	return err
+}
+
+func (it *HistoryChangesStream) advanceByKey() error {
+	for {
+		if it.txNums != nil {
+			for it.txNums.HasNext() {
+				txNum := it.txNums.next()
+				if it.hasLast && txNum <= it.lastTxNum { // not pruned yet recent history overlaps files
+					continue
+				}
+				it.lastTxNum, it.hasLast = txNum, true
+				return it.setNext(it.key, txNum)
+			}
+			it.txNums.Close()
+			it.txNums = nil
+		}
+		if !it.keys.HasNext() {
+			it.hasNext = false
+			return it.keys.Err()
+		}
+		it.key = it.keys.Next(nil) // not re-used: referenced by returned k
+		if !bytes.HasPrefix(it.key, it.prefix) {
+			if bytes.Compare(it.key, it.prefix) > 0 {
+				it.hasNext = false
+				return nil
+			}
+			continue
+		}
+		var err error
+		if it.txNums, err = it.hc.ic.IterateRange(it.key, int(it.from), int(it.to), order.Asc, -1, it.roTx); err != nil {
+			return err
+		}
+		it.hasLast = false
+	}
+}
+
+func (it *HistoryChangesStream) advanceByTxNum() (err error) {
+	for {
+		if it.bufI < len(it.buf) {
+			c := it.buf[it.bufI]
+			it.bufI++
+			return it.setNext(c.key, c.txNum)
+		}
+		if it.fileI < len(it.hc.ic.files) {
+			if err = it.loadFile(it.hc.ic.files[it.fileI]); err != nil {
+				return err
+			}
+			it.fileI++
+			continue
+		}
+		var k, v []byte
+		if it.cursor == nil {
+			if it.cursor, err = it.roTx.CursorDupSort(it.hc.h.indexKeysTable); err != nil {
+				return err
+			}
+			var txKey [8]byte
+			from := it.from
+			if from < it.filesEnd { // not pruned yet recent history overlaps files
+				from = it.filesEnd
+			}
+			binary.BigEndian.PutUint64(txKey[:], from)
+			k, v, err = it.cursor.Seek(txKey[:])
+		} else {
+			k, v, err = it.cursor.Next()
+		}
+		if err != nil {
+			return err
+		}
+		if k == nil || binary.BigEndian.Uint64(k) >= it.to {
+			it.hasNext = false
+			return nil
+		}
+		key := v[:len(v)-8]
+		if !bytes.HasPrefix(key, it.prefix) {
+			continue
+		}
+		it.nextK, it.nextTxNum, it.hasNext = common.Copy(key), binary.BigEndian.Uint64(k), true
+		if binary.BigEndian.Uint64(v[len(v)-8:]) == 0 {
+			it.nextV = nil
+			return nil
+		}
+		if it.nextV, err = it.roTx.GetOne(it.hc.h.historyValsTable, v[len(v)-8:]); err != nil {
+			return err
+		}
+		it.nextV = common.Copy(it.nextV)
+		return nil
+	}
+}
+
+// loadFile - changes of file within range, sorted by (txNum, key)
+func (it *HistoryChangesStream) loadFile(item ctxItem) error {
+	it.buf, it.bufI = it.buf[:0], 0
+	if item.endTxNum <= it.from || item.startTxNum >= it.to {
+		return nil
+	}
+	if err := item.src.open(); err != nil {
+		return err
+	}
+	g := item.src.decompressor.MakeGetter()
+	for g.HasNext() {
+		key, _ := g.NextUncompressed()
+		if !g.HasNext() {
+			break
+		}
+		if !bytes.HasPrefix(key, it.prefix) {
+			if bytes.Compare(key, it.prefix) > 0 {
+				break
+			}
+			g.SkipUncompressed()
+			continue
+		}
+		key = common.Copy(key)
+		val, _ := g.NextUncompressed()
+		ef, _ := eliasfano32.ReadEliasFano(val)
+		for efi := ef.Iterator(); efi.HasNext(); {
+			txNum, _ := efi.Next()
+			if txNum < it.from {
+				continue
+			}
+			if txNum >= it.to {
+				break
+			}
+			it.buf = append(it.buf, historyChange{key: key, txNum: txNum})
+		}
+	}
+	sort.Slice(it.buf, func(i, j int) bool {
+		if it.buf[i].txNum != it.buf[j].txNum {
+			return it.buf[i].txNum < it.buf[j].txNum
+		}
+		return bytes.Compare(it.buf[i].key, it.buf[j].key) < 0
+	})
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/kv/temporal/historyv2"
+)
+
+// ChangesetReader - read API of legacy (block-based) history: changesets kv.AccountChangeSet/kv.StorageChangeSet
+// and their indices, see historyv2. Allows code written against legacy storage mode to migrate to AggregatorV3
+// incrementally: NewChangesetReader picks backing store at runtime.
+//
+// Keys have legacy layout: account - address, storage - address+incarnation+location.
+// Values are returned as written by application (AggregatorV3 doesn't re-encode them).
+type ChangesetReader interface {
+	// FindByHistory - value of key as of beginning of block `blockNum`, see historyv2.FindByHistory.
+	// ok=false - key wasn't changed since `blockNum`: caller must read latest state.
+	FindByHistory(storage bool, key []byte, blockNum uint64) (v []byte, ok bool, err error)
+	// ForEachChange - changes of blocks [fromBlock; toBlock) in order of blocks and keys: key and its value before block
+	ForEachChange(storage bool, fromBlock, toBlock uint64, walker func(blockN uint64, k, v []byte) error) error
+	// AvailableFrom - first block with history, math.MaxUint64 if there is no history
+	AvailableFrom(storage bool) (uint64, error)
+}
+
+// aggCtxProvider - implemented by temporal transactions (see kv/temporal.Tx)
+type aggCtxProvider interface {
+	AggCtx() *AggregatorV3Context
+}
+
+// NewChangesetReader - backed by AggregatorV3 if `tx` is temporal and aggregator has history (or legacy changesets
+// are empty), by legacy changesets otherwise
+func NewChangesetReader(tx kv.Tx) (ChangesetReader, error) {
+	legacy := &legacyChangesetReader{tx: tx}
+	p, ok := tx.(aggCtxProvider)
+	if !ok || p.AggCtx() == nil {
+		return legacy, nil
+	}
+	agg := &aggChangesetReader{tx: tx, ac: p.AggCtx()}
+	from, err := agg.AvailableFrom(false)
+	if err != nil {
+		return nil, err
+	}
+	if from != math.MaxUint64 {
+		return agg, nil
+	}
+	if from, err = legacy.AvailableFrom(false); err != nil {
+		return nil, err
+	}
+	if from != math.MaxUint64 {
+		return legacy, nil
+	}
+	return agg, nil
+}
+
+type legacyChangesetReader struct {
+	tx kv.Tx
+}
+
+func changeSetTable(storage bool) string {
+	if storage {
+		return kv.StorageChangeSet
+	}
+	return kv.AccountChangeSet
+}
+
+func (r *legacyChangesetReader) FindByHistory(storage bool, key []byte, blockNum uint64) ([]byte, bool, error) {
+	table := changeSetTable(storage)
+	indexC, err := r.tx.Cursor(historyv2.Mapper[table].IndexBucket)
+	if err != nil {
+		return nil, false, err
+	}
+	defer indexC.Close()
+	changesC, err := r.tx.CursorDupSort(table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer changesC.Close()
+	return historyv2.FindByHistory(indexC, changesC, storage, key, blockNum)
+}
+
+func (r *legacyChangesetReader) ForEachChange(storage bool, fromBlock, toBlock uint64, walker func(blockN uint64, k, v []byte) error) error {
+	table := changeSetTable(storage)
+	c, err := r.tx.Cursor(table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	decode := historyv2.Mapper[table].Decode
+	for k, v, err := c.Seek(hexutility.EncodeTs(fromBlock)); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		blockN, k, v, err := decode(k, v)
+		if err != nil {
+			return err
+		}
+		if blockN >= toBlock {
+			break
+		}
+		if err = walker(blockN, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *legacyChangesetReader) AvailableFrom(storage bool) (uint64, error) {
+	if storage {
+		return historyv2.AvailableStorageFrom(r.tx)
+	}
+	return historyv2.AvailableFrom(r.tx)
+}
+
+// aggChangesetReader - blocks are mapped to txNums by rawdbv3.TxNums. AggregatorV3 has no incarnations: storage keys
+// of changes have firstContractIncarnation, incarnation of requested key is ignored.
+type aggChangesetReader struct {
+	tx kv.Tx
+	ac *AggregatorV3Context
+}
+
+const firstContractIncarnation = 1
+
+func (r *aggChangesetReader) historyContext(storage bool) *HistoryContext {
+	if storage {
+		return r.ac.storage
+	}
+	return r.ac.accounts
+}
+
+func (r *aggChangesetReader) FindByHistory(storage bool, key []byte, blockNum uint64) ([]byte, bool, error) {
+	txNum, err := rawdbv3.TxNums.Min(r.tx, blockNum)
+	if err != nil {
+		return nil, false, err
+	}
+	if !storage {
+		return r.ac.ReadAccountDataNoStateWithRecent(key, txNum, r.tx)
+	}
+	if len(key) != length.Addr+length.Incarnation+length.Hash {
+		return nil, false, fmt.Errorf("FindByHistory: unexpected storage key length %d", len(key))
+	}
+	return r.ac.ReadAccountStorageNoStateWithRecent(key[:length.Addr], key[length.Addr+length.Incarnation:], txNum, r.tx)
+}
+
+// ForEachChange - AggregatorV3 history is not grouped by blocks: iterates changes of each block separately
+func (r *aggChangesetReader) ForEachChange(storage bool, fromBlock, toBlock uint64, walker func(blockN uint64, k, v []byte) error) error {
+	hc := r.historyContext(storage)
+	var legacyKey []byte
+	for blockN := fromBlock; blockN < toBlock; blockN++ {
+		txFrom, err := rawdbv3.TxNums.Min(r.tx, blockN)
+		if err != nil {
+			return err
+		}
+		txTo, err := rawdbv3.TxNums.Max(r.tx, blockN)
+		if err != nil {
+			return err
+		}
+		if txFrom > txTo { // after last block
+			break
+		}
+		if err = func() error {
+			it := hc.IterateChanged(int(txFrom), int(txTo+1), nil, nil, order.Asc, -1, r.tx)
+			defer it.Close()
+			for it.HasNext() {
+				k, v, err := it.Next()
+				if err != nil {
+					return err
+				}
+				if storage {
+					legacyKey = append(append(append(legacyKey[:0], k[:length.Addr]...), hexutility.EncodeTs(firstContractIncarnation)...), k[length.Addr:]...)
+					k = legacyKey
+				}
+				if err = walker(blockN, k, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *aggChangesetReader) AvailableFrom(storage bool) (uint64, error) {
+	hc := r.historyContext(storage)
+	var txNum uint64
+	if len(hc.ic.files) > 0 {
+		txNum = hc.ic.files[0].startTxNum
+	} else {
+		c, err := r.tx.CursorDupSort(hc.h.indexKeysTable)
+		if err != nil {
+			return math.MaxUint64, err
+		}
+		k, _, err := c.First()
+		c.Close()
+		if err != nil || k == nil {
+			return math.MaxUint64, err
+		}
+		txNum = binary.BigEndian.Uint64(k)
+	}
+	if horizon := hc.h.HistoryHorizon(); txNum < horizon {
+		txNum = horizon
+	}
+	ok, blockNum, err := rawdbv3.TxNums.FindBlockNum(r.tx, txNum)
+	if err != nil || !ok {
+		return math.MaxUint64, err
+	}
+	minTxNum, err := rawdbv3.TxNums.Min(r.tx, blockNum)
+	if err != nil {
+		return math.MaxUint64, err
+	}
+	if minTxNum < txNum { // history of block is incomplete
+		blockNum++
+	}
+	return blockNum, nil
+}
@@ -0,0 +1,192 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/kv/temporal/historyv2"
+)
+
+type testTemporalTx struct {
+	kv.Tx
+	ac *AggregatorV3Context
+}
+
+func (tx testTemporalTx) AggCtx() *AggregatorV3Context { return tx.ac }
+
+func collectChanges(t *testing.T, r ChangesetReader, storage bool) (res []string) {
+	t.Helper()
+	require.NoError(t, r.ForEachChange(storage, 0, 100, func(blockN uint64, k, v []byte) error {
+		res = append(res, fmt.Sprintf("%d:%x=%s", blockN, k, v))
+		return nil
+	}))
+	return res
+}
+
+func TestChangesetReader(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+	addr[0], loc[0] = 1, 2
+	storageKey := append(append(append([]byte{}, addr...), hexutility.EncodeTs(firstContractIncarnation)...), loc...)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	for blockNum := uint64(0); blockNum < 4; blockNum++ {
+		require.NoError(rawdbv3.TxNums.Append(tx, blockNum, blockNum*10+9))
+	}
+
+	// legacy changesets
+	cs := historyv2.NewAccountChangeSet()
+	require.NoError(cs.Add(addr, []byte("legacy")))
+	require.NoError(historyv2.EncodeAccounts(2, cs, func(k, v []byte) error { return tx.Put(kv.AccountChangeSet, k, v) }))
+	r, err := NewChangesetReader(tx)
+	require.NoError(err)
+	require.IsType(&legacyChangesetReader{}, r)
+	from, err := r.AvailableFrom(false)
+	require.NoError(err)
+	require.Equal(uint64(2), from)
+	require.Equal([]string{fmt.Sprintf("2:%x=legacy", addr)}, collectChanges(t, r, false))
+
+	// temporal tx without history in aggregator: legacy changesets are used
+	ac := agg.MakeContext()
+	defer ac.Close()
+	r, err = NewChangesetReader(testTemporalTx{Tx: tx, ac: ac})
+	require.NoError(err)
+	require.IsType(&legacyChangesetReader{}, r)
+
+	agg.SetTx(tx)
+	agg.StartWrites()
+	agg.SetTxNum(10)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v0")))
+	require.NoError(agg.AddStoragePrev(addr, loc, []byte("s0")))
+	agg.SetTxNum(25)
+	require.NoError(agg.AddAccountPrev(addr, []byte("v1")))
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+
+	r, err = NewChangesetReader(testTemporalTx{Tx: tx, ac: ac})
+	require.NoError(err)
+	require.IsType(&aggChangesetReader{}, r)
+	from, err = r.AvailableFrom(false)
+	require.NoError(err)
+	require.Equal(uint64(1), from)
+
+	for _, tt := range []struct {
+		blockNum uint64
+		v        string
+		ok       bool
+	}{{0, "v0", true}, {1, "v0", true}, {2, "v1", true}, {3, "", false}} {
+		v, ok, err := r.FindByHistory(false, addr, tt.blockNum)
+		require.NoError(err)
+		require.Equal(tt.ok, ok, tt.blockNum)
+		require.Equal(tt.v, string(v), tt.blockNum)
+	}
+	v, ok, err := r.FindByHistory(true, storageKey, 1)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal("s0", string(v))
+	_, _, err = r.FindByHistory(true, addr, 1)
+	require.Error(err)
+
+	require.Equal([]string{fmt.Sprintf("1:%x=v0", addr), fmt.Sprintf("2:%x=v1", addr)}, collectChanges(t, r, false))
+	require.Equal([]string{fmt.Sprintf("1:%x=s0", storageKey)}, collectChanges(t, r, true))
+}
+
+func TestImportChangesets(t *testing.T) {
+	ctx := context.Background()
+	_, db, agg := testDbAndAggregatorV3(t, 16)
+	require := require.New(t)
+
+	addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+	addr[0], loc[0] = 1, 2
+	storageKey := append(append(append([]byte{}, addr...), hexutility.EncodeTs(7)...), loc...)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	for blockNum := uint64(0); blockNum < 6; blockNum++ {
+		require.NoError(rawdbv3.TxNums.Append(tx, blockNum, blockNum*10+9))
+	}
+	for _, blockNum := range []uint64{1, 2, 5} {
+		cs := historyv2.NewAccountChangeSet()
+		require.NoError(cs.Add(addr, []byte(fmt.Sprintf("acc%d", blockNum))))
+		require.NoError(historyv2.EncodeAccounts(blockNum, cs, func(k, v []byte) error { return tx.Put(kv.AccountChangeSet, k, v) }))
+	}
+	cs := historyv2.NewStorageChangeSet()
+	require.NoError(cs.Add(storageKey, []byte("st")))
+	require.NoError(historyv2.EncodeStorage(3, cs, func(k, v []byte) error { return tx.Put(kv.StorageChangeSet, k, v) }))
+
+	legacy, err := NewChangesetReader(tx)
+	require.NoError(err)
+	_, err = agg.ImportChangesets(ctx, tx, legacy, 0, 7)
+	require.ErrorContains(err, "no txNums of block 6")
+	res, err := agg.ImportChangesets(ctx, tx, legacy, 0, 6)
+	require.NoError(err)
+	require.Equal(ChangesetImportResult{Blocks: 6, AccountChanges: 3, StorageChanges: 1, ToTxNum: 60}, res)
+	require.NoError(tx.Commit())
+
+	check := func() {
+		t.Helper()
+		roTx, err := db.BeginRo(ctx)
+		require.NoError(err)
+		defer roTx.Rollback()
+		ac := agg.MakeContext()
+		defer ac.Close()
+		r, err := NewChangesetReader(testTemporalTx{Tx: roTx, ac: ac})
+		require.NoError(err)
+		require.IsType(&aggChangesetReader{}, r)
+		for blockNum, want := range []string{"acc1", "acc1", "acc2", "acc5", "acc5", "acc5"} {
+			v, ok, err := r.FindByHistory(false, addr, uint64(blockNum))
+			require.NoError(err)
+			require.True(ok, blockNum)
+			require.Equal(want, string(v), blockNum)
+		}
+		v, ok, err := r.FindByHistory(true, storageKey, 2)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal("st", string(v))
+		require.Equal([]string{fmt.Sprintf("1:%x=acc1", addr), fmt.Sprintf("2:%x=acc2", addr), fmt.Sprintf("5:%x=acc5", addr)}, collectChanges(t, r, false))
+	}
+	check()
+
+	// imported history is built into files by usual path
+	_, err = agg.Freeze(ctx, 32)
+	require.NoError(err)
+	require.Equal(uint64(32), agg.EndTxNumMinimax())
+	check()
+
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	legacy, err = NewChangesetReader(tx)
+	require.NoError(err)
+	_, err = agg.ImportChangesets(ctx, tx, legacy, 1, 2)
+	require.ErrorContains(err, "covered by files")
+}
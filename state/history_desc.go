@@ -0,0 +1,157 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+// descChunk - files without .efbt are walked backward by chunks of this amount of keys. Variable for tests.
+var descChunk = 512
+
+// descFileIter - keys of .ef file in range (to, from] in descending order, see HistoryContext.WalkAsOf.
+// With .efbt keys are read by ordinals: constant memory. Without it file is walked forward once to remember offset
+// of each descChunk-th key, then chunks are read forward one by one from the end: memory is 8 bytes per chunk plus one chunk.
+// Words of .ef files are uncompressed.
+type descFileIter struct {
+	g                    *compress.Getter
+	bt                   *BtIndex
+	startTxNum, endTxNum uint64
+	to                   []byte
+
+	ord uint64 // with bt: ordinal of current key + 1, 0 - no more keys
+
+	chunks    []uint64    // without bt: offsets of first key of chunks not read yet
+	lastChunk int         // amount of keys in range in last chunk of `chunks`
+	chunk     []descEntry // keys of current chunk, consumed from the end
+
+	key       []byte
+	valOffset uint64 // position of value of `key`
+}
+
+type descEntry struct {
+	key       []byte
+	valOffset uint64
+}
+
+func newDescFileIter(g *compress.Getter, bt *BtIndex, startTxNum, endTxNum uint64, from, to []byte) *descFileIter {
+	it := &descFileIter{g: g, bt: bt, startTxNum: startTxNum, endTxNum: endTxNum, to: to}
+	if bt == nil {
+		it.collectChunks(from)
+		return it
+	}
+	it.ord = bt.KeyCount()
+	if from != nil {
+		if it.ord = bt.Seek(g, from); it.ord < bt.KeyCount() {
+			if key, _ := it.keyAt(it.ord); bytes.Equal(key, from) {
+				it.ord++ // `from` is included
+			}
+		}
+	}
+	return it
+}
+
+func (it *descFileIter) keyAt(ord uint64) ([]byte, uint64) {
+	it.g.Reset(it.bt.Offset(ord))
+	return it.g.NextUncompressed()
+}
+
+// collectChunks - offsets of chunks of keys <= from
+func (it *descFileIter) collectChunks(from []byte) {
+	it.g.Reset(0)
+	var offset uint64
+	for n := 0; it.g.HasNext(); n++ {
+		key, _ := it.g.NextUncompressed()
+		if from != nil && bytes.Compare(key, from) > 0 {
+			break
+		}
+		if n%descChunk == 0 {
+			it.chunks = append(it.chunks, offset)
+		}
+		it.lastChunk = n%descChunk + 1
+		offset = it.g.SkipUncompressed()
+	}
+}
+
+// loadChunk - reads last chunk of `chunks`, buffers of keys are re-used
+func (it *descFileIter) loadChunk() bool {
+	if len(it.chunks) == 0 {
+		return false
+	}
+	offset, n := it.chunks[len(it.chunks)-1], it.lastChunk
+	it.chunks, it.lastChunk = it.chunks[:len(it.chunks)-1], descChunk
+	if it.chunk == nil {
+		it.chunk = make([]descEntry, 0, descChunk)
+	}
+	it.chunk = it.chunk[:n]
+	it.g.Reset(offset)
+	for i := range it.chunk {
+		key, valOffset := it.g.NextUncompressed()
+		it.chunk[i].key, it.chunk[i].valOffset = append(it.chunk[i].key[:0], key...), valOffset
+		it.g.SkipUncompressed()
+	}
+	return true
+}
+
+// next - moves to previous key in range, false if there is no such key
+func (it *descFileIter) next() bool {
+	if it.bt != nil {
+		if it.ord == 0 {
+			return false
+		}
+		it.ord--
+		it.key, it.valOffset = it.keyAt(it.ord)
+	} else {
+		if len(it.chunk) == 0 && !it.loadChunk() {
+			return false
+		}
+		e := it.chunk[len(it.chunk)-1]
+		it.chunk = it.chunk[:len(it.chunk)-1]
+		it.key, it.valOffset = e.key, e.valOffset
+	}
+	return it.to == nil || bytes.Compare(it.key, it.to) > 0
+}
+
+// value - word of current key
+func (it *descFileIter) value() []byte {
+	it.g.Reset(it.valOffset)
+	v, _ := it.g.NextUncompressed()
+	return v
+}
+
+// descHeap - by key desc, for same key - older file first (same as ReconHeap)
+type descHeap []*descFileIter
+
+func (h descHeap) Len() int { return len(h) }
+func (h descHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].key, h[j].key); c != 0 {
+		return c > 0
+	}
+	return h[i].endTxNum < h[j].endTxNum
+}
+func (h descHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *descHeap) Push(x interface{}) { *h = append(*h, x.(*descFileIter)) }
+func (h *descHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
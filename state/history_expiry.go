@@ -0,0 +1,380 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// ErrHistoryPruned - requested txNum is below history horizon: data was permanently removed by ExpireHistory,
+// so "not found" can't be distinguished from "removed".
+var ErrHistoryPruned = errors.New("history is pruned")
+
+// History horizon is persisted in `<filenameBase>.expiry` file (8 bytes BigEndian txNum) next to data files.
+func (ii *InvertedIndex) horizonPath() string {
+	return filepath.Join(ii.dir, ii.filenameBase+".expiry")
+}
+
+func (ii *InvertedIndex) loadHistoryHorizon() error {
+	v, err := os.ReadFile(ii.horizonPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			ii.historyHorizon.Store(0)
+			return nil
+		}
+		return err
+	}
+	if len(v) != 8 {
+		return fmt.Errorf("%s: invalid history horizon file len %d", ii.filenameBase, len(v))
+	}
+	ii.historyHorizon.Store(binary.BigEndian.Uint64(v))
+	return nil
+}
+
+func (ii *InvertedIndex) saveHistoryHorizon(txNum uint64) error {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], txNum)
+	tmpPath := ii.horizonPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, v[:], 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, ii.horizonPath()); err != nil {
+		return err
+	}
+	ii.historyHorizon.Store(txNum)
+	return nil
+}
+
+// HistoryHorizon - txNums below it were removed by ExpireHistory. 0 - nothing removed.
+func (ii *InvertedIndex) HistoryHorizon() uint64 { return ii.historyHorizon.Load() }
+
+func (ii *InvertedIndex) checkHistoryHorizon(txNum uint64) error {
+	if horizon := ii.historyHorizon.Load(); txNum < horizon {
+		return fmt.Errorf("%w: %s txNum=%d, horizon=%d", ErrHistoryPruned, ii.filenameBase, txNum, horizon)
+	}
+	return nil
+}
+
+// nextHistoryHorizon - horizonTxNum rounded down to aggregation step and limited by end of files.
+// Data in DB is not expired - it's pruned by regular `prune` after files build. Horizon never moves back.
+func (ii *InvertedIndex) nextHistoryHorizon(horizonTxNum uint64, files []ctxItem) (uint64, bool) {
+	var filesEnd uint64
+	if len(files) > 0 {
+		filesEnd = files[len(files)-1].endTxNum
+	}
+	if horizonTxNum > filesEnd {
+		horizonTxNum = filesEnd
+	}
+	horizonTxNum = (horizonTxNum / ii.aggregationStep) * ii.aggregationStep
+	current := ii.historyHorizon.Load()
+	if horizonTxNum == current && horizonTxNum > 0 {
+		// horizon is persisted before files are replaced: finish expiry interrupted by crash
+		for _, item := range files {
+			if item.startTxNum < horizonTxNum {
+				return horizonTxNum, true
+			}
+		}
+	}
+	return horizonTxNum, horizonTxNum > current
+}
+
+// isExpiredFile - file is left by ExpireHistory (removal is lazy and may be interrupted): it's fully below horizon,
+// or contains horizon and its truncated replacement [horizon, endTxNum) is already built. Such files are not opened.
+func (ii *InvertedIndex) isExpiredFile(ext string, startTxNum, endTxNum uint64) bool {
+	horizon := ii.historyHorizon.Load()
+	if startTxNum >= horizon {
+		return false
+	}
+	if endTxNum <= horizon {
+		return true
+	}
+	replacement := fmt.Sprintf("%s.%d-%d.%s", ii.filenameBase, horizon/ii.aggregationStep, endTxNum/ii.aggregationStep, ext)
+	return fileOrStubExist(filepath.Join(ii.dir, replacement))
+}
+
+// expiredFiles - `outs`: files which must be removed, `boundary`: visible file which contains horizon (it's also in `outs`).
+func expiredFiles(files *btree2.BTreeG[*filesItem], visible []ctxItem, horizonTxNum uint64) (outs []*filesItem, boundary *filesItem) {
+	for _, item := range visible {
+		if item.startTxNum < horizonTxNum && item.endTxNum > horizonTxNum {
+			boundary = item.src
+		}
+	}
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum <= horizonTxNum || (item.startTxNum < horizonTxNum && item.endTxNum > horizonTxNum) {
+				outs = append(outs, item)
+			}
+		}
+		return true
+	})
+	return outs, boundary
+}
+
+// integrateExpiredFiles - files which are not used by any context are removed right away,
+// others - by Close of last context (see filesItem.markDeleted).
+func integrateExpiredFiles(files *btree2.BTreeG[*filesItem], outs []*filesItem, in *filesItem) {
+	for _, out := range outs {
+		files.Delete(out)
+	}
+	if in != nil {
+		files.Set(in)
+	}
+	for _, out := range outs {
+		out.markDeleted()
+	}
+}
+
+// ExpireHistory - permanently removes data older than horizonTxNum (rounded down to aggregation step) for partial-archive nodes:
+// files fully below horizon are deleted, file which contains horizon is replaced by file [horizon, end) with only txNums >= horizon.
+// Horizon is persisted before any file is touched: reads below it return ErrHistoryPruned.
+// Only files are expired, horizon is limited by end of files.
+// Replacement of boundary file is not aligned to merge ranges: merges never extend below horizon (see findMergeRange).
+func (ii *InvertedIndex) ExpireHistory(ctx context.Context, horizonTxNum uint64) error {
+	ic := ii.MakeContext()
+	defer ic.Close()
+	horizonTxNum, ok := ii.nextHistoryHorizon(horizonTxNum, ic.files)
+	if !ok {
+		return nil
+	}
+	if err := ii.saveHistoryHorizon(horizonTxNum); err != nil {
+		return fmt.Errorf("save %s history horizon: %w", ii.filenameBase, err)
+	}
+	outs, boundary := expiredFiles(ii.files.Load(), ic.files, horizonTxNum)
+	var in *filesItem
+	if boundary != nil {
+		var err error
+		if in, err = ii.truncateFile(ctx, boundary, horizonTxNum); err != nil {
+			return err
+		}
+	}
+	integrateExpiredFiles(ii.files.Load(), outs, in)
+	ii.reCalcRoFiles()
+	return nil
+}
+
+// truncateFile - builds .ef/.efi of [horizonTxNum, item.endTxNum) with txNums >= horizonTxNum of `item`
+func (ii *InvertedIndex) truncateFile(ctx context.Context, item *filesItem, horizonTxNum uint64) (*filesItem, error) {
+	if err := item.open(); err != nil {
+		return nil, err
+	}
+	fromStep, toStep := horizonTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
+	datPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, fromStep, toStep))
+	comp, err := compress.NewCompressor(ctx, "expire ef", datPath, ii.tmpdir, compress.MinPatternScore, ii.compressWorkers, log.LvlTrace)
+	if err != nil {
+		return nil, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
+	}
+	defer comp.Close()
+	var keysCount int
+	var txNums []uint64
+	var buf []byte
+	g := item.decompressor.MakeGetter()
+	for g.HasNext() {
+		key, _ := g.NextUncompressed()
+		efBuf, _ := g.NextUncompressed()
+		txNums = txNums[:0]
+		ef, _ := eliasfano32.ReadEliasFano(efBuf)
+		for it := ef.Iterator(); it.HasNext(); {
+			txNum, _ := it.Next()
+			if txNum >= horizonTxNum {
+				txNums = append(txNums, txNum)
+			}
+		}
+		if len(txNums) == 0 {
+			continue
+		}
+		newEf := eliasfano32.NewEliasFano(uint64(len(txNums)), txNums[len(txNums)-1])
+		for _, txNum := range txNums {
+			newEf.AddOffset(txNum)
+		}
+		newEf.Build()
+		buf = newEf.AppendBytes(buf[:0])
+		if err = comp.AddUncompressedWord(key); err != nil {
+			return nil, fmt.Errorf("add %s key [%x]: %w", ii.filenameBase, key, err)
+		}
+		if err = comp.AddUncompressedWord(buf); err != nil {
+			return nil, fmt.Errorf("add %s val: %w", ii.filenameBase, err)
+		}
+		keysCount++
+	}
+	if err = comp.Compress(); err != nil {
+		return nil, fmt.Errorf("compress %s: %w", ii.filenameBase, err)
+	}
+	comp.Close()
+	decomp, err := compress.NewDecompressor(datPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
+	}
+	var index *recsplit.Index
+	if !ii.withoutIdx {
+		idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))
+		if index, err = buildIndex(ctx, decomp, idxPath, ii.tmpdir, keysCount, false /* values */, nil); err != nil {
+			decomp.Close()
+			return nil, fmt.Errorf("build %s efi: %w", ii.filenameBase, err)
+		}
+	}
+	bt, err := ii.buildBt(ctx, decomp, fromStep, toStep)
+	if err != nil {
+		decomp.Close()
+		if index != nil {
+			index.Close()
+		}
+		return nil, err
+	}
+	return &filesItem{
+		frozen:       (item.endTxNum-horizonTxNum)/ii.aggregationStep == StepsInBiggestFile,
+		startTxNum:   horizonTxNum,
+		endTxNum:     item.endTxNum,
+		decompressor: decomp,
+		index:        index,
+		bt:           bt,
+	}, nil
+}
+
+// ExpireHistory - same as InvertedIndex.ExpireHistory, but also for .v/.vi files
+func (h *History) ExpireHistory(ctx context.Context, horizonTxNum uint64) error {
+	hc := h.MakeContext()
+	defer hc.Close()
+	horizonTxNum, ok := h.nextHistoryHorizon(horizonTxNum, hc.ic.files)
+	if !ok {
+		return nil
+	}
+	iiOuts, iiBoundary := expiredFiles(h.InvertedIndex.files.Load(), hc.ic.files, horizonTxNum)
+	outs, boundary := expiredFiles(h.files.Load(), hc.files, horizonTxNum)
+	if (iiBoundary == nil) != (boundary == nil) || (boundary != nil && boundary.startTxNum != iiBoundary.startTxNum) {
+		return fmt.Errorf("%s: history and index files are not aligned at txNum=%d", h.filenameBase, horizonTxNum)
+	}
+	if err := h.saveHistoryHorizon(horizonTxNum); err != nil {
+		return fmt.Errorf("save %s history horizon: %w", h.filenameBase, err)
+	}
+	var iiIn, in *filesItem
+	if boundary != nil {
+		var err error
+		if iiIn, err = h.InvertedIndex.truncateFile(ctx, iiBoundary, horizonTxNum); err != nil {
+			return err
+		}
+		if in, err = h.truncateFile(ctx, boundary, iiBoundary, iiIn, horizonTxNum); err != nil {
+			iiIn.closeFilesAndRemove()
+			return err
+		}
+	}
+	integrateExpiredFiles(h.InvertedIndex.files.Load(), iiOuts, iiIn)
+	h.InvertedIndex.reCalcRoFiles()
+	integrateExpiredFiles(h.files.Load(), outs, in)
+	h.reCalcRoFiles()
+	return nil
+}
+
+// truncateFile - builds .v/.vi of [horizonTxNum, item.endTxNum) with values of txNums >= horizonTxNum.
+// iiItem - index file of `item`, iiIn - already truncated index file.
+func (h *History) truncateFile(ctx context.Context, item, iiItem, iiIn *filesItem, horizonTxNum uint64) (*filesItem, error) {
+	if err := item.open(); err != nil {
+		return nil, err
+	}
+	if err := iiItem.open(); err != nil {
+		return nil, err
+	}
+	fromStep, toStep := horizonTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+	datPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep))
+	comp, err := compress.NewCompressor(ctx, "expire history", datPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace)
+	if err != nil {
+		return nil, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
+	}
+	defer comp.Close()
+	var count int
+	var valBuf []byte
+	// taggedVals: literal of reference may be expired, large values of expired txNums are dropped
+	dec := valsDecoder{blobs: item.blobs, compressVals: h.compressVals}
+	blobsOut := h.newBlobsWriter(fromStep, toStep)
+	defer blobsOut.close()
+	enc := h.newValsEncoder(blobsOut)
+	g, g2 := iiItem.decompressor.MakeGetter(), item.decompressor.MakeGetter()
+	for g.HasNext() {
+		key, _ := g.NextUncompressed()
+		efBuf, _ := g.NextUncompressed()
+		ef, _ := eliasfano32.ReadEliasFano(efBuf)
+		for it := ef.Iterator(); it.HasNext(); {
+			txNum, _ := it.Next()
+			if h.compressVals {
+				valBuf, _ = g2.Next(valBuf[:0])
+			} else {
+				valBuf, _ = g2.NextUncompressed()
+			}
+			word := valBuf
+			if h.taggedVals() {
+				val, err := dec.decode(key, valBuf)
+				if err != nil {
+					return nil, fmt.Errorf("expire %s history: %s: %w", h.filenameBase, g2.FileName(), err)
+				}
+				if txNum >= horizonTxNum {
+					if word, err = enc.encode(key, txNum, val); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if txNum < horizonTxNum {
+				continue
+			}
+			if h.compressVals {
+				err = comp.AddWord(word)
+			} else {
+				err = comp.AddUncompressedWord(word)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("add %s history val: %w", h.filenameBase, err)
+			}
+			count++
+		}
+	}
+	if err = comp.Compress(); err != nil {
+		return nil, fmt.Errorf("compress %s history: %w", h.filenameBase, err)
+	}
+	comp.Close()
+	in := &filesItem{
+		frozen:     iiIn.frozen,
+		startTxNum: horizonTxNum,
+		endTxNum:   item.endTxNum,
+	}
+	if in.blobs, err = blobsOut.build(ctx); err != nil {
+		return nil, err
+	}
+	if in.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		in.closeFilesAndRemove()
+		return nil, fmt.Errorf("open %s history decompressor: %w", h.filenameBase, err)
+	}
+	idxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep))
+	if err = buildVi(in, iiIn, idxPath, h.tmpdir, count, false /* values */, h.compressVals, nil); err != nil {
+		in.closeFilesAndRemove()
+		return nil, fmt.Errorf("build %s vi: %w", h.filenameBase, err)
+	}
+	if in.index, err = recsplit.OpenIndex(idxPath); err != nil {
+		in.closeFilesAndRemove()
+		return nil, fmt.Errorf("open %s vi: %w", h.filenameBase, err)
+	}
+	return in, nil
+}
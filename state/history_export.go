@@ -0,0 +1,184 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// Columns of history export, see HistoryExportCfg and NewCSVHistoryWriter
+const (
+	ExportColumnKey   = "key"
+	ExportColumnTxNum = "txnum"
+	ExportColumnValue = "value" // value of key before txNum, only for histories
+)
+
+// HistoryExportRow - one change of key. For inverted indices Value is always nil.
+type HistoryExportRow struct {
+	Key   []byte
+	TxNum uint64
+	Value []byte
+}
+
+// HistoryRowWriter - sink of AggregatorV3.ExportHistory. Rows must be copied if retained: buffers are re-used.
+// CSV is implemented by NewCSVHistoryWriter, columnar formats (Parquet, ...) can be plugged in by implementing this interface.
+type HistoryRowWriter interface {
+	WriteRow(row HistoryExportRow) error
+	Flush() error
+}
+
+type csvHistoryWriter struct {
+	w       *csv.Writer
+	columns []string
+	record  []string
+}
+
+// NewCSVHistoryWriter - writes header and rows of selected `columns` (all if empty). Keys and values are hex-encoded.
+func NewCSVHistoryWriter(w io.Writer, columns []string) (HistoryRowWriter, error) {
+	if len(columns) == 0 {
+		columns = []string{ExportColumnKey, ExportColumnTxNum, ExportColumnValue}
+	}
+	for _, c := range columns {
+		switch c {
+		case ExportColumnKey, ExportColumnTxNum, ExportColumnValue:
+		default:
+			return nil, fmt.Errorf("NewCSVHistoryWriter: unknown column %q", c)
+		}
+	}
+	cw := &csvHistoryWriter{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	if err := cw.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvHistoryWriter) WriteRow(row HistoryExportRow) error {
+	for i, c := range cw.columns {
+		switch c {
+		case ExportColumnKey:
+			cw.record[i] = hex.EncodeToString(row.Key)
+		case ExportColumnTxNum:
+			cw.record[i] = strconv.FormatUint(row.TxNum, 10)
+		case ExportColumnValue:
+			cw.record[i] = hex.EncodeToString(row.Value)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvHistoryWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// HistoryExportCfg - what to export by AggregatorV3.ExportHistory
+type HistoryExportCfg struct {
+	Entity             string // "accounts", "storage", "code" - history; "logaddrs", "logtopics", "tracesfrom", "tracesto" - inverted index
+	FromTxNum, ToTxNum uint64 // [FromTxNum; ToTxNum)
+	KeyPrefix          []byte // nil - all keys
+	KeyFilter          func(k []byte) bool
+	WithoutValues      bool // don't read values of history: cheaper if "value" column is not exported
+}
+
+// ExportHistory - streams changes of `cfg.Entity` in [FromTxNum; ToTxNum) to `w`: from frozen files and from recent
+// history in `tx`. Rows are ordered by key, then by txNum. Value of history row is value of key before txNum
+// (empty if key didn't exist). Returns amount of written rows, `w` is flushed.
+func (a *AggregatorV3) ExportHistory(ctx context.Context, tx kv.Tx, cfg HistoryExportCfg, w HistoryRowWriter) (rows uint64, err error) {
+	if cfg.FromTxNum >= cfg.ToTxNum {
+		return 0, fmt.Errorf("ExportHistory: empty range [%d; %d)", cfg.FromTxNum, cfg.ToTxNum)
+	}
+	ac := a.MakeContext()
+	defer ac.Close()
+	var hc *HistoryContext
+	var ic *InvertedIndexContext
+	switch cfg.Entity {
+	case a.accounts.filenameBase:
+		hc = ac.accounts
+	case a.storage.filenameBase:
+		hc = ac.storage
+	case a.code.filenameBase:
+		hc = ac.code
+	case a.logAddrs.filenameBase:
+		ic = ac.logAddrs
+	case a.logTopics.filenameBase:
+		ic = ac.logTopics
+	case a.tracesFrom.filenameBase:
+		ic = ac.tracesFrom
+	case a.tracesTo.filenameBase:
+		ic = ac.tracesTo
+	default:
+		return 0, fmt.Errorf("ExportHistory: unknown entity %s", cfg.Entity)
+	}
+	if hc != nil {
+		ic = hc.ic
+		if cfg.WithoutValues {
+			hc = nil
+		}
+	}
+
+	keys := ic.IterateChangedKeys(cfg.FromTxNum, cfg.ToTxNum, tx)
+	defer keys.Close()
+	var row HistoryExportRow
+	var keyBuf []byte
+	for keys.HasNext() {
+		keyBuf = keys.Next(keyBuf[:0])
+		if !bytes.HasPrefix(keyBuf, cfg.KeyPrefix) || (cfg.KeyFilter != nil && !cfg.KeyFilter(keyBuf)) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return rows, ctx.Err()
+		default:
+		}
+		txNums, err := ic.IterateRange(keyBuf, int(cfg.FromTxNum), int(cfg.ToTxNum), order.Asc, -1, tx)
+		if err != nil {
+			return rows, fmt.Errorf("ExportHistory: %w", err)
+		}
+		for first := true; txNums.HasNext(); first = false {
+			txNum := txNums.next()
+			if !first && txNum <= row.TxNum { // not pruned yet recent history overlaps files
+				continue
+			}
+			row.Key, row.TxNum, row.Value = keyBuf, txNum, nil
+			if hc != nil {
+				if row.Value, _, err = hc.GetNoStateWithRecent(keyBuf, row.TxNum, tx); err != nil {
+					txNums.Close()
+					return rows, fmt.Errorf("ExportHistory: %w", err)
+				}
+			}
+			if err = w.WriteRow(row); err != nil {
+				txNums.Close()
+				return rows, err
+			}
+			rows++
+		}
+		txNums.Close()
+	}
+	if err := keys.Err(); err != nil {
+		return rows, fmt.Errorf("ExportHistory: %w", err)
+	}
+	return rows, w.Flush()
+}
@@ -0,0 +1,320 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+// RepackOpts - settings of files written by History.Repack
+type RepackOpts struct {
+	// CompressVals - compress values of .v files by dictionary. Becomes setting of History,
+	// after restart History must be created with same compressVals.
+	CompressVals bool
+	// MinPatternScore - compression level: minimal score of dictionary pattern. Lower - bigger dictionary and better compression, but slower.
+	// 0 - compress.MinPatternScore
+	MinPatternScore uint64
+	// Workers - amount of compression workers, 0 - same as for new files of History
+	Workers int
+}
+
+const repackSuffix = ".repack"
+
+// repackedFiles - new .ef/.efi/.v/.vi of 1 range, written with repackSuffix
+type repackedFiles struct {
+	old, iiOld      *filesItem
+	efPath, efiPath string // without repackSuffix
+	vPath, viPath   string
+	efbtPath        string // "" - .efbt is not built, see SetBtIndex
+	withoutEfi      bool
+}
+
+// Repack - rewrites all .v/.ef files with new settings (new dictionary is built for each file) and atomically swaps them in:
+// allows reclaim disk space without full re-sync. Files are rewritten 1 by 1: each new file is written next to old one
+// and renamed over it, readers of old files continue to read them until their contexts are closed.
+//
+// If CompressVals changes - all files are swapped together at the end (all files must be read with same setting), so
+// Repack needs free disk space for copy of all history files. In this case Repack must not run concurrently with readers of History.
+// Must not run concurrently with merge, prune or expiry of files of this History.
+func (h *History) Repack(ctx context.Context, opts RepackOpts) error {
+	toggle := opts.CompressVals != h.compressVals
+	if toggle && slices.Contains(h.integrityFileExtensions, "kv") {
+		return fmt.Errorf("%s: can't change compressVals of domain history: .kv files are read with same setting", h.filenameBase)
+	}
+	if toggle && h.blobThreshold > 0 {
+		return fmt.Errorf("%s: can't change compressVals of history with overflow store: .vb files are read with same setting", h.filenameBase)
+	}
+	if opts.MinPatternScore == 0 {
+		opts.MinPatternScore = compress.MinPatternScore
+	}
+	if opts.Workers == 0 {
+		opts.Workers = h.compressWorkers
+	}
+	h.removeRepackLeftovers()
+
+	hc := h.MakeContext()
+	defer hc.Close()
+	if len(hc.files) != len(hc.ic.files) {
+		return fmt.Errorf("%s: history and index files are not aligned", h.filenameBase)
+	}
+	var pending []*repackedFiles
+	defer func() {
+		for _, r := range pending {
+			r.remove()
+		}
+	}()
+	for i := range hc.files {
+		item, iiItem := hc.files[i].src, hc.ic.files[i].src
+		if item.startTxNum != iiItem.startTxNum || item.endTxNum != iiItem.endTxNum {
+			return fmt.Errorf("%s: history and index files are not aligned at txNum=%d", h.filenameBase, item.startTxNum)
+		}
+		r, err := h.repackFile(ctx, item, iiItem, opts)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, r)
+		if toggle {
+			continue
+		}
+		if err = h.swapRepacked(pending); err != nil {
+			return err
+		}
+		pending = pending[:0]
+	}
+	if err := h.swapRepacked(pending); err != nil {
+		return err
+	}
+	pending = pending[:0]
+	if toggle {
+		h.compressVals = opts.CompressVals
+	}
+	return nil
+}
+
+// removeRepackLeftovers - files of interrupted Repack
+func (h *History) removeRepackLeftovers() {
+	leftovers, _ := filepath.Glob(filepath.Join(h.dir, h.filenameBase+".*"+repackSuffix+"*"))
+	for _, f := range leftovers {
+		_ = os.Remove(f)
+	}
+}
+
+func (h *History) repackFile(ctx context.Context, item, iiItem *filesItem, opts RepackOpts) (*repackedFiles, error) {
+	if err := item.open(); err != nil {
+		return nil, err
+	}
+	if err := iiItem.open(); err != nil {
+		return nil, err
+	}
+	fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+	r := &repackedFiles{
+		old:        item,
+		iiOld:      iiItem,
+		efPath:     filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.ef", h.filenameBase, fromStep, toStep)),
+		efiPath:    filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.efi", h.filenameBase, fromStep, toStep)),
+		vPath:      filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep)),
+		viPath:     filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep)),
+		withoutEfi: h.withoutIdx,
+	}
+	if h.btIndex {
+		r.efbtPath = h.btPath(fromStep, toStep)
+	}
+	if err := r.build(ctx, h, opts); err != nil {
+		r.remove()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *repackedFiles) build(ctx context.Context, h *History, opts RepackOpts) error {
+	// .ef: keys and elias-fano lists are always stored uncompressed - only file and .efi are rebuilt
+	comp, err := compress.NewCompressor(ctx, "repack ef", r.efPath+repackSuffix, h.tmpdir, opts.MinPatternScore, opts.Workers, log.LvlTrace)
+	if err != nil {
+		return fmt.Errorf("create %s compressor: %w", h.filenameBase, err)
+	}
+	defer comp.Close()
+	var words int
+	g := r.iiOld.decompressor.MakeGetter()
+	for g.HasNext() {
+		word, _ := g.NextUncompressed()
+		if err = comp.AddUncompressedWord(word); err != nil {
+			return fmt.Errorf("add %s word: %w", h.filenameBase, err)
+		}
+		words++
+	}
+	if err = comp.Compress(); err != nil {
+		return fmt.Errorf("compress %s: %w", h.filenameBase, err)
+	}
+	comp.Close()
+	// temporary items: only close files, they are renamed by swapRepacked or removed on error
+	iiIn := &filesItem{startTxNum: r.iiOld.startTxNum, endTxNum: r.iiOld.endTxNum}
+	iiIn.replaced.Store(true)
+	defer iiIn.closeFilesAndRemove()
+	if iiIn.decompressor, err = compress.NewDecompressor(r.efPath + repackSuffix); err != nil {
+		return fmt.Errorf("open %s decompressor: %w", h.filenameBase, err)
+	}
+	if !r.withoutEfi {
+		if iiIn.index, err = buildIndex(ctx, iiIn.decompressor, r.efiPath+repackSuffix, h.tmpdir, words/2, false /* values */, nil); err != nil {
+			return fmt.Errorf("build %s efi: %w", h.filenameBase, err)
+		}
+	}
+	if r.efbtPath != "" { // offsets of words in new .ef file differ
+		if iiIn.bt, err = buildBtIndex(ctx, iiIn.decompressor, r.efbtPath+repackSuffix, nil); err != nil {
+			return fmt.Errorf("build %s efbt: %w", h.filenameBase, err)
+		}
+	}
+
+	// .v: values are re-read with current setting and written with new one
+	if comp, err = compress.NewCompressor(ctx, "repack history", r.vPath+repackSuffix, h.tmpdir, opts.MinPatternScore, opts.Workers, log.LvlTrace); err != nil {
+		return fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
+	}
+	defer comp.Close()
+	var count int
+	var valBuf []byte
+	g = r.old.decompressor.MakeGetter()
+	for g.HasNext() {
+		if h.compressVals {
+			valBuf, _ = g.Next(valBuf[:0])
+		} else {
+			valBuf, _ = g.NextUncompressed()
+		}
+		if opts.CompressVals {
+			err = comp.AddWord(valBuf)
+		} else {
+			err = comp.AddUncompressedWord(valBuf)
+		}
+		if err != nil {
+			return fmt.Errorf("add %s history val: %w", h.filenameBase, err)
+		}
+		count++
+	}
+	if err = comp.Compress(); err != nil {
+		return fmt.Errorf("compress %s history: %w", h.filenameBase, err)
+	}
+	comp.Close()
+	in := &filesItem{startTxNum: r.old.startTxNum, endTxNum: r.old.endTxNum}
+	in.replaced.Store(true)
+	defer in.closeFilesAndRemove()
+	if in.decompressor, err = compress.NewDecompressor(r.vPath + repackSuffix); err != nil {
+		return fmt.Errorf("open %s history decompressor: %w", h.filenameBase, err)
+	}
+	if err = buildVi(in, iiIn, r.viPath+repackSuffix, h.tmpdir, count, false /* values */, opts.CompressVals, nil); err != nil {
+		return fmt.Errorf("build %s vi: %w", h.filenameBase, err)
+	}
+	return nil
+}
+
+func (r *repackedFiles) paths() []string {
+	paths := []string{r.efPath, r.efiPath, r.vPath, r.viPath, r.efbtPath}
+	if r.withoutEfi {
+		paths = []string{r.efPath, r.vPath, r.viPath, r.efbtPath}
+	}
+	if r.efbtPath == "" {
+		paths = paths[:len(paths)-1]
+	}
+	return paths
+}
+
+func (r *repackedFiles) remove() {
+	for _, path := range r.paths() {
+		_ = os.Remove(path + repackSuffix)
+	}
+}
+
+// swapRepacked - renames new files over old ones and replaces items of old files.
+// Old items are closed (without removing files) by last context which uses them.
+func (h *History) swapRepacked(repacked []*repackedFiles) error {
+	for _, r := range repacked {
+		for _, path := range r.paths() {
+			if err := os.Rename(path+repackSuffix, path); err != nil {
+				return fmt.Errorf("%s: %w", h.filenameBase, err)
+			}
+		}
+		if h.contentAddressed { // replaced content-addressed files are removed by CleanupDir
+			for _, path := range []string{r.efPath, r.vPath} {
+				if err := addressByContent(path); err != nil {
+					return fmt.Errorf("%s: %w", h.filenameBase, err)
+				}
+			}
+		}
+	}
+	for _, r := range repacked {
+		iiIn, err := h.openRepacked(r.iiOld, r.efPath, r.efiPath, r.withoutEfi)
+		if err != nil {
+			return err
+		}
+		if r.efbtPath != "" {
+			if err = openBtOf(iiIn, r.efbtPath, h.lazyOpen); err != nil {
+				iiIn.closeFilesAndRemove()
+				return err
+			}
+		}
+		in, err := h.openRepacked(r.old, r.vPath, r.viPath, false)
+		if err != nil {
+			iiIn.closeFilesAndRemove()
+			return err
+		}
+		if err = h.openBlobs(in); err != nil { // .vb is not repacked: new item has own instance of same files
+			in.replaced.Store(true)
+			in.closeFilesAndRemove()
+			iiIn.closeFilesAndRemove()
+			return err
+		}
+		h.InvertedIndex.files.Load().Set(iiIn)
+		h.files.Load().Set(in)
+		for _, out := range []*filesItem{r.iiOld, r.old} {
+			out.replaced.Store(true)
+			out.markDeleted()
+		}
+	}
+	h.InvertedIndex.reCalcRoFiles()
+	h.reCalcRoFiles()
+	return nil
+}
+
+func (h *History) openRepacked(old *filesItem, datPath, idxPath string, withoutIdx bool) (in *filesItem, err error) {
+	in = &filesItem{frozen: old.frozen, startTxNum: old.startTxNum, endTxNum: old.endTxNum}
+	in.replaced.Store(true) // on error: don't remove renamed files
+	if h.lazyOpen {
+		in.datPath = datPath
+		if !withoutIdx {
+			in.idxPath = idxPath
+		}
+		in.replaced.Store(false)
+		return in, nil
+	}
+	if in.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		return nil, fmt.Errorf("open %s: %w", datPath, err)
+	}
+	if !withoutIdx {
+		if in.index, err = recsplit.OpenIndex(idxPath); err != nil {
+			in.closeFilesAndRemove()
+			return nil, fmt.Errorf("open %s: %w", idxPath, err)
+		}
+	}
+	in.replaced.Store(false)
+	return in, nil
+}
@@ -17,15 +17,22 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/fstest"
 	"time"
 
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon-lib/kv/order"
@@ -34,6 +41,8 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
+	atomic2 "go.uber.org/atomic"
+	"golang.org/x/sync/semaphore"
 )
 
 func testDbAndHistory(tb testing.TB) (string, kv.RwDB, *History) {
@@ -107,10 +116,10 @@ func TestHistoryCollationBuild(t *testing.T) {
 	require.NoError(err)
 	require.True(strings.HasSuffix(c.historyPath, "hist.0-1.v"))
 	require.Equal(6, c.historyCount)
-	require.Equal(3, len(c.indexBitmaps))
-	require.Equal([]uint64{7}, c.indexBitmaps["key3"].ToArray())
-	require.Equal([]uint64{3, 6, 7}, c.indexBitmaps["key2"].ToArray())
-	require.Equal([]uint64{2, 6}, c.indexBitmaps["key1"].ToArray())
+	require.Equal(3, len(c.indexBitmaps.m))
+	require.Equal([]uint64{7}, c.indexBitmaps.m["key3"].ToArray())
+	require.Equal([]uint64{3, 6, 7}, c.indexBitmaps.m["key2"].ToArray())
+	require.Equal([]uint64{2, 6}, c.indexBitmaps.m["key1"].ToArray())
 
 	sf, err := h.buildFiles(ctx, 0, c)
 	require.NoError(err)
@@ -406,6 +415,354 @@ func TestHistoryScanFiles(t *testing.T) {
 	checkHistoryHistory(t, db, h, txs)
 }
 
+func TestHistoryExpire(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+	ctx := context.Background()
+
+	check := func(t *testing.T, horizon uint64) {
+		t.Helper()
+		require.Equal(t, horizon, h.HistoryHorizon())
+		tx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		hc := h.MakeContext()
+		defer hc.Close()
+		for _, f := range hc.files {
+			require.GreaterOrEqual(t, f.startTxNum, horizon)
+		}
+		for _, f := range hc.ic.files {
+			require.GreaterOrEqual(t, f.startTxNum, horizon)
+		}
+
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], 3)
+		k[0] = 0x01
+		_, _, err = hc.GetNoState(k[:], horizon-1)
+		require.ErrorIs(t, err, ErrHistoryPruned)
+		_, err = hc.ic.IterateRange(k[:], int(horizon)-1, -1, order.Asc, -1, tx)
+		require.ErrorIs(t, err, ErrHistoryPruned)
+		_, err = hc.ic.IdxCount(k[:], int(horizon)-1, -1, tx)
+		require.ErrorIs(t, err, ErrHistoryPruned)
+		it := hc.WalkAsOf(horizon-1, nil, nil, order.Asc, tx, -1)
+		require.True(t, it.HasNext())
+		_, _, err = it.Next()
+		require.ErrorIs(t, err, ErrHistoryPruned)
+		it.Close()
+
+		// unbounded range - from horizon
+		txNums, err := hc.ic.IterateRange(k[:], -1, -1, order.Asc, -1, tx)
+		require.NoError(t, err)
+		require.Equal(t, (horizon+2)/3*3, txNums.next())
+
+		for txNum := horizon - 1; txNum <= txs; txNum++ {
+			for keyNum := uint64(1); keyNum <= uint64(31); keyNum++ {
+				var k, v [8]byte
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				binary.BigEndian.PutUint64(v[:], txNum/keyNum)
+				k[0], v[0] = 0x01, 0xff
+				label := fmt.Sprintf("txNum=%d, keyNum=%d", txNum, keyNum)
+				val, ok, err := hc.GetNoStateWithRecent(k[:], txNum+1, tx)
+				require.NoError(t, err, label)
+				require.Equal(t, txNum+1 <= txs/keyNum*keyNum, ok, label) // found if key changes after txNum
+				if ok {
+					require.Equal(t, v[:], val, label)
+				}
+			}
+		}
+	}
+
+	// boundary file [0-32) truncated to [31-32)
+	require.NoError(t, h.ExpireHistory(ctx, 500))
+	check(t, 31*h.aggregationStep)
+	for _, f := range h.Files() {
+		require.False(t, strings.Contains(f, ".0-"), f)
+	}
+
+	// files fully below horizon removed, [48-56) truncated to [50-56). Horizon never moves back.
+	require.NoError(t, h.ExpireHistory(ctx, 800))
+	require.NoError(t, h.ExpireHistory(ctx, 100))
+	check(t, 50*h.aggregationStep)
+
+	// horizon is persisted
+	require.NoError(t, h.reOpenFolder())
+	check(t, 50*h.aggregationStep)
+}
+
+func TestHistoryExpireReopenMerge(t *testing.T) {
+	path, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+	ctx := context.Background()
+
+	// context keeps replaced files on disk: restart must not open them
+	hc := h.MakeContext()
+	require.NoError(t, h.ExpireHistory(ctx, 500))
+	horizon := 31 * h.aggregationStep
+
+	h2, err := NewHistory(path, path, h.aggregationStep, "hist", "Keys", "Index", "Vals", "Settings", false, nil)
+	require.NoError(t, err)
+	defer h2.Close()
+	require.NoError(t, h2.reOpenFolder())
+	hc.Close()
+	require.Equal(t, horizon, h2.HistoryHorizon())
+
+	// boundary file [31-32) is not aligned: merge must not extend it below horizon
+	maxSpan := h2.aggregationStep * StepsInBiggestFile
+	for r := h2.findMergeRange(h2.endTxNumMinimax(), maxSpan); r.any(); r = h2.findMergeRange(h2.endTxNumMinimax(), maxSpan) {
+		func() {
+			hc := h2.MakeContext()
+			defer hc.Close()
+			indexOuts, historyOuts, _, err := h2.staticFilesInRange(r, hc)
+			require.NoError(t, err)
+			indexIn, historyIn, err := h2.mergeFiles(ctx, indexOuts, historyOuts, r, 1)
+			require.NoError(t, err)
+			h2.integrateMergedFiles(indexOuts, historyOuts, indexIn, historyIn)
+		}()
+	}
+	for _, f := range h2.Files() {
+		require.False(t, strings.Contains(f, ".0-"), f)
+	}
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	hc = h2.MakeContext()
+	defer hc.Close()
+	require.Equal(t, horizon, hc.files[0].startTxNum)
+	require.Equal(t, horizon, hc.ic.files[0].startTxNum)
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 3)
+	k[0] = 0x01
+	_, _, err = hc.GetNoState(k[:], horizon-1)
+	require.ErrorIs(t, err, ErrHistoryPruned)
+	for txNum := horizon; txNum <= txs; txNum++ {
+		for keyNum := uint64(1); keyNum <= uint64(31); keyNum++ {
+			var k, v [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], txNum/keyNum)
+			k[0], v[0] = 0x01, 0xff
+			label := fmt.Sprintf("txNum=%d, keyNum=%d", txNum, keyNum)
+			val, ok, err := hc.GetNoStateWithRecent(k[:], txNum+1, tx)
+			require.NoError(t, err, label)
+			require.Equal(t, txNum+1 <= txs/keyNum*keyNum, ok, label)
+			if ok {
+				require.Equal(t, v[:], val, label)
+			}
+		}
+	}
+}
+
+func TestHistoryWithoutIndex(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	h.SetWithoutIndex(true)
+	collateAndMergeHistory(t, db, h, txs)
+	_, db2, h2, _ := filledHistory(t)
+	collateAndMergeHistory(t, db2, h2, txs)
+
+	for _, f := range h.Files() {
+		require.False(t, strings.HasSuffix(f, ".efi"), f)
+	}
+	entries, err := os.ReadDir(h.dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasSuffix(e.Name(), ".efi"), e.Name())
+		require.False(t, strings.HasSuffix(e.Name(), ".li"), e.Name())
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	tx2, err := db2.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx2.Rollback()
+	hc, hc2 := h.MakeContext(), h2.MakeContext()
+	defer hc.Close()
+	defer hc2.Close()
+
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 3)
+	k[0] = 0x01
+	_, _, err = hc.GetNoState(k[:], 100)
+	require.ErrorIs(t, err, ErrWithoutIndex)
+	_, err = hc.ic.IterateRange(k[:], 0, 100, order.Asc, -1, tx)
+	require.ErrorIs(t, err, ErrWithoutIndex)
+	_, err = hc.ic.IdxCount(k[:], 0, 100, tx)
+	require.ErrorIs(t, err, ErrWithoutIndex)
+	// range which is only in db
+	it, err := hc.ic.IterateRange(k[:], int(txs)-5, -1, order.Asc, -1, tx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(996), it.next())
+
+	collect := func(it *StateAsOfIter) (res []string) {
+		defer it.Close()
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(t, err)
+			res = append(res, fmt.Sprintf("%x=%x", k, v))
+		}
+		return res
+	}
+	for _, txNum := range []uint64{2, 500, 995} {
+		require.Equal(t, collect(hc2.WalkAsOf(txNum, nil, nil, order.Asc, tx2, -1)), collect(hc.WalkAsOf(txNum, nil, nil, order.Asc, tx, -1)))
+	}
+}
+
+func TestHistoryBtIndex(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	h.SetWithoutIndex(true)
+	h.SetBtIndex(true)
+	collateAndMergeHistory(t, db, h, txs)
+	_, db2, h2, _ := filledHistory(t)
+	collateAndMergeHistory(t, db2, h2, txs)
+	ctx := context.Background()
+
+	var efbt []string
+	for _, f := range h.Files() {
+		require.False(t, strings.HasSuffix(f, ".efi"), f)
+		if strings.HasSuffix(f, ".ef") {
+			efbt = append(efbt, filepath.Join(h.dir, f+"bt"))
+		}
+	}
+	require.NotEmpty(t, efbt)
+	for _, f := range efbt {
+		require.FileExists(t, f)
+	}
+
+	check := func() {
+		t.Helper()
+		checkHistoryHistory(t, db, h, txs) // GetNoState by .efbt
+
+		tx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		tx2, err := db2.BeginRo(ctx)
+		require.NoError(t, err)
+		defer tx2.Rollback()
+		hc, hc2 := h.MakeContext(), h2.MakeContext()
+		defer hc.Close()
+		defer hc2.Close()
+		key := func(n uint64) []byte {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], n)
+			k[0] = 0x01
+			return k[:]
+		}
+		for _, n := range []uint64{3, 31, 32} {
+			cnt, err := hc.ic.IdxCount(key(n), 0, 900, tx)
+			require.NoError(t, err)
+			cnt2, err := hc2.ic.IdxCount(key(n), 0, 900, tx2)
+			require.NoError(t, err)
+			require.Equal(t, cnt2, cnt)
+		}
+		collect := func(it *StateAsOfIter) (res []string) {
+			defer it.Close()
+			for it.HasNext() {
+				k, v, err := it.Next()
+				require.NoError(t, err)
+				res = append(res, fmt.Sprintf("%x=%x", k, v))
+			}
+			return res
+		}
+		for _, txNum := range []uint64{2, 500, 995} {
+			for _, r := range [][2][]byte{{nil, nil}, {key(6), key(21)}, {key(30), nil}, {key(40), nil}} {
+				require.Equal(t, collect(hc2.WalkAsOf(txNum, r[0], r[1], order.Asc, tx2, -1)), collect(hc.WalkAsOf(txNum, r[0], r[1], order.Asc, tx, -1)))
+			}
+		}
+	}
+	check()
+
+	// missing .efbt is built by BuildMissedIndices
+	h.Close()
+	require.NoError(t, os.Remove(efbt[0]))
+	require.NoError(t, h.reOpenFolder())
+	hc := h.MakeContext()
+	_, _, err := hc.GetNoState(make([]byte, 8), 2)
+	require.ErrorIs(t, err, ErrWithoutIndex)
+	hc.Close()
+	require.NoError(t, h.BuildMissedIndices(ctx, semaphore.NewWeighted(4)))
+	require.FileExists(t, efbt[0])
+	h.reCalcRoFiles()
+	h.InvertedIndex.reCalcRoFiles()
+	check()
+
+	// .efbt is rebuilt with repacked .ef
+	require.NoError(t, h.Repack(ctx, RepackOpts{MinPatternScore: 2 * compress.MinPatternScore}))
+	check()
+}
+
+func TestWalkAsOfDesc(t *testing.T) {
+	test := func(t *testing.T, db kv.RwDB, h *History) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		hc := h.MakeContext()
+		defer hc.Close()
+		key := func(n uint64) []byte {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], n)
+			k[0] = 0x01
+			return k[:]
+		}
+		collect := func(it *StateAsOfIter) (keys, vals []string) {
+			defer it.Close()
+			for it.HasNext() {
+				k, v, err := it.Next()
+				require.NoError(t, err)
+				keys = append(keys, fmt.Sprintf("%x", k))
+				vals = append(vals, fmt.Sprintf("%x", v))
+			}
+			return keys, vals
+		}
+		reverse := func(in []string) []string {
+			out := make([]string, 0, len(in))
+			for i := len(in) - 1; i >= 0; i-- {
+				out = append(out, in[i])
+			}
+			return out
+		}
+		for _, txNum := range []uint64{2, 500, 995} {
+			ascKeys, ascVals := collect(hc.WalkAsOf(txNum, nil, nil, order.Asc, tx, -1))
+			require.NotEmpty(t, ascKeys)
+			descKeys, descVals := collect(hc.WalkAsOf(txNum, nil, nil, order.Desc, tx, -1))
+			require.Equal(t, reverse(ascKeys), descKeys)
+			require.Equal(t, reverse(ascVals), descVals)
+
+			// asc [6, 21) == desc [20, 5)
+			ascKeys, ascVals = collect(hc.WalkAsOf(txNum, key(6), key(21), order.Asc, tx, -1))
+			descKeys, descVals = collect(hc.WalkAsOf(txNum, key(20), key(5), order.Desc, tx, -1))
+			require.Equal(t, reverse(ascKeys), descKeys)
+			require.Equal(t, reverse(ascVals), descVals)
+
+			descKeys, _ = collect(hc.WalkAsOf(txNum, nil, nil, order.Desc, tx, 2))
+			require.Equal(t, 2, len(descKeys))
+		}
+	}
+	t.Run("db", func(t *testing.T) {
+		_, db, h, _ := filledHistory(t)
+		test(t, db, h)
+	})
+	t.Run("files", func(t *testing.T) {
+		_, db, h, txs := filledHistory(t)
+		collateAndMergeHistory(t, db, h, txs)
+		test(t, db, h)
+	})
+	t.Run("files by chunks", func(t *testing.T) {
+		defer func(v int) { descChunk = v }(descChunk)
+		descChunk = 4
+		_, db, h, txs := filledHistory(t)
+		collateAndMergeHistory(t, db, h, txs)
+		test(t, db, h)
+	})
+	t.Run("files with efbt", func(t *testing.T) {
+		_, db, h, txs := filledHistory(t)
+		h.SetBtIndex(true)
+		collateAndMergeHistory(t, db, h, txs)
+		test(t, db, h)
+	})
+}
+
 func TestIterateChanged(t *testing.T) {
 	_, db, h, txs := filledHistory(t)
 	collateAndMergeHistory(t, db, h, txs)
@@ -418,7 +775,7 @@ func TestIterateChanged(t *testing.T) {
 	ic := h.MakeContext()
 	defer ic.Close()
 
-	it := ic.IterateChanged(2, 20, order.Asc, -1, tx)
+	it := ic.IterateChanged(2, 20, nil, nil, order.Asc, -1, tx)
 	defer it.Close()
 	for it.HasNext() {
 		k, v, err := it.Next()
@@ -467,7 +824,7 @@ func TestIterateChanged(t *testing.T) {
 		"",
 		"",
 		""}, vals)
-	it = ic.IterateChanged(995, 1000, order.Asc, -1, tx)
+	it = ic.IterateChanged(995, 1000, nil, nil, order.Asc, -1, tx)
 	keys, vals = keys[:0], vals[:0]
 	for it.HasNext() {
 		k, v, err := it.Next()
@@ -498,6 +855,42 @@ func TestIterateChanged(t *testing.T) {
 		"ff0000000000006e",
 		"ff00000000000052",
 		"ff00000000000024"}, vals)
+
+	// key bounds: [from, to)
+	from, to := hexutility.MustDecodeHex("0100000000000003"), hexutility.MustDecodeHex("0100000000000007")
+	it = ic.IterateChanged(2, 20, from, to, order.Asc, -1, tx)
+	keys, vals = keys[:0], vals[:0]
+	for it.HasNext() {
+		k, _, err := it.Next()
+		require.NoError(t, err)
+		keys = append(keys, fmt.Sprintf("%x", k))
+	}
+	it.Close()
+	require.Equal(t, []string{
+		"0100000000000003",
+		"0100000000000004",
+		"0100000000000005",
+		"0100000000000006",
+	}, keys)
+
+	it = ic.IterateChanged(995, 1000, hexutility.MustDecodeHex("0100000000000005"), hexutility.MustDecodeHex("010000000000000c"), order.Asc, -1, tx)
+	keys = keys[:0]
+	for it.HasNext() {
+		k, v, err := it.Next()
+		require.NoError(t, err)
+		keys = append(keys, fmt.Sprintf("%x", k))
+		vals = append(vals, fmt.Sprintf("%x", v))
+	}
+	it.Close()
+	require.Equal(t, []string{
+		"0100000000000005",
+		"0100000000000006",
+		"0100000000000009",
+	}, keys)
+	require.Equal(t, []string{
+		"ff000000000000c6",
+		"ff000000000000a5",
+		"ff0000000000006e"}, vals)
 }
 
 func TestIterateChanged2(t *testing.T) {
@@ -624,7 +1017,7 @@ func TestIterateChanged2(t *testing.T) {
 
 func TestScanStaticFilesH(t *testing.T) {
 	h := &History{InvertedIndex: &InvertedIndex{filenameBase: "test", aggregationStep: 1},
-		files: btree2.NewBTreeG[*filesItem](filesItemLess),
+		files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess)),
 	}
 	ffs := fstest.MapFS{
 		"test.0-1.v": {},
@@ -638,7 +1031,7 @@ func TestScanStaticFilesH(t *testing.T) {
 	require.NoError(t, err)
 	h.scanStateFiles(files, nil)
 	var found []string
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			found = append(found, fmt.Sprintf("%d-%d", item.startTxNum, item.endTxNum))
 		}
@@ -646,8 +1039,509 @@ func TestScanStaticFilesH(t *testing.T) {
 	})
 	require.Equal(t, 6, len(found))
 
-	h.files.Clear()
+	h.files.Load().Clear()
 	h.scanStateFiles(files, []string{"kv"})
-	require.Equal(t, 0, h.files.Len())
+	require.Equal(t, 0, h.files.Load().Len())
+
+}
+
+func TestHistoryRepack(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+	ctx := context.Background()
+	files := h.Files()
+
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 3)
+	k[0] = 0x01
+	hc := h.MakeContext()
+	before, ok, err := hc.GetNoState(k[:], 100)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, h.Repack(ctx, RepackOpts{MinPatternScore: 2 * compress.MinPatternScore}))
+	require.Equal(t, files, h.Files())
+	// context opened before Repack still reads old files
+	after, ok, err := hc.GetNoState(k[:], 100)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, before, after)
+	hc.Close()
+	checkHistoryHistory(t, db, h, txs)
+
+	// compressed empty value is read as nil, compare as strings
+	readAll := func() (res []string) {
+		hc := h.MakeContext()
+		defer hc.Close()
+		for txNum := uint64(0); txNum <= txs; txNum += 7 {
+			for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				k[0] = 0x01
+				v, ok, err := hc.GetNoState(k[:], txNum+1)
+				require.NoError(t, err)
+				res = append(res, fmt.Sprintf("%t %x", ok, v))
+			}
+		}
+		return res
+	}
+	expect := readAll()
+	require.NoError(t, h.Repack(ctx, RepackOpts{CompressVals: true}))
+	require.True(t, h.compressVals)
+	require.Equal(t, files, h.Files())
+	require.Equal(t, expect, readAll())
+
+	require.NoError(t, h.reOpenFolder())
+	require.Equal(t, expect, readAll())
+	entries, err := os.ReadDir(h.dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasSuffix(e.Name(), repackSuffix), e.Name())
+	}
+}
+
+func TestHistoryFilesInfo(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+
+	var names []string
+	for _, f := range h.Files() {
+		names = append(names, filepath.Base(f))
+	}
+	var infoNames []string
+	kinds := map[FileKind]int{}
+	for _, fi := range h.FilesInfo() {
+		kinds[fi.Kind]++
+		require.Equal(t, h.filenameBase, fi.Entity)
+		require.True(t, fi.Open, fi.Name)
+		require.True(t, fi.HasIndex(), fi.Name)
+		require.Positive(t, fi.Size, fi.Name)
+		require.Positive(t, fi.IdxSize, fi.Name)
+		if fi.Kind != FileKindLocality {
+			require.Equal(t, fi.ToStep-fi.FromStep == StepsInBiggestFile, fi.Frozen, fi.Name)
+			infoNames = append(infoNames, fi.Name)
+		}
+	}
+	require.Equal(t, names, infoNames)
+	require.Equal(t, kinds[FileKindHistory], kinds[FileKindInvertedIndex])
+	require.Equal(t, 1, kinds[FileKindLocality])
+
+	hc := h.MakeContext()
+	_, found, err := hc.GetNoState([]byte("key-not-exists"), 10)
+	require.NoError(t, err)
+	require.False(t, found)
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], 1)
+	key[0] = 1
+	v, found, err := hc.GetNoState(key[:], 10)
+	require.NoError(t, err)
+	require.True(t, found)
+	hc.Close()
+	var total FileReads
+	for _, fi := range h.FilesInfo() {
+		require.LessOrEqual(t, fi.Reads.Hits, fi.Reads.Lookups, fi.Name)
+		if fi.Kind == FileKindHistory && fi.Reads.Hits > 0 {
+			require.Equal(t, FileReads{Lookups: 1, Hits: 1, Bytes: uint64(len(v))}, fi.Reads, fi.Name)
+		}
+		total.Lookups, total.Hits = total.Lookups+fi.Reads.Lookups, total.Hits+fi.Reads.Hits
+	}
+	require.Greater(t, total.Lookups, total.Hits)
+	require.Equal(t, uint64(2), total.Hits) // .ef and .v of found key
+
+	h.SetLazyOpen(true)
+	require.NoError(t, h.reOpenFolder())
+	for _, fi := range h.FilesInfo() {
+		if fi.Kind != FileKindLocality {
+			require.False(t, fi.Open, fi.Name)
+			require.Positive(t, fi.Size, fi.Name)
+		}
+	}
+
+	// steps hold readers of their files: not closed as idle until Close
+	steps, err := h.MakeSteps(math.MaxUint64)
+	require.NoError(t, err)
+	require.NotEmpty(t, steps)
+	require.Zero(t, h.closeIdleFiles())
+	closeSteps(steps)
+	require.Positive(t, h.closeIdleFiles())
+}
+
+func TestHistoryUnwind(t *testing.T) {
+	ctx := context.Background()
+	const txUnwindTo = 600
+	dump := func(tx kv.Tx, h *History) (res []string) {
+		for _, table := range []string{h.indexKeysTable, h.indexTable, h.historyValsTable} {
+			err := tx.ForEach(table, nil, func(k, v []byte) error {
+				res = append(res, fmt.Sprintf("%s %x %x", table, k, v))
+				return nil
+			})
+			require.NoError(t, err)
+		}
+		return res
+	}
+
+	// reference: unwind by pruneF
+	_, db, h, _ := filledHistory(t)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	h.SetTx(tx)
+	expectState := map[string][]byte{}
+	err = h.pruneF(txUnwindTo, math.MaxUint64, func(_ uint64, k, v []byte) error {
+		if _, ok := expectState[string(k)]; !ok {
+			expectState[string(k)] = common.Copy(v)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	expect := dump(tx, h)
+
+	// 2 histories unwound together
+	_, db1, h1, _ := filledHistory(t)
+	_, db2, h2, _ := filledHistory(t)
+	tx1, err := db1.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx1.Rollback()
+	tx2, err := db2.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx2.Rollback()
+	h1.SetTx(tx1)
+	h2.SetTx(tx2)
+	state := map[string][]byte{}
+	err = unwindHistories(ctx, "unwind", h1.tmpdir, txUnwindTo, func(k, v []byte) error {
+		if _, ok := state[string(k)]; !ok {
+			state[string(k)] = common.Copy(v)
+		}
+		return nil
+	}, h1, h2)
+	require.NoError(t, err)
+	require.Equal(t, expectState, state)
+	require.Equal(t, expect, dump(tx1, h1))
+	require.Equal(t, expect, dump(tx2, h2))
+}
+
+func TestHistoryCheckFilesIntegrity(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+	ctx := context.Background()
+
+	res, err := h.CheckFilesIntegrity(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, res)
+	for _, r := range res {
+		require.True(t, r.OK(), r.String())
+		require.True(t, r.HasHistory)
+		require.Positive(t, r.EfTxNums)
+		require.Equal(t, r.EfKeys, r.EfiKeys)
+	}
+
+	// .vi of other range: keys of .ef don't resolve to their values
+	var items []*filesItem
+	h.files.Load().Walk(func(list []*filesItem) bool {
+		items = append(items, list...)
+		return true
+	})
+	require.GreaterOrEqual(t, len(items), 2)
+	items[0].index, items[1].index = items[1].index, items[0].index
+	res, err = h.CheckFilesIntegrity(ctx)
+	items[0].index, items[1].index = items[1].index, items[0].index
+	require.NoError(t, err)
+	require.False(t, res[0].OK())
+	require.Positive(t, res[0].ViMismatch)
+}
+
+func TestHistoryBuildMissedIndices(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	collateAndMergeHistory(t, db, h, txs)
+	ctx := context.Background()
+
+	var items []*filesItem
+	hc := h.MakeContext()
+	for _, item := range hc.files {
+		items = append(items, item.src)
+	}
+	hc.Close()
+	require.GreaterOrEqual(t, len(items), 2)
+	name := func(item *filesItem, ext string) string {
+		return filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.%s", h.filenameBase, item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep, ext))
+	}
+	// missing indices
+	h.Close()
+	require.NoError(t, os.Remove(name(items[0], "vi")))
+	require.NoError(t, os.Remove(name(items[0], "efi")))
+	// interrupted build: index exists, but marker was not removed
+	require.NoError(t, os.WriteFile(name(items[1], "vi")+idxBuildMarkerSuffix, nil, 0644))
+	// completed index is not rebuilt
+	completed := name(items[len(items)-1], "vi")
+	completedInfo, err := os.Stat(completed)
+	require.NoError(t, err)
+	require.NoError(t, h.reOpenFolder())
 
+	ps := background.NewProgressSet()
+	err = h.BuildMissedIndicesWithProgress(ctx, semaphore.NewWeighted(4), ps)
+	require.NoError(t, err)
+	require.Empty(t, ps.String())
+	h.reCalcRoFiles()
+	h.InvertedIndex.reCalcRoFiles()
+
+	require.FileExists(t, name(items[0], "vi"))
+	require.FileExists(t, name(items[0], "efi"))
+	require.NoFileExists(t, name(items[1], "vi")+idxBuildMarkerSuffix)
+	st, err := os.Stat(completed)
+	require.NoError(t, err)
+	require.Equal(t, completedInfo.ModTime(), st.ModTime())
+	checkHistoryHistory(t, db, h, txs)
+}
+
+func TestHistoryDedupValues(t *testing.T) {
+	ctx := context.Background()
+	txs := uint64(480)
+	fill := func(dedup bool) (kv.RwDB, *History) {
+		t.Helper()
+		_, db, h := testDbAndHistory(t)
+		h.SetDedupValues(dedup)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		h.SetTx(tx)
+		h.StartWrites("")
+		defer h.FinishWrites()
+		// key changes on every txNum which is multiple of the key, but same value is written 10 times in a row
+		var prevVal [8][]byte
+		for txNum := uint64(1); txNum <= txs; txNum++ {
+			h.SetTxNum(txNum)
+			for keyNum := uint64(1); keyNum < 8; keyNum++ {
+				if txNum%keyNum != 0 {
+					continue
+				}
+				var k [8]byte
+				v := make([]byte, 32)
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				binary.BigEndian.PutUint64(v, txNum/keyNum/10)
+				require.NoError(t, h.AddPrevValue(k[:], nil, prevVal[keyNum]))
+				prevVal[keyNum] = v
+			}
+		}
+		require.NoError(t, h.Rotate().Flush(ctx, tx))
+		require.NoError(t, tx.Commit())
+		collateAndMergeHistory(t, db, h, txs)
+		return db, h
+	}
+	vSize := func(h *History) (size int64) {
+		hc := h.MakeContext()
+		defer hc.Close()
+		for _, f := range hc.files {
+			size += f.src.decompressor.Size()
+		}
+		return size
+	}
+	plainDb, plain := fill(false)
+	dedupDb, dedup := fill(true)
+	require.Less(t, vSize(dedup)*2, vSize(plain))
+	compareHistories(t, 0, txs, 8, plain, dedup, plainDb, dedupDb)
+
+	// literal of reference may be below horizon
+	require.NoError(t, plain.ExpireHistory(ctx, 205))
+	require.NoError(t, dedup.ExpireHistory(ctx, 205))
+	compareHistories(t, plain.HistoryHorizon(), txs, 8, plain, dedup, plainDb, dedupDb)
+	res, err := dedup.CheckFilesIntegrity(ctx)
+	require.NoError(t, err)
+	for _, r := range res {
+		require.True(t, r.OK(), "%s.%d-%d", r.Entity, r.FromStep, r.ToStep)
+	}
+}
+
+func TestHistorySkipNoopWrites(t *testing.T) {
+	ctx := context.Background()
+	txs := uint64(480)
+	fill := func(skip bool) (kv.RwDB, *History, int) {
+		t.Helper()
+		_, db, h := testDbAndHistory(t)
+		h.SetSkipNoopWrites(skip)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		h.SetTx(tx)
+		h.StartWrites("")
+		defer h.FinishWrites()
+		// key is written on every txNum which is multiple of the key, but its value changes only every 10th write
+		var prevVal [8][]byte
+		for txNum := uint64(1); txNum <= txs; txNum++ {
+			h.SetTxNum(txNum)
+			for keyNum := uint64(1); keyNum < 8; keyNum++ {
+				if txNum%keyNum != 0 {
+					continue
+				}
+				var k [8]byte
+				v := make([]byte, 8)
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				binary.BigEndian.PutUint64(v, txNum/keyNum/10)
+				require.NoError(t, h.AddPrevValue(k[:], nil, prevVal[keyNum]))
+				prevVal[keyNum] = v
+			}
+			if txNum%100 == 0 { // pending changes are written on flush
+				require.NoError(t, h.Rotate().Flush(ctx, tx))
+			}
+		}
+		require.NoError(t, h.Rotate().Flush(ctx, tx))
+		c, err := tx.Cursor(h.indexKeysTable)
+		require.NoError(t, err)
+		changes, err := c.Count()
+		require.NoError(t, err)
+		c.Close()
+		require.NoError(t, tx.Commit())
+		collateAndMergeHistory(t, db, h, txs)
+		return db, h, int(changes)
+	}
+	plainDb, plain, plainChanges := fill(false)
+	skipDb, skip, skipChanges := fill(true)
+	require.Less(t, skipChanges*2, plainChanges)
+	compareHistories(t, 0, txs, 8, plain, skip, plainDb, skipDb)
+}
+
+// compareHistories - GetNoState of keys [1, keys) in txNums [fromTxNum, txs] and WalkAsOf of every 50th txNum are same
+func compareHistories(t *testing.T, fromTxNum, txs, keys uint64, expect, got *History, expectDb, gotDb kv.RoDB) {
+	t.Helper()
+	ctx := context.Background()
+	ec, gc := expect.MakeContext(), got.MakeContext()
+	defer ec.Close()
+	defer gc.Close()
+	etx, err := expectDb.BeginRo(ctx)
+	require.NoError(t, err)
+	defer etx.Rollback()
+	gtx, err := gotDb.BeginRo(ctx)
+	require.NoError(t, err)
+	defer gtx.Rollback()
+	for txNum := fromTxNum; txNum <= txs; txNum++ {
+		for keyNum := uint64(1); keyNum < keys; keyNum++ {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			label := fmt.Sprintf("txNum=%d, keyNum=%d", txNum, keyNum)
+			ev, eok, err := ec.GetNoState(k[:], txNum)
+			require.NoError(t, err, label)
+			gv, gok, err := gc.GetNoState(k[:], txNum)
+			require.NoError(t, err, label)
+			require.Equal(t, eok, gok, label)
+			require.Equal(t, ev, gv, label)
+		}
+		if txNum%50 != 0 {
+			continue
+		}
+		eit, git := ec.WalkAsOf(txNum, nil, nil, order.Asc, etx, -1), gc.WalkAsOf(txNum, nil, nil, order.Asc, gtx, -1)
+		for eit.HasNext() {
+			require.True(t, git.HasNext())
+			ek, ev, err := eit.Next()
+			require.NoError(t, err)
+			gk, gv, err := git.Next()
+			require.NoError(t, err)
+			require.Equal(t, ek, gk)
+			require.Equal(t, ev, gv, fmt.Sprintf("txNum=%d, key=%x", txNum, ek))
+		}
+		require.False(t, git.HasNext())
+		eit.Close()
+		git.Close()
+	}
+}
+
+func TestHistoryBlobs(t *testing.T) {
+	ctx := context.Background()
+	txs := uint64(480)
+	fill := func(blobThreshold int, dedup bool) (kv.RwDB, *History) {
+		t.Helper()
+		_, db, h := testDbAndHistory(t)
+		h.SetBlobThreshold(blobThreshold)
+		h.SetDedupValues(dedup)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		h.SetTx(tx)
+		h.StartWrites("")
+		defer h.FinishWrites()
+		// odd keys have large values, same for all odd keys and changing every 40 txNums; even keys - small values
+		var prevVal [8][]byte
+		for txNum := uint64(1); txNum <= txs; txNum++ {
+			h.SetTxNum(txNum)
+			for keyNum := uint64(1); keyNum < 8; keyNum++ {
+				if txNum%keyNum != 0 {
+					continue
+				}
+				var k [8]byte
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				v := make([]byte, 8)
+				binary.BigEndian.PutUint64(v, txNum)
+				if keyNum%2 == 1 {
+					v = bytes.Repeat(v, 256)
+					binary.BigEndian.PutUint64(v, txNum/40)
+					v = v[:2000+txNum/40]
+				}
+				require.NoError(t, h.AddPrevValue(k[:], nil, prevVal[keyNum]))
+				prevVal[keyNum] = v
+			}
+		}
+		require.NoError(t, h.Rotate().Flush(ctx, tx))
+		require.NoError(t, tx.Commit())
+		collateAndMergeHistory(t, db, h, txs)
+		return db, h
+	}
+	vSize := func(h *History) (size int64) {
+		hc := h.MakeContext()
+		defer hc.Close()
+		for _, f := range hc.files {
+			size += f.src.decompressor.Size()
+		}
+		return size
+	}
+
+	plainDb, plain := fill(0, false)
+	blobsDb, blobs := fill(1024, false)
+	bothDb, both := fill(1024, true)
+	require.Less(t, vSize(blobs)*4, vSize(plain))
+	compareHistories(t, 0, txs, 8, plain, blobs, plainDb, blobsDb)
+	compareHistories(t, 0, txs, 8, plain, both, plainDb, bothDb)
+
+	// .vbi is rebuilt on open
+	vbis, err := filepath.Glob(filepath.Join(blobs.dir, "*.vbi"))
+	require.NoError(t, err)
+	require.NotEmpty(t, vbis)
+	blobs.closeFiles()
+	for _, f := range vbis {
+		require.NoError(t, os.Remove(f))
+	}
+	require.NoError(t, blobs.reOpenFolder())
+	compareHistories(t, 0, txs, 8, plain, blobs, plainDb, blobsDb)
+
+	require.NoError(t, plain.ExpireHistory(ctx, 205))
+	require.NoError(t, blobs.ExpireHistory(ctx, 205))
+	require.NoError(t, both.ExpireHistory(ctx, 205))
+	compareHistories(t, plain.HistoryHorizon(), txs, 8, plain, blobs, plainDb, blobsDb)
+	compareHistories(t, plain.HistoryHorizon(), txs, 8, plain, both, plainDb, bothDb)
+	res, err := both.CheckFilesIntegrity(ctx)
+	require.NoError(t, err)
+	for _, r := range res {
+		require.True(t, r.OK(), "%s.%d-%d", r.Entity, r.FromStep, r.ToStep)
+	}
+
+	// missing overflow store: reads of large values return error
+	blobs.closeFiles()
+	vbs, err := filepath.Glob(filepath.Join(blobs.dir, "*.vb*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, vbs)
+	for _, f := range vbs {
+		require.NoError(t, os.Remove(f))
+	}
+	require.NoError(t, blobs.reOpenFolder())
+	tx, err := blobsDb.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	hc := blobs.MakeContext()
+	defer hc.Close()
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	_, _, err = hc.GetNoState(k[:], 300)
+	require.ErrorContains(t, err, "no .vb file")
+	it := hc.WalkAsOf(300, nil, nil, order.Asc, tx, -1)
+	defer it.Close()
+	for err == nil && it.HasNext() {
+		_, _, err = it.Next()
+	}
+	require.ErrorContains(t, err, "no .vb file")
 }
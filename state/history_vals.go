@@ -0,0 +1,293 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// .v words of History with tagged values (dedupVals or blobThreshold > 0) have 1-byte tag:
+//
+//	valLiteral + value
+//	valRef + txNum (8 bytes) - value is same as value of same key at txNum, which is literal of same file
+//	valBlob + sha256 of value - value is in overflow store of same file: .vb (hash, value) pairs, .vbi hash -> value
+//
+// Amount of words is still equal to amount of txNums in .ef - .vi and integrity checks don't decode words.
+const (
+	valLiteral byte = 0
+	valRef     byte = 1
+	valBlob    byte = 2
+
+	valRefLen  = 1 + 8
+	valBlobLen = 1 + sha256.Size
+)
+
+// SetDedupValues - values equal to previous value of same key are stored in .v files as reference.
+// Changes format of .v files: like compressVals, must be same for all files of History (and across restarts).
+func (h *History) SetDedupValues(v bool) { h.dedupVals = v }
+
+// SetBlobThreshold - values of at least `n` bytes are stored in separate .vb file of same range, addressed by hash:
+// they don't bloat .v and its compression dictionary, and same value is stored once per file. 0 - disabled.
+// Changes format of .v files: like compressVals, must be same for all files of History (and across restarts).
+func (h *History) SetBlobThreshold(n int) { h.blobThreshold = n }
+
+func (h *History) taggedVals() bool { return h.dedupVals || h.blobThreshold > 0 }
+
+func (h *History) blobsPaths(fromStep, toStep uint64) (datPath, idxPath string) {
+	return filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vb", h.filenameBase, fromStep, toStep)),
+		filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vbi", h.filenameBase, fromStep, toStep))
+}
+
+// openBlobs - overflow store of item, if it has one. Missing .vbi is built.
+func (h *History) openBlobs(item *filesItem) (err error) {
+	datPath, idxPath := h.blobsPaths(item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep)
+	if !dir.FileExist(datPath) {
+		return nil
+	}
+	if !dir.FileExist(idxPath) {
+		d, err := compress.NewDecompressor(datPath)
+		if err != nil {
+			return err
+		}
+		idx, err := buildIndex(context.Background(), d, idxPath, h.tmpdir, d.Count()/2, true /* values */, nil)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		idx.Close()
+	}
+	blobs := &filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, frozen: item.frozen}
+	if h.lazyOpen {
+		blobs.datPath, blobs.idxPath = datPath, idxPath
+		item.blobs = blobs
+		return nil
+	}
+	if blobs.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		return err
+	}
+	if blobs.index, err = recsplit.OpenIndex(idxPath); err != nil {
+		blobs.decompressor.Close()
+		return err
+	}
+	item.blobs = blobs
+	return nil
+}
+
+// blobsWriter - overflow store of 1 file being built, file is created on first value
+type blobsWriter struct {
+	h                *History
+	fromStep, toStep uint64
+	comp             *compress.Compressor
+	seen             map[[sha256.Size]byte]struct{}
+}
+
+func (h *History) newBlobsWriter(fromStep, toStep uint64) *blobsWriter {
+	if h.blobThreshold <= 0 {
+		return nil
+	}
+	return &blobsWriter{h: h, fromStep: fromStep, toStep: toStep, seen: map[[sha256.Size]byte]struct{}{}}
+}
+
+func (w *blobsWriter) add(hash [sha256.Size]byte, val []byte) (err error) {
+	if _, ok := w.seen[hash]; ok {
+		return nil
+	}
+	if w.comp == nil {
+		datPath, _ := w.h.blobsPaths(w.fromStep, w.toStep)
+		if w.comp, err = compress.NewCompressor(context.Background(), "history blobs", datPath, w.h.tmpdir, compress.MinPatternScore, w.h.compressWorkers, log.LvlTrace); err != nil {
+			return fmt.Errorf("create %s blobs compressor: %w", w.h.filenameBase, err)
+		}
+		w.comp.SetCompressTmpFiles(w.h.compressTmp)
+	}
+	w.seen[hash] = struct{}{}
+	if err = w.comp.AddUncompressedWord(hash[:]); err != nil {
+		return err
+	}
+	if w.h.compressVals {
+		return w.comp.AddWord(val)
+	}
+	return w.comp.AddUncompressedWord(val)
+}
+
+// build - .vb and .vbi, nil if there are no large values
+func (w *blobsWriter) build(ctx context.Context) (*filesItem, error) {
+	if w == nil || w.comp == nil {
+		return nil, nil
+	}
+	defer w.close()
+	if err := w.comp.Compress(); err != nil {
+		return nil, fmt.Errorf("compress %s blobs: %w", w.h.filenameBase, err)
+	}
+	w.comp.Close()
+	w.comp = nil
+	datPath, idxPath := w.h.blobsPaths(w.fromStep, w.toStep)
+	blobs := &filesItem{startTxNum: w.fromStep * w.h.aggregationStep, endTxNum: w.toStep * w.h.aggregationStep}
+	var err error
+	if blobs.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		return nil, fmt.Errorf("open %s blobs: %w", w.h.filenameBase, err)
+	}
+	if blobs.index, err = buildIndex(ctx, blobs.decompressor, idxPath, w.h.tmpdir, len(w.seen), true /* values */, nil); err != nil {
+		blobs.closeFilesAndRemove()
+		return nil, fmt.Errorf("build %s blobs idx: %w", w.h.filenameBase, err)
+	}
+	return blobs, nil
+}
+
+func (w *blobsWriter) close() {
+	if w != nil && w.comp != nil {
+		w.comp.Close()
+		w.comp = nil
+	}
+}
+
+// valsEncoder - encodes words of 1 .v file, keys must come in order of file: by key, then by txNum
+type valsEncoder struct {
+	dedup         bool
+	blobThreshold int
+	blobs         *blobsWriter
+
+	has      bool
+	key, val []byte
+	txNum    uint64
+	buf      []byte
+}
+
+func (h *History) newValsEncoder(blobs *blobsWriter) *valsEncoder {
+	return &valsEncoder{dedup: h.dedupVals, blobThreshold: h.blobThreshold, blobs: blobs}
+}
+
+func (e *valsEncoder) encode(key []byte, txNum uint64, val []byte) ([]byte, error) {
+	if e.dedup && e.has && len(val) > valRefLen && bytes.Equal(e.key, key) && bytes.Equal(e.val, val) {
+		e.buf = append(e.buf[:0], valRef, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(e.buf[1:], e.txNum)
+		return e.buf, nil
+	}
+	e.has = true
+	e.key = append(e.key[:0], key...)
+	e.val = append(e.val[:0], val...)
+	e.txNum = txNum
+	if e.blobThreshold > 0 && len(val) >= e.blobThreshold && len(val) > valBlobLen {
+		hash := sha256.Sum256(val)
+		if err := e.blobs.add(hash, val); err != nil {
+			return nil, err
+		}
+		e.buf = append(append(e.buf[:0], valBlob), hash[:]...)
+		return e.buf, nil
+	}
+	e.buf = append(append(e.buf[:0], valLiteral), val...)
+	return e.buf, nil
+}
+
+// valsDecoder - decodes words of 1 .v file read sequentially: reference is resolved to previous value of same key
+type valsDecoder struct {
+	blobs        *filesItem
+	compressVals bool
+
+	has      bool
+	key, val []byte
+}
+
+func (d *valsDecoder) decode(key, word []byte) ([]byte, error) {
+	if len(word) == 0 {
+		return nil, fmt.Errorf("empty word of tagged .v file, key=%x", key)
+	}
+	switch word[0] {
+	case valLiteral, valBlob:
+		v := word[1:]
+		if word[0] == valBlob {
+			var err error
+			if v, err = blobVal(d.blobs, word[1:], d.compressVals, nil); err != nil {
+				return nil, err
+			}
+		}
+		d.has = true
+		d.key = append(d.key[:0], key...)
+		d.val = append(d.val[:0], v...)
+		return d.val, nil
+	case valRef:
+		if !d.has || !bytes.Equal(d.key, key) {
+			return nil, fmt.Errorf("reference without literal in tagged .v file, key=%x", key)
+		}
+		return d.val, nil
+	default:
+		return nil, fmt.Errorf("unknown tag %d of tagged .v file, key=%x", word[0], key)
+	}
+}
+
+// blobVal - value of overflow store by hash
+func blobVal(blobs *filesItem, hash []byte, compressVals bool, buf []byte) ([]byte, error) {
+	if blobs == nil {
+		return nil, fmt.Errorf("value %x is in overflow store, but there is no .vb file", hash)
+	}
+	if err := blobs.open(); err != nil {
+		return nil, err
+	}
+	g := blobs.decompressor.MakeGetter()
+	g.Reset(recsplit.NewIndexReader(blobs.index).Lookup(hash))
+	var v []byte
+	if compressVals {
+		v, _ = g.Next(buf[:0])
+	} else {
+		v, _ = g.NextUncompressed()
+	}
+	return v, nil
+}
+
+// historyVal - value of .v word at offset found by (txNum, key) in .vi. If taggedVals: reference is resolved
+// by 1 more lookup in same file, large value - by lookup in overflow store `blobs`.
+// Result is valid until next use of g (or may be buf if compressVals).
+func historyVal(g *compress.Getter, r *recsplit.IndexReader, blobs *filesItem, key []byte, offset uint64, compressVals, taggedVals bool, buf []byte) ([]byte, error) {
+	next := func() (v []byte) {
+		if compressVals {
+			v, _ = g.Next(buf[:0])
+		} else {
+			v, _ = g.NextUncompressed()
+		}
+		return v
+	}
+	g.Reset(offset)
+	v := next()
+	if !taggedVals || len(v) == 0 {
+		return v, nil
+	}
+	if v[0] == valRef && len(v) == valRefLen {
+		var txKey [8]byte
+		copy(txKey[:], v[1:])
+		g.Reset(r.Lookup2(txKey[:], key))
+		if v = next(); len(v) == 0 {
+			return v, nil
+		}
+	}
+	if v[0] == valBlob && len(v) == valBlobLen {
+		blob, err := blobVal(blobs, v[1:], compressVals, buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key=%x: %w", g.FileName(), key, err)
+		}
+		return blob, nil
+	}
+	return v[1:], nil
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+const (
+	indexHeadersFileName = "idxheaders.json"
+	openIndicesWorkers   = 16 // opening is IO-bound: page faults on headers of indices
+)
+
+// indexHeaderCache - parsed headers of recsplit indices (.vi, .efi), persisted next to files. Entry is keyed by
+// file name and valid only for same size and mtime of file (see recsplit.OpenIndexWithHeader), so ReopenFolder
+// parses headers only of changed files. Saved from the set of currently open files: entries of files removed
+// by merge are dropped, merged files are added.
+//
+// Cache is a file in snapshots dir, not a table of AggregatorV3's DB (as leases are): it describes files of the dir and
+// must stay valid when dir is copied or replaced without DB. And it's written by ReopenFolder and Close, which callers
+// may invoke while holding RwTx of same DB - write to DB there would wait for MDBX writer lock. Entries are checked
+// against bounds of file on open (recsplit.OpenIndexWithHeader), damaged entries are parsed from file.
+type indexHeaderCache struct {
+	path string
+
+	lock    sync.Mutex
+	headers map[string]recsplit.IndexHeader
+}
+
+// newIndexHeaderCache - cache is optional: broken or missing file is just an empty cache
+func newIndexHeaderCache(dir string) *indexHeaderCache {
+	c := &indexHeaderCache{path: filepath.Join(dir, indexHeadersFileName), headers: map[string]recsplit.IndexHeader{}}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return c
+	}
+	if err = json.Unmarshal(data, &c.headers); err != nil {
+		log.Debug("[snapshots] broken index headers cache", "file", c.path, "err", err)
+		c.headers = map[string]recsplit.IndexHeader{}
+	}
+	return c
+}
+
+func (c *indexHeaderCache) openIndex(path string) (*recsplit.Index, error) {
+	if c == nil {
+		return recsplit.OpenIndex(path)
+	}
+	c.lock.Lock()
+	h, ok := c.headers[filepath.Base(path)]
+	c.lock.Unlock()
+	if !ok {
+		return recsplit.OpenIndex(path)
+	}
+	return recsplit.OpenIndexWithHeader(path, &h)
+}
+
+// save - replaces content of cache by headers of `indices`, atomically
+func (c *indexHeaderCache) save(indices []*recsplit.Index) error {
+	headers := make(map[string]recsplit.IndexHeader, len(indices))
+	for _, idx := range indices {
+		headers[idx.FileName()] = idx.Header()
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("save index headers: %w", err)
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("save index headers: %w", err)
+	}
+	c.headers = headers
+	return nil
+}
+
+type pendingIndex struct {
+	item *filesItem
+	path string
+}
+
+// openIndices - opens indices of `pending` items in parallel, returns first error
+func (c *indexHeaderCache) openIndices(pending []pendingIndex) error {
+	g := &errgroup.Group{}
+	g.SetLimit(openIndicesWorkers)
+	for _, p := range pending {
+		p := p
+		g.Go(func() (err error) {
+			if p.item.index, err = c.openIndex(p.path); err != nil {
+				return fmt.Errorf("%w, %s", err, p.path)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// saveIndexHeaders - persists headers of all open indices of histories and inverted indices, see indexHeaderCache
+func (a *AggregatorV3) saveIndexHeaders() {
+	var indices []*recsplit.Index
+	collect := func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.index != nil {
+				indices = append(indices, item.index)
+			}
+		}
+		return true
+	}
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		h.files.Load().Walk(collect)
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.files.Load().Walk(collect)
+	}
+	if len(indices) == 0 { // not opened yet: keep cache of previous run
+		return
+	}
+	if err := a.idxHeaders.save(indices); err != nil {
+		log.Warn("[snapshots] index headers cache", "err", err)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+//go:generate moq -stub -out mocks.go . IndexReader HistoryReader Merger Pruner
+
+// IndexReader - read access to InvertedIndex: frozen files + recent data in db.
+// Implemented by *InvertedIndexContext. Returned iterators must be closed by `kv.Closer` if they implement it.
+type IndexReader interface {
+	// IdxRange - txNums where `key` changed in [startTxNum, endTxNum). -1 means unbounded. See kv.TemporalTx.IndexRange
+	IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error)
+	Close()
+}
+
+// HistoryReader - read access to History: frozen files + recent data in db.
+// Implemented by *HistoryContext.
+type HistoryReader interface {
+	IndexReader
+	// GetNoStateWithRecent - value of `key` before first change at or after `txNum`. ok=false means: `key` didn't change after `txNum`
+	GetNoStateWithRecent(key []byte, txNum uint64, roTx kv.Tx) (v []byte, ok bool, err error)
+	// HistoryRange - keys in [from, to) changed in [fromTxNum, toTxNum) with their values before change
+	HistoryRange(fromTxNum, toTxNum int, from, to []byte, asc order.By, limit int, roTx kv.Tx) (iter.KV, error)
+}
+
+// Merger - merge of small files into bigger ones. Implemented by *InvertedIndex and *History.
+type Merger interface {
+	// EndTxNumMinimax - txNum up to which all files are built
+	EndTxNumMinimax() uint64
+	// MergeRangesUpTo - merge files while there is something to merge in [0, maxTxNum) with files not bigger than maxSpan
+	MergeRangesUpTo(ctx context.Context, maxTxNum, maxSpan uint64, workers int) error
+}
+
+// Pruner - removal from db of data which is already in files. Implemented by *InvertedIndex and *History.
+type Pruner interface {
+	SetTx(tx kv.RwTx)
+	// Prune - deletes data of [txFrom, txTo) from db, not more than `limit` keys. Requires SetTx.
+	Prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error
+}
+
+var (
+	_ IndexReader   = (*InvertedIndexContext)(nil)
+	_ HistoryReader = (*HistoryContext)(nil)
+	_ Merger        = (*InvertedIndex)(nil)
+	_ Merger        = (*History)(nil)
+	_ Pruner        = (*InvertedIndex)(nil)
+	_ Pruner        = (*History)(nil)
+)
+
+func (ic *InvertedIndexContext) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
+	it, err := ic.IterateRange(key, startTxNum, endTxNum, asc, limit, roTx)
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (hc *HistoryContext) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
+	return hc.ic.IdxRange(key, startTxNum, endTxNum, asc, limit, roTx)
+}
+
+func (hc *HistoryContext) HistoryRange(fromTxNum, toTxNum int, from, to []byte, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
+	if asc == order.Desc {
+		return nil, fmt.Errorf("%w: HistoryRange in order.Desc", kv.ErrNotSupported)
+	}
+	if limit >= 0 || fromTxNum < 0 || toTxNum < 0 {
+		return nil, fmt.Errorf("%w: HistoryRange with limit or unbounded txNum", kv.ErrNotSupported)
+	}
+	return hc.IterateChanged(fromTxNum, toTxNum, from, to, asc, limit, roTx), nil
+}
+
+func (ii *InvertedIndex) EndTxNumMinimax() uint64 { return ii.endTxNumMinimax() }
+func (h *History) EndTxNumMinimax() uint64        { return h.endTxNumMinimax() }
+
+func (ii *InvertedIndex) Prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+	return ii.prune(ctx, txFrom, txTo, limit, logEvery)
+}
+func (h *History) Prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+	return h.prune(ctx, txFrom, txTo, limit, logEvery)
+}
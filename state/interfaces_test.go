@@ -0,0 +1,132 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/stretchr/testify/require"
+)
+
+// buildAndMerge - collate/build files, then use only Pruner and Merger contracts
+func buildAndMerge(t *testing.T, db kv.RwDB, step uint64, txs uint64, p Pruner, m Merger, build func(tx kv.RwTx, step uint64, logEvery *time.Ticker)) {
+	t.Helper()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	p.SetTx(tx)
+
+	// Leave the last 2 aggregation steps un-collated
+	for s := uint64(0); s < txs/step-1; s++ {
+		build(tx, s, logEvery)
+		require.NoError(t, p.Prune(ctx, s*step, (s+1)*step, math.MaxUint64, logEvery))
+	}
+	maxEndTxNum := m.EndTxNumMinimax()
+	require.Equal(t, (txs/step-1)*step, maxEndTxNum)
+	require.NoError(t, m.MergeRangesUpTo(ctx, maxEndTxNum, step*StepsInBiggestFile, 1))
+	require.Equal(t, maxEndTxNum, m.EndTxNumMinimax())
+	require.NoError(t, tx.Commit())
+}
+
+func TestInvIndexContracts(t *testing.T) {
+	_, db, ii, txs := filledInvIndex(t)
+	buildAndMerge(t, db, ii.aggregationStep, txs, ii, ii, func(tx kv.RwTx, step uint64, logEvery *time.Ticker) {
+		bs, err := ii.collate(context.Background(), step*ii.aggregationStep, (step+1)*ii.aggregationStep, tx, logEvery)
+		require.NoError(t, err)
+		sf, err := ii.buildFiles(context.Background(), step, bs)
+		require.NoError(t, err)
+		ii.integrateFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+	})
+	found, _, _ := ii.findMergeRange(ii.endTxNumMinimax(), ii.aggregationStep*StepsInBiggestFile)
+	require.False(t, found)
+	checkRanges(t, db, ii, txs)
+
+	tx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	var r IndexReader = ii.MakeContext()
+	defer r.Close()
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	it, err := r.IdxRange(k[:], 10, 30, order.Asc, -1, tx)
+	require.NoError(t, err)
+	txNums, err := iter.ToU64Arr(it)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29}, txNums)
+}
+
+func TestHistoryContracts(t *testing.T) {
+	_, db, h, txs := filledHistory(t)
+	buildAndMerge(t, db, h.aggregationStep, txs, h, h, func(tx kv.RwTx, step uint64, logEvery *time.Ticker) {
+		c, err := h.collate(step, step*h.aggregationStep, (step+1)*h.aggregationStep, tx, logEvery)
+		require.NoError(t, err)
+		sf, err := h.buildFiles(context.Background(), step, c)
+		require.NoError(t, err)
+		h.integrateFiles(sf, step*h.aggregationStep, (step+1)*h.aggregationStep)
+	})
+	require.False(t, h.findMergeRange(h.endTxNumMinimax(), h.aggregationStep*StepsInBiggestFile).any())
+	require.NoError(t, h.BuildOptionalMissedIndices(context.Background()))
+	checkHistoryHistory(t, db, h, txs)
+
+	tx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	var r HistoryReader = h.MakeContext()
+	defer r.Close()
+	_, err = r.HistoryRange(2, 20, nil, nil, order.Desc, -1, tx)
+	require.True(t, errors.Is(err, kv.ErrNotSupported))
+	it, err := r.HistoryRange(2, 20, nil, nil, order.Asc, -1, tx)
+	require.NoError(t, err)
+	keys, _, err := iter.ToKVArray(it)
+	require.NoError(t, err)
+	require.Equal(t, 19, len(keys))
+}
+
+func TestHistoryReaderMock(t *testing.T) {
+	m := &HistoryReaderMock{
+		IdxRangeFunc: func(key []byte, startTxNum int, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
+			return iter.Array([]uint64{1, 5, 7}), nil
+		},
+	}
+	var r HistoryReader = m
+	it, err := r.IdxRange([]byte("k"), 0, 10, order.Asc, -1, nil)
+	require.NoError(t, err)
+	txNums, err := iter.ToU64Arr(it)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 5, 7}, txNums)
+	require.Equal(t, 1, len(m.IdxRangeCalls()))
+	require.Equal(t, []byte("k"), m.IdxRangeCalls()[0].Key)
+
+	// -stub: not mocked methods return zero values
+	v, ok, err := r.GetNoStateWithRecent([]byte("k"), 1, nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Nil(t, v)
+	r.Close()
+	require.Equal(t, 1, len(m.CloseCalls()))
+}
@@ -21,6 +21,7 @@ import (
 	"container/heap"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
@@ -38,10 +39,10 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	btree2 "github.com/tidwall/btree"
 	atomic2 "go.uber.org/atomic"
-	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/cmp"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/compress"
@@ -50,10 +51,11 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/erigon-lib/segment"
 )
 
 type InvertedIndex struct {
-	files *btree2.BTreeG[*filesItem] // thread-safe, but maybe need 1 RWLock for all trees in AggregatorV3
+	files atomic2.Pointer[btree2.BTreeG[*filesItem]] // thread-safe tree, replaced as a whole by reOpenFolder (see newFilesTree)
 
 	// roFiles derivative from field `file`, but without garbage (canDelete=true, overlaps, etc...)
 	// MakeContext() using this field in zero-copy way
@@ -65,11 +67,23 @@ type InvertedIndex struct {
 	filenameBase    string
 	aggregationStep uint64
 	compressWorkers int
+	compressTmp     bool              // collation and build compress their ETL temp files, see AggregatorV3.SetCompressTmpFiles
+	collateBudget   *memBudget        // see AggregatorV3.SetCollateMemBudget
+	idxHeaders      *indexHeaderCache // nil - headers of indices are parsed on each open
 
 	integrityFileExtensions []string
 	withLocalityIndex       bool
+	lazyOpen                bool // see `filesItem.open`
+	cold                    *coldStorage
+	contentAddressed        bool         // see AggregatorV3.SetContentAddressedNames
+	disabled                atomic2.Bool // see AggregatorV3.DisableIndex
+	withoutIdx              bool         // .efi files are not built, see SetWithoutIndex
+	btIndex                 bool         // .efbt files are built, see SetBtIndex
 	localityIndex           *LocalityIndex
+	cpuLimit                *background.CPULimit // shared with other background jobs, see AggregatorV3.SetBackgroundCPULimit
 	tx                      kv.RwTx
+	historyHorizon          atomic2.Uint64 // txNums below it are removed by ExpireHistory
+	filesEndTxNum           atomic2.Uint64 // endTxNum of last file, updated on each change of files, see endTxNumMinimax
 
 	// fields for history write
 	txNum      uint64
@@ -90,13 +104,14 @@ func NewInvertedIndex(
 	ii := InvertedIndex{
 		dir:                     dir,
 		tmpdir:                  tmpdir,
-		files:                   btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false}),
+		files:                   *atomic2.NewPointer(newFilesTree()),
 		roFiles:                 *atomic2.NewPointer(&[]ctxItem{}),
 		aggregationStep:         aggregationStep,
 		filenameBase:            filenameBase,
 		indexKeysTable:          indexKeysTable,
 		indexTable:              indexTable,
 		compressWorkers:         1,
+		collateBudget:           newMemBudget(nil),
 		integrityFileExtensions: integrityFileExtensions,
 		withLocalityIndex:       withLocalityIndex,
 	}
@@ -112,26 +127,42 @@ func NewInvertedIndex(
 	//}
 	return &ii, nil
 }
+
+// reOpenFolder - copy-on-write, see newFilesTree
 func (ii *InvertedIndex) reOpenFolder() error {
-	ii.closeFiles()
+	ic := ii.MakeContext() // dropped files are closed by Close of this context, if nobody else uses them
+	defer ic.Close()
+	if err := ii.loadHistoryHorizon(); err != nil { // files below horizon are not opened
+		return fmt.Errorf("NewHistory.loadHistoryHorizon: %s, %w", ii.filenameBase, err)
+	}
 	files, err := os.ReadDir(ii.dir)
 	if err != nil {
 		return err
 	}
-	_ = ii.scanStateFiles(files, ii.integrityFileExtensions)
-	if err = ii.openFiles(); err != nil {
+	prev, next := ii.files.Load(), newFilesTree()
+	_ = ii.scanStateFilesTo(next, withOffloadedFiles(files), ii.integrityFileExtensions)
+	reuseOpenedItems(prev, next, ii.lazyOpen)
+	if err = ii.openFilesOf(next); err != nil {
+		retireDroppedItems(next, prev)
 		return fmt.Errorf("NewHistory.openFiles: %s, %w", ii.filenameBase, err)
 	}
+	ii.files.Store(next)
+	ii.reCalcRoFiles()
+	retireDroppedItems(prev, next)
 
 	return ii.localityIndex.reOpenFolder()
 }
 
 func (ii *InvertedIndex) scanStateFiles(files []fs.DirEntry, integrityFileExtensions []string) (uselessFiles []*filesItem) {
+	return ii.scanStateFilesTo(ii.files.Load(), files, integrityFileExtensions)
+}
+
+func (ii *InvertedIndex) scanStateFilesTo(tree *btree2.BTreeG[*filesItem], files []fs.DirEntry, integrityFileExtensions []string) (uselessFiles []*filesItem) {
 	re := regexp.MustCompile("^" + ii.filenameBase + ".([0-9]+)-([0-9]+).ef$")
 	var err error
 Loop:
 	for _, f := range files {
-		if !f.Type().IsRegular() {
+		if !isDataFileEntry(f) {
 			continue
 		}
 
@@ -159,10 +190,14 @@ Loop:
 
 		startTxNum, endTxNum := startStep*ii.aggregationStep, endStep*ii.aggregationStep
 		frozen := endStep-startStep == StepsInBiggestFile
+		if ii.isExpiredFile("ef", startTxNum, endTxNum) {
+			log.Debug(fmt.Sprintf("[snapshots] skip %s because it's below history horizon", name))
+			continue
+		}
 
 		for _, ext := range integrityFileExtensions {
 			requiredFile := fmt.Sprintf("%s.%d-%d.%s", ii.filenameBase, startStep, endStep, ext)
-			if !dir.FileExist(filepath.Join(ii.dir, requiredFile)) {
+			if !fileOrStubExist(filepath.Join(ii.dir, requiredFile)) {
 				log.Debug(fmt.Sprintf("[snapshots] skip %s because %s doesn't exists", name, requiredFile))
 				continue Loop
 			}
@@ -171,7 +206,7 @@ Loop:
 		var newFile = &filesItem{startTxNum: startTxNum, endTxNum: endTxNum, frozen: frozen}
 		addNewFile := true
 		var subSets []*filesItem
-		ii.files.Walk(func(items []*filesItem) bool {
+		tree.Walk(func(items []*filesItem) bool {
 			for _, item := range items {
 				if item.isSubsetOf(newFile) {
 					subSets = append(subSets, item)
@@ -189,20 +224,19 @@ Loop:
 			return true
 		})
 		//for _, subSet := range subSets {
-		//	ii.files.Delete(subSet)
+		//	tree.Delete(subSet)
 		//}
-		if addNewFile {
-			ii.files.Set(newFile)
+		if _, ok := tree.Get(newFile); addNewFile && !ok { // keep opened item: cleanupDir scans live registry
+			tree.Set(newFile)
 		}
 	}
-	ii.reCalcRoFiles()
 	return uselessFiles
 }
 
 func (ii *InvertedIndex) reCalcRoFiles() {
-	roFiles := make([]ctxItem, 0, ii.files.Len())
+	roFiles := make([]ctxItem, 0, ii.files.Load().Len())
 	var prevStart uint64
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.canDelete.Load() {
 				continue
@@ -238,13 +272,17 @@ func (ii *InvertedIndex) reCalcRoFiles() {
 		roFiles = []ctxItem{}
 	}
 	ii.roFiles.Store(&roFiles)
+	ii.filesEndTxNum.Store(lastFileEndTxNum(ii.files.Load()))
 }
 
 func (ii *InvertedIndex) missedIdxFiles() (l []*filesItem) {
-	ii.files.Walk(func(items []*filesItem) bool {
+	if ii.withoutIdx {
+		return nil
+	}
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
-			if !dir.FileExist(filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))) {
+			if !idxBuilt(item, filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))) {
 				l = append(l, item)
 			}
 		}
@@ -254,7 +292,13 @@ func (ii *InvertedIndex) missedIdxFiles() (l []*filesItem) {
 }
 
 // BuildMissedIndices - produce .efi/.vi/.kvi from .ef/.v/.kv
+// Can be interrupted: completed indices are skipped by next call, see idxBuildMarkerSuffix.
 func (ii *InvertedIndex) BuildMissedIndices(ctx context.Context, sem *semaphore.Weighted) (err error) {
+	return ii.BuildMissedIndicesWithProgress(ctx, sem, nil)
+}
+
+// BuildMissedIndicesWithProgress - BuildMissedIndices, progress of each index is added to ps (may be nil)
+func (ii *InvertedIndex) BuildMissedIndicesWithProgress(ctx context.Context, sem *semaphore.Weighted, ps *background.ProgressSet) (err error) {
 	missedFiles := ii.missedIdxFiles()
 	g, ctx := errgroup.WithContext(ctx)
 	for _, item := range missedFiles {
@@ -264,15 +308,44 @@ func (ii *InvertedIndex) BuildMissedIndices(ctx context.Context, sem *semaphore.
 				return err
 			}
 			defer sem.Release(1)
+			if _, err := ii.cpuLimit.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer ii.cpuLimit.Release(1)
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
 			fName := fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep)
 			idxPath := filepath.Join(ii.dir, fName)
 			log.Info("[snapshots] build idx", "file", fName)
-			_, err := buildIndex(ctx, item.decompressor, idxPath, ii.tmpdir, item.decompressor.Count()/2, false)
-			if err != nil {
+			if err := item.open(); err != nil {
 				return err
 			}
-			return nil
+			count := item.decompressor.Count() / 2
+			return buildMissedIdx(ps, idxPath, count, func(p *background.Progress) error {
+				idx, err := buildIndex(ctx, item.decompressor, idxPath, ii.tmpdir, count, false, p)
+				if err != nil {
+					return err
+				}
+				return idx.Close() // opened by openFiles
+			})
+		})
+	}
+	for _, item := range ii.missedBtFiles() {
+		item := item
+		g.Go(func() error {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+			if _, err := ii.cpuLimit.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer ii.cpuLimit.Release(1)
+			btPath := ii.btPath(item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep)
+			log.Info("[snapshots] build idx", "file", filepath.Base(btPath))
+			if err := item.open(); err != nil {
+				return err
+			}
+			return buildMissedBt(ctx, ps, item.decompressor, btPath)
 		})
 	}
 	if err := g.Wait(); err != nil {
@@ -282,39 +355,65 @@ func (ii *InvertedIndex) BuildMissedIndices(ctx context.Context, sem *semaphore.
 }
 
 func (ii *InvertedIndex) openFiles() error {
+	err := ii.openFilesOf(ii.files.Load())
+	ii.filesEndTxNum.Store(lastFileEndTxNum(ii.files.Load()))
+	return err
+}
+
+// openFilesOf - opens files of `tree`, items of missing files are removed from it
+func (ii *InvertedIndex) openFilesOf(tree *btree2.BTreeG[*filesItem]) error {
 	var err error
-	var totalKeys uint64
+	var pending []pendingIndex
 	var invalidFileItems []*filesItem
-	ii.files.Walk(func(items []*filesItem) bool {
+	tree.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				item.decompressor.Close()
-			}
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
 			datPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, fromStep, toStep))
-			if !dir.FileExist(datPath) {
+			if !fileOrStubExist(datPath) {
 				invalidFileItems = append(invalidFileItems, item)
 			}
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				log.Debug("InvertedIndex.openFiles: %w, %s", err, datPath)
+			if ii.lazyOpen {
+				if item.datPath == "" { // opened items are shared with contexts: only missed indices are added
+					item.datPath = datPath
+					if ii.cold != nil {
+						ii.cold.register(item)
+					}
+				}
+				if idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep)); item.idxPath == "" && fileOrStubExist(idxPath) {
+					item.idxPath = idxPath
+				}
+				if err = ii.openBt(item); err != nil {
+					return false
+				}
 				continue
 			}
+			if item.decompressor == nil {
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					log.Debug("InvertedIndex.openFiles: %w, %s", err, datPath)
+					continue
+				}
+			}
 
 			if item.index == nil {
 				idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))
 				if dir.FileExist(idxPath) {
-					if item.index, err = recsplit.OpenIndex(idxPath); err != nil {
-						log.Debug("InvertedIndex.openFiles: %w, %s", err, idxPath)
-						return false
-					}
-					totalKeys += item.index.KeyCount()
+					pending = append(pending, pendingIndex{item: item, path: idxPath})
 				}
 			}
+			if err = ii.openBt(item); err != nil {
+				log.Debug("InvertedIndex.openFiles: %w, %s", err, datPath)
+				return false
+			}
 		}
 		return true
 	})
+	if err == nil {
+		if err = ii.idxHeaders.openIndices(pending); err != nil {
+			log.Debug("InvertedIndex.openFiles: %w", err)
+		}
+	}
 	for _, item := range invalidFileItems {
-		ii.files.Delete(item)
+		tree.Delete(item)
 	}
 	if err != nil {
 		return err
@@ -323,7 +422,7 @@ func (ii *InvertedIndex) openFiles() error {
 }
 
 func (ii *InvertedIndex) closeFiles() {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.decompressor != nil {
 				if err := item.decompressor.Close(); err != nil {
@@ -337,13 +436,15 @@ func (ii *InvertedIndex) closeFiles() {
 				}
 				item.index = nil
 			}
+			item.bt.Close()
+			item.bt = nil
 		}
 		return true
 	})
 	if ii.localityIndex != nil {
 		ii.localityIndex.Close()
 	}
-	ii.files.Clear()
+	ii.files.Load().Clear()
 	ii.reCalcRoFiles()
 }
 
@@ -351,11 +452,43 @@ func (ii *InvertedIndex) Close() {
 	ii.closeFiles()
 }
 
+// SetLazyOpen - in lazy-open mode files are not mmapped by reOpenFolder, but on first use by any context.
+// Must be called before reOpenFolder.
+func (ii *InvertedIndex) SetLazyOpen(v bool) { ii.lazyOpen = v }
+
+// ErrWithoutIndex - lookup by key in files requires .efi files, but they are disabled by SetWithoutIndex
+var ErrWithoutIndex = errors.New("files are built without .efi index")
+
+// SetWithoutIndex - don't build .efi files (and LocalityIndex of History). Saves ~30% of disk space of History,
+// files still can be walked in order of keys (WalkAsOf, IterateChanged), but lookups of key in files
+// (GetNoState, IterateRange, IdxCount) return ErrWithoutIndex - unless files have .efbt (see SetBtIndex).
+// Must be set before files are built or merged.
+func (ii *InvertedIndex) SetWithoutIndex(v bool) { ii.withoutIdx = v }
+
+func (ii *InvertedIndex) errWithoutIndex() error {
+	return fmt.Errorf("%s: %w", ii.filenameBase, ErrWithoutIndex)
+}
+
+// closeIdleFiles - closes lazy-opened files which are not used by any context
+func (ii *InvertedIndex) closeIdleFiles() (closed int) {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.closeIdle() {
+				closed++
+			}
+		}
+		return true
+	})
+	return closed
+}
+
 func (ii *InvertedIndex) Files() (res []string) {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.decompressor != nil {
 				res = append(res, item.decompressor.FileName())
+			} else if item.datPath != "" {
+				res = append(res, filepath.Base(item.datPath))
 			}
 		}
 		return true
@@ -373,8 +506,13 @@ func (ii *InvertedIndex) SetTxNum(txNum uint64) {
 }
 
 func (ii *InvertedIndex) add(key, indexKey []byte) (err error) {
+	return ii.addAt(ii.txNumBytes[:], key, indexKey)
+}
+
+// addAt - add at txNum which can be before current one (it must be in same not-flushed step)
+func (ii *InvertedIndex) addAt(txNum, key, indexKey []byte) (err error) {
 	ii.walLock.RLock()
-	err = ii.wal.add(key, indexKey)
+	err = ii.wal.add(txNum, key, indexKey)
 	ii.walLock.RUnlock()
 	return err
 }
@@ -484,67 +622,84 @@ func (ii *InvertedIndex) newWriter(tmpdir string, buffered, discard bool) *inver
 	return w
 }
 
-func (ii *invertedIndexWAL) add(key, indexKey []byte) error {
+func (ii *invertedIndexWAL) add(txNum, key, indexKey []byte) error {
 	if ii.discard {
 		return nil
 	}
 
 	if ii.buffered {
-		if err := ii.indexKeys.Collect(ii.ii.txNumBytes[:], key); err != nil {
+		if err := ii.indexKeys.Collect(txNum, key); err != nil {
 			return err
 		}
 
-		if err := ii.index.Collect(indexKey, ii.ii.txNumBytes[:]); err != nil {
+		if err := ii.index.Collect(indexKey, txNum); err != nil {
 			return err
 		}
 	} else {
-		if err := ii.ii.tx.Put(ii.ii.indexKeysTable, ii.ii.txNumBytes[:], key); err != nil {
+		if err := ii.ii.tx.Put(ii.ii.indexKeysTable, txNum, key); err != nil {
 			return err
 		}
-		if err := ii.ii.tx.Put(ii.ii.indexTable, indexKey, ii.ii.txNumBytes[:]); err != nil {
+		if err := ii.ii.tx.Put(ii.ii.indexTable, indexKey, txNum); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// addFlushing - like add, but into collectors which are flushed now (after Rotate)
+func (ii *invertedIndexWAL) addFlushing(tx kv.RwTx, txNum, key, indexKey []byte) error {
+	if ii.discard {
+		return nil
+	}
+	if ii.buffered {
+		if err := ii.indexKeysFlushing.Collect(txNum, key); err != nil {
+			return err
+		}
+		return ii.indexFlushing.Collect(indexKey, txNum)
+	}
+	if err := tx.Put(ii.ii.indexKeysTable, txNum, key); err != nil {
+		return err
+	}
+	return tx.Put(ii.ii.indexTable, indexKey, txNum)
+}
+
 func (ii *InvertedIndex) MakeContext() *InvertedIndexContext {
 	var ic = InvertedIndexContext{
 		ii:    ii,
-		files: *ii.roFiles.Load(),
-	}
-	for _, item := range ic.files {
-		if !item.src.frozen {
-			item.src.refcount.Inc()
-		}
+		files: acquireRoFiles(&ii.roFiles),
 	}
 
 	if ic.ii.localityIndex != nil {
 		ic.loc.file = ic.ii.localityIndex.file
 		ic.loc.reader = ic.ii.localityIndex.NewIdxReader()
 		ic.loc.bm = ic.ii.localityIndex.bm
+		ic.loc.shards = ic.ii.localityIndex.shards
 		if ic.loc.file != nil {
 			ic.loc.file.refcount.Inc()
 		}
 	}
 	return &ic
 }
-func (ic *InvertedIndexContext) Close() {
-	for _, item := range ic.files {
-		if item.src.frozen {
-			continue
-		}
-		refCnt := item.src.refcount.Dec()
-		//GC: last reader responsible to remove useles files: close it and delete
-		if refCnt == 0 && item.src.canDelete.Load() {
-			item.src.closeFilesAndRemove()
-		}
+
+// reuse - re-acquires files of closed context, keeping getters/readers. Valid only if files set didn't change since MakeContext:
+// if some file was removed meanwhile, context sees current files.
+func (ic *InvertedIndexContext) reuse() {
+	if !acquireAll(ic.files) {
+		ic.files, ic.getters, ic.readers = acquireRoFiles(&ic.ii.roFiles), nil, nil
+	}
+	if ic.loc.file != nil {
+		ic.loc.file.refcount.Inc()
 	}
+}
+
+func (ic *InvertedIndexContext) Close() {
+	//GC: last reader responsible to remove useles files: close it and delete. Frozen files too: see ExpireHistory
+	releaseAll(ic.files)
 	if ic.loc.file != nil {
 		refCnt := ic.loc.file.refcount.Dec()
 		if refCnt == 0 && ic.loc.file.canDelete.Load() {
 			ic.ii.localityIndex.closeFilesAndRemove(ic.loc)
-			ic.loc.file, ic.loc.bm = nil, nil
+			ic.loc.file, ic.loc.bm, ic.loc.shards = nil, nil, nil
 		}
 	}
 }
@@ -571,6 +726,9 @@ type InvertedIterator struct {
 
 	res []uint64
 	bm  *roaring64.Bitmap
+
+	tracer *queryTracer // see AggregatorV3Context.EnableTracing
+	qt     *QueryTrace
 }
 
 func (it *InvertedIterator) Close() {
@@ -589,23 +747,36 @@ func (it *InvertedIterator) advanceInFiles() {
 			}
 			item := it.stack[len(it.stack)-1]
 			it.stack = it.stack[:len(it.stack)-1]
-			offset := item.reader.Lookup(it.key)
+			if it.startTxNum >= 0 && ((it.orderAscend && item.endTxNum <= uint64(it.startTxNum)) || (!it.orderAscend && item.startTxNum > uint64(it.startTxNum))) {
+				continue // whole file is before Seek position
+			}
 			g := item.getter
+			offset, ok := lookupKey(item.src, item.reader, g, it.key)
+			if !ok {
+				it.tracer.probe(it.qt, item.src.decompressor.FileName(), 1, 0, false)
+				continue
+			}
 			g.Reset(offset)
 			k, _ := g.NextUncompressed()
-			if bytes.Equal(k, it.key) {
+			if !bytes.Equal(k, it.key) {
+				it.tracer.probe(it.qt, item.src.decompressor.FileName(), 1, len(k), false)
+			} else {
 				eliasVal, _ := g.NextUncompressed()
+				it.tracer.probe(it.qt, item.src.decompressor.FileName(), 1, len(k)+len(eliasVal), true)
 				ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 
 				if it.orderAscend {
-					it.efIt = ef.Iterator()
+					efIt := ef.Iterator()
+					if it.startTxNum > 0 {
+						efIt.Seek(uint64(it.startTxNum))
+					}
+					it.efIt = efIt
 				} else {
 					it.efIt = ef.ReverseIterator()
 				}
 			}
 		}
 
-		//TODO: add seek method
 		//Asc:  [from, to) AND from > to
 		//Desc: [from, to) AND from < to
 		if it.orderAscend {
@@ -643,6 +814,7 @@ func (it *InvertedIterator) advanceInDb() {
 	var v []byte
 	var err error
 	if it.cursor == nil {
+		it.tracer.db(it.qt)
 		if it.cursor, err = it.roTx.CursorDupSort(it.indexTable); err != nil {
 			// TODO pass error properly around
 			panic(err)
@@ -750,6 +922,61 @@ func (it *InvertedIterator) advance() {
 	}
 }
 
+// Seek - moves iterator forward to the first txNum >= txNum (for descending order: <= txNum). Doesn't move back.
+// In files values before txNum are not decoded: Elias-Fano of current file is searched, files before txNum are skipped.
+func (it *InvertedIterator) Seek(txNum uint64) {
+	if it.orderAscend {
+		if int(txNum) <= it.startTxNum {
+			return
+		}
+	} else if it.startTxNum >= 0 && int(txNum) >= it.startTxNum {
+		return
+	}
+	it.startTxNum = int(txNum)
+	if !it.hasNextInFiles && !it.hasNextInDb {
+		return
+	}
+	if (it.orderAscend && it.nextN >= txNum) || (!it.orderAscend && it.nextN <= txNum) {
+		return // already there
+	}
+
+	if it.orderAscend {
+		if !it.hasNextInFiles {
+			it.seekInDb()
+			return
+		}
+		it.seekInFiles(txNum)
+		if it.hasNextInDb && !it.hasNextInFiles {
+			it.seekInDb()
+		}
+	} else {
+		if !it.hasNextInDb { // db has newer txNums
+			it.seekInFiles(txNum)
+			return
+		}
+		it.seekInDb()
+		if it.hasNextInFiles && !it.hasNextInDb {
+			it.advanceInFiles()
+		}
+	}
+}
+
+func (it *InvertedIterator) seekInFiles(txNum uint64) {
+	if efIt, ok := it.efIt.(*eliasfano32.EliasFanoIter); ok {
+		efIt.Seek(txNum)
+	}
+	it.advanceInFiles()
+}
+
+// seekInDb - cursor is re-positioned by SeekBothRange to new startTxNum
+func (it *InvertedIterator) seekInDb() {
+	if it.cursor != nil {
+		it.cursor.Close()
+		it.cursor = nil
+	}
+	it.advanceInDb()
+}
+
 func (it *InvertedIterator) HasNext() bool {
 	if it.nextErrInDB != nil || it.nextErrInFile != nil { // always true, then .Next() call will return this error
 		return true
@@ -796,29 +1023,36 @@ type InvertedIndexContext struct {
 	getters []*compress.Getter
 	readers []*recsplit.IndexReader
 	loc     ctxLocalityItem
+	tracer  *queryTracer // see AggregatorV3Context.EnableTracing
 }
 
-func (ic *InvertedIndexContext) statelessGetter(i int) *compress.Getter {
+func (ic *InvertedIndexContext) statelessGetter(i int) (*compress.Getter, error) {
 	if ic.getters == nil {
 		ic.getters = make([]*compress.Getter, len(ic.files))
 	}
 	r := ic.getters[i]
 	if r == nil {
+		if err := ic.files[i].src.open(); err != nil {
+			return nil, err
+		}
 		r = ic.files[i].src.decompressor.MakeGetter()
 		ic.getters[i] = r
 	}
-	return r
+	return r, nil
 }
-func (ic *InvertedIndexContext) statelessIdxReader(i int) *recsplit.IndexReader {
+func (ic *InvertedIndexContext) statelessIdxReader(i int) (*recsplit.IndexReader, error) {
 	if ic.readers == nil {
 		ic.readers = make([]*recsplit.IndexReader, len(ic.files))
 	}
 	r := ic.readers[i]
 	if r == nil {
+		if err := ic.files[i].src.open(); err != nil {
+			return nil, err
+		}
 		r = recsplit.NewIndexReader(ic.files[i].src.index)
 		ic.readers[i] = r
 	}
-	return r
+	return r, nil
 }
 
 func (ic *InvertedIndexContext) getFile(from, to uint64) (it ctxItem, ok bool) {
@@ -834,6 +1068,16 @@ func (ic *InvertedIndexContext) getFile(from, to uint64) (it ctxItem, ok bool) {
 // so that iteration can be done even when the inverted index is being updated.
 // [startTxNum; endNumTx)
 func (ic *InvertedIndexContext) IterateRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (*InvertedIterator, error) {
+	if asc && startTxNum >= 0 {
+		if err := ic.ii.checkHistoryHorizon(uint64(startTxNum)); err != nil {
+			return nil, err
+		}
+	}
+	if !asc && endTxNum >= 0 {
+		if err := ic.ii.checkHistoryHorizon(uint64(endTxNum) + 1); err != nil {
+			return nil, err
+		}
+	}
 	if asc && (startTxNum >= 0 && endTxNum >= 0) && startTxNum > endTxNum {
 		return nil, fmt.Errorf("startTxNum=%d epected to be lower than endTxNum=%d", startTxNum, endTxNum)
 	}
@@ -851,6 +1095,14 @@ func (ic *InvertedIndexContext) IterateRange(key []byte, startTxNum, endTxNum in
 		orderAscend: asc,
 		limit:       limit,
 	}
+	if ic.tracer != nil {
+		var from uint64
+		if startTxNum > 0 {
+			from = uint64(startTxNum)
+		}
+		it.tracer, it.qt = ic.tracer, ic.tracer.start(ic.ii.filenameBase+".IterateRange", key, from)
+		defer ic.tracer.done(it.qt, time.Now())
+	}
 	if asc {
 		for i := len(ic.files) - 1; i >= 0; i-- {
 			// [from,to) && from < to
@@ -860,9 +1112,11 @@ func (ic *InvertedIndexContext) IterateRange(key []byte, startTxNum, endTxNum in
 			if startTxNum >= 0 && ic.files[i].endTxNum <= uint64(startTxNum) {
 				break
 			}
-			it.stack = append(it.stack, ic.files[i])
-			it.stack[len(it.stack)-1].getter = it.stack[len(it.stack)-1].src.decompressor.MakeGetter()
-			it.stack[len(it.stack)-1].reader = recsplit.NewIndexReader(it.stack[len(it.stack)-1].src.index)
+			item, err := ic.lookupItem(i)
+			if err != nil {
+				return nil, err
+			}
+			it.stack = append(it.stack, item)
 			it.hasNextInFiles = true
 		}
 		it.hasNextInDb = len(it.stack) == 0 || endTxNum < 0 || it.stack[0].endTxNum < uint64(endTxNum)
@@ -875,10 +1129,11 @@ func (ic *InvertedIndexContext) IterateRange(key []byte, startTxNum, endTxNum in
 			if startTxNum >= 0 && ic.files[i].startTxNum > uint64(startTxNum) {
 				break
 			}
-
-			it.stack = append(it.stack, ic.files[i])
-			it.stack[len(it.stack)-1].getter = it.stack[len(it.stack)-1].src.decompressor.MakeGetter()
-			it.stack[len(it.stack)-1].reader = recsplit.NewIndexReader(it.stack[len(it.stack)-1].src.index)
+			item, err := ic.lookupItem(i)
+			if err != nil {
+				return nil, err
+			}
+			it.stack = append(it.stack, item)
 			it.hasNextInFiles = true
 		}
 		it.hasNextInDb = len(it.stack) == 0 || startTxNum < 0 || it.stack[len(it.stack)-1].endTxNum < uint64(startTxNum)
@@ -887,6 +1142,98 @@ func (ic *InvertedIndexContext) IterateRange(key []byte, startTxNum, endTxNum in
 	return it, nil
 }
 
+// IdxCount - amount of txNums where `key` changed in [startTxNum, endTxNum), -1 means unbounded. Doesn't iterate over txNums:
+// files fully inside range - count from Elias-Fano header, files on the edges of range - binary search in Elias-Fano.
+// Only not-frozen data in db is counted one-by-one. Useful to choose cheapest side of intersection (for example: logs filter).
+func (ic *InvertedIndexContext) IdxCount(key []byte, startTxNum, endTxNum int, roTx kv.Tx) (cnt uint64, err error) {
+	from, to := uint64(0), uint64(math.MaxUint64)
+	if startTxNum >= 0 {
+		from = uint64(startTxNum)
+		if err = ic.ii.checkHistoryHorizon(from); err != nil {
+			return 0, err
+		}
+	}
+	if endTxNum >= 0 {
+		to = uint64(endTxNum)
+	}
+	if from >= to {
+		return 0, nil
+	}
+
+	var filesEndTxNum uint64
+	for i, item := range ic.files {
+		filesEndTxNum = cmp.Max(filesEndTxNum, item.endTxNum)
+		if item.endTxNum <= from || item.startTxNum >= to {
+			continue
+		}
+		offset, ok, err := ic.lookup(i, key)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		g, err := ic.statelessGetter(i)
+		if err != nil {
+			return 0, err
+		}
+		g.Reset(offset)
+		k, _ := g.NextUncompressed()
+		if !bytes.Equal(k, key) {
+			continue
+		}
+		eliasVal, _ := g.NextUncompressed()
+		item.src.reads.hit(len(eliasVal))
+		if from <= item.startTxNum && item.endTxNum <= to {
+			cnt += eliasfano32.Count(eliasVal)
+			continue
+		}
+		ef, _ := eliasfano32.ReadEliasFano(eliasVal)
+		cnt += ef.Rank(to) - ef.Rank(from)
+	}
+	if to <= filesEndTxNum {
+		return cnt, nil
+	}
+
+	// db may have data which is already in files (not pruned yet) - count only after files
+	from = cmp.Max(from, filesEndTxNum)
+	c, err := roTx.CursorDupSort(ic.ii.indexTable)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if from == 0 && to == math.MaxUint64 {
+		k, _, err := c.SeekExact(key)
+		if err != nil {
+			return 0, err
+		}
+		if k == nil {
+			return cnt, nil
+		}
+		dups, err := c.CountDuplicates()
+		if err != nil {
+			return 0, err
+		}
+		return cnt + dups, nil
+	}
+	var fromKey [8]byte
+	binary.BigEndian.PutUint64(fromKey[:], from)
+	v, err := c.SeekBothRange(key, fromKey[:])
+	if err != nil {
+		return 0, err
+	}
+	for ; v != nil; _, v, err = c.NextDup() {
+		if err != nil {
+			return 0, err
+		}
+		if binary.BigEndian.Uint64(v) >= to {
+			break
+		}
+		cnt++
+	}
+	return cnt, nil
+}
+
 type InvertedIterator1 struct {
 	roTx           kv.Tx
 	cursor         kv.CursorDupSort
@@ -901,6 +1248,7 @@ type InvertedIterator1 struct {
 	startTxKey     [8]byte
 	hasNextInDb    bool
 	hasNextInFiles bool
+	err            error // error of lazy-open of files, see Err
 }
 
 func (it *InvertedIterator1) Close() {
@@ -997,9 +1345,12 @@ func (it *InvertedIterator1) advance() {
 }
 
 func (it *InvertedIterator1) HasNext() bool {
-	return it.hasNextInFiles || it.hasNextInDb || it.nextKey != nil
+	return it.err == nil && (it.hasNextInFiles || it.hasNextInDb || it.nextKey != nil)
 }
 
+// Err - error which stopped iteration, check it after HasNext returned false
+func (it *InvertedIterator1) Err() error { return it.err }
+
 func (it *InvertedIterator1) Next(keyBuf []byte) []byte {
 	result := append(keyBuf, it.nextKey...)
 	it.advance()
@@ -1021,6 +1372,9 @@ func (ic *InvertedIndexContext) IterateChangedKeys(startTxNum, endTxNum uint64,
 		if item.endTxNum >= endTxNum {
 			ii1.hasNextInDb = false
 		}
+		if ii1.err = item.src.open(); ii1.err != nil {
+			return ii1
+		}
 		g := item.src.decompressor.MakeGetter()
 		if g.HasNext() {
 			key, _ := g.NextUncompressed()
@@ -1037,13 +1391,14 @@ func (ic *InvertedIndexContext) IterateChangedKeys(startTxNum, endTxNum uint64,
 	return ii1
 }
 
-func (ii *InvertedIndex) collate(ctx context.Context, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.Ticker) (map[string]*roaring64.Bitmap, error) {
+// collate - result is owned by caller: must be closed
+func (ii *InvertedIndex) collate(ctx context.Context, txFrom, txTo uint64, roTx kv.Tx, logEvery *time.Ticker) (*collatedBitmaps, error) {
 	keysCursor, err := roTx.CursorDupSort(ii.indexKeysTable)
 	if err != nil {
 		return nil, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
 	defer keysCursor.Close()
-	indexBitmaps := map[string]*roaring64.Bitmap{}
+	indexBitmaps := newCollatedBitmaps(ii)
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 	var k, v []byte
@@ -1052,25 +1407,24 @@ func (ii *InvertedIndex) collate(ctx context.Context, txFrom, txTo uint64, roTx
 		if txNum >= txTo {
 			break
 		}
-		var bitmap *roaring64.Bitmap
-		var ok bool
-		if bitmap, ok = indexBitmaps[string(v)]; !ok {
-			bitmap = bitmapdb.NewBitmap64()
-			indexBitmaps[string(v)] = bitmap
+		if err = indexBitmaps.add(v, txNum); err != nil {
+			break
 		}
-		bitmap.Add(txNum)
 
 		select {
 		case <-logEvery.C:
 			log.Info("[snapshots] collate history", "name", ii.filenameBase, "range", fmt.Sprintf("%.2f-%.2f", float64(txNum)/float64(ii.aggregationStep), float64(txTo)/float64(ii.aggregationStep)))
-			bitmap.RunOptimize()
 		case <-ctx.Done():
-			err := ctx.Err()
-			return nil, err
+			indexBitmaps.close()
+			return nil, ctx.Err()
 		default:
 		}
 	}
+	if err == nil {
+		err = indexBitmaps.finish()
+	}
 	if err != nil {
+		indexBitmaps.close()
 		return nil, fmt.Errorf("iterate over %s keys cursor: %w", ii.filenameBase, err)
 	}
 	return indexBitmaps, nil
@@ -1079,6 +1433,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, txFrom, txTo uint64, roTx
 type InvertedFiles struct {
 	decomp *compress.Decompressor
 	index  *recsplit.Index
+	bt     *BtIndex
 }
 
 func (sf InvertedFiles) Close() {
@@ -1088,45 +1443,39 @@ func (sf InvertedFiles) Close() {
 	if sf.index != nil {
 		sf.index.Close()
 	}
+	sf.bt.Close()
 }
 
-func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps map[string]*roaring64.Bitmap) (InvertedFiles, error) {
-	var decomp *compress.Decompressor
-	var index *recsplit.Index
-	var comp *compress.Compressor
-	var err error
-	closeComp := true
-	defer func() {
-		if closeComp {
-			if comp != nil {
-				comp.Close()
-			}
-			if decomp != nil {
-				decomp.Close()
-			}
-			if index != nil {
-				index.Close()
-			}
-		}
-	}()
-	txNumFrom := step * ii.aggregationStep
-	txNumTo := (step + 1) * ii.aggregationStep
-	datPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, txNumFrom/ii.aggregationStep, txNumTo/ii.aggregationStep))
-	comp, err = compress.NewCompressor(ctx, "ef", datPath, ii.tmpdir, compress.MinPatternScore, ii.compressWorkers, log.LvlTrace)
+// buildFiles - consumes `bitmaps`: closes them
+func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps *collatedBitmaps) (InvertedFiles, error) {
+	defer bitmaps.close()
+	sf, _, err := ii.buildEfFiles(ctx, step, bitmaps, ii.compressWorkers)
+	return sf, err
+}
+
+// buildEfFiles - .ef file of step with its indices. History builds its .ef files by it too
+func (ii *InvertedIndex) buildEfFiles(ctx context.Context, step uint64, bitmaps *collatedBitmaps, workers int) (sf InvertedFiles, stats FileStats, err error) {
+	args := segment.WriterArgs{
+		DataPath: filepath.Join(ii.dir, segment.FileName(ii.filenameBase, step, step+1, "ef")),
+		TmpDir:   ii.tmpdir,
+		Workers:  workers,
+		Stats:    &stats,
+
+		CompressTmp: ii.compressTmp,
+	}
+	if !ii.withoutIdx {
+		args.IndexPath = filepath.Join(ii.dir, segment.FileName(ii.filenameBase, step, step+1, "efi"))
+	}
+	if ii.contentAddressed {
+		args.Sealed = addressByContent
+	}
+	w, err := segment.NewWriter(ctx, "ef", args)
 	if err != nil {
-		return InvertedFiles{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
+		return sf, stats, err
 	}
+	defer w.Close()
 	var buf []byte
-	keys := make([]string, 0, len(bitmaps))
-	for key := range bitmaps {
-		keys = append(keys, key)
-	}
-	slices.Sort(keys)
-	for _, key := range keys {
-		if err = comp.AddUncompressedWord([]byte(key)); err != nil {
-			return InvertedFiles{}, fmt.Errorf("add %s key [%x]: %w", ii.filenameBase, key, err)
-		}
-		bitmap := bitmaps[key]
+	if err = bitmaps.forEach(func(key []byte, bitmap *roaring64.Bitmap) error {
 		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
 		it := bitmap.Iterator()
 		for it.HasNext() {
@@ -1134,41 +1483,40 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps ma
 		}
 		ef.Build()
 		buf = ef.AppendBytes(buf[:0])
-		if err = comp.AddUncompressedWord(buf); err != nil {
-			return InvertedFiles{}, fmt.Errorf("add %s val: %w", ii.filenameBase, err)
-		}
+		return w.Add(key, buf)
+	}); err != nil {
+		return sf, stats, err
 	}
-	if err = comp.Compress(); err != nil {
-		return InvertedFiles{}, fmt.Errorf("compress %s: %w", ii.filenameBase, err)
-	}
-	comp.Close()
-	comp = nil
-	if decomp, err = compress.NewDecompressor(datPath); err != nil {
-		return InvertedFiles{}, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
+	files, err := w.Build()
+	if err != nil {
+		return sf, stats, err
 	}
-	idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, txNumFrom/ii.aggregationStep, txNumTo/ii.aggregationStep))
-	if index, err = buildIndex(ctx, decomp, idxPath, ii.tmpdir, len(keys), false /* values */); err != nil {
-		return InvertedFiles{}, fmt.Errorf("build %s efi: %w", ii.filenameBase, err)
+	bt, err := ii.buildBt(ctx, files.Decomp, step, step+1)
+	if err != nil {
+		files.Close()
+		return sf, stats, err
 	}
-	closeComp = false
-	return InvertedFiles{decomp: decomp, index: index}, nil
+	return InvertedFiles{decomp: files.Decomp, index: files.Index, bt: bt}, stats, nil
 }
 
 func (ii *InvertedIndex) integrateFiles(sf InvertedFiles, txNumFrom, txNumTo uint64) {
-	ii.files.Set(&filesItem{
+	ii.files.Load().Set(&filesItem{
 		frozen:       (txNumTo-txNumFrom)/ii.aggregationStep == StepsInBiggestFile,
 		startTxNum:   txNumFrom,
 		endTxNum:     txNumTo,
 		decompressor: sf.decomp,
 		index:        sf.index,
+		bt:           sf.bt,
 	})
 	ii.reCalcRoFiles()
 }
 
-func (ii *InvertedIndex) warmup(txFrom, limit uint64, tx kv.Tx) error {
+// warmup - reads keys of [txFrom; txTo) and their index entries into page cache. Stops on txNum boundary
+// when read size reaches budget (0 - no budget). Returns txNum up to which data is warm and read size.
+func (ii *InvertedIndex) warmup(ctx context.Context, txFrom, txTo, budget uint64, tx kv.Tx) (warmedTo, size uint64, err error) {
 	keysCursor, err := tx.CursorDupSort(ii.indexKeysTable)
 	if err != nil {
-		return fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
+		return 0, 0, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
 	defer keysCursor.Close()
 	var txKey [8]byte
@@ -1176,36 +1524,53 @@ func (ii *InvertedIndex) warmup(txFrom, limit uint64, tx kv.Tx) error {
 	var k, v []byte
 	idxC, err := tx.CursorDupSort(ii.indexTable)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer idxC.Close()
-	k, v, err = keysCursor.Seek(txKey[:])
-	if err != nil {
-		return err
-	}
-	if k == nil {
-		return nil
-	}
-	txFrom = binary.BigEndian.Uint64(k)
-	txTo := txFrom + ii.aggregationStep
-	if limit != math.MaxUint64 && limit != 0 {
-		txTo = txFrom + limit
-	}
-	for ; err == nil && k != nil; k, v, err = keysCursor.Next() {
+	warmedTo = txTo
+	var prevTxNum uint64
+	for k, v, err = keysCursor.Seek(txKey[:]); err == nil && k != nil; k, v, err = keysCursor.Next() {
+		if err = ctx.Err(); err != nil {
+			return 0, 0, err
+		}
 		txNum := binary.BigEndian.Uint64(k)
 		if txNum >= txTo {
 			break
 		}
+		if budget > 0 && size >= budget && txNum != prevTxNum {
+			warmedTo = txNum
+			break
+		}
+		prevTxNum = txNum
 		_, _ = idxC.SeekBothRange(v, k)
+		size += uint64(len(k) + 2*len(v))
 	}
 	if err != nil {
-		return fmt.Errorf("iterate over %s keys: %w", ii.filenameBase, err)
+		return 0, 0, fmt.Errorf("iterate over %s keys: %w", ii.filenameBase, err)
 	}
-	return nil
+	return warmedTo, size, nil
 }
 
 // [txFrom; txTo)
+// pruneFrontier - first txNum in db, math.MaxUint64 if there is nothing
+func (ii *InvertedIndex) pruneFrontier(tx kv.Tx) uint64 {
+	fst, _ := kv.FirstKey(tx, ii.indexKeysTable)
+	if len(fst) < 8 {
+		return math.MaxUint64
+	}
+	return binary.BigEndian.Uint64(fst)
+}
+
 func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+	return ii.pruneWithStat(ctx, txFrom, txTo, limit, logEvery, nil)
+}
+
+// pruneWithStat - prune which counts deleted records into `stat`, if it's not nil
+func (ii *InvertedIndex) pruneWithStat(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker, stat *EntityPruneStat) error {
+	if stat != nil {
+		defer func(t time.Time) { stat.Took += time.Since(t) }(time.Now())
+		stat.PrunedTo = txTo
+	}
 	keysCursor, err := ii.tx.RwCursorDupSort(ii.indexKeysTable)
 	if err != nil {
 		return fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
@@ -1224,6 +1589,9 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 	if limit != math.MaxUint64 && limit != 0 {
 		txTo = cmp.Min(txTo, txFrom+limit)
 	}
+	if stat != nil {
+		stat.PrunedTo = txTo
+	}
 	if txFrom >= txTo {
 		return nil
 	}
@@ -1246,6 +1614,8 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 			if err = idxC.DeleteExact(v, k); err != nil {
 				return err
 			}
+			stat.deleted(ii.indexTable, v, k)
+			stat.deleted(ii.indexKeysTable, k, v)
 			//for vv, err := idxC.SeekBothRange(v, k); vv != nil; _, vv, err = idxC.NextDup() {
 			//	if err != nil {
 			//		return err
@@ -1265,6 +1635,9 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 		}
 		select {
 		case <-ctx.Done():
+			if stat != nil {
+				stat.PrunedTo = txNum + 1
+			}
 			return nil
 		case <-logEvery.C:
 			log.Info("[snapshots] prune history", "name", ii.filenameBase, "range", fmt.Sprintf("%.2f-%.2f", float64(txNum)/float64(ii.aggregationStep), float64(txTo)/float64(ii.aggregationStep)))
@@ -1278,8 +1651,11 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 }
 
 func (ii *InvertedIndex) DisableReadAhead() {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.DisableReadAhead()
 			if item.index != nil {
 				item.index.DisableReadAhead()
@@ -1290,8 +1666,11 @@ func (ii *InvertedIndex) DisableReadAhead() {
 }
 
 func (ii *InvertedIndex) EnableReadAhead() *InvertedIndex {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableReadAhead()
 			if item.index != nil {
 				item.index.EnableReadAhead()
@@ -1302,8 +1681,11 @@ func (ii *InvertedIndex) EnableReadAhead() *InvertedIndex {
 	return ii
 }
 func (ii *InvertedIndex) EnableMadvWillNeed() *InvertedIndex {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableWillNeed()
 			if item.index != nil {
 				item.index.EnableWillNeed()
@@ -1314,8 +1696,11 @@ func (ii *InvertedIndex) EnableMadvWillNeed() *InvertedIndex {
 	return ii
 }
 func (ii *InvertedIndex) EnableMadvNormalReadAhead() *InvertedIndex {
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
+			if item.decompressor == nil { // lazy-open and not opened yet
+				continue
+			}
 			item.decompressor.EnableMadvNormal()
 			if item.index != nil {
 				item.index.EnableMadvNormal()
@@ -1327,10 +1712,10 @@ func (ii *InvertedIndex) EnableMadvNormalReadAhead() *InvertedIndex {
 }
 
 func (ii *InvertedIndex) collectFilesStat() (filesCount, filesSize, idxSize uint64) {
-	if ii.files == nil {
+	if ii.files.Load() == nil {
 		return 0, 0, 0
 	}
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.index == nil {
 				return false
@@ -1344,7 +1729,10 @@ func (ii *InvertedIndex) collectFilesStat() (filesCount, filesSize, idxSize uint
 	return filesCount, filesSize, idxSize
 }
 
-func (ii *InvertedIndex) CleanupDir() {
+func (ii *InvertedIndex) CleanupDir() { ii.cleanupDir(nil) }
+
+// cleanupDir - files for which `keep` returns true stay on disk
+func (ii *InvertedIndex) cleanupDir(keep func(f *filesItem) bool) {
 	files, err := os.ReadDir(ii.dir)
 	if err != nil {
 		log.Warn("[clean] can't read dir", "err", err, "dir", ii.dir)
@@ -1352,12 +1740,18 @@ func (ii *InvertedIndex) CleanupDir() {
 	}
 	uselessFiles := ii.scanStateFiles(files, ii.integrityFileExtensions)
 	for _, f := range uselessFiles {
+		if keep != nil && keep(f) {
+			continue
+		}
 		fName := fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, f.startTxNum/ii.aggregationStep, f.endTxNum/ii.aggregationStep)
-		err = os.Remove(filepath.Join(ii.dir, fName))
+		err = removeDataFile(filepath.Join(ii.dir, fName))
 		log.Debug("[clean] remove", "file", fName, "err", err)
+		removeFileStats(filepath.Join(ii.dir, fName))
 		fIdxName := fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, f.startTxNum/ii.aggregationStep, f.endTxNum/ii.aggregationStep)
 		err = os.Remove(filepath.Join(ii.dir, fIdxName))
 		log.Debug("[clean] remove", "file", fName, "err", err)
+		_ = os.Remove(ii.btPath(f.startTxNum/ii.aggregationStep, f.endTxNum/ii.aggregationStep))
 	}
+	removeOrphanContentFiles(ii.dir, ii.filenameBase)
 	ii.localityIndex.CleanupDir()
 }
@@ -31,6 +31,7 @@ import (
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
+	atomic2 "go.uber.org/atomic"
 
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
@@ -95,10 +96,10 @@ func TestInvIndexCollationBuild(t *testing.T) {
 
 	bs, err := ii.collate(ctx, 0, 7, roTx, logEvery)
 	require.NoError(t, err)
-	require.Equal(t, 3, len(bs))
-	require.Equal(t, []uint64{3}, bs["key2"].ToArray())
-	require.Equal(t, []uint64{2, 6}, bs["key1"].ToArray())
-	require.Equal(t, []uint64{6}, bs["key3"].ToArray())
+	require.Equal(t, 3, len(bs.m))
+	require.Equal(t, []uint64{3}, bs.m["key2"].ToArray())
+	require.Equal(t, []uint64{2, 6}, bs.m["key1"].ToArray())
+	require.Equal(t, []uint64{6}, bs.m["key3"].ToArray())
 
 	sf, err := ii.buildFiles(ctx, 0, bs)
 	require.NoError(t, err)
@@ -377,6 +378,151 @@ func mergeInverted(tb testing.TB, db kv.RwDB, ii *InvertedIndex, txs uint64) {
 	require.NoError(tb, err)
 }
 
+func TestInvIndexDeferredDeletion(t *testing.T) {
+	_, db, ii, _ := filledInvIndex(t)
+	ctx := context.Background()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	for step := uint64(0); step < 2; step++ {
+		bs, err := ii.collate(ctx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, tx, logEvery)
+		require.NoError(t, err)
+		sf, err := ii.buildFiles(ctx, step, bs)
+		require.NoError(t, err)
+		ii.integrateFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+	}
+
+	old := ii.MakeContext() // holds getter of file which will be merged
+	require.Equal(t, 2, len(old.files))
+	out := old.files[0].src
+	datPath := out.decompressor.FilePath()
+	g, err := old.statelessGetter(0)
+	require.NoError(t, err)
+
+	ic := ii.MakeContext()
+	outs, _ := ii.staticFilesInRange(0, 2*ii.aggregationStep, ic)
+	in, err := ii.mergeFiles(ctx, outs, 0, 2*ii.aggregationStep, 1)
+	require.NoError(t, err)
+	ii.integrateMergedFiles(outs, in)
+	ic.Close()
+
+	require.True(t, out.canDelete.Load())
+	require.FileExists(t, datPath)
+	g.Reset(0)
+	require.True(t, g.HasNext())
+	ic = ii.MakeContext()
+	require.Equal(t, 1, len(ic.files))
+	ic.Close()
+
+	old.Close() // last context: file is removed
+	require.NoFileExists(t, datPath)
+	require.Nil(t, out.decompressor)
+	require.False(t, out.acquire())
+
+	// not used by any context: removed right away
+	ii.files.Load().Delete(in)
+	ii.reCalcRoFiles()
+	inPath := in.decompressor.FilePath()
+	in.markDeleted()
+	require.NoFileExists(t, inPath)
+	require.Equal(t, int32(-1), in.readers.Load())
+}
+
+func TestInvIndexCount(t *testing.T) {
+	test := func(t *testing.T, db kv.RwDB, ii *InvertedIndex) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		ic := ii.MakeContext()
+		defer ic.Close()
+		for _, keyNum := range []uint64{1, 3, 17, 31, 100} {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			for _, r := range [][2]int{{-1, -1}, {0, 1000}, {10, 20}, {5, 999}, {17, 800}, {900, -1}, {20, 10}} {
+				label := fmt.Sprintf("key=%d, range=%d", keyNum, r)
+				cnt, err := ic.IdxCount(k[:], r[0], r[1], tx)
+				require.NoError(t, err, label)
+				var expect int
+				if r[0] < 0 || r[1] < 0 || r[0] < r[1] {
+					it, err := ic.IterateRange(k[:], r[0], r[1], order.Asc, -1, tx)
+					require.NoError(t, err, label)
+					expect = len(it.ToArray())
+				}
+				require.Equal(t, expect, int(cnt), label)
+			}
+		}
+	}
+	t.Run("db", func(t *testing.T) {
+		_, db, ii, _ := filledInvIndex(t)
+		test(t, db, ii)
+	})
+	t.Run("files", func(t *testing.T) {
+		_, db, ii, txs := filledInvIndex(t)
+		mergeInverted(t, db, ii, txs)
+		test(t, db, ii)
+	})
+}
+
+func TestInvIndexSeek(t *testing.T) {
+	test := func(t *testing.T, db kv.RwDB, ii *InvertedIndex) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		ic := ii.MakeContext()
+		defer ic.Close()
+		for _, keyNum := range []uint64{1, 3, 17, 31} {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			it, err := ic.IterateRange(k[:], -1, -1, order.Asc, -1, tx)
+			require.NoError(t, err)
+			all := it.ToArray()
+			it.Close()
+			for _, seek := range []uint64{0, 5, 100, 511, 512, 700, 960, 999, 2000} {
+				label := fmt.Sprintf("key=%d, seek=%d", keyNum, seek)
+
+				it, err := ic.IterateRange(k[:], -1, -1, order.Asc, -1, tx)
+				require.NoError(t, err, label)
+				first, _ := it.Next()
+				it.Seek(seek)
+				expect := []uint64{first}
+				for _, n := range all[1:] {
+					if n >= seek {
+						expect = append(expect, n)
+					}
+				}
+				require.Equal(t, expect, append([]uint64{first}, it.ToArray()...), label)
+				it.Close()
+
+				it, err = ic.IterateRange(k[:], 10_000, -1, order.Desc, -1, tx)
+				require.NoError(t, err, label)
+				first, _ = it.Next()
+				it.Seek(seek)
+				expect = []uint64{first}
+				for i := len(all) - 2; i >= 0; i-- {
+					if all[i] <= seek {
+						expect = append(expect, all[i])
+					}
+				}
+				require.Equal(t, expect, append([]uint64{first}, it.ToArray()...), label)
+				it.Close()
+			}
+		}
+	}
+	t.Run("db", func(t *testing.T) {
+		_, db, ii, _ := filledInvIndex(t)
+		test(t, db, ii)
+	})
+	t.Run("files", func(t *testing.T) {
+		_, db, ii, txs := filledInvIndex(t)
+		mergeInverted(t, db, ii, txs)
+		test(t, db, ii)
+	})
+}
+
 func TestInvIndexRanges(t *testing.T) {
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
@@ -499,7 +645,7 @@ func TestChangedKeysIterator(t *testing.T) {
 
 func TestScanStaticFiles(t *testing.T) {
 	ii := &InvertedIndex{filenameBase: "test", aggregationStep: 1,
-		files: btree2.NewBTreeG[*filesItem](filesItemLess),
+		files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess)),
 	}
 	ffs := fstest.MapFS{
 		"test.0-1.ef": {},
@@ -513,7 +659,7 @@ func TestScanStaticFiles(t *testing.T) {
 	require.NoError(t, err)
 	ii.scanStateFiles(files, nil)
 	var found []string
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			found = append(found, fmt.Sprintf("%d-%d", item.startTxNum, item.endTxNum))
 		}
@@ -521,19 +667,173 @@ func TestScanStaticFiles(t *testing.T) {
 	})
 	require.Equal(t, 6, len(found))
 
-	ii.files.Clear()
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Clear()
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			fmt.Printf("%s\n", fmt.Sprintf("%d-%d", item.startTxNum, item.endTxNum))
 		}
 		return true
 	})
 	ii.scanStateFiles(files, []string{"v"})
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			fmt.Printf("%s\n", fmt.Sprintf("%d-%d", item.startTxNum, item.endTxNum))
 		}
 		return true
 	})
-	require.Equal(t, 0, ii.files.Len())
+	require.Equal(t, 0, ii.files.Load().Len())
+}
+
+func TestInvIndexLazyOpen(t *testing.T) {
+	path, db, ii, txs := filledInvIndex(t)
+	mergeInverted(t, db, ii, txs)
+
+	var err error
+	ii, err = NewInvertedIndex(path, path, ii.aggregationStep, ii.filenameBase, ii.indexKeysTable, ii.indexTable, false, nil)
+	require.NoError(t, err)
+	defer ii.Close()
+	ii.SetLazyOpen(true)
+	require.NoError(t, ii.reOpenFolder())
+
+	opened := func() (n int) {
+		ii.files.Load().Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.decompressor != nil {
+					n++
+				}
+			}
+			return true
+		})
+		return n
+	}
+	require.Equal(t, 0, opened())
+	require.NotEmpty(t, ii.Files())
+
+	checkRanges(t, db, ii, txs)
+	require.Greater(t, opened(), 0)
+
+	ic := ii.MakeContext()
+	require.Equal(t, 0, ii.closeIdleFiles()) // pinned by context
+	ic.Close()
+	require.Greater(t, ii.closeIdleFiles(), 0)
+	require.Equal(t, 0, opened())
+
+	checkRanges(t, db, ii, txs) // re-open after close
+
+	// missing file: open error is returned by readers, not panic
+	require.Greater(t, ii.closeIdleFiles(), 0)
+	var datPath string
+	ii.files.Load().Walk(func(items []*filesItem) bool {
+		datPath = items[0].datPath
+		return false
+	})
+	require.NoError(t, os.Rename(datPath, datPath+".bak"))
+	defer os.Rename(datPath+".bak", datPath)
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	ic = ii.MakeContext()
+	defer ic.Close()
+	it := ic.IterateChangedKeys(0, txs, roTx)
+	defer it.Close()
+	require.False(t, it.HasNext())
+	require.ErrorContains(t, it.Err(), "lazy open")
+}
+
+func TestInvIndexReOpenFolderCopyOnWrite(t *testing.T) {
+	_, db, ii, txs := filledInvIndex(t)
+	mergeInverted(t, db, ii, txs)
+
+	ic := ii.MakeContext()
+	require.NotEmpty(t, ic.files)
+	last := ic.files[len(ic.files)-1].src
+
+	// unchanged folder: opened files are reused, context keeps its view
+	require.NoError(t, ii.reOpenFolder())
+	ic2 := ii.MakeContext()
+	require.Equal(t, len(ic.files), len(ic2.files))
+	for i := range ic.files {
+		require.Same(t, ic.files[i].src, ic2.files[i].src)
+	}
+	ic2.Close()
+
+	// file disappeared from folder: new contexts don't see it, old one still reads it
+	fromStep, toStep := last.startTxNum/ii.aggregationStep, last.endTxNum/ii.aggregationStep
+	for _, ext := range []string{"ef", "efi"} {
+		require.NoError(t, os.Remove(fmt.Sprintf("%s/%s.%d-%d.%s", ii.dir, ii.filenameBase, fromStep, toStep, ext)))
+	}
+	require.NoError(t, ii.reOpenFolder())
+	ic2 = ii.MakeContext()
+	require.Equal(t, len(ic.files)-1, len(ic2.files))
+	ic2.Close()
+
+	require.NotNil(t, last.decompressor)
+	g := last.decompressor.MakeGetter()
+	require.True(t, g.HasNext())
+	ic.Close()
+	require.Nil(t, last.decompressor) // closed by last context
+}
+
+func TestInvIndexWarmupScheduler(t *testing.T) {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, ii, _ := filledInvIndex(t)
+	ctx := context.Background()
+	targets := []warmupTarget{{name: ii.filenameBase, keysTable: ii.indexKeysTable, warmup: ii.warmup}}
+	s := &warmupScheduler{budget: 2_000}
+
+	var warmedTo uint64
+	err := db.View(ctx, func(tx kv.Tx) error {
+		if err := s.run(ctx, tx, targets, 0, 500); err != nil {
+			return err
+		}
+		warmedTo = s.warmedTo(ii.filenameBase)
+		require.Greater(t, warmedTo, uint64(1))
+		require.Less(t, warmedTo, uint64(500), "budget must stop warmup")
+		require.GreaterOrEqual(t, s.residentBytes(), s.budget)
+
+		// budget is exhausted: nothing to read until prune
+		require.NoError(t, s.run(ctx, tx, targets, 0, 500))
+		require.Equal(t, warmedTo, s.warmedTo(ii.filenameBase))
+
+		// cancelled
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, _, err := ii.warmup(cancelled, 0, 500, 0, tx)
+		require.ErrorIs(t, err, context.Canceled)
+		return nil
+	})
+	require.NoError(t, err)
+
+	prune := func(txTo uint64) {
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		ii.SetTx(tx)
+		func() {
+			defer s.trackPrune(tx, targets)()
+			require.NoError(t, ii.prune(ctx, 0, txTo, math.MaxUint64, logEvery))
+		}()
+		require.NoError(t, tx.Commit())
+	}
+
+	prune(warmedTo) // only warmed data
+	require.Equal(t, uint64(1), s.keptUp)
+	require.Equal(t, uint64(0), s.fellBehind)
+	require.Equal(t, uint64(0), s.residentBytes())
+
+	prune(warmedTo + 100) // not warmed
+	require.Equal(t, uint64(1), s.keptUp)
+	require.Equal(t, uint64(1), s.fellBehind)
+
+	// next run starts from prune position
+	err = db.View(ctx, func(tx kv.Tx) error {
+		s.budget = 0
+		if err := s.run(ctx, tx, targets, 0, 100); err != nil {
+			return err
+		}
+		require.Equal(t, warmedTo+200, s.warmedTo(ii.filenameBase))
+		return nil
+	})
+	require.NoError(t, err)
 }
@@ -0,0 +1,201 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Leases - external readers (other processes: rpcdaemon, ...) read history of txNums [FromTxNum, ToTxNum) directly
+// from db and files. Unlike PruneHorizons, leases are persisted: they survive restart of both sides.
+// While lease is active:
+//   - prune doesn't delete data of leased range from db
+//   - files of leased range replaced by merge are closed, but stay on disk (until CleanDir after lease expired)
+//
+// Leases are kept in settings table of accounts (see leaseKeyPrefix), by name of consumer: 1 lease per name.
+const leaseKeyPrefix = "Lease."
+
+type Lease struct {
+	Name               string
+	FromTxNum, ToTxNum uint64
+	Expires            time.Time
+}
+
+func (l Lease) Expired(now time.Time) bool { return !now.Before(l.Expires) }
+
+// overlaps - range [fromTxNum, toTxNum) has txNums of lease
+func (l Lease) overlaps(fromTxNum, toTxNum uint64) bool {
+	return fromTxNum < l.ToTxNum && l.FromTxNum < toTxNum
+}
+
+type leases []Lease
+
+func (ls leases) overlaps(fromTxNum, toTxNum uint64) bool {
+	for _, l := range ls {
+		if l.overlaps(fromTxNum, toTxNum) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneLimit - txTo which prune of [txFrom, txTo) must respect
+func (ls leases) pruneLimit(txFrom, txTo uint64) uint64 {
+	for _, l := range ls {
+		if l.overlaps(txFrom, txTo) {
+			txTo = l.FromTxNum
+		}
+	}
+	if txTo < txFrom {
+		return txFrom
+	}
+	return txTo
+}
+
+// Lease - creates or extends lease of consumer `name`: ttl counts from now
+func (a *AggregatorV3) Lease(tx kv.RwTx, name string, fromTxNum, toTxNum uint64, ttl time.Duration) error {
+	if name == "" || fromTxNum >= toTxNum || ttl <= 0 {
+		return fmt.Errorf("lease %q: invalid range %d-%d or ttl %s", name, fromTxNum, toTxNum, ttl)
+	}
+	v := make([]byte, 24)
+	binary.BigEndian.PutUint64(v, fromTxNum)
+	binary.BigEndian.PutUint64(v[8:], toTxNum)
+	binary.BigEndian.PutUint64(v[16:], uint64(time.Now().Add(ttl).UnixNano()))
+	return tx.Put(a.accounts.settingsTable, []byte(leaseKeyPrefix+name), v)
+}
+
+func (a *AggregatorV3) ReleaseLease(tx kv.RwTx, name string) error {
+	return tx.Delete(a.accounts.settingsTable, []byte(leaseKeyPrefix+name))
+}
+
+// Leases - all leases, including expired: for admin listing
+func (a *AggregatorV3) Leases(tx kv.Tx) (res []Lease, err error) {
+	c, err := tx.Cursor(a.accounts.settingsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	prefix := []byte(leaseKeyPrefix)
+	for k, v, err := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v, err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != 24 {
+			return nil, fmt.Errorf("lease %q: value of len %d", k[len(prefix):], len(v))
+		}
+		res = append(res, Lease{
+			Name:      string(k[len(prefix):]),
+			FromTxNum: binary.BigEndian.Uint64(v),
+			ToTxNum:   binary.BigEndian.Uint64(v[8:]),
+			Expires:   time.Unix(0, int64(binary.BigEndian.Uint64(v[16:]))),
+		})
+	}
+	return res, nil
+}
+
+func (a *AggregatorV3) activeLeases(tx kv.Tx) (res leases, err error) {
+	all, err := a.Leases(tx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, l := range all {
+		if !l.Expired(now) {
+			res = append(res, l)
+		}
+	}
+	return res, nil
+}
+
+// activeLeasesOfDB - for background merge and CleanDir: they have no tx
+func (a *AggregatorV3) activeLeasesOfDB(ctx context.Context) (res leases, err error) {
+	if a.db == nil {
+		return nil, nil
+	}
+	if err = a.db.View(ctx, func(tx kv.Tx) error {
+		res, err = a.activeLeases(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pruneExpiredLeases - housekeeping, on prune
+func (a *AggregatorV3) pruneExpiredLeases(tx kv.RwTx) error {
+	all, err := a.Leases(tx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, l := range all {
+		if l.Expired(now) {
+			if err = a.ReleaseLease(tx, l.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markLeased - files which merge replaces, but which have txNums of active lease: they stay on disk
+func (a *AggregatorV3) markLeased(ctx context.Context, outs SelectedStaticFilesV3) error {
+	ls, err := a.activeLeasesOfDB(ctx)
+	if err != nil || len(ls) == 0 {
+		return err
+	}
+	for _, group := range [][]*filesItem{outs.accountsIdx, outs.accountsHist, outs.storageIdx, outs.storageHist, outs.codeIdx, outs.codeHist,
+		outs.logAddrs, outs.logTopics, outs.tracesFrom, outs.tracesTo} {
+		for _, item := range group {
+			if item != nil && ls.overlaps(item.startTxNum, item.endTxNum) {
+				item.leased.Store(true)
+			}
+		}
+	}
+	return nil
+}
+
+// CleanDir - remove all useless files. call it manually on startup of Main application (don't call it from utilities)
+// Files of ranges of active leases (see Lease) are kept. If leases can't be read - nothing is removed, error is logged.
+func (a *AggregatorV3) CleanDir() {
+	if err := a.CleanDirWithLeases(context.Background()); err != nil {
+		log.Warn("[snapshots] CleanDir", "err", err)
+	}
+}
+
+// CleanDirWithLeases - CleanDir which returns error of reading leases
+func (a *AggregatorV3) CleanDirWithLeases(ctx context.Context) error {
+	ls, err := a.activeLeasesOfDB(ctx)
+	if err != nil {
+		return err
+	}
+	keep := func(f *filesItem) bool { return ls.overlaps(f.startTxNum, f.endTxNum) }
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		h.cleanupDir(keep)
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		ii.cleanupDir(keep)
+	}
+	return nil
+}
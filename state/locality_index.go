@@ -17,22 +17,29 @@
 package state
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ledgerwatch/erigon-lib/common/assert"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon-lib/mmap"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/segment"
 	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/sync/errgroup"
 )
 
 const LocalityIndexUint64Limit = 64 //bitmap spend 1 bit per file, stored as uint64
@@ -45,8 +52,31 @@ type LocalityIndex struct {
 	dir, tmpdir     string // Directory where static files are created
 	aggregationStep uint64 // immutable
 
-	file *filesItem
-	bm   *bitmapdb.FixedSizeBitmaps
+	file   *filesItem
+	bm     *bitmapdb.FixedSizeBitmaps
+	shards *localityShards // not nil if .li file is sharded, then `file.index` is nil
+
+	// build settings, see SetShards
+	shardBits    uint8
+	shardWorkers int
+
+	buildLock sync.Mutex // 1 build at a time: BuildMissedIndices and onFrozenFile may run concurrently
+}
+
+// SetShards - next build of .li file will split keys by first `bits` bits of key (address prefix) into 2^bits shards,
+// each shard has own recsplit (with own salt) and own slice of bitmaps and is built by one of `workers` goroutines.
+// 0 bits - build single recsplit (default). Files of both layouts can be opened.
+func (li *LocalityIndex) SetShards(bits uint8, workers int) {
+	if li == nil {
+		return
+	}
+	if bits > 8 {
+		bits = 8
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	li.shardBits, li.shardWorkers = bits, workers
 }
 
 func NewLocalityIndex(
@@ -67,15 +97,29 @@ func (li *LocalityIndex) reOpenFolder() error {
 		return nil
 	}
 
-	li.closeFiles()
 	files, err := os.ReadDir(li.dir)
 	if err != nil {
 		return fmt.Errorf("LocalityIndex: %s, %w", li.filenameBase, err)
 	}
+	// copy-on-write: contexts keep using prev file until Close, see newFilesTree
+	prev := ctxLocalityItem{file: li.file, bm: li.bm, shards: li.shards}
+	li.file, li.bm, li.shards = nil, nil, nil
 	_ = li.scanStateFiles(files)
+	if prev.file != nil && li.file != nil && prev.file.startTxNum == li.file.startTxNum && prev.file.endTxNum == li.file.endTxNum {
+		li.file, li.bm, li.shards = prev.file, prev.bm, prev.shards
+		return nil
+	}
 	if err = li.openFiles(); err != nil {
+		li.file, li.bm, li.shards = prev.file, prev.bm, prev.shards
 		return fmt.Errorf("LocalityIndex: %s, %w", li.filenameBase, err)
 	}
+	if prev.file != nil {
+		prev.file.replaced.Store(true)
+		prev.file.canDelete.Store(true)
+		if prev.file.refcount.Load() == 0 {
+			li.closeFilesAndRemove(prev)
+		}
+	}
 	return nil
 }
 
@@ -135,7 +179,15 @@ func (li *LocalityIndex) openFiles() (err error) {
 	}
 	fromStep, toStep := li.file.startTxNum/li.aggregationStep, li.file.endTxNum/li.aggregationStep
 	idxPath := filepath.Join(li.dir, fmt.Sprintf("%s.%d-%d.li", li.filenameBase, fromStep, toStep))
-	li.file.index, err = recsplit.OpenIndex(idxPath)
+	sharded, err := isShardedLocalityFile(idxPath)
+	if err != nil {
+		return fmt.Errorf("LocalityIndex.openFiles: %w, %s", err, idxPath)
+	}
+	if sharded {
+		li.shards, err = openLocalityShards(idxPath)
+	} else {
+		li.file.index, err = recsplit.OpenIndex(idxPath)
+	}
 	if err != nil {
 		return fmt.Errorf("LocalityIndex.openFiles: %w, %s", err, idxPath)
 	}
@@ -155,6 +207,11 @@ func (li *LocalityIndex) closeFiles() {
 		li.file.index.Close()
 		li.file = nil
 	}
+	if li.shards != nil {
+		li.shards.Close()
+		li.shards = nil
+		li.file = nil
+	}
 	if li.bm != nil {
 		li.bm.Close()
 		li.bm = nil
@@ -168,28 +225,64 @@ func (li *LocalityIndex) closeFilesAndRemove(i ctxLocalityItem) {
 	if i.file != nil {
 		i.file.closeFilesAndRemove()
 	}
+	remove := i.file == nil || !i.file.replaced.Load() // replaced by reOpenFolder: file is still on disk
+	if i.shards != nil {
+		i.shards.Close()
+		if remove {
+			if err := os.Remove(i.shards.filePath); err != nil {
+				log.Trace("os.Remove", "err", err, "file", i.shards.filePath)
+			}
+		}
+	}
 	if i.bm != nil {
 		if err := i.bm.Close(); err != nil {
 			log.Trace("close", "err", err, "file", i.bm.FileName())
 		}
-		if err := os.Remove(i.bm.FilePath()); err != nil {
-			log.Trace("os.Remove", "err", err, "file", i.bm.FileName())
+		if remove {
+			if err := os.Remove(i.bm.FilePath()); err != nil {
+				log.Trace("os.Remove", "err", err, "file", i.bm.FileName())
+			}
 		}
 	}
 }
 
 func (li *LocalityIndex) Close()                { li.closeFiles() }
 func (li *LocalityIndex) Files() (res []string) { return res }
-func (li *LocalityIndex) NewIdxReader() *recsplit.IndexReader {
-	if li != nil && li.file != nil && li.file.index != nil {
-		return recsplit.NewIndexReader(li.file.index)
+func (li *LocalityIndex) NewIdxReader() *LocalityIdxReader {
+	if li == nil || li.file == nil {
+		return nil
+	}
+	if li.shards != nil {
+		return li.shards.newReader()
+	}
+	if li.file.index != nil && !li.file.index.Empty() { // index of files without keys can't be looked up
+		return &LocalityIdxReader{r: recsplit.NewIndexReader(li.file.index)}
 	}
 	return nil
 }
 
+// LocalityIdxReader - maps key to number of it's bitmap. Hides .li file layout (single recsplit or sharded). Not thread-safe.
+type LocalityIdxReader struct {
+	r *recsplit.IndexReader
+
+	shards    []*recsplit.IndexReader // nil for empty shard
+	shardBits uint8
+}
+
+func (r *LocalityIdxReader) Lookup(key []byte) uint64 {
+	if r.r != nil {
+		return r.r.Lookup(key)
+	}
+	s := localityShardOf(key, r.shardBits)
+	if r.shards[s] == nil {
+		return 0
+	}
+	return r.shards[s].Lookup(key) // sharded recsplit stores global bitmap number as value
+}
+
 // LocalityIndex return exactly 2 file (step)
 // prevents searching key in many files
-func (li *LocalityIndex) lookupIdxFiles(r *recsplit.IndexReader, bm *bitmapdb.FixedSizeBitmaps, file *filesItem, key []byte, fromTxNum uint64) (exactShard1, exactShard2 uint64, lastIndexedTxNum uint64, ok1, ok2 bool) {
+func (li *LocalityIndex) lookupIdxFiles(r *LocalityIdxReader, bm *bitmapdb.FixedSizeBitmaps, file *filesItem, key []byte, fromTxNum uint64) (exactShard1, exactShard2 uint64, lastIndexedTxNum uint64, ok1, ok2 bool) {
 	if li == nil || r == nil || bm == nil || file == nil {
 		return 0, 0, 0, false, false
 	}
@@ -206,11 +299,11 @@ func (li *LocalityIndex) lookupIdxFiles(r *recsplit.IndexReader, bm *bitmapdb.Fi
 }
 
 func (li *LocalityIndex) missedIdxFiles(ii *InvertedIndex) (toStep uint64, idxExists bool) {
-	a, _ := ii.files.Max()
+	a, _ := ii.files.Load().Max()
 	if a == nil {
 		a = &filesItem{}
 	}
-	ii.files.Descend(a, func(item *filesItem) bool {
+	ii.files.Load().Descend(a, func(item *filesItem) bool {
 		if item.endTxNum-item.startTxNum == StepsInBiggestFile*li.aggregationStep {
 			toStep = item.endTxNum / li.aggregationStep
 			return false
@@ -221,6 +314,9 @@ func (li *LocalityIndex) missedIdxFiles(ii *InvertedIndex) (toStep uint64, idxEx
 	return toStep, dir.FileExist(filepath.Join(li.dir, fName))
 }
 func (li *LocalityIndex) buildFiles(ctx context.Context, ii *InvertedIndex, toStep uint64) (files *LocalityIndexFiles, err error) {
+	if li.shardBits > 0 {
+		return li.buildShardedFiles(ctx, ii, toStep)
+	}
 	defer ii.EnableMadvNormalReadAhead().DisableReadAhead()
 
 	logEvery := time.NewTicker(30 * time.Second)
@@ -228,8 +324,13 @@ func (li *LocalityIndex) buildFiles(ctx context.Context, ii *InvertedIndex, toSt
 
 	fromStep := uint64(0)
 
+	ic := ii.MakeContext()
+	defer ic.Close()
 	count := 0
-	it := ii.MakeContext().iterateKeysLocality(toStep * li.aggregationStep)
+	it, err := ic.iterateKeysLocality(toStep * li.aggregationStep)
+	if err != nil {
+		return nil, err
+	}
 	for it.HasNext() {
 		_, _ = it.Next()
 		count++
@@ -242,66 +343,41 @@ func (li *LocalityIndex) buildFiles(ctx context.Context, ii *InvertedIndex, toSt
 		//}
 	}
 
-	fName := fmt.Sprintf("%s.%d-%d.li", li.filenameBase, fromStep, toStep)
-	idxPath := filepath.Join(li.dir, fName)
-	filePath := filepath.Join(li.dir, fmt.Sprintf("%s.%d-%d.l", li.filenameBase, fromStep, toStep))
-
-	rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
-		KeyCount:   count,
-		Enums:      false,
-		BucketSize: 2000,
-		LeafSize:   8,
-		TmpDir:     li.tmpdir,
-		IndexFile:  idxPath,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("create recsplit: %w", err)
-	}
-	defer rs.Close()
-	rs.LogLvl(log.LvlTrace)
+	idxPath := filepath.Join(li.dir, segment.FileName(li.filenameBase, fromStep, toStep, "li"))
+	filePath := filepath.Join(li.dir, segment.FileName(li.filenameBase, fromStep, toStep, "l"))
 
-	i := uint64(0)
-	for {
+	if err = segment.BuildIndex(ctx, segment.IndexArgs{IndexFile: idxPath, TmpDir: li.tmpdir, KeyCount: count}, func(add func(key []byte, offset uint64) error) error {
 		dense, err := bitmapdb.NewFixedSizeBitmapsWriter(filePath, int(it.FilesAmount()), uint64(count))
 		if err != nil {
-			return nil, err
+			return err
 		}
 		defer dense.Close()
 
-		it = ii.MakeContext().iterateKeysLocality(toStep * li.aggregationStep)
+		i := uint64(0)
+		if it, err = ic.iterateKeysLocality(toStep * li.aggregationStep); err != nil {
+			return err
+		}
 		for it.HasNext() {
 			k, inFiles := it.Next()
 			if err := dense.AddArray(i, inFiles); err != nil {
-				return nil, err
+				return err
 			}
-			if err = rs.AddKey(k, 0); err != nil {
-				return nil, err
+			if err = add(k, 0); err != nil {
+				return err
 			}
 			i++
 
 			select {
 			case <-ctx.Done():
-				return nil, ctx.Err()
+				return ctx.Err()
 			case <-logEvery.C:
 				log.Debug("[LocalityIndex] build", "name", li.filenameBase, "progress", fmt.Sprintf("%.2f%%", 50+it.Progress()/2))
 			default:
 			}
 		}
-
-		if err := dense.Build(); err != nil {
-			return nil, err
-		}
-
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Debug("Building recsplit. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return nil, fmt.Errorf("build idx: %w", err)
-			}
-		} else {
-			break
-		}
+		return dense.Build()
+	}); err != nil {
+		return nil, err
 	}
 
 	idx, err := recsplit.OpenIndex(idxPath)
@@ -326,16 +402,22 @@ func (li *LocalityIndex) integrateFiles(sf LocalityIndexFiles, txNumFrom, txNumT
 		frozen:     false,
 	}
 	li.bm = sf.bm
+	li.shards = sf.shards
 }
 
 func (li *LocalityIndex) BuildMissedIndices(ctx context.Context, ii *InvertedIndex) error {
 	if li == nil {
 		return nil
 	}
+	li.buildLock.Lock()
+	defer li.buildLock.Unlock()
 	toStep, idxExists := li.missedIdxFiles(ii)
 	if idxExists || toStep == 0 {
 		return nil
 	}
+	// previous generation of index is removed by last context which uses it - this one, if there are no others
+	ic := ii.MakeContext()
+	defer ic.Close()
 	fromStep := uint64(0)
 	f, err := li.buildFiles(ctx, ii, toStep)
 	if err != nil {
@@ -345,15 +427,52 @@ func (li *LocalityIndex) BuildMissedIndices(ctx context.Context, ii *InvertedInd
 	return nil
 }
 
+// onFrozenFile - called after merge integrated frozen file `f` into `ii`: if `f` is next after files covered by
+// index, index gains 1 column - next generation is built up to end of `f` and replaces current one. Otherwise
+// (gap or already covered) does nothing: BuildMissedIndices catches up.
+// Previous generation is removed like merged files: by last context which uses it, caller must hold one.
+func (li *LocalityIndex) onFrozenFile(ctx context.Context, ii *InvertedIndex, f *filesItem) error {
+	if li == nil || f == nil || !f.frozen {
+		return nil
+	}
+	li.buildLock.Lock()
+	defer li.buildLock.Unlock()
+	var coveredTo uint64
+	if li.file != nil {
+		coveredTo = li.file.endTxNum
+	}
+	toStep := f.endTxNum / li.aggregationStep
+	if f.startTxNum != coveredTo || toStep > StepsInBiggestFile*LocalityIndexUint64Limit {
+		return nil
+	}
+	files, err := li.buildFiles(ctx, ii, toStep)
+	if err != nil {
+		return fmt.Errorf("LocalityIndex.onFrozenFile: %s, %w", li.filenameBase, err)
+	}
+	li.integrateFiles(*files, 0, f.endTxNum)
+	return nil
+}
+
 type LocalityIndexFiles struct {
-	index *recsplit.Index
-	bm    *bitmapdb.FixedSizeBitmaps
+	index  *recsplit.Index
+	shards *localityShards
+	bm     *bitmapdb.FixedSizeBitmaps
+}
+
+func (sf LocalityIndexFiles) NewIdxReader() *LocalityIdxReader {
+	if sf.shards != nil {
+		return sf.shards.newReader()
+	}
+	return &LocalityIdxReader{r: recsplit.NewIndexReader(sf.index)}
 }
 
 func (sf LocalityIndexFiles) Close() {
 	if sf.index != nil {
 		sf.index.Close()
 	}
+	if sf.shards != nil {
+		sf.shards.Close()
+	}
 	if sf.bm != nil {
 		sf.bm.Close()
 	}
@@ -418,12 +537,15 @@ func (si *LocalityIterator) Next() ([]byte, []uint64) {
 	return si.nextKey, si.nextFiles
 }
 
-func (ic *InvertedIndexContext) iterateKeysLocality(uptoTxNum uint64) *LocalityIterator {
+func (ic *InvertedIndexContext) iterateKeysLocality(uptoTxNum uint64) (*LocalityIterator, error) {
 	si := &LocalityIterator{hc: ic}
 	for _, item := range ic.files {
 		if !item.src.frozen || item.startTxNum > uptoTxNum {
 			continue
 		}
+		if err := item.src.open(); err != nil {
+			return nil, err
+		}
 		if assert.Enable {
 			if (item.endTxNum-item.startTxNum)/ic.ii.aggregationStep != StepsInBiggestFile {
 				panic(fmt.Errorf("frozen file of small size: %s", item.src.decompressor.FileName()))
@@ -440,7 +562,7 @@ func (ic *InvertedIndexContext) iterateKeysLocality(uptoTxNum uint64) *LocalityI
 		si.filesAmount++
 	}
 	si.advance()
-	return si
+	return si, nil
 }
 
 func (li *LocalityIndex) CleanupDir() {
@@ -462,3 +584,373 @@ func (li *LocalityIndex) CleanupDir() {
 		log.Debug("[clean] remove", "file", fName, "err", err)
 	}
 }
+
+// buildShardedFiles - same as buildFiles, but keys are split by prefix into 2^shardBits shards.
+// Files are iterated twice: first pass counts keys per shard, second pass writes bitmaps to shard's slice of .l file
+// and adds keys to shard's recsplit, recsplit of finished shard is built by one of workers - while next shards are iterated.
+// On recsplit collision the shard re-iterates files to re-add its keys (see buildShard).
+func (li *LocalityIndex) buildShardedFiles(ctx context.Context, ii *InvertedIndex, toStep uint64) (files *LocalityIndexFiles, err error) {
+	defer ii.EnableMadvNormalReadAhead().DisableReadAhead()
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	fromStep := uint64(0)
+	ic := ii.MakeContext()
+	defer ic.Close()
+
+	counts := make([]int, 1<<li.shardBits)
+	it, err := ic.iterateKeysLocality(toStep * li.aggregationStep)
+	if err != nil {
+		return nil, err
+	}
+	for it.HasNext() {
+		k, _ := it.Next()
+		counts[localityShardOf(k, li.shardBits)]++
+	}
+	bases := make([]uint64, len(counts))
+	var total uint64
+	for s, cnt := range counts {
+		bases[s] = total
+		total += uint64(cnt)
+	}
+
+	fName := fmt.Sprintf("%s.%d-%d.li", li.filenameBase, fromStep, toStep)
+	idxPath := filepath.Join(li.dir, fName)
+	filePath := filepath.Join(li.dir, fmt.Sprintf("%s.%d-%d.l", li.filenameBase, fromStep, toStep))
+
+	shardPaths := make([]string, len(counts))
+	defer func() {
+		for _, p := range shardPaths {
+			if p != "" {
+				_ = os.Remove(p)
+			}
+		}
+	}()
+
+	dense, err := bitmapdb.NewFixedSizeBitmapsWriter(filePath, int(it.FilesAmount()), total)
+	if err != nil {
+		return nil, err
+	}
+	defer dense.Close()
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(li.shardWorkers)
+	var rs *recsplit.RecSplit
+	curShard := -1
+	finishShard := func() {
+		if rs == nil {
+			return
+		}
+		shardRs, shard := rs, curShard
+		rs = nil
+		g.Go(func() error { return li.buildShard(gCtx, ic, shardRs, toStep, shard, bases[shard]) })
+	}
+
+	i := uint64(0)
+	if it, err = ic.iterateKeysLocality(toStep * li.aggregationStep); err != nil {
+		return nil, err
+	}
+	for it.HasNext() {
+		k, inFiles := it.Next()
+		if s := localityShardOf(k, li.shardBits); s != curShard {
+			finishShard()
+			curShard = s
+			shardPaths[s] = fmt.Sprintf("%s.%d.tmp", idxPath, s)
+			if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
+				KeyCount:   counts[s],
+				Enums:      false,
+				BucketSize: 2000,
+				LeafSize:   8,
+				TmpDir:     li.tmpdir,
+				IndexFile:  shardPaths[s],
+			}); err != nil {
+				_ = g.Wait()
+				return nil, fmt.Errorf("create recsplit: %w", err)
+			}
+			rs.LogLvl(log.LvlTrace)
+		}
+		if err = dense.AddArray(i, inFiles); err != nil {
+			rs.Close()
+			_ = g.Wait()
+			return nil, err
+		}
+		if err = rs.AddKey(k, i); err != nil {
+			rs.Close()
+			_ = g.Wait()
+			return nil, err
+		}
+		i++
+
+		select {
+		case <-gCtx.Done():
+			rs.Close()
+			if err = g.Wait(); err != nil {
+				return nil, err
+			}
+			return nil, ctx.Err()
+		case <-logEvery.C:
+			log.Debug("[LocalityIndex] build", "name", li.filenameBase, "shard", curShard, "progress", fmt.Sprintf("%.2f%%", 50+it.Progress()/2))
+		default:
+		}
+	}
+	finishShard()
+	if err = g.Wait(); err != nil {
+		return nil, err
+	}
+	if err = dense.Build(); err != nil {
+		return nil, err
+	}
+	if err = writeLocalityShards(idxPath, li.shardBits, bases, shardPaths); err != nil {
+		return nil, err
+	}
+
+	shards, err := openLocalityShards(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	bm, err := bitmapdb.OpenFixedSizeBitmaps(filePath, int(it.FilesAmount()))
+	if err != nil {
+		shards.Close()
+		return nil, err
+	}
+	return &LocalityIndexFiles{shards: shards, bm: bm}, nil
+}
+
+// buildShard - builds recsplit of 1 shard. On collision: re-adds keys of this shard only (with next salt)
+func (li *LocalityIndex) buildShard(ctx context.Context, ic *InvertedIndexContext, rs *recsplit.RecSplit, toStep uint64, shard int, base uint64) error {
+	defer rs.Close()
+	for {
+		err := rs.Build()
+		if err == nil {
+			return nil
+		}
+		if !rs.Collision() {
+			return fmt.Errorf("build idx: %w", err)
+		}
+		log.Debug("Building recsplit. Collision happened. It's ok. Restarting...", "shard", shard)
+		rs.ResetNextSalt()
+
+		i := base
+		it, err := ic.iterateKeysLocality(toStep * li.aggregationStep)
+		if err != nil {
+			return err
+		}
+		for it.HasNext() {
+			k, _ := it.Next()
+			s := localityShardOf(k, li.shardBits)
+			if s < shard {
+				continue
+			}
+			if s > shard {
+				break
+			}
+			if err = rs.AddKey(k, i); err != nil {
+				return err
+			}
+			i++
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+}
+
+// localityShardOf - keys are sorted, so shard by first bits of key gives continuous ranges of keys
+func localityShardOf(key []byte, shardBits uint8) int {
+	if shardBits == 0 || len(key) == 0 {
+		return 0
+	}
+	return int(key[0] >> (8 - shardBits))
+}
+
+// Sharded .li file format:
+//
+//	header: magic(4 bytes) | version(1 byte) | shardBits(1 byte) | reserved(2 bytes)
+//	shards directory: 2^shardBits entries of: base(uint64) | offset(uint64) | size(uint64), size=0 for empty shard
+//	recsplit files of shards, each starts at 8-bytes aligned offset
+//
+// base - number of shard's first bitmap in .l file. Plain .li file is recsplit file - starts from baseDataID=0.
+var localityShardsMagic = []byte("LIsh")
+
+const (
+	localityShardsVersion     = 1
+	localityShardsHeaderSize  = 8
+	localityShardsDirItemSize = 3 * 8
+)
+
+func isShardedLocalityFile(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(localityShardsMagic))
+	if _, err = io.ReadFull(f, magic); err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, localityShardsMagic), nil
+}
+
+func writeLocalityShards(filePath string, shardBits uint8, bases []uint64, shardPaths []string) error {
+	tmpPath := filePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer os.Remove(tmpPath)
+
+	sizes := make([]uint64, len(shardPaths))
+	for s, p := range shardPaths {
+		if p == "" {
+			continue
+		}
+		st, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		sizes[s] = uint64(st.Size())
+	}
+
+	w := bufio.NewWriterSize(f, 1024*1024)
+	header := make([]byte, localityShardsHeaderSize)
+	copy(header, localityShardsMagic)
+	header[4], header[5] = localityShardsVersion, shardBits
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	offset := uint64(localityShardsHeaderSize + localityShardsDirItemSize*len(shardPaths))
+	offsets := make([]uint64, len(shardPaths))
+	var numBuf [localityShardsDirItemSize]byte
+	for s := range shardPaths {
+		offset = (offset + 7) &^ 7
+		offsets[s] = offset
+		binary.BigEndian.PutUint64(numBuf[:], bases[s])
+		binary.BigEndian.PutUint64(numBuf[8:], offsets[s])
+		binary.BigEndian.PutUint64(numBuf[16:], sizes[s])
+		if _, err = w.Write(numBuf[:]); err != nil {
+			return err
+		}
+		offset += sizes[s]
+	}
+	written := uint64(localityShardsHeaderSize + localityShardsDirItemSize*len(shardPaths))
+	var padding [8]byte
+	for s, p := range shardPaths {
+		if sizes[s] == 0 {
+			continue
+		}
+		if _, err = w.Write(padding[:offsets[s]-written]); err != nil {
+			return err
+		}
+		if err = appendFile(w, p); err != nil {
+			return err
+		}
+		written = offsets[s] + sizes[s]
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+func appendFile(w io.Writer, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// localityShards - opened sharded .li file: 1 mmap, recsplit of each shard is a view on it
+type localityShards struct {
+	f        *os.File
+	filePath string
+	region   *mmap.Region
+
+	shardBits uint8
+	idx       []*recsplit.Index // nil for empty shard
+	bases     []uint64
+}
+
+func openLocalityShards(filePath string) (ls *localityShards, err error) {
+	ls = &localityShards{filePath: filePath}
+	if ls.f, err = os.Open(filePath); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ls.Close()
+		}
+	}()
+	st, err := ls.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if ls.region, err = mmap.DefaultManager.Map(ls.f, int(st.Size())); err != nil {
+		return nil, err
+	}
+	data := ls.region.Bytes()[:st.Size()]
+	if len(data) < localityShardsHeaderSize || !bytes.Equal(data[:len(localityShardsMagic)], localityShardsMagic) {
+		return nil, fmt.Errorf("not a sharded locality index: %s", filePath)
+	}
+	if data[4] != localityShardsVersion {
+		return nil, fmt.Errorf("unsupported sharded locality index version %d: %s", data[4], filePath)
+	}
+	ls.shardBits = data[5]
+	shardsAmount := 1 << ls.shardBits
+	dir := data[localityShardsHeaderSize:]
+	if len(dir) < shardsAmount*localityShardsDirItemSize {
+		return nil, fmt.Errorf("sharded locality index is truncated: %s", filePath)
+	}
+	ls.idx, ls.bases = make([]*recsplit.Index, shardsAmount), make([]uint64, shardsAmount)
+	for s := 0; s < shardsAmount; s++ {
+		item := dir[s*localityShardsDirItemSize:]
+		ls.bases[s] = binary.BigEndian.Uint64(item)
+		offset, size := binary.BigEndian.Uint64(item[8:]), binary.BigEndian.Uint64(item[16:])
+		if size == 0 {
+			continue
+		}
+		if offset+size > uint64(len(data)) {
+			return nil, fmt.Errorf("sharded locality index is truncated: %s, shard %d", filePath, s)
+		}
+		if ls.idx[s], err = recsplit.NewIndexFromData(filePath, data[offset:offset+size]); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", s, err)
+		}
+	}
+	return ls, nil
+}
+
+func (ls *localityShards) newReader() *LocalityIdxReader {
+	r := &LocalityIdxReader{shards: make([]*recsplit.IndexReader, len(ls.idx)), shardBits: ls.shardBits}
+	for s, idx := range ls.idx {
+		if idx != nil && !idx.Empty() {
+			r.shards[s] = recsplit.NewIndexReader(idx)
+		}
+	}
+	return r
+}
+
+func (ls *localityShards) Close() {
+	if ls == nil || ls.f == nil {
+		return
+	}
+	if err := ls.region.Unmap(); err != nil {
+		log.Trace("unmap", "err", err, "file", ls.filePath)
+	}
+	if err := ls.f.Close(); err != nil {
+		log.Trace("close", "err", err, "file", ls.filePath)
+	}
+	ls.f, ls.idx = nil, nil
+}
@@ -6,7 +6,6 @@ import (
 	"math"
 	"testing"
 
-	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,7 +21,8 @@ func TestLocality(t *testing.T) {
 	t.Run("locality iterator", func(t *testing.T) {
 		ic := ii.MakeContext()
 		defer ic.Close()
-		it := ic.iterateKeysLocality(math.MaxUint64)
+		it, err := ic.iterateKeysLocality(math.MaxUint64)
+		require.NoError(err)
 		require.True(it.HasNext())
 		key, bitmap := it.Next()
 		require.Equal(uint64(2), binary.BigEndian.Uint64(key))
@@ -74,7 +74,7 @@ func TestLocality(t *testing.T) {
 	t.Run("locality index: lookup", func(t *testing.T) {
 		var k [8]byte
 		binary.BigEndian.PutUint64(k[:], 1)
-		v1, v2, from, ok1, ok2 := li.lookupIdxFiles(recsplit.NewIndexReader(files.index), files.bm, li.file, k[:], 1*li.aggregationStep*StepsInBiggestFile)
+		v1, v2, from, ok1, ok2 := li.lookupIdxFiles(files.NewIdxReader(), files.bm, li.file, k[:], 1*li.aggregationStep*StepsInBiggestFile)
 		require.True(ok1)
 		require.False(ok2)
 		require.Equal(uint64(1*StepsInBiggestFile), v1)
@@ -82,3 +82,41 @@ func TestLocality(t *testing.T) {
 		require.Equal(2*li.aggregationStep*StepsInBiggestFile, from)
 	})
 }
+
+func TestLocalitySharded(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	const Module uint64 = 31
+	path, db, ii, txs := filledInvIndexOfSize(t, 300, 4, Module)
+	mergeInverted(t, db, ii, txs)
+	li, _ := NewLocalityIndex(path, path, 4, "inv")
+	defer li.Close()
+	li.SetShards(2, 2)
+	err := li.BuildMissedIndices(ctx, ii)
+	require.NoError(err)
+	require.NotNil(li.shards)
+	require.Nil(li.file.index)
+
+	check := func(r *LocalityIdxReader) {
+		ic := ii.MakeContext()
+		defer ic.Close()
+		it, err := ic.iterateKeysLocality(math.MaxUint64)
+		require.NoError(err)
+		for it.HasNext() {
+			k, expect := it.Next()
+			res, err := li.bm.At(r.Lookup(k))
+			require.NoError(err)
+			require.Equal(expect, res)
+		}
+	}
+	check(li.NewIdxReader())
+
+	// re-open from disk
+	require.NoError(li.reOpenFolder())
+	require.NotNil(li.shards)
+	check(li.NewIdxReader())
+
+	require.Equal(0, localityShardOf([]byte{0x3f}, 2))
+	require.Equal(1, localityShardOf([]byte{0x40}, 2))
+	require.Equal(3, localityShardOf([]byte{0xff}, 2))
+	require.Equal(0, localityShardOf(nil, 2))
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// LogFilterGroup - set of keys of one index, txNum matches group if it matches any of keys (OR).
+// Position: -1 for addresses, topic position otherwise.
+type LogFilterGroup struct {
+	Position int
+	Keys     [][]byte
+	Counts   []uint64 // amount of txNums of each key in plan's range, see InvertedIndexContext.IdxCount
+	Estimate uint64   // sum of Counts - upper bound of amount of txNums matching group
+}
+
+func (g LogFilterGroup) isAddrs() bool { return g.Position < 0 }
+
+// LogFilterPlan - eth_getLogs-like filter (addresses AND topic[0] AND topic[1] ...) as sequence of index lookups.
+// Groups are sorted by Estimate: first group is the most selective one - it drives streaming intersection with next groups,
+// nothing is read into memory, streams of next groups are advanced only while first group has txNums.
+// Keys which have no txNums in range are already excluded from Groups.
+type LogFilterPlan struct {
+	FromTxNum, ToTxNum int // [from, to), -1 means unbounded
+	Groups             []LogFilterGroup
+	empty              bool
+}
+
+// Empty - filter has no matches, no need to read anything
+func (p *LogFilterPlan) Empty() bool { return p.empty }
+
+// Unfiltered - filter has no addresses and no topics: every txNum of range matches
+func (p *LogFilterPlan) Unfiltered() bool { return !p.empty && len(p.Groups) == 0 }
+
+func (p *LogFilterPlan) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "txNums=[%d, %d)", p.FromTxNum, p.ToTxNum)
+	if p.empty {
+		sb.WriteString(" empty")
+		return sb.String()
+	}
+	for i, g := range p.Groups {
+		if g.isAddrs() {
+			fmt.Fprintf(&sb, " %d:addrs", i)
+		} else {
+			fmt.Fprintf(&sb, " %d:topic%d", i, g.Position)
+		}
+		fmt.Fprintf(&sb, "(keys=%d, estimate=%d)", len(g.Keys), g.Estimate)
+	}
+	return sb.String()
+}
+
+// planLogFilter - addrs: any of addresses; topics[i]: any of topics at position i, empty topics[i] - any topic.
+// Index of topics doesn't store topic position, so positions of LogFilterGroup are only for plan explanation.
+func planLogFilter(addrIdx, topicIdx *InvertedIndexContext, addrs [][]byte, topics [][][]byte, fromTxNum, toTxNum int, tx kv.Tx) (*LogFilterPlan, error) {
+	p := &LogFilterPlan{FromTxNum: fromTxNum, ToTxNum: toTxNum}
+	addGroup := func(ic *InvertedIndexContext, position int, keys [][]byte) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		g := LogFilterGroup{Position: position}
+		for _, k := range keys {
+			cnt, err := ic.IdxCount(k, fromTxNum, toTxNum, tx)
+			if err != nil {
+				return err
+			}
+			if cnt == 0 {
+				continue
+			}
+			g.Keys = append(g.Keys, k)
+			g.Counts = append(g.Counts, cnt)
+			g.Estimate += cnt
+		}
+		if g.Estimate == 0 {
+			p.empty = true
+		}
+		p.Groups = append(p.Groups, g)
+		return nil
+	}
+	if err := addGroup(addrIdx, -1, addrs); err != nil {
+		return nil, err
+	}
+	for i, keys := range topics {
+		if err := addGroup(topicIdx, i, keys); err != nil {
+			return nil, err
+		}
+	}
+	if p.empty {
+		p.Groups = nil
+		return p, nil
+	}
+	slices.SortStableFunc(p.Groups, func(a, b LogFilterGroup) bool { return a.Estimate < b.Estimate })
+	return p, nil
+}
+
+// iterateLogFilter - txNums matching plan in ascending order
+func iterateLogFilter(addrIdx, topicIdx *InvertedIndexContext, p *LogFilterPlan, tx kv.Tx) (iter.U64, error) {
+	if p.empty {
+		return iter.EmptyU64, nil
+	}
+	if len(p.Groups) == 0 {
+		if p.FromTxNum < 0 || p.ToTxNum < 0 {
+			return nil, fmt.Errorf("%w: log filter without addresses and topics on unbounded txNum range", kv.ErrNotSupported)
+		}
+		return iter.Range[uint64](uint64(p.FromTxNum), uint64(p.ToTxNum)), nil
+	}
+
+	var res iter.U64
+	for i, g := range p.Groups {
+		ic := topicIdx
+		if g.isAddrs() {
+			ic = addrIdx
+		}
+		groupIt, err := iterateLogFilterGroup(ic, g, p.FromTxNum, p.ToTxNum, tx)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			res = groupIt
+			continue
+		}
+		// groups are sorted by selectivity: most selective stream drives intersection
+		res = iter.Intersect[uint64](res, groupIt)
+	}
+	return res, nil
+}
+
+// iterateLogFilterGroup - txNums of group: union of txNums of group keys
+func iterateLogFilterGroup(ic *InvertedIndexContext, g LogFilterGroup, from, to int, tx kv.Tx) (iter.U64, error) {
+	var groupIt iter.U64
+	for _, k := range g.Keys {
+		it, err := ic.IterateRange(k, from, to, order.Asc, -1, tx)
+		if err != nil {
+			return nil, err
+		}
+		groupIt = iter.Union[uint64](groupIt, it)
+	}
+	return groupIt, nil
+}
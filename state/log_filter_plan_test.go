@@ -0,0 +1,99 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFilterPlan(t *testing.T) {
+	key := func(keyNum uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		return k[:]
+	}
+	test := func(t *testing.T, db kv.RwDB, ii *InvertedIndex) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		ic := ii.MakeContext()
+		defer ic.Close()
+
+		// same index for addresses and topics: key N is present at txNums which are multiples of N
+		addrs := [][]byte{key(2), key(3), key(100)}
+		topics := [][][]byte{{key(5)}, nil, {key(7), key(31)}}
+		p, err := planLogFilter(ic, ic, addrs, topics, 10, 900, tx)
+		require.NoError(t, err)
+		require.False(t, p.Empty())
+		require.Equal(t, 3, len(p.Groups))
+		require.Equal(t, []int{2, 0, -1}, []int{p.Groups[0].Position, p.Groups[1].Position, p.Groups[2].Position})
+		require.Equal(t, 2, len(p.Groups[2].Keys), "key without txNums in range is excluded")
+		for i := 1; i < len(p.Groups); i++ {
+			require.LessOrEqual(t, p.Groups[i-1].Estimate, p.Groups[i].Estimate)
+		}
+		t.Log(p.String())
+
+		it, err := iterateLogFilter(ic, ic, p, tx)
+		require.NoError(t, err)
+		txNums, err := iter.ToU64Arr(it)
+		require.NoError(t, err)
+		var expect []uint64
+		for txNum := uint64(10); txNum < 900; txNum++ {
+			if (txNum%2 == 0 || txNum%3 == 0) && txNum%5 == 0 && (txNum%7 == 0 || txNum%31 == 0) {
+				expect = append(expect, txNum)
+			}
+		}
+		require.Equal(t, expect, txNums)
+
+		// group without txNums in range: nothing to read
+		p, err = planLogFilter(ic, ic, [][]byte{key(100)}, topics, 10, 900, tx)
+		require.NoError(t, err)
+		require.True(t, p.Empty())
+		it, err = iterateLogFilter(ic, ic, p, tx)
+		require.NoError(t, err)
+		require.False(t, it.HasNext())
+
+		p, err = planLogFilter(ic, ic, nil, [][][]byte{nil, nil}, 10, 20, tx)
+		require.NoError(t, err)
+		require.True(t, p.Unfiltered())
+		it, err = iterateLogFilter(ic, ic, p, tx)
+		require.NoError(t, err)
+		txNums, err = iter.ToU64Arr(it)
+		require.NoError(t, err)
+		require.Equal(t, 10, len(txNums))
+		p.FromTxNum = -1
+		_, err = iterateLogFilter(ic, ic, p, tx)
+		require.True(t, errors.Is(err, kv.ErrNotSupported))
+	}
+	t.Run("db", func(t *testing.T) {
+		_, db, ii, _ := filledInvIndex(t)
+		test(t, db, ii)
+	})
+	t.Run("files", func(t *testing.T) {
+		_, db, ii, txs := filledInvIndex(t)
+		mergeInverted(t, db, ii, txs)
+		test(t, db, ii)
+	})
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/ledgerwatch/erigon-lib/mmap"
+)
+
+// MadvPolicy - access pattern of files by their age. Files which end within HotSteps steps of newest data
+// get Hot advice, frozen files (of StepsInBiggestFile steps) - Cold, other files - Warm.
+// On memory-constrained servers it keeps page cache for recent steps instead of read-ahead of whole history.
+type MadvPolicy struct {
+	HotSteps        uint64
+	Hot, Warm, Cold mmap.Advice
+}
+
+var DefaultMadvPolicy = MadvPolicy{HotSteps: 2, Hot: mmap.WillNeed, Warm: mmap.Normal, Cold: mmap.Random}
+
+var stepsOfFileRe = regexp.MustCompile(`^[^.]+\.([0-9]+)-([0-9]+)\.`)
+
+// advice - maxStep: end of newest files. Files which name has no step range are Warm.
+func (p *MadvPolicy) advice(path string, maxStep uint64) mmap.Advice {
+	subs := stepsOfFileRe.FindStringSubmatch(filepath.Base(path))
+	if len(subs) != 3 {
+		return p.Warm
+	}
+	fromStep, err := strconv.ParseUint(subs[1], 10, 64)
+	if err != nil {
+		return p.Warm
+	}
+	toStep, err := strconv.ParseUint(subs[2], 10, 64)
+	if err != nil || toStep < fromStep {
+		return p.Warm
+	}
+	switch {
+	case toStep+p.HotSteps > maxStep:
+		return p.Hot
+	case toStep-fromStep == StepsInBiggestFile:
+		return p.Cold
+	default:
+		return p.Warm
+	}
+}
+
+// SetMadvPolicy - applies policy to files of aggregator (mapped now and later), can be changed at runtime.
+// Files move between Hot/Warm/Cold when new files are built. nil - removes policy: files return to mmap.Random.
+// Replaces EnableMadvWillNeed/EnableMadvNormal/EnableReadAhead and is replaced by them.
+func (a *AggregatorV3) SetMadvPolicy(p *MadvPolicy) error {
+	if p == nil {
+		a.madvPolicy.Store(nil)
+		return mmap.DefaultManager.SetAdvicePolicy(a.dir, nil)
+	}
+	policy := *p
+	a.madvPolicy.Store(&policy)
+	return mmap.DefaultManager.SetAdvicePolicy(a.dir, func(path string) mmap.Advice {
+		return policy.advice(path, a.maxTxNum.Load()/a.aggregationStep)
+	})
+}
+
+// reapplyMadvPolicy - after advance of maxTxNum some Hot files become Warm
+func (a *AggregatorV3) reapplyMadvPolicy() {
+	if a.madvPolicy.Load() == nil {
+		return
+	}
+	_ = mmap.DefaultManager.Reapply(a.dir)
+}
@@ -31,34 +31,31 @@ import (
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
 )
 
 func (d *Domain) endTxNumMinimax() uint64 {
 	minimax := d.History.endTxNumMinimax()
-	if max, ok := d.files.Max(); ok {
-		endTxNum := max.endTxNum
-		if minimax == 0 || endTxNum < minimax {
-			minimax = endTxNum
-		}
+	if endTxNum := d.valuesEndTxNum.Load(); endTxNum > 0 && (minimax == 0 || endTxNum < minimax) {
+		minimax = endTxNum
 	}
 	return minimax
 }
 
-func (ii *InvertedIndex) endTxNumMinimax() uint64 {
-	var minimax uint64
-	if max, ok := ii.files.Max(); ok {
-		endTxNum := max.endTxNum
-		if minimax == 0 || endTxNum < minimax {
-			minimax = endTxNum
-		}
+func (ii *InvertedIndex) endTxNumMinimax() uint64 { return ii.filesEndTxNum.Load() }
+
+// lastFileEndTxNum - to memoize endTxNum of files set after each change of it, see endTxNumMinimax
+func lastFileEndTxNum(files *btree2.BTreeG[*filesItem]) uint64 {
+	if max, ok := files.Max(); ok {
+		return max.endTxNum
 	}
-	return minimax
+	return 0
 }
 func (ii *InvertedIndex) endIndexedTxNumMinimax(needFrozen bool) uint64 {
 	var max uint64
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.index == nil || (needFrozen && !item.frozen) {
+			if !item.hasIndex() || (needFrozen && !item.frozen) {
 				continue
 			}
 			max = cmp.Max(max, item.endTxNum)
@@ -70,19 +67,16 @@ func (ii *InvertedIndex) endIndexedTxNumMinimax(needFrozen bool) uint64 {
 
 func (h *History) endTxNumMinimax() uint64 {
 	minimax := h.InvertedIndex.endTxNumMinimax()
-	if max, ok := h.files.Max(); ok {
-		endTxNum := max.endTxNum
-		if minimax == 0 || endTxNum < minimax {
-			minimax = endTxNum
-		}
+	if endTxNum := h.historyEndTxNum.Load(); endTxNum > 0 && (minimax == 0 || endTxNum < minimax) {
+		minimax = endTxNum
 	}
 	return minimax
 }
 func (h *History) endIndexedTxNumMinimax(needFrozen bool) uint64 {
 	var max uint64
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.index == nil || (needFrozen && !item.frozen) {
+			if !item.hasIndex() || (needFrozen && !item.frozen) {
 				continue
 			}
 			max = cmp.Max(max, item.endTxNum)
@@ -120,7 +114,13 @@ func (d *Domain) findMergeRange(maxEndTxNum, maxSpan uint64) DomainRanges {
 		indexEndTxNum:     hr.indexEndTxNum,
 		index:             hr.index,
 	}
-	d.files.Walk(func(items []*filesItem) bool {
+	r.values, r.valuesStartTxNum, r.valuesEndTxNum = d.findValuesMergeRange(maxEndTxNum, maxSpan)
+	return r
+}
+
+// findValuesMergeRange - range of .kv files to merge, same rules as for history
+func (d *Domain) findValuesMergeRange(maxEndTxNum, maxSpan uint64) (values bool, startTxNum, endTxNum uint64) {
+	d.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.endTxNum > maxEndTxNum {
 				return false
@@ -130,16 +130,16 @@ func (d *Domain) findMergeRange(maxEndTxNum, maxSpan uint64) DomainRanges {
 			span := cmp.Min(spanStep*d.aggregationStep, maxSpan)
 			start := item.endTxNum - span
 			if start < item.startTxNum {
-				if !r.values || start < r.valuesStartTxNum {
-					r.values = true
-					r.valuesStartTxNum = start
-					r.valuesEndTxNum = item.endTxNum
+				if !values || start < startTxNum {
+					values = true
+					startTxNum = start
+					endTxNum = item.endTxNum
 				}
 			}
 		}
 		return true
 	})
-	return r
+	return values, startTxNum, endTxNum
 }
 
 // nolint
@@ -239,7 +239,7 @@ func (s *staticFilesInRange) Close() {
 func (ii *InvertedIndex) findMergeRange(maxEndTxNum, maxSpan uint64) (bool, uint64, uint64) {
 	var minFound bool
 	var startTxNum, endTxNum uint64
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.endTxNum > maxEndTxNum {
 				continue
@@ -247,7 +247,7 @@ func (ii *InvertedIndex) findMergeRange(maxEndTxNum, maxSpan uint64) (bool, uint
 			endStep := item.endTxNum / ii.aggregationStep
 			spanStep := endStep & -endStep // Extract rightmost bit in the binary representation of endStep, this corresponds to size of maximally possible merge ending at endStep
 			span := cmp.Min(spanStep*ii.aggregationStep, maxSpan)
-			start := item.endTxNum - span
+			start := cmp.Max(item.endTxNum-span, ii.historyHorizon.Load()) // never merge into range expired by ExpireHistory
 			foundSuperSet := startTxNum == item.startTxNum && item.endTxNum >= endTxNum
 			if foundSuperSet {
 				minFound = false
@@ -266,46 +266,27 @@ func (ii *InvertedIndex) findMergeRange(maxEndTxNum, maxSpan uint64) (bool, uint
 	return minFound, startTxNum, endTxNum
 }
 
-/*
-// nolint
-func (ii *InvertedIndex) mergeRangesUpTo(ctx context.Context, maxTxNum, maxSpan uint64, workers int) (err error) {
-	closeAll := true
-	for updated, startTx, endTx := ii.findMergeRange(maxSpan, maxTxNum); updated; updated, startTx, endTx = ii.findMergeRange(maxTxNum, maxSpan) {
-		staticFiles, startJ := ii.staticFilesInRange(startTx, endTx)
-		defer func() {
-			if closeAll {
-				for _, i := range staticFiles {
-					i.decompressor.Close()
-					i.index.Close()
-				}
-			}
-		}()
-		_ = startJ
-
-		mergedIndex, err := ii.mergeFiles(ctx, staticFiles, startTx, endTx, workers)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if closeAll {
-				mergedIndex.decompressor.Close()
-				mergedIndex.index.Close()
-			}
-		}()
-
-		//defer func(t time.Time) { log.Info("[snapshots] merge", "took", time.Since(t)) }(time.Now())
-		ii.integrateMergedFiles(staticFiles, mergedIndex)
-
-		if err := ii.deleteFiles(staticFiles); err != nil {
+// MergeRangesUpTo - merges files until nothing to merge. Aggregator merges by itself - it's for standalone usage
+func (ii *InvertedIndex) MergeRangesUpTo(ctx context.Context, maxTxNum, maxSpan uint64, workers int) error {
+	for found, startTxNum, endTxNum := ii.findMergeRange(maxTxNum, maxSpan); found; found, startTxNum, endTxNum = ii.findMergeRange(maxTxNum, maxSpan) {
+		if err := ii.mergeRange(ctx, startTxNum, endTxNum, workers); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		log.Info(fmt.Sprintf("domain files mergedRange[%d, %d) name=%s span=%d \n", startTx, endTx, ii.filenameBase, maxSpan))
+func (ii *InvertedIndex) mergeRange(ctx context.Context, startTxNum, endTxNum uint64, workers int) error {
+	ic := ii.MakeContext()
+	defer ic.Close()
+	outs, _ := ii.staticFilesInRange(startTxNum, endTxNum, ic)
+	in, err := ii.mergeFiles(ctx, outs, startTxNum, endTxNum, workers)
+	if err != nil {
+		return err
 	}
-	closeAll = false
+	ii.integrateMergedFiles(outs, in)
 	return nil
 }
-*/
 
 type HistoryRanges struct {
 	historyStartTxNum uint64
@@ -330,10 +311,35 @@ func (r HistoryRanges) any() bool {
 	return r.history || r.index
 }
 
+// MergeRangesUpTo - merges files until nothing to merge. Aggregator merges by itself - it's for standalone usage
+func (h *History) MergeRangesUpTo(ctx context.Context, maxTxNum, maxSpan uint64, workers int) error {
+	for r := h.findMergeRange(maxTxNum, maxSpan); r.any(); r = h.findMergeRange(maxTxNum, maxSpan) {
+		if err := h.mergeRange(ctx, r, workers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *History) mergeRange(ctx context.Context, r HistoryRanges, workers int) error {
+	hc := h.MakeContext()
+	defer hc.Close()
+	indexOuts, historyOuts, _, err := h.staticFilesInRange(r, hc)
+	if err != nil {
+		return err
+	}
+	indexIn, historyIn, err := h.mergeFiles(ctx, indexOuts, historyOuts, r, workers)
+	if err != nil {
+		return err
+	}
+	h.integrateMergedFiles(indexOuts, historyOuts, indexIn, historyIn)
+	return nil
+}
+
 func (h *History) findMergeRange(maxEndTxNum, maxSpan uint64) HistoryRanges {
 	var r HistoryRanges
 	r.index, r.indexStartTxNum, r.indexEndTxNum = h.InvertedIndex.findMergeRange(maxEndTxNum, maxSpan)
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.endTxNum > maxEndTxNum {
 				continue
@@ -341,7 +347,7 @@ func (h *History) findMergeRange(maxEndTxNum, maxSpan uint64) HistoryRanges {
 			endStep := item.endTxNum / h.aggregationStep
 			spanStep := endStep & -endStep // Extract rightmost bit in the binary representation of endStep, this corresponds to size of maximally possible merge ending at endStep
 			span := cmp.Min(spanStep*h.aggregationStep, maxSpan)
-			start := item.endTxNum - span
+			start := cmp.Max(item.endTxNum-span, h.historyHorizon.Load())
 			foundSuperSet := r.indexStartTxNum == item.startTxNum && item.endTxNum >= r.historyEndTxNum
 			if foundSuperSet {
 				r.history = false
@@ -393,26 +399,33 @@ func (d *Domain) staticFilesInRange(r DomainRanges, dc *DomainContext) (valuesFi
 		}
 	}
 	if r.values {
-		d.files.Walk(func(items []*filesItem) bool {
-			for _, item := range items {
-				if item.startTxNum < r.valuesStartTxNum {
-					startJ++
-					continue
-				}
-				if item.endTxNum > r.valuesEndTxNum {
-					return false
-				}
-				valuesFiles = append(valuesFiles, item)
+		var valuesStartJ int
+		valuesFiles, valuesStartJ = d.valuesFilesInRange(r.valuesStartTxNum, r.valuesEndTxNum)
+		startJ += valuesStartJ
+	}
+	return
+}
+
+func (d *Domain) valuesFilesInRange(startTxNum, endTxNum uint64) (valuesFiles []*filesItem, startJ int) {
+	d.files.Load().Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.startTxNum < startTxNum {
+				startJ++
+				continue
 			}
-			return true
-		})
-		for _, f := range valuesFiles {
-			if f == nil {
-				panic("must not happen")
+			if item.endTxNum > endTxNum {
+				return false
 			}
+			valuesFiles = append(valuesFiles, item)
+		}
+		return true
+	})
+	for _, f := range valuesFiles {
+		if f == nil {
+			panic("must not happen")
 		}
 	}
-	return
+	return valuesFiles, startJ
 }
 
 func (ii *InvertedIndex) staticFilesInRange(startTxNum, endTxNum uint64, ic *InvertedIndexContext) ([]*filesItem, int) {
@@ -421,7 +434,7 @@ func (ii *InvertedIndex) staticFilesInRange(startTxNum, endTxNum uint64, ic *Inv
 	var startJ int
 
 	var prevStart uint64
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.startTxNum < startTxNum {
 				startJ++
@@ -466,7 +479,7 @@ func (h *History) staticFilesInRange(r HistoryRanges, hc *HistoryContext) (index
 
 		var prevStart uint64
 		var walkErr error
-		h.files.Walk(func(items []*filesItem) bool {
+		h.files.Load().Walk(func(items []*filesItem) bool {
 			for _, item := range items {
 				if item.startTxNum < r.historyStartTxNum {
 					startJ++
@@ -490,7 +503,7 @@ func (h *History) staticFilesInRange(r HistoryRanges, hc *HistoryContext) (index
 
 				prevStart = item.startTxNum
 				historyFiles = append(historyFiles, item)
-				idxFile, ok := h.InvertedIndex.files.Get(item)
+				idxFile, ok := h.InvertedIndex.files.Load().Get(item)
 				if ok {
 					indexFiles = append(indexFiles, idxFile)
 				} else {
@@ -508,6 +521,14 @@ func (h *History) staticFilesInRange(r HistoryRanges, hc *HistoryContext) (index
 			if f == nil {
 				panic("must not happen")
 			}
+			if err = f.open(); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+		for _, f := range indexFiles {
+			if err = f.open(); err != nil {
+				return nil, nil, 0, err
+			}
 		}
 		if r.index && len(indexFiles) != len(historyFiles) {
 			var sIdx, sHist []string
@@ -551,14 +572,12 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 	if !r.any() {
 		return
 	}
-	var comp *compress.Compressor
-	//var decomp *compress.Decompressor
+	if err = openFiles(valuesFiles); err != nil {
+		return nil, nil, nil, err
+	}
 	var closeItem = true
 	defer func() {
 		if closeItem {
-			if comp != nil {
-				comp.Close()
-			}
 			//if decomp != nil {
 			//	decomp.Close()
 			//}
@@ -569,6 +588,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				if indexIn.index != nil {
 					indexIn.index.Close()
 				}
+				indexIn.bt.Close()
 			}
 			if historyIn != nil {
 				if historyIn.decompressor != nil {
@@ -579,12 +599,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				}
 			}
 			if valuesIn != nil {
-				if valuesIn.decompressor != nil {
-					valuesIn.decompressor.Close()
-				}
-				if valuesIn.index != nil {
-					valuesIn.index.Close()
-				}
+				valuesIn.closeFilesAndRemove()
 			}
 		}
 	}()
@@ -599,128 +614,116 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 		return nil, nil, nil, err
 	}
 	if r.values {
-		log.Info(fmt.Sprintf("[snapshots] merge: %s.%d-%d.kv", d.filenameBase, r.valuesStartTxNum/d.aggregationStep, r.valuesEndTxNum/d.aggregationStep))
-		for _, f := range valuesFiles {
-			defer f.decompressor.EnableMadvNormal().DisableReadAhead()
+		if valuesIn, err = d.mergeValuesFiles(ctx, valuesFiles, r.valuesStartTxNum, r.valuesEndTxNum, workers); err != nil {
+			return nil, nil, nil, err
 		}
+	}
+	closeItem = false
+	d.stats.MergesCount++
+	d.mergesCount++
+	return
+}
 
-		datPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, r.valuesStartTxNum/d.aggregationStep, r.valuesEndTxNum/d.aggregationStep))
-		if comp, err = compress.NewCompressor(ctx, "merge", datPath, d.tmpdir, compress.MinPatternScore, workers, log.LvlTrace); err != nil {
-			return nil, nil, nil, fmt.Errorf("merge %s history compressor: %w", d.filenameBase, err)
+// mergeValuesFiles - merges .kv files of [startTxNum, endTxNum): latest value of each key wins, deletions are dropped
+// if merged file starts from beginning
+func (d *Domain) mergeValuesFiles(ctx context.Context, valuesFiles []*filesItem, startTxNum, endTxNum uint64, workers int) (*filesItem, error) {
+	log.Info(fmt.Sprintf("[snapshots] merge: %s.%d-%d.kv", d.filenameBase, startTxNum/d.aggregationStep, endTxNum/d.aggregationStep))
+	var parts []*filesItem
+	for _, f := range valuesFiles {
+		parts = append(parts, f.allParts()...)
+	}
+	for _, f := range parts {
+		defer f.decompressor.EnableMadvNormal().DisableReadAhead()
+	}
+
+	w := &domainPartsWriter{d: d, ctx: ctx, workers: workers, fromStep: startTxNum / d.aggregationStep, toStep: endTxNum / d.aggregationStep}
+	closeW := true
+	defer func() {
+		if closeW {
+			w.close()
 		}
-		var cp CursorHeap
-		heap.Init(&cp)
-		for _, item := range valuesFiles {
-			g := item.decompressor.MakeGetter()
-			g.Reset(0)
-			if g.HasNext() {
-				key, _ := g.NextUncompressed()
-				var val []byte
-				if d.compressVals {
-					val, _ = g.Next(nil)
-				} else {
-					val, _ = g.NextUncompressed()
-				}
-				heap.Push(&cp, &CursorItem{
-					t:        FILE_CURSOR,
-					dg:       g,
-					key:      key,
-					val:      val,
-					endTxNum: item.endTxNum,
-					reverse:  true,
-				})
+	}()
+	var cp CursorHeap
+	heap.Init(&cp)
+	for _, item := range parts { // parts of 1 file have different keys
+		g := item.decompressor.MakeGetter()
+		g.Reset(0)
+		if g.HasNext() {
+			key, _ := g.NextUncompressed()
+			var val []byte
+			if d.compressVals {
+				val, _ = g.Next(nil)
+			} else {
+				val, _ = g.NextUncompressed()
 			}
+			heap.Push(&cp, &CursorItem{
+				t:        FILE_CURSOR,
+				dg:       g,
+				key:      key,
+				val:      val,
+				endTxNum: item.endTxNum,
+				reverse:  true,
+			})
 		}
-		keyCount := 0
-		// In the loop below, the pair `keyBuf=>valBuf` is always 1 item behind `lastKey=>lastVal`.
-		// `lastKey` and `lastVal` are taken from the top of the multi-way merge (assisted by the CursorHeap cp), but not processed right away
-		// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
-		// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
-		// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
-		var keyBuf, valBuf []byte
-		for cp.Len() > 0 {
-			lastKey := common.Copy(cp[0].key)
-			lastVal := common.Copy(cp[0].val)
-			// Advance all the items that have this key (including the top)
-			for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
-				ci1 := cp[0]
-				if ci1.dg.HasNext() {
-					ci1.key, _ = ci1.dg.NextUncompressed()
-					if d.compressVals {
-						ci1.val, _ = ci1.dg.Next(ci1.val[:0])
-					} else {
-						ci1.val, _ = ci1.dg.NextUncompressed()
-					}
-					heap.Fix(&cp, 0)
+	}
+	// In the loop below, the pair `keyBuf=>valBuf` is always 1 item behind `lastKey=>lastVal`.
+	// `lastKey` and `lastVal` are taken from the top of the multi-way merge (assisted by the CursorHeap cp), but not processed right away
+	// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
+	// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
+	// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
+	var keyBuf, valBuf []byte
+	for cp.Len() > 0 {
+		lastKey := common.Copy(cp[0].key)
+		lastVal := common.Copy(cp[0].val)
+		// Advance all the items that have this key (including the top)
+		for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
+			ci1 := cp[0]
+			if ci1.dg.HasNext() {
+				ci1.key, _ = ci1.dg.NextUncompressed()
+				if d.compressVals {
+					ci1.val, _ = ci1.dg.Next(ci1.val[:0])
 				} else {
-					heap.Pop(&cp)
+					ci1.val, _ = ci1.dg.NextUncompressed()
 				}
-			}
-			var skip bool
-			if d.prefixLen > 0 {
-				skip = r.valuesStartTxNum == 0 && len(lastVal) == 0 && len(lastKey) != d.prefixLen
+				heap.Fix(&cp, 0)
 			} else {
-				// For the rest of types, empty value means deletion
-				skip = r.valuesStartTxNum == 0 && len(lastVal) == 0
-			}
-			if !skip {
-				if keyBuf != nil && (d.prefixLen == 0 || len(keyBuf) != d.prefixLen || bytes.HasPrefix(lastKey, keyBuf)) {
-					if err = comp.AddUncompressedWord(keyBuf); err != nil {
-						return nil, nil, nil, err
-					}
-					keyCount++ // Only counting keys, not values
-					if d.compressVals {
-						if err = comp.AddWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
-					} else {
-						if err = comp.AddUncompressedWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
-					}
-				}
-				keyBuf = append(keyBuf[:0], lastKey...)
-				valBuf = append(valBuf[:0], lastVal...)
+				heap.Pop(&cp)
 			}
 		}
-		if keyBuf != nil {
-			if err = comp.AddUncompressedWord(keyBuf); err != nil {
-				return nil, nil, nil, err
-			}
-			keyCount++ // Only counting keys, not values
-			if d.compressVals {
-				if err = comp.AddWord(valBuf); err != nil {
-					return nil, nil, nil, err
-				}
-			} else {
-				if err = comp.AddUncompressedWord(valBuf); err != nil {
-					return nil, nil, nil, err
+		var skip bool
+		if d.prefixLen > 0 {
+			skip = startTxNum == 0 && len(lastVal) == 0 && len(lastKey) != d.prefixLen
+		} else {
+			// For the rest of types, empty value means deletion
+			skip = startTxNum == 0 && len(lastVal) == 0
+		}
+		if !skip {
+			if keyBuf != nil && (d.prefixLen == 0 || len(keyBuf) != d.prefixLen || bytes.HasPrefix(lastKey, keyBuf)) {
+				if err := w.add(keyBuf, valBuf); err != nil {
+					return nil, err
 				}
 			}
+			keyBuf = append(keyBuf[:0], lastKey...)
+			valBuf = append(valBuf[:0], lastVal...)
 		}
-		if err = comp.Compress(); err != nil {
-			return nil, nil, nil, err
-		}
-		comp.Close()
-		comp = nil
-		idxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, r.valuesStartTxNum/d.aggregationStep, r.valuesEndTxNum/d.aggregationStep))
-		frozen := (r.valuesEndTxNum-r.valuesStartTxNum)/d.aggregationStep == StepsInBiggestFile
-		valuesIn = &filesItem{startTxNum: r.valuesStartTxNum, endTxNum: r.valuesEndTxNum, frozen: frozen}
-		if valuesIn.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-			return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
-		}
-		//		if valuesIn.index, err = buildIndex(valuesIn.decompressor, idxPath, d.dir, keyCount, false /* values */); err != nil {
-		if valuesIn.index, err = buildIndex(ctx, valuesIn.decompressor, idxPath, d.tmpdir, keyCount, false /* values */); err != nil {
-			return nil, nil, nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+	}
+	if keyBuf != nil {
+		if err := w.add(keyBuf, valBuf); err != nil {
+			return nil, err
 		}
 	}
-	closeItem = false
-	d.stats.MergesCount++
-	d.mergesCount++
-	return
+	valuesIn, err := w.finish()
+	if err != nil {
+		return nil, err
+	}
+	closeW = false
+	return valuesIn, nil
 }
 
 func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, startTxNum, endTxNum uint64, workers int) (*filesItem, error) {
+	if err := openFiles(files); err != nil {
+		return nil, err
+	}
 	for _, h := range files {
 		defer h.decompressor.EnableMadvNormal().DisableReadAhead()
 	}
@@ -778,6 +781,7 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 		}
 	}
 	keyCount := 0
+	var stats FileStats
 
 	// In the loop below, the pair `keyBuf=>valBuf` is always 1 item behind `lastKey=>lastVal`.
 	// `lastKey` and `lastVal` are taken from the top of the multi-way merge (assisted by the CursorHeap cp), but not processed right away
@@ -818,6 +822,7 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 			if err = comp.AddUncompressedWord(valBuf); err != nil {
 				return nil, err
 			}
+			stats.addEf(valBuf)
 		}
 		keyBuf = append(keyBuf[:0], lastKey...)
 		valBuf = append(valBuf[:0], lastVal...)
@@ -830,20 +835,34 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 		if err = comp.AddUncompressedWord(valBuf); err != nil {
 			return nil, err
 		}
+		stats.addEf(valBuf)
 	}
 	if err = comp.Compress(); err != nil {
 		return nil, err
 	}
 	comp.Close()
 	comp = nil
+	if err = writeFileStats(datPath, stats); err != nil {
+		return nil, err
+	}
+	if ii.contentAddressed {
+		if err = addressByContent(datPath); err != nil {
+			return nil, err
+		}
+	}
 	idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, startTxNum/ii.aggregationStep, endTxNum/ii.aggregationStep))
 	frozen := (endTxNum-startTxNum)/ii.aggregationStep == StepsInBiggestFile
 	outItem = &filesItem{startTxNum: startTxNum, endTxNum: endTxNum, frozen: frozen}
 	if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
 	}
-	if outItem.index, err = buildIndex(ctx, outItem.decompressor, idxPath, ii.tmpdir, keyCount, false /* values */); err != nil {
-		return nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
+	if !ii.withoutIdx {
+		if outItem.index, err = buildIndex(ctx, outItem.decompressor, idxPath, ii.tmpdir, keyCount, false /* values */, nil); err != nil {
+			return nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
+		}
+	}
+	if outItem.bt, err = ii.buildBt(ctx, outItem.decompressor, startTxNum/ii.aggregationStep, endTxNum/ii.aggregationStep); err != nil {
+		return nil, err
 	}
 	closeItem = false
 	return outItem, nil
@@ -859,6 +878,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 			if indexIn != nil {
 				indexIn.decompressor.Close()
 				indexIn.index.Close()
+				indexIn.bt.Close()
 			}
 		}
 	}()
@@ -867,6 +887,9 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 	}
 	if r.history {
 		log.Info(fmt.Sprintf("[snapshots] merge: %s.%d-%d.v", h.filenameBase, r.historyStartTxNum/h.aggregationStep, r.historyEndTxNum/h.aggregationStep))
+		if err = openFiles(historyFiles); err != nil {
+			return nil, nil, err
+		}
 		for _, f := range indexFiles {
 			defer f.decompressor.EnableMadvNormal().DisableReadAhead()
 		}
@@ -878,12 +901,17 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		var decomp *compress.Decompressor
 		var rs *recsplit.RecSplit
 		var index *recsplit.Index
+		var blobs *filesItem
 		var closeItem = true
 		defer func() {
 			if closeItem {
 				if comp != nil {
 					comp.Close()
 				}
+				if blobs != nil {
+					blobs.decompressor.Close()
+					blobs.index.Close()
+				}
 				if decomp != nil {
 					decomp.Close()
 				}
@@ -915,9 +943,11 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 			g.Reset(0)
 			if g.HasNext() {
 				var g2 *compress.Getter
+				var blobs *filesItem
 				for _, hi := range historyFiles { // full-scan, because it's ok to have different amount files. by unclean-shutdown.
 					if hi.startTxNum == item.startTxNum && hi.endTxNum == item.endTxNum {
 						g2 = hi.decompressor.MakeGetter()
+						blobs = hi.blobs
 						break
 					}
 				}
@@ -930,6 +960,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 					t:        FILE_CURSOR,
 					dg:       g,
 					dg2:      g2,
+					blobs:    blobs,
 					key:      key,
 					val:      val,
 					endTxNum: item.endTxNum,
@@ -944,12 +975,28 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
 		var valBuf []byte
 		var keyCount int
+		var stats FileStats
+		// taggedVals: input words are decoded (references and large values resolved) and encoded again - across all
+		// steps of merged file
+		var dec valsDecoder
+		blobsOut := h.newBlobsWriter(r.historyStartTxNum/h.aggregationStep, r.historyEndTxNum/h.aggregationStep)
+		defer blobsOut.close()
+		enc := h.newValsEncoder(blobsOut)
 		for cp.Len() > 0 {
 			lastKey := common.Copy(cp[0].key)
+			stats.Keys++
 			// Advance all the items that have this key (including the top)
 			for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
 				ci1 := cp[0]
 				count := eliasfano32.Count(ci1.val)
+				stats.addTxNums(eliasfano32.Min(ci1.val), eliasfano32.Max(ci1.val))
+				stats.Values += count
+				var efIt *eliasfano32.EliasFanoIter
+				if h.taggedVals() {
+					dec = valsDecoder{blobs: ci1.blobs, compressVals: h.compressVals}
+					ef, _ := eliasfano32.ReadEliasFano(ci1.val)
+					efIt = ef.Iterator()
+				}
 				for i := uint64(0); i < count; i++ {
 					if !ci1.dg2.HasNext() {
 						panic(fmt.Errorf("assert: no value??? %s, i=%d, count=%d, lastKey=%x, ci1.key=%x", ci1.dg2.FileName(), i, count, lastKey, ci1.key))
@@ -957,14 +1004,30 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 
 					if h.compressVals {
 						valBuf, _ = ci1.dg2.Next(valBuf[:0])
-						if err = comp.AddWord(valBuf); err != nil {
-							return nil, nil, err
-						}
 					} else {
 						valBuf, _ = ci1.dg2.NextUncompressed()
-						if err = comp.AddUncompressedWord(valBuf); err != nil {
+					}
+					word := valBuf
+					if h.taggedVals() {
+						txNum, _ := efIt.Next()
+						val, err := dec.decode(lastKey, valBuf)
+						if err != nil {
+							return nil, nil, fmt.Errorf("merge %s: %s: %w", h.filenameBase, ci1.dg2.FileName(), err)
+						}
+						stats.ValuesBytes += uint64(len(val))
+						if word, err = enc.encode(lastKey, txNum, val); err != nil {
 							return nil, nil, err
 						}
+					} else {
+						stats.ValuesBytes += uint64(len(valBuf))
+					}
+					if h.compressVals {
+						err = comp.AddWord(word)
+					} else {
+						err = comp.AddUncompressedWord(word)
+					}
+					if err != nil {
+						return nil, nil, err
 					}
 				}
 				keyCount += int(count)
@@ -982,6 +1045,17 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		}
 		comp.Close()
 		comp = nil
+		if blobs, err = blobsOut.build(ctx); err != nil {
+			return nil, nil, err
+		}
+		if err = writeFileStats(datPath, stats); err != nil {
+			return nil, nil, err
+		}
+		if h.contentAddressed {
+			if err = addressByContent(datPath); err != nil {
+				return nil, nil, err
+			}
+		}
 		if decomp, err = compress.NewDecompressor(datPath); err != nil {
 			return nil, nil, err
 		}
@@ -1042,7 +1116,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 			return nil, nil, fmt.Errorf("open %s idx: %w", h.filenameBase, err)
 		}
 		frozen := (r.historyEndTxNum-r.historyStartTxNum)/h.aggregationStep == StepsInBiggestFile
-		historyIn = &filesItem{startTxNum: r.historyStartTxNum, endTxNum: r.historyEndTxNum, decompressor: decomp, index: index, frozen: frozen}
+		historyIn = &filesItem{startTxNum: r.historyStartTxNum, endTxNum: r.historyEndTxNum, decompressor: decomp, index: index, frozen: frozen, blobs: blobs}
 		closeItem = false
 	}
 
@@ -1052,13 +1126,17 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 
 func (d *Domain) integrateMergedFiles(valuesOuts, indexOuts, historyOuts []*filesItem, valuesIn, indexIn, historyIn *filesItem) {
 	d.History.integrateMergedFiles(indexOuts, historyOuts, indexIn, historyIn)
+	d.integrateMergedValuesFiles(valuesOuts, valuesIn)
+}
+
+func (d *Domain) integrateMergedValuesFiles(valuesOuts []*filesItem, valuesIn *filesItem) {
 	if valuesIn != nil {
-		d.files.Set(valuesIn)
+		d.files.Load().Set(valuesIn)
 
 		// `kill -9` may leave some garbage
 		// but it still may be useful for merges, until we finish merge frozen file
-		if historyIn.frozen {
-			d.files.Walk(func(items []*filesItem) bool {
+		if valuesIn.frozen {
+			d.files.Load().Walk(func(items []*filesItem) bool {
 				for _, item := range items {
 					if item.frozen || item.endTxNum > valuesIn.endTxNum {
 						continue
@@ -1073,20 +1151,22 @@ func (d *Domain) integrateMergedFiles(valuesOuts, indexOuts, historyOuts []*file
 		if out == nil {
 			panic("must not happen")
 		}
-		d.files.Delete(out)
-		out.canDelete.Store(true)
+		d.files.Load().Delete(out)
 	}
 	d.reCalcRoFiles()
+	for _, out := range valuesOuts {
+		out.markDeleted()
+	}
 }
 
 func (ii *InvertedIndex) integrateMergedFiles(outs []*filesItem, in *filesItem) {
 	if in != nil {
-		ii.files.Set(in)
+		ii.files.Load().Set(in)
 
 		// `kill -9` may leave some garbage
 		// but it still may be useful for merges, until we finish merge frozen file
 		if in.frozen {
-			ii.files.Walk(func(items []*filesItem) bool {
+			ii.files.Load().Walk(func(items []*filesItem) bool {
 				for _, item := range items {
 					if item.frozen || item.endTxNum > in.endTxNum {
 						continue
@@ -1101,22 +1181,24 @@ func (ii *InvertedIndex) integrateMergedFiles(outs []*filesItem, in *filesItem)
 		if out == nil {
 			panic("must not happen: " + ii.filenameBase)
 		}
-		ii.files.Delete(out)
-		out.canDelete.Store(true)
+		ii.files.Load().Delete(out)
 	}
 	ii.reCalcRoFiles()
+	for _, out := range outs {
+		out.markDeleted()
+	}
 }
 
 func (h *History) integrateMergedFiles(indexOuts, historyOuts []*filesItem, indexIn, historyIn *filesItem) {
 	h.InvertedIndex.integrateMergedFiles(indexOuts, indexIn)
 	//TODO: handle collision
 	if historyIn != nil {
-		h.files.Set(historyIn)
+		h.files.Load().Set(historyIn)
 
 		// `kill -9` may leave some garbage
 		// but it still may be useful for merges, until we finish merge frozen file
 		if historyIn.frozen {
-			h.files.Walk(func(items []*filesItem) bool {
+			h.files.Load().Walk(func(items []*filesItem) bool {
 				for _, item := range items {
 					if item.frozen || item.endTxNum > historyIn.endTxNum {
 						continue
@@ -1131,10 +1213,12 @@ func (h *History) integrateMergedFiles(indexOuts, historyOuts []*filesItem, inde
 		if out == nil {
 			panic("must not happen: " + h.filenameBase)
 		}
-		h.files.Delete(out)
-		out.canDelete.Store(true)
+		h.files.Load().Delete(out)
 	}
 	h.reCalcRoFiles()
+	for _, out := range historyOuts {
+		out.markDeleted()
+	}
 }
 
 func (d *Domain) cleanAfterFreeze(f *filesItem) {
@@ -1145,7 +1229,7 @@ func (d *Domain) cleanAfterFreeze(f *filesItem) {
 	var outs []*filesItem
 	// `kill -9` may leave some garbage
 	// but it may be useful for merges, until merge `frozen` file
-	d.files.Walk(func(items []*filesItem) bool {
+	d.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.frozen || item.endTxNum > f.endTxNum {
 				continue
@@ -1159,13 +1243,16 @@ func (d *Domain) cleanAfterFreeze(f *filesItem) {
 		if out == nil {
 			panic("must not happen: " + d.filenameBase)
 		}
-		d.files.Delete(out)
-		out.canDelete.Store(true)
+		d.files.Load().Delete(out)
+	}
+	d.reCalcRoFiles()
+	for _, out := range outs {
+		out.markDeleted() // physically deleted by last context which uses it
 	}
 	d.History.cleanAfterFreeze(f)
 }
 
-// cleanAfterFreeze - mark all small files before `f` as `canDelete=true`
+// cleanAfterFreeze - small files before `f` are deleted, see filesItem.markDeleted
 func (h *History) cleanAfterFreeze(f *filesItem) {
 	if f == nil || !f.frozen {
 		return
@@ -1173,7 +1260,7 @@ func (h *History) cleanAfterFreeze(f *filesItem) {
 	var outs []*filesItem
 	// `kill -9` may leave some garbage
 	// but it may be useful for merges, until merge `frozen` file
-	h.files.Walk(func(items []*filesItem) bool {
+	h.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.frozen || item.endTxNum > f.endTxNum {
 				continue
@@ -1187,13 +1274,16 @@ func (h *History) cleanAfterFreeze(f *filesItem) {
 		if out == nil {
 			panic("must not happen: " + h.filenameBase)
 		}
-		h.files.Delete(out)
-		out.canDelete.Store(true)
+		h.files.Load().Delete(out)
+	}
+	h.reCalcRoFiles()
+	for _, out := range outs {
+		out.markDeleted() // physically deleted by last context which uses it
 	}
 	h.InvertedIndex.cleanAfterFreeze(f)
 }
 
-// cleanAfterFreeze - mark all small files before `f` as `canDelete=true`
+// cleanAfterFreeze - small files before `f` are deleted, see filesItem.markDeleted
 func (ii *InvertedIndex) cleanAfterFreeze(f *filesItem) {
 	if f == nil || !f.frozen {
 		return
@@ -1201,7 +1291,7 @@ func (ii *InvertedIndex) cleanAfterFreeze(f *filesItem) {
 	var outs []*filesItem
 	// `kill -9` may leave some garbage
 	// but it may be useful for merges, until merge `frozen` file
-	ii.files.Walk(func(items []*filesItem) bool {
+	ii.files.Load().Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.frozen || item.endTxNum > f.endTxNum {
 				continue
@@ -1215,7 +1305,10 @@ func (ii *InvertedIndex) cleanAfterFreeze(f *filesItem) {
 		if out == nil {
 			panic("must not happen: " + ii.filenameBase)
 		}
-		ii.files.Delete(out)
-		out.canDelete.Store(true)
+		ii.files.Load().Delete(out)
+	}
+	ii.reCalcRoFiles()
+	for _, out := range outs {
+		out.markDeleted() // physically deleted by last context which uses it
 	}
 }
@@ -7,16 +7,17 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
+	atomic2 "go.uber.org/atomic"
 
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 )
 
 func TestFindMergeRangeCornerCases(t *testing.T) {
 	t.Run("> 2 unmerged files", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 		needMerge, from, to := ii.findMergeRange(4, 32)
 		assert.True(t, needMerge)
 		assert.Equal(t, 0, int(from))
@@ -24,21 +25,21 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		idxF, _ := ii.staticFilesInRange(from, to, nil)
 		assert.Equal(t, 3, len(idxF))
 
-		ii = &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii = &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 		needMerge, from, to = ii.findMergeRange(4, 32)
 		assert.True(t, needMerge)
 		assert.Equal(t, 0, int(from))
 		assert.Equal(t, 2, int(to))
 
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		h.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		h.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
 		r := h.findMergeRange(4, 32)
 		assert.True(t, r.history)
@@ -46,15 +47,15 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		assert.Equal(t, 2, int(r.indexEndTxNum))
 	})
 	t.Run("not equal amount of files", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
 
 		r := h.findMergeRange(4, 32)
 		assert.True(t, r.index)
@@ -64,14 +65,14 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		assert.Equal(t, 2, int(r.indexEndTxNum))
 	})
 	t.Run("idx merged, history not yet", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
 
 		r := h.findMergeRange(4, 32)
 		assert.True(t, r.history)
@@ -80,18 +81,18 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		assert.Equal(t, 2, int(r.historyEndTxNum))
 	})
 	t.Run("idx merged, history not yet, 2", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 4})
-
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		h.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 4})
+
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		h.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
 		r := h.findMergeRange(4, 32)
 		assert.False(t, r.index)
@@ -103,14 +104,14 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		require.Equal(t, 2, len(histFiles))
 	})
 	t.Run("idx merged and small files lost", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 4})
 
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		h.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		h.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
 		r := h.findMergeRange(4, 32)
 		assert.False(t, r.index)
@@ -121,15 +122,15 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 	})
 
 	t.Run("history merged, but index not and history garbage left", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
 
 		// `kill -9` may leave small garbage files, but if big one already exists we assume it's good(fsynced) and no reason to merge again
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
 
 		r := h.findMergeRange(4, 32)
 		assert.True(t, r.index)
@@ -141,20 +142,20 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		require.Equal(t, 0, len(histFiles))
 	})
 	t.Run("history merge progress ahead of idx", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
 		// `kill -9` may leave small garbage files, but if big one already exists we assume it's good(fsynced) and no reason to merge again
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		h.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		h.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 
 		r := h.findMergeRange(4, 32)
 		assert.True(t, r.index)
@@ -166,17 +167,17 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		require.Equal(t, 3, len(histFiles))
 	})
 	t.Run("idx merge progress ahead of history", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
 
 		// `kill -9` may leave small garbage files, but if big one already exists we assume it's good(fsynced) and no reason to merge again
-		h := &History{InvertedIndex: ii, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		h.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		h.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		h.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		h := &History{InvertedIndex: ii, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		h.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		h.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		h.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
 
 		r := h.findMergeRange(4, 32)
 		assert.False(t, r.index)
@@ -188,27 +189,27 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		require.Equal(t, 2, len(histFiles))
 	})
 	t.Run("idx merged, but garbage left", func(t *testing.T) {
-		ii := &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii := &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
 		needMerge, _, _ := ii.findMergeRange(4, 32)
 		assert.False(t, needMerge)
 
-		ii = &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii = &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
 		needMerge, _, _ = ii.findMergeRange(4, 32)
 		assert.False(t, needMerge)
 
-		ii = &InvertedIndex{aggregationStep: 1, files: btree2.NewBTreeG[*filesItem](filesItemLess)}
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 1})
-		ii.files.Set(&filesItem{startTxNum: 1, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 0, endTxNum: 2})
-		ii.files.Set(&filesItem{startTxNum: 2, endTxNum: 3})
-		ii.files.Set(&filesItem{startTxNum: 3, endTxNum: 4})
+		ii = &InvertedIndex{aggregationStep: 1, files: *atomic2.NewPointer(btree2.NewBTreeG[*filesItem](filesItemLess))}
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 1})
+		ii.files.Load().Set(&filesItem{startTxNum: 1, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 0, endTxNum: 2})
+		ii.files.Load().Set(&filesItem{startTxNum: 2, endTxNum: 3})
+		ii.files.Load().Set(&filesItem{startTxNum: 3, endTxNum: 4})
 		needMerge, from, to := ii.findMergeRange(4, 32)
 		assert.True(t, needMerge)
 		require.Equal(t, 0, int(from))
@@ -0,0 +1,103 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+)
+
+// idxBuildMarkerSuffix - BuildMissedIndices creates marker file next to index before build and removes it
+// when index is durably written. So progress of BuildMissedIndices survives restart: index without marker is complete
+// and skipped, index with marker (build interrupted by crash) is removed and built again.
+const idxBuildMarkerSuffix = ".building"
+
+// idxBuilt - index exists and its build was not interrupted. Removes leftovers of interrupted build.
+// Must be called before index is used by readers.
+func idxBuilt(item *filesItem, idxPath string) bool {
+	if !dir.FileExist(idxPath + idxBuildMarkerSuffix) {
+		return fileOrStubExist(idxPath)
+	}
+	if item.index != nil {
+		item.index.Close()
+		item.index = nil
+	}
+	if item.idxPath == idxPath {
+		item.idxPath = ""
+	}
+	_ = os.Remove(idxPath)
+	_ = os.Remove(idxPath + ".tmp")
+	_ = os.Remove(idxPath + idxBuildMarkerSuffix)
+	return false
+}
+
+func startIdxBuild(idxPath string) error {
+	f, err := os.Create(idxPath + idxBuildMarkerSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(idxPath))
+}
+
+// finishIdxBuild - index file is synced by recsplit before rename, here rename is made durable before marker removal
+func finishIdxBuild(idxPath string) error {
+	if !dir.FileExist(idxPath) {
+		return fmt.Errorf("index %s was not created", idxPath)
+	}
+	if err := syncDir(filepath.Dir(idxPath)); err != nil {
+		return err
+	}
+	return os.Remove(idxPath + idxBuildMarkerSuffix)
+}
+
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" { // directories can't be synced, rename is durable
+		return nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// buildMissedIdx - builds 1 index between start/finish markers, progress of build is visible in ps (if not nil)
+func buildMissedIdx(ps *background.ProgressSet, idxPath string, total int, build func(p *background.Progress) error) error {
+	p := &background.Progress{}
+	p.Name.Store(filepath.Base(idxPath))
+	p.Total.Store(uint64(total))
+	ps.Add(p)
+	defer ps.Delete(p)
+
+	if err := startIdxBuild(idxPath); err != nil {
+		return err
+	}
+	if err := build(p); err != nil {
+		return err
+	}
+	return finishIdxBuild(idxPath)
+}
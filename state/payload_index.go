@@ -0,0 +1,113 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// PayloadIndex - InvertedIndex which stores small value (payload) per (key, txNum). For example: index of log
+// within block - then RPC doesn't need re-read receipts to find matching log.
+// Files and db tables are same as of History (.ef + .v): collated, built, merged and pruned by History methods.
+// Unlike History, payload belongs to txNum itself (not value before change): it's looked up by exact txNum.
+type PayloadIndex struct {
+	*History
+}
+
+func NewPayloadIndex(dir, tmpdir string, aggregationStep uint64, filenameBase, indexKeysTable, indexTable, payloadsTable, settingsTable string, compressPayloads bool) (*PayloadIndex, error) {
+	h, err := NewHistory(dir, tmpdir, aggregationStep, filenameBase, indexKeysTable, indexTable, payloadsTable, settingsTable, compressPayloads, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NewPayloadIndex: %s, %w", filenameBase, err)
+	}
+	return &PayloadIndex{History: h}, nil
+}
+
+// AddWithPayload - like InvertedIndex.Add, but also stores payload of key at current txNum. Empty payload is valid: read as nil.
+func (p *PayloadIndex) AddWithPayload(key, payload []byte) error {
+	return p.AddPrevValue(key, nil, payload)
+}
+
+type PayloadIndexContext struct {
+	hc *HistoryContext
+}
+
+func (p *PayloadIndex) MakeContext() *PayloadIndexContext {
+	return &PayloadIndexContext{hc: p.History.MakeContext()}
+}
+
+func (pc *PayloadIndexContext) Close() { pc.hc.Close() }
+
+// Get - payload of key at exactly txNum, ok=false if key wasn't added at txNum.
+// Returned payload is valid until context is closed.
+func (pc *PayloadIndexContext) Get(key []byte, txNum uint64, roTx kv.Tx) (payload []byte, ok bool, err error) {
+	it, err := pc.hc.ic.IterateRange(key, int(txNum), int(txNum)+1, order.Asc, 1, roTx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer it.Close()
+	if !it.HasNext() {
+		return nil, false, nil
+	}
+	if payload, ok, err = pc.hc.GetNoStateWithRecent(key, txNum, roTx); len(payload) == 0 {
+		payload = nil
+	}
+	return payload, ok, err
+}
+
+// IterateRange - txNums of key with their payloads, range and order are same as of InvertedIndexContext.IterateRange
+func (pc *PayloadIndexContext) IterateRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (*PayloadIterator, error) {
+	it, err := pc.hc.ic.IterateRange(key, startTxNum, endTxNum, asc, limit, roTx)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadIterator{it: it, hc: pc.hc, key: key, roTx: roTx}, nil
+}
+
+// PayloadIterator - iter.Dual of txNum and payload. Payload of each txNum is found by its exact txNum.
+type PayloadIterator struct {
+	it   *InvertedIterator
+	hc   *HistoryContext
+	key  []byte
+	roTx kv.Tx
+}
+
+func (pi *PayloadIterator) Close()        { pi.it.Close() }
+func (pi *PayloadIterator) HasNext() bool { return pi.it.HasNext() }
+
+// Seek - see InvertedIterator.Seek
+func (pi *PayloadIterator) Seek(txNum uint64) { pi.it.Seek(txNum) }
+
+func (pi *PayloadIterator) Next() (uint64, []byte, error) {
+	txNum, err := pi.it.Next()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, ok, err := pi.hc.GetNoStateWithRecent(pi.key, txNum, pi.roTx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, fmt.Errorf("payload of %x at txNum=%d not found in %s", pi.key, txNum, pi.hc.h.filenameBase)
+	}
+	if len(payload) == 0 {
+		payload = nil
+	}
+	return txNum, payload, nil
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// payloadOf - index of log within block in real use; empty for every 5th txNum
+func payloadOf(txNum uint64) []byte {
+	if txNum%5 == 0 {
+		return nil
+	}
+	return []byte{byte(txNum % 251), 0xaa}
+}
+
+func filledPayloadIndex(tb testing.TB) (kv.RwDB, *PayloadIndex, uint64) {
+	tb.Helper()
+	path := tb.TempDir()
+	db := mdbx.NewMDBX(log.New()).InMem(path).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{
+			"Keys":     kv.TableCfgItem{Flags: kv.DupSort},
+			"Index":    kv.TableCfgItem{Flags: kv.DupSort},
+			"Payloads": kv.TableCfgItem{},
+			"Settings": kv.TableCfgItem{},
+		}
+	}).MustOpen()
+	tb.Cleanup(db.Close)
+	p, err := NewPayloadIndex(path, path, 16, "logaddrs", "Keys", "Index", "Payloads", "Settings", false)
+	require.NoError(tb, err)
+	tb.Cleanup(p.Close)
+
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(tb, err)
+	defer tx.Rollback()
+	p.SetTx(tx)
+	p.StartWrites("")
+	defer p.FinishWrites()
+	txs := uint64(1000)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		p.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			if txNum%keyNum == 0 {
+				var k [8]byte
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				require.NoError(tb, p.AddWithPayload(k[:], payloadOf(txNum)))
+			}
+		}
+	}
+	require.NoError(tb, p.Rotate().Flush(ctx, tx))
+	require.NoError(tb, tx.Commit())
+	return db, p, txs
+}
+
+func TestPayloadIndex(t *testing.T) {
+	test := func(t *testing.T, db kv.RwDB, p *PayloadIndex) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		pc := p.MakeContext()
+		defer pc.Close()
+		for _, keyNum := range []uint64{1, 3, 17, 31} {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+
+			it, err := pc.IterateRange(k[:], 0, 1001, order.Asc, -1, tx)
+			require.NoError(t, err)
+			expect := keyNum
+			for it.HasNext() {
+				txNum, payload, err := it.Next()
+				require.NoError(t, err)
+				label := fmt.Sprintf("key=%d, txNum=%d", keyNum, txNum)
+				require.Equal(t, expect, txNum, label)
+				require.Equal(t, payloadOf(txNum), payload, label)
+				expect += keyNum
+			}
+			it.Close()
+			require.Greater(t, expect, uint64(1000))
+
+			it, err = pc.IterateRange(k[:], 1000, 500, order.Desc, 3, tx)
+			require.NoError(t, err)
+			for expect = 1000 - 1000%keyNum; it.HasNext(); expect -= keyNum {
+				txNum, payload, err := it.Next()
+				require.NoError(t, err)
+				require.Equal(t, expect, txNum)
+				require.Equal(t, payloadOf(txNum), payload)
+			}
+			it.Close()
+
+			for _, txNum := range []uint64{keyNum * 7, keyNum * 20, keyNum*31 + 1, 999} {
+				payload, ok, err := pc.Get(k[:], txNum, tx)
+				require.NoError(t, err)
+				require.Equal(t, txNum%keyNum == 0, ok, txNum)
+				if ok {
+					require.Equal(t, payloadOf(txNum), payload)
+				}
+			}
+		}
+	}
+	t.Run("db", func(t *testing.T) {
+		db, p, _ := filledPayloadIndex(t)
+		test(t, db, p)
+	})
+	t.Run("files", func(t *testing.T) {
+		db, p, txs := filledPayloadIndex(t)
+		collateAndMergeHistory(t, db, p.History, txs)
+		test(t, db, p)
+	})
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"math"
+	"sync"
+)
+
+// PruneHorizons - readers (for example RPC: logs search, traces) register the oldest txNum they still need
+// from given inverted index (by it's filenameBase: "logaddrs", "tracesto", "accounts", ...).
+// Prune of index never deletes data at or above the deepest registration of this index: neither prune of DB
+// (AggregatorV3.Prune, retire plan) nor removal of files (AggregatorV3.ExpireHistory).
+// Indices without registrations are pruned as usual. Thread-safe.
+type PruneHorizons struct {
+	lock   sync.Mutex
+	nextID uint64
+	regs   map[string]map[uint64]uint64 // index -> registration id -> oldest needed txNum
+}
+
+// PruneHorizon - one registration, see PruneHorizons.Register
+type PruneHorizon struct {
+	hs    *PruneHorizons
+	index string
+	id    uint64
+}
+
+func NewPruneHorizons() *PruneHorizons {
+	return &PruneHorizons{regs: map[string]map[uint64]uint64{}}
+}
+
+func (hs *PruneHorizons) Register(index string, oldestNeededTxNum uint64) *PruneHorizon {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.nextID++
+	if hs.regs[index] == nil {
+		hs.regs[index] = map[uint64]uint64{}
+	}
+	hs.regs[index][hs.nextID] = oldestNeededTxNum
+	return &PruneHorizon{hs: hs, index: index, id: hs.nextID}
+}
+
+// Horizon - deepest (smallest) registered txNum of index. `ok=false` if index has no registrations.
+func (hs *PruneHorizons) Horizon(index string) (txNum uint64, ok bool) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	regs := hs.regs[index]
+	if len(regs) == 0 {
+		return 0, false
+	}
+	txNum = math.MaxUint64
+	for _, v := range regs {
+		if v < txNum {
+			txNum = v
+		}
+	}
+	return txNum, true
+}
+
+// limit - txTo (or expiry horizon) which prune of index must respect
+func (hs *PruneHorizons) limit(index string, txTo uint64) uint64 {
+	if horizon, ok := hs.Horizon(index); ok && horizon < txTo {
+		return horizon
+	}
+	return txTo
+}
+
+// Update - moves registration (usually forward: reader doesn't need old data anymore)
+func (h *PruneHorizon) Update(oldestNeededTxNum uint64) {
+	h.hs.lock.Lock()
+	defer h.hs.lock.Unlock()
+	if _, ok := h.hs.regs[h.index][h.id]; ok {
+		h.hs.regs[h.index][h.id] = oldestNeededTxNum
+	}
+}
+
+func (h *PruneHorizon) Release() {
+	h.hs.lock.Lock()
+	defer h.hs.lock.Unlock()
+	delete(h.hs.regs[h.index], h.id)
+}
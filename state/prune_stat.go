@@ -0,0 +1,110 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	common2 "github.com/ledgerwatch/erigon-lib/common"
+)
+
+// PruneStat - result of AggregatorV3.Prune: for logs of progress and tuning of prune limits
+type PruneStat struct {
+	Entities []*EntityPruneStat // in order of prune
+	Took     time.Duration
+}
+
+// EntityPruneStat - prune of 1 history, inverted index or latest state domain
+type EntityPruneStat struct {
+	Name     string
+	Deleted  map[string]uint64 // table -> amount of deleted records
+	Bytes    uint64            // size of deleted keys and values: db pages are freed and re-used by db later
+	PrunedTo uint64            // txNum: data before it is pruned
+	Took     time.Duration
+}
+
+func newEntityPruneStat(name string) *EntityPruneStat {
+	return &EntityPruneStat{Name: name, Deleted: map[string]uint64{}}
+}
+
+func (s *EntityPruneStat) deleted(table string, k, v []byte) {
+	if s == nil {
+		return
+	}
+	s.Deleted[table]++
+	s.Bytes += uint64(len(k) + len(v))
+}
+
+// Records - amount of deleted records in all tables
+func (s *EntityPruneStat) Records() (n uint64) {
+	for _, cnt := range s.Deleted {
+		n += cnt
+	}
+	return n
+}
+
+func (s *PruneStat) entity(name string) *EntityPruneStat {
+	for _, e := range s.Entities {
+		if e.Name == name {
+			return e
+		}
+	}
+	e := newEntityPruneStat(name)
+	s.Entities = append(s.Entities, e)
+	return e
+}
+
+// Records - amount of deleted records of all entities
+func (s *PruneStat) Records() (n uint64) {
+	for _, e := range s.Entities {
+		n += e.Records()
+	}
+	return n
+}
+
+// Accumulate - adds stat of next prune (like PruneWithTiemout does): PrunedTo is taken from `o`
+func (s *PruneStat) Accumulate(o *PruneStat) {
+	for _, oe := range o.Entities {
+		e := s.entity(oe.Name)
+		for table, cnt := range oe.Deleted {
+			e.Deleted[table] += cnt
+		}
+		e.Bytes += oe.Bytes
+		e.PrunedTo = oe.PrunedTo
+		e.Took += oe.Took
+	}
+	s.Took += o.Took
+}
+
+func (s *PruneStat) String() string {
+	var sb strings.Builder
+	for _, e := range s.Entities {
+		if e.Records() == 0 {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s: %d records, %s, to=%d, took=%s", e.Name, e.Records(), common2.ByteCount(e.Bytes), e.PrunedTo, e.Took)
+	}
+	if sb.Len() == 0 {
+		return "nothing pruned"
+	}
+	return sb.String()
+}
@@ -0,0 +1,358 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package query - ad-hoc inspection of history and inverted indices of AggregatorV3, for debugging tools.
+// Expressions are compiled onto iterators of AggregatorV3Context - nothing is indexed additionally.
+//
+// Text form:
+//
+//	[count|distinct] <source> [key|prefix <hex>] [txnums <from>..[<to>]] [limit <n>]
+//
+// For example, amount of storage keys of contract changed in txNums [1000, 2000):
+//
+//	distinct storage prefix 0x1f9840a85d5af5bf1d1762f925bdaddc4201f984 txnums 1000..2000
+package query
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+// Source - history of domain or inverted index, named as their files
+type Source string
+
+const (
+	Accounts   Source = "accounts"
+	Storage    Source = "storage"
+	Code       Source = "code"
+	LogAddrs   Source = "logaddrs"
+	LogTopics  Source = "logtopics"
+	TracesFrom Source = "tracesfrom"
+	TracesTo   Source = "tracesto"
+)
+
+var sources = []Source{Accounts, Storage, Code, LogAddrs, LogTopics, TracesFrom, TracesTo}
+
+func (s Source) isHistory() bool { return s == Accounts || s == Storage || s == Code }
+
+// Agg - what Run returns
+type Agg int
+
+const (
+	List     Agg = iota // Result.Rows: (key, txNum) pairs
+	Count               // Result.Count: amount of (key, txNum) pairs
+	Distinct            // Result.Count: amount of distinct keys
+)
+
+// Expr - query. Built by From and composed by methods, each returns modified copy:
+//
+//	query.From(query.Storage).Prefix(addr).TxNums(1000, 2000).Distinct()
+type Expr struct {
+	src       Source
+	key       []byte
+	prefix    bool
+	fromTxNum uint64
+	toTxNum   uint64 // 0 - unbounded
+	agg       Agg
+	limit     int // only for List, -1 - unlimited
+}
+
+// From - all keys of source in all txNums
+func From(src Source) Expr { return Expr{src: src, limit: -1} }
+
+// Key - only given key. Required for inverted indices: they can't be iterated by keys.
+func (e Expr) Key(key []byte) Expr {
+	e.key, e.prefix = common.Copy(key), false
+	return e
+}
+
+// Prefix - only keys with given prefix (for storage: address). Only for history of domains.
+func (e Expr) Prefix(prefix []byte) Expr {
+	e.key, e.prefix = common.Copy(prefix), true
+	return e
+}
+
+// TxNums - only changes in [from, to), to=0 means unbounded
+func (e Expr) TxNums(from, to uint64) Expr {
+	e.fromTxNum, e.toTxNum = from, to
+	return e
+}
+
+func (e Expr) Count() Expr    { e.agg = Count; return e }
+func (e Expr) Distinct() Expr { e.agg = Distinct; return e }
+
+// Limit - max amount of rows of List, -1 - unlimited
+func (e Expr) Limit(n int) Expr {
+	e.limit = n
+	return e
+}
+
+// String - text form of expression, Parse(e.String()) returns same expression
+func (e Expr) String() string {
+	var sb strings.Builder
+	switch e.agg {
+	case Count:
+		sb.WriteString("count ")
+	case Distinct:
+		sb.WriteString("distinct ")
+	}
+	sb.WriteString(string(e.src))
+	if e.key != nil {
+		if e.prefix {
+			sb.WriteString(" prefix 0x")
+		} else {
+			sb.WriteString(" key 0x")
+		}
+		sb.WriteString(hex.EncodeToString(e.key))
+	}
+	if e.fromTxNum > 0 || e.toTxNum > 0 {
+		fmt.Fprintf(&sb, " txnums %d..", e.fromTxNum)
+		if e.toTxNum > 0 {
+			sb.WriteString(strconv.FormatUint(e.toTxNum, 10))
+		}
+	}
+	if e.limit >= 0 {
+		fmt.Fprintf(&sb, " limit %d", e.limit)
+	}
+	return sb.String()
+}
+
+// Parse - expression from text form, see package doc
+func Parse(s string) (e Expr, err error) {
+	tokens := strings.Fields(s)
+	next := func(what string) (string, error) {
+		if len(tokens) == 0 {
+			return "", fmt.Errorf("query %q: expected %s", s, what)
+		}
+		t := tokens[0]
+		tokens = tokens[1:]
+		return t, nil
+	}
+	t, err := next("source")
+	if err != nil {
+		return e, err
+	}
+	agg := List
+	switch t {
+	case "count":
+		agg = Count
+	case "distinct":
+		agg = Distinct
+	}
+	if agg != List {
+		if t, err = next("source"); err != nil {
+			return e, err
+		}
+	}
+	src, err := ParseSource(t)
+	if err != nil {
+		return e, fmt.Errorf("query %q: %w", s, err)
+	}
+	e = From(src)
+	e.agg = agg
+	for len(tokens) > 0 {
+		clause, _ := next("")
+		arg, err := next(clause + " argument")
+		if err != nil {
+			return e, err
+		}
+		switch clause {
+		case "key", "prefix":
+			b, err := hex.DecodeString(strings.TrimPrefix(arg, "0x"))
+			if err != nil {
+				return e, fmt.Errorf("query %q: %s: %w", s, clause, err)
+			}
+			if clause == "key" {
+				e = e.Key(b)
+			} else {
+				e = e.Prefix(b)
+			}
+		case "txnums":
+			from, to, ok := strings.Cut(arg, "..")
+			if !ok {
+				return e, fmt.Errorf("query %q: txnums: expected <from>..[<to>], got %q", s, arg)
+			}
+			if e.fromTxNum, err = strconv.ParseUint(from, 10, 64); err != nil {
+				return e, fmt.Errorf("query %q: txnums: %w", s, err)
+			}
+			e.toTxNum = 0
+			if to != "" {
+				if e.toTxNum, err = strconv.ParseUint(to, 10, 64); err != nil {
+					return e, fmt.Errorf("query %q: txnums: %w", s, err)
+				}
+			}
+		case "limit":
+			if e.limit, err = strconv.Atoi(arg); err != nil {
+				return e, fmt.Errorf("query %q: limit: %w", s, err)
+			}
+		default:
+			return e, fmt.Errorf("query %q: unknown clause %q", s, clause)
+		}
+	}
+	return e, e.validate()
+}
+
+func ParseSource(s string) (Source, error) {
+	for _, src := range sources {
+		if string(src) == s {
+			return src, nil
+		}
+	}
+	return "", fmt.Errorf("unknown source %q, expected one of %v", s, sources)
+}
+
+func (e Expr) validate() error {
+	if !e.src.isHistory() {
+		if e.key == nil || e.prefix {
+			return fmt.Errorf("query %q: index %s can be queried only by key", e, e.src)
+		}
+	}
+	if e.toTxNum > 0 && e.toTxNum < e.fromTxNum {
+		return fmt.Errorf("query %q: empty txnums range", e)
+	}
+	return nil
+}
+
+// Row - key changed (or added to index) at txNum
+type Row struct {
+	Key   []byte
+	TxNum uint64
+}
+
+type Result struct {
+	Rows  []Row  // List
+	Count uint64 // Count, Distinct
+}
+
+// Run - executes expression on files and recent data in tx
+func (e Expr) Run(ctx context.Context, ac *state.AggregatorV3Context, tx kv.Tx) (res Result, err error) {
+	if err = e.validate(); err != nil {
+		return res, err
+	}
+	if !e.src.isHistory() {
+		err = e.add(&res, e.key, ac, tx)
+		return res, err
+	}
+
+	// keys changed in range - by history, then txNums of each key - by its inverted index
+	from, to := e.key, []byte(nil)
+	if e.key != nil {
+		if e.prefix {
+			to, _ = kv.NextSubtree(e.key)
+		} else {
+			to = append(common.Copy(e.key), 0)
+		}
+	}
+	toTxNum := math.MaxInt
+	if e.toTxNum > 0 {
+		toTxNum = int(e.toTxNum)
+	}
+	var it *state.HistoryChangesIter
+	switch e.src {
+	case Accounts:
+		it = ac.AccountHistoryIterateChanged(int(e.fromTxNum), toTxNum, from, to, order.Asc, -1, tx)
+	case Storage:
+		it = ac.StorageHistoryIterateChanged(int(e.fromTxNum), toTxNum, from, to, order.Asc, -1, tx)
+	case Code:
+		it = ac.CodeHistoryIterateChanged(int(e.fromTxNum), toTxNum, from, to, order.Asc, -1, tx)
+	}
+	defer it.Close()
+	for it.HasNext() {
+		if e.agg == List && e.limit >= 0 && len(res.Rows) >= e.limit {
+			break
+		}
+		k, _, err := it.Next()
+		if err != nil {
+			return res, fmt.Errorf("query %q: %w", e, err)
+		}
+		if e.agg == Distinct {
+			res.Count++
+			continue
+		}
+		if err = e.add(&res, common.Copy(k), ac, tx); err != nil {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		default:
+		}
+	}
+	return res, nil
+}
+
+// add - txNums of key to result
+func (e Expr) add(res *Result, key []byte, ac *state.AggregatorV3Context, tx kv.Tx) error {
+	toTxNum := -1
+	if e.toTxNum > 0 {
+		toTxNum = int(e.toTxNum)
+	}
+	var it *state.InvertedIterator
+	var err error
+	switch e.src {
+	case Accounts:
+		it, err = ac.AccountHistoyIdxIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case Storage:
+		it, err = ac.StorageHistoyIdxIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case Code:
+		it, err = ac.CodeHistoyIdxIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case LogAddrs:
+		it, err = ac.LogAddrIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case LogTopics:
+		it, err = ac.LogTopicIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case TracesFrom:
+		it, err = ac.TraceFromIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	case TracesTo:
+		it, err = ac.TraceToIterator(key, int(e.fromTxNum), toTxNum, order.Asc, -1, tx)
+	}
+	if err != nil {
+		return fmt.Errorf("query %q: %w", e, err)
+	}
+	defer it.Close()
+	var last uint64
+	for seen := false; it.HasNext(); seen = true {
+		txNum, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("query %q: %w", e, err)
+		}
+		if seen && txNum <= last { // files and not yet pruned db can overlap
+			continue
+		}
+		last = txNum
+		switch e.agg {
+		case List:
+			if e.limit >= 0 && len(res.Rows) >= e.limit {
+				return nil
+			}
+			res.Rows = append(res.Rows, Row{Key: key, TxNum: txNum})
+		case Count:
+			res.Count++
+		case Distinct:
+			res.Count++
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/state"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for _, e := range []Expr{
+		From(Storage),
+		From(Storage).Prefix([]byte{0xaa, 0xbb}).TxNums(10, 30).Distinct(),
+		From(Code).Key([]byte{1}).TxNums(5, 0).Limit(3),
+		From(LogAddrs).Key([]byte{1, 2}).Count(),
+	} {
+		parsed, err := Parse(e.String())
+		require.NoError(t, err, e.String())
+		require.Equal(t, e, parsed)
+	}
+
+	e, err := Parse("count  storage prefix 0xAABB txnums 1..2")
+	require.NoError(t, err)
+	require.Equal(t, From(Storage).Prefix([]byte{0xaa, 0xbb}).TxNums(1, 2).Count(), e)
+
+	for _, s := range []string{"", "count", "blocks", "logaddrs", "logaddrs prefix 0x01", "storage txnums 5", "storage txnums 5..1", "storage limit", "storage where 1"} {
+		_, err = Parse(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+	db := mdbx.NewMDBX(log.New()).InMem(filepath.Join(path, "db4")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	agg, err := state.NewAggregatorV3(ctx, path, filepath.Join(path, "e4tmp"), 2, db)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+
+	a, b := bytes.Repeat([]byte{0xaa}, 20), bytes.Repeat([]byte{0xbb}, 20)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 70; txNum++ {
+		agg.SetTxNum(txNum)
+		require.NoError(t, agg.AddAccountPrev(a, []byte{byte(txNum)}))
+		require.NoError(t, agg.AddStoragePrev(a, []byte{byte(txNum % 5)}, []byte{byte(txNum)}))
+		if txNum%2 == 0 {
+			require.NoError(t, agg.AddStoragePrev(b, []byte{0}, []byte{byte(txNum)}))
+		}
+		if txNum%3 == 0 {
+			require.NoError(t, agg.AddLogAddr(a))
+		}
+	}
+	require.NoError(t, agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(t, tx.Commit())
+	_, err = agg.Freeze(ctx, 65) // [0, 64) in files, rest in db
+	require.NoError(t, err)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	run := func(s string) Result {
+		t.Helper()
+		e, err := Parse(s)
+		require.NoError(t, err, s)
+		res, err := e.Run(ctx, ac, roTx)
+		require.NoError(t, err, s)
+		return res
+	}
+
+	require.Equal(t, uint64(6), run("distinct storage").Count)
+	require.Equal(t, uint64(5), run("distinct storage prefix 0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa txnums 10..30").Count)
+	require.Equal(t, uint64(20), run("count storage prefix 0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa txnums 10..30").Count)
+	require.Equal(t, uint64(35), run("count storage prefix 0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb").Count)
+	require.Equal(t, uint64(6), run("count storage prefix 0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb txnums 60..").Count)
+
+	key := append(append([]byte{}, a...), 1)
+	rows := run("storage key 0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa01 limit 3").Rows
+	require.Equal(t, []Row{{Key: key, TxNum: 1}, {Key: key, TxNum: 6}, {Key: key, TxNum: 11}}, rows)
+
+	require.Equal(t, uint64(4), run("count logaddrs key 0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa txnums 60..70").Count)
+	require.Equal(t, uint64(1), run("distinct logaddrs key 0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa").Count)
+	require.Equal(t, uint64(0), run("distinct logaddrs key 0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb").Count)
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryTrace - files accessed by 1 call of AggregatorV3Context, see AggregatorV3Context.EnableTracing
+type QueryTrace struct {
+	Op       string // example: "accounts.GetNoState", "logaddrs.IterateRange"
+	Key      []byte
+	TxNum    uint64      // as-of txNum of Get, startTxNum of IterateRange (-1 is stored as 0)
+	Files    []FileProbe // in order of access
+	DBReads  int         // reads of recent (not frozen) data from db
+	Duration time.Duration
+}
+
+// FileProbe - access of 1 query to 1 file
+type FileProbe struct {
+	File         string
+	IndexLookups int  // lookups by .efi/.vi/.bt index
+	Bytes        int  // decompressed bytes
+	Found        bool // key (or its txNum in .v) is in file
+}
+
+func (t QueryTrace) IndexLookups() (n int) {
+	for _, p := range t.Files {
+		n += p.IndexLookups
+	}
+	return n
+}
+
+func (t QueryTrace) Bytes() (n int) {
+	for _, p := range t.Files {
+		n += p.Bytes
+	}
+	return n
+}
+
+// queryTracer - keeps last `limit` traces. Iterators record their file accesses after creation of trace: all access
+// is under lock. nil tracer - tracing is disabled, all methods are no-op.
+type queryTracer struct {
+	lock   sync.Mutex
+	limit  int
+	traces []*QueryTrace
+}
+
+const defaultQueryTracesLimit = 1024
+
+func newQueryTracer(limit int) *queryTracer {
+	if limit <= 0 {
+		limit = defaultQueryTracesLimit
+	}
+	return &queryTracer{limit: limit}
+}
+
+func (t *queryTracer) start(op string, key []byte, txNum uint64) *QueryTrace {
+	if t == nil {
+		return nil
+	}
+	qt := &QueryTrace{Op: op, Key: append([]byte(nil), key...), TxNum: txNum}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.traces) >= t.limit {
+		t.traces = append(t.traces[:0], t.traces[len(t.traces)-t.limit+1:]...)
+	}
+	t.traces = append(t.traces, qt)
+	return qt
+}
+
+func (t *queryTracer) probe(qt *QueryTrace, file string, lookups, bytes int, found bool) {
+	if t == nil || qt == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if last := len(qt.Files) - 1; last >= 0 && qt.Files[last].File == file {
+		qt.Files[last].IndexLookups += lookups
+		qt.Files[last].Bytes += bytes
+		qt.Files[last].Found = qt.Files[last].Found || found
+		return
+	}
+	qt.Files = append(qt.Files, FileProbe{File: file, IndexLookups: lookups, Bytes: bytes, Found: found})
+}
+
+func (t *queryTracer) db(qt *QueryTrace) {
+	if t == nil || qt == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	qt.DBReads++
+}
+
+func (t *queryTracer) done(qt *QueryTrace, start time.Time) {
+	if t == nil || qt == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	qt.Duration = time.Since(start)
+}
+
+func (t *queryTracer) copyTraces() []QueryTrace {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	res := make([]QueryTrace, len(t.traces))
+	for i, qt := range t.traces {
+		res[i] = *qt
+		res[i].Files = append([]FileProbe(nil), qt.Files...)
+	}
+	return res
+}
+
+func (t *queryTracer) reset() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.traces = nil
+}
+
+// EnableTracing - opt-in: each GetNoState/GetNoStateWithRecent/IterateRange call of this context records which files
+// were probed, amount of index lookups and decompressed bytes. Keeps last `limit` traces (0 - default). For diagnosing
+// slow historical RPC calls. Tracing is disabled when pooled context is re-used, see GetContext.
+func (ac *AggregatorV3Context) EnableTracing(limit int) {
+	ac.setTracer(newQueryTracer(limit))
+}
+
+// Traces - recorded by EnableTracing, oldest first
+func (ac *AggregatorV3Context) Traces() []QueryTrace { return ac.tracer.copyTraces() }
+
+func (ac *AggregatorV3Context) ResetTraces() { ac.tracer.reset() }
+
+func (ac *AggregatorV3Context) setTracer(t *queryTracer) {
+	ac.tracer = t
+	for _, hc := range []*HistoryContext{ac.accounts, ac.storage, ac.code} {
+		hc.tracer, hc.ic.tracer = t, t
+	}
+	for _, ic := range []*InvertedIndexContext{ac.logAddrs, ac.logTopics, ac.tracesFrom, ac.tracesTo} {
+		ic.tracer = t
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/ledgerwatch/erigon-lib/kv"
 )
 
@@ -90,12 +89,15 @@ func (ri *ReadIndices) SetTxNum(txNum uint64) {
 }
 
 type RCollation struct {
-	accounts map[string]*roaring64.Bitmap
-	storage  map[string]*roaring64.Bitmap
-	code     map[string]*roaring64.Bitmap
+	accounts *collatedBitmaps
+	storage  *collatedBitmaps
+	code     *collatedBitmaps
 }
 
 func (c RCollation) Close() {
+	c.accounts.close()
+	c.storage.close()
+	c.code.close()
 }
 
 func (ri *ReadIndices) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (RCollation, error) {
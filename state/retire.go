@@ -0,0 +1,236 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common/cmp"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// RetirePhase - stage of RetireBlocksUpTo, in order of execution
+type RetirePhase string
+
+const (
+	RetireBuild    RetirePhase = "build"    // db steps -> files
+	RetireMerge    RetirePhase = "merge"    // small files -> bigger ones, locality indices of frozen files are updated
+	RetireLocality RetirePhase = "locality" // optional indices which were not built by merge
+	RetirePrune    RetirePhase = "prune"    // db data which is in files
+	RetireDone     RetirePhase = "done"
+)
+
+// RetireOpts - see RetireBlocksUpTo. Zero value: no budget, 1 worker, prune by 1_000 txs
+type RetireOpts struct {
+	DryRun     bool              // only plan: nothing is built, merged or pruned
+	Workers    int               // of merge and optional indices build
+	PruneLimit uint64            // txs of each entity pruned by 1 RwTx
+	TimeBudget time.Duration     // 0 - unlimited. Checked between steps: current step is not interrupted
+	IOBudget   datasize.ByteSize // 0 - unlimited. Bytes of built and merged files, checked between steps
+	Progress   func(RetireProgress)
+}
+
+// RetireProgress - reported after each step of each phase
+type RetireProgress struct {
+	Phase   RetirePhase
+	Done    uint64 // steps built, merges done, prune batches committed
+	Total   uint64 // known only for build: 0 - unknown
+	Written uint64 // bytes of files written since start
+	Elapsed time.Duration
+}
+
+// RetirePlan - work to retire blocks up to txNum, as seen before start (merges may appear after build)
+type RetirePlan struct {
+	BuildFrom, BuildTo uint64            // steps [from, to) to build
+	Merge              bool              // existing files already have range to merge
+	Prune              map[string]uint64 // entity -> txNum up to which db data will be pruned, only entities which have something to prune
+}
+
+// RetireStat - result of RetireBlocksUpTo
+type RetireStat struct {
+	Plan        RetirePlan
+	Built       uint64 // steps
+	Merges      uint64
+	Written     uint64 // bytes of built and merged files
+	Prune       *PruneStat
+	Interrupted bool // budget exhausted: call again to continue
+	Took        time.Duration
+}
+
+func (s *RetireStat) String() string {
+	return fmt.Sprintf("built=%d steps, merges=%d, written=%s, prune: %s, interrupted=%t, took=%s",
+		s.Built, s.Merges, datasize.ByteSize(s.Written).HR(), s.Prune, s.Interrupted, s.Took)
+}
+
+// RetireBlocksUpTo - moves data of txs below txNum from db to files: builds files of complete steps, merges them
+// (updating locality indices), builds missed optional indices and prunes db in batches of opts.PruneLimit txs - each batch
+// in own RwTx. Replaces host's orchestration of BuildFilesInBackground + MergeLoop + Prune.
+// Stops between steps if opts.TimeBudget or opts.IOBudget is exhausted (RetireStat.Interrupted): next call continues.
+// Like Freeze ignores KeepInDB (caller decides which txNum is final) and waits for background build and merge,
+// but steps which are not in db yet are skipped instead of error. Caller must not hold RwTx of db.
+func (a *AggregatorV3) RetireBlocksUpTo(ctx context.Context, db kv.RwDB, txNum uint64, opts RetireOpts) (*RetireStat, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.PruneLimit == 0 {
+		opts.PruneLimit = 1_000
+	}
+	start := time.Now()
+	r := &retirer{a: a, opts: opts, start: start, written: a.written.Load()}
+	stat := &RetireStat{Prune: &PruneStat{}}
+	defer func() { stat.Took = time.Since(start) }()
+
+	var err error
+	if opts.DryRun {
+		stat.Plan, err = a.retirePlan(ctx, db, txNum)
+		return stat, err
+	}
+	if err = acquireFlag(ctx, &a.working); err != nil {
+		return stat, err
+	}
+	defer a.working.Store(false)
+	if err = acquireFlag(ctx, &a.workingMerge); err != nil {
+		return stat, err
+	}
+	defer a.workingMerge.Store(false)
+	if stat.Plan, err = a.retirePlan(ctx, db, txNum); err != nil { // after background work is done: it changes files
+		return stat, err
+	}
+	defer func() { stat.Written = r.writtenSince() }()
+
+	// build
+	plan := stat.Plan
+	for step := plan.BuildFrom; step < plan.BuildTo; step++ {
+		if stat.Interrupted = r.exhausted(); stat.Interrupted {
+			return stat, nil
+		}
+		if err := a.buildFilesInBackground(ctx, step, db); err != nil {
+			return stat, fmt.Errorf("retire: build step %d: %w", step, err)
+		}
+		stat.Built++
+		r.report(RetireBuild, stat.Built, plan.BuildTo-plan.BuildFrom)
+	}
+
+	// merge
+	for {
+		if stat.Interrupted = r.exhausted(); stat.Interrupted {
+			return stat, nil
+		}
+		merged, err := a.mergeLoopStep(ctx, opts.Workers)
+		if err != nil {
+			return stat, fmt.Errorf("retire: merge: %w", err)
+		}
+		if !merged {
+			break
+		}
+		stat.Merges++
+		r.report(RetireMerge, stat.Merges, 0)
+	}
+
+	// locality
+	if stat.Interrupted = r.exhausted(); stat.Interrupted {
+		return stat, nil
+	}
+	if err := a.BuildOptionalMissedIndices(ctx, opts.Workers); err != nil {
+		return stat, fmt.Errorf("retire: optional indices: %w", err)
+	}
+	r.report(RetireLocality, 1, 1)
+
+	// prune
+	pruneTo := cmp.Min(txNum, a.maxTxNum.Load())
+	prevTx := a.rwTx
+	for batches := uint64(1); ; batches++ {
+		if stat.Interrupted = r.exhausted(); stat.Interrupted {
+			return stat, nil
+		}
+		var s *PruneStat
+		var canPrune bool
+		if err := db.Update(ctx, func(tx kv.RwTx) error {
+			if canPrune = a.canPrune(tx, pruneTo); !canPrune {
+				return nil
+			}
+			a.SetTx(tx)
+			defer a.SetTx(prevTx)
+			s, err = a.prune(ctx, 0, pruneTo, opts.PruneLimit)
+			return err
+		}); err != nil {
+			return stat, fmt.Errorf("retire: prune: %w", err)
+		}
+		if !canPrune {
+			break
+		}
+		stat.Prune.Accumulate(s)
+		r.report(RetirePrune, batches, 0)
+		if s.Records() == 0 { // everything below pruneTo is held by horizons or leases
+			break
+		}
+	}
+	r.report(RetireDone, 0, 0)
+	log.Info("[snapshots] retire", "to", txNum, "stat", stat)
+	return stat, nil
+}
+
+func (a *AggregatorV3) retirePlan(ctx context.Context, db kv.RoDB, txNum uint64) (plan RetirePlan, err error) {
+	lastInDB := lastIdInDB(db, a.accounts.indexKeysTable)
+	plan.BuildFrom = a.maxTxNum.Load() / a.aggregationStep
+	plan.BuildTo = cmp.Max(plan.BuildFrom, cmp.Min(txNum, lastInDB)/a.aggregationStep)
+	plan.Merge = a.findMergeRange(a.maxTxNum.Load(), a.aggregationStep*StepsInBiggestFile).any()
+
+	pruneTo := cmp.Min(txNum, plan.BuildTo*a.aggregationStep)
+	plan.Prune = map[string]uint64{}
+	err = db.View(ctx, func(tx kv.Tx) error {
+		ls, err := a.activeLeases(tx)
+		if err != nil {
+			return err
+		}
+		historyTxTo := ls.pruneLimit(0, pruneTo)
+		for name, from := range a.PruneFrontiers(tx) {
+			if to := a.pruneHorizons.limit(name, historyTxTo); from < to {
+				plan.Prune[name] = to
+			}
+		}
+		return nil
+	})
+	return plan, err
+}
+
+type retirer struct {
+	a       *AggregatorV3
+	opts    RetireOpts
+	start   time.Time
+	written uint64 // a.written at start
+}
+
+func (r *retirer) writtenSince() uint64 { return r.a.written.Load() - r.written }
+
+func (r *retirer) exhausted() bool {
+	if r.opts.TimeBudget > 0 && time.Since(r.start) >= r.opts.TimeBudget {
+		return true
+	}
+	return r.opts.IOBudget > 0 && r.writtenSince() >= uint64(r.opts.IOBudget)
+}
+
+func (r *retirer) report(phase RetirePhase, done, total uint64) {
+	if r.opts.Progress == nil {
+		return
+	}
+	r.opts.Progress(RetireProgress{Phase: phase, Done: done, Total: total, Written: r.writtenSince(), Elapsed: time.Since(r.start)})
+}
@@ -19,7 +19,9 @@ package state
 import (
 	"bytes"
 	"encoding/binary"
+	"sort"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
@@ -150,6 +152,9 @@ type HistoryIteratorInc struct {
 	nextVal      []byte
 	hasNext      bool
 	compressVals bool
+	taggedVals   bool
+	blobs        *filesItem
+	err          error
 }
 
 func (hs *HistoryStep) interateHistoryBeforeTxNum(txNum uint64) *HistoryIteratorInc {
@@ -158,6 +163,8 @@ func (hs *HistoryStep) interateHistoryBeforeTxNum(txNum uint64) *HistoryIterator
 	hii.historyG = hs.historyFile.getter
 	hii.r = hs.historyFile.reader
 	hii.compressVals = hs.compressVals
+	hii.taggedVals = hs.taggedVals
+	hii.blobs = hs.historyItem.blobs
 	hii.indexG.Reset(0)
 	if hii.indexG.HasNext() {
 		hii.key, _ = hii.indexG.NextUncompressed()
@@ -186,12 +193,9 @@ func (hii *HistoryIteratorInc) advance() {
 			var txKey [8]byte
 			binary.BigEndian.PutUint64(txKey[:], n)
 			offset := hii.r.Lookup2(txKey[:], hii.key)
-			hii.historyG.Reset(offset)
 			hii.nextKey = hii.key
-			if hii.compressVals {
-				hii.nextVal, _ = hii.historyG.Next(nil)
-			} else {
-				hii.nextVal, _ = hii.historyG.NextUncompressed()
+			if hii.nextVal, hii.err = historyVal(hii.historyG, hii.r, hii.blobs, hii.key, offset, hii.compressVals, hii.taggedVals, nil); hii.err != nil {
+				return
 			}
 		}
 		if hii.indexG.HasNext() {
@@ -206,11 +210,127 @@ func (hii *HistoryIteratorInc) advance() {
 }
 
 func (hii *HistoryIteratorInc) HasNext() bool {
-	return hii.hasNext
+	return hii.err != nil || hii.hasNext
 }
 
 func (hii *HistoryIteratorInc) Next() ([]byte, []byte, error) {
+	if hii.err != nil {
+		return nil, nil, hii.err
+	}
 	k, v := hii.nextKey, hii.nextVal
 	hii.advance()
 	return k, v, nil
 }
+
+// seekIndexEvery - every N-th key of .ef file is in sparse index of HistoryStep
+const seekIndexEvery = 256
+
+type seekPoint struct {
+	key    []byte
+	offset uint64
+}
+
+// seek - positions getter of .ef file before first key >= prefix (at most seekIndexEvery keys before it).
+// Sparse index of keys is built on first call by full scan of file.
+func (hs *HistoryStep) seek(prefix []byte) {
+	g := hs.indexFile.getter
+	if hs.seekIdx == nil {
+		hs.seekIdx = []seekPoint{}
+		g.Reset(0)
+		var offset uint64
+		for i := 0; g.HasNext(); i++ {
+			if i%seekIndexEvery == 0 {
+				k, _ := g.NextUncompressed()
+				hs.seekIdx = append(hs.seekIdx, seekPoint{key: common.Copy(k), offset: offset})
+			} else {
+				g.SkipUncompressed()
+			}
+			offset = g.SkipUncompressed()
+		}
+	}
+	i := sort.Search(len(hs.seekIdx), func(i int) bool { return bytes.Compare(hs.seekIdx[i].key, prefix) >= 0 })
+	if i == 0 {
+		g.Reset(0)
+		return
+	}
+	g.Reset(hs.seekIdx[i-1].offset)
+}
+
+// HistoryPrefixIteratorInc - changes of keys with prefix within HistoryStep, see AggregatorStep.IterateStoragePrefix
+type HistoryPrefixIteratorInc struct {
+	prefix       []byte
+	indexG       *compress.Getter
+	historyG     *compress.Getter
+	r            *recsplit.IndexReader
+	compressVals bool
+	taggedVals   bool
+	blobs        *filesItem
+
+	key       []byte
+	txNums    *eliasfano32.EliasFanoIter
+	nextKey   []byte
+	nextVal   []byte
+	nextTxNum uint64
+	hasNext   bool
+	txKey     [8]byte
+	err       error
+}
+
+func (hs *HistoryStep) iteratePrefix(prefix []byte) *HistoryPrefixIteratorInc {
+	hpi := &HistoryPrefixIteratorInc{
+		prefix:       prefix,
+		indexG:       hs.indexFile.getter,
+		historyG:     hs.historyFile.getter,
+		r:            hs.historyFile.reader,
+		compressVals: hs.compressVals,
+		taggedVals:   hs.taggedVals,
+		blobs:        hs.historyItem.blobs,
+		hasNext:      true,
+	}
+	if hs.indexFile.reader.Empty() {
+		hpi.hasNext = false
+		return hpi
+	}
+	hs.seek(prefix)
+	hpi.advance()
+	return hpi
+}
+
+func (hpi *HistoryPrefixIteratorInc) advance() {
+	for hpi.txNums == nil || !hpi.txNums.HasNext() {
+		if !hpi.indexG.HasNext() {
+			hpi.hasNext = false
+			return
+		}
+		hpi.key, _ = hpi.indexG.NextUncompressed()
+		if bytes.Compare(hpi.key, hpi.prefix) < 0 {
+			hpi.indexG.SkipUncompressed()
+			continue
+		}
+		if !bytes.HasPrefix(hpi.key, hpi.prefix) {
+			hpi.hasNext = false
+			return
+		}
+		val, _ := hpi.indexG.NextUncompressed()
+		ef, _ := eliasfano32.ReadEliasFano(val)
+		hpi.txNums = ef.Iterator()
+	}
+	hpi.nextTxNum, _ = hpi.txNums.Next()
+	binary.BigEndian.PutUint64(hpi.txKey[:], hpi.nextTxNum)
+	hpi.nextKey = hpi.key
+	hpi.nextVal, hpi.err = historyVal(hpi.historyG, hpi.r, hpi.blobs, hpi.key, hpi.r.Lookup2(hpi.txKey[:], hpi.key), hpi.compressVals, hpi.taggedVals, nil)
+}
+
+func (hpi *HistoryPrefixIteratorInc) HasNext() bool {
+	return hpi.err != nil || hpi.hasNext
+}
+
+// Next - key, its value before txNum (nil - key didn't exist) and txNum of change
+func (hpi *HistoryPrefixIteratorInc) Next() ([]byte, []byte, uint64, error) {
+	if hpi.err != nil {
+		return nil, nil, 0, hpi.err
+	}
+	k, v, txNum := hpi.nextKey, hpi.nextVal, hpi.nextTxNum
+	hpi.advance()
+	return k, v, txNum, nil
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// StepGapError - files of [FromTxNum, ToTxNum) are missing and can't be rebuilt: this range is already pruned from DB.
+// Without files reads of this range would silently return "not found".
+type StepGapError struct {
+	Name               string // filenameBase of history or inverted index
+	FromStep, ToStep   uint64
+	FromTxNum, ToTxNum uint64
+}
+
+func (e *StepGapError) Error() string {
+	return fmt.Sprintf("%s: files of steps %d-%d (txNums [%d, %d)) are missing and pruned from db", e.Name, e.FromStep, e.ToStep, e.FromTxNum, e.ToTxNum)
+}
+
+// stepGap - [from, to) txNums range without files
+type stepGap struct{ from, to uint64 }
+
+// stepGaps - ranges in [fromTxNum, end of files) which are not covered by files of all `trees`.
+// File which covers part of gap in one tree (but not in another) is added to gap - it's rebuilt together with gap.
+func stepGaps(aggregationStep, fromTxNum uint64, trees ...[]ctxItem) (gaps []stepGap) {
+	fromStep, toStep := fromTxNum/aggregationStep, fromTxNum/aggregationStep
+	for _, files := range trees {
+		if len(files) > 0 && files[len(files)-1].endTxNum/aggregationStep > toStep {
+			toStep = files[len(files)-1].endTxNum / aggregationStep
+		}
+	}
+	if toStep == fromStep {
+		return nil
+	}
+	missed := make([]bool, toStep-fromStep)
+	for _, files := range trees {
+		covered := make([]bool, len(missed))
+		for _, item := range files {
+			for step := item.startTxNum / aggregationStep; step < item.endTxNum/aggregationStep; step++ {
+				if step >= fromStep {
+					covered[step-fromStep] = true
+				}
+			}
+		}
+		for i := range missed {
+			missed[i] = missed[i] || !covered[i]
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, files := range trees {
+			for _, item := range files {
+				itemFrom, itemTo := item.startTxNum/aggregationStep, item.endTxNum/aggregationStep
+				if itemFrom < fromStep {
+					continue
+				}
+				var inGap bool
+				for step := itemFrom; step < itemTo && !inGap; step++ {
+					inGap = missed[step-fromStep]
+				}
+				for step := itemFrom; step < itemTo && inGap; step++ {
+					changed = changed || !missed[step-fromStep]
+					missed[step-fromStep] = true
+				}
+			}
+		}
+	}
+	for i := 0; i < len(missed); i++ {
+		if !missed[i] {
+			continue
+		}
+		j := i
+		for j < len(missed) && missed[j] {
+			j++
+		}
+		gaps = append(gaps, stepGap{from: (fromStep + uint64(i)) * aggregationStep, to: (fromStep + uint64(j)) * aggregationStep})
+		i = j
+	}
+	return gaps
+}
+
+func (ii *InvertedIndex) gapError(g stepGap) *StepGapError {
+	return &StepGapError{Name: ii.filenameBase, FromStep: g.from / ii.aggregationStep, ToStep: g.to / ii.aggregationStep, FromTxNum: g.from, ToTxNum: g.to}
+}
+
+// removeFilesInGap - files which intersect with gap are removed: gap is rebuilt from DB
+func removeFilesInGap(files *btree2.BTreeG[*filesItem], g stepGap) {
+	var outs []*filesItem
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.startTxNum < g.to && item.endTxNum > g.from {
+				outs = append(outs, item)
+			}
+		}
+		return true
+	})
+	for _, out := range outs {
+		files.Delete(out)
+		out.closeFilesAndRemove()
+	}
+}
+
+func (ii *InvertedIndex) stepGaps() []stepGap {
+	return stepGaps(ii.aggregationStep, ii.historyHorizon.Load(), *ii.roFiles.Load())
+}
+
+// repairGap - builds files of gap from DB, step by step
+func (ii *InvertedIndex) repairGap(ctx context.Context, g stepGap, roTx kv.Tx, logEvery *time.Ticker) error {
+	removeFilesInGap(ii.files.Load(), g)
+	for txFrom := g.from; txFrom < g.to; txFrom += ii.aggregationStep {
+		txTo := txFrom + ii.aggregationStep
+		bitmaps, err := ii.collate(ctx, txFrom, txTo, roTx, logEvery)
+		if err != nil {
+			return err
+		}
+		sf, err := ii.buildFiles(ctx, txFrom/ii.aggregationStep, bitmaps)
+		if err != nil {
+			return err
+		}
+		ii.integrateFiles(sf, txFrom, txTo)
+	}
+	return nil
+}
+
+func (h *History) stepGaps() []stepGap {
+	return stepGaps(h.aggregationStep, h.historyHorizon.Load(), *h.roFiles.Load(), *h.InvertedIndex.roFiles.Load())
+}
+
+// repairGap - builds .v and .ef files of gap from DB, step by step
+func (h *History) repairGap(ctx context.Context, g stepGap, roTx kv.Tx, logEvery *time.Ticker) error {
+	removeFilesInGap(h.files.Load(), g)
+	removeFilesInGap(h.InvertedIndex.files.Load(), g)
+	for txFrom := g.from; txFrom < g.to; txFrom += h.aggregationStep {
+		txTo, step := txFrom+h.aggregationStep, txFrom/h.aggregationStep
+		c, err := h.collate(step, txFrom, txTo, roTx, logEvery)
+		if err != nil {
+			return err
+		}
+		sf, err := h.buildFiles(ctx, step, c)
+		if err != nil {
+			return err
+		}
+		h.integrateFiles(sf, txFrom, txTo)
+	}
+	return nil
+}
+
+// repairStepGaps - rebuilds missing step files (gaps between files) from DB. If range of gap is already pruned from DB - returns *StepGapError.
+// All histories and indices are pruned together, so first txNum of accounts history in DB is a border of not-pruned data.
+func (a *AggregatorV3) repairStepGaps(ctx context.Context) error {
+	if a.db == nil {
+		return nil
+	}
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	return a.db.View(ctx, func(tx kv.Tx) error {
+		first, err := kv.FirstKey(tx, a.accounts.indexKeysTable)
+		if err != nil {
+			return err
+		}
+		inDB := func(g stepGap) bool { return len(first) == 8 && binary.BigEndian.Uint64(first) <= g.from }
+		for _, h := range []*History{a.accounts, a.storage, a.code} {
+			for _, g := range h.stepGaps() {
+				if !inDB(g) {
+					return h.gapError(g)
+				}
+				log.Info("[snapshots] rebuild missing files from db", "name", h.filenameBase, "steps", fmt.Sprintf("%d-%d", g.from/a.aggregationStep, g.to/a.aggregationStep))
+				if err := h.repairGap(ctx, g, tx, logEvery); err != nil {
+					return fmt.Errorf("rebuild %s gap: %w", h.filenameBase, err)
+				}
+			}
+		}
+		for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+			for _, g := range ii.stepGaps() {
+				if !inDB(g) {
+					return ii.gapError(g)
+				}
+				log.Info("[snapshots] rebuild missing files from db", "name", ii.filenameBase, "steps", fmt.Sprintf("%d-%d", g.from/a.aggregationStep, g.to/a.aggregationStep))
+				if err := ii.repairGap(ctx, g, tx, logEvery); err != nil {
+					return fmt.Errorf("rebuild %s gap: %w", ii.filenameBase, err)
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepGaps(t *testing.T) {
+	files := func(ranges ...uint64) (res []ctxItem) {
+		for i := 0; i < len(ranges); i += 2 {
+			res = append(res, ctxItem{startTxNum: ranges[i] * 10, endTxNum: ranges[i+1] * 10})
+		}
+		return res
+	}
+	require.Nil(t, stepGaps(10, 0, files(0, 4, 4, 5)))
+	require.Nil(t, stepGaps(10, 0, nil))
+	require.Equal(t, []stepGap{{0, 20}, {40, 60}}, stepGaps(10, 0, files(2, 4, 6, 7)))
+	// gap below horizon is not a gap
+	require.Equal(t, []stepGap{{40, 60}}, stepGaps(10, 20, files(2, 4, 6, 7)))
+
+	// gap in one tree: file of another tree which intersects with gap is rebuilt too
+	require.Equal(t, []stepGap{{40, 80}}, stepGaps(10, 0, files(0, 4, 4, 5, 6, 8), files(0, 4, 4, 8)))
+	require.Equal(t, []stepGap{{40, 60}}, stepGaps(10, 0, files(0, 4, 5, 6), files(0, 4, 4, 5)))
+}
+
+func TestHistoryRepairGap(t *testing.T) {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	path, db, h, txs := filledHistory(t)
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	h.SetTx(tx)
+
+	// files are built, but data is not pruned from db
+	for step := uint64(0); step < txs/h.aggregationStep-1; step++ {
+		c, err := h.collate(step, step*h.aggregationStep, (step+1)*h.aggregationStep, tx, logEvery)
+		require.NoError(t, err)
+		sf, err := h.buildFiles(ctx, step, c)
+		require.NoError(t, err)
+		h.integrateFiles(sf, step*h.aggregationStep, (step+1)*h.aggregationStep)
+	}
+	require.Empty(t, h.stepGaps())
+
+	require.NoError(t, os.Remove(filepath.Join(path, fmt.Sprintf("%s.3-4.v", h.filenameBase))))
+	require.NoError(t, os.Remove(filepath.Join(path, fmt.Sprintf("%s.3-4.ef", h.filenameBase))))
+	require.NoError(t, os.Remove(filepath.Join(path, fmt.Sprintf("%s.5-6.v", h.filenameBase))))
+	require.NoError(t, h.reOpenFolder())
+	gaps := h.stepGaps()
+	require.Equal(t, []stepGap{{3 * h.aggregationStep, 4 * h.aggregationStep}, {5 * h.aggregationStep, 6 * h.aggregationStep}}, gaps)
+	for _, g := range gaps {
+		require.NoError(t, h.repairGap(ctx, g, tx, logEvery))
+	}
+	require.Empty(t, h.stepGaps())
+	checkHistoryHistory(t, db, h, txs)
+
+	err = h.gapError(gaps[0])
+	var gapErr *StepGapError
+	require.True(t, errors.As(err, &gapErr))
+	require.Equal(t, uint64(3), gapErr.FromStep)
+	require.Equal(t, 3*h.aggregationStep, gapErr.FromTxNum)
+}
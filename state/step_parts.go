@@ -0,0 +1,270 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// SetStepParts - step is built from `n` parts of equal size: each part is collated and built into files of
+// `dir/parts/<step>`, then parts are merged into files of step. Built parts survive restart: only missing parts are
+// built again. Applied to histories and inverted indices, latest state is built by 1 pass. 0 or 1 - step is built at once.
+func (a *AggregatorV3) SetStepParts(n uint64) error {
+	if n > 1 && a.aggregationStep%n != 0 {
+		return fmt.Errorf("SetStepParts: aggregation step %d is not divisible by %d", a.aggregationStep, n)
+	}
+	a.stepParts = n
+	return nil
+}
+
+const partsDirName = "parts"
+
+func (a *AggregatorV3) partsDir(step uint64) string {
+	return filepath.Join(a.dir, partsDirName, strconv.FormatUint(step, 10))
+}
+
+// removeParts - parts of steps below `toStep`: their files are built already
+func (a *AggregatorV3) removeParts(toStep uint64) {
+	entries, err := os.ReadDir(filepath.Join(a.dir, partsDirName))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if step, err := strconv.ParseUint(e.Name(), 10, 64); err == nil && step < toStep {
+			if err = os.RemoveAll(a.partsDir(step)); err != nil {
+				log.Warn("[snapshots] remove parts", "step", step, "err", err)
+			}
+		}
+	}
+}
+
+// stepPartsBuilder - builds parts of 1 step: its entities have same tables and settings as entities of
+// aggregator, but `dir` is parts dir and aggregation step is size of part. Files names are in parts units.
+type stepPartsBuilder struct {
+	dir        string
+	partSize   uint64
+	parts      uint64
+	txFrom     uint64
+	db         kv.RoDB
+	logEvery   *time.Ticker
+	mergeLimit int
+}
+
+func (b *stepPartsBuilder) doneMarker(filenameBase string, part uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%s.%d-%d.done", filenameBase, part, part+1))
+}
+
+func (b *stepPartsBuilder) newInvertedIndex(ii *InvertedIndex) (*InvertedIndex, error) {
+	pii, err := NewInvertedIndex(b.dir, ii.tmpdir, b.partSize, ii.filenameBase, ii.indexKeysTable, ii.indexTable, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	pii.compressWorkers, pii.compressTmp, pii.collateBudget = ii.compressWorkers, ii.compressTmp, ii.collateBudget
+	pii.withoutIdx = true // merge reads only data files of parts
+	return pii, nil
+}
+
+func (b *stepPartsBuilder) newHistory(h *History) (*History, error) {
+	ph, err := NewHistory(b.dir, h.tmpdir, b.partSize, h.filenameBase, h.indexKeysTable, h.indexTable, h.historyValsTable, h.settingsTable, h.compressVals, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ph.InvertedIndex, err = b.newInvertedIndex(h.InvertedIndex); err != nil {
+		return nil, err
+	}
+	ph.compressWorkers, ph.dedupVals, ph.blobThreshold = h.compressWorkers, h.dedupVals, h.blobThreshold
+	return ph, nil
+}
+
+// closeParts - files of parts are removed (with their done markers) only if `remove`: otherwise they are reused after restart
+func (b *stepPartsBuilder) closeParts(remove bool, filenameBase string, parts ...[]*filesItem) {
+	for _, items := range parts {
+		for _, item := range items {
+			item.replaced.Store(!remove)
+			item.closeFilesAndRemove()
+		}
+	}
+	if !remove {
+		return
+	}
+	for i := uint64(0); i < b.parts; i++ {
+		_ = os.Remove(b.doneMarker(filenameBase, b.txFrom/b.partSize+i))
+	}
+}
+
+func (b *stepPartsBuilder) openPart(path string, part uint64) (*filesItem, error) {
+	item := &filesItem{startTxNum: part * b.partSize, endTxNum: (part + 1) * b.partSize}
+	var err error
+	if item.decompressor, err = compress.NewDecompressor(path); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (b *stepPartsBuilder) buildInvertedIndex(ctx context.Context, ii *InvertedIndex) (sf InvertedFiles, err error) {
+	pii, err := b.newInvertedIndex(ii)
+	if err != nil {
+		return sf, err
+	}
+	var items []*filesItem
+	defer func() { b.closeParts(err == nil, ii.filenameBase, items) }()
+	for i := uint64(0); i < b.parts; i++ {
+		part := b.txFrom/b.partSize + i
+		var item *filesItem
+		if dir.FileExist(b.doneMarker(ii.filenameBase, part)) {
+			if item, err = b.openPart(filepath.Join(b.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, part, part+1)), part); err != nil {
+				return sf, err
+			}
+			items = append(items, item)
+			continue
+		}
+		var bitmaps *collatedBitmaps
+		if err = b.db.View(ctx, func(tx kv.Tx) error {
+			bitmaps, err = pii.collate(ctx, part*b.partSize, (part+1)*b.partSize, tx, b.logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+		}
+		partFiles, err := pii.buildFiles(ctx, part, bitmaps)
+		if err != nil {
+			return sf, err
+		}
+		items = append(items, &filesItem{startTxNum: part * b.partSize, endTxNum: (part + 1) * b.partSize, decompressor: partFiles.decomp, bt: partFiles.bt})
+		if err = os.WriteFile(b.doneMarker(ii.filenameBase, part), nil, 0644); err != nil {
+			return sf, err
+		}
+	}
+	merged, err := ii.mergeFiles(ctx, items, b.txFrom, b.txFrom+b.parts*b.partSize, b.mergeLimit)
+	if err != nil {
+		return sf, err
+	}
+	return InvertedFiles{decomp: merged.decompressor, index: merged.index, bt: merged.bt}, nil
+}
+
+func (b *stepPartsBuilder) buildHistory(ctx context.Context, h *History) (sf HistoryFiles, err error) {
+	ph, err := b.newHistory(h)
+	if err != nil {
+		return sf, err
+	}
+	var efItems, vItems []*filesItem
+	defer func() { b.closeParts(err == nil, h.filenameBase, efItems, vItems) }()
+	for i := uint64(0); i < b.parts; i++ {
+		part := b.txFrom/b.partSize + i
+		if dir.FileExist(b.doneMarker(h.filenameBase, part)) {
+			efItem, err := b.openPart(filepath.Join(b.dir, fmt.Sprintf("%s.%d-%d.ef", h.filenameBase, part, part+1)), part)
+			if err != nil {
+				return sf, err
+			}
+			efItems = append(efItems, efItem)
+			vItem, err := b.openPart(filepath.Join(b.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, part, part+1)), part)
+			if err != nil {
+				return sf, err
+			}
+			vItems = append(vItems, vItem)
+			if err = ph.openBlobs(vItem); err != nil {
+				return sf, err
+			}
+			continue
+		}
+		var collation HistoryCollation
+		if err = b.db.View(ctx, func(tx kv.Tx) error {
+			collation, err = ph.collate(part, part*b.partSize, (part+1)*b.partSize, tx, b.logEvery)
+			return err
+		}); err != nil {
+			return sf, err
+		}
+		partFiles, err := ph.buildFiles(ctx, part, collation)
+		if err != nil {
+			collation.Close()
+			return sf, err
+		}
+		efItems = append(efItems, &filesItem{startTxNum: part * b.partSize, endTxNum: (part + 1) * b.partSize, decompressor: partFiles.efHistoryDecomp, bt: partFiles.efHistoryBt})
+		vItems = append(vItems, &filesItem{startTxNum: part * b.partSize, endTxNum: (part + 1) * b.partSize, decompressor: partFiles.historyDecomp, index: partFiles.historyIdx, blobs: partFiles.blobs})
+		if err = os.WriteFile(b.doneMarker(h.filenameBase, part), nil, 0644); err != nil {
+			return sf, err
+		}
+	}
+	txTo := b.txFrom + b.parts*b.partSize
+	r := HistoryRanges{history: true, historyStartTxNum: b.txFrom, historyEndTxNum: txTo, index: true, indexStartTxNum: b.txFrom, indexEndTxNum: txTo}
+	indexIn, historyIn, err := h.mergeFiles(ctx, efItems, vItems, r, b.mergeLimit)
+	if err != nil {
+		return sf, err
+	}
+	return HistoryFiles{
+		historyDecomp:   historyIn.decompressor,
+		historyIdx:      historyIn.index,
+		efHistoryDecomp: indexIn.decompressor,
+		efHistoryIdx:    indexIn.index,
+		efHistoryBt:     indexIn.bt,
+		blobs:           historyIn.blobs,
+	}, nil
+}
+
+// buildFilesByParts - see SetStepParts
+func (a *AggregatorV3) buildFilesByParts(ctx context.Context, step uint64, txFrom, txTo uint64, db kv.RoDB) (sf AggV3StaticFiles, err error) {
+	logEvery := time.NewTicker(60 * time.Second)
+	defer logEvery.Stop()
+	b := &stepPartsBuilder{dir: a.partsDir(step), partSize: (txTo - txFrom) / a.stepParts, parts: a.stepParts, txFrom: txFrom, db: db, logEvery: logEvery, mergeLimit: a.accounts.compressWorkers}
+	if (txTo-txFrom)%a.stepParts != 0 {
+		return sf, errors.New("buildFilesByParts: step is not divisible by parts")
+	}
+	if err = os.MkdirAll(b.dir, 0755); err != nil {
+		return sf, err
+	}
+	closeFiles := true
+	defer func() {
+		if closeFiles {
+			sf.Close()
+		}
+	}()
+	for _, e := range []struct {
+		h  *History
+		sf *HistoryFiles
+	}{{a.accounts, &sf.accounts}, {a.storage, &sf.storage}, {a.code, &sf.code}} {
+		if *e.sf, err = b.buildHistory(ctx, e.h); err != nil {
+			return sf, fmt.Errorf("build %s by parts: %w", e.h.filenameBase, err)
+		}
+	}
+	for _, e := range []struct {
+		ii *InvertedIndex
+		sf *InvertedFiles
+	}{{a.logAddrs, &sf.logAddrs}, {a.logTopics, &sf.logTopics}, {a.tracesFrom, &sf.tracesFrom}, {a.tracesTo, &sf.tracesTo}} {
+		if e.ii.disabled.Load() {
+			continue
+		}
+		if *e.sf, err = b.buildInvertedIndex(ctx, e.ii); err != nil {
+			return sf, fmt.Errorf("build %s by parts: %w", e.ii.filenameBase, err)
+		}
+	}
+	if sf.latest, err = a.latest.buildFiles(ctx, step, txFrom, txTo, db, logEvery); err != nil {
+		return sf, err
+	}
+	closeFiles = false
+	return sf, nil
+}
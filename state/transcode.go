@@ -0,0 +1,158 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/time/rate"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+// TranscodeFilesInBackground - see TranscodeFiles. Does nothing if previous transcoding is not finished yet.
+func (a *AggregatorV3) TranscodeFilesInBackground(ctx context.Context, format string, bytesPerSec datasize.ByteSize) {
+	if !a.workingTranscode.CompareAndSwap(false, true) {
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer a.workingTranscode.Store(false)
+		if _, err := a.TranscodeFiles(ctx, format, bytesPerSec); err != nil {
+			log.Warn("[snapshots] transcode", "format", format, "err", err)
+		}
+	}()
+}
+
+// TranscodeFiles - rewrites data files of histories and inverted indices (with their blobs) which have format other
+// than `format` (see compress.Format): directory may contain files of both formats meanwhile. Writes are limited by
+// `bytesPerSec`, 0 - no limit. Contexts which opened file keep reading its previous version, new version is read
+// after reopen. Content-addressed and offloaded files are skipped, .torrent of rewritten file is removed (it has
+// hash of previous content). Returns amount of rewritten files.
+func (a *AggregatorV3) TranscodeFiles(ctx context.Context, format string, bytesPerSec datasize.ByteSize) (transcoded int, err error) {
+	f, ok := compress.FormatByName(format)
+	if !ok {
+		return 0, fmt.Errorf("TranscodeFiles: unknown format %s", format)
+	}
+	var wrap func(io.Writer) io.Writer
+	if bytesPerSec > 0 {
+		burst := int(datasize.MB)
+		if uint64(burst) > uint64(bytesPerSec) {
+			burst = int(bytesPerSec)
+		}
+		limiter := rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+		wrap = func(w io.Writer) io.Writer { return &rateLimitedWriter{ctx: ctx, w: w, limiter: limiter} }
+	}
+
+	ac := a.MakeContext()
+	defer ac.Close()
+	var paths []string
+	for _, files := range [][]ctxItem{
+		ac.accounts.files, ac.accounts.ic.files, ac.storage.files, ac.storage.ic.files, ac.code.files, ac.code.ic.files,
+		ac.logAddrs.files, ac.logTopics.files, ac.tracesFrom.files, ac.tracesTo.files,
+	} {
+		for _, item := range files {
+			paths = append(paths, itemDataPaths(item.src)...)
+		}
+	}
+
+	start := time.Now()
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return transcoded, ctx.Err()
+		}
+		if current, ok := fileFormat(path); !ok || current == f.Name {
+			continue
+		}
+		if err = compress.Transcode(path, path, f, wrap); err != nil {
+			return transcoded, err
+		}
+		if torrentPath := path + ".torrent"; dir.FileExist(torrentPath) {
+			_ = os.Remove(torrentPath)
+		}
+		transcoded++
+		log.Debug("[snapshots] transcoded", "file", path, "format", f.Name)
+	}
+	if transcoded > 0 {
+		log.Info("[snapshots] transcoded", "files", transcoded, "format", f.Name, "took", time.Since(start))
+	}
+	return transcoded, nil
+}
+
+// itemDataPaths - data files of item and its blobs
+func itemDataPaths(item *filesItem) (paths []string) {
+	if item.datPath != "" {
+		paths = append(paths, item.datPath)
+	} else if item.decompressor != nil {
+		paths = append(paths, item.decompressor.FilePath())
+	}
+	if item.blobs != nil {
+		paths = append(paths, itemDataPaths(item.blobs)...)
+	}
+	return paths
+}
+
+// fileFormat - false if file is not regular local file: content-addressed link, offloaded stub, removed
+func fileFormat(path string) (string, bool) {
+	if st, err := os.Lstat(path); err != nil || !st.Mode().IsRegular() {
+		return "", false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	head := make([]byte, 16)
+	n, _ := io.ReadFull(file, head)
+	if n == 0 {
+		return "", false
+	}
+	return compress.DetectFormat(head[:n]).Name, true
+}
+
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := len(p)
+		if chunk > w.limiter.Burst() {
+			chunk = w.limiter.Burst()
+		}
+		if err = w.limiter.WaitN(w.ctx, chunk); err != nil {
+			return n, err
+		}
+		m, err := w.w.Write(p[:chunk])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// historyUnwind - deletions of 1 History, collected during unwindHistories pass
+type historyUnwind struct {
+	h    *History
+	idx  *etl.Collector // key+txNum of indexTable
+	vals *etl.Collector // keys of historyValsTable
+	recs chan []byte    // key+txNum+valNum
+}
+
+func (u *historyUnwind) collect(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case rec, ok := <-u.recs:
+			if !ok {
+				return nil
+			}
+			if err := u.idx.Collect(rec[:len(rec)-8], nil); err != nil {
+				return err
+			}
+			if valNum := rec[len(rec)-8:]; binary.BigEndian.Uint64(valNum) != 0 { // 0 - value was empty, nothing in historyValsTable
+				if err := u.vals.Collect(valNum, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (u *historyUnwind) close() {
+	u.idx.Close()
+	u.vals.Close()
+}
+
+// unwindHistories - removes all history records with txNum >= txUnwindTo from DB.
+// Keys tables of all histories are read in 1 pass merged by txNum, previous values are passed to `stateChanges`
+// (oldest first, for same key - in order of txNum). Deletions are sorted by etl in background (1 goroutine per history,
+// while DB is read) and applied per table in key order - because RwTx is not thread-safe, DB is modified sequentially.
+func unwindHistories(ctx context.Context, logPrefix, tmpdir string, txUnwindTo uint64, stateChanges func(k, v []byte) error, hs ...*History) error {
+	unwinds := make([]*historyUnwind, len(hs))
+	for i, h := range hs {
+		unwinds[i] = &historyUnwind{
+			h:    h,
+			idx:  etl.NewCollector(logPrefix, tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize/2)),
+			vals: etl.NewCollector(logPrefix, tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize/2)),
+			recs: make(chan []byte, 1024),
+		}
+		defer unwinds[i].close()
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, u := range unwinds {
+		u := u
+		g.Go(func() error { return u.collect(gCtx) })
+	}
+	readErr := readHistoriesMerged(gCtx, txUnwindTo, unwinds, stateChanges)
+	for _, u := range unwinds {
+		close(u.recs)
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	var txKey [8]byte
+	binary.BigEndian.PutUint64(txKey[:], txUnwindTo)
+	for _, u := range unwinds {
+		if err := u.apply(ctx, txKey[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHistoriesMerged - k-way merge of keys tables of histories by txNum
+func readHistoriesMerged(ctx context.Context, txUnwindTo uint64, unwinds []*historyUnwind, stateChanges func(k, v []byte) error) error {
+	var txKey [8]byte
+	binary.BigEndian.PutUint64(txKey[:], txUnwindTo)
+	keysCursors := make([]kv.CursorDupSort, len(unwinds))
+	valsCursors := make([]kv.Cursor, len(unwinds))
+	ks, vs := make([][]byte, len(unwinds)), make([][]byte, len(unwinds))
+	for i, u := range unwinds {
+		var err error
+		if keysCursors[i], err = u.h.tx.CursorDupSort(u.h.indexKeysTable); err != nil {
+			return fmt.Errorf("create %s history cursor: %w", u.h.filenameBase, err)
+		}
+		defer keysCursors[i].Close()
+		if valsCursors[i], err = u.h.tx.Cursor(u.h.historyValsTable); err != nil {
+			return fmt.Errorf("create %s history vals cursor: %w", u.h.filenameBase, err)
+		}
+		defer valsCursors[i].Close()
+		if ks[i], vs[i], err = keysCursors[i].Seek(txKey[:]); err != nil {
+			return fmt.Errorf("iterate over %s history keys: %w", u.h.filenameBase, err)
+		}
+	}
+
+	for {
+		min := -1
+		for i := range ks {
+			if ks[i] != nil && (min < 0 || binary.BigEndian.Uint64(ks[i]) < binary.BigEndian.Uint64(ks[min])) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return nil
+		}
+		u, k, v := unwinds[min], ks[min], vs[min]
+		key, valNum := v[:len(v)-8], v[len(v)-8:]
+		_, val, err := valsCursors[min].SeekExact(valNum)
+		if err != nil {
+			return err
+		}
+		if err = stateChanges(key, val); err != nil {
+			return err
+		}
+		rec := make([]byte, 0, len(key)+16)
+		rec = append(append(append(rec, key...), k...), valNum...)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u.recs <- rec:
+		}
+		if ks[min], vs[min], err = keysCursors[min].Next(); err != nil {
+			return fmt.Errorf("iterate over %s history keys: %w", u.h.filenameBase, err)
+		}
+	}
+}
+
+func (u *historyUnwind) apply(ctx context.Context, txKey []byte) error {
+	h := u.h
+	idxC, err := h.tx.RwCursorDupSort(h.indexTable)
+	if err != nil {
+		return err
+	}
+	defer idxC.Close()
+	if err = u.idx.Load(h.tx, "", func(k, _ []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		return idxC.DeleteExact(k[:len(k)-8], k[len(k)-8:])
+	}, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		return fmt.Errorf("unwind %s index: %w", h.filenameBase, err)
+	}
+
+	valsC, err := h.tx.RwCursor(h.historyValsTable)
+	if err != nil {
+		return err
+	}
+	defer valsC.Close()
+	if err = u.vals.Load(h.tx, "", func(k, _ []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		return valsC.Delete(k)
+	}, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		return fmt.Errorf("unwind %s history vals: %w", h.filenameBase, err)
+	}
+
+	// keys table is sorted by txNum: unwound records are its tail
+	keysC, err := h.tx.RwCursorDupSort(h.indexKeysTable)
+	if err != nil {
+		return err
+	}
+	defer keysC.Close()
+	var k []byte
+	for k, _, err = keysC.Seek(txKey); err == nil && k != nil; k, _, err = keysC.Seek(txKey) {
+		if err = keysC.DeleteCurrentDuplicates(); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("iterate over %s history keys: %w", h.filenameBase, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/downloader/verify"
+)
+
+// verifyTargets - data file is checked by pieces of .torrent next to it (as downloader does)
+// and, if it's content-addressed, by hash embedded in name. Files without both are skipped.
+func (a *AggregatorV3) verifyTargets() ([]verify.Target, error) {
+	var targets []verify.Target
+	for _, fi := range a.FilesInfo() {
+		if torrentPath := filepath.Join(a.dir, fi.Name+".torrent"); dir.FileExist(torrentPath) {
+			mi, err := metainfo.LoadFromFile(torrentPath)
+			if err != nil {
+				return nil, fmt.Errorf("verify %s: %w", fi.Name, err)
+			}
+			info, err := mi.UnmarshalInfo()
+			if err != nil {
+				return nil, fmt.Errorf("verify %s: %w", fi.Name, err)
+			}
+			targets = append(targets, verify.TorrentTarget(&info, a.dir))
+		}
+		if subs := contentNameRe.FindStringSubmatch(fi.ContentName); len(subs) == 6 {
+			expected, err := hex.DecodeString(subs[4])
+			if err != nil {
+				return nil, fmt.Errorf("verify %s: %w", fi.ContentName, err)
+			}
+			targets = append(targets, verify.FileTarget(filepath.Join(a.dir, fi.ContentName), verify.SHA256, expected))
+		}
+	}
+	return targets, nil
+}
+
+// VerifyFiles - client-side checksumming of data files by workers goroutines, see verifyTargets.
+// Reads files completely. Mismatches are reported in results, error is returned only if verification can't be done.
+func (a *AggregatorV3) VerifyFiles(ctx context.Context, workers int, progress *background.Progress) ([]verify.Result, error) {
+	targets, err := a.verifyTargets()
+	if err != nil {
+		return nil, err
+	}
+	return verify.Files(ctx, targets, workers, progress)
+}
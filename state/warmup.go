@@ -0,0 +1,294 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common/cmp"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// warmupTarget - table which prune deletes from: keys table is read by txNum ranges
+type warmupTarget struct {
+	name      string
+	keysTable string
+	warmup    func(ctx context.Context, txFrom, txTo, budget uint64, tx kv.Tx) (warmedTo, size uint64, err error)
+}
+
+func (a *AggregatorV3) warmupTargets() []warmupTarget {
+	targets := make([]warmupTarget, 0, 7)
+	for _, h := range []*History{a.accounts, a.storage, a.code} {
+		targets = append(targets, warmupTarget{name: h.filenameBase, keysTable: h.indexKeysTable, warmup: h.warmup})
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		if ii.disabled.Load() { // not pruned
+			continue
+		}
+		targets = append(targets, warmupTarget{name: ii.filenameBase, keysTable: ii.indexKeysTable, warmup: ii.warmup})
+	}
+	return targets
+}
+
+// warmedRange - [from; to) of table was read by warmup and is assumed resident until prune deletes it
+type warmedRange struct {
+	from, to, size uint64
+}
+
+// warmupScheduler - reads data which prune will delete soon, so prune doesn't wait for disk.
+// Tables are warmed in order of their prune position (table which prune will reach first - first),
+// total size of warmed and not yet pruned data is limited by budget.
+type warmupScheduler struct {
+	lock   sync.Mutex
+	budget uint64 // 0 - no limit
+	warmed map[string][]warmedRange
+	ran    bool
+
+	keptUp, fellBehind uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WarmupStats - state of prune warmup. KeptUp/FellBehind - amount of prunes which deleted only warmed data / also not warmed data.
+type WarmupStats struct {
+	ResidentBytes, Budget uint64
+	KeptUp, FellBehind    uint64
+}
+
+// SetWarmupBudget - max size of data read by Warmup and not yet pruned. 0 - no limit.
+func (a *AggregatorV3) SetWarmupBudget(bytes uint64) {
+	a.warmup.lock.Lock()
+	defer a.warmup.lock.Unlock()
+	a.warmup.budget = bytes
+}
+
+func (a *AggregatorV3) WarmupStats() WarmupStats {
+	s := &a.warmup
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return WarmupStats{ResidentBytes: s.residentBytes(), Budget: s.budget, KeptUp: s.keptUp, FellBehind: s.fellBehind}
+}
+
+// Warmup - in background reads up to `limit` txNums (starting from max(txFrom, prune position)) of each table
+// which prune deletes from. Does nothing if warmup is already running. See SetWarmupBudget, CancelWarmup.
+func (a *AggregatorV3) Warmup(ctx context.Context, txFrom, limit uint64) {
+	if a.db == nil {
+		return
+	}
+	if limit < 10_000 {
+		return
+	}
+	ctx, ok := a.warmup.start(ctx)
+	if !ok {
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer a.warmup.finish()
+		if err := a.db.View(ctx, func(tx kv.Tx) error {
+			return a.warmup.run(ctx, tx, a.warmupTargets(), txFrom, limit)
+		}); err != nil && !errors.Is(err, context.Canceled) {
+			log.Warn("[snapshots] prune warmup", "err", err)
+		}
+	}()
+}
+
+// CancelWarmup - stops running warmup and waits for it
+func (a *AggregatorV3) CancelWarmup() { a.warmup.stop() }
+
+func (s *warmupScheduler) start(ctx context.Context) (context.Context, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		return nil, false
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	return ctx, true
+}
+
+func (s *warmupScheduler) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancel()
+	close(s.done)
+	s.cancel, s.done = nil, nil
+}
+
+func (s *warmupScheduler) stop() {
+	s.lock.Lock()
+	cancel, done := s.cancel, s.done
+	s.lock.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// run - warms [max(txFrom, pruneFrom); +limit) of each target within budget
+func (s *warmupScheduler) run(ctx context.Context, tx kv.Tx, targets []warmupTarget, txFrom, limit uint64) error {
+	type job struct {
+		target   warmupTarget
+		from, to uint64
+	}
+	jobs := make([]job, 0, len(targets))
+	for _, t := range targets {
+		pruneFrom, ok, err := firstTxNum(tx, t.keysTable)
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.ran = true
+		if !ok { // everything is pruned
+			delete(s.warmed, t.name)
+			s.lock.Unlock()
+			continue
+		}
+		s.release(t.name, pruneFrom)
+		from := cmp.Max(txFrom, pruneFrom)
+		to := from + limit
+		from = cmp.Max(from, s.warmedTo(t.name))
+		s.lock.Unlock()
+		if from < to {
+			jobs = append(jobs, job{target: t, from: from, to: to})
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].from < jobs[j].from })
+
+	for _, j := range jobs {
+		s.lock.Lock()
+		budget, resident := s.budget, s.residentBytes()
+		s.lock.Unlock()
+		var available uint64 // 0 - no limit
+		if budget > 0 {
+			if resident >= budget {
+				return nil
+			}
+			available = budget - resident
+		}
+		warmedTo, size, err := j.target.warmup(ctx, j.from, j.to, available, tx)
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.add(j.target.name, warmedRange{from: j.from, to: warmedTo, size: size})
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+// trackPrune - pattern: `defer s.trackPrune(tx, targets)()`. Compares prune progress of each target
+// with warmed ranges: prune kept up if it deleted only warmed data.
+func (s *warmupScheduler) trackPrune(tx kv.Tx, targets []warmupTarget) func() {
+	s.lock.Lock()
+	ran := s.ran
+	s.lock.Unlock()
+	if !ran || tx == nil {
+		return func() {}
+	}
+	before, end := make([]uint64, len(targets)), make([]uint64, len(targets))
+	for i, t := range targets {
+		before[i], _, _ = firstTxNum(tx, t.keysTable)
+		if k, _ := kv.LastKey(tx, t.keysTable); len(k) >= 8 {
+			end[i] = binary.BigEndian.Uint64(k) + 1
+		}
+	}
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, t := range targets {
+			after, ok, err := firstTxNum(tx, t.keysTable)
+			if err != nil {
+				continue
+			}
+			if !ok { // everything is pruned
+				after = end[i]
+			}
+			if after <= before[i] { // nothing pruned
+				continue
+			}
+			if s.warmedTo(t.name) >= after {
+				s.keptUp++
+			} else {
+				s.fellBehind++
+			}
+			s.release(t.name, after)
+		}
+	}
+}
+
+// release - drops ranges which are fully pruned. Must be called under lock.
+func (s *warmupScheduler) release(name string, pruneFrom uint64) {
+	ranges := s.warmed[name]
+	i := 0
+	for i < len(ranges) && ranges[i].to <= pruneFrom {
+		i++
+	}
+	if i > 0 {
+		s.warmed[name] = ranges[i:]
+	}
+}
+
+// warmedTo - end of last warmed range. Must be called under lock.
+func (s *warmupScheduler) warmedTo(name string) uint64 {
+	ranges := s.warmed[name]
+	if len(ranges) == 0 {
+		return 0
+	}
+	return ranges[len(ranges)-1].to
+}
+
+// add - must be called under lock
+func (s *warmupScheduler) add(name string, r warmedRange) {
+	if r.to <= r.from {
+		return
+	}
+	if s.warmed == nil {
+		s.warmed = map[string][]warmedRange{}
+	}
+	s.warmed[name] = append(s.warmed[name], r)
+}
+
+// residentBytes - must be called under lock
+func (s *warmupScheduler) residentBytes() (size uint64) {
+	for _, ranges := range s.warmed {
+		for _, r := range ranges {
+			size += r.size
+		}
+	}
+	return size
+}
+
+func firstTxNum(tx kv.Tx, keysTable string) (uint64, bool, error) {
+	k, err := kv.FirstKey(tx, keysTable)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(k) < 8 {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint64(k), true, nil
+}
@@ -0,0 +1,490 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// Audit log - append-only binary log of ordering decisions of pool: which transactions entered pool, moves between sub-pools
+// with ranking fields at the moment of move, updates of ranking fields, evictions with reason (which limit triggered it),
+// pending base fee and order in which transactions were yielded to block builder. Records are grouped by operation
+// (new block, batch of remote txs, local txs, yield) with its time.
+// AuditReplayer reproduces state of sub-pools from the log and explains why one transaction ranks above another.
+//
+// Format: auditMagic, then records: kind byte + fields. Numbers are uvarint, hashes - 32 bytes,
+// uint256 - length byte + big-endian bytes.
+
+var auditMagic = []byte{'t', 'x', 'p', 'a', 1}
+
+// AuditOp - operation of pool which produced records
+type AuditOp uint8
+
+const (
+	AuditNewBlock  AuditOp = 1
+	AuditRemoteTxs AuditOp = 2
+	AuditLocalTxs  AuditOp = 3
+	AuditYield     AuditOp = 4
+)
+
+func (op AuditOp) String() string {
+	switch op {
+	case AuditNewBlock:
+		return "new block"
+	case AuditRemoteTxs:
+		return "remote txs"
+	case AuditLocalTxs:
+		return "local txs"
+	case AuditYield:
+		return "yield"
+	default:
+		return fmt.Sprintf("unknown op %d", op)
+	}
+}
+
+// AuditRecordKind - kind of audit log record
+type AuditRecordKind uint8
+
+const (
+	AuditRecordOp      AuditRecordKind = 1 // start of operation: Op, Time, BlockNum
+	AuditRecordLimits  AuditRecordKind = 2 // limits of sub-pools: Limits
+	AuditRecordBaseFee AuditRecordKind = 3 // new pending base fee: BaseFee
+	AuditRecordAdd     AuditRecordKind = 4 // transaction entered pool: IDHash
+	AuditRecordMove    AuditRecordKind = 5 // transaction moved to sub-pool: IDHash, SubPool
+	AuditRecordRank    AuditRecordKind = 6 // ranking fields of transaction changed: IDHash
+	AuditRecordRemove  AuditRecordKind = 7 // transaction removed from sub-pool, but not from pool: IDHash
+	AuditRecordDiscard AuditRecordKind = 8 // transaction removed from pool: IDHash, Reason
+	AuditRecordYield   AuditRecordKind = 9 // transactions yielded to block builder, in order: Yielded
+)
+
+var ErrAuditLogCorrupted = errors.New("txpool audit log corrupted")
+
+// auditLog - writer of audit log. All methods are called under TxPool.lock, nil auditLog - disabled.
+type auditLog struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+func openAuditLog(path string, cfg Config) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open txpool audit log: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &auditLog{f: f, w: bufio.NewWriter(f)}
+	if st.Size() == 0 {
+		a.write(auditMagic)
+	}
+	a.buf = append(a.buf[:0], byte(AuditRecordLimits))
+	a.buf = appendUvarint(a.buf, uint64(cfg.PendingSubPoolLimit))
+	a.buf = appendUvarint(a.buf, uint64(cfg.BaseFeeSubPoolLimit))
+	a.buf = appendUvarint(a.buf, uint64(cfg.QueuedSubPoolLimit))
+	a.write(a.buf)
+	a.flush()
+	return a, a.err
+}
+
+func (a *auditLog) write(b []byte) {
+	if a.err != nil {
+		return
+	}
+	if _, err := a.w.Write(b); err != nil {
+		a.fail(err)
+	}
+}
+
+// fail - pool must work without audit log: log is stopped on first error
+func (a *auditLog) fail(err error) {
+	a.err = err
+	log.Warn("[txpool] audit log stopped", "err", err)
+}
+
+func (a *auditLog) flush() {
+	if a == nil || a.err != nil {
+		return
+	}
+	if err := a.w.Flush(); err != nil {
+		a.fail(err)
+	}
+}
+
+func (a *auditLog) begin(op AuditOp, blockNum uint64) {
+	if a == nil {
+		return
+	}
+	a.buf = append(a.buf[:0], byte(AuditRecordOp), byte(op))
+	a.buf = appendUvarint(a.buf, uint64(time.Now().UnixNano()))
+	a.buf = appendUvarint(a.buf, blockNum)
+	a.write(a.buf)
+}
+
+func (a *auditLog) baseFee(baseFee uint64) {
+	if a == nil {
+		return
+	}
+	a.buf = appendUvarint(append(a.buf[:0], byte(AuditRecordBaseFee)), baseFee)
+	a.write(a.buf)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendU256(buf []byte, v *uint256.Int) []byte {
+	b := v.Bytes()
+	return append(append(buf, byte(len(b))), b...)
+}
+
+func appendRank(buf []byte, mt *metaTx) []byte {
+	buf = append(buf, byte(mt.subPool))
+	buf = appendU256(buf, &mt.minFeeCap)
+	buf = appendUvarint(buf, mt.minTip)
+	buf = appendUvarint(buf, mt.nonceDistance)
+	return appendUvarint(buf, mt.cumulativeBalanceDistance)
+}
+
+func (a *auditLog) add(mt *metaTx) {
+	if a == nil {
+		return
+	}
+	a.buf = append(append(a.buf[:0], byte(AuditRecordAdd)), mt.Tx.IDHash[:]...)
+	a.buf = appendUvarint(a.buf, mt.Tx.SenderID)
+	a.buf = appendUvarint(a.buf, mt.Tx.Nonce)
+	a.buf = appendUvarint(a.buf, mt.timestamp)
+	a.buf = appendU256(a.buf, &mt.Tx.Tip)
+	a.buf = appendU256(a.buf, &mt.Tx.FeeCap)
+	a.write(a.buf)
+}
+
+func (a *auditLog) move(mt *metaTx, to SubPoolType) {
+	if a == nil {
+		return
+	}
+	a.buf = append(append(a.buf[:0], byte(AuditRecordMove)), mt.Tx.IDHash[:]...)
+	a.buf = appendRank(append(a.buf, byte(to)), mt)
+	a.write(a.buf)
+}
+
+func (a *auditLog) rank(mt *metaTx) {
+	if a == nil {
+		return
+	}
+	a.buf = appendRank(append(append(a.buf[:0], byte(AuditRecordRank)), mt.Tx.IDHash[:]...), mt)
+	a.write(a.buf)
+}
+
+func (a *auditLog) remove(mt *metaTx) {
+	if a == nil {
+		return
+	}
+	a.write(append(append(a.buf[:0], byte(AuditRecordRemove)), mt.Tx.IDHash[:]...))
+}
+
+func (a *auditLog) discard(mt *metaTx, reason DiscardReason) {
+	if a == nil {
+		return
+	}
+	a.write(append(append(append(a.buf[:0], byte(AuditRecordDiscard)), mt.Tx.IDHash[:]...), byte(reason)))
+}
+
+func (a *auditLog) yield(yielded [][32]byte) {
+	if a == nil {
+		return
+	}
+	a.buf = appendUvarint(append(a.buf[:0], byte(AuditRecordYield)), uint64(len(yielded)))
+	for _, h := range yielded {
+		a.buf = append(a.buf, h[:]...)
+	}
+	a.write(a.buf)
+}
+
+// AuditRecord - decoded record of audit log. Only fields listed in comment of Kind are set.
+type AuditRecord struct {
+	Kind     AuditRecordKind
+	Op       AuditOp   // operation which record belongs to
+	Time     time.Time // time of operation
+	BlockNum uint64    // last seen block at the moment of operation, for AuditYield - block on top of which txs are yielded
+	IDHash   [32]byte
+	SubPool  SubPoolType
+	Reason   DiscardReason
+	BaseFee  uint64
+	Limits   [3]int // pending, baseFee, queued
+	Yielded  [][32]byte
+}
+
+// AuditReplayer - reproduces state of sub-pools by applying records of audit log one by one
+type AuditReplayer struct {
+	r        *bufio.Reader
+	op       AuditRecord
+	baseFee  uint64
+	limits   [3]int
+	txs      map[[32]byte]*metaTx
+	readHdr  bool
+	u256Buf  [32]byte
+	recorded int
+}
+
+func NewAuditReplayer(r io.Reader) *AuditReplayer {
+	return &AuditReplayer{r: bufio.NewReader(r), txs: map[[32]byte]*metaTx{}}
+}
+
+// Next - reads and applies next record. Returns io.EOF at the end of log.
+func (r *AuditReplayer) Next() (rec AuditRecord, err error) {
+	if !r.readHdr {
+		hdr := make([]byte, len(auditMagic))
+		if _, err = io.ReadFull(r.r, hdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return rec, io.EOF
+			}
+			return rec, fmt.Errorf("%w: %s", ErrAuditLogCorrupted, err)
+		}
+		if !bytes.Equal(hdr, auditMagic) {
+			return rec, fmt.Errorf("%w: unknown header %x", ErrAuditLogCorrupted, hdr)
+		}
+		r.readHdr = true
+	}
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return rec, err // io.EOF between records - end of log
+	}
+	if rec, err = r.read(AuditRecordKind(kind)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return rec, fmt.Errorf("%w: record %d: %s", ErrAuditLogCorrupted, r.recorded, err)
+	}
+	r.recorded++
+	r.apply(&rec)
+	return rec, nil
+}
+
+// Replay - applies all records of log
+func (r *AuditReplayer) Replay() error {
+	for {
+		if _, err := r.Next(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (r *AuditReplayer) read(kind AuditRecordKind) (rec AuditRecord, err error) {
+	rec = AuditRecord{Kind: kind, Op: r.op.Op, Time: r.op.Time, BlockNum: r.op.BlockNum}
+	switch kind {
+	case AuditRecordOp:
+		var op byte
+		var nanos uint64
+		if op, err = r.r.ReadByte(); err != nil {
+			return rec, err
+		}
+		if nanos, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		if rec.BlockNum, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		rec.Op, rec.Time = AuditOp(op), time.Unix(0, int64(nanos))
+		r.op = rec
+	case AuditRecordLimits:
+		for i := range rec.Limits {
+			var l uint64
+			if l, err = binary.ReadUvarint(r.r); err != nil {
+				return rec, err
+			}
+			rec.Limits[i] = int(l)
+		}
+	case AuditRecordBaseFee:
+		rec.BaseFee, err = binary.ReadUvarint(r.r)
+	case AuditRecordAdd:
+		if _, err = io.ReadFull(r.r, rec.IDHash[:]); err != nil {
+			return rec, err
+		}
+		mt := &metaTx{Tx: &types.TxSlot{IDHash: rec.IDHash}, bestIndex: -1, worstIndex: -1}
+		if mt.Tx.SenderID, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		if mt.Tx.Nonce, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		if mt.timestamp, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		if err = r.readU256(&mt.Tx.Tip); err != nil {
+			return rec, err
+		}
+		if err = r.readU256(&mt.Tx.FeeCap); err != nil {
+			return rec, err
+		}
+		r.txs[rec.IDHash] = mt
+	case AuditRecordMove, AuditRecordRank:
+		if _, err = io.ReadFull(r.r, rec.IDHash[:]); err != nil {
+			return rec, err
+		}
+		if kind == AuditRecordMove {
+			var sp byte
+			if sp, err = r.r.ReadByte(); err != nil {
+				return rec, err
+			}
+			rec.SubPool = SubPoolType(sp)
+		}
+		mt, ok := r.txs[rec.IDHash]
+		if !ok {
+			return rec, fmt.Errorf("unknown tx %x", rec.IDHash)
+		}
+		err = r.readRank(mt)
+	case AuditRecordRemove:
+		_, err = io.ReadFull(r.r, rec.IDHash[:])
+	case AuditRecordDiscard:
+		if _, err = io.ReadFull(r.r, rec.IDHash[:]); err != nil {
+			return rec, err
+		}
+		var reason byte
+		reason, err = r.r.ReadByte()
+		rec.Reason = DiscardReason(reason)
+	case AuditRecordYield:
+		var n uint64
+		if n, err = binary.ReadUvarint(r.r); err != nil {
+			return rec, err
+		}
+		rec.Yielded = make([][32]byte, n)
+		for i := range rec.Yielded {
+			if _, err = io.ReadFull(r.r, rec.Yielded[i][:]); err != nil {
+				return rec, err
+			}
+		}
+	default:
+		return rec, fmt.Errorf("unknown record kind %d", kind)
+	}
+	return rec, err
+}
+
+func (r *AuditReplayer) readU256(v *uint256.Int) error {
+	l, err := r.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if int(l) > len(r.u256Buf) {
+		return fmt.Errorf("uint256 of %d bytes", l)
+	}
+	if _, err = io.ReadFull(r.r, r.u256Buf[:l]); err != nil {
+		return err
+	}
+	v.SetBytes(r.u256Buf[:l])
+	return nil
+}
+
+func (r *AuditReplayer) readRank(mt *metaTx) (err error) {
+	var subPool byte
+	if subPool, err = r.r.ReadByte(); err != nil {
+		return err
+	}
+	mt.subPool = SubPoolMarker(subPool)
+	if err = r.readU256(&mt.minFeeCap); err != nil {
+		return err
+	}
+	if mt.minTip, err = binary.ReadUvarint(r.r); err != nil {
+		return err
+	}
+	if mt.nonceDistance, err = binary.ReadUvarint(r.r); err != nil {
+		return err
+	}
+	mt.cumulativeBalanceDistance, err = binary.ReadUvarint(r.r)
+	return err
+}
+
+func (r *AuditReplayer) apply(rec *AuditRecord) {
+	switch rec.Kind {
+	case AuditRecordLimits:
+		r.limits = rec.Limits
+	case AuditRecordBaseFee:
+		r.baseFee = rec.BaseFee
+	case AuditRecordMove:
+		r.txs[rec.IDHash].currentSubPool = rec.SubPool
+	case AuditRecordRemove:
+		if mt, ok := r.txs[rec.IDHash]; ok {
+			mt.currentSubPool = 0
+		}
+	case AuditRecordDiscard:
+		delete(r.txs, rec.IDHash)
+	}
+}
+
+// PendingBaseFee - pending base fee after applied records
+func (r *AuditReplayer) PendingBaseFee() uint64 { return r.baseFee }
+
+// Limits - limits of pending, baseFee and queued sub-pools
+func (r *AuditReplayer) Limits() (pending, baseFee, queued int) {
+	return r.limits[0], r.limits[1], r.limits[2]
+}
+
+// SubPool - transactions of sub-pool after applied records, best first (same order as in pool, ties are ordered by hash)
+func (r *AuditReplayer) SubPool(t SubPoolType) [][32]byte {
+	var mts []*metaTx
+	for _, mt := range r.txs {
+		if mt.currentSubPool == t {
+			mts = append(mts, mt)
+		}
+	}
+	baseFee := *uint256.NewInt(r.baseFee)
+	sort.Slice(mts, func(i, j int) bool {
+		if mts[i].better(mts[j], baseFee) != mts[j].better(mts[i], baseFee) {
+			return mts[i].better(mts[j], baseFee)
+		}
+		return bytes.Compare(mts[i].Tx.IDHash[:], mts[j].Tx.IDHash[:]) < 0
+	})
+	res := make([][32]byte, len(mts))
+	for i, mt := range mts {
+		res[i] = mt.Tx.IDHash
+	}
+	return res
+}
+
+// Explain - why transaction `a` ranks above (or below) `b` after applied records: returns order and name of field which decided it
+func (r *AuditReplayer) Explain(a, b [32]byte) (aIsBetter bool, decidedBy string, err error) {
+	mtA, okA := r.txs[a]
+	mtB, okB := r.txs[b]
+	if !okA || !okB {
+		return false, "", fmt.Errorf("tx is not in pool: %x %t, %x %t", a, okA, b, okB)
+	}
+	if mtA.currentSubPool != mtB.currentSubPool {
+		return mtA.currentSubPool != 0 && (mtB.currentSubPool == 0 || mtA.currentSubPool < mtB.currentSubPool), "sub-pool", nil
+	}
+	better, by := mtA.betterBy(mtB, *uint256.NewInt(r.baseFee))
+	return better, by.String(), nil
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/u256"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/kv/kvcache"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAuditLogReplay(t *testing.T) {
+	require := require.New(t)
+	ch := make(chan types.Announcements, 100)
+	db, coreDB := memdb.NewTestPoolDB(t), memdb.NewTestDB(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+
+	cfg := DefaultConfig
+	cfg.PendingSubPoolLimit = 3
+	cfg.AuditLog = auditPath
+	pool, err := New(ch, coreDB, cfg, kvcache.New(kvcache.DefaultCoherentConfig), *u256.N1, nil)
+	require.NoError(err)
+	ctx := context.Background()
+
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch:         []*remote.StateChange{{BlockHeight: 0, BlockHash: h1}},
+	}
+	addrs := make([][20]byte, 5)
+	for i := range addrs {
+		addrs[i][0] = byte(i + 1)
+		v := make([]byte, types.EncodeSenderLengthForStorage(0, *uint256.NewInt(1 * common.Ether)))
+		types.EncodeSender(0, *uint256.NewInt(1 * common.Ether), v)
+		change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+			Action:  remote.Action_UPSERT,
+			Address: gointerfaces.ConvertAddressToH160(addrs[i]),
+			Data:    v,
+		})
+	}
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	require.NoError(pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, tx))
+
+	// 5 senders with different tips: pending limit is 3, so 2 cheapest are evicted
+	var txSlots types.TxSlots
+	for i, addr := range addrs {
+		txSlot := &types.TxSlot{
+			Tip:    *uint256.NewInt(uint64(300_000 + i*1000)),
+			FeeCap: *uint256.NewInt(uint64(300_000 + i*1000)),
+			Gas:    100_000,
+			Rlp:    []byte{byte(i)},
+		}
+		txSlot.IDHash[0] = byte(i + 1)
+		txSlots.Append(txSlot, addr[:], true)
+	}
+	_, err = pool.AddLocalTxs(ctx, txSlots, tx)
+	require.NoError(err)
+
+	var txs types.TxsRlp
+	_, err = pool.PeekBest(10, &txs, tx, 0, 1_000_000)
+	require.NoError(err)
+	require.Equal(3, len(txs.Txs))
+
+	f, err := os.Open(auditPath)
+	require.NoError(err)
+	defer f.Close()
+	r := NewAuditReplayer(f)
+	var evicted, yielded [][32]byte
+	var ops []AuditOp
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			require.ErrorIs(err, io.EOF)
+			break
+		}
+		switch rec.Kind {
+		case AuditRecordOp:
+			ops = append(ops, rec.Op)
+		case AuditRecordDiscard:
+			require.Equal(PendingPoolOverflow, rec.Reason)
+			evicted = append(evicted, rec.IDHash)
+		case AuditRecordYield:
+			yielded = rec.Yielded
+		}
+	}
+	require.Equal([]AuditOp{AuditNewBlock, AuditLocalTxs, AuditYield}, ops)
+	require.Equal(uint64(200_000), r.PendingBaseFee())
+	pendingLimit, _, _ := r.Limits()
+	require.Equal(3, pendingLimit)
+
+	// replayed state is same as state of pool
+	hashes := func(ms []*metaTx) (res [][32]byte) {
+		for _, mt := range ms {
+			res = append(res, mt.Tx.IDHash)
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i][0] < res[j][0] })
+		return res
+	}
+	sorted := func(in [][32]byte) [][32]byte {
+		var res [][32]byte
+		res = append(res, in...)
+		sort.Slice(res, func(i, j int) bool { return res[i][0] < res[j][0] })
+		return res
+	}
+	require.Equal(hashes(pool.pending.best.ms), sorted(r.SubPool(PendingSubPool)))
+	require.Equal(hashes(pool.baseFee.best.ms), sorted(r.SubPool(BaseFeeSubPool)))
+	require.Equal(hashes(pool.queued.best.ms), sorted(r.SubPool(QueuedSubPool)))
+	require.Equal(r.SubPool(PendingSubPool), yielded)
+	require.Equal([][32]byte{{1}, {2}}, sorted(evicted))
+
+	better, by, err := r.Explain([32]byte{5}, [32]byte{4})
+	require.NoError(err)
+	require.True(better)
+	require.Equal(rankByEffectiveTip.String(), by)
+	_, _, err = r.Explain([32]byte{5}, [32]byte{1})
+	require.Error(err)
+
+	// log is appended after restart of pool
+	pool2, err := New(ch, coreDB, cfg, kvcache.New(kvcache.DefaultCoherentConfig), *u256.N1, nil)
+	require.NoError(err)
+	_, err = pool2.PeekBest(10, &txs, tx, 0, 1_000_000)
+	require.NoError(err)
+	_, err = f.Seek(0, 0)
+	require.NoError(err)
+	require.NoError(NewAuditReplayer(f).Replay())
+}
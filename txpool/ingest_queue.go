@@ -0,0 +1,183 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// IngestPolicy - what ingestion queue does with new remote tx when it's full
+type IngestPolicy uint8
+
+const (
+	IngestShed   IngestPolicy = iota // evict newest tx of lower priority class, reject if there is no such tx
+	IngestReject                     // reject new tx
+)
+
+// ingestPriority - class of tx waiting for processRemoteTxs. Txs of higher class are processed first and are never
+// evicted by txs of lower class. Local txs (AddLocalTxs) are not queued at all: they are processed synchronously.
+type ingestPriority uint8
+
+const (
+	ingestBulk    ingestPriority = iota // gossip
+	ingestPopular                       // received from many peers (see ingestPopularAfter)
+	ingestLocal                         // known as local (isLocalLRU): own tx echoed back by peers
+	ingestPriorities
+)
+
+const ingestPopularAfter = 3 // tx received this many times is "announced by many peers"
+
+var (
+	ingestQueueDepth = [ingestPriorities]*metrics.Counter{
+		metrics.GetOrCreateCounter(`txpool_ingest_queue{priority="bulk"}`),
+		metrics.GetOrCreateCounter(`txpool_ingest_queue{priority="popular"}`),
+		metrics.GetOrCreateCounter(`txpool_ingest_queue{priority="local"}`),
+	}
+	ingestShedCounter     = metrics.GetOrCreateCounter(`txpool_ingest_dropped{reason="shed"}`)
+	ingestRejectedCounter = metrics.GetOrCreateCounter(`txpool_ingest_dropped{reason="rejected"}`)
+)
+
+type ingestItem struct {
+	txn      *types.TxSlot
+	sender   [20]byte
+	received int
+	priority ingestPriority
+	dropped  bool
+}
+
+// ingestQueue - remote txs waiting for processRemoteTxs, bounded by amount and size of txs (0 - no limit).
+// Not thread-safe: guarded by TxPool.lock.
+type ingestQueue struct {
+	limit   int
+	limitB  uint64
+	policy  IngestPolicy
+	byHash  map[string]*ingestItem // to reject duplicates
+	classes [ingestPriorities][]*ingestItem
+	counts  [ingestPriorities]int
+	size    uint64
+}
+
+func newIngestQueue(limit int, limitBytes uint64, policy IngestPolicy) *ingestQueue {
+	return &ingestQueue{limit: limit, limitB: limitBytes, policy: policy, byHash: map[string]*ingestItem{}}
+}
+
+func (q *ingestQueue) Len() int { return len(q.byHash) }
+
+func (q *ingestQueue) has(idHash []byte) bool {
+	_, ok := q.byHash[string(idHash)]
+	return ok
+}
+
+func (q *ingestQueue) appendAnnouncements(txTypes []byte, sizes []uint32, hashes []byte) ([]byte, []uint32, []byte) {
+	for _, it := range q.byHash {
+		txTypes = append(txTypes, it.txn.Type)
+		sizes = append(sizes, it.txn.Size)
+		hashes = append(hashes, it.txn.IDHash[:]...)
+	}
+	return txTypes, sizes, hashes
+}
+
+func (q *ingestQueue) full(size uint64) bool {
+	return (q.limit > 0 && len(q.byHash) >= q.limit) || (q.limitB > 0 && q.size+size > q.limitB)
+}
+
+// push - false if tx is rejected. Duplicate is accepted: it makes tx popular
+func (q *ingestQueue) push(txn *types.TxSlot, sender []byte, local bool) bool {
+	if it, ok := q.byHash[string(txn.IDHash[:])]; ok {
+		it.received++
+		if it.received >= ingestPopularAfter && it.priority < ingestPopular {
+			q.move(it, ingestPopular)
+		}
+		return true
+	}
+	priority := ingestBulk
+	if local {
+		priority = ingestLocal
+	}
+	size := uint64(txn.Size)
+	for q.full(size) {
+		if q.policy == IngestReject || !q.shedLowerThan(priority) {
+			ingestRejectedCounter.Inc()
+			return false
+		}
+	}
+	it := &ingestItem{txn: txn, received: 1, priority: priority}
+	copy(it.sender[:], sender)
+	q.byHash[string(txn.IDHash[:])] = it
+	q.classes[priority] = append(q.classes[priority], it)
+	q.counts[priority]++
+	q.size += size
+	return true
+}
+
+// move - to higher class. Item stays in list of old class too: skipped there by priority mismatch
+func (q *ingestQueue) move(it *ingestItem, priority ingestPriority) {
+	q.counts[it.priority]--
+	it.priority = priority
+	q.classes[priority] = append(q.classes[priority], it)
+	q.counts[priority]++
+}
+
+// shedLowerThan - evicts newest tx of lowest class which is lower than `priority`
+func (q *ingestQueue) shedLowerThan(priority ingestPriority) bool {
+	for c := ingestBulk; c < priority; c++ {
+		list := q.classes[c]
+		for len(list) > 0 {
+			it := list[len(list)-1]
+			list = list[:len(list)-1]
+			if it.dropped || it.priority != c {
+				continue
+			}
+			q.classes[c] = list
+			it.dropped = true
+			delete(q.byHash, string(it.txn.IDHash[:]))
+			q.counts[c]--
+			q.size -= uint64(it.txn.Size)
+			ingestShedCounter.Inc()
+			return true
+		}
+		q.classes[c] = list
+	}
+	return false
+}
+
+// drain - moves all txs to `to`, higher classes first
+func (q *ingestQueue) drain(to *types.TxSlots) {
+	for c := ingestLocal; ; c-- {
+		for _, it := range q.classes[c] {
+			if it.dropped || it.priority != c {
+				continue
+			}
+			to.Append(it.txn, it.sender[:], false)
+		}
+		q.classes[c] = q.classes[c][:0]
+		q.counts[c] = 0
+		if c == ingestBulk {
+			break
+		}
+	}
+	q.byHash = map[string]*ingestItem{}
+	q.size = 0
+}
+
+func (q *ingestQueue) updateMetrics() {
+	for c, n := range q.counts {
+		ingestQueueDepth[c].Set(uint64(n))
+	}
+}
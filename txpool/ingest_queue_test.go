@@ -0,0 +1,90 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func ingestTestTx(id byte) *types.TxSlot {
+	txn := &types.TxSlot{Size: 100}
+	txn.IDHash[0] = id
+	return txn
+}
+
+func ingestDrained(t *testing.T, q *ingestQueue) (ids []byte) {
+	var slots types.TxSlots
+	q.drain(&slots)
+	for i, txn := range slots.Txs {
+		ids = append(ids, txn.IDHash[0])
+		require.Equal(t, txn.IDHash[0], slots.Senders.At(i)[0])
+	}
+	return ids
+}
+
+func TestIngestQueuePriority(t *testing.T) {
+	q := newIngestQueue(0, 0, IngestShed)
+	push := func(id byte, local bool) bool { return q.push(ingestTestTx(id), []byte{id}, local) }
+	require.True(t, push(1, false))
+	require.True(t, push(2, false))
+	require.True(t, push(3, true))
+	for i := 1; i < ingestPopularAfter; i++ {
+		require.True(t, push(2, false)) // received from many peers
+	}
+	require.Equal(t, 3, q.Len())
+	require.True(t, q.has(ingestTestTx(2).IDHash[:]))
+	require.Equal(t, []byte{3, 2, 1}, ingestDrained(t, q))
+	require.Equal(t, 0, q.Len())
+	require.Nil(t, ingestDrained(t, q))
+}
+
+func TestIngestQueueShed(t *testing.T) {
+	q := newIngestQueue(3, 0, IngestShed)
+	push := func(id byte, local bool) bool { return q.push(ingestTestTx(id), []byte{id}, local) }
+	require.True(t, push(1, false))
+	require.True(t, push(2, false))
+	require.True(t, push(3, false))
+	require.False(t, push(4, false)) // nothing of lower class to shed
+	require.True(t, push(5, true))   // newest gossip is shed
+	require.False(t, q.has(ingestTestTx(3).IDHash[:]))
+	require.True(t, push(6, true))
+	require.True(t, push(7, true))
+	require.False(t, push(8, true)) // full of locals
+	require.Equal(t, []byte{5, 6, 7}, ingestDrained(t, q))
+
+	// by size
+	q = newIngestQueue(0, 250, IngestShed)
+	require.True(t, push(1, false))
+	require.True(t, push(2, false))
+	require.False(t, push(3, false))
+	require.True(t, push(4, true))
+	require.Equal(t, []byte{4, 1}, ingestDrained(t, q))
+}
+
+func TestIngestQueueReject(t *testing.T) {
+	q := newIngestQueue(2, 0, IngestReject)
+	push := func(id byte, local bool) bool { return q.push(ingestTestTx(id), []byte{id}, local) }
+	require.True(t, push(1, false))
+	require.True(t, push(2, false))
+	require.False(t, push(3, true))
+	require.True(t, push(1, false)) // duplicate is not new tx
+	require.Equal(t, []byte{1, 2}, ingestDrained(t, q))
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// PendingFilter - server-side filter of new pending txs stream (see GrpcServer.OnAddFiltered): gateways which
+// subscribe on behalf of many clients receive only matching txs instead of discarding the full stream.
+// Tx matches if it satisfies all non-empty conditions.
+type PendingFilter struct {
+	From     map[common.Address]struct{} // senders
+	To       map[common.Address]struct{} // recipients, contract creations never match
+	MinValue *uint256.Int
+	Types    []byte // types.LegacyTxType, types.AccessListTxType, ...
+}
+
+// pendingTxMeta - fields of new pending tx checked by PendingFilter
+type pendingTxMeta struct {
+	sender   common.Address
+	to       common.Address
+	creation bool
+	value    uint256.Int
+	txType   byte
+	known    bool // false - tx is not in pool anymore: only subscribers without filter receive it
+}
+
+func newPendingTxMeta(txn *types.TxSlot, sender common.Address) pendingTxMeta {
+	return pendingTxMeta{sender: sender, to: txn.To, creation: txn.Creation, value: txn.Value, txType: txn.Type, known: true}
+}
+
+func (f *PendingFilter) match(m *pendingTxMeta) bool {
+	if f == nil {
+		return true
+	}
+	if !m.known {
+		return false
+	}
+	if len(f.From) > 0 {
+		if _, ok := f.From[m.sender]; !ok {
+			return false
+		}
+	}
+	if len(f.To) > 0 {
+		if m.creation {
+			return false
+		}
+		if _, ok := f.To[m.to]; !ok {
+			return false
+		}
+	}
+	if f.MinValue != nil && m.value.Lt(f.MinValue) {
+		return false
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == m.txType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	txpool_proto "github.com/ledgerwatch/erigon-lib/gointerfaces/txpool"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+type onAddStreamMock struct {
+	grpc.ServerStream
+	replies []*txpool_proto.OnAddReply
+}
+
+func (s *onAddStreamMock) Send(reply *txpool_proto.OnAddReply) error {
+	s.replies = append(s.replies, reply)
+	return nil
+}
+func (s *onAddStreamMock) Context() context.Context { return context.Background() }
+
+func TestPendingFilter(t *testing.T) {
+	alice, bob, carol := common.Address{1}, common.Address{2}, common.Address{3}
+	meta := func(from, to common.Address, value uint64, txType byte) pendingTxMeta {
+		txn := &types.TxSlot{To: to, Creation: to == common.Address{}, Type: txType}
+		txn.Value.SetUint64(value)
+		return newPendingTxMeta(txn, from)
+	}
+	txs := []pendingTxMeta{
+		meta(alice, bob, 10, types.LegacyTxType),
+		meta(bob, carol, 1000, types.DynamicFeeTxType),
+		meta(carol, common.Address{}, 0, types.DynamicFeeTxType), // contract creation
+		{}, // left pool
+	}
+	matched := func(f *PendingFilter) (res []int) {
+		for i := range txs {
+			if f.match(&txs[i]) {
+				res = append(res, i)
+			}
+		}
+		return res
+	}
+	require.Equal(t, []int{0, 1, 2, 3}, matched(nil))
+	require.Equal(t, []int{0, 1, 2}, matched(&PendingFilter{}))
+	require.Equal(t, []int{0, 2}, matched(&PendingFilter{From: map[common.Address]struct{}{alice: {}, carol: {}}}))
+	require.Equal(t, []int{1}, matched(&PendingFilter{To: map[common.Address]struct{}{carol: {}}}))
+	require.Equal(t, []int{1}, matched(&PendingFilter{MinValue: uint256.NewInt(11)}))
+	require.Equal(t, []int{1, 2}, matched(&PendingFilter{Types: []byte{types.DynamicFeeTxType}}))
+	require.Nil(t, matched(&PendingFilter{From: map[common.Address]struct{}{alice: {}}, Types: []byte{types.DynamicFeeTxType}}))
+
+	var streams NewSlotsStreams
+	all, onlyCarol, none := &onAddStreamMock{}, &onAddStreamMock{}, &onAddStreamMock{}
+	defer streams.Add(all)()
+	defer streams.AddFiltered(onlyCarol, &PendingFilter{To: map[common.Address]struct{}{carol: {}}})()
+	removeNone := streams.AddFiltered(none, &PendingFilter{MinValue: uint256.NewInt(1_000_000)})
+	require.True(t, streams.hasFiltered())
+
+	rlps := [][]byte{{0}, {1}, {2}, {3}}
+	streams.broadcastFiltered(rlps, txs)
+	require.Equal(t, 1, len(all.replies))
+	require.Equal(t, rlps, all.replies[0].RplTxs)
+	require.Equal(t, 1, len(onlyCarol.replies))
+	require.Equal(t, [][]byte{{1}}, onlyCarol.replies[0].RplTxs)
+	require.Equal(t, 0, len(none.replies)) // nothing matched: nothing sent
+
+	removeNone()
+	removeNone() // double-unsubscribe
+	require.True(t, streams.hasFiltered())
+}
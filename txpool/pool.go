@@ -47,11 +47,9 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/common/fixedgas"
 	emath "github.com/ledgerwatch/erigon-lib/common/math"
-	"github.com/ledgerwatch/erigon-lib/common/u256"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces/grpcutil"
 	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
-	proto_txpool "github.com/ledgerwatch/erigon-lib/gointerfaces/txpool"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/kvcache"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
@@ -85,6 +83,12 @@ type Config struct {
 	AccountSlots          uint64 // Number of executable transaction slots guaranteed per account
 	PriceBump             uint64 // Price bump percentage to replace an already existing transaction
 	OverrideShanghaiTime  *big.Int
+	AuditLog              string // file to append log of ordering decisions (see audit.go), empty - disabled
+
+	// remote txs waiting for batch processing (see ingestQueue): gossip floods are shed instead of ballooning memory
+	IngestQueueLimit int    // max amount of txs, 0 - no limit
+	IngestQueueBytes uint64 // max size of txs, 0 - no limit
+	IngestPolicy     IngestPolicy
 }
 
 var DefaultConfig = Config{
@@ -101,6 +105,10 @@ var DefaultConfig = Config{
 	AccountSlots:         16, //TODO: to choose right value (16 to be compatible with Geth)
 	PriceBump:            10, // Price bump percentage to replace an already existing transaction
 	OverrideShanghaiTime: nil,
+
+	IngestQueueLimit: 32_768,
+	IngestQueueBytes: 64 * 1024 * 1024,
+	IngestPolicy:     IngestShed,
 }
 
 // Pool is interface for the transaction pool
@@ -170,6 +178,8 @@ const (
 	NotReplaced         DiscardReason = 20 // There was an existing transaction with the same sender and nonce, not enough price bump to replace
 	DuplicateHash       DiscardReason = 21 // There was an existing transaction with the same hash
 	InitCodeTooLarge    DiscardReason = 22 // EIP-3860 - transaction init code is too large
+	TxTypeNotSupported  DiscardReason = 23 // type of transaction is not active at tip of chain, see ValidationRules
+	TipAboveFeeCap      DiscardReason = 24 // EIP-1559 - max priority fee is higher than max fee
 )
 
 func (r DiscardReason) String() string {
@@ -220,6 +230,10 @@ func (r DiscardReason) String() string {
 		return "existing tx with same hash"
 	case InitCodeTooLarge:
 		return "initcode too large"
+	case TxTypeNotSupported:
+		return "transaction type not supported"
+	case TipAboveFeeCap:
+		return "tip above fee cap"
 	default:
 		panic(fmt.Sprintf("discard reason: %d", r))
 	}
@@ -308,8 +322,8 @@ type TxPool struct {
 	//   - reduce amount of _chainDB transactions
 	//   - batch notifications about new txs (reduce P2P spam to other nodes about txs propagation)
 	//   - and as a result reducing lock contention
-	unprocessedRemoteTxs    *types.TxSlots
-	unprocessedRemoteByHash map[string]int     // to reject duplicates
+	unprocessedRemoteTxs    *types.TxSlots     // batch drained from unprocessedRemoteIngest by processRemoteTxs
+	unprocessedRemoteIngest *ingestQueue       // prioritized and bounded, rejects duplicates
 	byHash                  map[string]*metaTx // tx_hash => tx : only not committed to db yet records
 	discardReasonsLRU       *simplelru.LRU     // tx_hash => discard_reason : non-persisted
 	pending                 *PendingPool
@@ -328,6 +342,8 @@ type TxPool struct {
 	blockGasLimit           atomic.Uint64
 	shanghaiTime            *big.Int
 	isPostShanghai          atomic.Bool
+	chainConfig             *chain.Config // nil - defaultRules, see SetChainConfig
+	audit                   *auditLog     // nil if disabled
 }
 
 func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg Config, cache kvcache.Cache, chainID uint256.Int, shanghaiTime *big.Int) (*TxPool, error) {
@@ -349,6 +365,14 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg Config, cache kvca
 	for _, sender := range cfg.TracedSenders {
 		tracedSenders[sender] = struct{}{}
 	}
+	var audit *auditLog
+	if cfg.AuditLog != "" {
+		if audit, err = openAuditLog(cfg.AuditLog, cfg); err != nil {
+			return nil, err
+		}
+	}
+	pending, baseFee, queued := NewPendingSubPool(PendingSubPool, cfg.PendingSubPoolLimit), NewSubPool(BaseFeeSubPool, cfg.BaseFeeSubPoolLimit), NewSubPool(QueuedSubPool, cfg.QueuedSubPoolLimit)
+	pending.audit, baseFee.audit, queued.audit = audit, audit, audit
 	return &TxPool{
 		lock:                    &sync.Mutex{},
 		byHash:                  map[string]*metaTx{},
@@ -356,9 +380,9 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg Config, cache kvca
 		discardReasonsLRU:       discardHistory,
 		all:                     byNonce,
 		recentlyConnectedPeers:  &recentlyConnectedPeers{},
-		pending:                 NewPendingSubPool(PendingSubPool, cfg.PendingSubPoolLimit),
-		baseFee:                 NewSubPool(BaseFeeSubPool, cfg.BaseFeeSubPoolLimit),
-		queued:                  NewSubPool(QueuedSubPool, cfg.QueuedSubPoolLimit),
+		pending:                 pending,
+		baseFee:                 baseFee,
+		queued:                  queued,
 		newPendingTxs:           newTxs,
 		_stateCache:             cache,
 		senders:                 newSendersCache(tracedSenders),
@@ -366,8 +390,9 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg Config, cache kvca
 		cfg:                     cfg,
 		chainID:                 chainID,
 		unprocessedRemoteTxs:    &types.TxSlots{},
-		unprocessedRemoteByHash: map[string]int{},
+		unprocessedRemoteIngest: newIngestQueue(cfg.IngestQueueLimit, cfg.IngestQueueBytes, cfg.IngestPolicy),
 		shanghaiTime:            shanghaiTime,
+		audit:                   audit,
 	}, nil
 }
 
@@ -387,6 +412,8 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 	defer p.lock.Unlock()
 
 	p.lastSeenBlock.Store(stateChanges.ChangeBatch[len(stateChanges.ChangeBatch)-1].BlockHeight)
+	p.audit.begin(AuditNewBlock, p.lastSeenBlock.Load())
+	defer p.audit.flush()
 	if !p.started.Load() {
 		if err := p.fromDB(ctx, tx, coreTx); err != nil {
 			return fmt.Errorf("loading txs from DB: %w", err)
@@ -411,6 +438,7 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 	pendingBaseFee, baseFeeChanged := p.setBaseFee(baseFee)
 	// Update pendingBase for all pool queues and slices
 	if baseFeeChanged {
+		p.audit.baseFee(pendingBaseFee)
 		p.pending.best.pendingBaseFee = pendingBaseFee
 		p.pending.worst.pendingBaseFee = pendingBaseFee
 		p.baseFee.best.pendingBastFee = pendingBaseFee
@@ -499,10 +527,15 @@ func (p *TxPool) processRemoteTxs(ctx context.Context) error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	l := len(p.unprocessedRemoteTxs.Txs)
-	if l == 0 {
+	if len(p.unprocessedRemoteTxs.Txs) == 0 { // else: retry of failed batch
+		p.unprocessedRemoteIngest.drain(p.unprocessedRemoteTxs)
+		p.unprocessedRemoteIngest.updateMetrics()
+	}
+	if len(p.unprocessedRemoteTxs.Txs) == 0 {
 		return nil
 	}
+	p.audit.begin(AuditRemoteTxs, p.lastSeenBlock.Load())
+	defer p.audit.flush()
 
 	err = p.senders.registerNewSenders(p.unprocessedRemoteTxs)
 	if err != nil {
@@ -534,7 +567,6 @@ func (p *TxPool) processRemoteTxs(ctx context.Context) error {
 	}
 
 	p.unprocessedRemoteTxs.Resize(0)
-	p.unprocessedRemoteByHash = map[string]int{}
 
 	//log.Info("[txpool] on new txs", "amount", len(newPendingTxs.txs), "in", time.Since(t))
 	return nil
@@ -553,6 +585,19 @@ func (p *TxPool) getRlpLocked(tx kv.Tx, hash []byte) (rlpTxn []byte, sender []by
 	}
 	return v[20:], v[:20], txn != nil && txn.subPool&IsLocal > 0, nil
 }
+
+// pendingTxMeta - fields of tx checked by PendingFilter, not known if tx is not in pool anymore
+func (p *TxPool) pendingTxMeta(hash []byte) pendingTxMeta {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	txn, ok := p.byHash[string(hash)]
+	if !ok {
+		return pendingTxMeta{}
+	}
+	var sender common.Address
+	copy(sender[:], p.senders.senderID2Addr[txn.Tx.SenderID])
+	return newPendingTxMeta(txn.Tx, sender)
+}
 func (p *TxPool) GetRlp(tx kv.Tx, hash []byte) ([]byte, error) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -584,13 +629,7 @@ func (p *TxPool) AppendRemoteAnnouncements(types []byte, sizes []uint32, hashes
 		sizes = append(sizes, txn.Tx.Size)
 		hashes = append(hashes, hash...)
 	}
-	for hash, txIdx := range p.unprocessedRemoteByHash {
-		txSlot := p.unprocessedRemoteTxs.Txs[txIdx]
-		types = append(types, txSlot.Type)
-		sizes = append(sizes, txSlot.Size)
-		hashes = append(hashes, hash...)
-	}
-	return types, sizes, hashes
+	return p.unprocessedRemoteIngest.appendAnnouncements(types, sizes, hashes)
 }
 func (p *TxPool) AppendAllAnnouncements(types []byte, sizes []uint32, hashes []byte) ([]byte, []uint32, []byte) {
 	types, sizes, hashes = p.AppendLocalAnnouncements(types, sizes, hashes)
@@ -603,7 +642,7 @@ func (p *TxPool) IdHashKnown(tx kv.Tx, hash []byte) (bool, error) {
 	if _, ok := p.discardReasonsLRU.Get(string(hash)); ok {
 		return true, nil
 	}
-	if _, ok := p.unprocessedRemoteByHash[string(hash)]; ok {
+	if p.unprocessedRemoteIngest.has(hash) {
 		return true, nil
 	}
 	if _, ok := p.byHash[string(hash)]; ok {
@@ -628,11 +667,12 @@ func (p *TxPool) best(n uint16, txs *types.TxsRlp, tx kv.Tx, onTopOf, availableG
 		return false, 0, nil // Too early
 	}
 
-	isShanghai := p.isShanghai()
+	rules := p.validationRules()
 	best := p.pending.best
 
 	txs.Resize(uint(cmp.Min(int(n), len(best.ms))))
 	var toRemove []*metaTx
+	var yielded [][32]byte // for audit log
 	count := 0
 
 	for i := 0; count < int(n) && i < len(best.ms); i++ {
@@ -663,7 +703,7 @@ func (p *TxPool) best(n uint16, txs *types.TxsRlp, tx kv.Tx, onTopOf, availableG
 		// make sure we have enough gas in the caller to add this transaction.
 		// not an exact science using intrinsic gas but as close as we could hope for at
 		// this stage
-		intrinsicGas, _ := CalcIntrinsicGas(uint64(mt.Tx.DataLen), uint64(mt.Tx.DataNonZeroLen), nil, mt.Tx.Creation, true, true, isShanghai)
+		intrinsicGas, _ := rules.IntrinsicGas(mt.Tx)
 		if intrinsicGas > availableGas {
 			// we might find another TX with a low enough intrinsic gas to include so carry on
 			continue
@@ -677,10 +717,18 @@ func (p *TxPool) best(n uint16, txs *types.TxsRlp, tx kv.Tx, onTopOf, availableG
 		copy(txs.Senders.At(count), sender)
 		txs.IsLocal[count] = isLocal
 		toSkip.Add(mt.Tx.IDHash)
+		if p.audit != nil {
+			yielded = append(yielded, mt.Tx.IDHash)
+		}
 		count++
 	}
 
 	txs.Resize(uint(count))
+	if p.audit != nil {
+		p.audit.begin(AuditYield, onTopOf)
+		p.audit.yield(yielded)
+		defer p.audit.flush()
+	}
 	if len(toRemove) > 0 {
 		for _, mt := range toRemove {
 			p.pending.Remove(mt)
@@ -718,21 +766,17 @@ func (p *TxPool) AddRemoteTxs(_ context.Context, newTxs types.TxSlots) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	for i, txn := range newTxs.Txs {
-		_, ok := p.unprocessedRemoteByHash[string(txn.IDHash[:])]
-		if ok {
-			continue
-		}
-		p.unprocessedRemoteByHash[string(txn.IDHash[:])] = len(p.unprocessedRemoteTxs.Txs)
-		p.unprocessedRemoteTxs.Append(txn, newTxs.Senders.At(i), false)
+		p.unprocessedRemoteIngest.push(txn, newTxs.Senders.At(i), p.isLocalLRU.Contains(string(txn.IDHash[:])))
 	}
+	p.unprocessedRemoteIngest.updateMetrics()
 }
 
 func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.CacheView) DiscardReason {
-	isShanghai := p.isShanghai()
-	if isShanghai {
-		if txn.DataLen > fixedgas.MaxInitCodeSize {
-			return InitCodeTooLarge
+	if reason := p.validationRules().Validate(txn); reason != Success {
+		if txn.Traced {
+			log.Info(fmt.Sprintf("TX TRACING: validateTx consensus rules failed idHash=%x type=%d, gas=%d, reason=%s", txn.IDHash, txn.Type, txn.Gas, reason))
 		}
+		return reason
 	}
 
 	// Drop non-local transactions under our own minimal accepted gas price or tip
@@ -742,22 +786,6 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 		}
 		return UnderPriced
 	}
-	gas, reason := CalcIntrinsicGas(uint64(txn.DataLen), uint64(txn.DataNonZeroLen), nil, txn.Creation, true, true, isShanghai)
-	if txn.Traced {
-		log.Info(fmt.Sprintf("TX TRACING: validateTx intrinsic gas idHash=%x gas=%d", txn.IDHash, gas))
-	}
-	if reason != Success {
-		if txn.Traced {
-			log.Info(fmt.Sprintf("TX TRACING: validateTx intrinsic gas calculated failed idHash=%x reason=%s", txn.IDHash, reason))
-		}
-		return reason
-	}
-	if gas > txn.Gas {
-		if txn.Traced {
-			log.Info(fmt.Sprintf("TX TRACING: validateTx intrinsic gas > txn.gas idHash=%x gas=%d, txn.gas=%d", txn.IDHash, gas, txn.Gas))
-		}
-		return IntrinsicGas
-	}
 	if !isLocal && uint64(p.all.count(txn.SenderID)) > p.cfg.AccountSlots {
 		if txn.Traced {
 			log.Info(fmt.Sprintf("TX TRACING: validateTx marked as spamming idHash=%x slots=%d, limit=%d", txn.IDHash, p.all.count(txn.SenderID), p.cfg.AccountSlots))
@@ -774,10 +802,8 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 		return NonceTooLow
 	}
 	// Transactor should have enough funds to cover the costs
-	total := uint256.NewInt(txn.Gas)
-	total.Mul(total, &txn.FeeCap)
-	total.Add(total, &txn.Value)
-	if senderBalance.Cmp(total) < 0 {
+	total := types.MaxGasCost(txn.Gas, &txn.FeeCap, &txn.Value)
+	if senderBalance.Cmp(&total) < 0 {
 		if txn.Traced {
 			log.Info(fmt.Sprintf("TX TRACING: validateTx insufficient funds idHash=%x balance in state=%d, txn.gas*txn.tip=%d", txn.IDHash, senderBalance, total))
 		}
@@ -786,6 +812,19 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 	return Success
 }
 
+// SetChainConfig - transactions are validated by rules of fork at tip of chain (see ValidationRules),
+// without chain config - by defaultRules. Shanghai is still activated by shanghaiTime of New.
+func (p *TxPool) SetChainConfig(cfg *chain.Config) { p.chainConfig = cfg }
+
+func (p *TxPool) validationRules() ValidationRules {
+	if p.chainConfig == nil {
+		return defaultRules(p.isShanghai())
+	}
+	rules := RulesAt(p.chainConfig, p.lastSeenBlock.Load()+1, uint64(time.Now().Unix()))
+	rules.IsShanghai = p.isShanghai()
+	return rules
+}
+
 func (p *TxPool) isShanghai() bool {
 	// once this flag has been set for the first time we no longer need to check the timestamp
 	set := p.isPostShanghai.Load()
@@ -912,6 +951,8 @@ func (p *TxPool) AddLocalTxs(ctx context.Context, newTransactions types.TxSlots,
 
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	p.audit.begin(AuditLocalTxs, p.lastSeenBlock.Load())
+	defer p.audit.flush()
 
 	if !p.Started() {
 		if err := p.fromDB(ctx, tx, coreTx); err != nil {
@@ -1122,13 +1163,9 @@ func (p *TxPool) addLocked(mt *metaTx) DiscardReason {
 	// Insert to pending pool, if pool doesn't have txn with same Nonce and bigger Tip
 	found := p.all.get(mt.Tx.SenderID, mt.Tx.Nonce)
 	if found != nil {
-		tipThreshold := uint256.NewInt(0)
-		tipThreshold = tipThreshold.Mul(&found.Tx.Tip, uint256.NewInt(100+p.cfg.PriceBump))
-		tipThreshold.Div(tipThreshold, u256.N100)
-		feecapThreshold := uint256.NewInt(0)
-		feecapThreshold.Mul(&found.Tx.FeeCap, uint256.NewInt(100+p.cfg.PriceBump))
-		feecapThreshold.Div(feecapThreshold, u256.N100)
-		if mt.Tx.Tip.Cmp(tipThreshold) < 0 || mt.Tx.FeeCap.Cmp(feecapThreshold) < 0 {
+		tipThreshold := types.BumpedPrice(&found.Tx.Tip, p.cfg.PriceBump)
+		feecapThreshold := types.BumpedPrice(&found.Tx.FeeCap, p.cfg.PriceBump)
+		if mt.Tx.Tip.Cmp(&tipThreshold) < 0 || mt.Tx.FeeCap.Cmp(&feecapThreshold) < 0 {
 			// Both tip and feecap need to be larger than previously to replace the transaction
 			// In case if the transation is stuck, "poke" it to rebroadcast
 			// TODO refactor to return the list of promoted hashes instead of using added inside the pool
@@ -1175,6 +1212,7 @@ func (p *TxPool) addLocked(mt *metaTx) DiscardReason {
 	if mt.subPool&IsLocal != 0 {
 		p.isLocalLRU.Add(string(mt.Tx.IDHash[:]), struct{}{})
 	}
+	p.audit.add(mt)
 	// All transactions are first added to the queued pool and then immediately promoted from there if required
 	p.queued.Add(mt)
 	return NotSet
@@ -1183,6 +1221,7 @@ func (p *TxPool) addLocked(mt *metaTx) DiscardReason {
 // dropping transaction from all sub-structures and from db
 // Important: don't call it while iterating by all
 func (p *TxPool) discardLocked(mt *metaTx, reason DiscardReason) {
+	p.audit.discard(mt, reason)
 	delete(p.byHash, string(mt.Tx.IDHash[:]))
 	p.deletedTxs = append(p.deletedTxs, mt)
 	p.all.delete(mt)
@@ -1199,6 +1238,76 @@ func (p *TxPool) NonceFromAddress(addr [20]byte) (nonce uint64, inPool bool) {
 	return p.all.nonce(senderID)
 }
 
+// SenderDiagnostics - why transactions of sender are not included into blocks. Computed from pool's own view of
+// sender's state (as of last block seen by pool), without state reads.
+type SenderDiagnostics struct {
+	Found        bool   // sender has transactions in pool, other fields are empty otherwise
+	StateNonce   uint64 // nonce of sender in state
+	LowestNonce  uint64 // lowest nonce of sender's transactions in pool
+	HighestNonce uint64
+	// NonceGap - amount of missing nonces starting from FirstMissingNonce: transactions with nonces after them
+	// can't be included until missing ones are sent. 0 - no gap (FirstMissingNonce is next nonce after HighestNonce)
+	NonceGap          uint64
+	FirstMissingNonce uint64
+	// FeeShortfall - how much fee cap of transaction FeeShortfallNonce (and of all transactions after it, see
+	// metaTx.minFeeCap) is below current pending base fee. 0 - fee caps of all transactions are enough
+	FeeShortfall      uint256.Int
+	FeeShortfallNonce uint64
+	BaseFee           uint64 // pending base fee
+	// InsufficientBalanceNonce - first transaction which sender can't pay for (together with all prior ones), valid if InsufficientBalance
+	InsufficientBalance      bool
+	InsufficientBalanceNonce uint64
+
+	Pending, BaseFeeCount, Queued int // amount of sender's transactions in sub-pools
+}
+
+// SenderDiagnostics - see SenderDiagnostics type
+func (p *TxPool) SenderDiagnostics(addr [20]byte) (d SenderDiagnostics) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	senderID, found := p.senders.getID(addr[:])
+	if !found || !p.all.hasTxs(senderID) {
+		return d
+	}
+	d.Found = true
+	d.BaseFee = p.pendingBaseFee.Load()
+	baseFee := uint256.NewInt(d.BaseFee)
+	first := true
+	p.all.ascend(senderID, func(mt *metaTx) bool {
+		if first {
+			first = false
+			d.StateNonce = mt.Tx.Nonce - mt.nonceDistance
+			d.LowestNonce = mt.Tx.Nonce
+			d.FirstMissingNonce = d.StateNonce
+		}
+		d.HighestNonce = mt.Tx.Nonce
+		if d.NonceGap == 0 {
+			if mt.Tx.Nonce == d.FirstMissingNonce {
+				d.FirstMissingNonce++
+			} else {
+				d.NonceGap = mt.Tx.Nonce - d.FirstMissingNonce
+			}
+		}
+		if d.FeeShortfall.IsZero() && mt.minFeeCap.Lt(baseFee) {
+			d.FeeShortfall.Sub(baseFee, &mt.minFeeCap)
+			d.FeeShortfallNonce = mt.Tx.Nonce
+		}
+		if !d.InsufficientBalance && mt.subPool&EnoughBalance == 0 {
+			d.InsufficientBalance, d.InsufficientBalanceNonce = true, mt.Tx.Nonce
+		}
+		switch mt.currentSubPool {
+		case PendingSubPool:
+			d.Pending++
+		case BaseFeeSubPool:
+			d.BaseFeeCount++
+		case QueuedSubPool:
+			d.Queued++
+		}
+		return true
+	})
+	return d
+}
+
 // removeMined - apply new highest block (or batch of blocks)
 //
 // 1. New best block arrives, which potentially changes the balance and the nonce of some senders.
@@ -1300,9 +1409,7 @@ func onSenderStateChange(senderID uint64, senderNonce uint64, senderBalance uint
 		}
 
 		// Sender has enough balance for: gasLimit x feeCap + transferred_value
-		needBalance := uint256.NewInt(mt.Tx.Gas)
-		needBalance.Mul(needBalance, &mt.Tx.FeeCap)
-		needBalance.Add(needBalance, &mt.Tx.Value)
+		needBalance := types.MaxGasCost(mt.Tx.Gas, &mt.Tx.FeeCap, &mt.Tx.Value)
 		// 1. Minimum fee requirement. Set to 1 if feeCap of the transaction is no less than in-protocol
 		// parameter of minimal base fee. Set to 0 if feeCap is less than minimum base fee, which means
 		// this transaction will never be included into this particular chain.
@@ -1332,7 +1439,7 @@ func onSenderStateChange(senderID uint64, senderNonce uint64, senderBalance uint
 		mt.subPool &^= EnoughBalance
 		mt.cumulativeBalanceDistance = math.MaxUint64
 		if mt.Tx.Nonce >= senderNonce {
-			cumulativeRequiredBalance = cumulativeRequiredBalance.Add(cumulativeRequiredBalance, needBalance) // already deleted all transactions with nonce <= sender.nonce
+			*cumulativeRequiredBalance = types.AddSaturating(cumulativeRequiredBalance, &needBalance) // already deleted all transactions with nonce <= sender.nonce
 			if senderBalance.Gt(cumulativeRequiredBalance) || senderBalance.Eq(cumulativeRequiredBalance) {
 				mt.subPool |= EnoughBalance
 			} else {
@@ -1503,6 +1610,8 @@ func MainLoop(ctx context.Context, db kv.RwDB, coreDB kv.RoDB, p *TxPool, newTxs
 				var remoteTxHashes types.Hashes
 				var remoteTxRlps [][]byte
 				slotsRlp := make([][]byte, 0, announcements.Len())
+				var slotsMeta []pendingTxMeta // only if there are subscribers with filter
+				withFilters := newSlotsStreams != nil && newSlotsStreams.hasFiltered()
 
 				if err := db.View(ctx, func(tx kv.Tx) error {
 					for i := 0; i < announcements.Len(); i++ {
@@ -1517,6 +1626,9 @@ func MainLoop(ctx context.Context, db kv.RwDB, coreDB kv.RoDB, p *TxPool, newTxs
 
 						// Empty rlp can happen if a transaction we want to broadcase has just been mined, for example
 						slotsRlp = append(slotsRlp, slotRlp)
+						if withFilters {
+							slotsMeta = append(slotsMeta, p.pendingTxMeta(hash))
+						}
 						if p.IsLocal(hash) {
 							localTxTypes = append(localTxTypes, t)
 							localTxSizes = append(localTxSizes, size)
@@ -1535,7 +1647,7 @@ func MainLoop(ctx context.Context, db kv.RwDB, coreDB kv.RoDB, p *TxPool, newTxs
 					return
 				}
 				if newSlotsStreams != nil {
-					newSlotsStreams.Broadcast(&proto_txpool.OnAddReply{RplTxs: slotsRlp})
+					newSlotsStreams.broadcastFiltered(slotsRlp, slotsMeta)
 				}
 
 				// first broadcast all local txs to all peers, then non-local to random sqrt(peersAmount) peers
@@ -1825,6 +1937,7 @@ func (p *TxPool) logStats() {
 		"pending", p.pending.Len(),
 		"baseFee", p.baseFee.Len(),
 		"queued", p.queued.Len(),
+		"ingest", p.unprocessedRemoteIngest.Len(),
 	}
 	cacheKeys := p._stateCache.Len()
 	if cacheKeys > 0 {
@@ -1865,6 +1978,11 @@ func (p *TxPool) deprecatedForEach(_ context.Context, f func(rlp, sender []byte,
 
 // CalcIntrinsicGas computes the 'intrinsic gas' for a message with the given data.
 func CalcIntrinsicGas(dataLen, dataNonZeroLen uint64, accessList types.AccessList, isContractCreation, isHomestead, isEIP2028, isShanghai bool) (uint64, DiscardReason) {
+	return calcIntrinsicGas(dataLen, dataNonZeroLen, uint64(len(accessList)), uint64(accessList.StorageKeys()), isContractCreation, isHomestead, isEIP2028, isShanghai)
+}
+
+// calcIntrinsicGas - CalcIntrinsicGas by sizes of access list, as they are known by TxSlot
+func calcIntrinsicGas(dataLen, dataNonZeroLen, accessListLen, storageKeysLen uint64, isContractCreation, isHomestead, isEIP2028, isShanghai bool) (uint64, DiscardReason) {
 	// Set the starting gas for the raw transaction
 	var gas uint64
 	if isContractCreation && isHomestead {
@@ -1914,8 +2032,8 @@ func CalcIntrinsicGas(dataLen, dataNonZeroLen uint64, accessList types.AccessLis
 			}
 		}
 	}
-	if accessList != nil {
-		product, overflow := emath.SafeMul(uint64(len(accessList)), fixedgas.TxAccessListAddressGas)
+	if accessListLen > 0 || storageKeysLen > 0 {
+		product, overflow := emath.SafeMul(accessListLen, fixedgas.TxAccessListAddressGas)
 		if overflow {
 			return 0, GasUintOverflow
 		}
@@ -1924,7 +2042,7 @@ func CalcIntrinsicGas(dataLen, dataNonZeroLen uint64, accessList types.AccessLis
 			return 0, GasUintOverflow
 		}
 
-		product, overflow = emath.SafeMul(uint64(accessList.StorageKeys()), fixedgas.TxAccessListStorageKeyGas)
+		product, overflow = emath.SafeMul(storageKeysLen, fixedgas.TxAccessListStorageKeyGas)
 		if overflow {
 			return 0, GasUintOverflow
 		}
@@ -2164,6 +2282,7 @@ type PendingPool struct {
 	limit  int
 	t      SubPoolType
 	adding bool
+	audit  *auditLog
 }
 
 func NewPendingSubPool(t SubPoolType, limit int) *PendingPool {
@@ -2232,6 +2351,7 @@ func (p *PendingPool) PopWorst() *metaTx { //nolint
 	return i
 }
 func (p *PendingPool) Updated(mt *metaTx) {
+	p.audit.rank(mt)
 	heap.Fix(p.worst, mt.worstIndex)
 }
 func (p *PendingPool) Len() int { return len(p.best.ms) }
@@ -2244,6 +2364,7 @@ func (p *PendingPool) Remove(i *metaTx) {
 		p.best.UnsafeRemove(i)
 	}
 	i.currentSubPool = 0
+	p.audit.remove(i)
 }
 
 func (p *PendingPool) Add(i *metaTx) {
@@ -2254,6 +2375,7 @@ func (p *PendingPool) Add(i *metaTx) {
 		log.Info(fmt.Sprintf("TX TRACING: moved to subpool %s, IdHash=%x, sender=%d", p.t, i.Tx.IDHash, i.Tx.SenderID))
 	}
 	i.currentSubPool = p.t
+	p.audit.move(i, p.t)
 	heap.Push(p.worst, i)
 	p.best.UnsafeAdd(i)
 }
@@ -2273,6 +2395,7 @@ type SubPool struct {
 	limit  int
 	t      SubPoolType
 	adding bool
+	audit  *auditLog
 }
 
 func NewSubPool(t SubPoolType, limit int) *SubPool {
@@ -2323,6 +2446,7 @@ func (p *SubPool) Add(i *metaTx) {
 		log.Info(fmt.Sprintf("TX TRACING: moved to subpool %s, IdHash=%x, sender=%d", p.t, i.Tx.IDHash, i.Tx.SenderID))
 	}
 	i.currentSubPool = p.t
+	p.audit.move(i, p.t)
 	heap.Push(p.best, i)
 	heap.Push(p.worst, i)
 }
@@ -2331,9 +2455,11 @@ func (p *SubPool) Remove(i *metaTx) {
 	heap.Remove(p.best, i.bestIndex)
 	heap.Remove(p.worst, i.worstIndex)
 	i.currentSubPool = 0
+	p.audit.remove(i)
 }
 
 func (p *SubPool) Updated(i *metaTx) {
+	p.audit.rank(i)
 	heap.Fix(p.best, i.bestIndex)
 	heap.Fix(p.worst, i.worstIndex)
 }
@@ -2353,6 +2479,43 @@ type BestQueue struct {
 }
 
 func (mt *metaTx) better(than *metaTx, pendingBaseFee uint256.Int) bool {
+	better, _ := mt.betterBy(than, pendingBaseFee)
+	return better
+}
+
+// rankCriterion - which field of metaTx decided order of 2 transactions (see metaTx.betterBy)
+type rankCriterion uint8
+
+const (
+	rankBySubPool rankCriterion = iota
+	rankByEffectiveTip
+	rankByMinFeeCap
+	rankByNonceDistance
+	rankByBalanceDistance
+	rankByTimestamp
+)
+
+func (c rankCriterion) String() string {
+	switch c {
+	case rankBySubPool:
+		return "sub-pool bits"
+	case rankByEffectiveTip:
+		return "effective tip"
+	case rankByMinFeeCap:
+		return "min fee cap"
+	case rankByNonceDistance:
+		return "nonce distance"
+	case rankByBalanceDistance:
+		return "cumulative balance distance"
+	case rankByTimestamp:
+		return "timestamp"
+	default:
+		return fmt.Sprintf("unknown criterion %d", c)
+	}
+}
+
+// betterBy - same as better, but also returns criterion which decided the order
+func (mt *metaTx) betterBy(than *metaTx, pendingBaseFee uint256.Int) (bool, rankCriterion) {
 	subPool := mt.subPool
 	thanSubPool := than.subPool
 	if mt.minFeeCap.Cmp(&pendingBaseFee) >= 0 {
@@ -2362,56 +2525,39 @@ func (mt *metaTx) better(than *metaTx, pendingBaseFee uint256.Int) bool {
 		thanSubPool |= EnoughFeeCapBlock
 	}
 	if subPool != thanSubPool {
-		return subPool > thanSubPool
+		return subPool > thanSubPool, rankBySubPool
 	}
 
 	switch mt.currentSubPool {
 	case PendingSubPool:
-		var effectiveTip, thanEffectiveTip uint256.Int
-		if mt.minFeeCap.Cmp(&pendingBaseFee) >= 0 {
-			difference := uint256.NewInt(0)
-			difference.Sub(&mt.minFeeCap, &pendingBaseFee)
-			if difference.Cmp(uint256.NewInt(mt.minTip)) <= 0 {
-				effectiveTip = *difference
-			} else {
-				effectiveTip = *uint256.NewInt(mt.minTip)
-			}
-		}
-		if than.minFeeCap.Cmp(&pendingBaseFee) >= 0 {
-			difference := uint256.NewInt(0)
-			difference.Sub(&than.minFeeCap, &pendingBaseFee)
-			if difference.Cmp(uint256.NewInt(than.minTip)) <= 0 {
-				thanEffectiveTip = *difference
-			} else {
-				thanEffectiveTip = *uint256.NewInt(than.minTip)
-			}
-		}
+		effectiveTip := types.EffectiveTip(&mt.minFeeCap, uint256.NewInt(mt.minTip), &pendingBaseFee)
+		thanEffectiveTip := types.EffectiveTip(&than.minFeeCap, uint256.NewInt(than.minTip), &pendingBaseFee)
 		if effectiveTip.Cmp(&thanEffectiveTip) != 0 {
-			return effectiveTip.Cmp(&thanEffectiveTip) > 0
+			return effectiveTip.Cmp(&thanEffectiveTip) > 0, rankByEffectiveTip
 		}
 		// Compare nonce and cumulative balance. Just as a side note, it doesn't
 		// matter if they're from same sender or not because we're comparing
 		// nonce distance of the sender from state's nonce and not the actual
 		// value of nonce.
 		if mt.nonceDistance != than.nonceDistance {
-			return mt.nonceDistance < than.nonceDistance
+			return mt.nonceDistance < than.nonceDistance, rankByNonceDistance
 		}
 		if mt.cumulativeBalanceDistance != than.cumulativeBalanceDistance {
-			return mt.cumulativeBalanceDistance < than.cumulativeBalanceDistance
+			return mt.cumulativeBalanceDistance < than.cumulativeBalanceDistance, rankByBalanceDistance
 		}
 	case BaseFeeSubPool:
 		if mt.minFeeCap.Cmp(&than.minFeeCap) != 0 {
-			return mt.minFeeCap.Cmp(&than.minFeeCap) > 0
+			return mt.minFeeCap.Cmp(&than.minFeeCap) > 0, rankByMinFeeCap
 		}
 	case QueuedSubPool:
 		if mt.nonceDistance != than.nonceDistance {
-			return mt.nonceDistance < than.nonceDistance
+			return mt.nonceDistance < than.nonceDistance, rankByNonceDistance
 		}
 		if mt.cumulativeBalanceDistance != than.cumulativeBalanceDistance {
-			return mt.cumulativeBalanceDistance < than.cumulativeBalanceDistance
+			return mt.cumulativeBalanceDistance < than.cumulativeBalanceDistance, rankByBalanceDistance
 		}
 	}
-	return mt.timestamp < than.timestamp
+	return mt.timestamp < than.timestamp, rankByTimestamp
 }
 
 func (mt *metaTx) worse(than *metaTx, pendingBaseFee uint256.Int) bool {
@@ -763,3 +763,59 @@ func TestShanghaiValidateTx(t *testing.T) {
 		})
 	}
 }
+
+func TestSenderDiagnostics(t *testing.T) {
+	require := require.New(t)
+	ch := make(chan types.Announcements, 100)
+	db, coreDB := memdb.NewTestPoolDB(t), memdb.NewTestDB(t)
+	pool, err := New(ch, coreDB, DefaultConfig, kvcache.New(kvcache.DefaultCoherentConfig), *u256.N1, nil)
+	require.NoError(err)
+	ctx := context.Background()
+	pendingBaseFee := uint64(200000)
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: pendingBaseFee,
+		BlockGasLimit:       1000000,
+		ChangeBatch:         []*remote.StateChange{{BlockHeight: 0, BlockHash: gointerfaces.ConvertHashToH256([32]byte{})}},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := make([]byte, types.EncodeSenderLengthForStorage(2, *uint256.NewInt(1 * common.Ether)))
+	types.EncodeSender(2, *uint256.NewInt(1 * common.Ether), v)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	require.NoError(pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, tx))
+
+	require.False(pool.SenderDiagnostics(addr).Found)
+
+	var txSlots types.TxSlots
+	for i, tt := range []struct{ nonce, feeCap uint64 }{{2, 300000}, {3, 100000}, {6, 300000}} {
+		txSlot := &types.TxSlot{Tip: *uint256.NewInt(100000), FeeCap: *uint256.NewInt(tt.feeCap), Gas: 100000, Nonce: tt.nonce}
+		txSlot.IDHash[0] = byte(i + 1)
+		txSlots.Append(txSlot, addr[:], true)
+	}
+	reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+	require.NoError(err)
+	for _, reason := range reasons {
+		require.Equal(Success, reason, reason.String())
+	}
+
+	d := pool.SenderDiagnostics(addr)
+	require.True(d.Found)
+	require.Equal(uint64(2), d.StateNonce)
+	require.Equal(uint64(2), d.LowestNonce)
+	require.Equal(uint64(6), d.HighestNonce)
+	require.Equal(uint64(4), d.FirstMissingNonce)
+	require.Equal(uint64(2), d.NonceGap)
+	require.Equal(pendingBaseFee, d.BaseFee)
+	require.Equal(uint64(100000), d.FeeShortfall.Uint64())
+	require.Equal(uint64(3), d.FeeShortfallNonce)
+	require.False(d.InsufficientBalance)
+	require.Equal(1, d.Pending)
+	require.Equal(3, d.Pending+d.BaseFeeCount+d.Queued)
+}
@@ -58,6 +58,7 @@ type txPool interface {
 	CountContent() (int, int, int)
 	IdHashKnown(tx kv.Tx, hash []byte) (bool, error)
 	NonceFromAddress(addr [20]byte) (nonce uint64, inPool bool)
+	SenderDiagnostics(addr [20]byte) SenderDiagnostics
 }
 
 var _ txpool_proto.TxpoolServer = (*GrpcServer)(nil)   // compile-time interface check
@@ -240,7 +241,7 @@ func mapDiscardReasonToProto(reason DiscardReason) txpool_proto.ImportResult {
 		return txpool_proto.ImportResult_ALREADY_EXISTS
 	case UnderPriced, ReplaceUnderpriced, FeeTooLow:
 		return txpool_proto.ImportResult_FEE_TOO_LOW
-	case InvalidSender, NegativeValue, OversizedData, InitCodeTooLarge, RLPTooLong:
+	case InvalidSender, NegativeValue, OversizedData, InitCodeTooLarge, RLPTooLong, TxTypeNotSupported, TipAboveFeeCap:
 		return txpool_proto.ImportResult_INVALID
 	default:
 		return txpool_proto.ImportResult_INTERNAL_ERROR
@@ -248,9 +249,15 @@ func mapDiscardReasonToProto(reason DiscardReason) txpool_proto.ImportResult {
 }
 
 func (s *GrpcServer) OnAdd(req *txpool_proto.OnAddRequest, stream txpool_proto.Txpool_OnAddServer) error {
-	log.Info("New txs subscriber joined")
+	return s.OnAddFiltered(nil, stream)
+}
+
+// OnAddFiltered - OnAdd which sends only txs matching `filter`, see PendingFilter.
+// Not a method of Txpool gRPC service yet (OnAddRequest has no filter fields): for in-process RPC daemon.
+func (s *GrpcServer) OnAddFiltered(filter *PendingFilter, stream txpool_proto.Txpool_OnAddServer) error {
+	log.Info("New txs subscriber joined", "filtered", filter != nil)
 	//txpool.Loop does send messages to this streams
-	remove := s.NewSlotsStreams.Add(stream)
+	remove := s.NewSlotsStreams.AddFiltered(stream, filter)
 	defer remove()
 	select {
 	case <-stream.Context().Done():
@@ -303,48 +310,108 @@ func (s *GrpcServer) Nonce(ctx context.Context, in *txpool_proto.NonceRequest) (
 	}, nil
 }
 
+// SenderDiagnostics - why transactions of sender are stuck, see TxPool.SenderDiagnostics.
+// Not a method of Txpool gRPC service yet: for in-process RPC daemon.
+func (s *GrpcServer) SenderDiagnostics(_ context.Context, addr common.Address) (SenderDiagnostics, error) {
+	return s.txPool.SenderDiagnostics(addr), nil
+}
+
 // NewSlotsStreams - it's safe to use this class as non-pointer
 type NewSlotsStreams struct {
-	chans map[uint]txpool_proto.Txpool_OnAddServer
-	mu    sync.Mutex
-	id    uint
+	chans    map[uint]newSlotsSubscriber
+	filtered int // amount of subscribers with filter
+	mu       sync.Mutex
+	id       uint
+}
+
+type newSlotsSubscriber struct {
+	stream txpool_proto.Txpool_OnAddServer
+	filter *PendingFilter // nil - all txs
 }
 
 func (s *NewSlotsStreams) Add(stream txpool_proto.Txpool_OnAddServer) (remove func()) {
+	return s.AddFiltered(stream, nil)
+}
+
+// AddFiltered - subscriber receives only txs matching `filter`, nil - all txs
+func (s *NewSlotsStreams) AddFiltered(stream txpool_proto.Txpool_OnAddServer, filter *PendingFilter) (remove func()) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.chans == nil {
-		s.chans = make(map[uint]txpool_proto.Txpool_OnAddServer)
+		s.chans = make(map[uint]newSlotsSubscriber)
 	}
 	s.id++
 	id := s.id
-	s.chans[id] = stream
+	s.chans[id] = newSlotsSubscriber{stream: stream, filter: filter}
+	if filter != nil {
+		s.filtered++
+	}
 	return func() { s.remove(id) }
 }
 
+func (s *NewSlotsStreams) hasFiltered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filtered > 0
+}
+
+// Broadcast - sends `reply` to all subscribers, ignoring their filters
 func (s *NewSlotsStreams) Broadcast(reply *txpool_proto.OnAddReply) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for id, stream := range s.chans {
-		err := stream.Send(reply)
-		if err != nil {
-			log.Debug("failed send to mined block stream", "err", err)
-			select {
-			case <-stream.Context().Done():
-				delete(s.chans, id)
-			default:
+	for id, sub := range s.chans {
+		s.send(id, sub, reply)
+	}
+}
+
+// broadcastFiltered - sends to each subscriber txs matching its filter. `metas` of `rlps` are required only if
+// there are subscribers with filter: otherwise nil.
+func (s *NewSlotsStreams) broadcastFiltered(rlps [][]byte, metas []pendingTxMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := &txpool_proto.OnAddReply{RplTxs: rlps}
+	for id, sub := range s.chans {
+		if sub.filter == nil {
+			s.send(id, sub, all)
+			continue
+		}
+		var matched [][]byte
+		for i := range rlps {
+			if i < len(metas) && sub.filter.match(&metas[i]) {
+				matched = append(matched, rlps[i])
 			}
 		}
+		if len(matched) > 0 {
+			s.send(id, sub, &txpool_proto.OnAddReply{RplTxs: matched})
+		}
+	}
+}
+
+func (s *NewSlotsStreams) send(id uint, sub newSlotsSubscriber, reply *txpool_proto.OnAddReply) {
+	if err := sub.stream.Send(reply); err != nil {
+		log.Debug("failed send to mined block stream", "err", err)
+		select {
+		case <-sub.stream.Context().Done():
+			s.removeLocked(id)
+		default:
+		}
 	}
 }
 
 func (s *NewSlotsStreams) remove(id uint) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, ok := s.chans[id]
+	s.removeLocked(id)
+}
+
+func (s *NewSlotsStreams) removeLocked(id uint) {
+	sub, ok := s.chans[id]
 	if !ok { // double-unsubscribe support
 		return
 	}
+	if sub.filter != nil {
+		s.filtered--
+	}
 	delete(s.chans, id)
 }
 
@@ -126,6 +126,7 @@ func AllComponents(ctx context.Context, cfg txpool.Config, cache kvcache.Cache,
 	if err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
+	txPool.SetChainConfig(chainConfig)
 
 	fetch := txpool.NewFetch(ctx, sentryClients, txPool, stateChangesClient, chainDB, txPoolDB, *chainID)
 	//fetch.ConnectCore()
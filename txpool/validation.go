@@ -0,0 +1,87 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"github.com/ledgerwatch/erigon-lib/chain"
+	"github.com/ledgerwatch/erigon-lib/common/fixedgas"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// ValidationRules - consensus rules of transaction validity which don't depend on state, as of some fork.
+// Selected by RulesAt from chain config at tip: pool rejects transactions which block builder would reject anyway.
+// Blob transactions (EIP-4844) are not parsed by types.TxParseContext yet - so there is no rule of blobs count.
+type ValidationRules struct {
+	IsHomestead bool // EIP-2: contract creation costs TxGasContractCreation
+	IsIstanbul  bool // EIP-2028: cheaper non-zero bytes of data
+	IsBerlin    bool // EIP-2930: access list transactions
+	IsLondon    bool // EIP-1559: dynamic fee transactions
+	IsShanghai  bool // EIP-3860: limit of init code size and gas per word of it
+}
+
+// RulesAt - rules of block `blockNum` with timestamp `time`
+func RulesAt(cfg *chain.Config, blockNum, time uint64) ValidationRules {
+	r := cfg.Rules(blockNum, time)
+	return ValidationRules{
+		IsHomestead: r.IsHomestead,
+		IsIstanbul:  r.IsIstanbul,
+		IsBerlin:    r.IsBerlin,
+		IsLondon:    r.IsLondon,
+		IsShanghai:  r.IsShanghai,
+	}
+}
+
+// defaultRules - rules of pool without chain config: all block-number forks are active, Shanghai - by its time
+func defaultRules(isShanghai bool) ValidationRules {
+	return ValidationRules{IsHomestead: true, IsIstanbul: true, IsBerlin: true, IsLondon: true, IsShanghai: isShanghai}
+}
+
+// IntrinsicGas - gas which transaction costs before execution: data, access list and contract creation
+func (r ValidationRules) IntrinsicGas(txn *types.TxSlot) (uint64, DiscardReason) {
+	return calcIntrinsicGas(uint64(txn.DataLen), uint64(txn.DataNonZeroLen), uint64(txn.AlAddrCount), uint64(txn.AlStorCount), txn.Creation, r.IsHomestead, r.IsIstanbul, r.IsShanghai)
+}
+
+// Validate - checks type, fees, init code size and gas limit of transaction
+func (r ValidationRules) Validate(txn *types.TxSlot) DiscardReason {
+	switch txn.Type {
+	case types.LegacyTxType:
+	case types.AccessListTxType:
+		if !r.IsBerlin {
+			return TxTypeNotSupported
+		}
+	case types.DynamicFeeTxType:
+		if !r.IsLondon {
+			return TxTypeNotSupported
+		}
+		if txn.FeeCap.Lt(&txn.Tip) { // other types have single gas price: tip and fee cap are same
+			return TipAboveFeeCap
+		}
+	default:
+		return TxTypeNotSupported
+	}
+	if r.IsShanghai && txn.Creation && txn.DataLen > fixedgas.MaxInitCodeSize {
+		return InitCodeTooLarge
+	}
+	gas, reason := r.IntrinsicGas(txn)
+	if reason != Success {
+		return reason
+	}
+	if gas > txn.Gas {
+		return IntrinsicGas
+	}
+	return Success
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/chain"
+	"github.com/ledgerwatch/erigon-lib/kv/kvcache"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// forkConfig - chain config with all forks up to `fork` (inclusive) activated at genesis
+func forkConfig(t *testing.T, fork string) *chain.Config {
+	t.Helper()
+	cfg := &chain.Config{ChainID: big.NewInt(1)}
+	forks := []struct {
+		name string
+		num  **big.Int
+	}{
+		{"Frontier", nil},
+		{"Homestead", &cfg.HomesteadBlock},
+		{"TangerineWhistle", &cfg.TangerineWhistleBlock},
+		{"SpuriousDragon", &cfg.SpuriousDragonBlock},
+		{"Byzantium", &cfg.ByzantiumBlock},
+		{"Constantinople", &cfg.ConstantinopleBlock},
+		{"Petersburg", &cfg.PetersburgBlock},
+		{"Istanbul", &cfg.IstanbulBlock},
+		{"Berlin", &cfg.BerlinBlock},
+		{"London", &cfg.LondonBlock},
+		{"Shanghai", &cfg.ShanghaiTime},
+	}
+	for _, f := range forks {
+		if f.num != nil {
+			*f.num = big.NewInt(0)
+		}
+		if f.name == fork {
+			return cfg
+		}
+	}
+	t.Fatalf("unknown fork %s", fork)
+	return nil
+}
+
+// TestValidationConformance - vectors of consensus rules of transaction validity, see testdata/validation
+func TestValidationConformance(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "validation", "vectors.json"))
+	require.NoError(t, err)
+	var vectors []struct {
+		Name string
+		Fork string
+		Tx   struct {
+			Type           byte
+			Creation       bool
+			DataLen        int
+			DataNonZeroLen int
+			AlAddrs        int
+			AlKeys         int
+			Gas            uint64
+			FeeCap         uint64
+			Tip            uint64
+		}
+		Reason string
+	}
+	require.NoError(t, json.Unmarshal(data, &vectors))
+	require.NotEmpty(t, vectors)
+	for _, v := range vectors {
+		rules := RulesAt(forkConfig(t, v.Fork), 1, 1)
+		txn := &types.TxSlot{
+			Type:           v.Tx.Type,
+			Creation:       v.Tx.Creation,
+			DataLen:        v.Tx.DataLen,
+			DataNonZeroLen: v.Tx.DataNonZeroLen,
+			AlAddrCount:    v.Tx.AlAddrs,
+			AlStorCount:    v.Tx.AlKeys,
+			Gas:            v.Tx.Gas,
+		}
+		txn.FeeCap.SetUint64(v.Tx.FeeCap)
+		txn.Tip.SetUint64(v.Tx.Tip)
+		require.Equal(t, v.Reason, rules.Validate(txn).String(), "%s at %s", v.Name, v.Fork)
+	}
+}
+
+func TestPoolValidationRules(t *testing.T) {
+	_, coreDB := memdb.NewTestPoolDB(t), memdb.NewTestDB(t)
+	pool, err := New(make(chan types.Announcements, 1), coreDB, DefaultConfig, &kvcache.DummyCache{}, *uint256.NewInt(1), nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultRules(false), pool.validationRules())
+
+	cfg := forkConfig(t, "Istanbul")
+	cfg.BerlinBlock = big.NewInt(10)
+	pool.SetChainConfig(cfg)
+	pool.lastSeenBlock.Store(8)
+	accessListTx := &types.TxSlot{Type: types.AccessListTxType, Gas: 21000}
+	require.Equal(t, TxTypeNotSupported, pool.validationRules().Validate(accessListTx))
+	pool.lastSeenBlock.Store(9) // next block is Berlin
+	require.Equal(t, Success, pool.validationRules().Validate(accessListTx))
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright 2021 The Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package types
+
+import (
+	"github.com/holiman/uint256"
+)
+
+// Fee math shared by txpool ordering and RPC fee suggestions.
+// All functions are overflow-proof: results saturate at 2^256-1 instead of wrapping around.
+// Pre-London (no base fee) is expressed by baseFee == nil or zero, legacy transactions have feeCap == tip.
+
+const (
+	MinBlobGasPrice            = 1       // EIP-4844: MIN_BLOB_GASPRICE
+	BlobGasPriceUpdateFraction = 3338477 // EIP-4844: BLOB_GASPRICE_UPDATE_FRACTION
+)
+
+var maxU256 = new(uint256.Int).SetAllOne()
+
+// EffectiveTip - part of gas price which goes to block producer: min(tip, feeCap - baseFee).
+// Zero if feeCap < baseFee (transaction can't be included into block with such base fee).
+func EffectiveTip(feeCap, tip, baseFee *uint256.Int) (res uint256.Int) {
+	if baseFee == nil || baseFee.IsZero() {
+		if tip.Gt(feeCap) {
+			return *feeCap
+		}
+		return *tip
+	}
+	if _, underflow := res.SubOverflow(feeCap, baseFee); underflow {
+		return uint256.Int{}
+	}
+	if res.Gt(tip) {
+		res = *tip
+	}
+	return res
+}
+
+// EffectiveGasPrice - price per gas paid by sender: baseFee + EffectiveTip. Never above feeCap.
+// If feeCap < baseFee - returns feeCap (transaction can't be included).
+func EffectiveGasPrice(feeCap, tip, baseFee *uint256.Int) (res uint256.Int) {
+	res = EffectiveTip(feeCap, tip, baseFee)
+	if baseFee == nil {
+		return res
+	}
+	if feeCap.Lt(baseFee) {
+		return *feeCap
+	}
+	res.Add(&res, baseFee) // can't overflow: result <= feeCap
+	return res
+}
+
+// MaxGasCost - upper bound of what transaction can cost to sender: gas * feeCap + value. Saturates on overflow.
+func MaxGasCost(gas uint64, feeCap, value *uint256.Int) (res uint256.Int) {
+	res.SetUint64(gas)
+	if _, overflow := res.MulOverflow(&res, feeCap); overflow {
+		return *maxU256
+	}
+	return AddSaturating(&res, value)
+}
+
+// BumpedPrice - price increased by `percent`: price * (100 + percent) / 100. Saturates on overflow.
+// Used to check that replacement transaction pays enough more than replaced one.
+func BumpedPrice(price *uint256.Int, percent uint64) (res uint256.Int) {
+	if _, overflow := res.MulDivOverflow(price, uint256.NewInt(100+percent), uint256.NewInt(100)); overflow {
+		return *maxU256
+	}
+	return res
+}
+
+// AddSaturating - x + y, or 2^256-1 on overflow
+func AddSaturating(x, y *uint256.Int) (res uint256.Int) {
+	if _, overflow := res.AddOverflow(x, y); overflow {
+		return *maxU256
+	}
+	return res
+}
+
+// BlobGasPrice - EIP-4844 price of blob gas for given excess blob gas of parent block.
+func BlobGasPrice(excessBlobGas uint64) (res uint256.Int) {
+	return FakeExponential(uint256.NewInt(MinBlobGasPrice), uint256.NewInt(excessBlobGas), uint256.NewInt(BlobGasPriceUpdateFraction))
+}
+
+// BlobFee - blobGasUsed * blobGasPrice. Saturates on overflow.
+func BlobFee(blobGasUsed uint64, blobGasPrice *uint256.Int) (res uint256.Int) {
+	res.SetUint64(blobGasUsed)
+	if _, overflow := res.MulOverflow(&res, blobGasPrice); overflow {
+		return *maxU256
+	}
+	return res
+}
+
+// FakeExponential - approximates factor * e ** (numerator / denominator) using Taylor expansion (EIP-4844). Saturates on overflow.
+func FakeExponential(factor, numerator, denominator *uint256.Int) (res uint256.Int) {
+	var output, accum, tmp uint256.Int
+	if _, overflow := accum.MulOverflow(factor, denominator); overflow {
+		return *maxU256
+	}
+	for i := uint64(1); !accum.IsZero(); i++ {
+		var overflow bool
+		if _, overflow = output.AddOverflow(&output, &accum); overflow {
+			return *maxU256
+		}
+		if _, overflow = accum.MulOverflow(&accum, numerator); overflow {
+			return *maxU256
+		}
+		tmp.SetUint64(i)
+		if _, overflow = tmp.MulOverflow(&tmp, denominator); overflow {
+			return *maxU256
+		}
+		accum.Div(&accum, &tmp)
+	}
+	return *res.Div(&output, denominator)
+}
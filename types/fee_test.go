@@ -0,0 +1,86 @@
+/*
+   Copyright 2021 The Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package types
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEffectiveTip(t *testing.T) {
+	n := uint256.NewInt
+	tests := []struct {
+		feeCap, tip, baseFee *uint256.Int
+		tip2, price          uint64
+	}{
+		{n(100), n(10), n(50), 10, 60},  // tip fits
+		{n(100), n(10), n(95), 5, 100},  // tip limited by feeCap
+		{n(100), n(10), n(100), 0, 100}, // nothing left for tip
+		{n(100), n(10), n(101), 0, 100}, // can't be included
+		{n(100), n(100), nil, 100, 100}, // pre-London legacy
+		{n(100), n(100), n(0), 100, 100},
+		{n(50), n(100), nil, 50, 50}, // tip > feeCap
+	}
+	for i, tt := range tests {
+		tip := EffectiveTip(tt.feeCap, tt.tip, tt.baseFee)
+		assert.Equal(t, tt.tip2, tip.Uint64(), i)
+		price := EffectiveGasPrice(tt.feeCap, tt.tip, tt.baseFee)
+		assert.Equal(t, tt.price, price.Uint64(), i)
+	}
+}
+
+func TestFeeSaturation(t *testing.T) {
+	max := new(uint256.Int).SetAllOne()
+
+	cost := MaxGasCost(21_000, uint256.NewInt(10), uint256.NewInt(5))
+	assert.Equal(t, uint64(210_005), cost.Uint64())
+	cost = MaxGasCost(2, max, uint256.NewInt(0))
+	assert.True(t, cost.Eq(max))
+	cost = MaxGasCost(1, max, uint256.NewInt(1))
+	assert.True(t, cost.Eq(max))
+
+	bumped := BumpedPrice(uint256.NewInt(1000), 10)
+	assert.Equal(t, uint64(1100), bumped.Uint64())
+	bumped = BumpedPrice(max, 10)
+	assert.True(t, bumped.Eq(max))
+
+	sum := AddSaturating(max, uint256.NewInt(1))
+	assert.True(t, sum.Eq(max))
+
+	fee := BlobFee(2, max)
+	assert.True(t, fee.Eq(max))
+}
+
+func TestBlobGasPrice(t *testing.T) {
+	for _, tt := range []struct{ excess, price uint64 }{
+		{0, 1},
+		{2314057, 1},
+		{2314058, 2},
+		{10 * 1024 * 1024, 23},
+	} {
+		price := BlobGasPrice(tt.excess)
+		assert.Equal(t, tt.price, price.Uint64(), tt.excess)
+	}
+	res := FakeExponential(uint256.NewInt(1), uint256.NewInt(0), uint256.NewInt(1))
+	assert.Equal(t, uint64(1), res.Uint64())
+	res = FakeExponential(uint256.NewInt(38493), uint256.NewInt(0), uint256.NewInt(1000))
+	assert.Equal(t, uint64(38493), res.Uint64())
+	res = FakeExponential(uint256.NewInt(2), uint256.NewInt(5), uint256.NewInt(2))
+	assert.Equal(t, uint64(23), res.Uint64())
+}
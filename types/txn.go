@@ -97,6 +97,7 @@ type TxSlot struct {
 	IDHash         [32]byte // Transaction hash for the purposes of using it as a transaction Id
 	Traced         bool     // Whether transaction needs to be traced throughout transaction pool code and generate debug printing
 	Creation       bool     // Set to true if "To" field of the transaction is not set
+	To             [20]byte // Destination address, zero if Creation
 	Type           byte     // Transaction type
 	Size           uint32   // Size of the payload
 }
@@ -240,8 +241,12 @@ func (ctx *TxParseContext) ParseTransaction(payload []byte, pos int, slot *TxSlo
 		return 0, fmt.Errorf("%w: unexpected length of to field: %d", ErrParseTxn, dataLen)
 	}
 
-	// Only note if To field is empty or not
 	slot.Creation = dataLen == 0
+	if !slot.Creation {
+		copy(slot.To[:], payload[dataPos:dataPos+dataLen])
+	} else {
+		slot.To = [20]byte{}
+	}
 	p = dataPos + dataLen
 	// Next follows value
 	p, err = rlp.U256(payload, p, &slot.Value)